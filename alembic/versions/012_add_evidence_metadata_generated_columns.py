@@ -0,0 +1,47 @@
+"""Promote hot evidence metadata fields to indexed generated columns
+
+Revision ID: 012_add_evidence_metadata_generated_columns
+Revises: 011_add_calibration_certificates
+Create Date: 2026-10-16
+
+Evidence search filters on metadata->>'uploaded_by' and
+metadata->>'content_type' within a session. Expression filters on JSONB
+cannot use a plain index, so both fields become STORED generated columns
+with btree indexes on (session_id, <field>). Other metadata fields are still
+searched with JSONB operators.
+
+Adding a STORED generated column rewrites the evidence table; run during a
+maintenance window on large deployments.
+"""
+
+from alembic import op
+
+
+revision = '012_add_evidence_metadata_generated_columns'
+down_revision = '011_add_calibration_certificates'
+branch_labels = None
+depends_on = None
+
+PROMOTED_FIELDS = ('uploaded_by', 'content_type')
+
+
+def upgrade():
+    """Add generated columns and indexes for promoted metadata fields"""
+    for field in PROMOTED_FIELDS:
+        op.execute(
+            f"ALTER TABLE evidence ADD COLUMN IF NOT EXISTS {field} TEXT "
+            f"GENERATED ALWAYS AS (metadata->>'{field}') STORED"
+        )
+        op.create_index(
+            f'ix_evidence_session_{field}',
+            'evidence',
+            ['session_id', field],
+            if_not_exists=True,
+        )
+
+
+def downgrade():
+    """Drop the promoted metadata columns and their indexes"""
+    for field in PROMOTED_FIELDS:
+        op.drop_index(f'ix_evidence_session_{field}', table_name='evidence', if_exists=True)
+        op.execute(f"ALTER TABLE evidence DROP COLUMN IF EXISTS {field}")
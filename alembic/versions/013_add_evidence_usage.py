@@ -0,0 +1,36 @@
+"""Add evidence_usage counters for evidence quotas
+
+Revision ID: 013_add_evidence_usage
+Revises: 012_add_evidence_metadata_generated_columns
+Create Date: 2026-10-16
+
+The Go service enforces per-session and per-user evidence quotas against
+maintained counters instead of counting evidence rows on every upload.
+"""
+from alembic import op
+import sqlalchemy as sa
+
+# revision identifiers, used by Alembic.
+revision = '013_add_evidence_usage'
+down_revision = '012_add_evidence_metadata_generated_columns'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    """Create evidence_usage table"""
+    op.create_table('evidence_usage',
+        sa.Column('scope', sa.String(16), nullable=False,
+                 comment="'session' or 'user'"),
+        sa.Column('scope_id', sa.String(255), nullable=False),
+        sa.Column('evidence_count', sa.BigInteger(), nullable=False, server_default='0'),
+        sa.Column('total_bytes', sa.BigInteger(), nullable=False, server_default='0'),
+        sa.Column('updated_at', sa.DateTime(timezone=True), server_default=sa.func.now()),
+        sa.PrimaryKeyConstraint('scope', 'scope_id'),
+        comment='Maintained evidence usage counters for per-session and per-user quotas',
+    )
+
+
+def downgrade():
+    """Drop evidence_usage table"""
+    op.drop_table('evidence_usage')
@@ -0,0 +1,31 @@
+"""Add crdt_meta column to test_sessions
+
+Revision ID: 014_add_test_sessions_crdt_meta
+Revises: 013_add_evidence_usage
+Create Date: 2026-10-16
+
+Per-path CRDT merge metadata (timestamps, originating node) used for
+last-writer-wins resolution by the Go service.
+"""
+from alembic import op
+import sqlalchemy as sa
+from sqlalchemy.dialects.postgresql import JSONB
+
+# revision identifiers, used by Alembic.
+revision = '014_add_test_sessions_crdt_meta'
+down_revision = '013_add_evidence_usage'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    """Add crdt_meta to test_sessions"""
+    op.add_column('test_sessions',
+        sa.Column('crdt_meta', JSONB, nullable=True, server_default=sa.text("'{}'::jsonb"),
+                 comment="Per-path CRDT merge metadata for LWW resolution")
+    )
+
+
+def downgrade():
+    """Remove crdt_meta from test_sessions"""
+    op.drop_column('test_sessions', 'crdt_meta')
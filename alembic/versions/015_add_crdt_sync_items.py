@@ -0,0 +1,45 @@
+"""Add crdt_sync_items sync cursor table
+
+Revision ID: 015_add_crdt_sync_items
+Revises: 014_add_test_sessions_crdt_meta
+Create Date: 2026-10-16
+
+Records the items applied by resumable batch CRDT syncs so a retried batch
+skips items that were already applied.
+"""
+from alembic import op
+import sqlalchemy as sa
+from sqlalchemy.dialects.postgresql import UUID
+
+# revision identifiers, used by Alembic.
+revision = '015_add_crdt_sync_items'
+down_revision = '014_add_test_sessions_crdt_meta'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    """Create crdt_sync_items table"""
+    op.create_table('crdt_sync_items',
+        sa.Column('sync_key', sa.String(64), nullable=False,
+                 comment='SHA-256 of user, session and client sync ID'),
+        sa.Column('item_hash', sa.String(64), nullable=False,
+                 comment='SHA-256 of item position and content'),
+        sa.Column('sync_id', sa.String(255), nullable=False),
+        sa.Column('session_id', UUID(as_uuid=True),
+                 sa.ForeignKey('test_sessions.id', ondelete='CASCADE'), nullable=True),
+        sa.Column('user_id', sa.String(255), nullable=False),
+        sa.Column('item_index', sa.Integer(), nullable=False),
+        sa.Column('applied_at', sa.DateTime(timezone=True), server_default=sa.func.now()),
+        sa.PrimaryKeyConstraint('sync_key', 'item_hash'),
+        comment='Sync cursor: items applied by resumable batch CRDT syncs'
+    )
+
+    op.create_index('idx_crdt_sync_items_applied_at', 'crdt_sync_items', ['applied_at'],
+                    comment='For cleanup of old sync cursors')
+
+
+def downgrade():
+    """Drop crdt_sync_items table"""
+    op.drop_index('idx_crdt_sync_items_applied_at', table_name='crdt_sync_items')
+    op.drop_table('crdt_sync_items')
@@ -0,0 +1,36 @@
+"""Add evidence_pending_uploads table for the evidence spool
+
+Revision ID: 016_add_evidence_pending_uploads
+Revises: 015_add_crdt_sync_items
+Create Date: 2026-10-16
+
+Evidence accepted while the evidence store was unavailable is spooled to
+local disk and tracked here until the reconciler delivers it.
+"""
+from alembic import op
+import sqlalchemy as sa
+
+# revision identifiers, used by Alembic.
+revision = '016_add_evidence_pending_uploads'
+down_revision = '015_add_crdt_sync_items'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    """Create evidence_pending_uploads table"""
+    op.create_table('evidence_pending_uploads',
+        sa.Column('object_key', sa.String(255), primary_key=True,
+                 comment='Evidence store key (tenant-namespaced)'),
+        sa.Column('size_bytes', sa.BigInteger(), nullable=False),
+        sa.Column('attempts', sa.Integer(), nullable=False, server_default='0'),
+        sa.Column('last_error', sa.Text(), nullable=True),
+        sa.Column('last_attempt_at', sa.DateTime(timezone=True), nullable=True),
+        sa.Column('created_at', sa.DateTime(timezone=True), server_default=sa.func.now()),
+        comment='Evidence spooled locally while the evidence store was unavailable'
+    )
+
+
+def downgrade():
+    """Drop evidence_pending_uploads table"""
+    op.drop_table('evidence_pending_uploads')
@@ -0,0 +1,36 @@
+"""Add parent_evidence_id to evidence for derived artifacts
+
+Revision ID: 017_add_evidence_parent_id
+Revises: 016_add_evidence_pending_uploads
+Create Date: 2026-10-16
+
+Derived artifacts (e.g. thumbnails) link to the evidence they were generated
+from and are removed with it.
+"""
+from alembic import op
+import sqlalchemy as sa
+from sqlalchemy.dialects.postgresql import UUID
+
+# revision identifiers, used by Alembic.
+revision = '017_add_evidence_parent_id'
+down_revision = '016_add_evidence_pending_uploads'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    """Add parent_evidence_id to evidence"""
+    op.add_column('evidence',
+        sa.Column('parent_evidence_id', UUID(as_uuid=True),
+                 sa.ForeignKey('evidence.id', ondelete='CASCADE'),
+                 nullable=True,
+                 comment="Evidence this derived artifact was generated from")
+    )
+
+    op.create_index('idx_evidence_parent_id', 'evidence', ['parent_evidence_id'])
+
+
+def downgrade():
+    """Remove parent_evidence_id from evidence"""
+    op.drop_index('idx_evidence_parent_id', table_name='evidence')
+    op.drop_column('evidence', 'parent_evidence_id')
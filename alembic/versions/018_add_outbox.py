@@ -0,0 +1,48 @@
+"""Add transactional outbox table
+
+Revision ID: 018_add_outbox
+Revises: 017_add_evidence_parent_id
+Create Date: 2026-10-16
+
+Webhook events are written to the outbox in the same transaction as the
+evidence or CRDT change and relayed at least once by the Go service's
+background relay, which polls this table unconditionally at startup.
+"""
+from alembic import op
+import sqlalchemy as sa
+from sqlalchemy.dialects.postgresql import JSONB
+
+# revision identifiers, used by Alembic.
+revision = '018_add_outbox'
+down_revision = '017_add_evidence_parent_id'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    """Create outbox table"""
+    op.create_table('outbox',
+        sa.Column('id', sa.BigInteger(), primary_key=True, autoincrement=True),
+        sa.Column('event_type', sa.String(100), nullable=False),
+        sa.Column('destination', sa.Text(), nullable=False),
+        sa.Column('payload', JSONB, nullable=False),
+        sa.Column('dedup_key', sa.String(255), nullable=True, unique=True,
+                 comment='Set for side effects enqueued at most once per idempotency key'),
+        sa.Column('attempts', sa.Integer(), nullable=False, server_default='0'),
+        sa.Column('last_error', sa.Text(), nullable=True),
+        sa.Column('next_attempt_at', sa.DateTime(timezone=True), server_default=sa.func.now()),
+        sa.Column('delivered_at', sa.DateTime(timezone=True), nullable=True),
+        sa.Column('failed_at', sa.DateTime(timezone=True), nullable=True,
+                 comment='Gave up after OUTBOX_MAX_ATTEMPTS'),
+        sa.Column('created_at', sa.DateTime(timezone=True), server_default=sa.func.now()),
+        comment='Transactional outbox relayed to webhooks at least once'
+    )
+
+    op.create_index('idx_outbox_pending', 'outbox', ['next_attempt_at'],
+                    postgresql_where=sa.text('delivered_at IS NULL AND failed_at IS NULL'))
+
+
+def downgrade():
+    """Drop outbox table"""
+    op.drop_index('idx_outbox_pending', table_name='outbox')
+    op.drop_table('outbox')
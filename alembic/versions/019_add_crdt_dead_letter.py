@@ -0,0 +1,46 @@
+"""Add crdt_dead_letter table
+
+Revision ID: 019_add_crdt_dead_letter
+Revises: 018_add_outbox
+Create Date: 2026-10-16
+
+CRDT payloads rejected with non-retriable errors are kept for operator
+inspection and replay.
+"""
+from alembic import op
+import sqlalchemy as sa
+from sqlalchemy.dialects.postgresql import UUID, JSONB
+
+# revision identifiers, used by Alembic.
+revision = '019_add_crdt_dead_letter'
+down_revision = '018_add_outbox'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    """Create crdt_dead_letter table"""
+    op.execute('CREATE EXTENSION IF NOT EXISTS "uuid-ossp";')
+
+    op.create_table('crdt_dead_letter',
+        sa.Column('id', UUID(as_uuid=True), primary_key=True,
+                 server_default=sa.text('uuid_generate_v4()')),
+        sa.Column('session_id', sa.String(255), nullable=False),
+        sa.Column('user_id', sa.String(255), nullable=False),
+        sa.Column('endpoint', sa.String(500), nullable=False),
+        sa.Column('payload', JSONB, nullable=False),
+        sa.Column('status_code', sa.Integer(), nullable=False),
+        sa.Column('error', sa.Text(), nullable=False),
+        sa.Column('created_at', sa.DateTime(timezone=True), server_default=sa.func.now()),
+        sa.Column('replayed_at', sa.DateTime(timezone=True), nullable=True),
+        sa.Column('replay_error', sa.Text(), nullable=True),
+        comment='CRDT payloads rejected with non-retriable errors, kept for replay'
+    )
+
+    op.create_index('idx_crdt_dead_letter_session', 'crdt_dead_letter', ['session_id', 'created_at'])
+
+
+def downgrade():
+    """Drop crdt_dead_letter table"""
+    op.drop_index('idx_crdt_dead_letter_session', table_name='crdt_dead_letter')
+    op.drop_table('crdt_dead_letter')
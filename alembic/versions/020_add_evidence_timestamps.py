@@ -0,0 +1,46 @@
+"""Add evidence_timestamps table for RFC 3161 timestamp tokens
+
+Revision ID: 020_add_evidence_timestamps
+Revises: 019_add_crdt_dead_letter
+Create Date: 2026-10-16
+
+Timestamp tokens over evidence checksums are requested from the TSA after
+upload and retried by a background relay while pending.
+"""
+from alembic import op
+import sqlalchemy as sa
+from sqlalchemy.dialects.postgresql import UUID
+
+# revision identifiers, used by Alembic.
+revision = '020_add_evidence_timestamps'
+down_revision = '019_add_crdt_dead_letter'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    """Create evidence_timestamps table"""
+    op.create_table('evidence_timestamps',
+        sa.Column('evidence_id', UUID(as_uuid=True),
+                 sa.ForeignKey('evidence.id', ondelete='CASCADE'), primary_key=True),
+        sa.Column('checksum', sa.String(64), nullable=False),
+        sa.Column('status', sa.String(16), nullable=False,
+                 comment="'pending', 'granted' or 'failed'"),
+        sa.Column('token', sa.LargeBinary(), nullable=True,
+                 comment='DER-encoded TimeStampToken'),
+        sa.Column('gen_time', sa.DateTime(timezone=True), nullable=True),
+        sa.Column('attempts', sa.Integer(), nullable=False, server_default='0'),
+        sa.Column('last_error', sa.Text(), nullable=True),
+        sa.Column('next_attempt_at', sa.DateTime(timezone=True), server_default=sa.func.now()),
+        sa.Column('created_at', sa.DateTime(timezone=True), server_default=sa.func.now()),
+        comment='RFC 3161 timestamp tokens over evidence checksums'
+    )
+
+    op.create_index('idx_evidence_timestamps_pending', 'evidence_timestamps', ['next_attempt_at'],
+                    postgresql_where=sa.text("status = 'pending'"))
+
+
+def downgrade():
+    """Drop evidence_timestamps table"""
+    op.drop_index('idx_evidence_timestamps_pending', table_name='evidence_timestamps')
+    op.drop_table('evidence_timestamps')
@@ -0,0 +1,30 @@
+"""Add merge_strategy column to test_sessions
+
+Revision ID: 021_add_test_sessions_merge_strategy
+Revises: 020_add_evidence_timestamps
+Create Date: 2026-10-16
+
+Per-session CRDT merge strategy ('overwrite' or 'lww') chosen at creation.
+NULL falls back to the service-wide MERGE_STRATEGY.
+"""
+from alembic import op
+import sqlalchemy as sa
+
+# revision identifiers, used by Alembic.
+revision = '021_add_test_sessions_merge_strategy'
+down_revision = '020_add_evidence_timestamps'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    """Add merge_strategy to test_sessions"""
+    op.add_column('test_sessions',
+        sa.Column('merge_strategy', sa.String(32), nullable=True,
+                 comment="CRDT merge strategy: 'overwrite' or 'lww'; NULL uses MERGE_STRATEGY")
+    )
+
+
+def downgrade():
+    """Remove merge_strategy from test_sessions"""
+    op.drop_column('test_sessions', 'merge_strategy')
@@ -0,0 +1,30 @@
+"""Add hybrid logical clock column to test_sessions
+
+Revision ID: 022_add_test_sessions_hlc
+Revises: 021_add_test_sessions_merge_strategy
+Create Date: 2026-10-16
+
+Holds the hybrid logical clock of the last CRDT merge (ms << 16 | logical
+counter). Each merged change is stamped with the next value.
+"""
+from alembic import op
+import sqlalchemy as sa
+
+# revision identifiers, used by Alembic.
+revision = '022_add_test_sessions_hlc'
+down_revision = '021_add_test_sessions_merge_strategy'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    """Add hlc to test_sessions"""
+    op.add_column('test_sessions',
+        sa.Column('hlc', sa.BigInteger(), nullable=True, server_default='0',
+                 comment="Hybrid logical clock of the last CRDT merge")
+    )
+
+
+def downgrade():
+    """Remove hlc from test_sessions"""
+    op.drop_column('test_sessions', 'hlc')
@@ -0,0 +1,30 @@
+"""Add captured_at to evidence
+
+Revision ID: 023_add_evidence_captured_at
+Revises: 022_add_test_sessions_hlc
+Create Date: 2026-10-16
+
+Client-asserted capture time of evidence collected offline, distinct from
+created_at (server receipt time).
+"""
+from alembic import op
+import sqlalchemy as sa
+
+# revision identifiers, used by Alembic.
+revision = '023_add_evidence_captured_at'
+down_revision = '022_add_test_sessions_hlc'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    """Add captured_at to evidence"""
+    op.add_column('evidence',
+        sa.Column('captured_at', sa.DateTime(timezone=True), nullable=True,
+                 comment="Client-asserted capture time")
+    )
+
+
+def downgrade():
+    """Remove captured_at from evidence"""
+    op.drop_column('evidence', 'captured_at')
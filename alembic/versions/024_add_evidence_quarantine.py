@@ -0,0 +1,42 @@
+"""Add evidence_quarantine table
+
+Revision ID: 024_add_evidence_quarantine
+Revises: 023_add_evidence_captured_at
+Create Date: 2026-10-16
+
+Uploads failing hash verification are kept for tamper investigation when
+HASH_MISMATCH_POLICY=quarantine. Session and user are stored as submitted
+because the session may not exist.
+"""
+from alembic import op
+import sqlalchemy as sa
+from sqlalchemy.dialects.postgresql import UUID
+
+# revision identifiers, used by Alembic.
+revision = '024_add_evidence_quarantine'
+down_revision = '023_add_evidence_captured_at'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    """Create evidence_quarantine table"""
+    op.create_table('evidence_quarantine',
+        sa.Column('id', UUID(as_uuid=True), primary_key=True),
+        sa.Column('object_key', sa.String(255), nullable=False,
+                 comment='Quarantine store key (tenant-namespaced)'),
+        sa.Column('session_id', sa.Text(), nullable=True),
+        sa.Column('user_id', sa.Text(), nullable=True),
+        sa.Column('evidence_type', sa.String(100), nullable=True),
+        sa.Column('filename', sa.Text(), nullable=True),
+        sa.Column('declared_hash', sa.Text(), nullable=False),
+        sa.Column('actual_hash', sa.String(64), nullable=False),
+        sa.Column('size_bytes', sa.BigInteger(), nullable=False),
+        sa.Column('created_at', sa.DateTime(timezone=True), server_default=sa.func.now()),
+        comment='Uploads that failed hash verification'
+    )
+
+
+def downgrade():
+    """Drop evidence_quarantine table"""
+    op.drop_table('evidence_quarantine')
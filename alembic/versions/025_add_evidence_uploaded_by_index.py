@@ -0,0 +1,27 @@
+"""Index evidence by uploader for per-user quota seeding
+
+Revision ID: 025_add_evidence_uploaded_by_index
+Revises: 024_add_evidence_quarantine
+Create Date: 2026-10-16
+
+Per-user evidence quotas seed their evidence_usage counter by counting the
+user's evidence. The (session_id, uploaded_by) index from 012 cannot serve a
+filter on uploaded_by alone, so add an index leading on it.
+"""
+from alembic import op
+
+# revision identifiers, used by Alembic.
+revision = '025_add_evidence_uploaded_by_index'
+down_revision = '024_add_evidence_quarantine'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    """Create ix_evidence_uploaded_by"""
+    op.create_index('ix_evidence_uploaded_by', 'evidence', ['uploaded_by'], if_not_exists=True)
+
+
+def downgrade():
+    """Drop ix_evidence_uploaded_by"""
+    op.drop_index('ix_evidence_uploaded_by', table_name='evidence', if_exists=True)
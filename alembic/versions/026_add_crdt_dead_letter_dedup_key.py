@@ -0,0 +1,35 @@
+"""Deduplicate CRDT dead letters per request
+
+Revision ID: 026_add_crdt_dead_letter_dedup_key
+Revises: 025_add_evidence_uploaded_by_index
+Create Date: 2026-10-16
+
+A client retrying a rejected CRDT payload under the same idempotency key (or
+sync cursor) used to add a dead letter per attempt. dedup_key identifies the
+request, and a partial unique index lets the insert skip repeats while rows
+without a key keep being recorded individually.
+"""
+from alembic import op
+import sqlalchemy as sa
+
+# revision identifiers, used by Alembic.
+revision = '026_add_crdt_dead_letter_dedup_key'
+down_revision = '025_add_evidence_uploaded_by_index'
+branch_labels = None
+depends_on = None
+
+
+def upgrade():
+    """Add dedup_key to crdt_dead_letter"""
+    op.add_column('crdt_dead_letter',
+        sa.Column('dedup_key', sa.String(64), nullable=True,
+                 comment="SHA-256 of the request's idempotency key or sync cursor and content")
+    )
+    op.create_index('ux_crdt_dead_letter_dedup_key', 'crdt_dead_letter', ['dedup_key'], unique=True,
+                    postgresql_where=sa.text('dedup_key IS NOT NULL'))
+
+
+def downgrade():
+    """Remove dedup_key from crdt_dead_letter"""
+    op.drop_index('ux_crdt_dead_letter_dedup_key', table_name='crdt_dead_letter')
+    op.drop_column('crdt_dead_letter', 'dedup_key')
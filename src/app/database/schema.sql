@@ -100,6 +100,125 @@ CREATE TABLE IF NOT EXISTS audit_log (
     created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
 );
 
+-- Soft-delete flag columns (mirrors alembic 002_add_evidence_flag_columns)
+ALTER TABLE evidence ADD COLUMN IF NOT EXISTS flagged_for_review BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE evidence ADD COLUMN IF NOT EXISTS flag_reason TEXT;
+ALTER TABLE evidence ADD COLUMN IF NOT EXISTS flagged_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE evidence ADD COLUMN IF NOT EXISTS flagged_by UUID REFERENCES users(id) ON DELETE SET NULL;
+
+-- Derived artifacts (e.g. thumbnails) link to the evidence they were generated from
+ALTER TABLE evidence ADD COLUMN IF NOT EXISTS parent_evidence_id UUID REFERENCES evidence(id) ON DELETE CASCADE;
+
+-- Per-path CRDT merge metadata (timestamps, originating node) for LWW resolution
+ALTER TABLE test_sessions ADD COLUMN IF NOT EXISTS crdt_meta JSONB DEFAULT '{}';
+
+-- Per-session CRDT merge strategy ('overwrite' or 'lww'), set at creation; NULL uses MERGE_STRATEGY
+ALTER TABLE test_sessions ADD COLUMN IF NOT EXISTS merge_strategy VARCHAR(32);
+
+-- Hybrid logical clock of the last CRDT merge (ms << 16 | logical counter), stamped on each change's crdt_meta
+ALTER TABLE test_sessions ADD COLUMN IF NOT EXISTS hlc BIGINT DEFAULT 0;
+
+-- Client-asserted capture time of evidence collected offline, distinct from created_at (server receipt)
+ALTER TABLE evidence ADD COLUMN IF NOT EXISTS captured_at TIMESTAMP WITH TIME ZONE;
+
+-- Hot metadata fields promoted to indexed generated columns for evidence search (alembic 012)
+ALTER TABLE evidence ADD COLUMN IF NOT EXISTS uploaded_by TEXT GENERATED ALWAYS AS (metadata->>'uploaded_by') STORED;
+ALTER TABLE evidence ADD COLUMN IF NOT EXISTS content_type TEXT GENERATED ALWAYS AS (metadata->>'content_type') STORED;
+CREATE INDEX IF NOT EXISTS ix_evidence_session_uploaded_by ON evidence (session_id, uploaded_by);
+CREATE INDEX IF NOT EXISTS ix_evidence_session_content_type ON evidence (session_id, content_type);
+-- Per-user quota seeding filters on uploader alone (alembic 025)
+CREATE INDEX IF NOT EXISTS ix_evidence_uploaded_by ON evidence (uploaded_by);
+
+-- Maintained evidence usage counters for per-session and per-user quotas
+CREATE TABLE IF NOT EXISTS evidence_usage (
+    scope VARCHAR(16) NOT NULL, -- 'session' or 'user'
+    scope_id VARCHAR(255) NOT NULL,
+    evidence_count BIGINT NOT NULL DEFAULT 0,
+    total_bytes BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (scope, scope_id)
+);
+
+-- Sync cursor: items applied by resumable batch CRDT syncs
+CREATE TABLE IF NOT EXISTS crdt_sync_items (
+    sync_key VARCHAR(64) NOT NULL, -- SHA-256 of user, session and client sync ID
+    item_hash VARCHAR(64) NOT NULL, -- SHA-256 of item position and content
+    sync_id VARCHAR(255) NOT NULL,
+    session_id UUID REFERENCES test_sessions(id) ON DELETE CASCADE,
+    user_id VARCHAR(255) NOT NULL,
+    item_index INTEGER NOT NULL,
+    applied_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (sync_key, item_hash)
+);
+
+-- Evidence spooled locally while the evidence store was unavailable, awaiting delivery
+CREATE TABLE IF NOT EXISTS evidence_pending_uploads (
+    object_key VARCHAR(255) PRIMARY KEY, -- evidence store key (tenant-namespaced)
+    size_bytes BIGINT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    last_attempt_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Uploads that failed hash verification, kept for tamper investigation under HASH_MISMATCH_POLICY=quarantine
+CREATE TABLE IF NOT EXISTS evidence_quarantine (
+    id UUID PRIMARY KEY,
+    object_key VARCHAR(255) NOT NULL, -- quarantine store key (tenant-namespaced)
+    session_id TEXT, -- as submitted; the session may not exist
+    user_id TEXT,
+    evidence_type VARCHAR(100),
+    filename TEXT,
+    declared_hash TEXT NOT NULL,
+    actual_hash VARCHAR(64) NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- CRDT payloads rejected with non-retriable errors, kept for operator replay
+CREATE TABLE IF NOT EXISTS crdt_dead_letter (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    session_id VARCHAR(255) NOT NULL,
+    user_id VARCHAR(255) NOT NULL,
+    endpoint VARCHAR(500) NOT NULL,
+    payload JSONB NOT NULL,
+    status_code INTEGER NOT NULL,
+    error TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    replayed_at TIMESTAMP WITH TIME ZONE,
+    replay_error TEXT,
+    dedup_key VARCHAR(64) -- SHA-256 of the request's idempotency key or sync cursor and content
+);
+
+-- RFC 3161 timestamp tokens over evidence checksums, requested after upload
+CREATE TABLE IF NOT EXISTS evidence_timestamps (
+    evidence_id UUID PRIMARY KEY REFERENCES evidence(id) ON DELETE CASCADE,
+    checksum VARCHAR(64) NOT NULL,
+    status VARCHAR(16) NOT NULL, -- 'pending', 'granted' or 'failed'
+    token BYTEA, -- DER-encoded TimeStampToken
+    gen_time TIMESTAMP WITH TIME ZONE,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Transactional outbox: events written with the evidence/CRDT change and relayed
+-- to webhooks at least once
+CREATE TABLE IF NOT EXISTS outbox (
+    id BIGSERIAL PRIMARY KEY,
+    event_type VARCHAR(100) NOT NULL,
+    destination TEXT NOT NULL,
+    payload JSONB NOT NULL,
+    dedup_key VARCHAR(255) UNIQUE, -- set for side effects enqueued at most once per idempotency key
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    delivered_at TIMESTAMP WITH TIME ZONE,
+    failed_at TIMESTAMP WITH TIME ZONE, -- gave up after OUTBOX_MAX_ATTEMPTS
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
 -- Create updated_at trigger function
 CREATE OR REPLACE FUNCTION update_updated_at_column()
 RETURNS TRIGGER AS $$
@@ -137,6 +256,7 @@ END$$;
 CREATE INDEX IF NOT EXISTS idx_test_sessions_vector_clock ON test_sessions USING GIN (vector_clock);
 CREATE INDEX IF NOT EXISTS idx_evidence_session_id ON evidence(session_id);
 CREATE INDEX IF NOT EXISTS idx_evidence_checksum ON evidence(checksum);
+CREATE INDEX IF NOT EXISTS idx_evidence_parent_id ON evidence(parent_evidence_id);
 CREATE INDEX IF NOT EXISTS idx_as1851_rules_code ON as1851_rules(rule_code);
 CREATE INDEX IF NOT EXISTS idx_as1851_rules_schema ON as1851_rules USING GIN (rule_schema);
 CREATE INDEX IF NOT EXISTS idx_token_revocation_jti ON token_revocation_list(token_jti);
@@ -147,6 +267,11 @@ CREATE INDEX IF NOT EXISTS idx_audit_log_user_id ON audit_log(user_id);
 CREATE INDEX IF NOT EXISTS idx_audit_log_action ON audit_log(action);
 CREATE INDEX IF NOT EXISTS idx_audit_log_created_at ON audit_log(created_at);
 CREATE INDEX IF NOT EXISTS idx_audit_log_resource ON audit_log(resource_type, resource_id);
+CREATE INDEX IF NOT EXISTS idx_crdt_sync_items_applied_at ON crdt_sync_items(applied_at);
+CREATE INDEX IF NOT EXISTS idx_crdt_dead_letter_session ON crdt_dead_letter(session_id, created_at);
+CREATE UNIQUE INDEX IF NOT EXISTS ux_crdt_dead_letter_dedup_key ON crdt_dead_letter(dedup_key) WHERE dedup_key IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_evidence_timestamps_pending ON evidence_timestamps(next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS idx_outbox_pending ON outbox(next_attempt_at) WHERE delivered_at IS NULL AND failed_at IS NULL;
 
 -- Cleanup function for expired records
 CREATE OR REPLACE FUNCTION cleanup_expired_records()
@@ -157,5 +282,11 @@ BEGIN
     
     -- Clean up expired idempotency keys
     DELETE FROM idempotency_keys WHERE expires_at < CURRENT_TIMESTAMP;
+    
+    -- Clean up sync cursors older than a week
+    DELETE FROM crdt_sync_items WHERE applied_at < CURRENT_TIMESTAMP - INTERVAL '7 days';
+    
+    -- Clean up outbox events delivered more than a week ago
+    DELETE FROM outbox WHERE delivered_at < CURRENT_TIMESTAMP - INTERVAL '7 days';
 END;
 $$ LANGUAGE plpgsql;
\ No newline at end of file
@@ -0,0 +1,47 @@
+package main
+
+import (
+        "fmt"
+        "net/http"
+)
+
+// Report whether token claims grant a role, via a "role" string or "roles" list
+func hasRole(claims map[string]interface{}, role string) bool {
+        if r, ok := claims["role"].(string); ok && r == role {
+                return true
+        }
+        if roles, ok := claims["roles"].([]interface{}); ok {
+                for _, r := range roles {
+                        if s, ok := r.(string); ok && s == role {
+                                return true
+                        }
+                }
+        }
+        return false
+}
+
+// Check that X-User-ID names the token's subject, so a caller cannot act as
+// another user. Tokens without a sub claim, or carrying SERVICE_ACCOUNT_ROLE,
+// may act on behalf of any user.
+func checkActingUser(r *http.Request, claims map[string]interface{}) error {
+        userID := r.Header.Get("X-User-ID")
+        if !cfg.VerifyUserIDSubject || userID == "" {
+                return nil
+        }
+        subject, _ := claims["sub"].(string)
+        if subject == "" || subject == userID || (cfg.ServiceAccountRole != "" && hasRole(claims, cfg.ServiceAccountRole)) {
+                return nil
+        }
+        return fmt.Errorf("X-User-ID does not match the authenticated user")
+}
+
+// Restrict a handler to tokens carrying ADMIN_ROLE. Must be wrapped by validateInternalJWT.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+                if !hasRole(claimsFromContext(r.Context()), cfg.AdminRole) {
+                        http.Error(w, "Forbidden", http.StatusForbidden)
+                        return
+                }
+                next(w, r)
+        }
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+        "net/http"
+        "net/http/httptest"
+        "testing"
+
+        "github.com/golang-jwt/jwt/v5"
+)
+
+// Sign an internal token with the test secret, adding the expected audience and issuer
+func internalToken(t *testing.T, claims jwt.MapClaims) string {
+        t.Helper()
+        t.Setenv("INTERNAL_JWT_SECRET_KEY", "internal-test-secret")
+        claims["aud"] = "go-service"
+        claims["iss"] = "fastapi"
+        token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("internal-test-secret"))
+        if err != nil {
+                t.Fatal(err)
+        }
+        return token
+}
+
+func TestCheckActingUser(t *testing.T) {
+        tests := []struct {
+                name    string
+                verify  bool
+                userID  string
+                claims  map[string]interface{}
+                wantErr bool
+        }{
+                {"matching subject", true, "inspector-8", map[string]interface{}{"sub": "inspector-8"}, false},
+                {"mismatched subject", true, "inspector-9", map[string]interface{}{"sub": "inspector-8"}, true},
+                {"service role", true, "inspector-9", map[string]interface{}{"sub": "sync-worker", "role": "service"}, false},
+                {"service in roles", true, "inspector-9", map[string]interface{}{"sub": "sync-worker", "roles": []interface{}{"reader", "service"}}, false},
+                {"other role", true, "inspector-9", map[string]interface{}{"sub": "sync-worker", "role": "admin"}, true},
+                {"no subject", true, "inspector-9", map[string]interface{}{}, false},
+                {"no user header", true, "", map[string]interface{}{"sub": "inspector-8"}, false},
+                {"disabled", false, "inspector-9", map[string]interface{}{"sub": "inspector-8"}, false},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        withConfig(t, func(c *Config) {
+                                c.VerifyUserIDSubject = tt.verify
+                                c.ServiceAccountRole = "service"
+                        })
+                        r := httptest.NewRequest(http.MethodPost, "/v1/evidence", nil)
+                        if tt.userID != "" {
+                                r.Header.Set("X-User-ID", tt.userID)
+                        }
+                        if err := checkActingUser(r, tt.claims); (err != nil) != tt.wantErr {
+                                t.Errorf("err = %v, want error %v", err, tt.wantErr)
+                        }
+                })
+        }
+}
+
+func TestInternalJWTRejectsImpersonation(t *testing.T) {
+        withConfig(t, func(c *Config) {
+                c.VerifyUserIDSubject = true
+                c.ServiceAccountRole = "sync-service"
+                c.RequireScopes = false
+        })
+        tests := []struct {
+                name   string
+                claims jwt.MapClaims
+                want   int
+        }{
+                {"own user", jwt.MapClaims{"sub": "inspector-14"}, http.StatusOK},
+                {"another user", jwt.MapClaims{"sub": "inspector-15"}, http.StatusForbidden},
+                {"service account", jwt.MapClaims{"sub": "offline-sync", "roles": []interface{}{"sync-service"}}, http.StatusOK},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        reached := false
+                        handler := validateInternalJWT(func(w http.ResponseWriter, r *http.Request) { reached = true })
+                        r := httptest.NewRequest(http.MethodPost, "/v1/tests/sessions/abc/results", nil)
+                        r.Header.Set("X-Internal-Authorization", internalToken(t, tt.claims))
+                        r.Header.Set("X-User-ID", "inspector-14")
+                        w := httptest.NewRecorder()
+                        handler(w, r)
+                        if w.Code != tt.want || reached != (tt.want == http.StatusOK) {
+                                t.Errorf("status = %d (handler reached %v), want %d", w.Code, reached, tt.want)
+                        }
+                })
+        }
+}
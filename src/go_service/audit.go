@@ -0,0 +1,230 @@
+package main
+
+import (
+        "context"
+        "encoding/base64"
+        "encoding/json"
+        "fmt"
+        "log"
+        "net/http"
+        "strconv"
+        "strings"
+        "time"
+
+        "github.com/google/uuid"
+        "github.com/jackc/pgx/v5"
+)
+
+// Audit actions recorded by the service
+const (
+        auditActionEvidenceUpload = "evidence.upload"
+)
+
+// Record an audit entry within tx. The acting user is linked when it is a known
+// user ID and always kept in new_values.
+func writeAuditLog(ctx context.Context, tx pgx.Tx, userID, action, resourceType, resourceID string, values map[string]interface{}) error {
+        item := auditLogItem(userID, action, resourceType, resourceID, values)
+        _, err := tx.Exec(ctx, item.SQL, item.Args...)
+        return err
+}
+
+// The statement writeAuditLog runs, for callers pipelining it with other writes
+func auditLogItem(userID, action, resourceType, resourceID string, values map[string]interface{}) BatchItem {
+        if values == nil {
+                values = make(map[string]interface{})
+        }
+        values["user_id"] = userID
+        valuesJSON, _ := json.Marshal(values)
+
+        return BatchItem{
+                SQL: `
+                        INSERT INTO audit_log (user_id, action, resource_type, resource_id, new_values)
+                        VALUES ((SELECT id FROM users WHERE id::text = $1), $2, $3, $4, $5)
+                `,
+                Args: []interface{}{userID, action, resourceType, resourceID, string(valuesJSON)},
+        }
+}
+
+// Audit log entry as returned by the audit API
+type AuditEntry struct {
+        ID           string                 `json:"id"`
+        UserID       *string                `json:"user_id,omitempty"`
+        Action       string                 `json:"action"`
+        ResourceType string                 `json:"resource_type"`
+        ResourceID   *string                `json:"resource_id,omitempty"`
+        OldValues    map[string]interface{} `json:"old_values,omitempty"`
+        NewValues    map[string]interface{} `json:"new_values,omitempty"`
+        IPAddress    *string                `json:"ip_address,omitempty"`
+        UserAgent    *string                `json:"user_agent,omitempty"`
+        CreatedAt    time.Time              `json:"created_at"`
+}
+
+// Page of audit entries with the cursor for the next page, if any
+type AuditPage struct {
+        Entries    []AuditEntry `json:"entries"`
+        NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+// Replacement for values named in AUDIT_REDACT_FIELDS
+const auditRedacted = "[REDACTED]"
+
+// Page size bounds for the audit API
+const (
+        defaultAuditPageSize = 50
+        maxAuditPageSize     = 500
+)
+
+// Encode a keyset cursor from the last entry of a page
+func encodeAuditCursor(entry AuditEntry) string {
+        return base64.RawURLEncoding.EncodeToString([]byte(entry.CreatedAt.Format(time.RFC3339Nano) + "|" + entry.ID))
+}
+
+// Decode a keyset cursor into its (created_at, id) position
+func decodeAuditCursor(cursor string) (time.Time, string, error) {
+        raw, err := base64.RawURLEncoding.DecodeString(cursor)
+        if err != nil {
+                return time.Time{}, "", err
+        }
+        ts, id, ok := strings.Cut(string(raw), "|")
+        if !ok {
+                return time.Time{}, "", fmt.Errorf("malformed cursor")
+        }
+        createdAt, err := time.Parse(time.RFC3339Nano, ts)
+        if err != nil {
+                return time.Time{}, "", err
+        }
+        if _, err := uuid.Parse(id); err != nil {
+                return time.Time{}, "", err
+        }
+        return createdAt, id, nil
+}
+
+// Replace configured fields in audit values, at any depth, with a redaction marker
+func redactAuditValues(values map[string]interface{}, fields map[string]bool) {
+        for key, value := range values {
+                if fields[key] {
+                        values[key] = auditRedacted
+                        continue
+                }
+                if nested, ok := value.(map[string]interface{}); ok {
+                        redactAuditValues(nested, fields)
+                }
+        }
+}
+
+// List audit entries newest first with keyset pagination. Filters: user_id,
+// session_id, from and to (RFC 3339), plus limit and cursor. Admin only.
+func handleListAudit(w http.ResponseWriter, r *http.Request) {
+        q := r.URL.Query()
+
+        var conditions []string
+        var args []interface{}
+        addCondition := func(sql string, arg interface{}) {
+                args = append(args, arg)
+                conditions = append(conditions, fmt.Sprintf(sql, len(args)))
+        }
+
+        if userID := q.Get("user_id"); userID != "" {
+                addCondition("(user_id::text = $%[1]d OR new_values->>'user_id' = $%[1]d)", userID)
+        }
+        if sessionID := q.Get("session_id"); sessionID != "" {
+                addCondition("new_values->>'session_id' = $%d", sessionID)
+        }
+        for _, bound := range []struct{ param, sql string }{{"from", "created_at >= $%d"}, {"to", "created_at < $%d"}} {
+                if raw := q.Get(bound.param); raw != "" {
+                        t, err := time.Parse(time.RFC3339, raw)
+                        if err != nil {
+                                http.Error(w, fmt.Sprintf("Invalid %s parameter", bound.param), http.StatusBadRequest)
+                                return
+                        }
+                        addCondition(bound.sql, t)
+                }
+        }
+        if cursor := q.Get("cursor"); cursor != "" {
+                createdAt, id, err := decodeAuditCursor(cursor)
+                if err != nil {
+                        http.Error(w, "Invalid cursor", http.StatusBadRequest)
+                        return
+                }
+                args = append(args, createdAt, id)
+                conditions = append(conditions, fmt.Sprintf("(created_at, id) < ($%d, $%d)", len(args)-1, len(args)))
+        }
+
+        limit := defaultAuditPageSize
+        if raw := q.Get("limit"); raw != "" {
+                parsed, err := strconv.Atoi(raw)
+                if err != nil || parsed < 1 {
+                        http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+                        return
+                }
+                limit = min(parsed, maxAuditPageSize)
+        }
+
+        where := ""
+        if len(conditions) > 0 {
+                where = "WHERE " + strings.Join(conditions, " AND ")
+        }
+        // Fetch one extra row to learn whether another page follows
+        query := fmt.Sprintf(`
+                SELECT id::text, user_id::text, action, resource_type, resource_id::text,
+                       COALESCE(old_values, 'null'), COALESCE(new_values, 'null'), host(ip_address), user_agent, created_at
+                FROM audit_log
+                %s
+                ORDER BY created_at DESC, id DESC
+                LIMIT %d
+        `, where, limit+1)
+
+        ctx := r.Context()
+        var entries []AuditEntry
+        err := timeQuery("list_audit_log", func() error {
+                rows, err := dbFor(ctx).Query(ctx, query, args...)
+                if err != nil {
+                        return err
+                }
+                defer rows.Close()
+
+                for rows.Next() {
+                        var entry AuditEntry
+                        var oldValuesJSON, newValuesJSON string
+                        if err := rows.Scan(&entry.ID, &entry.UserID, &entry.Action, &entry.ResourceType, &entry.ResourceID,
+                                &oldValuesJSON, &newValuesJSON, &entry.IPAddress, &entry.UserAgent, &entry.CreatedAt); err != nil {
+                                return err
+                        }
+                        json.Unmarshal([]byte(oldValuesJSON), &entry.OldValues)
+                        json.Unmarshal([]byte(newValuesJSON), &entry.NewValues)
+                        entries = append(entries, entry)
+                }
+                return rows.Err()
+        })
+        if err != nil {
+                log.Printf("Failed to list audit log: %v", err)
+                http.Error(w, "Database error", http.StatusInternalServerError)
+                return
+        }
+
+        page := AuditPage{Entries: make([]AuditEntry, 0, len(entries))}
+        if len(entries) > limit {
+                entries = entries[:limit]
+                page.NextCursor = encodeAuditCursor(entries[len(entries)-1])
+        }
+
+        redact := make(map[string]bool)
+        for _, field := range strings.Split(cfg.AuditRedactFields, ",") {
+                if field = strings.TrimSpace(field); field != "" {
+                        redact[field] = true
+                }
+        }
+        for _, entry := range entries {
+                redactAuditValues(entry.OldValues, redact)
+                redactAuditValues(entry.NewValues, redact)
+                if redact["ip_address"] && entry.IPAddress != nil {
+                        entry.IPAddress = nil
+                }
+                if redact["user_agent"] && entry.UserAgent != nil {
+                        entry.UserAgent = nil
+                }
+                page.Entries = append(page.Entries, entry)
+        }
+
+        writeJSON(w, http.StatusOK, page)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "net/http"
+        "net/http/httptest"
+        "net/url"
+        "testing"
+        "time"
+
+        "github.com/golang-jwt/jwt/v5"
+        "github.com/google/uuid"
+)
+
+// Call the audit API with query parameters, decoding the page on success
+func listAudit(t *testing.T, params url.Values) (*httptest.ResponseRecorder, AuditPage) {
+        t.Helper()
+        r := httptest.NewRequest(http.MethodGet, "/v1/audit?"+params.Encode(), nil)
+        w := httptest.NewRecorder()
+        handleListAudit(w, r)
+        var page AuditPage
+        if w.Code == http.StatusOK {
+                if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+                        t.Fatal(err)
+                }
+        }
+        return w, page
+}
+
+func TestAuditCursorRoundTrip(t *testing.T) {
+        entry := AuditEntry{ID: uuid.NewString(), CreatedAt: time.Date(2026, 3, 14, 9, 26, 53, 589793000, time.UTC)}
+        createdAt, id, err := decodeAuditCursor(encodeAuditCursor(entry))
+        if err != nil || !createdAt.Equal(entry.CreatedAt) || id != entry.ID {
+                t.Errorf("decoded %v %q %v, want %v %q", createdAt, id, err, entry.CreatedAt, entry.ID)
+        }
+
+        for _, cursor := range []string{"!!!", "bm8tc2VwYXJhdG9y", encodeAuditCursor(AuditEntry{ID: "not-a-uuid"})} {
+                if _, _, err := decodeAuditCursor(cursor); err == nil {
+                        t.Errorf("cursor %q decoded without error", cursor)
+                }
+        }
+}
+
+func TestRedactAuditValues(t *testing.T) {
+        values := map[string]interface{}{
+                "session_id": "s-1",
+                "filename":   "alarm-panel.jpg",
+                "upload": map[string]interface{}{
+                        "filename": "nested.jpg",
+                        "size":     float64(2048),
+                },
+        }
+        redactAuditValues(values, map[string]bool{"filename": true})
+        if values["filename"] != auditRedacted || values["upload"].(map[string]interface{})["filename"] != auditRedacted {
+                t.Errorf("filename not redacted at every depth: %v", values)
+        }
+        if values["session_id"] != "s-1" || values["upload"].(map[string]interface{})["size"] != float64(2048) {
+                t.Errorf("unlisted fields changed: %v", values)
+        }
+}
+
+func TestAuditRejectsBadParameters(t *testing.T) {
+        for _, params := range []url.Values{
+                {"from": {"yesterday"}},
+                {"to": {"2026-13-01T00:00:00Z"}},
+                {"cursor": {"garbage"}},
+                {"limit": {"0"}},
+                {"limit": {"ten"}},
+        } {
+                if w, _ := listAudit(t, params); w.Code != http.StatusBadRequest {
+                        t.Errorf("%v = %d, want 400", params, w.Code)
+                }
+        }
+}
+
+func TestAuditRequiresAdminRole(t *testing.T) {
+        withConfig(t, func(c *Config) { c.AdminRole = "compliance" })
+        reached := false
+        handler := requireAdmin(func(w http.ResponseWriter, r *http.Request) { reached = true })
+
+        tests := []struct {
+                claims jwt.MapClaims
+                want   int
+        }{
+                {jwt.MapClaims{"role": "inspector"}, http.StatusForbidden},
+                {jwt.MapClaims{"roles": []interface{}{"inspector", "compliance"}}, http.StatusOK},
+                {jwt.MapClaims{"role": "compliance"}, http.StatusOK},
+                {nil, http.StatusForbidden},
+        }
+        for _, tt := range tests {
+                reached = false
+                r := httptest.NewRequest(http.MethodGet, "/v1/audit", nil)
+                r = r.WithContext(withClaims(r.Context(), tt.claims))
+                w := httptest.NewRecorder()
+                handler(w, r)
+                if w.Code != tt.want || reached != (tt.want == http.StatusOK) {
+                        t.Errorf("claims %v: status %d reached %v, want %d", tt.claims, w.Code, reached, tt.want)
+                }
+        }
+}
+
+func TestAuditFilteringAndPagination(t *testing.T) {
+        pool := testDB(t)
+        withConfig(t, func(c *Config) { c.AuditRedactFields = "original_filename" })
+        ctx := context.Background()
+        alice := insertTestUser(t, pool, "audit-alice")
+        bob := insertTestUser(t, pool, "audit-bob")
+        sessionID := uuid.NewString()
+
+        // Five uploads an hour apart: alice, bob, alice, bob, alice
+        base := time.Date(2026, 5, 4, 8, 0, 0, 0, time.UTC)
+        for i := 0; i < 5; i++ {
+                user := []string{alice, bob}[i%2]
+                values, _ := json.Marshal(map[string]interface{}{
+                        "user_id":           user,
+                        "session_id":        sessionID,
+                        "original_filename": "hydrant-" + string(rune('a'+i)) + ".jpg",
+                })
+                _, err := pool.Exec(ctx, `
+                        INSERT INTO audit_log (user_id, action, resource_type, resource_id, new_values, created_at)
+                        VALUES ($1, $2, 'evidence', $3, $4, $5)
+                `, user, auditActionEvidenceUpload, uuid.NewString(), string(values), base.Add(time.Duration(i)*time.Hour))
+                if err != nil {
+                        t.Fatal(err)
+                }
+        }
+
+        w, page := listAudit(t, url.Values{"session_id": {sessionID}, "user_id": {alice}})
+        if w.Code != http.StatusOK || len(page.Entries) != 3 {
+                t.Fatalf("alice's entries = %d %d, want 3", w.Code, len(page.Entries))
+        }
+        for _, entry := range page.Entries {
+                if entry.UserID == nil || *entry.UserID != alice {
+                        t.Errorf("entry for user %v in alice's filter", entry.UserID)
+                }
+                if entry.NewValues["original_filename"] != auditRedacted {
+                        t.Errorf("filename not redacted: %v", entry.NewValues)
+                }
+        }
+
+        _, page = listAudit(t, url.Values{
+                "session_id": {sessionID},
+                "from":       {base.Add(time.Hour).Format(time.RFC3339)},
+                "to":         {base.Add(3 * time.Hour).Format(time.RFC3339)},
+        })
+        if len(page.Entries) != 2 {
+                t.Errorf("date range returned %d entries, want 2", len(page.Entries))
+        }
+
+        // Walk the session two entries at a time, newest first
+        var seen []time.Time
+        params := url.Values{"session_id": {sessionID}, "limit": {"2"}}
+        for pages := 0; ; pages++ {
+                if pages > 3 {
+                        t.Fatal("pagination did not terminate")
+                }
+                _, page := listAudit(t, params)
+                for _, entry := range page.Entries {
+                        seen = append(seen, entry.CreatedAt)
+                }
+                if page.NextCursor == "" {
+                        break
+                }
+                params.Set("cursor", page.NextCursor)
+        }
+        if len(seen) != 5 {
+                t.Fatalf("paged through %d entries, want 5", len(seen))
+        }
+        for i, createdAt := range seen {
+                if want := base.Add(time.Duration(4-i) * time.Hour); !createdAt.Equal(want) {
+                        t.Errorf("entry %d created %v, want %v", i, createdAt, want)
+                }
+        }
+}
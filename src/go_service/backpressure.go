@@ -0,0 +1,58 @@
+package main
+
+import (
+        "math"
+        "net/http"
+        "strconv"
+        "sync/atomic"
+
+        "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Response header advertising server load as 0-100
+const serverLoadHeader = "X-Server-Load"
+
+// Requests currently being handled, counted whether or not load shedding is on
+var requestsInFlight atomic.Int64
+
+// Fraction of a pool's connections currently acquired
+func poolSaturation(pool *pgxpool.Pool) float64 {
+        stat := pool.Stat()
+        if stat.MaxConns() <= 0 {
+                return 0
+        }
+        return float64(stat.AcquiredConns()) / float64(stat.MaxConns())
+}
+
+// Current load as 0-100: the higher of database pool saturation (across the
+// default and tenant pools) and in-flight requests against SERVER_LOAD_MAX_IN_FLIGHT
+func serverLoad() int {
+        var load float64
+        if dbPool != nil {
+                load = poolSaturation(dbPool)
+        }
+        for _, pool := range tenantPools.All() {
+                load = math.Max(load, poolSaturation(pool))
+        }
+        if limit := cfg.ServerLoadMaxInFlight; limit > 0 {
+                load = math.Max(load, float64(requestsInFlight.Load())/float64(limit))
+        }
+        return int(math.Round(math.Min(load, 1) * 100))
+}
+
+// Set X-Server-Load on every response so well-behaved clients can slow down
+// before the service starts shedding requests. Load is sampled on arrival,
+// counting the request itself.
+func serverLoadMiddleware(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                if !cfg.ServerLoadHeaderEnabled {
+                        next.ServeHTTP(w, r)
+                        return
+                }
+                requestsInFlight.Add(1)
+                defer requestsInFlight.Add(-1)
+
+                w.Header().Set(serverLoadHeader, strconv.Itoa(serverLoad()))
+                next.ServeHTTP(w, r)
+        })
+}
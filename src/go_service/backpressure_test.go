@@ -0,0 +1,90 @@
+package main
+
+import (
+        "net/http"
+        "net/http/httptest"
+        "strconv"
+        "sync"
+        "testing"
+        "time"
+)
+
+func TestServerLoadHeaderRisesWithInFlightRequests(t *testing.T) {
+        withConfig(t, func(c *Config) {
+                c.ServerLoadHeaderEnabled = true
+                c.ServerLoadMaxInFlight = 8
+        })
+        saved := dbPool
+        dbPool = nil
+        t.Cleanup(func() { dbPool = saved })
+
+        // Slow requests stay in flight until released
+        release := make(chan struct{})
+        handler := serverLoadMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                if r.URL.Path == "/slow" {
+                        <-release
+                }
+                w.WriteHeader(http.StatusNoContent)
+        }))
+        probe := func() int {
+                t.Helper()
+                w := httptest.NewRecorder()
+                handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/capabilities", nil))
+                load, err := strconv.Atoi(w.Header().Get(serverLoadHeader))
+                if err != nil {
+                        t.Fatalf("%s = %q, want a number", serverLoadHeader, w.Header().Get(serverLoadHeader))
+                }
+                return load
+        }
+        holdSlow := func(n int, wg *sync.WaitGroup) {
+                for i := 0; i < n; i++ {
+                        wg.Add(1)
+                        go func() {
+                                defer wg.Done()
+                                handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+                        }()
+                }
+        }
+        waitInFlight := func(n int64) {
+                t.Helper()
+                deadline := time.Now().Add(5 * time.Second)
+                for requestsInFlight.Load() < n {
+                        if time.Now().After(deadline) {
+                                t.Fatalf("in flight = %d, want %d", requestsInFlight.Load(), n)
+                        }
+                        time.Sleep(time.Millisecond)
+                }
+        }
+
+        idle := probe()
+        if idle != 13 { // the probe itself: 1 of 8
+                t.Errorf("idle load = %d, want 13", idle)
+        }
+
+        var wg sync.WaitGroup
+        holdSlow(3, &wg)
+        waitInFlight(3)
+        busy := probe()
+        holdSlow(8, &wg)
+        waitInFlight(11)
+        saturated := probe()
+        close(release)
+        wg.Wait()
+
+        if !(idle < busy && busy < saturated) {
+                t.Errorf("load %d -> %d -> %d, want it to rise with in-flight requests", idle, busy, saturated)
+        }
+        if busy != 50 || saturated != 100 {
+                t.Errorf("busy = %d, saturated = %d; want 50 and a capped 100", busy, saturated)
+        }
+}
+
+func TestServerLoadHeaderDisabled(t *testing.T) {
+        withConfig(t, func(c *Config) { c.ServerLoadHeaderEnabled = false })
+        handler := serverLoadMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+        w := httptest.NewRecorder()
+        handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+        if got := w.Header().Get(serverLoadHeader); got != "" {
+                t.Errorf("%s = %q with the header disabled", serverLoadHeader, got)
+        }
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+        "context"
+        "fmt"
+
+        "github.com/jackc/pgx/v5"
+)
+
+// Anything that can pipeline a pgx.Batch (pool, connection or transaction)
+type batchSender interface {
+        SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults
+}
+
+// A statement queued for batch execution, tagged with the logical request it serves
+type BatchItem struct {
+        Ref  string
+        SQL  string
+        Args []interface{}
+}
+
+// Identifies which batch item failed
+type BatchItemError struct {
+        Index int
+        Ref   string
+        Err   error
+}
+
+func (e *BatchItemError) Error() string {
+        return fmt.Sprintf("batch item %d (%s) failed: %v", e.Index, e.Ref, e.Err)
+}
+
+func (e *BatchItemError) Unwrap() error {
+        return e.Err
+}
+
+// Execute items in a single network round-trip. The first failing statement is
+// reported as a *BatchItemError carrying the item's Ref; within a transaction
+// every later statement is aborted as well, so callers should treat the batch
+// as failed from that item onwards.
+func execBatch(ctx context.Context, sender batchSender, items []BatchItem) error {
+        if len(items) == 0 {
+                return nil
+        }
+
+        batch := &pgx.Batch{}
+        for _, item := range items {
+                batch.Queue(item.SQL, item.Args...)
+        }
+
+        results := sender.SendBatch(ctx, batch)
+        var firstErr error
+        for i, item := range items {
+                if _, err := results.Exec(); err != nil && firstErr == nil {
+                        firstErr = &BatchItemError{Index: i, Ref: item.Ref, Err: err}
+                }
+        }
+        if err := results.Close(); err != nil && firstErr == nil {
+                firstErr = err
+        }
+        return firstErr
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "fmt"
+        "reflect"
+        "testing"
+
+        "github.com/jackc/pgx/v5"
+        "github.com/jackc/pgx/v5/pgconn"
+        "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Replays scripted per-statement results instead of talking to Postgres
+type scriptedBatch struct {
+        errs     []error
+        closeErr error
+        queued   []string
+        next     int
+}
+
+func (s *scriptedBatch) SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults {
+        for _, query := range b.QueuedQueries {
+                s.queued = append(s.queued, query.SQL)
+        }
+        return s
+}
+
+func (s *scriptedBatch) Exec() (pgconn.CommandTag, error) {
+        err := s.errs[s.next]
+        s.next++
+        return pgconn.NewCommandTag("INSERT 0 1"), err
+}
+
+func (s *scriptedBatch) Query() (pgx.Rows, error) { return nil, errors.New("not scripted") }
+func (s *scriptedBatch) QueryRow() pgx.Row        { return nil }
+func (s *scriptedBatch) Close() error             { return s.closeErr }
+
+func TestExecBatchReportsFirstFailure(t *testing.T) {
+        violation := &pgconn.PgError{Code: "23505", Message: "duplicate key value"}
+        aborted := &pgconn.PgError{Code: "25P02", Message: "current transaction is aborted"}
+        sender := &scriptedBatch{errs: []error{nil, violation, aborted}}
+        items := []BatchItem{
+                {Ref: "usage:session-a", SQL: "INSERT INTO a VALUES ($1)", Args: []interface{}{1}},
+                {Ref: "usage:session-b", SQL: "INSERT INTO b VALUES ($1)", Args: []interface{}{2}},
+                {Ref: "usage:session-c", SQL: "INSERT INTO c VALUES ($1)", Args: []interface{}{3}},
+        }
+
+        err := execBatch(context.Background(), sender, items)
+        var itemErr *BatchItemError
+        if !errors.As(err, &itemErr) {
+                t.Fatalf("err = %v, want *BatchItemError", err)
+        }
+        if itemErr.Index != 1 || itemErr.Ref != "usage:session-b" || !errors.Is(err, violation) {
+                t.Errorf("reported item %d (%s): %v; want item 1 (usage:session-b)", itemErr.Index, itemErr.Ref, itemErr.Err)
+        }
+        if sender.next != len(items) {
+                t.Errorf("read %d results, want all %d drained", sender.next, len(items))
+        }
+        if len(sender.queued) != len(items) || sender.queued[2] != items[2].SQL {
+                t.Errorf("queued %v", sender.queued)
+        }
+}
+
+func TestExecBatchCloseErrorAndEmpty(t *testing.T) {
+        closeErr := errors.New("conn closed")
+        sender := &scriptedBatch{errs: []error{nil}, closeErr: closeErr}
+        if err := execBatch(context.Background(), sender, []BatchItem{{Ref: "only", SQL: "SELECT 1"}}); err != closeErr {
+                t.Errorf("err = %v, want the Close error", err)
+        }
+        if err := execBatch(context.Background(), nil, nil); err != nil {
+                t.Errorf("empty batch = %v", err)
+        }
+}
+
+// Readings inserted by the batched-vs-sequential comparison
+func readingItems(table string, n int) []BatchItem {
+        items := make([]BatchItem, n)
+        for i := range items {
+                items[i] = BatchItem{
+                        Ref:  fmt.Sprintf("reading-%d", i),
+                        SQL:  "INSERT INTO " + table + " (device, psi) VALUES ($1, $2)",
+                        Args: []interface{}{fmt.Sprintf("gauge-%02d", i%7), 40 + i%25},
+                }
+        }
+        return items
+}
+
+func createReadingsTable(tb testing.TB, pool *pgxpool.Pool, table string) {
+        tb.Helper()
+        _, err := pool.Exec(context.Background(),
+                "DROP TABLE IF EXISTS "+table+"; CREATE TABLE "+table+" (id serial PRIMARY KEY, device text NOT NULL, psi int NOT NULL)")
+        if err != nil {
+                tb.Fatal(err)
+        }
+        tb.Cleanup(func() { pool.Exec(context.Background(), "DROP TABLE IF EXISTS "+table) })
+}
+
+func selectReadings(t *testing.T, pool *pgxpool.Pool, table string) [][2]interface{} {
+        t.Helper()
+        rows, err := pool.Query(context.Background(), "SELECT device, psi FROM "+table+" ORDER BY id")
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer rows.Close()
+        var readings [][2]interface{}
+        for rows.Next() {
+                var device string
+                var psi int
+                if err := rows.Scan(&device, &psi); err != nil {
+                        t.Fatal(err)
+                }
+                readings = append(readings, [2]interface{}{device, psi})
+        }
+        return readings
+}
+
+func TestExecBatchMatchesSequentialInserts(t *testing.T) {
+        pool := testDB(t)
+        ctx := context.Background()
+        createReadingsTable(t, pool, "batch_test_sequential")
+        createReadingsTable(t, pool, "batch_test_batched")
+
+        for _, item := range readingItems("batch_test_sequential", 60) {
+                if _, err := pool.Exec(ctx, item.SQL, item.Args...); err != nil {
+                        t.Fatal(err)
+                }
+        }
+        tx, err := pool.Begin(ctx)
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer tx.Rollback(ctx)
+        if err := execBatch(ctx, tx, readingItems("batch_test_batched", 60)); err != nil {
+                t.Fatal(err)
+        }
+        if err := tx.Commit(ctx); err != nil {
+                t.Fatal(err)
+        }
+
+        sequential := selectReadings(t, pool, "batch_test_sequential")
+        batched := selectReadings(t, pool, "batch_test_batched")
+        if len(batched) != 60 || !reflect.DeepEqual(sequential, batched) {
+                t.Errorf("batched rows differ from sequential rows:\n%v\n%v", batched, sequential)
+        }
+
+        // A failing item aborts the transaction and is reported by Ref
+        tx, err = pool.Begin(ctx)
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer tx.Rollback(ctx)
+        items := readingItems("batch_test_batched", 3)
+        items[1].Args = []interface{}{nil, 50}
+        var itemErr *BatchItemError
+        if err := execBatch(ctx, tx, items); !errors.As(err, &itemErr) || itemErr.Ref != "reading-1" {
+                t.Errorf("err = %v, want a failure of reading-1", err)
+        }
+}
+
+func BenchmarkInsertReadings(b *testing.B) {
+        pool := testDB(b)
+        ctx := context.Background()
+        createReadingsTable(b, pool, "batch_bench_readings")
+        items := readingItems("batch_bench_readings", 100)
+
+        b.Run("sequential", func(b *testing.B) {
+                for i := 0; i < b.N; i++ {
+                        for _, item := range items {
+                                if _, err := pool.Exec(ctx, item.SQL, item.Args...); err != nil {
+                                        b.Fatal(err)
+                                }
+                        }
+                }
+        })
+        b.Run("batched", func(b *testing.B) {
+                for i := 0; i < b.N; i++ {
+                        if err := execBatch(ctx, pool, items); err != nil {
+                                b.Fatal(err)
+                        }
+                }
+        })
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "fmt"
+        "io"
+        "log"
+        "sync"
+        "time"
+
+        "github.com/prometheus/client_golang/prometheus"
+)
+
+var evidenceStoreBreakerState = prometheus.NewGauge(prometheus.GaugeOpts{
+        Name: "evidence_store_breaker_state",
+        Help: "State of the evidence store circuit breaker: 0 closed, 1 half-open, 2 open.",
+})
+
+func init() {
+        prometheus.MustRegister(evidenceStoreBreakerState)
+}
+
+// Circuit breaker states, in the order reported by the state gauges
+const (
+        breakerClosed = iota
+        breakerHalfOpen
+        breakerOpen
+)
+
+// Returned instead of calling a dependency whose circuit is open
+var errCircuitOpen = errors.New("circuit open")
+
+// Consecutive-failure circuit breaker. After threshold failures in a row the
+// circuit opens and calls fail fast for the cooldown; then a single trial call
+// is let through, closing the circuit on success and reopening it on failure.
+type CircuitBreaker struct {
+        name      string
+        threshold int64
+        cooldown  time.Duration
+        gauge     prometheus.Gauge
+
+        mu       sync.Mutex
+        state    int
+        failures int64
+        openedAt time.Time
+        // A half-open trial call is in flight
+        trial bool
+}
+
+func NewCircuitBreaker(name string, threshold int64, cooldown time.Duration, gauge prometheus.Gauge) *CircuitBreaker {
+        return &CircuitBreaker{name: name, threshold: threshold, cooldown: cooldown, gauge: gauge}
+}
+
+// Report whether a call may proceed; when it may not, also how long until the next trial
+func (b *CircuitBreaker) Allow() (bool, time.Duration) {
+        b.mu.Lock()
+        defer b.mu.Unlock()
+
+        switch b.state {
+        case breakerOpen:
+                if wait := b.cooldown - time.Since(b.openedAt); wait > 0 {
+                        return false, wait
+                }
+                b.setState(breakerHalfOpen)
+                b.trial = true
+                return true, 0
+        case breakerHalfOpen:
+                // Only the trial call proceeds until it settles the circuit
+                if b.trial {
+                        return false, b.cooldown
+                }
+                b.trial = true
+                return true, 0
+        }
+        return true, 0
+}
+
+// Time left before an open circuit lets a trial call through; 0 when calls are not failing fast
+func (b *CircuitBreaker) OpenFor() time.Duration {
+        b.mu.Lock()
+        defer b.mu.Unlock()
+        if b.state != breakerOpen {
+                return 0
+        }
+        return max(b.cooldown-time.Since(b.openedAt), 0)
+}
+
+// Record the outcome of an allowed call
+func (b *CircuitBreaker) Record(success bool) {
+        b.mu.Lock()
+        defer b.mu.Unlock()
+
+        b.trial = false
+        if success {
+                b.failures = 0
+                if b.state != breakerClosed {
+                        log.Printf("Circuit %s closed", b.name)
+                        b.setState(breakerClosed)
+                }
+                return
+        }
+
+        b.failures++
+        if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+                log.Printf("Circuit %s opened after %d consecutive failures", b.name, b.failures)
+                b.openedAt = time.Now()
+                b.setState(breakerOpen)
+        }
+}
+
+// Finish an allowed call whose outcome says nothing about the dependency's
+// health. A half-open trial slot is freed for the next call; the state and
+// failure count are unchanged.
+func (b *CircuitBreaker) Release() {
+        b.mu.Lock()
+        defer b.mu.Unlock()
+        b.trial = false
+}
+
+func (b *CircuitBreaker) setState(state int) {
+        b.state = state
+        if b.gauge != nil {
+                b.gauge.Set(float64(state))
+        }
+}
+
+// Breaker guarding the evidence store, or nil when EVIDENCE_STORE_BREAKER_THRESHOLD is 0
+var evidenceStoreBreaker *CircuitBreaker
+
+// Returned by evidence store operations while the store circuit is open
+var errEvidenceStoreUnavailable = errors.New("evidence store unavailable")
+
+// Time until new evidence can be accepted again: non-zero while the store
+// circuit is open and there is no spool to absorb writes
+func evidenceStoreUnavailableFor() time.Duration {
+        if evidenceStoreBreaker == nil || cfg.EvidenceSpoolDir != "" {
+                return 0
+        }
+        return evidenceStoreBreaker.OpenFor()
+}
+
+// Evidence store wrapped in a circuit breaker, so a failing backend is not
+// waited on by every upload and download. Only evidence handling is affected;
+// session and CRDT endpoints do not touch the store.
+type BreakerEvidenceStore struct {
+        inner   EvidenceStore
+        breaker *CircuitBreaker
+}
+
+func NewBreakerEvidenceStore(inner EvidenceStore, breaker *CircuitBreaker) *BreakerEvidenceStore {
+        return &BreakerEvidenceStore{inner: inner, breaker: breaker}
+}
+
+// Run op through the breaker. Missing objects and cancelled requests say
+// nothing about the store's health, so they record no outcome.
+func (s *BreakerEvidenceStore) call(ctx context.Context, op func() error) error {
+        if ok, _ := s.breaker.Allow(); !ok {
+                return fmt.Errorf("%w: %w", errEvidenceStoreUnavailable, errCircuitOpen)
+        }
+        err := op()
+        if errors.Is(err, errEvidenceNotFound) || (err != nil && ctx.Err() != nil) {
+                s.breaker.Release()
+                return err
+        }
+        s.breaker.Record(err == nil)
+        return err
+}
+
+func (s *BreakerEvidenceStore) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+        var n int64
+        err := s.call(ctx, func() error {
+                var err error
+                n, err = s.inner.Put(ctx, key, r)
+                return err
+        })
+        return n, err
+}
+
+func (s *BreakerEvidenceStore) Get(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+        var blob io.ReadSeekCloser
+        err := s.call(ctx, func() error {
+                var err error
+                blob, err = s.inner.Get(ctx, key)
+                return err
+        })
+        return blob, err
+}
+
+func (s *BreakerEvidenceStore) Size(ctx context.Context, key string) (int64, error) {
+        var size int64
+        err := s.call(ctx, func() error {
+                var err error
+                size, err = s.inner.Size(ctx, key)
+                return err
+        })
+        return size, err
+}
+
+func (s *BreakerEvidenceStore) Delete(ctx context.Context, key string) error {
+        return s.call(ctx, func() error {
+                return s.inner.Delete(ctx, key)
+        })
+}
+
+func (s *BreakerEvidenceStore) StorageLocation() StorageLocation {
+        if locator, ok := s.inner.(EvidenceStoreLocator); ok {
+                return locator.StorageLocation()
+        }
+        return StorageLocation{}
+}
+
+// Probe the store directly, so readiness reports its real state while the circuit is open
+func (s *BreakerEvidenceStore) Check(ctx context.Context) error {
+        return probeEvidenceStore(ctx, s.inner)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "errors"
+        "net/http"
+        "net/http/httptest"
+        "strings"
+        "testing"
+        "time"
+
+        "github.com/prometheus/client_golang/prometheus"
+        dto "github.com/prometheus/client_model/go"
+)
+
+func gaugeValue(t *testing.T, gauge prometheus.Gauge) float64 {
+        t.Helper()
+        var m dto.Metric
+        if err := gauge.Write(&m); err != nil {
+                t.Fatal(err)
+        }
+        return m.GetGauge().GetValue()
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+        captureLog(t)
+        gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_breaker_state"})
+        b := NewCircuitBreaker("test", 3, 40*time.Millisecond, gauge)
+
+        // Failures below the threshold, interrupted by a success, keep it closed
+        b.Record(false)
+        b.Record(false)
+        b.Record(true)
+        b.Record(false)
+        b.Record(false)
+        if ok, _ := b.Allow(); !ok || gaugeValue(t, gauge) != breakerClosed {
+                t.Fatal("circuit opened before three consecutive failures")
+        }
+        b.Record(false)
+        if ok, wait := b.Allow(); ok || wait <= 0 || wait > 40*time.Millisecond || gaugeValue(t, gauge) != breakerOpen {
+                t.Fatalf("Allow = %v, %s after the threshold, want a fast failure", ok, wait)
+        }
+        if b.OpenFor() <= 0 {
+                t.Error("OpenFor = 0 while open")
+        }
+
+        // After the cooldown exactly one trial call proceeds; its failure reopens
+        time.Sleep(50 * time.Millisecond)
+        if ok, _ := b.Allow(); !ok || gaugeValue(t, gauge) != breakerHalfOpen {
+                t.Fatal("no trial call after the cooldown")
+        }
+        if ok, _ := b.Allow(); ok {
+                t.Error("second call allowed during the trial")
+        }
+        if b.OpenFor() != 0 {
+                t.Error("OpenFor non-zero while half-open")
+        }
+        b.Record(false)
+        if ok, _ := b.Allow(); ok {
+                t.Error("failed trial did not reopen the circuit")
+        }
+
+        // A successful trial closes it
+        time.Sleep(50 * time.Millisecond)
+        b.Allow()
+        b.Record(true)
+        if ok, _ := b.Allow(); !ok || gaugeValue(t, gauge) != breakerClosed {
+                t.Error("successful trial did not close the circuit")
+        }
+}
+
+func TestBreakerStoreOpensOnFailures(t *testing.T) {
+        captureLog(t)
+        inner := newOutageStore(t)
+        breaker := NewCircuitBreaker("evidence_store", 2, time.Hour, nil)
+        store := NewBreakerEvidenceStore(inner, breaker)
+        ctx := context.Background()
+
+        if _, err := store.Put(ctx, "ev-ok", strings.NewReader("sprinkler photo")); err != nil {
+                t.Fatal(err)
+        }
+        inner.down.Store(true)
+        for i := 0; i < 2; i++ {
+                if _, err := store.Put(ctx, "ev-down", strings.NewReader("alarm photo")); !errors.Is(err, errTestStoreDown) {
+                        t.Fatalf("put %d: err = %v, want the store error", i+1, err)
+                }
+        }
+
+        // Open: calls fail fast without reaching the store
+        puts := inner.puts.Load()
+        _, err := store.Put(ctx, "ev-down", strings.NewReader("alarm photo"))
+        if !errors.Is(err, errEvidenceStoreUnavailable) || !errors.Is(err, errCircuitOpen) {
+                t.Errorf("err = %v, want errEvidenceStoreUnavailable", err)
+        }
+        if _, err := store.Get(ctx, "ev-ok"); !errors.Is(err, errEvidenceStoreUnavailable) {
+                t.Errorf("Get err = %v while open", err)
+        }
+        if inner.puts.Load() != puts {
+                t.Error("the open circuit still called the store")
+        }
+}
+
+func TestBreakerStoreIgnoresNotFoundAndCancellation(t *testing.T) {
+        captureLog(t)
+        inner := newOutageStore(t)
+        breaker := NewCircuitBreaker("evidence_store", 1, 20*time.Millisecond, nil)
+        store := NewBreakerEvidenceStore(inner, breaker)
+
+        // Missing objects never open the circuit
+        for i := 0; i < 3; i++ {
+                if _, err := store.Size(context.Background(), "ev-missing"); err != errEvidenceNotFound {
+                        t.Fatalf("Size err = %v", err)
+                }
+        }
+        // Nor does a failure of a request the client already abandoned
+        inner.down.Store(true)
+        cancelled, cancel := context.WithCancel(context.Background())
+        cancel()
+        store.Get(cancelled, "ev-missing")
+        if ok, _ := breaker.Allow(); !ok {
+                t.Fatal("circuit opened on not-found or cancelled calls")
+        }
+        breaker.Record(true)
+
+        // Open it, then let a not-found trial through: it frees the trial slot
+        // without closing the circuit, so the next call is the new trial
+        store.Get(context.Background(), "ev-missing")
+        time.Sleep(30 * time.Millisecond)
+        inner.down.Store(false)
+        if _, err := store.Get(context.Background(), "ev-missing"); err != errEvidenceNotFound {
+                t.Fatalf("trial err = %v, want not found", err)
+        }
+        if breaker.state != breakerHalfOpen {
+                t.Errorf("state = %d after a not-found trial, want half-open", breaker.state)
+        }
+        if _, err := store.Put(context.Background(), "ev-after", strings.NewReader("exit sign")); err != nil {
+                t.Errorf("next trial = %v, want it allowed", err)
+        }
+        if breaker.state != breakerClosed {
+                t.Errorf("state = %d after a successful trial, want closed", breaker.state)
+        }
+}
+
+// Open the global evidence store breaker for one test
+func openEvidenceStoreBreaker(t *testing.T) {
+        t.Helper()
+        captureLog(t)
+        withConfig(t, func(c *Config) { c.EvidenceSpoolDir = "" })
+        saved := evidenceStoreBreaker
+        evidenceStoreBreaker = NewCircuitBreaker("evidence_store", 1, time.Minute, nil)
+        evidenceStoreBreaker.Record(false)
+        t.Cleanup(func() { evidenceStoreBreaker = saved })
+}
+
+func TestOpenStoreBreakerRejectsUploads(t *testing.T) {
+        openEvidenceStoreBreaker(t)
+        r := evidenceUploadRequest(t, map[string]string{"session_id": "session-breaker", "evidence_type": "photo"},
+                map[string][]byte{"panel.jpg": []byte("panel")})
+        r.Header.Set("Idempotency-Key", "breaker-upload-1")
+        r.Header.Set("X-User-ID", "inspector-80")
+        w := httptest.NewRecorder()
+        handleEvidence(w, r)
+        if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+                t.Errorf("upload = %d, Retry-After %q; want 503 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+        }
+
+        // With a spool configured, uploads are still accepted while the store is down
+        cfg.EvidenceSpoolDir = t.TempDir()
+        if evidenceStoreUnavailableFor() != 0 {
+                t.Error("uploads rejected although the spool can absorb them")
+        }
+}
+
+func TestOpenStoreBreakerLeavesCRDTWorking(t *testing.T) {
+        pool := testDB(t)
+        openEvidenceStoreBreaker(t)
+        sessionID := insertTestSession(t, pool, nil, nil)
+        body, _ := json.Marshal(CRDTPayload{
+                IdempotencyKey: "breaker-crdt-" + sessionID,
+                Changes:        []map[string]interface{}{{"op": "set", "path": "/jockey_pump", "value": "running"}},
+        })
+        w := postCRDTResults(t, sessionID, body, http.Header{"X-User-Id": {insertTestUser(t, pool, "breaker-crdt")}})
+        if w.Code != http.StatusOK {
+                t.Errorf("CRDT post = %d %s with the store circuit open, want 200", w.Code, w.Body.String())
+        }
+}
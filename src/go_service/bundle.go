@@ -0,0 +1,240 @@
+package main
+
+import (
+        "archive/tar"
+        "crypto/ed25519"
+        "crypto/hmac"
+        "crypto/sha256"
+        "encoding/base64"
+        "encoding/hex"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "io"
+        "log"
+        "net/http"
+        "strings"
+        "time"
+
+        "github.com/google/uuid"
+        "github.com/gorilla/mux"
+)
+
+// Evidence bundles are tar archives streamed straight from the evidence store:
+// one entry per live evidence blob under files/, then manifest.json listing
+// each file's checksum and metadata, then manifest.json.sig holding the base64
+// signature over the exact manifest.json bytes. The manifest comes last so its
+// checksums are those of the bytes actually streamed, not just the stored ones.
+
+// Returned when EVIDENCE_BUNDLE_SIGNING_KEY is unset
+var errBundleSigningDisabled = errors.New("evidence bundle signing is not configured")
+
+// Manifest describing the contents of an evidence bundle
+type BundleManifest struct {
+        SessionID   string               `json:"session_id"`
+        GeneratedAt time.Time            `json:"generated_at"`
+        Algorithm   string               `json:"signature_algorithm"`
+        Files       []BundleManifestFile `json:"files"`
+}
+
+// A single evidence file within a bundle
+type BundleManifestFile struct {
+        Name         string                 `json:"name"`
+        EvidenceID   string                 `json:"evidence_id"`
+        EvidenceType string                 `json:"evidence_type"`
+        SHA256       string                 `json:"sha256"`
+        Size         int64                  `json:"size"`
+        Metadata     map[string]interface{} `json:"metadata"`
+        CreatedAt    time.Time              `json:"created_at"`
+}
+
+// Parse EVIDENCE_BUNDLE_SIGNING_KEY, formatted like PAYLOAD_SIGNING_KEYS values:
+// "hmac:<base64 secret>" or "ed25519:<base64 seed or private key>"
+func bundleSigningKey() (string, []byte, error) {
+        if cfg.EvidenceBundleSigningKey == "" {
+                return "", nil, errBundleSigningDisabled
+        }
+        algorithm, encodedKey, _ := strings.Cut(cfg.EvidenceBundleSigningKey, ":")
+        key, err := base64.StdEncoding.DecodeString(encodedKey)
+        if err != nil {
+                return "", nil, fmt.Errorf("bundle signing key is not valid base64")
+        }
+        switch algorithm {
+        case "hmac":
+                return "hmac-sha256", key, nil
+        case "ed25519":
+                switch len(key) {
+                case ed25519.SeedSize:
+                        return "ed25519", ed25519.NewKeyFromSeed(key), nil
+                case ed25519.PrivateKeySize:
+                        return "ed25519", key, nil
+                }
+                return "", nil, fmt.Errorf("bundle signing key is not an Ed25519 seed or private key")
+        }
+        return "", nil, fmt.Errorf("bundle signing key has unsupported algorithm %q", algorithm)
+}
+
+// Sign manifest bytes with a key returned by bundleSigningKey
+func signBundleManifest(algorithm string, key, manifest []byte) []byte {
+        if algorithm == "ed25519" {
+                return ed25519.Sign(ed25519.PrivateKey(key), manifest)
+        }
+        mac := hmac.New(sha256.New, key)
+        mac.Write(manifest)
+        return mac.Sum(nil)
+}
+
+// Write one in-memory file to a bundle
+func writeBundleEntry(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+        if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), ModTime: modTime}); err != nil {
+                return err
+        }
+        _, err := tw.Write(data)
+        return err
+}
+
+// Stream all live evidence of a session as a signed tar bundle. Headers are
+// committed before the first blob is read, so a blob that is missing or whose
+// content no longer matches its stored checksum aborts the stream, leaving a
+// truncated archive without a manifest rather than a manifest that lies.
+func handleEvidenceBundle(w http.ResponseWriter, r *http.Request) {
+        sessionID := mux.Vars(r)["session_id"]
+        if _, err := uuid.Parse(sessionID); err != nil {
+                http.Error(w, "Session not found", http.StatusNotFound)
+                return
+        }
+
+        algorithm, key, err := bundleSigningKey()
+        if errors.Is(err, errBundleSigningDisabled) {
+                http.Error(w, err.Error(), http.StatusServiceUnavailable)
+                return
+        }
+        if err != nil {
+                log.Printf("Evidence bundle signing key: %v", err)
+                http.Error(w, "Internal configuration error", http.StatusInternalServerError)
+                return
+        }
+
+        ctx := r.Context()
+        var exists bool
+        if err := dbFor(ctx).QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM test_sessions WHERE id = $1)", sessionID).Scan(&exists); err != nil {
+                log.Printf("Failed to check session %s: %v", sessionID, err)
+                http.Error(w, "Database error", http.StatusInternalServerError)
+                return
+        }
+        if !exists {
+                http.Error(w, "Session not found", http.StatusNotFound)
+                return
+        }
+
+        var records []EvidenceRecord
+        err = timeQuery("list_session_evidence", func() error {
+                rows, err := dbFor(ctx).Query(ctx, `
+                        SELECT id::text, evidence_type, metadata, COALESCE(checksum, ''), created_at
+                        FROM evidence
+                        WHERE session_id = $1 AND NOT flagged_for_review
+                        ORDER BY created_at, id
+                `, sessionID)
+                if err != nil {
+                        return err
+                }
+                defer rows.Close()
+                for rows.Next() {
+                        var record EvidenceRecord
+                        var metadataJSON string
+                        if err := rows.Scan(&record.ID, &record.EvidenceType, &metadataJSON, &record.Checksum, &record.CreatedAt); err != nil {
+                                return err
+                        }
+                        if err := json.Unmarshal([]byte(metadataJSON), &record.Metadata); err != nil || record.Metadata == nil {
+                                record.Metadata = make(map[string]interface{})
+                        }
+                        records = append(records, record)
+                }
+                return rows.Err()
+        })
+        if err != nil {
+                log.Printf("Failed to list evidence for session %s: %v", sessionID, err)
+                http.Error(w, "Database error", http.StatusInternalServerError)
+                return
+        }
+
+        manifest := BundleManifest{
+                SessionID:   sessionID,
+                GeneratedAt: time.Now().UTC(),
+                Algorithm:   algorithm,
+                Files:       make([]BundleManifestFile, 0, len(records)),
+        }
+
+        w.Header().Set("Content-Type", "application/x-tar")
+        w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="evidence-%s.tar"`, sessionID))
+        w.WriteHeader(http.StatusOK)
+
+        tw := tar.NewWriter(w)
+        for _, record := range records {
+                file, err := writeBundleBlob(r, tw, &record)
+                if err != nil {
+                        log.Printf("Aborting evidence bundle for session %s: %v", sessionID, err)
+                        return
+                }
+                manifest.Files = append(manifest.Files, file)
+        }
+
+        manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+        if err != nil {
+                log.Printf("Failed to encode bundle manifest for session %s: %v", sessionID, err)
+                return
+        }
+        signature := base64.StdEncoding.EncodeToString(signBundleManifest(algorithm, key, manifestJSON))
+        if err := writeBundleEntry(tw, "manifest.json", manifestJSON, manifest.GeneratedAt); err != nil {
+                log.Printf("Failed to write bundle manifest for session %s: %v", sessionID, err)
+                return
+        }
+        if err := writeBundleEntry(tw, "manifest.json.sig", []byte(signature+"\n"), manifest.GeneratedAt); err != nil {
+                log.Printf("Failed to write bundle signature for session %s: %v", sessionID, err)
+                return
+        }
+        if err := tw.Close(); err != nil {
+                log.Printf("Failed to finish evidence bundle for session %s: %v", sessionID, err)
+        }
+}
+
+// Copy one evidence blob into a bundle, hashing it on the way through
+func writeBundleBlob(r *http.Request, tw *tar.Writer, record *EvidenceRecord) (BundleManifestFile, error) {
+        ctx := r.Context()
+        blob, err := evidenceStore.Get(ctx, evidenceObjectKey(ctx, record.ID))
+        if err != nil {
+                return BundleManifestFile{}, fmt.Errorf("open evidence %s: %w", record.ID, err)
+        }
+        defer blob.Close()
+
+        size, err := blob.Seek(0, io.SeekEnd)
+        if err == nil {
+                _, err = blob.Seek(0, io.SeekStart)
+        }
+        if err != nil {
+                return BundleManifestFile{}, fmt.Errorf("size evidence %s: %w", record.ID, err)
+        }
+
+        name := "files/" + record.ID
+        if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: size, ModTime: record.CreatedAt}); err != nil {
+                return BundleManifestFile{}, err
+        }
+        hash := sha256.New()
+        if _, err := io.Copy(io.MultiWriter(tw, hash), blob); err != nil {
+                return BundleManifestFile{}, fmt.Errorf("copy evidence %s: %w", record.ID, err)
+        }
+        checksum := hex.EncodeToString(hash.Sum(nil))
+        if record.Checksum != "" && checksum != record.Checksum {
+                return BundleManifestFile{}, fmt.Errorf("evidence %s does not match its stored checksum", record.ID)
+        }
+
+        return BundleManifestFile{
+                Name:         name,
+                EvidenceID:   record.ID,
+                EvidenceType: record.EvidenceType,
+                SHA256:       checksum,
+                Size:         size,
+                Metadata:     record.Metadata,
+                CreatedAt:    record.CreatedAt,
+        }, nil
+}
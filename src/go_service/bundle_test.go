@@ -0,0 +1,157 @@
+package main
+
+import (
+        "archive/tar"
+        "bytes"
+        "context"
+        "crypto/ed25519"
+        "encoding/base64"
+        "encoding/json"
+        "io"
+        "net/http"
+        "net/http/httptest"
+        "strings"
+        "testing"
+        "time"
+
+        "github.com/gorilla/mux"
+)
+
+func TestBundleSigningKey(t *testing.T) {
+        seed := bytes.Repeat([]byte{7}, ed25519.SeedSize)
+        tests := []struct {
+                name          string
+                key           string
+                wantAlgorithm string
+                wantErr       string
+        }{
+                {"unset", "", "", "not configured"},
+                {"hmac", "hmac:" + base64.StdEncoding.EncodeToString([]byte("auditor-shared-secret")), "hmac-sha256", ""},
+                {"ed25519 seed", "ed25519:" + base64.StdEncoding.EncodeToString(seed), "ed25519", ""},
+                {"ed25519 private key", "ed25519:" + base64.StdEncoding.EncodeToString(ed25519.NewKeyFromSeed(seed)), "ed25519", ""},
+                {"short ed25519 key", "ed25519:" + base64.StdEncoding.EncodeToString(seed[:16]), "", "not an Ed25519"},
+                {"bad base64", "hmac:%%%", "", "not valid base64"},
+                {"unsupported", "rsa:" + base64.StdEncoding.EncodeToString(seed), "", "unsupported algorithm"},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        withConfig(t, func(c *Config) { c.EvidenceBundleSigningKey = tt.key })
+                        algorithm, _, err := bundleSigningKey()
+                        if tt.wantErr != "" {
+                                if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                                        t.Errorf("err = %v, want %q", err, tt.wantErr)
+                                }
+                                return
+                        }
+                        if err != nil || algorithm != tt.wantAlgorithm {
+                                t.Errorf("algorithm = %q, %v; want %q", algorithm, err, tt.wantAlgorithm)
+                        }
+                })
+        }
+}
+
+func TestBundleBlobRejectsChecksumDrift(t *testing.T) {
+        useTestEvidenceStore(t)
+        ctx := context.Background()
+        record := EvidenceRecord{ID: "4f9e1c2a-6b3d-4e8f-a1c7-2d5b9e0f3a64", EvidenceType: "photo", CreatedAt: time.Now()}
+        evidenceStore.Put(ctx, evidenceObjectKey(ctx, record.ID), strings.NewReader("panel photo, edited"))
+        record.Checksum = calculateSHA256([]byte("panel photo"))
+
+        var archive bytes.Buffer
+        _, err := writeBundleBlob(httptest.NewRequest(http.MethodGet, "/", nil), tar.NewWriter(&archive), &record)
+        if err == nil || !strings.Contains(err.Error(), "stored checksum") {
+                t.Errorf("err = %v, want a checksum mismatch", err)
+        }
+}
+
+func getEvidenceBundle(sessionID string) *httptest.ResponseRecorder {
+        r := httptest.NewRequest(http.MethodGet, "/v1/tests/sessions/"+sessionID+"/evidence:bundle", nil)
+        r = mux.SetURLVars(r, map[string]string{"session_id": sessionID})
+        w := httptest.NewRecorder()
+        handleEvidenceBundle(w, r)
+        return w
+}
+
+func TestEvidenceBundleRejectedBeforeStreaming(t *testing.T) {
+        withConfig(t, func(c *Config) { c.EvidenceBundleSigningKey = "" })
+        if w := getEvidenceBundle("not-a-session"); w.Code != http.StatusNotFound {
+                t.Errorf("malformed session: status = %d, want 404", w.Code)
+        }
+        if w := getEvidenceBundle("0b7d3e91-5c2a-4f68-9e14-a8c6f2d0b537"); w.Code != http.StatusServiceUnavailable {
+                t.Errorf("signing disabled: status = %d, want 503", w.Code)
+        }
+}
+
+func TestEvidenceBundleManifestMatchesFiles(t *testing.T) {
+        pool := testDB(t)
+        useTestEvidenceStore(t)
+        seed := bytes.Repeat([]byte{0x2a}, ed25519.SeedSize)
+        withConfig(t, func(c *Config) { c.EvidenceBundleSigningKey = "ed25519:" + base64.StdEncoding.EncodeToString(seed) })
+
+        sessionID := insertTestSession(t, pool, nil, nil)
+        contents := map[string][]byte{}
+        for _, content := range [][]byte{
+                []byte("fire alarm control panel, zone 4 in fault"),
+                bytes.Repeat([]byte{0x89, 'P', 'N', 'G'}, 4096),
+                []byte("extinguisher service tag 2026-10"),
+        } {
+                contents[insertTestEvidence(t, pool, sessionID, content, map[string]interface{}{"room": "plant room"})] = content
+        }
+
+        w := getEvidenceBundle(sessionID)
+        if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/x-tar" {
+                t.Fatalf("status = %d, content type %q", w.Code, w.Header().Get("Content-Type"))
+        }
+
+        entries := map[string][]byte{}
+        tr := tar.NewReader(w.Body)
+        for {
+                header, err := tr.Next()
+                if err == io.EOF {
+                        break
+                }
+                if err != nil {
+                        t.Fatal(err)
+                }
+                data, _ := io.ReadAll(tr)
+                entries[header.Name] = data
+        }
+
+        var manifest BundleManifest
+        if err := json.Unmarshal(entries["manifest.json"], &manifest); err != nil {
+                t.Fatal(err)
+        }
+        signature, _ := base64.StdEncoding.DecodeString(strings.TrimSpace(string(entries["manifest.json.sig"])))
+        public := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+        if manifest.Algorithm != "ed25519" || !ed25519.Verify(public, entries["manifest.json"], signature) {
+                t.Error("manifest signature does not verify")
+        }
+
+        if len(manifest.Files) != len(contents) {
+                t.Fatalf("manifest lists %d files, want %d", len(manifest.Files), len(contents))
+        }
+        for _, file := range manifest.Files {
+                data, ok := entries[file.Name]
+                if !ok {
+                        t.Errorf("%s listed in the manifest but missing from the bundle", file.Name)
+                        continue
+                }
+                if file.SHA256 != calculateSHA256(data) || file.Size != int64(len(data)) {
+                        t.Errorf("%s: manifest sha256 %s size %d, bundle has %s size %d", file.Name, file.SHA256, file.Size, calculateSHA256(data), len(data))
+                }
+                if !bytes.Equal(data, contents[file.EvidenceID]) {
+                        t.Errorf("%s does not hold evidence %s", file.Name, file.EvidenceID)
+                }
+                if file.Metadata["room"] != "plant room" {
+                        t.Errorf("%s metadata = %v", file.Name, file.Metadata)
+                }
+        }
+}
+
+func TestEvidenceBundleUnknownSession(t *testing.T) {
+        testDB(t)
+        withConfig(t, func(c *Config) { c.EvidenceBundleSigningKey = "hmac:" + base64.StdEncoding.EncodeToString([]byte("k")) })
+        if w := getEvidenceBundle("8d1f0a63-2e4b-47c9-b5a0-96e3d7c1f428"); w.Code != http.StatusNotFound {
+                t.Errorf("status = %d, want 404", w.Code)
+        }
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+        "net/http"
+        "sort"
+)
+
+// Hash algorithms the server computes for evidence checksums and digests
+var supportedHashAlgorithms = []string{"sha-256"}
+
+// Server capabilities advertised to clients so they need not hardcode limits
+type Capabilities struct {
+        HashAlgorithms []string          `json:"hash_algorithms"`
+        CRDT           CRDTCapabilities  `json:"crdt"`
+        Limits         LimitCapabilities `json:"limits"`
+}
+
+type CRDTCapabilities struct {
+        MergeStrategy       string   `json:"merge_strategy"`
+        MergeStrategies     []string `json:"merge_strategies"`
+        PatchOps            []string `json:"patch_ops"`
+        MaxVectorClockNodes int64    `json:"max_vector_clock_nodes,omitempty"`
+        // Largest accepted vector clock counter; 0 means any int64
+        MaxVectorClockCounter int64 `json:"max_vector_clock_counter,omitempty"`
+}
+
+// Configured limits; zero values mean unlimited and are omitted
+type LimitCapabilities struct {
+        MaxDecompressedBytes      int64 `json:"max_decompressed_bytes,omitempty"`
+        MaxJSONDepth              int64 `json:"max_json_depth,omitempty"`
+        MaxEvidenceFilenameLength int64 `json:"max_evidence_filename_length,omitempty"`
+        IdempotencyKeyMaxLength   int64 `json:"idempotency_key_max_length,omitempty"`
+        MaxRequestHeaders         int64 `json:"max_request_headers,omitempty"`
+        MaxEvidenceBytes          int64 `json:"max_evidence_bytes,omitempty"`
+        MaxBatchItems             int64 `json:"max_batch_items,omitempty"`
+        // Per-evidence-type overrides of MaxEvidenceBytes; 0 means unlimited
+        MaxEvidenceBytesByType map[string]int64 `json:"max_evidence_bytes_by_type,omitempty"`
+        // Required idempotency key format: any, uuid or ulid
+        IdempotencyKeyFormat string `json:"idempotency_key_format"`
+}
+
+// Build the capabilities response from the running configuration
+func currentCapabilities() Capabilities {
+        patchOps := []string{changeOpSet, changeOpDelete}
+        for op := range jsonPatchOps {
+                patchOps = append(patchOps, op)
+        }
+        sort.Strings(patchOps)
+
+        return Capabilities{
+                HashAlgorithms: supportedHashAlgorithms,
+                CRDT: CRDTCapabilities{
+                        MergeStrategy:         cfg.MergeStrategy,
+                        MergeStrategies:       mergeStrategyNames(),
+                        PatchOps:              patchOps,
+                        MaxVectorClockNodes:   cfg.MaxVectorClockNodes,
+                        MaxVectorClockCounter: cfg.MaxVectorClockCounter,
+                },
+                Limits: LimitCapabilities{
+                        MaxDecompressedBytes:      cfg.MaxDecompressedBytes,
+                        MaxJSONDepth:              cfg.MaxJSONDepth,
+                        MaxEvidenceFilenameLength: cfg.MaxEvidenceFilenameLength,
+                        IdempotencyKeyMaxLength:   cfg.IdempotencyKeyMaxLength,
+                        MaxRequestHeaders:         cfg.MaxRequestHeaders,
+                        MaxEvidenceBytes:          cfg.EvidenceMaxBytes,
+                        MaxBatchItems:             cfg.MaxBatchItems,
+                        MaxEvidenceBytesByType:    cfg.EvidenceTypeMaxBytes,
+                        IdempotencyKeyFormat:      cfg.IdempotencyKeyFormat,
+                },
+        }
+}
+
+// Report supported hash algorithms, CRDT strategies and request limits
+func handleCapabilities(w http.ResponseWriter, r *http.Request) {
+        writeJSON(w, http.StatusOK, currentCapabilities())
+}
+
+// Sorted names of the supported merge strategies
+func mergeStrategyNames() []string {
+        names := make([]string, 0, len(mergeStrategies))
+        for name := range mergeStrategies {
+                names = append(names, name)
+        }
+        sort.Strings(names)
+        return names
+}
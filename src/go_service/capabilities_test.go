@@ -0,0 +1,61 @@
+package main
+
+import (
+        "encoding/json"
+        "net/http"
+        "net/http/httptest"
+        "reflect"
+        "testing"
+)
+
+func TestCapabilitiesReflectConfig(t *testing.T) {
+        withConfig(t, func(c *Config) {
+                c.MergeStrategy = "lww"
+                c.MaxVectorClockNodes = 64
+                c.MaxJSONDepth = 24
+                c.EvidenceMaxBytes = 50 << 20
+                c.EvidenceTypeMaxBytes = map[string]int64{"video": 500 << 20, "photo": 10 << 20}
+                c.MaxBatchItems = 0
+                c.IdempotencyKeyFormat = "uuid"
+        })
+
+        w := httptest.NewRecorder()
+        handleCapabilities(w, httptest.NewRequest(http.MethodGet, "/v1/capabilities", nil))
+        if w.Code != http.StatusOK {
+                t.Fatalf("status = %d", w.Code)
+        }
+        var raw map[string]map[string]interface{}
+        json.Unmarshal(w.Body.Bytes(), &raw)
+        if _, ok := raw["limits"]["max_batch_items"]; ok {
+                t.Error("unlimited max_batch_items should be omitted")
+        }
+
+        var caps Capabilities
+        if err := json.Unmarshal(w.Body.Bytes(), &caps); err != nil {
+                t.Fatal(err)
+        }
+        if !reflect.DeepEqual(caps.HashAlgorithms, []string{"sha-256"}) {
+                t.Errorf("hash_algorithms = %v", caps.HashAlgorithms)
+        }
+        if caps.CRDT.MergeStrategy != "lww" || caps.CRDT.MaxVectorClockNodes != 64 {
+                t.Errorf("crdt = %+v", caps.CRDT)
+        }
+        if !reflect.DeepEqual(caps.CRDT.MergeStrategies, mergeStrategyNames()) || len(caps.CRDT.MergeStrategies) == 0 {
+                t.Errorf("merge_strategies = %v", caps.CRDT.MergeStrategies)
+        }
+        for _, op := range []string{changeOpSet, changeOpDelete, "add", "remove", "replace"} {
+                found := false
+                for _, advertised := range caps.CRDT.PatchOps {
+                        found = found || advertised == op
+                }
+                if !found {
+                        t.Errorf("patch_ops %v missing %q", caps.CRDT.PatchOps, op)
+                }
+        }
+        if caps.Limits.MaxJSONDepth != 24 || caps.Limits.MaxEvidenceBytes != 50<<20 || caps.Limits.IdempotencyKeyFormat != "uuid" {
+                t.Errorf("limits = %+v", caps.Limits)
+        }
+        if caps.Limits.MaxEvidenceBytesByType["video"] != 500<<20 || caps.Limits.MaxEvidenceBytesByType["photo"] != 10<<20 {
+                t.Errorf("max_evidence_bytes_by_type = %v", caps.Limits.MaxEvidenceBytesByType)
+        }
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+        "compress/gzip"
+        "net/http"
+        "strings"
+)
+
+// gzip-encoding response writer. The compressor is only created once a
+// body-bearing status is written, so 204/304 replies stay empty.
+type gzipResponseWriter struct {
+        http.ResponseWriter
+        gz          *gzip.Writer
+        wroteHeader bool
+}
+
+func (g *gzipResponseWriter) WriteHeader(statusCode int) {
+        if g.wroteHeader {
+                return
+        }
+        g.wroteHeader = true
+
+        // Byte-range responses must stay in the identity encoding the ranges refer to
+        rangeable := g.Header().Get("Accept-Ranges") != "" || g.Header().Get("Content-Range") != ""
+        if statusCode != http.StatusNoContent && statusCode != http.StatusNotModified &&
+                g.Header().Get("Content-Encoding") == "" && !rangeable {
+                g.Header().Set("Content-Encoding", "gzip")
+                g.Header().Del("Content-Length")
+                // Digests computed over the identity body no longer describe the encoded one
+                g.Header().Del("Repr-Digest")
+                g.gz = gzip.NewWriter(g.ResponseWriter)
+        }
+        g.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+        if !g.wroteHeader {
+                g.WriteHeader(http.StatusOK)
+        }
+        if g.gz == nil {
+                return g.ResponseWriter.Write(b)
+        }
+        return g.gz.Write(b)
+}
+
+// Flush pushes buffered compressed bytes to the client
+func (g *gzipResponseWriter) Flush() {
+        if g.gz != nil {
+                g.gz.Flush()
+        }
+        if f, ok := g.ResponseWriter.(http.Flusher); ok {
+                f.Flush()
+        }
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+        return g.ResponseWriter
+}
+
+func (g *gzipResponseWriter) close() {
+        if g.gz != nil {
+                g.gz.Close()
+        }
+}
+
+// Compress responses with gzip when enabled and accepted by the client
+func compressionMiddleware(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                if !cfg.ResponseGzipEnabled || r.Method == http.MethodHead ||
+                        !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+                        next.ServeHTTP(w, r)
+                        return
+                }
+
+                w.Header().Add("Vary", "Accept-Encoding")
+
+                gw := &gzipResponseWriter{ResponseWriter: w}
+                defer gw.close()
+
+                next.ServeHTTP(gw, r)
+        })
+}
+
+// Report whether the client asked for a minimal representation via the Prefer header.
+// Both the RFC 7240 form ("return=minimal") and the shorthand "minimal" are accepted.
+func prefersMinimal(r *http.Request) bool {
+        for _, pref := range strings.Split(r.Header.Get("Prefer"), ",") {
+                pref = strings.TrimSpace(pref)
+                if pref == "minimal" || pref == "return=minimal" {
+                        return true
+                }
+        }
+        return false
+}
+
+// Strip optional echo fields from a CRDT response for minimal-preference clients
+func minimizeCRDTResponse(w http.ResponseWriter, r *http.Request, response *CRDTResponse) {
+        if !prefersMinimal(r) {
+                return
+        }
+        response.ProcessedAt = nil
+        w.Header().Set("Preference-Applied", "return=minimal")
+}
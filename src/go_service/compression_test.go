@@ -0,0 +1,140 @@
+package main
+
+import (
+        "compress/gzip"
+        "encoding/json"
+        "io"
+        "net/http"
+        "net/http/httptest"
+        "testing"
+        "time"
+)
+
+func encodeCRDTResponse(t *testing.T, prefer string) (map[string]interface{}, http.Header) {
+        t.Helper()
+        processed := time.Date(2026, 3, 14, 9, 26, 53, 0, time.UTC)
+        response := CRDTResponse{
+                SessionID:    "7d1c8e6a-2f4b-4a51-9b0e-3c2d1f0a9e88",
+                Status:       "merged",
+                VectorClock:  map[string]int64{"tablet-a": 3, "server": 9},
+                ProcessedAt:  &processed,
+                AppliedCount: 2,
+        }
+
+        r := httptest.NewRequest(http.MethodPost, "/v1/tests/sessions/x/results", nil)
+        if prefer != "" {
+                r.Header.Set("Prefer", prefer)
+        }
+        w := httptest.NewRecorder()
+        minimizeCRDTResponse(w, r, &response)
+        writeJSON(w, http.StatusOK, response)
+
+        var body map[string]interface{}
+        if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+                t.Fatalf("invalid JSON: %v", err)
+        }
+        return body, w.Header()
+}
+
+func TestMinimalCRDTResponseOmitsEchoFields(t *testing.T) {
+        full, fullHeaders := encodeCRDTResponse(t, "")
+        if _, ok := full["processed_at"]; !ok {
+                t.Errorf("full response is missing processed_at: %v", full)
+        }
+        if fullHeaders.Get("Preference-Applied") != "" {
+                t.Errorf("full response set Preference-Applied")
+        }
+
+        for _, prefer := range []string{"return=minimal", "minimal", "respond-async, return=minimal"} {
+                minimal, headers := encodeCRDTResponse(t, prefer)
+                if _, ok := minimal["processed_at"]; ok {
+                        t.Errorf("Prefer %q: minimal response still has processed_at", prefer)
+                }
+                if got := headers.Get("Preference-Applied"); got != "return=minimal" {
+                        t.Errorf("Prefer %q: Preference-Applied = %q", prefer, got)
+                }
+                // Everything else in the body is unchanged
+                delete(full, "processed_at")
+                for key, value := range full {
+                        if got, _ := json.Marshal(minimal[key]); string(got) != mustJSON(t, value) {
+                                t.Errorf("Prefer %q: %s = %s, want %s", prefer, key, got, mustJSON(t, value))
+                        }
+                }
+        }
+}
+
+func TestPreferReturnRepresentationIsNotMinimal(t *testing.T) {
+        body, _ := encodeCRDTResponse(t, "return=representation")
+        if _, ok := body["processed_at"]; !ok {
+                t.Errorf("return=representation dropped processed_at")
+        }
+}
+
+func TestCompressionMiddleware(t *testing.T) {
+        withConfig(t, func(c *Config) { c.ResponseGzipEnabled = true })
+        payload := `{"session_id":"abc","status":"merged"}`
+        handler := compressionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                if r.URL.Path == "/empty" {
+                        w.WriteHeader(http.StatusNoContent)
+                        return
+                }
+                io.WriteString(w, payload)
+        }))
+
+        r := httptest.NewRequest(http.MethodGet, "/", nil)
+        r.Header.Set("Accept-Encoding", "gzip, deflate")
+        w := httptest.NewRecorder()
+        handler.ServeHTTP(w, r)
+        if w.Header().Get("Content-Encoding") != "gzip" {
+                t.Fatalf("Content-Encoding = %q, want gzip", w.Header().Get("Content-Encoding"))
+        }
+        gz, err := gzip.NewReader(w.Body)
+        if err != nil {
+                t.Fatal(err)
+        }
+        decoded, _ := io.ReadAll(gz)
+        if string(decoded) != payload {
+                t.Errorf("decoded body = %q, want %q", decoded, payload)
+        }
+
+        r = httptest.NewRequest(http.MethodGet, "/empty", nil)
+        r.Header.Set("Accept-Encoding", "gzip")
+        w = httptest.NewRecorder()
+        handler.ServeHTTP(w, r)
+        if w.Code != http.StatusNoContent || w.Header().Get("Content-Encoding") != "" || w.Body.Len() != 0 {
+                t.Errorf("204 response was encoded: %d %q %d bytes", w.Code, w.Header().Get("Content-Encoding"), w.Body.Len())
+        }
+
+        // Clients that do not accept gzip get the identity body
+        r = httptest.NewRequest(http.MethodGet, "/", nil)
+        w = httptest.NewRecorder()
+        handler.ServeHTTP(w, r)
+        if w.Body.String() != payload {
+                t.Errorf("identity body = %q", w.Body.String())
+        }
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+        t.Helper()
+        b, err := json.Marshal(v)
+        if err != nil {
+                t.Fatal(err)
+        }
+        return string(b)
+}
+
+func TestCompressionSkipsHead(t *testing.T) {
+        withConfig(t, func(c *Config) { c.ResponseGzipEnabled = true })
+        handler := compressionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                w.Header().Set("Content-Length", "42")
+                w.WriteHeader(http.StatusOK)
+        }))
+        r := httptest.NewRequest(http.MethodHead, "/", nil)
+        r.Header.Set("Accept-Encoding", "gzip")
+        w := httptest.NewRecorder()
+        handler.ServeHTTP(w, r)
+        if w.Header().Get("Content-Encoding") != "" || w.Header().Get("Content-Length") != "42" {
+                t.Errorf("HEAD headers rewritten: encoding %q, length %q",
+                        w.Header().Get("Content-Encoding"), w.Header().Get("Content-Length"))
+        }
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+        "log"
+        "os"
+        "strconv"
+        "strings"
+        "time"
+)
+
+// Service configuration sourced from environment variables
+type Config struct {
+        // Evidence quotas (0 disables the corresponding limit)
+        SessionMaxEvidenceCount int64
+        SessionMaxEvidenceBytes int64
+        UserMaxEvidenceCount    int64
+        UserMaxEvidenceBytes    int64
+
+        // Gzip-compress responses for clients that accept it
+        ResponseGzipEnabled bool
+
+        // Long-poll watch timeouts
+        LongPollDefaultTimeout time.Duration
+        LongPollMaxTimeout     time.Duration
+
+        // Interval between SSE heartbeat comments (0 disables)
+        SSEHeartbeatInterval time.Duration
+
+        // Template name -> template session ID used to seed new sessions
+        SessionTemplates map[string]string
+
+        // Directory backing the filesystem evidence store, and the location (e.g.
+        // region or bucket) and storage class reported on evidence records
+        EvidenceStoreDir      string
+        EvidenceStoreLocation string
+        EvidenceStoreClass    string
+        // Compare the stored object's size with the upload after each write
+        EvidenceVerifyStoredSize bool
+
+        // Queries slower than this are logged at warn level (0 disables)
+        SlowQueryThreshold time.Duration
+
+        // Diagnostics captured for requests running longer than the threshold (0
+        // disables): goroutine dumps, plus execution traces of the given duration,
+        // written to the directory at most once per interval
+        SlowRequestProfileThreshold time.Duration
+        SlowRequestProfileDir       string
+        SlowRequestProfileInterval  time.Duration
+        SlowRequestTraceDuration    time.Duration
+
+        // /memory endpoint exposure
+        MemoryEndpointEnabled     bool
+        MemoryEndpointRequireAuth bool
+
+        // Ceiling on gzip-decoded request body size
+        MaxDecompressedBytes int64
+
+        // Write vector clocks as bare maps instead of the versioned envelope.
+        // On by default: the Python app still reads vector_clock as a bare map.
+        VectorClockLegacyFormat bool
+
+        // Evidence malware scanning ("" disables, "clamd" uses a clamd daemon)
+        EvidenceScanner string
+        ClamdAddress    string
+        ScanTimeout     time.Duration
+
+        // Refresh vector_clock to the stored clock on idempotent CRDT replays
+        ReplayRefreshVectorClock bool
+
+        // CRDT merge strategy and change timestamp skew handling
+        MergeStrategy             string
+        ChangeTimestampMaxSkew    time.Duration
+        ChangeTimestampSkewPolicy string
+        // Strategies clients may select per request with X-Merge-Strategy
+        MergeStrategyOverrideAllowlist string
+        // This server's own vector clock node, advanced on every merge ("" disables),
+        // and whether payloads omitting it are merged ("advance") or refused ("reject")
+        ServerNodeID            string
+        ServerNodeMissingPolicy string
+        // Changes older than the session's latest write by more than this are
+        // rejected as stale (0 accepts them)
+        ChangeLateGraceWindow time.Duration
+        // Handling of unknown top-level CRDT payload fields: ignore, warn or reject
+        CRDTUnknownFieldPolicy string
+        // Accept CRDT posts without changes as vector-clock-only updates
+        CRDTAllowClockOnly bool
+
+        // Server-side statement_timeout for pooled connections (0, the default,
+        // leaves the database's own setting in place)
+        DBStatementTimeout time.Duration
+
+        // Emit Repr-Digest on JSON responses (evidence downloads always carry it)
+        JSONReprDigest bool
+
+        // Per-tenant routing ("none", "schema" or "database") keyed by the tenant_id JWT claim
+        TenantRouting      string
+        TenantSchemaPrefix string
+        TenantDatabaseURLs map[string]string
+        TenantPoolMaxConns int64
+
+        // Local spool for evidence when the store is unavailable ("" disables)
+        EvidenceSpoolDir               string
+        EvidenceSpoolReconcileInterval time.Duration
+
+        // Maximum object/array nesting depth accepted in CRDT payloads (0 disables)
+        MaxJSONDepth int64
+
+        // Goroutine/FD leak sampling (interval 0 disables)
+        LeakSampleInterval           time.Duration
+        LeakWindowSamples            int64
+        LeakGoroutineGrowthThreshold int64
+        LeakFDGrowthThreshold        int64
+
+        // Webhooks notified after evidence uploads and session merges ("" disables)
+        EvidenceWebhookURL string
+        SessionWebhookURL  string
+        WebhookTimeout     time.Duration
+
+        // Suggest the closest known route in 404 responses
+        RouteSuggestionsEnabled    bool
+        RouteSuggestionMaxDistance int64
+
+        // Accepted idempotency key length range in bytes (max 0 disables the upper bound)
+        IdempotencyKeyMinLength int64
+        IdempotencyKeyMaxLength int64
+        // Required idempotency key format: any, uuid or ulid
+        IdempotencyKeyFormat string
+        // Include evidence filenames in upload idempotency fingerprints
+        IdempotencyFingerprintFilename bool
+        // Completed keys first stored longer ago than this are not replayed (0
+        // disables): "reprocess" handles the request afresh, "reject" returns 422
+        IdempotencyKeyMaxAge       time.Duration
+        IdempotencyKeyMaxAgePolicy string
+
+        // Evidence uploads per user per minute (0 disables), with per-user/tenant overrides
+        EvidenceRateLimitPerMinute int64
+        EvidenceRateLimitOverrides map[string]string
+
+        // /readyz probe timeout; an unreachable evidence store fails readiness only when critical
+        ReadyzTimeout       time.Duration
+        ReadyzStoreCritical bool
+        // Background jobs are stale after this many of their intervals without a
+        // successful run; stale jobs in CRITICAL_JOBS make /readyz fail, others degrade it
+        JobStaleIntervals int64
+        CriticalJobs      string
+
+        // In-progress idempotency claims: typical processing time (for Retry-After)
+        // and the age after which an unfinished claim is considered abandoned
+        IdempotencyExpectedDuration time.Duration
+        IdempotencyClaimTTL         time.Duration
+
+        // CRDT payload signature verification: client_id -> "hmac:<b64>" or "ed25519:<b64>"
+        RequireSignedPayloads bool
+        PayloadSigningKeys    map[string]string
+        // Key signing evidence bundle manifests: "hmac:<b64>" or "ed25519:<b64 seed>"
+        EvidenceBundleSigningKey string
+
+        // Background worker pool for post-upload processing
+        WorkerPoolSize  int64
+        WorkerQueueSize int64
+
+        // Generate thumbnails for uploaded images as linked child evidence
+        EvidenceThumbnailsEnabled bool
+        ThumbnailMaxDimension     int64
+
+        // Error status classes cached under idempotency keys (e.g. "4xx"); 5xx, 408, 429
+        // and responses with Retry-After are never cached, nor are errors returned
+        // before the key is claimed
+        IdempotencyCacheErrorClasses string
+        // Send Idempotency-Status (and Idempotency-Replayed on replays) on keyed requests
+        IdempotencyStatusHeaders bool
+
+        // Longer evidence filenames are truncated (0 disables)
+        MaxEvidenceFilenameLength int64
+
+        // Adaptive load shedding gates (0 disables each) and the maximum shed rate
+        LoadShedLatencyThreshold time.Duration
+        LoadShedMaxInFlight      int64
+        LoadShedMaxPercent       int64
+
+        // X-Server-Load response header, and the in-flight request count treated
+        // as full load (0 reports database pool saturation only)
+        ServerLoadHeaderEnabled bool
+        ServerLoadMaxInFlight   int64
+
+        // Maximum distinct nodes in a session's vector clock (0 disables)
+        MaxVectorClockNodes int64
+        // Largest counter accepted in a client vector clock (0 allows any int64);
+        // the default keeps counters exact for JavaScript clients
+        MaxVectorClockCounter int64
+
+        // Role claim required for admin endpoints
+        AdminRole string
+        // Require X-User-ID to match the token's sub claim unless the token carries
+        // the service account role, which may act on behalf of any user. Off by
+        // default: enable once every caller sends its own subject or a service token
+        VerifyUserIDSubject bool
+        ServiceAccountRole  string
+        // Enforce per-route JWT scopes, with "METHOD /path=scopes" overrides
+        RequireScopes bool
+        RouteScopes   map[string]string
+
+        // Comma-separated audit value keys redacted from audit API responses
+        AuditRedactFields string
+
+        // Pool health: idle connection check period, and acquire-time pings of
+        // connections idle longer than the threshold (0 disables pings)
+        DBHealthCheckPeriod time.Duration
+        DBPingIdleThreshold time.Duration
+        DBPingTimeout       time.Duration
+
+        // Request header limits: total bytes (http.Server.MaxHeaderBytes; 0 keeps
+        // net/http's 1 MiB default) and distinct fields (0 disables the field count check)
+        MaxHeaderBytes    int64
+        MaxRequestHeaders int64
+
+        // Comma-separated JSON pointers that cannot change once set (pre-commit hook)
+        CRDTFinalizedFields string
+
+        // TLS is enabled when a certificate is configured; a client CA enables mTLS.
+        // Cipher suites are a comma-separated list of Go suite names (TLS 1.2 only).
+        TLSCertFile     string
+        TLSKeyFile      string
+        TLSClientCAFile string
+        TLSMinVersion   string
+        TLSCipherSuites string
+
+        // Persist CRDT payloads rejected with non-retriable (4xx) errors for replay
+        CRDTDeadLetterEnabled bool
+
+        // Comma-separated test_sessions statuses that reject new evidence
+        EvidenceClosedSessionStatuses string
+
+        // Prefix mixed into idempotency key hashes to isolate services sharing a database
+        IdempotencyNamespace string
+
+        // Maximum in-flight evidence uploads per session (0 disables)
+        SessionMaxConcurrentUploads int64
+        // Maximum in-flight CRDT merges per session, beyond which requests get 429 (0 disables)
+        SessionMaxConcurrentMerges int64
+
+        // Idempotency key TTL extension: default extension and the longest a key
+        // may live after it was first stored
+        IdempotencyExtendDefaultTTL time.Duration
+        IdempotencyKeyMaxLifetime   time.Duration
+
+        // Sliding window for /stats/latency, split into slots that expire in turn,
+        // and an optional p99 latency objective it reports against (0 disables)
+        LatencyWindow      time.Duration
+        LatencyWindowSlots int64
+        LatencySLOP99      time.Duration
+
+        // RFC 3161 timestamping authority for evidence hashes ("" disables), with
+        // the retry cadence for pending requests
+        TSAURL           string
+        TSATimeout       time.Duration
+        TSARetryInterval time.Duration
+        TSAMaxAttempts   int64
+
+        // Evidence file size limits: a global default and per-type overrides from
+        // MAX_BYTES_<TYPE> variables, keyed by lower-cased type (0 means unlimited)
+        EvidenceMaxBytes     int64
+        EvidenceTypeMaxBytes map[string]int64
+
+        // Share one query among concurrent GETs of the same session
+        SessionReadCoalescing bool
+
+        // Largest response cached for idempotent replay (0 disables the limit)
+        IdempotencyMaxResponseBytes int64
+
+        // Replays of a CRDT write transaction aborted by a database failover, and
+        // the backoff before the first replay (doubling after each)
+        DBFailoverMaxRetries   int64
+        DBFailoverRetryBackoff time.Duration
+
+        // HTTP server timeouts (0 disables each)
+        ServerReadTimeout       time.Duration
+        ServerReadHeaderTimeout time.Duration
+        ServerWriteTimeout      time.Duration
+        ServerIdleTimeout       time.Duration
+
+        // Start in maintenance mode, rejecting non-probe traffic with this message
+        // and Retry-After
+        MaintenanceMode       bool
+        MaintenanceMessage    string
+        MaintenanceRetryAfter time.Duration
+
+        // Session GETs whose stored data exceeds this many bytes are streamed from
+        // the database rather than buffered (0 disables)
+        SessionStreamThreshold int64
+
+        // Serve Prometheus metrics on /metrics; when off, JSON stats on /stats instead
+        PrometheusEnabled bool
+
+        // Base64 32-byte key wrapping per-object evidence data keys; empty disables encryption at rest
+        EvidenceEncryptionKey   string
+        EvidenceEncryptionKeyID string
+
+        // Abort uploads that send no bytes for this long (408); 0, the default, disables
+        UploadIdleTimeout time.Duration
+
+        // Consecutive evidence store failures that open its circuit breaker (0 disables), and how long it stays open
+        EvidenceStoreBreakerThreshold int64
+        EvidenceStoreBreakerCooldown  time.Duration
+
+        // How far past server time a client-asserted evidence captured_at may be
+        EvidenceCapturedAtMaxSkew time.Duration
+
+        // Handling of uploads failing hash verification: reject, or quarantine to EVIDENCE_QUARANTINE_DIR
+        HashMismatchPolicy    string
+        EvidenceQuarantineDir string
+
+        // Maximum items in one CRDT batch sync request (0 disables)
+        MaxBatchItems int64
+
+        // Outbox relay polling and retry limits
+        OutboxPollInterval time.Duration
+        OutboxBatchSize    int64
+        OutboxMaxAttempts  int64
+}
+
+// Active configuration, loaded once at startup
+var cfg = loadConfig()
+
+// Load configuration from the environment, falling back to defaults
+func loadConfig() Config {
+        return Config{
+                SessionMaxEvidenceCount:        envInt64("EVIDENCE_QUOTA_SESSION_MAX_COUNT", 0),
+                SessionMaxEvidenceBytes:        envInt64("EVIDENCE_QUOTA_SESSION_MAX_BYTES", 0),
+                UserMaxEvidenceCount:           envInt64("EVIDENCE_QUOTA_USER_MAX_COUNT", 0),
+                UserMaxEvidenceBytes:           envInt64("EVIDENCE_QUOTA_USER_MAX_BYTES", 0),
+                ResponseGzipEnabled:            envBool("RESPONSE_GZIP_ENABLED", false),
+                LongPollDefaultTimeout:         envDuration("LONG_POLL_DEFAULT_TIMEOUT", 25*time.Second),
+                LongPollMaxTimeout:             envDuration("LONG_POLL_MAX_TIMEOUT", 60*time.Second),
+                SSEHeartbeatInterval:           envDuration("SSE_HEARTBEAT_INTERVAL", 15*time.Second),
+                SessionTemplates:               envMap("SESSION_TEMPLATES"),
+                EvidenceStoreDir:               envString("EVIDENCE_STORE_DIR", "data/evidence"),
+                EvidenceStoreLocation:          envString("EVIDENCE_STORE_LOCATION", "local"),
+                EvidenceStoreClass:             envString("EVIDENCE_STORE_CLASS", "standard"),
+                EvidenceStoreBreakerThreshold:  envInt64("EVIDENCE_STORE_BREAKER_THRESHOLD", 5),
+                EvidenceStoreBreakerCooldown:   envDuration("EVIDENCE_STORE_BREAKER_COOLDOWN", 30*time.Second),
+                EvidenceCapturedAtMaxSkew:      envDuration("EVIDENCE_CAPTURED_AT_MAX_SKEW", 5*time.Minute),
+                HashMismatchPolicy:             envString("HASH_MISMATCH_POLICY", hashMismatchReject),
+                EvidenceQuarantineDir:          envString("EVIDENCE_QUARANTINE_DIR", "data/quarantine"),
+                EvidenceVerifyStoredSize:       envBool("EVIDENCE_VERIFY_STORED_SIZE", true),
+                SlowQueryThreshold:             envDuration("SLOW_QUERY_THRESHOLD", 200*time.Millisecond),
+                SlowRequestProfileThreshold:    envDuration("SLOW_REQUEST_PROFILE_THRESHOLD", 0),
+                SlowRequestProfileDir:          envString("SLOW_REQUEST_PROFILE_DIR", "data/diagnostics"),
+                SlowRequestProfileInterval:     envDuration("SLOW_REQUEST_PROFILE_INTERVAL", time.Minute),
+                SlowRequestTraceDuration:       envDuration("SLOW_REQUEST_TRACE_DURATION", 0),
+                MemoryEndpointEnabled:          envBool("ENABLE_MEMORY_ENDPOINT", true),
+                MemoryEndpointRequireAuth:      envBool("MEMORY_ENDPOINT_REQUIRE_AUTH", true),
+                MaxDecompressedBytes:           envInt64("MAX_DECOMPRESSED_BYTES", 64<<20),
+                VectorClockLegacyFormat:        envBool("VECTOR_CLOCK_LEGACY_FORMAT", true),
+                EvidenceScanner:                envString("EVIDENCE_SCANNER", ""),
+                ClamdAddress:                   envString("CLAMD_ADDRESS", "localhost:3310"),
+                ScanTimeout:                    envDuration("EVIDENCE_SCAN_TIMEOUT", 30*time.Second),
+                ReplayRefreshVectorClock:       envBool("IDEMPOTENCY_REPLAY_REFRESH_CLOCK", false),
+                MergeStrategy:                  envString("MERGE_STRATEGY", MergeStrategyOverwrite),
+                MergeStrategyOverrideAllowlist: envString("MERGE_STRATEGY_OVERRIDE_ALLOWLIST", ""),
+                ServerNodeID:                   envString("SERVER_NODE_ID", ""),
+                ServerNodeMissingPolicy:        envString("SERVER_NODE_MISSING_POLICY", serverNodeMissingAdvance),
+                ChangeTimestampMaxSkew:         envDuration("CHANGE_TIMESTAMP_MAX_SKEW", 5*time.Minute),
+                ChangeTimestampSkewPolicy:      envString("CHANGE_TIMESTAMP_SKEW_POLICY", skewPolicyReject),
+                CRDTUnknownFieldPolicy:         envString("CRDT_UNKNOWN_FIELD_POLICY", unknownFieldsIgnore),
+                CRDTAllowClockOnly:             envBool("CRDT_ALLOW_CLOCK_ONLY", false),
+                DBStatementTimeout:             envDuration("DB_STATEMENT_TIMEOUT", 0),
+                JSONReprDigest:                 envBool("JSON_REPR_DIGEST", false),
+                TenantRouting:                  envString("TENANT_ROUTING", TenantRoutingNone),
+                TenantSchemaPrefix:             envString("TENANT_SCHEMA_PREFIX", "tenant_"),
+                TenantDatabaseURLs:             envMap("TENANT_DATABASE_URLS"),
+                TenantPoolMaxConns:             envInt64("TENANT_POOL_MAX_CONNS", 10),
+                EvidenceSpoolDir:               envString("EVIDENCE_SPOOL_DIR", ""),
+                EvidenceSpoolReconcileInterval: envDuration("EVIDENCE_SPOOL_RECONCILE_INTERVAL", 30*time.Second),
+                MaxJSONDepth:                   envInt64("MAX_JSON_DEPTH", 32),
+                LeakSampleInterval:             envDuration("LEAK_SAMPLE_INTERVAL", 30*time.Second),
+                LeakWindowSamples:              envInt64("LEAK_WINDOW_SAMPLES", 10),
+                LeakGoroutineGrowthThreshold:   envInt64("LEAK_GOROUTINE_GROWTH_THRESHOLD", 100),
+                LeakFDGrowthThreshold:          envInt64("LEAK_FD_GROWTH_THRESHOLD", 50),
+                EvidenceWebhookURL:             envString("EVIDENCE_WEBHOOK_URL", ""),
+                SessionWebhookURL:              envString("SESSION_WEBHOOK_URL", ""),
+                WebhookTimeout:                 envDuration("WEBHOOK_TIMEOUT", 5*time.Second),
+                RouteSuggestionsEnabled:        envBool("ROUTE_SUGGESTIONS_ENABLED", true),
+                RouteSuggestionMaxDistance:     envInt64("ROUTE_SUGGESTION_MAX_DISTANCE", 3),
+                IdempotencyKeyMinLength:        envInt64("IDEMPOTENCY_KEY_MIN_LENGTH", 1),
+                IdempotencyKeyMaxLength:        envInt64("IDEMPOTENCY_KEY_MAX_LENGTH", 255),
+                IdempotencyKeyFormat:           envString("IDEMPOTENCY_KEY_FORMAT", idempotencyKeyFormatAny),
+                IdempotencyFingerprintFilename: envBool("IDEMPOTENCY_FINGERPRINT_FILENAME", true),
+                IdempotencyKeyMaxAge:           envDuration("IDEMPOTENCY_KEY_MAX_AGE", 0),
+                IdempotencyKeyMaxAgePolicy:     envString("IDEMPOTENCY_KEY_MAX_AGE_POLICY", idempotencyMaxAgeReprocess),
+                EvidenceRateLimitPerMinute:     envInt64("EVIDENCE_RATE_LIMIT_PER_MINUTE", 0),
+                EvidenceRateLimitOverrides:     envMap("EVIDENCE_RATE_LIMIT_OVERRIDES"),
+                ReadyzTimeout:                  envDuration("READYZ_TIMEOUT", 2*time.Second),
+                ReadyzStoreCritical:            envBool("READYZ_STORE_CRITICAL", true),
+                JobStaleIntervals:              envInt64("JOB_STALE_INTERVALS", 3),
+                CriticalJobs:                   envString("CRITICAL_JOBS", jobOutboxRelay),
+                IdempotencyExpectedDuration:    envDuration("IDEMPOTENCY_EXPECTED_DURATION", 5*time.Second),
+                IdempotencyClaimTTL:            envDuration("IDEMPOTENCY_CLAIM_TTL", 5*time.Minute),
+                RequireSignedPayloads:          envBool("REQUIRE_SIGNED_PAYLOADS", false),
+                PayloadSigningKeys:             envMap("PAYLOAD_SIGNING_KEYS"),
+                EvidenceBundleSigningKey:       envString("EVIDENCE_BUNDLE_SIGNING_KEY", ""),
+                EvidenceEncryptionKey:          envString("EVIDENCE_ENCRYPTION_KEY", ""),
+                EvidenceEncryptionKeyID:        envString("EVIDENCE_ENCRYPTION_KEY_ID", "default"),
+                WorkerPoolSize:                 envInt64("WORKER_POOL_SIZE", 4),
+                WorkerQueueSize:                envInt64("WORKER_QUEUE_SIZE", 100),
+                EvidenceThumbnailsEnabled:      envBool("EVIDENCE_THUMBNAILS_ENABLED", false),
+                ThumbnailMaxDimension:          envInt64("THUMBNAIL_MAX_DIMENSION", 256),
+                IdempotencyCacheErrorClasses:   envString("IDEMPOTENCY_CACHE_ERROR_CLASSES", ""),
+                IdempotencyStatusHeaders:       envBool("IDEMPOTENCY_STATUS_HEADERS", true),
+                MaxEvidenceFilenameLength:      envInt64("MAX_EVIDENCE_FILENAME_LENGTH", 255),
+                LoadShedLatencyThreshold:       envDuration("LOAD_SHED_LATENCY_THRESHOLD", 0),
+                LoadShedMaxInFlight:            envInt64("LOAD_SHED_MAX_IN_FLIGHT", 0),
+                LoadShedMaxPercent:             envInt64("LOAD_SHED_MAX_PERCENT", 50),
+                MaxVectorClockNodes:            envInt64("MAX_VECTOR_CLOCK_NODES", 256),
+                MaxVectorClockCounter:          envInt64("MAX_VECTOR_CLOCK_COUNTER", 1<<53-1),
+                AdminRole:                      envString("ADMIN_ROLE", "admin"),
+                VerifyUserIDSubject:            envBool("VERIFY_USER_ID_SUBJECT", false),
+                ServiceAccountRole:             envString("SERVICE_ACCOUNT_ROLE", "service"),
+                RequireScopes:                  envBool("REQUIRE_SCOPES", false),
+                RouteScopes:                    envMap("ROUTE_SCOPES"),
+                AuditRedactFields:              envString("AUDIT_REDACT_FIELDS", ""),
+                DBHealthCheckPeriod:            envDuration("DB_HEALTH_CHECK_PERIOD", 30*time.Second),
+                DBPingIdleThreshold:            envDuration("DB_PING_IDLE_THRESHOLD", 30*time.Second),
+                DBPingTimeout:                  envDuration("DB_PING_TIMEOUT", time.Second),
+                OutboxPollInterval:             envDuration("OUTBOX_POLL_INTERVAL", time.Second),
+                OutboxBatchSize:                envInt64("OUTBOX_BATCH_SIZE", 50),
+                OutboxMaxAttempts:              envInt64("OUTBOX_MAX_ATTEMPTS", 20),
+                MaxBatchItems:                  envInt64("MAX_BATCH_ITEMS", 100),
+                UploadIdleTimeout:              envDuration("UPLOAD_IDLE_TIMEOUT", 0),
+                PrometheusEnabled:              envBool("PROMETHEUS_ENABLED", true),
+                SessionStreamThreshold:         envInt64("SESSION_STREAM_THRESHOLD", 1<<20),
+                MaintenanceMode:                envBool("MAINTENANCE_MODE", false),
+                MaintenanceMessage:             envString("MAINTENANCE_MESSAGE", "Service is under maintenance"),
+                MaintenanceRetryAfter:          envDuration("MAINTENANCE_RETRY_AFTER", 60*time.Second),
+                ServerReadTimeout:              envDuration("SERVER_READ_TIMEOUT", 15*time.Second),
+                ServerReadHeaderTimeout:        envDuration("SERVER_READ_HEADER_TIMEOUT", 5*time.Second),
+                ServerWriteTimeout:             envDuration("SERVER_WRITE_TIMEOUT", 15*time.Second),
+                ServerIdleTimeout:              envDuration("SERVER_IDLE_TIMEOUT", 60*time.Second),
+                ServerLoadHeaderEnabled:        envBool("SERVER_LOAD_HEADER_ENABLED", true),
+                ServerLoadMaxInFlight:          envInt64("SERVER_LOAD_MAX_IN_FLIGHT", 0),
+                DBFailoverMaxRetries:           envInt64("DB_FAILOVER_MAX_RETRIES", 3),
+                DBFailoverRetryBackoff:         envDuration("DB_FAILOVER_RETRY_BACKOFF", 200*time.Millisecond),
+                IdempotencyMaxResponseBytes:    envInt64("IDEMPOTENCY_MAX_RESPONSE_BYTES", 0),
+                SessionReadCoalescing:          envBool("SESSION_READ_COALESCING", true),
+                EvidenceMaxBytes:               envInt64("MAX_EVIDENCE_BYTES", 0),
+                EvidenceTypeMaxBytes:           envInt64Prefix("MAX_BYTES_"),
+                TSAURL:                         envString("TSA_URL", ""),
+                TSATimeout:                     envDuration("TSA_TIMEOUT", 10*time.Second),
+                TSARetryInterval:               envDuration("TSA_RETRY_INTERVAL", 5*time.Second),
+                TSAMaxAttempts:                 envInt64("TSA_MAX_ATTEMPTS", 50),
+                LatencyWindow:                  envDuration("LATENCY_WINDOW", 5*time.Minute),
+                LatencyWindowSlots:             envInt64("LATENCY_WINDOW_SLOTS", 10),
+                LatencySLOP99:                  envDuration("LATENCY_SLO_P99", 0),
+                IdempotencyExtendDefaultTTL:    envDuration("IDEMPOTENCY_EXTEND_DEFAULT_TTL", 24*time.Hour),
+                IdempotencyKeyMaxLifetime:      envDuration("IDEMPOTENCY_KEY_MAX_LIFETIME", 7*24*time.Hour),
+                SessionMaxConcurrentUploads:    envInt64("SESSION_MAX_CONCURRENT_UPLOADS", 0),
+                SessionMaxConcurrentMerges:     envInt64("SESSION_MAX_CONCURRENT_MERGES", 0),
+                ChangeLateGraceWindow:          envDuration("CHANGE_LATE_GRACE_WINDOW", 0),
+                IdempotencyNamespace:           envString("IDEMPOTENCY_NAMESPACE", ""),
+                EvidenceClosedSessionStatuses:  envString("EVIDENCE_CLOSED_SESSION_STATUSES", "finalized,archived"),
+                CRDTDeadLetterEnabled:          envBool("CRDT_DEAD_LETTER_ENABLED", true),
+                TLSCertFile:                    envString("TLS_CERT_FILE", ""),
+                TLSKeyFile:                     envString("TLS_KEY_FILE", ""),
+                TLSClientCAFile:                envString("TLS_CLIENT_CA_FILE", ""),
+                TLSMinVersion:                  envString("TLS_MIN_VERSION", "1.2"),
+                TLSCipherSuites:                envString("TLS_CIPHER_SUITES", ""),
+                CRDTFinalizedFields:            envString("CRDT_FINALIZED_FIELDS", ""),
+                MaxHeaderBytes:                 envInt64("MAX_HEADER_BYTES", 0),
+                MaxRequestHeaders:              envInt64("MAX_REQUEST_HEADERS", 100),
+        }
+}
+
+// Read every int64 variable named <prefix><SUFFIX>, keyed by lower-cased suffix,
+// logging and ignoring malformed values
+func envInt64Prefix(prefix string) map[string]int64 {
+        result := make(map[string]int64)
+        for _, entry := range os.Environ() {
+                name, _, _ := strings.Cut(entry, "=")
+                suffix, ok := strings.CutPrefix(name, prefix)
+                if !ok || suffix == "" {
+                        continue
+                }
+                if v := envInt64(name, -1); v >= 0 {
+                        result[strings.ToLower(suffix)] = v
+                }
+        }
+        return result
+}
+
+// Read a string environment variable with a default
+func envString(key, def string) string {
+        if v := os.Getenv(key); v != "" {
+                return v
+        }
+        return def
+}
+
+// Read an int64 environment variable, logging and ignoring malformed values
+func envInt64(key string, def int64) int64 {
+        raw := os.Getenv(key)
+        if raw == "" {
+                return def
+        }
+        v, err := strconv.ParseInt(raw, 10, 64)
+        if err != nil {
+                log.Printf("Invalid value for %s (%q), using default %d", key, raw, def)
+                return def
+        }
+        return v
+}
+
+// Read a boolean environment variable, logging and ignoring malformed values
+func envBool(key string, def bool) bool {
+        raw := os.Getenv(key)
+        if raw == "" {
+                return def
+        }
+        v, err := strconv.ParseBool(raw)
+        if err != nil {
+                log.Printf("Invalid value for %s (%q), using default %t", key, raw, def)
+                return def
+        }
+        return v
+}
+
+// Read a duration environment variable (e.g. "500ms", "30s"), logging and ignoring malformed values
+func envDuration(key string, def time.Duration) time.Duration {
+        raw := os.Getenv(key)
+        if raw == "" {
+                return def
+        }
+        v, err := time.ParseDuration(raw)
+        if err != nil {
+                log.Printf("Invalid value for %s (%q), using default %s", key, raw, def)
+                return def
+        }
+        return v
+}
+
+// Read a comma-separated list of key=value pairs (e.g. "a=1,b=2")
+func envMap(key string) map[string]string {
+        result := make(map[string]string)
+        for _, pair := range strings.Split(os.Getenv(key), ",") {
+                pair = strings.TrimSpace(pair)
+                if pair == "" {
+                        continue
+                }
+                k, v, ok := strings.Cut(pair, "=")
+                if !ok {
+                        log.Printf("Ignoring malformed entry in %s: %q", key, pair)
+                        continue
+                }
+                result[strings.TrimSpace(k)] = strings.TrimSpace(v)
+        }
+        return result
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+        "bufio"
+        "bytes"
+        "fmt"
+        "mime/multipart"
+        "net"
+        "net/http"
+        "net/http/httptest"
+        "strings"
+        "testing"
+        "time"
+)
+
+// Serve handleEvidence behind the decompression middleware, as the router does
+func newEvidenceServer(t *testing.T) string {
+        t.Helper()
+        server := httptest.NewServer(decompressionMiddleware(http.HandlerFunc(handleEvidence)))
+        t.Cleanup(server.Close)
+        return strings.TrimPrefix(server.URL, "http://")
+}
+
+// Send request headers with Expect: 100-continue and return the first
+// response status line the server writes, without sending the body
+func sendExpectContinue(t *testing.T, addr string, header http.Header, contentLength int) (net.Conn, *bufio.Reader, string) {
+        t.Helper()
+        conn, err := net.Dial("tcp", addr)
+        if err != nil {
+                t.Fatal(err)
+        }
+        t.Cleanup(func() { conn.Close() })
+
+        var req strings.Builder
+        fmt.Fprintf(&req, "POST /v1/evidence HTTP/1.1\r\nHost: %s\r\nExpect: 100-continue\r\nContent-Length: %d\r\n", addr, contentLength)
+        for name, values := range header {
+                for _, value := range values {
+                        fmt.Fprintf(&req, "%s: %s\r\n", name, value)
+                }
+        }
+        req.WriteString("\r\n")
+        if _, err := conn.Write([]byte(req.String())); err != nil {
+                t.Fatal(err)
+        }
+
+        conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+        reader := bufio.NewReader(conn)
+        status, err := reader.ReadString('\n')
+        if err != nil {
+                t.Fatalf("no response to headers: %v", err)
+        }
+        return conn, reader, strings.TrimSpace(status)
+}
+
+func multipartUpload(t *testing.T, fields map[string]string, content []byte) ([]byte, string) {
+        t.Helper()
+        var body bytes.Buffer
+        form := multipart.NewWriter(&body)
+        for name, value := range fields {
+                form.WriteField(name, value)
+        }
+        part, _ := form.CreateFormFile("file", "upload.bin")
+        part.Write(content)
+        form.Close()
+        return body.Bytes(), form.FormDataContentType()
+}
+
+func TestExpectContinueRejectedBeforeBody(t *testing.T) {
+        addr := newEvidenceServer(t)
+        tests := []struct {
+                name   string
+                header http.Header
+                want   string
+        }{
+                {"missing idempotency key", http.Header{
+                        "X-User-Id":    {"inspector-100c"},
+                        "Content-Type": {"multipart/form-data; boundary=x"},
+                }, "HTTP/1.1 400"},
+                {"wrong content type", http.Header{
+                        "Idempotency-Key": {"expect-1"},
+                        "X-User-Id":       {"inspector-100c"},
+                        "Content-Type":    {"application/json"},
+                }, "HTTP/1.1 415"},
+                // The gzip reader opens lazily, so a rejected gzip upload is not read either
+                {"gzip upload missing user", http.Header{
+                        "Idempotency-Key":  {"expect-2"},
+                        "Content-Type":     {"multipart/form-data; boundary=x"},
+                        "Content-Encoding": {"gzip"},
+                }, "HTTP/1.1 400"},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        _, _, status := sendExpectContinue(t, addr, tt.header, 50<<20)
+                        if !strings.HasPrefix(status, tt.want) {
+                                t.Errorf("first status line = %q, want %s without 100 Continue", status, tt.want)
+                        }
+                })
+        }
+}
+
+func TestExpectContinueAcceptedHeaders(t *testing.T) {
+        saved := evidenceScanner
+        evidenceScanner = &patternScanner{pattern: eicarSignature, threat: "Eicar-Test-Signature"}
+        t.Cleanup(func() { evidenceScanner = saved })
+        addr := newEvidenceServer(t)
+
+        // The scanner rejects the file, so the upload completes without a database
+        content := []byte(eicarSignature)
+        body, contentType := multipartUpload(t, map[string]string{
+                "session_id":    "0b9d7f5e-1c2a-4e8b-9d3f-6a7c8e9f0a1b",
+                "evidence_type": "photo",
+                "sha256_hash":   calculateSHA256(content),
+        }, content)
+
+        conn, reader, status := sendExpectContinue(t, addr, http.Header{
+                "Idempotency-Key": {"expect-accepted"},
+                "X-User-Id":       {"inspector-100c-ok"},
+                "Content-Type":    {contentType},
+        }, len(body))
+        if status != "HTTP/1.1 100 Continue" {
+                t.Fatalf("status line = %q, want 100 Continue", status)
+        }
+        if blank, _ := reader.ReadString('\n'); blank != "\r\n" {
+                t.Fatalf("100 Continue not terminated by a blank line: %q", blank)
+        }
+
+        if _, err := conn.Write(body); err != nil {
+                t.Fatal(err)
+        }
+        resp, err := http.ReadResponse(reader, nil)
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode != http.StatusUnprocessableEntity {
+                t.Errorf("final status = %d, want 422 from the scanner", resp.StatusCode)
+        }
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+        "fmt"
+        "math"
+        "net/http"
+        "reflect"
+        "sort"
+        "strings"
+        "time"
+)
+
+// Merge strategies for applying changes to session data
+const (
+        // Apply changes in submission order; the last change to touch a path wins
+        MergeStrategyOverwrite = "overwrite"
+        // Per-path last-writer-wins by change timestamp
+        MergeStrategyLWW = "lww"
+)
+
+// Known merge strategies, for validating per-session overrides
+var mergeStrategies = map[string]bool{MergeStrategyOverwrite: true, MergeStrategyLWW: true}
+
+// Header selecting a merge strategy for a single request
+const mergeStrategyHeader = "X-Merge-Strategy"
+
+// Read the per-request merge strategy from X-Merge-Strategy, which must name a
+// known strategy listed in MERGE_STRATEGY_OVERRIDE_ALLOWLIST. Returns "" when
+// the header is absent.
+func parseMergeStrategyHeader(r *http.Request) (string, error) {
+        strategy := strings.TrimSpace(r.Header.Get(mergeStrategyHeader))
+        if strategy == "" {
+                return "", nil
+        }
+        if mergeStrategies[strategy] {
+                for _, allowed := range strings.Split(cfg.MergeStrategyOverrideAllowlist, ",") {
+                        if strings.TrimSpace(allowed) == strategy {
+                                return strategy, nil
+                        }
+                }
+        }
+        return "", fmt.Errorf("merge strategy %q is not allowed", strategy)
+}
+
+// Change operations
+const (
+        changeOpSet    = "set"
+        changeOpDelete = "delete"
+)
+
+// RFC 6902 JSON Patch operations accepted as changes, mapped onto set/delete.
+// "remove" becomes a tombstone, so removing an absent path is not an error as it
+// would be for a plain JSON Patch document. Paths address object members only;
+// a path through an array or scalar (e.g. "/items/0/x") is rejected on merge.
+var jsonPatchOps = map[string]string{
+        "add":     changeOpSet,
+        "replace": changeOpSet,
+        "remove":  changeOpDelete,
+}
+
+// JSON Patch operations that have no convergent equivalent and are rejected
+var unsupportedPatchOps = map[string]bool{"move": true, "copy": true, "test": true}
+
+// Policies for change timestamps too far in the future
+const (
+        skewPolicyReject = "reject"
+        skewPolicyClamp  = "clamp"
+)
+
+// A single change to session data. Changes are either operations
+// ({"op":"set","path":"/a/b","value":...}, or the JSON Patch ops add, replace
+// and remove) or legacy field maps ({"a":...}),
+// where each top-level key is treated as a set of "/key". The keys
+// "timestamp", "node_id" and "change_id" carry merge metadata in operations;
+// in legacy field maps they only do under LWW (see liftLegacyMeta) and are
+// otherwise merged as data, as they were before LWW existed.
+type Change struct {
+        Op        string
+        Path      string
+        Value     interface{}
+        Timestamp time.Time
+        NodeID    string
+        ChangeID  string
+        // Authenticated user that submitted the change, recorded as provenance
+        UserID string
+        // Hybrid logical clock value assigned by the server when the change is merged
+        HLC int64
+        // Legacy field map this change came from; nil for operations
+        legacy *legacyEntry
+}
+
+// A legacy field map's position in the payload and its raw metadata keys
+type legacyEntry struct {
+        index int
+        meta  map[string]interface{}
+}
+
+// Per-path merge metadata persisted alongside session data (test_sessions.crdt_meta)
+type FieldMeta struct {
+        Timestamp time.Time `json:"ts"`
+        NodeID    string    `json:"node_id,omitempty"`
+        ChangeID  string    `json:"change_id,omitempty"`
+        UserID    string    `json:"user_id,omitempty"`
+        Deleted   bool      `json:"deleted,omitempty"`
+        HLC       int64     `json:"hlc,omitempty"`
+}
+
+// Session data together with its per-path merge metadata
+type MergeState struct {
+        Data   map[string]interface{}
+        Fields map[string]FieldMeta
+}
+
+// Returned when a change cannot be interpreted
+type ChangeError struct {
+        Index  int
+        Reason string
+}
+
+func (e *ChangeError) Error() string {
+        return fmt.Sprintf("changes[%d]: %s", e.Index, e.Reason)
+}
+
+// Keys carrying change metadata rather than data
+var changeMetaKeys = map[string]bool{"timestamp": true, "node_id": true, "change_id": true}
+
+// Keys an operation may have; a map with any other key is a legacy field map
+var changeOpKeys = map[string]bool{"op": true, "path": true, "value": true, "from": true,
+        "timestamp": true, "node_id": true, "change_id": true}
+
+// Report whether a raw change is an operation rather than a legacy field map:
+// a known op, a string path, and no keys an operation does not use. Data maps
+// that merely contain "op" and "path" fields stay legacy field maps.
+func isChangeOp(entry map[string]interface{}) bool {
+        op, hasOp := entry["op"].(string)
+        _, hasPath := entry["path"].(string)
+        if !hasOp || !hasPath {
+                return false
+        }
+        if _, patchOp := jsonPatchOps[op]; !patchOp && !unsupportedPatchOps[op] && op != changeOpSet && op != changeOpDelete {
+                return false
+        }
+        for key := range entry {
+                if !changeOpKeys[key] {
+                        return false
+                }
+        }
+        return true
+}
+
+// Parse raw changes into operations, assigning server time to changes without a
+// timestamp and applying the configured skew policy to future-dated ones.
+// Legacy field maps are taken as-is with server time: every key, including the
+// metadata keys, is a set of that key until liftLegacyMeta reads them for LWW.
+func parseChanges(raw []map[string]interface{}, now time.Time) ([]Change, error) {
+        var changes []Change
+        for i, entry := range raw {
+                if !isChangeOp(entry) {
+                        legacy := &legacyEntry{index: i, meta: make(map[string]interface{})}
+                        for key, value := range entry {
+                                if changeMetaKeys[key] {
+                                        legacy.meta[key] = value
+                                }
+                                changes = append(changes, Change{Op: changeOpSet, Path: "/" + escapePointerToken(key), Value: value,
+                                        Timestamp: now, legacy: legacy})
+                        }
+                        continue
+                }
+
+                ts, err := parseChangeTimestamp(entry["timestamp"], now)
+                if err != nil {
+                        return nil, &ChangeError{Index: i, Reason: err.Error()}
+                }
+                nodeID, _ := entry["node_id"].(string)
+                changeID, _ := entry["change_id"].(string)
+
+                op, path := entry["op"].(string), entry["path"].(string)
+                if mapped, ok := jsonPatchOps[op]; ok {
+                        op = mapped
+                } else if unsupportedPatchOps[op] {
+                        return nil, &ChangeError{Index: i, Reason: fmt.Sprintf("JSON Patch op %q is not supported", op)}
+                }
+                if !strings.HasPrefix(path, "/") || path == "/" {
+                        return nil, &ChangeError{Index: i, Reason: fmt.Sprintf("invalid path %q", path)}
+                }
+                if _, hasValue := entry["value"]; op == changeOpSet && !hasValue && entry["op"] != changeOpSet {
+                        return nil, &ChangeError{Index: i, Reason: fmt.Sprintf("op %q requires a value", entry["op"])}
+                }
+                changes = append(changes, Change{Op: op, Path: path, Value: entry["value"],
+                        Timestamp: ts, NodeID: nodeID, ChangeID: changeID})
+        }
+        return changes, nil
+}
+
+// Under LWW, read legacy field maps' merge metadata from their "timestamp",
+// "node_id" and "change_id" keys, dropping those keys from the data. Other
+// strategies leave legacy maps untouched.
+func liftLegacyMeta(changes []Change, now time.Time) ([]Change, error) {
+        lifted := make([]Change, 0, len(changes))
+        for _, c := range changes {
+                if c.legacy == nil {
+                        lifted = append(lifted, c)
+                        continue
+                }
+                if changeMetaKeys[strings.TrimPrefix(c.Path, "/")] {
+                        continue
+                }
+                ts, err := parseChangeTimestamp(c.legacy.meta["timestamp"], now)
+                if err != nil {
+                        return nil, &ChangeError{Index: c.legacy.index, Reason: err.Error()}
+                }
+                c.Timestamp = ts
+                c.NodeID, _ = c.legacy.meta["node_id"].(string)
+                c.ChangeID, _ = c.legacy.meta["change_id"].(string)
+                lifted = append(lifted, c)
+        }
+        return lifted, nil
+}
+
+// Parse a change timestamp given as RFC 3339 or Unix seconds, enforcing CHANGE_TIMESTAMP_MAX_SKEW
+func parseChangeTimestamp(raw interface{}, now time.Time) (time.Time, error) {
+        var ts time.Time
+        switch v := raw.(type) {
+        case nil:
+                return now, nil
+        case string:
+                parsed, err := time.Parse(time.RFC3339Nano, v)
+                if err != nil {
+                        return time.Time{}, fmt.Errorf("invalid timestamp %q", v)
+                }
+                ts = parsed.UTC()
+        case float64:
+                if math.IsNaN(v) || math.IsInf(v, 0) || v < 0 {
+                        return time.Time{}, fmt.Errorf("invalid timestamp %v", v)
+                }
+                sec, frac := math.Modf(v)
+                ts = time.Unix(int64(sec), int64(frac*1e9)).UTC()
+        default:
+                return time.Time{}, fmt.Errorf("timestamp must be an RFC 3339 string or Unix seconds")
+        }
+
+        // Guard LWW registers against far-future timestamps that would win every conflict
+        if limit := now.Add(cfg.ChangeTimestampMaxSkew); ts.After(limit) {
+                if cfg.ChangeTimestampSkewPolicy == skewPolicyClamp {
+                        return now, nil
+                }
+                return time.Time{}, fmt.Errorf("timestamp %s is %s ahead of server time (max skew %s)",
+                        ts.Format(time.RFC3339), ts.Sub(now).Round(time.Second), cfg.ChangeTimestampMaxSkew)
+        }
+        return ts, nil
+}
+
+// Find the first change older than the session's latest write by more than the
+// grace window, returning how much older than the latest write it is
+func findLateChange(changes []Change, latestWrite time.Time, grace time.Duration) (*Change, time.Duration) {
+        cutoff := latestWrite.Add(-grace)
+        for i := range changes {
+                if changes[i].Timestamp.Before(cutoff) {
+                        return &changes[i], latestWrite.Sub(changes[i].Timestamp)
+                }
+        }
+        return nil, 0
+}
+
+// Report whether change c wins over the recorded metadata m under LWW.
+// Ties on timestamp are broken by node ID, then change ID, so the winner does
+// not depend on arrival order. Only when those also tie (the same node and
+// change ID, or changes without either) does the server-assigned HLC decide,
+// when both sides have one.
+func lwwWins(c Change, m FieldMeta) bool {
+        if !c.Timestamp.Equal(m.Timestamp) {
+                return c.Timestamp.After(m.Timestamp)
+        }
+        if c.NodeID != m.NodeID {
+                return c.NodeID > m.NodeID
+        }
+        if c.ChangeID != m.ChangeID {
+                return c.ChangeID > m.ChangeID
+        }
+        if c.HLC != 0 && m.HLC != 0 {
+                return c.HLC >= m.HLC
+        }
+        return true
+}
+
+// Order changes by (timestamp, node_id, change_id) so a merge is reproducible
+// regardless of the order the client listed them. The sort is stable: changes
+// with equal keys (e.g. untimestamped changes, which all receive the same server
+// time) keep their submission order. Under LWW the result matches lwwWins, so
+// ordering only removes intra-payload order dependence; under overwrite it makes
+// the latest-timestamped change to a path the one that sticks.
+func sortChanges(changes []Change) []Change {
+        sorted := make([]Change, len(changes))
+        copy(sorted, changes)
+        sort.SliceStable(sorted, func(i, j int) bool {
+                a, b := sorted[i], sorted[j]
+                if !a.Timestamp.Equal(b.Timestamp) {
+                        return a.Timestamp.Before(b.Timestamp)
+                }
+                if a.NodeID != b.NodeID {
+                        return a.NodeID < b.NodeID
+                }
+                return a.ChangeID < b.ChangeID
+        })
+        return sorted
+}
+
+// Apply changes to state using the given strategy, in sortChanges order. Returns
+// how many changes altered the data and how many were skipped, either as LWW
+// losers or as no-ops (setting the current value, deleting an absent path).
+// Fails without finishing when a change's path walks through a non-object
+// value; callers must discard the partially applied state.
+func applyChanges(state *MergeState, changes []Change, strategy string) (applied, skipped int, err error) {
+        for _, c := range sortChanges(changes) {
+                if err := checkObjectPath(state.Data, splitPointer(c.Path)); err != nil {
+                        return applied, skipped, fmt.Errorf("path %q: %v", c.Path, err)
+                }
+                if strategy == MergeStrategyLWW {
+                        if existing, ok := state.Fields[c.Path]; ok && !lwwWins(c, existing) {
+                                skipped++
+                                continue
+                        }
+                }
+
+                tokens := splitPointer(c.Path)
+                current, exists := lookupPath(state.Data, tokens)
+                if c.Op == changeOpDelete {
+                        deletePath(state.Data, tokens)
+                } else {
+                        setPath(state.Data, tokens, c.Value)
+                }
+                if (c.Op == changeOpDelete && !exists) || (c.Op != changeOpDelete && exists && reflect.DeepEqual(current, c.Value)) {
+                        skipped++
+                } else {
+                        applied++
+                }
+                state.Fields[c.Path] = FieldMeta{
+                        Timestamp: c.Timestamp,
+                        NodeID:    c.NodeID,
+                        ChangeID:  c.ChangeID,
+                        UserID:    c.UserID,
+                        Deleted:   c.Op == changeOpDelete,
+                        HLC:       c.HLC,
+                }
+        }
+        return applied, skipped, nil
+}
+
+// Split a JSON pointer ("/a/b~1c") into unescaped tokens
+func splitPointer(path string) []string {
+        tokens := strings.Split(strings.TrimPrefix(path, "/"), "/")
+        for i, t := range tokens {
+                tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+        }
+        return tokens
+}
+
+// Escape a key for use as a JSON pointer token
+func escapePointerToken(key string) string {
+        return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
+
+// Report an error if any existing intermediate node on the path is not an
+// object. Array indices and "-" are not supported, and replacing an array or
+// scalar with an object would silently drop its contents.
+func checkObjectPath(data map[string]interface{}, tokens []string) error {
+        node := data
+        for i, t := range tokens[:len(tokens)-1] {
+                value, exists := node[t]
+                if !exists || value == nil {
+                        return nil
+                }
+                child, ok := value.(map[string]interface{})
+                if !ok {
+                        return fmt.Errorf("/%s is not an object", strings.Join(escapePointerTokens(tokens[:i+1]), "/"))
+                }
+                node = child
+        }
+        return nil
+}
+
+// Escape each token of a split JSON pointer
+func escapePointerTokens(tokens []string) []string {
+        escaped := make([]string, len(tokens))
+        for i, t := range tokens {
+                escaped[i] = escapePointerToken(t)
+        }
+        return escaped
+}
+
+// Set a value at a path, creating missing (or null) intermediate nodes.
+// checkObjectPath must pass first.
+func setPath(data map[string]interface{}, tokens []string, value interface{}) {
+        node := data
+        for _, t := range tokens[:len(tokens)-1] {
+                child, ok := node[t].(map[string]interface{})
+                if !ok {
+                        child = make(map[string]interface{})
+                        node[t] = child
+                }
+                node = child
+        }
+        node[tokens[len(tokens)-1]] = value
+}
+
+// Remove the value at a path if present
+func deletePath(data map[string]interface{}, tokens []string) {
+        node := data
+        for _, t := range tokens[:len(tokens)-1] {
+                child, ok := node[t].(map[string]interface{})
+                if !ok {
+                        return
+                }
+                node = child
+        }
+        delete(node, tokens[len(tokens)-1])
+}
@@ -0,0 +1,685 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "errors"
+        "math/rand"
+        "net/http"
+        "net/http/httptest"
+        "reflect"
+        "strings"
+        "testing"
+        "time"
+)
+
+func TestChangeTimestampSkewPolicies(t *testing.T) {
+        now := time.Date(2026, 3, 14, 9, 30, 0, 0, time.UTC)
+        future := now.Add(2 * time.Hour)
+        withinSkew := now.Add(90 * time.Second)
+
+        tests := []struct {
+                name    string
+                policy  string
+                raw     interface{}
+                want    time.Time
+                wantErr string
+        }{
+                {"reject future RFC 3339", skewPolicyReject, future.Format(time.RFC3339), time.Time{}, "2h0m0s ahead of server time"},
+                {"reject future Unix seconds", skewPolicyReject, float64(future.Unix()), time.Time{}, "ahead of server time"},
+                {"clamp future RFC 3339", skewPolicyClamp, future.Format(time.RFC3339), now, ""},
+                {"clamp future Unix seconds", skewPolicyClamp, float64(future.Unix()) + 0.25, now, ""},
+                {"reject keeps timestamp within skew", skewPolicyReject, withinSkew.Format(time.RFC3339Nano), withinSkew, ""},
+                {"clamp keeps timestamp within skew", skewPolicyClamp, float64(withinSkew.Unix()), withinSkew, ""},
+                {"past timestamp", skewPolicyReject, "2026-03-01T08:00:00+02:00", time.Date(2026, 3, 1, 6, 0, 0, 0, time.UTC), ""},
+                {"omitted uses server time", skewPolicyReject, nil, now, ""},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        withConfig(t, func(c *Config) {
+                                c.ChangeTimestampMaxSkew = 5 * time.Minute
+                                c.ChangeTimestampSkewPolicy = tt.policy
+                        })
+                        got, err := parseChangeTimestamp(tt.raw, now)
+                        if tt.wantErr != "" {
+                                if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                                        t.Fatalf("err = %v, want %q", err, tt.wantErr)
+                                }
+                                return
+                        }
+                        if err != nil {
+                                t.Fatal(err)
+                        }
+                        if !got.Equal(tt.want) {
+                                t.Errorf("timestamp = %s, want %s", got, tt.want)
+                        }
+                })
+        }
+}
+
+func TestParseChangesRejectsFutureTimestampByIndex(t *testing.T) {
+        withConfig(t, func(c *Config) {
+                c.ChangeTimestampMaxSkew = time.Minute
+                c.ChangeTimestampSkewPolicy = skewPolicyReject
+        })
+        now := time.Now().UTC()
+        raw := []map[string]interface{}{
+                {"op": "set", "path": "/pump/pressure", "value": 118},
+                {"op": "set", "path": "/pump/status", "value": "running", "timestamp": now.Add(24 * time.Hour).Format(time.RFC3339)},
+        }
+
+        _, err := parseChanges(raw, now)
+        var changeErr *ChangeError
+        if !errors.As(err, &changeErr) || changeErr.Index != 1 {
+                t.Fatalf("err = %v, want a ChangeError for changes[1]", err)
+        }
+
+        cfg.ChangeTimestampSkewPolicy = skewPolicyClamp
+        changes, err := parseChanges(raw, now)
+        if err != nil {
+                t.Fatal(err)
+        }
+        for _, change := range changes {
+                if !change.Timestamp.Equal(now) {
+                        t.Errorf("%s timestamp = %s, want server time %s", change.Path, change.Timestamp, now)
+                }
+        }
+}
+
+func TestChangeTimestampInvalid(t *testing.T) {
+        for _, raw := range []interface{}{"yesterday", -1.0, true, map[string]interface{}{}} {
+                if _, err := parseChangeTimestamp(raw, time.Now()); err == nil {
+                        t.Errorf("parseChangeTimestamp(%v) succeeded", raw)
+                }
+        }
+}
+
+func newMergeState() *MergeState {
+        return &MergeState{Data: map[string]interface{}{}, Fields: map[string]FieldMeta{}}
+}
+
+func TestApplyChangesOrderIndependent(t *testing.T) {
+        base := time.Date(2026, 7, 1, 12, 0, 0, 0, time.UTC)
+        changes := []Change{
+                {Op: changeOpSet, Path: "/pumps/jockey", Value: "running", Timestamp: base, NodeID: "tablet-b", ChangeID: "c1"},
+                {Op: changeOpSet, Path: "/pumps/jockey", Value: "stopped", Timestamp: base, NodeID: "tablet-a", ChangeID: "c9"},
+                {Op: changeOpSet, Path: "/pumps/jockey", Value: "fault", Timestamp: base.Add(-time.Second), NodeID: "tablet-z"},
+                {Op: changeOpSet, Path: "/pumps/fire", Value: 150, Timestamp: base, NodeID: "tablet-a", ChangeID: "c2"},
+                {Op: changeOpDelete, Path: "/pumps/fire", Timestamp: base, NodeID: "tablet-a", ChangeID: "c3"},
+                {Op: changeOpSet, Path: "/tank/level", Value: 0.82, Timestamp: base.Add(time.Minute), NodeID: "tablet-c"},
+                {Op: changeOpSet, Path: "/tank/level", Value: 0.79, Timestamp: base.Add(time.Minute), NodeID: "tablet-c", ChangeID: "a"},
+        }
+
+        for _, strategy := range []string{MergeStrategyLWW, MergeStrategyOverwrite} {
+                t.Run(strategy, func(t *testing.T) {
+                        want := newMergeState()
+                        if _, _, err := applyChanges(want, changes, strategy); err != nil {
+                                t.Fatal(err)
+                        }
+
+                        rng := rand.New(rand.NewSource(892))
+                        for trial := 0; trial < 20; trial++ {
+                                scrambled := append([]Change(nil), changes...)
+                                rng.Shuffle(len(scrambled), func(i, j int) { scrambled[i], scrambled[j] = scrambled[j], scrambled[i] })
+                                got := newMergeState()
+                                if _, _, err := applyChanges(got, scrambled, strategy); err != nil {
+                                        t.Fatal(err)
+                                }
+                                if !reflect.DeepEqual(got, want) {
+                                        t.Fatalf("order %v produced %v, want %v", changeIDs(scrambled), got.Data, want.Data)
+                                }
+                        }
+
+                        // Timestamp, then node_id, then change_id decide the survivor
+                        pumps := want.Data["pumps"].(map[string]interface{})
+                        if pumps["jockey"] != "running" {
+                                t.Errorf("jockey = %v, want the tablet-b change (highest node at the latest timestamp)", pumps["jockey"])
+                        }
+                        if _, ok := pumps["fire"]; ok {
+                                t.Errorf("fire = %v, want deleted by the later change_id", pumps["fire"])
+                        }
+                        if level := want.Data["tank"].(map[string]interface{})["level"]; level != 0.79 {
+                                t.Errorf("tank level = %v, want the change with change_id a", level)
+                        }
+                })
+        }
+}
+
+func changeIDs(changes []Change) []string {
+        ids := make([]string, len(changes))
+        for i, c := range changes {
+                ids[i] = c.NodeID + "/" + c.ChangeID
+        }
+        return ids
+}
+
+func TestSortChangesIsStableForEqualKeys(t *testing.T) {
+        now := time.Now()
+        changes := []Change{
+                {Path: "/b", Timestamp: now},
+                {Path: "/a", Timestamp: now},
+                {Path: "/c", Timestamp: now.Add(-time.Hour)},
+        }
+        sorted := sortChanges(changes)
+        if sorted[0].Path != "/c" || sorted[1].Path != "/b" || sorted[2].Path != "/a" {
+                t.Errorf("sorted = %v, want /c then submission order", []string{sorted[0].Path, sorted[1].Path, sorted[2].Path})
+        }
+        if changes[0].Path != "/b" {
+                t.Error("sortChanges reordered its input")
+        }
+}
+
+func TestParseJSONPatchOps(t *testing.T) {
+        now := time.Now().UTC()
+        changes, err := parseChanges([]map[string]interface{}{
+                {"op": "add", "path": "/doors/stair_b", "value": map[string]interface{}{"closer": "ok"}},
+                {"op": "replace", "path": "/doors/stair_a", "value": "latched"},
+                {"op": "remove", "path": "/doors/lobby"},
+                {"op": "replace", "path": "/doors/roof", "value": nil},
+        }, now)
+        if err != nil {
+                t.Fatal(err)
+        }
+        wantOps := []string{changeOpSet, changeOpSet, changeOpDelete, changeOpSet}
+        for i, c := range changes {
+                if c.Op != wantOps[i] || !c.Timestamp.Equal(now) {
+                        t.Errorf("changes[%d] = %s at %s, want %s", i, c.Op, c.Timestamp, wantOps[i])
+                }
+        }
+        if changes[3].Value != nil {
+                t.Errorf("explicit null replace value = %v", changes[3].Value)
+        }
+}
+
+func TestParseJSONPatchRejectsUnsupported(t *testing.T) {
+        tests := []struct {
+                entry  map[string]interface{}
+                reason string
+        }{
+                {map[string]interface{}{"op": "move", "from": "/a", "path": "/b"}, `JSON Patch op "move" is not supported`},
+                {map[string]interface{}{"op": "copy", "from": "/a", "path": "/b"}, `JSON Patch op "copy" is not supported`},
+                {map[string]interface{}{"op": "test", "path": "/a", "value": 1}, `JSON Patch op "test" is not supported`},
+                {map[string]interface{}{"op": "add", "path": "/a"}, `op "add" requires a value`},
+                {map[string]interface{}{"op": "replace", "path": "/"}, `invalid path "/"`},
+                {map[string]interface{}{"op": "remove", "path": "a/b"}, `invalid path "a/b"`},
+        }
+        for _, tt := range tests {
+                _, err := parseChanges([]map[string]interface{}{{"op": "set", "path": "/ok", "value": 1}, tt.entry}, time.Now())
+                var changeErr *ChangeError
+                if !errors.As(err, &changeErr) || changeErr.Index != 1 || changeErr.Reason != tt.reason {
+                        t.Errorf("%v: err = %v, want changes[1]: %s", tt.entry, err, tt.reason)
+                }
+        }
+}
+
+func TestApplyJSONPatchAddRemoveReplace(t *testing.T) {
+        t0 := time.Date(2026, 8, 3, 10, 0, 0, 0, time.UTC)
+        state := newMergeState()
+        apply := func(ts time.Time, entries ...map[string]interface{}) (int, int) {
+                t.Helper()
+                changes, err := parseChanges(entries, ts)
+                if err != nil {
+                        t.Fatal(err)
+                }
+                applied, skipped, err := applyChanges(state, changes, MergeStrategyLWW)
+                if err != nil {
+                        t.Fatal(err)
+                }
+                return applied, skipped
+        }
+
+        // add creates intermediate objects
+        apply(t0, map[string]interface{}{"op": "add", "path": "/risers/r1/valve", "value": "open"})
+        // replace overwrites
+        apply(t0.Add(time.Second), map[string]interface{}{"op": "replace", "path": "/risers/r1/valve", "value": "closed"})
+        riser := state.Data["risers"].(map[string]interface{})["r1"].(map[string]interface{})
+        if riser["valve"] != "closed" {
+                t.Fatalf("valve = %v, want closed", riser["valve"])
+        }
+
+        // remove deletes the value and leaves a tombstone
+        apply(t0.Add(2*time.Second), map[string]interface{}{"op": "remove", "path": "/risers/r1/valve"})
+        if _, ok := riser["valve"]; ok {
+                t.Error("removed value still present")
+        }
+        if meta := state.Fields["/risers/r1/valve"]; !meta.Deleted || !meta.Timestamp.Equal(t0.Add(2*time.Second)) {
+                t.Errorf("tombstone = %+v", meta)
+        }
+
+        // A stale add from an offline client does not resurrect the removed value
+        if applied, skipped := apply(t0.Add(time.Second/2), map[string]interface{}{"op": "add", "path": "/risers/r1/valve", "value": "open"}); applied != 0 || skipped != 1 {
+                t.Errorf("stale add: applied %d skipped %d, want it skipped", applied, skipped)
+        }
+        if _, ok := riser["valve"]; ok {
+                t.Error("stale add resurrected the removed value")
+        }
+        // A newer add does
+        apply(t0.Add(3*time.Second), map[string]interface{}{"op": "add", "path": "/risers/r1/valve", "value": "open"})
+        if riser["valve"] != "open" || state.Fields["/risers/r1/valve"].Deleted {
+                t.Errorf("newer add: valve = %v, meta %+v", riser["valve"], state.Fields["/risers/r1/valve"])
+        }
+}
+
+func TestApplyChangesRejectsPathThroughNonObject(t *testing.T) {
+        for _, data := range []map[string]interface{}{
+                {"zones": []interface{}{"north", "south"}},
+                {"zones": "all clear"},
+                {"zones": map[string]interface{}{"a~b/c": 3.0}},
+        } {
+                path := "/zones/0/status"
+                if _, ok := data["zones"].(map[string]interface{}); ok {
+                        path = "/zones/a~0b~1c/status"
+                }
+                state := &MergeState{Data: data, Fields: map[string]FieldMeta{}}
+                changes := []Change{{Op: changeOpSet, Path: path, Value: "tested", Timestamp: time.Now()}}
+                _, _, err := applyChanges(state, changes, MergeStrategyOverwrite)
+                if err == nil || !strings.Contains(err.Error(), "is not an object") {
+                        t.Errorf("%v: err = %v, want a non-object path error", data, err)
+                }
+        }
+}
+
+func TestMergeRejectsArrayPathWith422(t *testing.T) {
+        pool := testDB(t)
+        sessionID := insertTestSession(t, pool, map[string]interface{}{"extinguishers": []interface{}{"A-1", "A-2"}}, nil)
+        _, err := mergeTestPayload(t, pool, sessionID, "inspector-3", &CRDTPayload{
+                Changes: []map[string]interface{}{{"op": "replace", "path": "/extinguishers/1", "value": "A-3"}},
+        })
+        var mergeErr *MergeError
+        if !errors.As(err, &mergeErr) || mergeErr.StatusCode != http.StatusUnprocessableEntity {
+                t.Fatalf("err = %v, want a 422 MergeError", err)
+        }
+        state, err := loadSessionState(t.Context(), sessionID)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if !reflect.DeepEqual(state.SessionData["extinguishers"], []interface{}{"A-1", "A-2"}) {
+                t.Errorf("array was modified: %v", state.SessionData["extinguishers"])
+        }
+}
+
+func TestFindLateChange(t *testing.T) {
+        latest := time.Date(2026, 5, 2, 14, 0, 0, 0, time.UTC)
+        changes := []Change{
+                {Path: "/panel/zone_1", Timestamp: latest.Add(-30 * time.Second)},
+                {Path: "/panel/zone_2", Timestamp: latest.Add(-4 * time.Minute)},
+                {Path: "/panel/zone_3", Timestamp: latest.Add(-9 * time.Minute)},
+        }
+
+        tests := []struct {
+                name     string
+                grace    time.Duration
+                wantPath string
+                wantAge  time.Duration
+        }{
+                {"all within grace", 10 * time.Minute, "", 0},
+                {"first change beyond grace", 2 * time.Minute, "/panel/zone_2", 4 * time.Minute},
+                {"only oldest beyond grace", 5 * time.Minute, "/panel/zone_3", 9 * time.Minute},
+                {"exactly at cutoff is accepted", 9 * time.Minute, "", 0},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        late, age := findLateChange(changes, latest, tt.grace)
+                        if tt.wantPath == "" {
+                                if late != nil {
+                                        t.Fatalf("late change = %s, want none", late.Path)
+                                }
+                                return
+                        }
+                        if late == nil || late.Path != tt.wantPath {
+                                t.Fatalf("late change = %v, want %s", late, tt.wantPath)
+                        }
+                        if age != tt.wantAge {
+                                t.Errorf("age = %s, want %s", age, tt.wantAge)
+                        }
+                })
+        }
+}
+
+func TestMergeLateChangeGraceWindow(t *testing.T) {
+        pool := testDB(t)
+
+        tests := []struct {
+                name    string
+                grace   time.Duration
+                age     time.Duration
+                wantErr bool
+        }{
+                {"within grace window", time.Hour, 30 * time.Minute, false},
+                {"beyond grace window", time.Hour, 3 * time.Hour, true},
+                {"grace window disabled", 0, 3 * time.Hour, false},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        withConfig(t, func(c *Config) { c.ChangeLateGraceWindow = tt.grace })
+                        sessionID := insertTestSession(t, pool, map[string]interface{}{"sprinkler_valve": "closed"}, nil)
+                        if _, err := pool.Exec(t.Context(), `UPDATE test_sessions SET updated_at = now() WHERE id = $1`, sessionID); err != nil {
+                                t.Fatal(err)
+                        }
+                        _, err := mergeTestPayload(t, pool, sessionID, "inspector-7", &CRDTPayload{
+                                Changes: []map[string]interface{}{{
+                                        "op":        "replace",
+                                        "path":      "/sprinkler_valve",
+                                        "value":     "open",
+                                        "timestamp": time.Now().Add(-tt.age).UTC().Format(time.RFC3339),
+                                }},
+                        })
+                        if !tt.wantErr {
+                                if err != nil {
+                                        t.Fatalf("merge rejected: %v", err)
+                                }
+                                return
+                        }
+                        var mergeErr *MergeError
+                        if !errors.As(err, &mergeErr) || mergeErr.StatusCode != http.StatusConflict {
+                                t.Fatalf("err = %v, want a 409 MergeError", err)
+                        }
+                        if !strings.Contains(mergeErr.Message, "stale") {
+                                t.Errorf("message = %q, want it to mention a stale change", mergeErr.Message)
+                        }
+                })
+        }
+}
+
+func TestApplyChangesCountsLWWLosers(t *testing.T) {
+        base := time.Date(2026, 8, 20, 7, 15, 0, 0, time.UTC)
+        state := newMergeState()
+        state.Data["alarm_panel"] = map[string]interface{}{"status": "normal", "battery_volts": 24.1}
+        state.Fields["/alarm_panel/status"] = FieldMeta{Timestamp: base.Add(time.Hour), NodeID: "tablet-north"}
+        state.Fields["/alarm_panel/battery_volts"] = FieldMeta{Timestamp: base.Add(time.Hour), NodeID: "tablet-north"}
+
+        changes := []Change{
+                // Older than the recorded writes: both lose under LWW
+                {Op: changeOpSet, Path: "/alarm_panel/status", Value: "trouble", Timestamp: base, NodeID: "tablet-south"},
+                {Op: changeOpDelete, Path: "/alarm_panel/battery_volts", Timestamp: base, NodeID: "tablet-south"},
+                // Newer, and actually changes the value
+                {Op: changeOpSet, Path: "/alarm_panel/battery_volts", Value: 23.8, Timestamp: base.Add(2 * time.Hour), NodeID: "tablet-south"},
+                // Newer, but writes the value already present
+                {Op: changeOpSet, Path: "/alarm_panel/status", Value: "normal", Timestamp: base.Add(2 * time.Hour), NodeID: "tablet-south"},
+                // Removing a path that was never set
+                {Op: changeOpDelete, Path: "/alarm_panel/ground_fault", Timestamp: base.Add(2 * time.Hour), NodeID: "tablet-south"},
+                {Op: changeOpSet, Path: "/alarm_panel/last_test", Value: "2026-08-20", Timestamp: base.Add(2 * time.Hour), NodeID: "tablet-south"},
+        }
+
+        applied, skipped, err := applyChanges(state, changes, MergeStrategyLWW)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if applied != 2 || skipped != 4 {
+                t.Errorf("applied = %d, skipped = %d, want 2 and 4", applied, skipped)
+        }
+        panel := state.Data["alarm_panel"].(map[string]interface{})
+        if panel["status"] != "normal" || panel["battery_volts"] != 23.8 {
+                t.Errorf("alarm panel = %v, want the newer battery reading and unchanged status", panel)
+        }
+
+        // Overwrite has no losers; only the no-ops are skipped
+        state = newMergeState()
+        state.Data["alarm_panel"] = map[string]interface{}{"status": "normal"}
+        applied, skipped, err = applyChanges(state, changes[:1], MergeStrategyOverwrite)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if applied != 1 || skipped != 0 {
+                t.Errorf("overwrite: applied = %d, skipped = %d, want 1 and 0", applied, skipped)
+        }
+}
+
+func TestMergeResponseReportsCounts(t *testing.T) {
+        pool := testDB(t)
+        withConfig(t, func(c *Config) { c.MergeStrategy = MergeStrategyLWW })
+        sessionID := insertTestSession(t, pool, map[string]interface{}{"hydrant": "flowing"}, nil)
+
+        now := time.Now().UTC()
+        if _, err := mergeTestPayload(t, pool, sessionID, "inspector-9", &CRDTPayload{
+                Changes: []map[string]interface{}{
+                        {"op": "replace", "path": "/hydrant", "value": "capped", "timestamp": now.Format(time.RFC3339Nano), "node_id": "tablet-1"},
+                },
+        }); err != nil {
+                t.Fatal(err)
+        }
+
+        // A second device syncs late: its hydrant reading loses to the recorded write
+        response, err := mergeTestPayload(t, pool, sessionID, "inspector-10", &CRDTPayload{
+                Changes: []map[string]interface{}{
+                        {"op": "replace", "path": "/hydrant", "value": "leaking", "timestamp": now.Add(-time.Minute).Format(time.RFC3339Nano), "node_id": "tablet-2"},
+                        {"op": "add", "path": "/pressure_kpa", "value": 420, "timestamp": now.Format(time.RFC3339Nano), "node_id": "tablet-2"},
+                },
+        })
+        if err != nil {
+                t.Fatal(err)
+        }
+        if response.AppliedCount != 1 || response.SkippedCount != 1 {
+                t.Errorf("applied_count = %d, skipped_count = %d, want 1 and 1", response.AppliedCount, response.SkippedCount)
+        }
+}
+
+func TestSessionMergeStrategyOverride(t *testing.T) {
+        pool := testDB(t)
+        withConfig(t, func(c *Config) { c.MergeStrategy = MergeStrategyLWW })
+        logs := captureLog(t)
+
+        tests := []struct {
+                strategy string
+                want     string
+        }{
+                {MergeStrategyLWW, "passed"},       // the late, older write loses
+                {MergeStrategyOverwrite, "failed"}, // the last write applied wins
+                {"", "passed"},                     // the global default
+                {"majority", "passed"},             // unknown: the global default, with a warning
+        }
+        for _, tt := range tests {
+                t.Run("strategy "+tt.strategy, func(t *testing.T) {
+                        sessionID := insertTestSession(t, pool, nil, nil)
+                        if _, err := pool.Exec(context.Background(),
+                                "UPDATE test_sessions SET merge_strategy = NULLIF($2, '') WHERE id = $1", sessionID, tt.strategy); err != nil {
+                                t.Fatal(err)
+                        }
+
+                        now := time.Now().UTC()
+                        for _, change := range []map[string]interface{}{
+                                {"op": "set", "path": "/fire_door_3", "value": "passed", "timestamp": now.Format(time.RFC3339Nano), "node_id": "tablet-a"},
+                                {"op": "set", "path": "/fire_door_3", "value": "failed", "timestamp": now.Add(-10 * time.Minute).Format(time.RFC3339Nano), "node_id": "tablet-b"},
+                        } {
+                                if _, err := mergeTestPayload(t, pool, sessionID, "inspector-5", &CRDTPayload{Changes: []map[string]interface{}{change}}); err != nil {
+                                        t.Fatal(err)
+                                }
+                        }
+
+                        state, err := loadSessionState(context.Background(), sessionID)
+                        if err != nil {
+                                t.Fatal(err)
+                        }
+                        if got := state.SessionData["fire_door_3"]; got != tt.want {
+                                t.Errorf("fire_door_3 = %v, want %s", got, tt.want)
+                        }
+                })
+        }
+        if !strings.Contains(logs.String(), `unknown merge strategy "majority"`) {
+                t.Error("unknown strategy not logged")
+        }
+}
+
+func TestParseMergeStrategyHeader(t *testing.T) {
+        withConfig(t, func(c *Config) { c.MergeStrategyOverrideAllowlist = " lww , quorum" })
+        tests := []struct {
+                header  string
+                want    string
+                wantErr bool
+        }{
+                {"", "", false},
+                {"lww", MergeStrategyLWW, false},
+                {"  lww ", MergeStrategyLWW, false},
+                {"overwrite", "", true}, // known but not allowlisted
+                {"quorum", "", true},    // allowlisted but unknown
+                {"LWW", "", true},
+        }
+        for _, tt := range tests {
+                r := httptest.NewRequest(http.MethodPost, "/v1/tests/sessions/s/results", nil)
+                r.Header.Set(mergeStrategyHeader, tt.header)
+                got, err := parseMergeStrategyHeader(r)
+                if got != tt.want || (err != nil) != tt.wantErr {
+                        t.Errorf("%q: got %q, %v; want %q, error %v", tt.header, got, err, tt.want, tt.wantErr)
+                }
+        }
+}
+
+func TestDisallowedMergeStrategyHeaderRejected(t *testing.T) {
+        withConfig(t, func(c *Config) { c.MergeStrategyOverrideAllowlist = "" })
+        body, _ := json.Marshal(CRDTPayload{
+                IdempotencyKey: "strategy-rejected-1",
+                Changes:        []map[string]interface{}{{"op": "set", "path": "/alarm_panel", "value": "armed"}},
+        })
+        w := postCRDTResults(t, "session-strategy", body, http.Header{
+                "X-User-Id":        {"inspector-40"},
+                "X-Merge-Strategy": {"lww"},
+        })
+        if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"lww" is not allowed`) {
+                t.Errorf("status = %d %q, want 400", w.Code, w.Body.String())
+        }
+}
+
+func TestMergeStrategyHeaderOverridesForOneRequest(t *testing.T) {
+        pool := testDB(t)
+        withConfig(t, func(c *Config) {
+                c.MergeStrategy = MergeStrategyOverwrite
+                c.MergeStrategyOverrideAllowlist = "lww,overwrite"
+        })
+        logs := captureLog(t)
+        sessionID := insertTestSession(t, pool, nil, nil)
+        userID := insertTestUser(t, pool, "strategy-header")
+        now := time.Now().UTC()
+
+        post := func(value string, at time.Time, strategy string) {
+                t.Helper()
+                body, _ := json.Marshal(CRDTPayload{
+                        IdempotencyKey: "pump-room-" + value + "-" + sessionID,
+                        Changes: []map[string]interface{}{
+                                {"op": "set", "path": "/pump_room", "value": value, "timestamp": at.Format(time.RFC3339Nano), "node_id": "tablet-" + value},
+                        },
+                })
+                header := http.Header{"X-User-Id": {userID}}
+                if strategy != "" {
+                        header.Set(mergeStrategyHeader, strategy)
+                }
+                if w := postCRDTResults(t, sessionID, body, header); w.Code != http.StatusOK {
+                        t.Fatalf("post %s = %d %s", value, w.Code, w.Body.String())
+                }
+        }
+        fieldIs := func(want string) {
+                t.Helper()
+                state, err := loadSessionState(context.Background(), sessionID)
+                if err != nil {
+                        t.Fatal(err)
+                }
+                if got := state.SessionData["pump_room"]; got != want {
+                        t.Errorf("pump_room = %v, want %s", got, want)
+                }
+        }
+
+        post("clear", now, "")
+        // Under LWW the older write loses for this request only
+        post("blocked", now.Add(-time.Hour), MergeStrategyLWW)
+        fieldIs("clear")
+        // Without the header the default overwrite strategy applies again
+        post("flooded", now.Add(-2*time.Hour), "")
+        fieldIs("flooded")
+
+        if !strings.Contains(logs.String(), "with requested strategy lww") {
+                t.Errorf("override not logged: %s", logs.String())
+        }
+}
+
+func TestLegacyFieldMapsKeepMetadataKeys(t *testing.T) {
+        withConfig(t, func(c *Config) { c.ChangeTimestampSkewPolicy = skewPolicyReject })
+        now := time.Date(2026, 5, 2, 14, 0, 0, 0, time.UTC)
+        tests := []struct {
+                name  string
+                entry map[string]interface{}
+        }{
+                {"epoch milliseconds", map[string]interface{}{"timestamp": float64(1712345678901), "node_id": "x", "change_id": "c-1", "hydrant_4": "flushed"}},
+                {"non-RFC 3339 timestamp", map[string]interface{}{"timestamp": "04/05/2024 10:15", "extinguisher_2": "tagged"}},
+                {"data with op and path", map[string]interface{}{"op": "visual", "path": "north stair", "result": "pass"}},
+                {"known op with extra keys", map[string]interface{}{"op": "set", "path": "/riser", "inspector": "jo"}},
+        }
+        for _, tt := range tests {
+                changes, err := parseChanges([]map[string]interface{}{tt.entry}, now)
+                if err != nil {
+                        t.Errorf("%s: %v", tt.name, err)
+                        continue
+                }
+                got := make(map[string]interface{})
+                for _, c := range changes {
+                        if c.Op != changeOpSet || !c.Timestamp.Equal(now) || c.NodeID != "" {
+                                t.Errorf("%s: change %+v, want a server-timed set", tt.name, c)
+                        }
+                        got[strings.TrimPrefix(c.Path, "/")] = c.Value
+                }
+                if !reflect.DeepEqual(got, tt.entry) {
+                        t.Errorf("%s: sets = %v, want every key of %v", tt.name, got, tt.entry)
+                }
+        }
+}
+
+func TestLiftLegacyMeta(t *testing.T) {
+        withConfig(t, func(c *Config) {
+                c.ChangeTimestampSkewPolicy = skewPolicyReject
+                c.ChangeTimestampMaxSkew = time.Minute
+        })
+        now := time.Date(2026, 5, 2, 14, 0, 0, 0, time.UTC)
+        at := now.Add(-10 * time.Minute)
+        changes, err := parseChanges([]map[string]interface{}{
+                {"op": "set", "path": "/alarm", "value": "armed"},
+                {"timestamp": at.Format(time.RFC3339), "node_id": "tablet-6", "change_id": "c-9", "damper": "closed"},
+        }, now)
+        if err != nil {
+                t.Fatal(err)
+        }
+        lifted, err := liftLegacyMeta(changes, now)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if len(lifted) != 2 || lifted[0].Path != "/alarm" {
+                t.Fatalf("lifted = %+v, want the op and the damper set", lifted)
+        }
+        if c := lifted[1]; c.Path != "/damper" || !c.Timestamp.Equal(at) || c.NodeID != "tablet-6" || c.ChangeID != "c-9" {
+                t.Errorf("lifted legacy change = %+v", c)
+        }
+
+        // Under LWW an epoch-milliseconds timestamp is still read as seconds, far in the future
+        changes, _ = parseChanges([]map[string]interface{}{{"timestamp": float64(1712345678901), "damper": "open"}}, now)
+        var changeErr *ChangeError
+        if _, err := liftLegacyMeta(changes, now); !errors.As(err, &changeErr) || changeErr.Index != 0 {
+                t.Errorf("err = %v, want a ChangeError for changes[0]", err)
+        }
+}
+
+func TestLegacyTimestampKeysStoredUnderOverwrite(t *testing.T) {
+        pool := testDB(t)
+        withConfig(t, func(c *Config) { c.MergeStrategy = MergeStrategyOverwrite })
+        userID := insertTestUser(t, pool, "legacy-client")
+        sessionID := insertTestSession(t, pool, map[string]interface{}{"hydrant_4": "untested"}, nil)
+
+        body := []byte(`{"idempotency_key":"legacy-ts-` + sessionID + `","changes":[` +
+                `{"timestamp":1712345678901,"node_id":"x","change_id":"c-1","hydrant_4":"flushed"}]}`)
+        w := postCRDTResults(t, sessionID, body, http.Header{"X-User-Id": {userID}})
+        if w.Code != http.StatusOK {
+                t.Fatalf("legacy change = %d %s, want 200", w.Code, w.Body.String())
+        }
+
+        state, err := loadSessionState(t.Context(), sessionID)
+        if err != nil {
+                t.Fatal(err)
+        }
+        want := map[string]interface{}{"hydrant_4": "flushed", "timestamp": float64(1712345678901), "node_id": "x", "change_id": "c-1"}
+        if !reflect.DeepEqual(state.SessionData, want) {
+                t.Errorf("session_data = %v, want %v", state.SessionData, want)
+        }
+        var deadLetters int
+        if err := pool.QueryRow(t.Context(), `SELECT count(*) FROM crdt_dead_letter WHERE session_id = $1`, sessionID).Scan(&deadLetters); err != nil {
+                t.Fatal(err)
+        }
+        if deadLetters != 0 {
+                t.Errorf("%d dead letters for an accepted legacy change", deadLetters)
+        }
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+        "context"
+        "sync"
+        "time"
+
+        "github.com/jackc/pgx/v5"
+        "github.com/jackc/pgx/v5/pgxpool"
+        "github.com/prometheus/client_golang/prometheus"
+)
+
+// Connections dropped by the acquire-time health check, by reason
+var dbPoolEvictions = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+                Name: "db_pool_evictions_total",
+                Help: "Pooled database connections evicted as dead before use.",
+        },
+        []string{"reason"},
+)
+
+func init() {
+        prometheus.MustRegister(dbPoolEvictions)
+}
+
+// Last release time of each pooled connection, used to decide which are suspect
+var connLastUsed sync.Map
+
+// Install connection health hooks on a pool configuration. Connections idle
+// longer than DB_PING_IDLE_THRESHOLD are pinged before being handed out, and
+// dead ones are evicted so the query transparently retries on a fresh
+// connection; this clears out connections to a failed-over primary.
+func configurePoolHealth(config *pgxpool.Config) {
+        if cfg.DBHealthCheckPeriod > 0 {
+                config.HealthCheckPeriod = cfg.DBHealthCheckPeriod
+        }
+
+        config.PrepareConn = func(ctx context.Context, conn *pgx.Conn) (bool, error) {
+                if conn.IsClosed() {
+                        dbPoolEvictions.WithLabelValues("closed").Inc()
+                        return false, nil
+                }
+                if cfg.DBPingIdleThreshold <= 0 {
+                        return true, nil
+                }
+                if last, ok := connLastUsed.Load(conn); ok && time.Since(last.(time.Time)) < cfg.DBPingIdleThreshold {
+                        return true, nil
+                }
+
+                pingCtx, cancel := context.WithTimeout(ctx, cfg.DBPingTimeout)
+                defer cancel()
+                if err := conn.Ping(pingCtx); err != nil {
+                        // A cancelled caller says nothing about the connection
+                        if ctx.Err() != nil {
+                                return true, ctx.Err()
+                        }
+                        dbPoolEvictions.WithLabelValues("ping_failed").Inc()
+                        return false, nil
+                }
+                return true, nil
+        }
+        config.AfterRelease = func(conn *pgx.Conn) bool {
+                connLastUsed.Store(conn, time.Now())
+                return true
+        }
+        config.BeforeClose = func(conn *pgx.Conn) {
+                connLastUsed.Delete(conn)
+        }
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "errors"
+        "log"
+        "net/http"
+        "strconv"
+        "time"
+
+        "github.com/google/uuid"
+        "github.com/gorilla/mux"
+        "github.com/jackc/pgx/v5"
+)
+
+// A CRDT payload that failed with a non-retriable error, kept for inspection and replay
+type DeadLetter struct {
+        ID          string      `json:"id"`
+        SessionID   string      `json:"session_id"`
+        UserID      string      `json:"user_id"`
+        Endpoint    string      `json:"endpoint"`
+        Payload     CRDTPayload `json:"payload"`
+        StatusCode  int         `json:"status_code"`
+        Error       string      `json:"error"`
+        CreatedAt   time.Time   `json:"created_at"`
+        ReplayedAt  *time.Time  `json:"replayed_at,omitempty"`
+        ReplayError *string     `json:"replay_error,omitempty"`
+}
+
+// Audit action for operator replays of dead-lettered payloads
+const auditActionDeadLetterReplay = "crdt.dead_letter.replay"
+
+// Page size bounds for the dead-letter API
+const (
+        defaultDeadLetterPageSize = 50
+        maxDeadLetterPageSize     = 500
+)
+
+// Persist a payload whose merge failed with a client (4xx) error. Server errors
+// are retriable by the client and are not dead-lettered. A non-empty dedupKey
+// records a failing request once however often the client retries it.
+func deadLetterCRDTPayload(ctx context.Context, sessionID, userID, endpoint, dedupKey string, payload *CRDTPayload, statusCode int, message string) {
+        if !cfg.CRDTDeadLetterEnabled || statusCode < 400 || statusCode >= 500 {
+                return
+        }
+        payloadJSON, err := json.Marshal(payload)
+        if err != nil {
+                log.Printf("Failed to encode dead-letter payload for session %s: %v", sessionID, err)
+                return
+        }
+        var key *string
+        if dedupKey != "" {
+                key = &dedupKey
+        }
+
+        query := `
+                INSERT INTO crdt_dead_letter (session_id, user_id, endpoint, payload, status_code, error, dedup_key)
+                VALUES ($1, $2, $3, $4, $5, $6, $7)
+                ON CONFLICT (dedup_key) WHERE dedup_key IS NOT NULL DO NOTHING
+        `
+        if _, err := dbFor(ctx).Exec(ctx, query, sessionID, userID, endpoint, string(payloadJSON), statusCode, message, key); err != nil {
+                log.Printf("Failed to dead-letter payload for session %s: %v", sessionID, err)
+        }
+}
+
+// Dead-letter dedup key for a request identified by scope (an idempotency key
+// hash or sync cursor) and the hash of its content
+func deadLetterDedupKey(scope, requestHash string) string {
+        return calculateSHA256([]byte(scope + ":" + requestHash))
+}
+
+// Dead-letter a payload after a failed merge, when the failure is a MergeError
+func deadLetterMergeFailure(ctx context.Context, sessionID, userID, endpoint, dedupKey string, payload *CRDTPayload, err error) {
+        var mergeErr *MergeError
+        if errors.As(err, &mergeErr) {
+                deadLetterCRDTPayload(ctx, sessionID, userID, endpoint, dedupKey, payload, mergeErr.StatusCode, mergeErr.Message)
+        }
+}
+
+// Load a dead-lettered payload by ID. Returns pgx.ErrNoRows for unknown IDs.
+func loadDeadLetter(ctx context.Context, id string) (*DeadLetter, error) {
+        query := `
+                SELECT id::text, session_id, user_id, endpoint, payload, status_code, error, created_at, replayed_at, replay_error
+                FROM crdt_dead_letter
+                WHERE id = $1
+        `
+        var item DeadLetter
+        var payloadJSON string
+        err := dbFor(ctx).QueryRow(ctx, query, id).Scan(&item.ID, &item.SessionID, &item.UserID, &item.Endpoint,
+                &payloadJSON, &item.StatusCode, &item.Error, &item.CreatedAt, &item.ReplayedAt, &item.ReplayError)
+        if err != nil {
+                return nil, err
+        }
+        json.Unmarshal([]byte(payloadJSON), &item.Payload)
+        return &item, nil
+}
+
+// List dead-lettered payloads newest first. Filters: session_id, and
+// include_replayed=true to also return items already replayed. Admin only.
+func handleListDeadLetters(w http.ResponseWriter, r *http.Request) {
+        q := r.URL.Query()
+
+        limit := defaultDeadLetterPageSize
+        if raw := q.Get("limit"); raw != "" {
+                parsed, err := strconv.Atoi(raw)
+                if err != nil || parsed < 1 {
+                        http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+                        return
+                }
+                limit = min(parsed, maxDeadLetterPageSize)
+        }
+
+        query := `
+                SELECT id::text, session_id, user_id, endpoint, payload, status_code, error, created_at, replayed_at, replay_error
+                FROM crdt_dead_letter
+                WHERE ($1 = '' OR session_id = $1) AND ($2 OR replayed_at IS NULL)
+                ORDER BY created_at DESC
+                LIMIT $3
+        `
+
+        ctx := r.Context()
+        items := make([]DeadLetter, 0)
+        err := timeQuery("list_crdt_dead_letter", func() error {
+                rows, err := dbFor(ctx).Query(ctx, query, q.Get("session_id"), q.Get("include_replayed") == "true", limit)
+                if err != nil {
+                        return err
+                }
+                defer rows.Close()
+
+                for rows.Next() {
+                        var item DeadLetter
+                        var payloadJSON string
+                        if err := rows.Scan(&item.ID, &item.SessionID, &item.UserID, &item.Endpoint, &payloadJSON,
+                                &item.StatusCode, &item.Error, &item.CreatedAt, &item.ReplayedAt, &item.ReplayError); err != nil {
+                                return err
+                        }
+                        json.Unmarshal([]byte(payloadJSON), &item.Payload)
+                        items = append(items, item)
+                }
+                return rows.Err()
+        })
+        if err != nil {
+                log.Printf("Failed to list dead letters: %v", err)
+                http.Error(w, "Database error", http.StatusInternalServerError)
+                return
+        }
+        writeJSON(w, http.StatusOK, map[string]interface{}{"items": items})
+}
+
+// Re-apply a dead-lettered payload to its session, bypassing idempotency (the
+// original request never committed). A failed replay is recorded on the item
+// and returned with the merge error's status. Admin only.
+func handleReplayDeadLetter(w http.ResponseWriter, r *http.Request) {
+        id := mux.Vars(r)["dead_letter_id"]
+        if _, err := uuid.Parse(id); err != nil {
+                http.Error(w, "Dead letter not found", http.StatusNotFound)
+                return
+        }
+        ctx := context.WithoutCancel(r.Context())
+
+        item, err := loadDeadLetter(ctx, id)
+        if err == pgx.ErrNoRows {
+                http.Error(w, "Dead letter not found", http.StatusNotFound)
+                return
+        }
+        if err != nil {
+                log.Printf("Failed to load dead letter %s: %v", id, err)
+                http.Error(w, "Database error", http.StatusInternalServerError)
+                return
+        }
+        if item.ReplayedAt != nil {
+                http.Error(w, "Dead letter already replayed", http.StatusConflict)
+                return
+        }
+
+        response, err := replayDeadLetter(ctx, item, r.Header.Get("X-User-ID"))
+        if err != nil {
+                if _, markErr := dbFor(ctx).Exec(ctx, "UPDATE crdt_dead_letter SET replay_error = $2 WHERE id = $1", id, err.Error()); markErr != nil {
+                        log.Printf("Failed to record replay error for dead letter %s: %v", id, markErr)
+                }
+                writeMergeError(w, item.SessionID, err)
+                return
+        }
+
+        publishSessionChange(ctx, SessionChange{SessionID: item.SessionID, VectorClock: response.VectorClock})
+        writeJSON(w, http.StatusOK, response)
+}
+
+// Merge a dead-lettered payload and mark it replayed in one transaction
+func replayDeadLetter(ctx context.Context, item *DeadLetter, operatorID string) (*CRDTResponse, error) {
+        changes, err := parseChanges(item.Payload.Changes, time.Now().UTC())
+        if err != nil {
+                return nil, &MergeError{StatusCode: http.StatusUnprocessableEntity, Message: err.Error()}
+        }
+
+        tx, err := dbFor(ctx).Begin(ctx)
+        if err != nil {
+                return nil, err
+        }
+        defer tx.Rollback(ctx)
+
+        response, err := mergeCRDTPayload(ctx, tx, item.SessionID, item.UserID, &item.Payload, changes)
+        if err != nil {
+                return nil, err
+        }
+        if _, err := tx.Exec(ctx, "UPDATE crdt_dead_letter SET replayed_at = CURRENT_TIMESTAMP, replay_error = NULL WHERE id = $1", item.ID); err != nil {
+                return nil, err
+        }
+        auditValues := map[string]interface{}{"session_id": item.SessionID, "original_user_id": item.UserID}
+        if err := writeAuditLog(ctx, tx, operatorID, auditActionDeadLetterReplay, "crdt_dead_letter", item.ID, auditValues); err != nil {
+                return nil, err
+        }
+        if err := tx.Commit(ctx); err != nil {
+                return nil, err
+        }
+        return response, nil
+}
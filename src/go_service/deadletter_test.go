@@ -0,0 +1,153 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "net/http"
+        "net/http/httptest"
+        "net/url"
+        "testing"
+
+        "github.com/gorilla/mux"
+)
+
+func listDeadLetters(t *testing.T, params url.Values) []DeadLetter {
+        t.Helper()
+        w := httptest.NewRecorder()
+        handleListDeadLetters(w, httptest.NewRequest(http.MethodGet, "/v1/admin/crdt/dead-letters?"+params.Encode(), nil))
+        if w.Code != http.StatusOK {
+                t.Fatalf("list = %d %s", w.Code, w.Body.String())
+        }
+        var page struct {
+                Items []DeadLetter `json:"items"`
+        }
+        json.Unmarshal(w.Body.Bytes(), &page)
+        return page.Items
+}
+
+func replayDeadLetterRequest(id, operatorID string) *httptest.ResponseRecorder {
+        r := httptest.NewRequest(http.MethodPost, "/v1/admin/crdt/dead-letters/"+id+"/replay", nil)
+        r.Header.Set("X-User-ID", operatorID)
+        w := httptest.NewRecorder()
+        handleReplayDeadLetter(w, mux.SetURLVars(r, map[string]string{"dead_letter_id": id}))
+        return w
+}
+
+func TestDeadLetterRejectsBadRequests(t *testing.T) {
+        w := httptest.NewRecorder()
+        handleListDeadLetters(w, httptest.NewRequest(http.MethodGet, "/v1/admin/crdt/dead-letters?limit=-1", nil))
+        if w.Code != http.StatusBadRequest {
+                t.Errorf("negative limit = %d, want 400", w.Code)
+        }
+        if w := replayDeadLetterRequest("not-a-uuid", "operator"); w.Code != http.StatusNotFound {
+                t.Errorf("replay of malformed ID = %d, want 404", w.Code)
+        }
+}
+
+func TestFailedMergeLandsInDeadLetter(t *testing.T) {
+        pool := testDB(t)
+        withConfig(t, func(c *Config) { c.CRDTDeadLetterEnabled = true })
+        userID := insertTestUser(t, pool, "dead-letter")
+        operatorID := insertTestUser(t, pool, "dead-letter-operator")
+        sessionID := insertTestSession(t, pool, map[string]interface{}{"hose_reels": []interface{}{"HR-1", "HR-2"}}, nil)
+
+        body, _ := json.Marshal(CRDTPayload{
+                Changes:        []map[string]interface{}{{"op": "set", "path": "/hose_reels/HR-2", "value": "serviced"}},
+                IdempotencyKey: "dead-letter-" + sessionID,
+        })
+        w := postCRDTResults(t, sessionID, body, http.Header{"X-User-Id": {userID}})
+        if w.Code != http.StatusUnprocessableEntity {
+                t.Fatalf("merge = %d %s, want 422", w.Code, w.Body.String())
+        }
+
+        items := listDeadLetters(t, url.Values{"session_id": {sessionID}})
+        if len(items) != 1 {
+                t.Fatalf("%d dead letters for the session, want 1", len(items))
+        }
+        item := items[0]
+        if item.StatusCode != http.StatusUnprocessableEntity || item.UserID != userID || item.Error == "" {
+                t.Errorf("dead letter = %+v", item)
+        }
+        if len(item.Payload.Changes) != 1 || item.Payload.Changes[0]["path"] != "/hose_reels/HR-2" {
+                t.Errorf("dead-lettered payload = %+v, want the original changes", item.Payload)
+        }
+
+        // Replaying unchanged fails again and records why
+        if w := replayDeadLetterRequest(item.ID, operatorID); w.Code != http.StatusUnprocessableEntity {
+                t.Fatalf("replay against the same data = %d, want 422", w.Code)
+        }
+        if failed, _ := loadDeadLetter(context.Background(), item.ID); failed.ReplayError == nil || failed.ReplayedAt != nil {
+                t.Errorf("failed replay not recorded: %+v", failed)
+        }
+
+        // After an operator repairs the session, the replay applies
+        if _, err := pool.Exec(context.Background(),
+                `UPDATE test_sessions SET session_data = '{"hose_reels": {"HR-1": "ok"}}' WHERE id = $1`, sessionID); err != nil {
+                t.Fatal(err)
+        }
+        if w := replayDeadLetterRequest(item.ID, operatorID); w.Code != http.StatusOK {
+                t.Fatalf("replay = %d %s", w.Code, w.Body.String())
+        }
+        state, err := loadSessionState(context.Background(), sessionID)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if reels, _ := state.SessionData["hose_reels"].(map[string]interface{}); reels["HR-2"] != "serviced" {
+                t.Errorf("session after replay = %v", state.SessionData)
+        }
+        if pending := listDeadLetters(t, url.Values{"session_id": {sessionID}}); len(pending) != 0 {
+                t.Errorf("replayed item still listed as pending: %+v", pending)
+        }
+        if all := listDeadLetters(t, url.Values{"session_id": {sessionID}, "include_replayed": {"true"}}); len(all) != 1 || all[0].ReplayedAt == nil {
+                t.Errorf("include_replayed = %+v, want the replayed item", all)
+        }
+        if w := replayDeadLetterRequest(item.ID, operatorID); w.Code != http.StatusConflict {
+                t.Errorf("second replay = %d, want 409", w.Code)
+        }
+}
+
+func TestServerErrorsAreNotDeadLettered(t *testing.T) {
+        pool := testDB(t)
+        sessionID := insertTestSession(t, pool, nil, nil)
+        payload := &CRDTPayload{Changes: []map[string]interface{}{{"op": "set", "path": "/alarm", "value": "reset"}}}
+
+        withConfig(t, func(c *Config) { c.CRDTDeadLetterEnabled = true })
+        deadLetterCRDTPayload(context.Background(), sessionID, "u-1", "/results", "", payload, http.StatusServiceUnavailable, "database unavailable")
+        withConfig(t, func(c *Config) { c.CRDTDeadLetterEnabled = false })
+        deadLetterCRDTPayload(context.Background(), sessionID, "u-1", "/results", "", payload, http.StatusUnprocessableEntity, "disabled")
+
+        if items := listDeadLetters(t, url.Values{"session_id": {sessionID}, "include_replayed": {"true"}}); len(items) != 0 {
+                t.Errorf("dead-lettered %+v, want nothing", items)
+        }
+}
+
+func TestUnparseableChangesDeadLetteredOncePerRequest(t *testing.T) {
+        pool := testDB(t)
+        withConfig(t, func(c *Config) { c.CRDTDeadLetterEnabled = true })
+        userID := insertTestUser(t, pool, "dead-letter-retries")
+        sessionID := insertTestSession(t, pool, nil, nil)
+        body, _ := json.Marshal(CRDTPayload{
+                Changes:        []map[string]interface{}{{"op": "set", "path": "sprinkler_heads", "value": 48}},
+                IdempotencyKey: "unparseable-" + sessionID,
+        })
+
+        // Unauthenticated or unknown callers are turned away before anything is recorded
+        for _, header := range []http.Header{{}, {"X-User-Id": {"inspector-21"}}} {
+                if w := postCRDTResults(t, sessionID, body, header); w.Code != http.StatusBadRequest {
+                        t.Errorf("post with %v = %d %s, want 400", header, w.Code, w.Body.String())
+                }
+        }
+        if items := listDeadLetters(t, url.Values{"session_id": {sessionID}}); len(items) != 0 {
+                t.Fatalf("dead-lettered %d payloads before authentication, want none", len(items))
+        }
+
+        // Retries of the same rejected request share one dead letter
+        for i := 0; i < 3; i++ {
+                if w := postCRDTResults(t, sessionID, body, http.Header{"X-User-Id": {userID}}); w.Code != http.StatusUnprocessableEntity {
+                        t.Fatalf("attempt %d = %d %s, want 422", i, w.Code, w.Body.String())
+                }
+        }
+        if items := listDeadLetters(t, url.Values{"session_id": {sessionID}}); len(items) != 1 || items[0].UserID != userID {
+                t.Errorf("dead letters = %+v, want one for the user", items)
+        }
+}
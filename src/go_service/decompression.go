@@ -0,0 +1,95 @@
+package main
+
+import (
+        "compress/gzip"
+        "errors"
+        "fmt"
+        "io"
+        "net/http"
+        "strings"
+)
+
+// Returned when a decompressed request body exceeds MAX_DECOMPRESSED_BYTES
+var errDecompressedTooLarge = errors.New("decompressed request body too large")
+
+// Counts decompressed bytes and fails once the ceiling is crossed
+type decompressedLimitReader struct {
+        r    io.Reader
+        read int64
+        max  int64
+}
+
+func (l *decompressedLimitReader) Read(p []byte) (int, error) {
+        n, err := l.r.Read(p)
+        l.read += int64(n)
+        if l.read > l.max {
+                return n - int(l.read-l.max), errDecompressedTooLarge
+        }
+        return n, err
+}
+
+// Returned by the first read of a gzip request body whose header is malformed
+var errInvalidGzipBody = errors.New("invalid gzip request body")
+
+// Decompresses the request body on first read, so nothing is read from the
+// client before the handler (and the authentication ahead of it) asks for the
+// body. Close closes both the gzip stream and the underlying request body.
+type gzipRequestBody struct {
+        body   io.ReadCloser
+        gz     *gzip.Reader
+        reader io.Reader
+        err    error
+}
+
+func (b *gzipRequestBody) Read(p []byte) (int, error) {
+        if b.reader == nil && b.err == nil {
+                gz, err := gzip.NewReader(b.body)
+                if err != nil {
+                        b.err = fmt.Errorf("%w: %v", errInvalidGzipBody, err)
+                } else {
+                        b.gz = gz
+                        b.reader = &decompressedLimitReader{r: gz, max: cfg.MaxDecompressedBytes}
+                }
+        }
+        if b.err != nil {
+                return 0, b.err
+        }
+        return b.reader.Read(p)
+}
+
+func (b *gzipRequestBody) Close() error {
+        if b.gz != nil {
+                b.gz.Close()
+        }
+        return b.body.Close()
+}
+
+// Transparently decompress gzip-encoded request bodies, bounding the decompressed
+// size independently of the compressed size to guard against zip bombs
+func decompressionMiddleware(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+                switch encoding {
+                case "", "identity":
+                        next.ServeHTTP(w, r)
+                        return
+                case "gzip":
+                default:
+                        http.Error(w, "Unsupported Content-Encoding", http.StatusUnsupportedMediaType)
+                        return
+                }
+
+                r.Body = &gzipRequestBody{body: r.Body}
+                r.Header.Del("Content-Encoding")
+                r.Header.Del("Content-Length")
+                r.ContentLength = -1
+
+                next.ServeHTTP(w, r)
+        })
+}
+
+// Report whether a body read failed because a size limit was exceeded
+func isBodyTooLarge(err error) bool {
+        var maxBytesErr *http.MaxBytesError
+        return errors.Is(err, errDecompressedTooLarge) || errors.As(err, &maxBytesErr)
+}
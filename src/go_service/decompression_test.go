@@ -0,0 +1,111 @@
+package main
+
+import (
+        "bytes"
+        "compress/gzip"
+        "errors"
+        "io"
+        "net/http"
+        "net/http/httptest"
+        "testing"
+)
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+        t.Helper()
+        var buf bytes.Buffer
+        gz := gzip.NewWriter(&buf)
+        if _, err := gz.Write(data); err != nil {
+                t.Fatal(err)
+        }
+        if err := gz.Close(); err != nil {
+                t.Fatal(err)
+        }
+        return buf.Bytes()
+}
+
+// Send body through decompressionMiddleware and return what the handler read
+func readThroughDecompression(t *testing.T, body []byte, encoding string) (*httptest.ResponseRecorder, []byte, error) {
+        t.Helper()
+        var read []byte
+        var readErr error
+        handler := decompressionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                read, readErr = io.ReadAll(r.Body)
+                w.WriteHeader(http.StatusNoContent)
+        }))
+        r := httptest.NewRequest(http.MethodPost, "/v1/tests/sessions/x/results", bytes.NewReader(body))
+        r.Header.Set("Content-Encoding", encoding)
+        w := httptest.NewRecorder()
+        handler.ServeHTTP(w, r)
+        return w, read, readErr
+}
+
+func TestDecompressionRejectsZipBomb(t *testing.T) {
+        withConfig(t, func(c *Config) { c.MaxDecompressedBytes = 64 << 10 })
+        // 4 MiB of repeated JSON compresses to a few KiB, well under any compressed-size limit
+        bomb := gzipBytes(t, bytes.Repeat([]byte(`{"status":"pass"},`), 4<<20/18))
+        if len(bomb) > 64<<10 {
+                t.Fatalf("fixture compressed to %d bytes, expected a small payload", len(bomb))
+        }
+
+        _, read, err := readThroughDecompression(t, bomb, "gzip")
+        if !errors.Is(err, errDecompressedTooLarge) || !isBodyTooLarge(err) {
+                t.Fatalf("read error = %v, want errDecompressedTooLarge", err)
+        }
+        if len(read) != 64<<10 {
+                t.Errorf("handler read %d bytes, want exactly the %d byte limit", len(read), 64<<10)
+        }
+}
+
+func TestDecompressionWithinLimit(t *testing.T) {
+        withConfig(t, func(c *Config) { c.MaxDecompressedBytes = 1 << 10 })
+        payload := []byte(`{"changes":[{"path":"/panel/zone_4","value":"fault"}]}`)
+
+        w, read, err := readThroughDecompression(t, gzipBytes(t, payload), " GZIP ")
+        if err != nil || !bytes.Equal(read, payload) {
+                t.Fatalf("read %q, %v; want the original payload", read, err)
+        }
+        if w.Code != http.StatusNoContent {
+                t.Errorf("status = %d", w.Code)
+        }
+}
+
+func TestDecompressionRejectsUnknownEncoding(t *testing.T) {
+        w, _, _ := readThroughDecompression(t, []byte("x"), "br")
+        if w.Code != http.StatusUnsupportedMediaType {
+                t.Errorf("status = %d, want 415", w.Code)
+        }
+}
+
+// Counts reads so tests can tell whether the body was touched
+type countingBody struct {
+        io.Reader
+        reads int
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+        b.reads++
+        return b.Reader.Read(p)
+}
+
+func (b *countingBody) Close() error { return nil }
+
+func TestGzipRequestBodyOpensLazily(t *testing.T) {
+        body := &countingBody{Reader: bytes.NewReader([]byte("not gzip at all"))}
+        handler := decompressionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                // Rejecting on headers alone must not read (and 100-continue) the body
+                http.Error(w, "X-User-ID header required", http.StatusBadRequest)
+        }))
+        r := httptest.NewRequest(http.MethodPost, "/v1/evidence", nil)
+        r.Body = body
+        r.Header.Set("Content-Encoding", "gzip")
+        handler.ServeHTTP(httptest.NewRecorder(), r)
+        if body.reads != 0 {
+                t.Errorf("middleware read the body %d times before the handler asked", body.reads)
+        }
+
+        // The malformed header surfaces on the handler's first read
+        _, read, err := readThroughDecompression(t, []byte("not gzip at all"), "gzip")
+        if !errors.Is(err, errInvalidGzipBody) || len(read) != 0 {
+                t.Errorf("read %q, %v; want errInvalidGzipBody", read, err)
+        }
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "encoding/json"
+        "fmt"
+        "image"
+        _ "image/gif" // Register GIF decoding for thumbnails
+        "image/jpeg"
+        _ "image/png" // Register PNG decoding for thumbnails
+        "io"
+        "log"
+        "strings"
+
+        "github.com/google/uuid"
+)
+
+// An artifact derived from an evidence file, stored as a linked child record
+type DerivedArtifact struct {
+        Kind        string
+        ContentType string
+        Data        []byte
+}
+
+// Generates derived artifacts (e.g. thumbnails) from evidence contents
+type EvidenceProcessor interface {
+        // Accepts reports whether the processor handles a content type
+        Accepts(contentType string) bool
+        // Process reads the evidence contents and returns the derived artifact
+        Process(ctx context.Context, r io.Reader, contentType string) (*DerivedArtifact, error)
+}
+
+// Processors run after each upload, configured at startup
+var evidenceProcessors []EvidenceProcessor
+
+// Scales still images (JPEG, PNG, GIF) down to a JPEG thumbnail
+type ImageThumbnailer struct {
+        MaxDimension int
+}
+
+func (t *ImageThumbnailer) Accepts(contentType string) bool {
+        switch strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0])) {
+        case "image/jpeg", "image/png", "image/gif":
+                return true
+        }
+        return false
+}
+
+// Largest image, in pixels, the thumbnailer will decode
+const maxThumbnailSourcePixels = 64 << 20
+
+func (t *ImageThumbnailer) Process(ctx context.Context, r io.Reader, contentType string) (*DerivedArtifact, error) {
+        // Check dimensions first so a small file cannot decode into a huge bitmap
+        if seeker, ok := r.(io.Seeker); ok {
+                config, _, err := image.DecodeConfig(r)
+                if err != nil {
+                        return nil, fmt.Errorf("failed to decode image: %v", err)
+                }
+                if config.Width*config.Height > maxThumbnailSourcePixels {
+                        return nil, fmt.Errorf("image too large to thumbnail (%dx%d)", config.Width, config.Height)
+                }
+                if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+                        return nil, err
+                }
+        }
+
+        src, _, err := image.Decode(r)
+        if err != nil {
+                return nil, fmt.Errorf("failed to decode image: %v", err)
+        }
+
+        bounds := src.Bounds()
+        width, height := bounds.Dx(), bounds.Dy()
+        if width == 0 || height == 0 {
+                return nil, fmt.Errorf("image has no pixels")
+        }
+        scale := float64(t.MaxDimension) / float64(max(width, height))
+        if scale > 1 {
+                scale = 1
+        }
+        dstWidth, dstHeight := max(1, int(float64(width)*scale)), max(1, int(float64(height)*scale))
+
+        // Nearest-neighbour sampling is plenty for a preview and needs no codec dependencies
+        dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+        for y := 0; y < dstHeight; y++ {
+                for x := 0; x < dstWidth; x++ {
+                        dst.Set(x, y, src.At(bounds.Min.X+x*width/dstWidth, bounds.Min.Y+y*height/dstHeight))
+                }
+        }
+
+        var buf bytes.Buffer
+        if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 80}); err != nil {
+                return nil, err
+        }
+        return &DerivedArtifact{Kind: "thumbnail", ContentType: "image/jpeg", Data: buf.Bytes()}, nil
+}
+
+// Configure evidence processors from the environment
+func newEvidenceProcessorsFromConfig() []EvidenceProcessor {
+        var processors []EvidenceProcessor
+        if cfg.EvidenceThumbnailsEnabled {
+                processors = append(processors, &ImageThumbnailer{MaxDimension: int(cfg.ThumbnailMaxDimension)})
+        }
+        return processors
+}
+
+// Queue derived-artifact generation for an uploaded evidence record. ctx must
+// outlive the request and carry its tenant routing.
+func scheduleEvidenceProcessing(ctx context.Context, parent *EvidenceRecord, contentType string) {
+        for _, processor := range evidenceProcessors {
+                if !processor.Accepts(contentType) {
+                        continue
+                }
+                job := func(context.Context) {
+                        if err := deriveEvidenceArtifact(ctx, processor, parent, contentType); err != nil {
+                                log.Printf("Failed to derive artifact for evidence %s: %v", parent.ID, err)
+                        }
+                }
+                if workerPool == nil || !workerPool.Submit(job) {
+                        log.Printf("Worker queue full, skipping derived artifact for evidence %s", parent.ID)
+                }
+        }
+}
+
+// Run a processor over a stored evidence object and store its output as a child record
+func deriveEvidenceArtifact(ctx context.Context, processor EvidenceProcessor, parent *EvidenceRecord, contentType string) error {
+        blob, err := evidenceStore.Get(ctx, evidenceObjectKey(ctx, parent.ID))
+        if err != nil {
+                return err
+        }
+        artifact, err := processor.Process(ctx, blob, contentType)
+        blob.Close()
+        if err != nil {
+                return err
+        }
+
+        childID := uuid.New().String()
+        if _, err := evidenceStore.Put(ctx, evidenceObjectKey(ctx, childID), bytes.NewReader(artifact.Data)); err != nil {
+                return err
+        }
+
+        metadata, _ := json.Marshal(map[string]interface{}{
+                "derived_from": parent.ID,
+                "kind":         artifact.Kind,
+                "content_type": artifact.ContentType,
+                "file_size":    len(artifact.Data),
+        })
+        query := `
+                INSERT INTO evidence (id, session_id, evidence_type, file_path, metadata, checksum, parent_evidence_id, created_at)
+                VALUES ($1, $2, $3, $4, $5, $6, $7, CURRENT_TIMESTAMP)
+        `
+        _, err = dbFor(ctx).Exec(ctx, query, childID, parent.SessionID, artifact.Kind, fmt.Sprintf("/evidence/%s", childID),
+                string(metadata), calculateSHA256(artifact.Data), parent.ID)
+        if err != nil {
+                evidenceStore.Delete(context.Background(), evidenceObjectKey(ctx, childID))
+                return err
+        }
+        return nil
+}
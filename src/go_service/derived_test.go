@@ -0,0 +1,166 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "image"
+        "image/color"
+        "image/jpeg"
+        "image/png"
+        "io"
+        "runtime"
+        "sync/atomic"
+        "testing"
+)
+
+// Processor standing in for real codec work: it "thumbnails" text files by
+// prefixing their contents
+type stubProcessor struct {
+        calls atomic.Int64
+}
+
+func (p *stubProcessor) Accepts(contentType string) bool {
+        return contentType == "text/x-floorplan"
+}
+
+func (p *stubProcessor) Process(ctx context.Context, r io.Reader, contentType string) (*DerivedArtifact, error) {
+        p.calls.Add(1)
+        data, err := io.ReadAll(r)
+        if err != nil {
+                return nil, err
+        }
+        return &DerivedArtifact{Kind: "thumbnail", ContentType: "text/plain", Data: append([]byte("thumb:"), data...)}, nil
+}
+
+// Install processors and a fresh worker pool for the duration of a test
+func useTestProcessors(t *testing.T, processors ...EvidenceProcessor) *WorkerPool {
+        t.Helper()
+        oldProcessors, oldPool := evidenceProcessors, workerPool
+        evidenceProcessors = processors
+        workerPool = NewWorkerPool(2, 8)
+        t.Cleanup(func() { evidenceProcessors, workerPool = oldProcessors, oldPool })
+        return workerPool
+}
+
+func TestEvidenceProcessingSkipsUnrecognizedTypes(t *testing.T) {
+        stub := &stubProcessor{}
+        pool := useTestProcessors(t, stub)
+
+        scheduleEvidenceProcessing(context.Background(), &EvidenceRecord{ID: "evidence-pdf"}, "application/pdf")
+        pool.Close()
+        if got := stub.calls.Load(); got != 0 {
+                t.Errorf("processor ran %d times for an unrecognized type", got)
+        }
+}
+
+func TestDerivedArtifactLinkedToParent(t *testing.T) {
+        db := testDB(t)
+        useTestEvidenceStore(t)
+        stub := &stubProcessor{}
+        workers := useTestProcessors(t, stub)
+
+        sessionID := insertTestSession(t, db, nil, nil)
+        parentID := insertTestEvidence(t, db, sessionID, []byte("level 2 floorplan"), nil)
+        scheduleEvidenceProcessing(context.Background(), &EvidenceRecord{ID: parentID, SessionID: sessionID}, "text/x-floorplan")
+        workers.Close() // waits for the queued job
+
+        if got := stub.calls.Load(); got != 1 {
+                t.Fatalf("processor ran %d times, want 1", got)
+        }
+        var childID string
+        err := db.QueryRow(context.Background(),
+                `SELECT id::text FROM evidence WHERE parent_evidence_id = $1`, parentID).Scan(&childID)
+        if err != nil {
+                t.Fatalf("no child evidence for parent: %v", err)
+        }
+
+        child, err := loadEvidenceRecord(context.Background(), childID)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if child.ParentID == nil || *child.ParentID != parentID {
+                t.Errorf("ParentID = %v, want %s", child.ParentID, parentID)
+        }
+        if child.SessionID != sessionID || child.EvidenceType != "thumbnail" {
+                t.Errorf("child = %+v, want a thumbnail in session %s", child, sessionID)
+        }
+        if child.Metadata["derived_from"] != parentID {
+                t.Errorf("metadata = %v, want derived_from %s", child.Metadata, parentID)
+        }
+
+        blob, err := evidenceStore.Get(context.Background(), evidenceObjectKey(context.Background(), childID))
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer blob.Close()
+        data, _ := io.ReadAll(blob)
+        if string(data) != "thumb:level 2 floorplan" {
+                t.Errorf("stored artifact = %q", data)
+        }
+}
+
+func TestImageThumbnailerScalesDown(t *testing.T) {
+        src := image.NewRGBA(image.Rect(0, 0, 640, 480))
+        for y := 0; y < 480; y++ {
+                for x := 0; x < 640; x++ {
+                        src.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 0x40, A: 0xff})
+                }
+        }
+        var buf bytes.Buffer
+        if err := png.Encode(&buf, src); err != nil {
+                t.Fatal(err)
+        }
+
+        thumbnailer := &ImageThumbnailer{MaxDimension: 128}
+        if !thumbnailer.Accepts("image/png; charset=binary") || thumbnailer.Accepts("video/mp4") {
+                t.Fatal("unexpected Accepts result")
+        }
+        artifact, err := thumbnailer.Process(context.Background(), bytes.NewReader(buf.Bytes()), "image/png")
+        if err != nil {
+                t.Fatal(err)
+        }
+        if artifact.Kind != "thumbnail" || artifact.ContentType != "image/jpeg" {
+                t.Errorf("artifact = %s %s", artifact.Kind, artifact.ContentType)
+        }
+        thumb, err := jpeg.Decode(bytes.NewReader(artifact.Data))
+        if err != nil {
+                t.Fatalf("thumbnail is not a JPEG: %v", err)
+        }
+        if got := thumb.Bounds().Size(); got != image.Pt(128, 96) {
+                t.Errorf("thumbnail size = %v, want 128x96", got)
+        }
+}
+
+func TestImageThumbnailerRejectsCorruptImages(t *testing.T) {
+        thumbnailer := &ImageThumbnailer{MaxDimension: 64}
+        _, err := thumbnailer.Process(context.Background(), bytes.NewReader([]byte("\x89PNG not really")), "image/png")
+        if err == nil {
+                t.Error("corrupt image produced a thumbnail")
+        }
+}
+
+func TestWorkerPoolQueueFullAndPanics(t *testing.T) {
+        captureLog(t)
+        pool := NewWorkerPool(1, 1)
+        started, release := make(chan struct{}), make(chan struct{})
+        var ran atomic.Int64
+
+        pool.Submit(func(context.Context) { close(started); <-release })
+        <-started
+        if !pool.Submit(func(context.Context) { panic("bad job") }) {
+                t.Fatal("queue rejected a job while it had room")
+        }
+        if pool.Submit(func(context.Context) { ran.Add(1) }) {
+                t.Error("queue accepted a job while full")
+        }
+        close(release)
+
+        // The worker survives the panicking job and keeps draining the queue
+        for !pool.Submit(func(context.Context) { ran.Add(1) }) {
+                runtime.Gosched()
+        }
+        pool.Close()
+        if got := ran.Load(); got != 1 {
+                t.Errorf("ran %d jobs after the panic, want 1", got)
+        }
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+        "crypto/sha256"
+        "encoding/base64"
+        "encoding/hex"
+        "fmt"
+)
+
+// Build an RFC 9530 Repr-Digest value ("sha-256=:<base64>:") from raw SHA-256 bytes
+func formatReprDigest(sum []byte) string {
+        return "sha-256=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+}
+
+// Build a Repr-Digest value from a hex-encoded SHA-256 checksum
+func reprDigestFromHex(checksum string) (string, error) {
+        sum, err := hex.DecodeString(checksum)
+        if err != nil || len(sum) != sha256.Size {
+                return "", fmt.Errorf("invalid SHA-256 checksum %q", checksum)
+        }
+        return formatReprDigest(sum), nil
+}
+
+// Build a Repr-Digest value over a response body
+func reprDigest(body []byte) string {
+        sum := sha256.Sum256(body)
+        return formatReprDigest(sum[:])
+}
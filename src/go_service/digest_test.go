@@ -0,0 +1,111 @@
+package main
+
+import (
+        "bytes"
+        "crypto/sha256"
+        "encoding/base64"
+        "net/http"
+        "net/http/httptest"
+        "regexp"
+        "testing"
+)
+
+// RFC 9530 Repr-Digest: a structured-field dictionary member whose value is a
+// byte sequence, i.e. standard base64 (with padding) between colons
+var reprDigestPattern = regexp.MustCompile(`^sha-256=:([A-Za-z0-9+/]{43}=):$`)
+
+// Decode a Repr-Digest header value, failing the test when it is malformed
+func decodeReprDigest(t *testing.T, value string) []byte {
+        t.Helper()
+        match := reprDigestPattern.FindStringSubmatch(value)
+        if match == nil {
+                t.Fatalf("Repr-Digest %q does not match the RFC 9530 format", value)
+        }
+        sum, err := base64.StdEncoding.DecodeString(match[1])
+        if err != nil {
+                t.Fatalf("Repr-Digest %q is not valid base64: %v", value, err)
+        }
+        return sum
+}
+
+func TestReprDigestFormat(t *testing.T) {
+        for _, body := range [][]byte{nil, []byte("{}\n"), bytes.Repeat([]byte{0xff, 0x00}, 3000)} {
+                want := sha256.Sum256(body)
+                if sum := decodeReprDigest(t, reprDigest(body)); !bytes.Equal(sum, want[:]) {
+                        t.Errorf("digest of %d bytes = %x, want %x", len(body), sum, want)
+                }
+        }
+}
+
+func TestReprDigestFromHex(t *testing.T) {
+        // SHA-256 of "abc" (FIPS 180-2 test vector)
+        digest, err := reprDigestFromHex("ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad")
+        if err != nil {
+                t.Fatal(err)
+        }
+        if digest != "sha-256=:ungWv48Bz+pBQUDeXa4iI7ADYaOWF3qctBD/YfIAFa0=:" {
+                t.Errorf("digest = %s", digest)
+        }
+        for _, bad := range []string{"", "abc", "zz7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad", "ba7816bf"} {
+                if _, err := reprDigestFromHex(bad); err == nil {
+                        t.Errorf("reprDigestFromHex(%q) succeeded", bad)
+                }
+        }
+}
+
+func TestWriteJSONReprDigest(t *testing.T) {
+        withConfig(t, func(c *Config) { c.JSONReprDigest = true })
+        w := httptest.NewRecorder()
+        writeJSON(w, http.StatusCreated, map[string]int{"devices_tested": 14})
+        want := sha256.Sum256(w.Body.Bytes())
+        if sum := decodeReprDigest(t, w.Header().Get("Repr-Digest")); !bytes.Equal(sum, want[:]) {
+                t.Errorf("Repr-Digest does not describe the body %q", w.Body.String())
+        }
+
+        cfg.JSONReprDigest = false
+        w = httptest.NewRecorder()
+        writeJSON(w, http.StatusOK, map[string]int{"devices_tested": 14})
+        if w.Header().Get("Repr-Digest") != "" {
+                t.Error("Repr-Digest emitted with JSON_REPR_DIGEST off")
+        }
+}
+
+func TestGzipDropsReprDigest(t *testing.T) {
+        withConfig(t, func(c *Config) {
+                c.ResponseGzipEnabled = true
+                c.JSONReprDigest = true
+        })
+        handler := compressionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                writeJSON(w, http.StatusOK, map[string]string{"notes": string(bytes.Repeat([]byte("a"), 4096))})
+        }))
+        r := httptest.NewRequest(http.MethodGet, "/v1/tests/sessions/x", nil)
+        r.Header.Set("Accept-Encoding", "gzip")
+        w := httptest.NewRecorder()
+        handler.ServeHTTP(w, r)
+        if w.Header().Get("Content-Encoding") != "gzip" {
+                t.Fatalf("Content-Encoding = %q, want gzip", w.Header().Get("Content-Encoding"))
+        }
+        if w.Header().Get("Repr-Digest") != "" {
+                t.Error("gzip-encoded response kept the identity Repr-Digest")
+        }
+}
+
+func TestEvidenceDownloadReprDigest(t *testing.T) {
+        pool := testDB(t)
+        useTestEvidenceStore(t)
+        content := bytes.Repeat([]byte("annual sprinkler inspection report\n"), 200)
+        evidenceID := insertTestEvidence(t, pool, insertTestSession(t, pool, nil, nil), content,
+                map[string]interface{}{"content_type": "text/plain"})
+
+        w := getEvidence(t, http.MethodGet, evidenceID, nil)
+        if w.Code != http.StatusOK {
+                t.Fatalf("status = %d", w.Code)
+        }
+        want := sha256.Sum256(content)
+        if sum := decodeReprDigest(t, w.Header().Get("Repr-Digest")); !bytes.Equal(sum, want[:]) {
+                t.Errorf("Repr-Digest = %x, want %x", sum, want)
+        }
+        if !bytes.Equal(w.Body.Bytes(), content) {
+                t.Error("downloaded body differs from the stored content")
+        }
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+        "context"
+        "crypto/aes"
+        "crypto/cipher"
+        "crypto/rand"
+        "encoding/base64"
+        "encoding/binary"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "io"
+)
+
+// Envelope encryption of evidence objects at rest. Each object gets a random
+// data key, wrapped by the configured key-encryption key and stored with the
+// object. Content is sealed with AES-256-GCM in fixed-size segments so reads
+// stay seekable; each segment's nonce and additional data bind its index and
+// whether it is the last, so reordered or truncated objects fail to decrypt.
+const (
+        evidenceEncryptionAlgorithm = "AES-256-GCM-SEGMENTED"
+        evidenceEncryptionMagic     = "FEV1"
+        evidenceSegmentSize         = 64 << 10
+        evidenceGCMTagSize          = 16
+        // Upper bound on the encoded header, guarding against corrupt length fields
+        maxEncryptionHeaderSize = 4 << 10
+)
+
+// Returned when an object is not in the encrypted format or fails authentication
+var errEvidenceDecryption = errors.New("evidence object failed decryption")
+
+// Encryption parameters stored in an object's header and recorded in the
+// evidence metadata. The wrapped key is only usable with the key-encryption key.
+type EvidenceEncryption struct {
+        Algorithm   string `json:"algorithm"`
+        KeyID       string `json:"key_id"`
+        IV          []byte `json:"iv"`
+        WrappedKey  []byte `json:"wrapped_key"`
+        SegmentSize int64  `json:"segment_size"`
+}
+
+// Wraps and unwraps per-object data keys. The local wrapper uses a configured
+// key; a KMS-backed wrapper can be substituted without changing the format.
+type EvidenceKeyWrapper interface {
+        KeyID() string
+        Wrap(dataKey []byte) ([]byte, error)
+        Unwrap(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// Key wrapper sealing data keys with AES-256-GCM under a local key
+type localKeyWrapper struct {
+        id   string
+        aead cipher.AEAD
+}
+
+// Create a wrapper from a base64-encoded 32-byte key
+func newLocalKeyWrapper(id, encodedKey string) (*localKeyWrapper, error) {
+        key, err := base64.StdEncoding.DecodeString(encodedKey)
+        if err != nil {
+                return nil, fmt.Errorf("evidence encryption key is not valid base64")
+        }
+        if len(key) != 32 {
+                return nil, fmt.Errorf("evidence encryption key must be 32 bytes, got %d", len(key))
+        }
+        aead, err := newGCM(key)
+        if err != nil {
+                return nil, err
+        }
+        return &localKeyWrapper{id: id, aead: aead}, nil
+}
+
+func (w *localKeyWrapper) KeyID() string {
+        return w.id
+}
+
+// Seal the data key under a random nonce, returned as nonce || ciphertext
+func (w *localKeyWrapper) Wrap(dataKey []byte) ([]byte, error) {
+        nonce := make([]byte, w.aead.NonceSize())
+        if _, err := rand.Read(nonce); err != nil {
+                return nil, err
+        }
+        return w.aead.Seal(nonce, nonce, dataKey, []byte(w.id)), nil
+}
+
+func (w *localKeyWrapper) Unwrap(keyID string, wrapped []byte) ([]byte, error) {
+        if keyID != w.id {
+                return nil, fmt.Errorf("evidence data key was wrapped with unknown key %q", keyID)
+        }
+        if len(wrapped) < w.aead.NonceSize() {
+                return nil, errEvidenceDecryption
+        }
+        nonce, sealed := wrapped[:w.aead.NonceSize()], wrapped[w.aead.NonceSize():]
+        dataKey, err := w.aead.Open(nil, nonce, sealed, []byte(keyID))
+        if err != nil {
+                return nil, errEvidenceDecryption
+        }
+        return dataKey, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+        block, err := aes.NewCipher(key)
+        if err != nil {
+                return nil, err
+        }
+        return cipher.NewGCM(block)
+}
+
+// Evidence store encrypting objects before they reach the wrapped store and
+// decrypting them on Get. Sizes and byte counts are of the plaintext, so
+// checksums and post-write verification are unaffected.
+type EncryptingEvidenceStore struct {
+        inner   EvidenceStore
+        wrapper EvidenceKeyWrapper
+}
+
+// Wrap inner so objects are encrypted with data keys wrapped by wrapper
+func NewEncryptingEvidenceStore(inner EvidenceStore, wrapper EvidenceKeyWrapper) *EncryptingEvidenceStore {
+        return &EncryptingEvidenceStore{inner: inner, wrapper: wrapper}
+}
+
+// Build the key wrapper from EVIDENCE_ENCRYPTION_KEY, or nil when encryption is disabled
+func newEvidenceKeyWrapperFromConfig() (EvidenceKeyWrapper, error) {
+        if cfg.EvidenceEncryptionKey == "" {
+                return nil, nil
+        }
+        return newLocalKeyWrapper(cfg.EvidenceEncryptionKeyID, cfg.EvidenceEncryptionKey)
+}
+
+func (s *EncryptingEvidenceStore) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+        dataKey := make([]byte, 32)
+        iv := make([]byte, 12)
+        if _, err := rand.Read(dataKey); err != nil {
+                return 0, err
+        }
+        if _, err := rand.Read(iv); err != nil {
+                return 0, err
+        }
+        wrapped, err := s.wrapper.Wrap(dataKey)
+        if err != nil {
+                return 0, fmt.Errorf("failed to wrap evidence data key: %v", err)
+        }
+        aead, err := newGCM(dataKey)
+        if err != nil {
+                return 0, err
+        }
+
+        header, err := encodeEncryptionHeader(EvidenceEncryption{
+                Algorithm:   evidenceEncryptionAlgorithm,
+                KeyID:       s.wrapper.KeyID(),
+                IV:          iv,
+                WrappedKey:  wrapped,
+                SegmentSize: evidenceSegmentSize,
+        })
+        if err != nil {
+                return 0, err
+        }
+
+        enc := &encryptingReader{src: r, aead: aead, iv: iv, header: header, out: header}
+        if _, err := s.inner.Put(ctx, key, enc); err != nil {
+                return enc.plaintext, err
+        }
+        return enc.plaintext, nil
+}
+
+func (s *EncryptingEvidenceStore) Get(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+        blob, err := s.inner.Get(ctx, key)
+        if err != nil {
+                return nil, err
+        }
+        dec, err := s.openDecrypting(blob)
+        if err != nil {
+                blob.Close()
+                return nil, fmt.Errorf("%w: %s: %v", errEvidenceDecryption, key, err)
+        }
+        return dec, nil
+}
+
+// Report the plaintext size, derived from the stored size and segment layout
+func (s *EncryptingEvidenceStore) Size(ctx context.Context, key string) (int64, error) {
+        blob, err := s.inner.Get(ctx, key)
+        if err != nil {
+                return 0, err
+        }
+        defer blob.Close()
+
+        info, headerSize, err := readEncryptionHeader(blob)
+        if err != nil {
+                return 0, fmt.Errorf("%w: %s: %v", errEvidenceDecryption, key, err)
+        }
+        total, err := s.inner.Size(ctx, key)
+        if err != nil {
+                return 0, err
+        }
+        _, plaintext, err := segmentLayout(total-headerSize, info.SegmentSize)
+        if err != nil {
+                return 0, fmt.Errorf("%w: %s: %v", errEvidenceDecryption, key, err)
+        }
+        return plaintext, nil
+}
+
+func (s *EncryptingEvidenceStore) Delete(ctx context.Context, key string) error {
+        return s.inner.Delete(ctx, key)
+}
+
+// Encryption parameters of a stored object, for recording with its evidence record
+func (s *EncryptingEvidenceStore) Encryption(ctx context.Context, key string) (*EvidenceEncryption, error) {
+        blob, err := s.inner.Get(ctx, key)
+        if err != nil {
+                return nil, err
+        }
+        defer blob.Close()
+
+        info, _, err := readEncryptionHeader(blob)
+        if err != nil {
+                return nil, fmt.Errorf("%w: %s: %v", errEvidenceDecryption, key, err)
+        }
+        return info, nil
+}
+
+func (s *EncryptingEvidenceStore) StorageLocation() StorageLocation {
+        if locator, ok := s.inner.(EvidenceStoreLocator); ok {
+                return locator.StorageLocation()
+        }
+        return StorageLocation{}
+}
+
+func (s *EncryptingEvidenceStore) Check(ctx context.Context) error {
+        return probeEvidenceStore(ctx, s.inner)
+}
+
+// Implemented by evidence stores that encrypt objects at rest
+type EvidenceStoreEncrypter interface {
+        Encryption(ctx context.Context, key string) (*EvidenceEncryption, error)
+}
+
+// Encryption parameters of the object stored under key, or nil when the active
+// store does not encrypt or the object is not (yet) in the encrypting store
+func evidenceEncryption(ctx context.Context, key string) *EvidenceEncryption {
+        encrypter, ok := evidenceStore.(EvidenceStoreEncrypter)
+        if !ok {
+                return nil
+        }
+        info, err := encrypter.Encryption(ctx, key)
+        if err != nil {
+                return nil
+        }
+        return info
+}
+
+// Header layout: magic, big-endian uint32 length, JSON-encoded EvidenceEncryption
+func encodeEncryptionHeader(info EvidenceEncryption) ([]byte, error) {
+        body, err := json.Marshal(info)
+        if err != nil {
+                return nil, err
+        }
+        header := make([]byte, len(evidenceEncryptionMagic)+4, len(evidenceEncryptionMagic)+4+len(body))
+        copy(header, evidenceEncryptionMagic)
+        binary.BigEndian.PutUint32(header[len(evidenceEncryptionMagic):], uint32(len(body)))
+        return append(header, body...), nil
+}
+
+// Read an object's header, returning its parameters and encoded length
+func readEncryptionHeader(r io.Reader) (*EvidenceEncryption, int64, error) {
+        prefix := make([]byte, len(evidenceEncryptionMagic)+4)
+        if _, err := io.ReadFull(r, prefix); err != nil {
+                return nil, 0, fmt.Errorf("missing encryption header")
+        }
+        if string(prefix[:len(evidenceEncryptionMagic)]) != evidenceEncryptionMagic {
+                return nil, 0, fmt.Errorf("object is not encrypted")
+        }
+        length := binary.BigEndian.Uint32(prefix[len(evidenceEncryptionMagic):])
+        if length > maxEncryptionHeaderSize {
+                return nil, 0, fmt.Errorf("encryption header too large")
+        }
+        body := make([]byte, length)
+        if _, err := io.ReadFull(r, body); err != nil {
+                return nil, 0, fmt.Errorf("truncated encryption header")
+        }
+
+        var info EvidenceEncryption
+        if err := json.Unmarshal(body, &info); err != nil {
+                return nil, 0, fmt.Errorf("invalid encryption header")
+        }
+        if info.Algorithm != evidenceEncryptionAlgorithm {
+                return nil, 0, fmt.Errorf("unsupported encryption algorithm %q", info.Algorithm)
+        }
+        if len(info.IV) != 12 || info.SegmentSize <= 0 {
+                return nil, 0, fmt.Errorf("invalid encryption parameters")
+        }
+        return &info, int64(len(prefix)) + int64(length), nil
+}
+
+// Number of segments and plaintext size for a ciphertext body. Every object has
+// at least one segment, so an empty plaintext still carries an authenticated tag.
+func segmentLayout(body, segmentSize int64) (int64, int64, error) {
+        sealed := segmentSize + evidenceGCMTagSize
+        segments := (body + sealed - 1) / sealed
+        if body < evidenceGCMTagSize || (body%sealed != 0 && body%sealed < evidenceGCMTagSize) {
+                return 0, 0, fmt.Errorf("truncated ciphertext")
+        }
+        return segments, body - segments*evidenceGCMTagSize, nil
+}
+
+// Nonce for a segment: the object IV with the segment index XORed into its tail
+func segmentNonce(iv []byte, index int64) []byte {
+        nonce := append([]byte(nil), iv...)
+        tail := binary.BigEndian.Uint64(nonce[4:]) ^ uint64(index)
+        binary.BigEndian.PutUint64(nonce[4:], tail)
+        return nonce
+}
+
+// Additional data binding a segment's position and whether it ends the object
+func segmentAAD(index int64, final bool) []byte {
+        aad := make([]byte, 9)
+        binary.BigEndian.PutUint64(aad, uint64(index))
+        if final {
+                aad[8] = 1
+        }
+        return aad
+}
+
+// Produces the header followed by sealed segments of src. A segment is read
+// ahead so the last one can be marked final.
+type encryptingReader struct {
+        src       io.Reader
+        aead      cipher.AEAD
+        iv        []byte
+        header    []byte
+        out       []byte
+        current   []byte
+        eof       bool
+        started   bool
+        done      bool
+        index     int64
+        plaintext int64
+}
+
+func (e *encryptingReader) Read(p []byte) (int, error) {
+        for len(e.out) == 0 {
+                if e.done {
+                        return 0, io.EOF
+                }
+                if err := e.seal(); err != nil {
+                        return 0, err
+                }
+        }
+        n := copy(p, e.out)
+        e.out = e.out[n:]
+        return n, nil
+}
+
+// Rewind to the start of the ciphertext so a store can retry the write (the
+// spool replays it after a primary store failure). Only a rewind of a seekable
+// src is supported; the same key and IV then seal the same plaintext, so the
+// replayed ciphertext is identical and no nonce is reused for other data.
+func (e *encryptingReader) Seek(offset int64, whence int) (int64, error) {
+        seeker, ok := e.src.(io.Seeker)
+        if !ok || offset != 0 || whence != io.SeekStart {
+                return 0, errors.New("encrypted evidence stream can only be rewound to the start")
+        }
+        if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+                return 0, err
+        }
+        e.out = e.header
+        e.current, e.eof, e.started, e.done = nil, false, false, false
+        e.index, e.plaintext = 0, 0
+        return 0, nil
+}
+
+func (e *encryptingReader) seal() error {
+        var err error
+        if !e.started {
+                e.started = true
+                if e.current, e.eof, err = readSegment(e.src); err != nil {
+                        return err
+                }
+        }
+
+        final := e.eof
+        var next []byte
+        if !final {
+                if next, e.eof, err = readSegment(e.src); err != nil {
+                        return err
+                }
+                final = e.eof && len(next) == 0
+        }
+
+        e.out = e.aead.Seal(nil, segmentNonce(e.iv, e.index), e.current, segmentAAD(e.index, final))
+        e.plaintext += int64(len(e.current))
+        e.index++
+        e.current = next
+        e.done = final
+        return nil
+}
+
+// Read up to one segment, reporting whether src is exhausted
+func readSegment(src io.Reader) ([]byte, bool, error) {
+        buf := make([]byte, evidenceSegmentSize)
+        n, err := io.ReadFull(src, buf)
+        if err == io.EOF || err == io.ErrUnexpectedEOF {
+                return buf[:n], true, nil
+        }
+        if err != nil {
+                return nil, false, err
+        }
+        return buf, false, nil
+}
+
+// Seekable plaintext view of an encrypted object, decrypting one segment at a time
+type decryptingReader struct {
+        blob        io.ReadSeekCloser
+        aead        cipher.AEAD
+        iv          []byte
+        segmentSize int64
+        dataStart   int64
+        dataSize    int64
+        segments    int64
+        size        int64
+        pos         int64
+        loaded      int64
+        plain       []byte
+}
+
+// Read the header, unwrap the data key and authenticate the final segment, so
+// a truncated object is rejected before any content is served
+func (s *EncryptingEvidenceStore) openDecrypting(blob io.ReadSeekCloser) (*decryptingReader, error) {
+        info, headerSize, err := readEncryptionHeader(blob)
+        if err != nil {
+                return nil, err
+        }
+        dataKey, err := s.wrapper.Unwrap(info.KeyID, info.WrappedKey)
+        if err != nil {
+                return nil, err
+        }
+        aead, err := newGCM(dataKey)
+        if err != nil {
+                return nil, err
+        }
+        end, err := blob.Seek(0, io.SeekEnd)
+        if err != nil {
+                return nil, err
+        }
+        segments, size, err := segmentLayout(end-headerSize, info.SegmentSize)
+        if err != nil {
+                return nil, err
+        }
+
+        d := &decryptingReader{
+                blob:        blob,
+                aead:        aead,
+                iv:          info.IV,
+                segmentSize: info.SegmentSize,
+                dataStart:   headerSize,
+                dataSize:    end - headerSize,
+                segments:    segments,
+                size:        size,
+                loaded:      -1,
+        }
+        if err := d.load(segments - 1); err != nil {
+                return nil, err
+        }
+        return d, nil
+}
+
+// Decrypt segment index into the plaintext buffer
+func (d *decryptingReader) load(index int64) error {
+        sealedSize := d.segmentSize + evidenceGCMTagSize
+        offset := index * sealedSize
+        length := sealedSize
+        if remaining := d.dataSize - offset; remaining < length {
+                length = remaining
+        }
+        if _, err := d.blob.Seek(d.dataStart+offset, io.SeekStart); err != nil {
+                return err
+        }
+        sealed := make([]byte, length)
+        if _, err := io.ReadFull(d.blob, sealed); err != nil {
+                return err
+        }
+        plain, err := d.aead.Open(sealed[:0], segmentNonce(d.iv, index), sealed, segmentAAD(index, index == d.segments-1))
+        if err != nil {
+                return errEvidenceDecryption
+        }
+        d.plain, d.loaded = plain, index
+        return nil
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+        if d.pos >= d.size {
+                return 0, io.EOF
+        }
+        index := d.pos / d.segmentSize
+        if index != d.loaded {
+                if err := d.load(index); err != nil {
+                        return 0, err
+                }
+        }
+        n := copy(p, d.plain[d.pos-index*d.segmentSize:])
+        d.pos += int64(n)
+        return n, nil
+}
+
+func (d *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+        var pos int64
+        switch whence {
+        case io.SeekStart:
+                pos = offset
+        case io.SeekCurrent:
+                pos = d.pos + offset
+        case io.SeekEnd:
+                pos = d.size + offset
+        default:
+                return 0, fmt.Errorf("invalid whence %d", whence)
+        }
+        if pos < 0 {
+                return 0, fmt.Errorf("negative position")
+        }
+        d.pos = pos
+        return pos, nil
+}
+
+func (d *decryptingReader) Close() error {
+        return d.blob.Close()
+}
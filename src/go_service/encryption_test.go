@@ -0,0 +1,148 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "crypto/rand"
+        "encoding/base64"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "io"
+        "net/http"
+        "testing"
+)
+
+func TestEncryptingStoreRoundTrip(t *testing.T) {
+        inner := useTestEvidenceStore(t)
+        store := newTestEncryptingStore(t, inner)
+        ctx := context.Background()
+
+        for _, size := range []int{0, 1, evidenceSegmentSize - 1, evidenceSegmentSize, 2*evidenceSegmentSize + 17} {
+                plaintext := make([]byte, size)
+                rand.Read(plaintext)
+                key := fmt.Sprintf("ev-round-trip-%d", size)
+
+                n, err := store.Put(ctx, key, bytes.NewReader(plaintext))
+                if err != nil || n != int64(size) {
+                        t.Fatalf("%d bytes: Put = %d, %v", size, n, err)
+                }
+                if got := readAllAndClose(t, mustGet(t, store, key)); !bytes.Equal(got, plaintext) {
+                        t.Errorf("%d bytes: decrypted content differs", size)
+                }
+                if stored, err := store.Size(ctx, key); err != nil || stored != int64(size) {
+                        t.Errorf("%d bytes: Size = %d, %v; want the plaintext size", size, stored, err)
+                }
+
+                // The wrapped store holds ciphertext, never the plaintext
+                raw := readAllAndClose(t, mustGet(t, inner, key))
+                if size >= 16 && bytes.Contains(raw, plaintext) {
+                        t.Errorf("%d bytes: plaintext stored in the clear", size)
+                }
+                if !bytes.HasPrefix(raw, []byte(evidenceEncryptionMagic)) {
+                        t.Errorf("%d bytes: stored object lacks the encryption header", size)
+                }
+        }
+}
+
+func TestEncryptingStoreSeeks(t *testing.T) {
+        store := newTestEncryptingStore(t, useTestEvidenceStore(t))
+        plaintext := bytes.Repeat([]byte("0123456789abcdef"), evidenceSegmentSize/8) // two segments
+        if _, err := store.Put(context.Background(), "ev-seek", bytes.NewReader(plaintext)); err != nil {
+                t.Fatal(err)
+        }
+        blob := mustGet(t, store, "ev-seek")
+        defer blob.Close()
+
+        // A range spanning the segment boundary, as served for Range requests
+        offset := int64(evidenceSegmentSize - 5)
+        if _, err := blob.Seek(offset, io.SeekStart); err != nil {
+                t.Fatal(err)
+        }
+        chunk := make([]byte, 10)
+        if _, err := io.ReadFull(blob, chunk); err != nil || !bytes.Equal(chunk, plaintext[offset:offset+10]) {
+                t.Errorf("range = %q, %v; want %q", chunk, err, plaintext[offset:offset+10])
+        }
+        if end, err := blob.Seek(0, io.SeekEnd); err != nil || end != int64(len(plaintext)) {
+                t.Errorf("Seek(end) = %d, %v", end, err)
+        }
+}
+
+func TestEncryptingStoreRejectsTampering(t *testing.T) {
+        inner := useTestEvidenceStore(t)
+        store := newTestEncryptingStore(t, inner)
+        ctx := context.Background()
+        plaintext := bytes.Repeat([]byte("sprinkler riser inspection "), 5000)
+        if _, err := store.Put(ctx, "ev-original", bytes.NewReader(plaintext)); err != nil {
+                t.Fatal(err)
+        }
+        raw := readAllAndClose(t, mustGet(t, inner, "ev-original"))
+
+        flipped := bytes.Clone(raw)
+        flipped[len(flipped)-40] ^= 0x01
+        tests := map[string][]byte{
+                "flipped bit":   flipped,
+                "truncated":     raw[:len(raw)-evidenceSegmentSize/2],
+                "not encrypted": plaintext,
+        }
+        for name, object := range tests {
+                if _, err := inner.Put(ctx, "ev-"+name, bytes.NewReader(object)); err != nil {
+                        t.Fatal(err)
+                }
+                blob, err := store.Get(ctx, "ev-"+name)
+                if err == nil {
+                        _, err = io.ReadAll(blob)
+                        blob.Close()
+                }
+                if !errors.Is(err, errEvidenceDecryption) {
+                        t.Errorf("%s: err = %v, want errEvidenceDecryption", name, err)
+                }
+        }
+
+        // Another key-encryption key cannot unwrap the data key
+        otherKey, _ := newLocalKeyWrapper("test-key-1", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{9}, 32)))
+        if _, err := NewEncryptingEvidenceStore(inner, otherKey).Get(ctx, "ev-original"); err == nil {
+                t.Error("object decrypted under the wrong key")
+        }
+}
+
+func TestNewLocalKeyWrapperValidatesKey(t *testing.T) {
+        for _, key := range []string{"", "not base64!", base64.StdEncoding.EncodeToString(make([]byte, 16))} {
+                if _, err := newLocalKeyWrapper("kek-1", key); err == nil {
+                        t.Errorf("key %q accepted", key)
+                }
+        }
+}
+
+func TestEncryptedEvidenceUploadAndDownload(t *testing.T) {
+        pool := testDB(t)
+        files := useTestEvidenceStore(t)
+        evidenceStore = newTestEncryptingStore(t, files)
+        userID := insertTestUser(t, pool, "encrypted-upload")
+        sessionID := insertTestSession(t, pool, nil, nil)
+        content := []byte("Hydrant 14: static 62 psi, residual 48 psi, flow 1120 gpm")
+
+        evidenceID := uploadTestEvidence(t, userID, sessionID, "hydrant-14.txt", content)
+        record, err := loadEvidenceRecord(context.Background(), evidenceID)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if record.Checksum != calculateSHA256(content) || record.FileSize != int64(len(content)) {
+                t.Errorf("record = %s/%d, want the plaintext checksum and size", record.Checksum, record.FileSize)
+        }
+        var encryption EvidenceEncryption
+        raw, _ := json.Marshal(record.Metadata["encryption"])
+        json.Unmarshal(raw, &encryption)
+        if encryption.Algorithm != evidenceEncryptionAlgorithm || encryption.KeyID != "test-key-1" ||
+                len(encryption.IV) == 0 || len(encryption.WrappedKey) == 0 {
+                t.Errorf("encryption metadata = %s", raw)
+        }
+
+        w := getEvidence(t, http.MethodGet, evidenceID, nil)
+        if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), content) {
+                t.Errorf("download = %d %q, want the plaintext", w.Code, w.Body.String())
+        }
+        if raw := readAllAndClose(t, mustGet(t, files, evidenceObjectKey(context.Background(), evidenceID))); bytes.Contains(raw, content) {
+                t.Error("evidence stored in the clear")
+        }
+}
@@ -0,0 +1,872 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "io"
+        "log"
+        "mime"
+        "net/http"
+        "path/filepath"
+        "strconv"
+        "strings"
+        "time"
+
+        "github.com/google/uuid"
+        "github.com/gorilla/mux"
+        "github.com/jackc/pgx/v5"
+)
+
+// Stored evidence record
+type EvidenceRecord struct {
+        ID           string                 `json:"evidence_id"`
+        SessionID    string                 `json:"session_id"`
+        EvidenceType string                 `json:"evidence_type"`
+        FilePath     string                 `json:"file_path"`
+        Metadata     map[string]interface{} `json:"metadata"`
+        Checksum     string                 `json:"checksum"`
+        FileSize     int64                  `json:"file_size"`
+        CreatedAt    time.Time              `json:"created_at"`
+        // Client-asserted capture time, e.g. of evidence collected offline; created_at is when the server received it
+        CapturedAt *time.Time `json:"captured_at,omitempty"`
+        // Set on derived artifacts (e.g. thumbnails) to the evidence they were generated from
+        ParentID *string `json:"parent_evidence_id,omitempty"`
+        // RFC 3161 timestamp over the checksum, when a TSA is configured
+        Timestamp *EvidenceTimestamp `json:"timestamp,omitempty"`
+        // Where the evidence store keeps the blob, for data-residency checks
+        StorageLocation string `json:"storage_location,omitempty"`
+        StorageClass    string `json:"storage_class,omitempty"`
+        // Soft-deleted records are flagged for review rather than removed
+        Deleted   bool       `json:"-"`
+        DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// Trusted timestamp state of an evidence record; Token is the DER TimeStampToken
+type EvidenceTimestamp struct {
+        Status  string     `json:"status"`
+        GenTime *time.Time `json:"gen_time,omitempty"`
+        Token   []byte     `json:"token,omitempty"`
+}
+
+// Columns read by scanEvidenceRecord, from evidence e joined with evidence_timestamps t
+const evidenceRecordColumns = `
+        e.id::text, e.session_id::text, e.evidence_type, COALESCE(e.file_path, ''), e.metadata,
+        COALESCE(e.checksum, ''), COALESCE((e.metadata->>'file_size')::bigint, 0), e.created_at,
+        e.captured_at, e.flagged_for_review, e.flagged_at, e.parent_evidence_id::text, t.status, t.gen_time, t.token`
+
+// Load an evidence record by ID. Returns pgx.ErrNoRows for unknown evidence.
+func loadEvidenceRecord(ctx context.Context, evidenceID string) (*EvidenceRecord, error) {
+        query := `
+                SELECT ` + evidenceRecordColumns + `
+                FROM evidence e
+                LEFT JOIN evidence_timestamps t ON t.evidence_id = e.id
+                WHERE e.id = $1
+        `
+        return scanEvidenceRecord(dbFor(ctx).QueryRow(ctx, query, evidenceID))
+}
+
+// Scan one row of evidenceRecordColumns
+func scanEvidenceRecord(row pgx.Row) (*EvidenceRecord, error) {
+        var record EvidenceRecord
+        var metadataJSON string
+        var timestampStatus *string
+        var timestamp EvidenceTimestamp
+        err := row.Scan(&record.ID, &record.SessionID, &record.EvidenceType,
+                &record.FilePath, &metadataJSON, &record.Checksum, &record.FileSize, &record.CreatedAt, &record.CapturedAt,
+                &record.Deleted, &record.DeletedAt, &record.ParentID, &timestampStatus, &timestamp.GenTime, &timestamp.Token)
+        if err != nil {
+                return nil, err
+        }
+        if timestampStatus != nil {
+                timestamp.Status = *timestampStatus
+                record.Timestamp = &timestamp
+        }
+        location := evidenceStorageLocation()
+        record.StorageLocation, record.StorageClass = location.Location, location.Class
+
+        if err := json.Unmarshal([]byte(metadataJSON), &record.Metadata); err != nil || record.Metadata == nil {
+                record.Metadata = make(map[string]interface{})
+        }
+        return &record, nil
+}
+
+// Load an evidence record for a read endpoint, writing 404 for unknown and 410 for
+// soft-deleted evidence. Returns false when a response has already been written.
+func loadLiveEvidence(w http.ResponseWriter, r *http.Request, evidenceID string) (*EvidenceRecord, bool) {
+        record, err := loadEvidenceRecord(r.Context(), evidenceID)
+        if err == pgx.ErrNoRows {
+                http.Error(w, "Evidence not found", http.StatusNotFound)
+                return nil, false
+        }
+        if err != nil {
+                log.Printf("Failed to load evidence %s: %v", evidenceID, err)
+                http.Error(w, "Database error", http.StatusInternalServerError)
+                return nil, false
+        }
+        if record.Deleted {
+                http.Error(w, "Evidence has been deleted", http.StatusGone)
+                return nil, false
+        }
+        return record, true
+}
+
+// Parse the optional captured_at form field (RFC 3339). Capture times later than
+// now plus EVIDENCE_CAPTURED_AT_MAX_SKEW are rejected as client clock errors.
+// Accepted values are normalized to UTC at the microsecond precision stored.
+func parseEvidenceCapturedAt(value string) (*time.Time, error) {
+        if value == "" {
+                return nil, nil
+        }
+        capturedAt, err := time.Parse(time.RFC3339Nano, value)
+        if err != nil {
+                return nil, fmt.Errorf("captured_at must be an RFC 3339 timestamp")
+        }
+        if capturedAt.After(time.Now().Add(cfg.EvidenceCapturedAtMaxSkew)) {
+                return nil, fmt.Errorf("captured_at is in the future (allowed skew %s)", cfg.EvidenceCapturedAtMaxSkew)
+        }
+        capturedAt = capturedAt.UTC().Truncate(time.Microsecond)
+        return &capturedAt, nil
+}
+
+// Where an evidence content type came from, recorded as metadata.content_type_source
+const (
+        contentTypeSourceClient    = "client"
+        contentTypeSourceSniffed   = "sniffed"
+        contentTypeSourceExtension = "extension"
+        contentTypeSourceDefault   = "default"
+)
+
+// Resolve an upload's content type: the client's when given, otherwise sniffed
+// from the leading bytes, otherwise guessed from the filename extension. Sniffing
+// only recognises coarse text types, so a more specific extension type wins over
+// a sniffed text/plain. Leaves file positioned at the start.
+func resolveEvidenceContentType(file io.ReadSeeker, provided, filename string) (string, string, error) {
+        if provided != "" {
+                return provided, contentTypeSourceClient, nil
+        }
+
+        if _, err := file.Seek(0, io.SeekStart); err != nil {
+                return "", "", err
+        }
+        head := make([]byte, 512)
+        n, err := io.ReadFull(file, head)
+        if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+                return "", "", err
+        }
+        if _, err := file.Seek(0, io.SeekStart); err != nil {
+                return "", "", err
+        }
+
+        byExtension := mime.TypeByExtension(strings.ToLower(filepath.Ext(filename)))
+        sniffed := "application/octet-stream"
+        if n > 0 {
+                sniffed = http.DetectContentType(head[:n])
+        }
+        switch {
+        case sniffed != "application/octet-stream" && !(strings.HasPrefix(sniffed, "text/plain") && byExtension != ""):
+                return sniffed, contentTypeSourceSniffed, nil
+        case byExtension != "":
+                return byExtension, contentTypeSourceExtension, nil
+        }
+        return "application/octet-stream", contentTypeSourceDefault, nil
+}
+
+// Size limit for an evidence type: its MAX_BYTES_<TYPE> override, otherwise
+// MAX_EVIDENCE_BYTES. 0 means unlimited.
+func evidenceMaxBytes(evidenceType string) int64 {
+        if limit, ok := cfg.EvidenceTypeMaxBytes[strings.ToLower(evidenceType)]; ok {
+                return limit
+        }
+        return cfg.EvidenceMaxBytes
+}
+
+// Cap on an upload body before its evidence type is known: the largest
+// configured limit, or 0 when some type is unlimited
+func evidenceBodyLimit() int64 {
+        limit := cfg.EvidenceMaxBytes
+        if limit == 0 {
+                return 0
+        }
+        for _, typeLimit := range cfg.EvidenceTypeMaxBytes {
+                if typeLimit == 0 {
+                        return 0
+                }
+                limit = max(limit, typeLimit)
+        }
+        return limit
+}
+
+// Reject a file over its evidence type's size limit with 413 and the limit
+func writeEvidenceTooLarge(w http.ResponseWriter, evidenceType string, limit int64) {
+        writeJSON(w, http.StatusRequestEntityTooLarge, map[string]interface{}{
+                "error":         "Evidence file too large",
+                "evidence_type": evidenceType,
+                "max_bytes":     limit,
+        })
+}
+
+// Strong ETag derived from the stored SHA-256 checksum
+func evidenceETag(checksum string) string {
+        return fmt.Sprintf(`"%s"`, checksum)
+}
+
+// Download evidence contents. HEAD returns the same headers without a body.
+func handleEvidenceDownload(w http.ResponseWriter, r *http.Request) {
+        evidenceID := mux.Vars(r)["evidence_id"]
+        ctx := r.Context()
+
+        record, ok := loadLiveEvidence(w, r, evidenceID)
+        if !ok {
+                return
+        }
+
+        blob, err := evidenceStore.Get(ctx, evidenceObjectKey(ctx, record.ID))
+        if err == errEvidenceNotFound {
+                log.Printf("Evidence %s has no stored object", record.ID)
+                http.Error(w, "Evidence content not found", http.StatusNotFound)
+                return
+        }
+        if errors.Is(err, errEvidenceStoreUnavailable) {
+                w.Header().Set("Retry-After", retryAfterSeconds(max(evidenceStoreBreaker.OpenFor(), time.Second)))
+                http.Error(w, "Evidence store unavailable", http.StatusServiceUnavailable)
+                return
+        }
+        if err != nil {
+                log.Printf("Failed to open evidence %s: %v", record.ID, err)
+                http.Error(w, "Evidence store error", http.StatusInternalServerError)
+                return
+        }
+        defer blob.Close()
+
+        if contentType, _ := record.Metadata["content_type"].(string); contentType != "" {
+                w.Header().Set("Content-Type", contentType)
+        } else {
+                w.Header().Set("Content-Type", "application/octet-stream")
+        }
+        // Without a checksum there is no strong validator, so resumed downloads
+        // (If-Range) fall back to comparing Last-Modified
+        if record.Checksum != "" {
+                w.Header().Set("ETag", evidenceETag(record.Checksum))
+                w.Header().Set("X-Content-SHA256", record.Checksum)
+                if digest, err := reprDigestFromHex(record.Checksum); err == nil {
+                        w.Header().Set("Repr-Digest", digest)
+                } else {
+                        log.Printf("Evidence %s: %v", record.ID, err)
+                }
+        }
+
+        // ServeContent sets Content-Length and handles HEAD, Range and conditional
+        // headers. If-Range is checked against the ETag above (strong comparison):
+        // a match serves the requested range (206), a mismatch the full object (200).
+        filename, _ := record.Metadata["original_filename"].(string)
+        http.ServeContent(w, r, filename, record.CreatedAt, blob)
+}
+
+// Return an evidence record's stored metadata without reading the blob
+func handleEvidenceMetadata(w http.ResponseWriter, r *http.Request) {
+        record, ok := loadLiveEvidence(w, r, mux.Vars(r)["evidence_id"])
+        if !ok {
+                return
+        }
+        writeJSON(w, http.StatusOK, record)
+}
+
+// Audit action for correcting evidence metadata
+const auditActionEvidenceMetadataUpdate = "evidence.metadata_update"
+
+// Evidence fields that PATCH .../metadata may change; everything describing the
+// stored bytes (checksum, file_path, size, filename, content type) is immutable
+var mutableEvidenceFields = map[string]bool{"evidence_type": true, "labels": true}
+
+// Update the mutable metadata of an evidence record without re-uploading it:
+// evidence_type and labels (a string map, or null to clear). Attempts to change
+// any other field, such as checksum or file_path, are rejected with 400. The
+// previous and new values are recorded in the audit log.
+func handleUpdateEvidenceMetadata(w http.ResponseWriter, r *http.Request) {
+        evidenceID := mux.Vars(r)["evidence_id"]
+        if _, err := uuid.Parse(evidenceID); err != nil {
+                http.Error(w, "Evidence not found", http.StatusNotFound)
+                return
+        }
+        userID := r.Header.Get("X-User-ID")
+        if userID == "" {
+                http.Error(w, "X-User-ID header required", http.StatusBadRequest)
+                return
+        }
+
+        var patch map[string]json.RawMessage
+        if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+                http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+                return
+        }
+        if len(patch) == 0 {
+                http.Error(w, "No metadata fields to update", http.StatusBadRequest)
+                return
+        }
+        for field := range patch {
+                if !mutableEvidenceFields[field] {
+                        http.Error(w, fmt.Sprintf("Field %q is immutable", field), http.StatusBadRequest)
+                        return
+                }
+        }
+        var evidenceType *string
+        if raw, ok := patch["evidence_type"]; ok {
+                if err := json.Unmarshal(raw, &evidenceType); err != nil || evidenceType == nil || strings.TrimSpace(*evidenceType) == "" {
+                        http.Error(w, "evidence_type must be a non-empty string", http.StatusBadRequest)
+                        return
+                }
+        }
+        var labels map[string]string
+        rawLabels, setLabels := patch["labels"]
+        if setLabels {
+                if err := json.Unmarshal(rawLabels, &labels); err != nil {
+                        http.Error(w, "labels must be an object of strings", http.StatusBadRequest)
+                        return
+                }
+        }
+
+        ctx := context.WithoutCancel(r.Context())
+        tx, err := dbFor(ctx).Begin(ctx)
+        if err != nil {
+                log.Printf("Failed to begin evidence metadata transaction: %v", err)
+                http.Error(w, "Database error", http.StatusInternalServerError)
+                return
+        }
+        defer tx.Rollback(ctx)
+
+        var currentType string
+        var currentLabels map[string]string
+        var size int64
+        var deleted bool
+        err = tx.QueryRow(ctx, `
+                SELECT evidence_type, metadata->'labels', COALESCE((metadata->>'file_size')::bigint, 0), flagged_for_review
+                FROM evidence
+                WHERE id = $1
+                FOR UPDATE
+        `, evidenceID).Scan(&currentType, &currentLabels, &size, &deleted)
+        if err == pgx.ErrNoRows {
+                http.Error(w, "Evidence not found", http.StatusNotFound)
+                return
+        }
+        if err != nil {
+                log.Printf("Failed to load evidence %s: %v", evidenceID, err)
+                http.Error(w, "Database error", http.StatusInternalServerError)
+                return
+        }
+        if deleted {
+                http.Error(w, "Evidence has been deleted", http.StatusGone)
+                return
+        }
+
+        newType := currentType
+        if evidenceType != nil {
+                newType = *evidenceType
+        }
+        // A new type must not let a file escape its type's size limit
+        if limit := evidenceMaxBytes(newType); limit > 0 && size > limit {
+                writeEvidenceTooLarge(w, newType, limit)
+                return
+        }
+        newLabels := currentLabels
+        if setLabels {
+                newLabels = labels
+        }
+
+        labelsJSON, _ := json.Marshal(newLabels)
+        _, err = tx.Exec(ctx, `
+                UPDATE evidence
+                SET evidence_type = $2,
+                    metadata = CASE WHEN $3::jsonb = 'null'::jsonb THEN metadata - 'labels'
+                                    ELSE jsonb_set(metadata, '{labels}', $3::jsonb) END
+                WHERE id = $1
+        `, evidenceID, newType, string(labelsJSON))
+        if err != nil {
+                log.Printf("Failed to update evidence %s metadata: %v", evidenceID, err)
+                http.Error(w, "Database error", http.StatusInternalServerError)
+                return
+        }
+
+        auditValues := map[string]interface{}{
+                "previous": map[string]interface{}{"evidence_type": currentType, "labels": currentLabels},
+                "current":  map[string]interface{}{"evidence_type": newType, "labels": newLabels},
+        }
+        if err := writeAuditLog(ctx, tx, userID, auditActionEvidenceMetadataUpdate, "evidence", evidenceID, auditValues); err != nil {
+                log.Printf("Failed to write evidence metadata audit entry: %v", err)
+                http.Error(w, "Database error", http.StatusInternalServerError)
+                return
+        }
+        if err := tx.Commit(ctx); err != nil {
+                log.Printf("Failed to commit evidence metadata transaction: %v", err)
+                http.Error(w, "Database error", http.StatusInternalServerError)
+                return
+        }
+
+        record, ok := loadLiveEvidence(w, r, evidenceID)
+        if !ok {
+                return
+        }
+        writeJSON(w, http.StatusOK, record)
+}
+
+// Audit action for deleting all evidence of a session
+const auditActionEvidenceBulkDelete = "evidence.bulk_delete"
+
+// Delete all evidence of a session in one transaction. By default evidence is
+// soft-deleted (flagged for review); ?hard=true removes the rows and purges the
+// stored objects once the transaction commits. Quota usage is released for
+// evidence not already soft-deleted, and one audit entry summarizes the action.
+func handleDeleteSessionEvidence(w http.ResponseWriter, r *http.Request) {
+        sessionID := mux.Vars(r)["session_id"]
+        hard, _ := strconv.ParseBool(r.URL.Query().Get("hard"))
+
+        userID := r.Header.Get("X-User-ID")
+        if userID == "" {
+                http.Error(w, "X-User-ID header required", http.StatusBadRequest)
+                return
+        }
+        if _, err := uuid.Parse(sessionID); err != nil {
+                http.Error(w, "Session not found", http.StatusNotFound)
+                return
+        }
+
+        ctx := context.WithoutCancel(r.Context())
+        tx, err := dbFor(ctx).Begin(ctx)
+        if err != nil {
+                log.Printf("Failed to begin evidence delete transaction: %v", err)
+                http.Error(w, "Database error", http.StatusInternalServerError)
+                return
+        }
+        defer tx.Rollback(ctx)
+
+        var exists bool
+        if err := tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM test_sessions WHERE id = $1)", sessionID).Scan(&exists); err != nil {
+                log.Printf("Failed to check session %s: %v", sessionID, err)
+                http.Error(w, "Database error", http.StatusInternalServerError)
+                return
+        }
+        if !exists {
+                http.Error(w, "Session not found", http.StatusNotFound)
+                return
+        }
+
+        // Both queries return the rows whose usage is still counted (not yet soft-deleted)
+        mode := "soft"
+        args := []interface{}{sessionID, userID}
+        query := `
+                UPDATE evidence
+                SET flagged_for_review = true, flag_reason = 'session_purge', flagged_at = CURRENT_TIMESTAMP,
+                    flagged_by = (SELECT id FROM users WHERE id::text = $2)
+                WHERE session_id = $1 AND NOT flagged_for_review
+                RETURNING id::text, true, COALESCE((metadata->>'file_size')::bigint, 0), COALESCE(metadata->>'uploaded_by', '')
+        `
+        if hard {
+                mode = "hard"
+                args = args[:1]
+                query = `
+                        DELETE FROM evidence
+                        WHERE session_id = $1
+                        RETURNING id::text, NOT flagged_for_review, COALESCE((metadata->>'file_size')::bigint, 0),
+                                  COALESCE(metadata->>'uploaded_by', '')
+                `
+        }
+
+        var evidenceIDs []string
+        var releasedCount, releasedBytes int64
+        userUsage := make(map[string][2]int64)
+        err = timeQuery("bulk_delete_evidence", func() error {
+                rows, err := tx.Query(ctx, query, args...)
+                if err != nil {
+                        return err
+                }
+                defer rows.Close()
+
+                for rows.Next() {
+                        var id, uploadedBy string
+                        var counted bool
+                        var size int64
+                        if err := rows.Scan(&id, &counted, &size, &uploadedBy); err != nil {
+                                return err
+                        }
+                        evidenceIDs = append(evidenceIDs, id)
+                        if counted {
+                                releasedCount++
+                                releasedBytes += size
+                                usage := userUsage[uploadedBy]
+                                userUsage[uploadedBy] = [2]int64{usage[0] + 1, usage[1] + size}
+                        }
+                }
+                return rows.Err()
+        })
+        if err != nil {
+                log.Printf("Failed to delete evidence for session %s: %v", sessionID, err)
+                http.Error(w, "Database error", http.StatusInternalServerError)
+                return
+        }
+
+        if releasedCount > 0 {
+                if err := releaseEvidenceQuota(ctx, tx, quotaScopeSession, sessionID, releasedCount, releasedBytes); err != nil {
+                        log.Printf("Evidence delete for session %s: %v", sessionID, err)
+                        http.Error(w, "Database error", http.StatusInternalServerError)
+                        return
+                }
+                for uploader, usage := range userUsage {
+                        if uploader == "" {
+                                continue
+                        }
+                        if err := releaseEvidenceQuota(ctx, tx, quotaScopeUser, uploader, usage[0], usage[1]); err != nil {
+                                log.Printf("Evidence delete for session %s: %v", sessionID, err)
+                                http.Error(w, "Database error", http.StatusInternalServerError)
+                                return
+                        }
+                }
+        }
+
+        auditValues := map[string]interface{}{
+                "session_id":     sessionID,
+                "mode":           mode,
+                "evidence_count": len(evidenceIDs),
+                "released_bytes": releasedBytes,
+        }
+        if err := writeAuditLog(ctx, tx, userID, auditActionEvidenceBulkDelete, "test_session", sessionID, auditValues); err != nil {
+                log.Printf("Failed to write evidence delete audit entry: %v", err)
+                http.Error(w, "Database error", http.StatusInternalServerError)
+                return
+        }
+
+        if err := tx.Commit(ctx); err != nil {
+                log.Printf("Failed to commit evidence delete transaction: %v", err)
+                http.Error(w, "Database error", http.StatusInternalServerError)
+                return
+        }
+
+        if hard && len(evidenceIDs) > 0 {
+                scheduleEvidencePurge(ctx, evidenceIDs)
+        }
+
+        writeJSON(w, http.StatusOK, map[string]interface{}{
+                "session_id": sessionID,
+                "mode":       mode,
+                "deleted":    len(evidenceIDs),
+        })
+}
+
+// Audit action for deleting a single evidence record
+const auditActionEvidenceDelete = "evidence.delete"
+
+// Result of deleting a single evidence record
+type EvidenceDeletion struct {
+        EvidenceID string    `json:"evidence_id"`
+        Status     string    `json:"status"`
+        DeletedAt  time.Time `json:"deleted_at"`
+}
+
+// Soft-delete one evidence record (flag it for review) and release its quota
+// usage. Evidence that is already deleted is left as is and reported with its
+// original deleted_at. Returns pgx.ErrNoRows for unknown evidence.
+func softDeleteEvidence(ctx context.Context, evidenceID, userID string) (*EvidenceDeletion, error) {
+        tx, err := dbFor(ctx).Begin(ctx)
+        if err != nil {
+                return nil, err
+        }
+        defer tx.Rollback(ctx)
+
+        deletion := &EvidenceDeletion{EvidenceID: evidenceID, Status: "deleted"}
+        var sessionID, uploadedBy string
+        var size int64
+        err = tx.QueryRow(ctx, `
+                UPDATE evidence
+                SET flagged_for_review = true, flag_reason = 'user_delete', flagged_at = CURRENT_TIMESTAMP,
+                    flagged_by = (SELECT id FROM users WHERE id::text = $2)
+                WHERE id = $1 AND NOT flagged_for_review
+                RETURNING session_id::text, COALESCE((metadata->>'file_size')::bigint, 0),
+                          COALESCE(metadata->>'uploaded_by', ''), flagged_at
+        `, evidenceID, userID).Scan(&sessionID, &size, &uploadedBy, &deletion.DeletedAt)
+        if err == pgx.ErrNoRows {
+                // Unknown, or deleted earlier: report the earlier deletion
+                var deletedAt *time.Time
+                if err := tx.QueryRow(ctx, "SELECT flagged_at FROM evidence WHERE id = $1 AND flagged_for_review", evidenceID).Scan(&deletedAt); err != nil {
+                        return nil, err
+                }
+                if deletedAt != nil {
+                        deletion.DeletedAt = *deletedAt
+                }
+                return deletion, nil
+        }
+        if err != nil {
+                return nil, err
+        }
+
+        if err := releaseEvidenceQuota(ctx, tx, quotaScopeSession, sessionID, 1, size); err != nil {
+                return nil, err
+        }
+        if uploadedBy != "" {
+                if err := releaseEvidenceQuota(ctx, tx, quotaScopeUser, uploadedBy, 1, size); err != nil {
+                        return nil, err
+                }
+        }
+        auditValues := map[string]interface{}{
+                "session_id":     sessionID,
+                "released_bytes": size,
+        }
+        if err := writeAuditLog(ctx, tx, userID, auditActionEvidenceDelete, "evidence", evidenceID, auditValues); err != nil {
+                return nil, fmt.Errorf("failed to write audit entry: %v", err)
+        }
+        if err := tx.Commit(ctx); err != nil {
+                return nil, err
+        }
+        return deletion, nil
+}
+
+// Delete one evidence record. Deletes are soft and idempotent: deleting evidence
+// that is already deleted returns the same 200 response. With an
+// Idempotency-Key the response is also cached like other writes.
+func handleDeleteEvidence(w http.ResponseWriter, r *http.Request) {
+        evidenceID := mux.Vars(r)["evidence_id"]
+        if _, err := uuid.Parse(evidenceID); err != nil {
+                http.Error(w, "Evidence not found", http.StatusNotFound)
+                return
+        }
+        userID := r.Header.Get("X-User-ID")
+        if userID == "" {
+                http.Error(w, "X-User-ID header required", http.StatusBadRequest)
+                return
+        }
+        idempotencyKey := r.Header.Get("Idempotency-Key")
+        if idempotencyKey != "" {
+                if err := validateIdempotencyKey(idempotencyKey); err != nil {
+                        http.Error(w, err.Error(), http.StatusBadRequest)
+                        return
+                }
+        }
+
+        ctx := context.WithoutCancel(r.Context())
+        keyHash := idempotencyKeyHash(idempotencyKey)
+        endpoint := "DELETE /v1/evidence/" + evidenceID
+        requestHash := calculateSHA256([]byte(evidenceID))
+        stored := false
+        if idempotencyKey != "" {
+                existingCheck, err := checkIdempotency(ctx, keyHash, userID, endpoint, requestHash)
+                if err != nil {
+                        writeIdempotencyCheckError(w, err)
+                        return
+                }
+                if existingCheck != nil && existingCheck.Pending {
+                        writeIdempotencyInProgress(w, existingCheck)
+                        return
+                }
+                if existingCheck != nil {
+                        writeReplayedResponse(w, existingCheck.StatusCode, []byte(existingCheck.ResponseData))
+                        return
+                }
+                // This request holds the key; settle it unless a success response gets cached
+                setIdempotencyStatus(w, idempotencyStatusOriginal)
+                rec := &errorRecorder{ResponseWriter: w}
+                w = rec
+                defer func() {
+                        if !stored {
+                                settleIdempotencyClaim(ctx, keyHash, userID, endpoint, requestHash, rec)
+                        }
+                }()
+        }
+
+        deletion, err := softDeleteEvidence(ctx, evidenceID, userID)
+        if err == pgx.ErrNoRows {
+                http.Error(w, "Evidence not found", http.StatusNotFound)
+                return
+        }
+        if err != nil {
+                log.Printf("Failed to delete evidence %s: %v", evidenceID, err)
+                http.Error(w, "Database error", http.StatusInternalServerError)
+                return
+        }
+
+        if idempotencyKey != "" {
+                if err := storeIdempotencyKey(ctx, keyHash, userID, endpoint, requestHash, deletion, http.StatusOK); err != nil {
+                        log.Printf("Failed to store idempotency key: %v", err)
+                } else {
+                        stored = true
+                }
+        }
+        writeJSON(w, http.StatusOK, deletion)
+}
+
+// Remove the stored objects of hard-deleted evidence in the background, or
+// inline when the worker queue is full
+func scheduleEvidencePurge(ctx context.Context, evidenceIDs []string) {
+        keys := make([]string, len(evidenceIDs))
+        for i, id := range evidenceIDs {
+                keys[i] = evidenceObjectKey(ctx, id)
+        }
+        purge := func(ctx context.Context) {
+                for _, key := range keys {
+                        if err := evidenceStore.Delete(ctx, key); err != nil && err != errEvidenceNotFound {
+                                log.Printf("Failed to purge evidence object %s: %v", key, err)
+                        }
+                }
+        }
+        if workerPool == nil || !workerPool.Submit(purge) {
+                purge(ctx)
+        }
+}
+
+// A verified evidence file ready to be stored
+type evidenceUpload struct {
+        ID           string
+        SessionID    string
+        EvidenceType string
+        UserID       string
+        Checksum     string
+        Size         int64
+        Metadata     map[string]interface{}
+        File         io.ReadSeeker
+        CapturedAt   *time.Time
+}
+
+// Identify one uploaded file within an idempotency fingerprint: its content hash
+// and, unless IDEMPOTENCY_FINGERPRINT_FILENAME is off, its filename. Excluding
+// the filename lets a retry that renames the file still deduplicate.
+func evidenceFileFingerprint(checksum, filename string) string {
+        if !cfg.IdempotencyFingerprintFilename {
+                return checksum
+        }
+        return checksum + ":" + filename
+}
+
+// Wraps evidence store failures returned by storeEvidenceFile
+var errEvidenceStoreFailed = errors.New("evidence store error")
+
+// Within tx: reserve quota, persist the file's bytes, then insert the evidence
+// row, its audit entry and timestamp request, and any extra statements (e.g. a
+// webhook) in one round trip. Reports whether the bytes were spooled locally
+// instead of reaching the store. The caller removes the stored object if tx
+// does not commit. Quota failures are *QuotaExceededError.
+func storeEvidenceFile(ctx context.Context, tx pgx.Tx, u *evidenceUpload, extra ...BatchItem) (bool, error) {
+        spooled, err := storeEvidenceBlob(ctx, tx, u)
+        if err != nil {
+                return spooled, err
+        }
+        if err := execBatch(ctx, tx, append(evidenceRowItems(u, u.ID), extra...)); err != nil {
+                log.Printf("Database error storing evidence: %v", err)
+                return spooled, err
+        }
+        return spooled, nil
+}
+
+// Within tx: reserve quota and persist the file's bytes, recording how they
+// were encrypted in u.Metadata. Reports whether the bytes were spooled locally.
+func storeEvidenceBlob(ctx context.Context, tx pgx.Tx, u *evidenceUpload) (bool, error) {
+        if err := reserveEvidenceQuota(ctx, tx, u.SessionID, u.UserID, u.Size); err != nil {
+                var quotaErr *QuotaExceededError
+                if !errors.As(err, &quotaErr) {
+                        log.Printf("Evidence quota check failed: %v", err)
+                }
+                return false, err
+        }
+
+        if _, err := u.File.Seek(0, io.SeekStart); err != nil {
+                return false, fmt.Errorf("%w: %v", errEvidenceStoreFailed, err)
+        }
+        key := evidenceObjectKey(ctx, u.ID)
+        written, err := evidenceStore.Put(ctx, key, u.File)
+        spooled := errors.Is(err, errEvidenceSpooled)
+        if err != nil && !spooled {
+                log.Printf("Failed to store evidence %s: %v", u.ID, err)
+                return false, fmt.Errorf("%w: %w", errEvidenceStoreFailed, err)
+        }
+        if cfg.EvidenceVerifyStoredSize {
+                if err := verifyStoredEvidenceSize(ctx, key, u.Size, written); err != nil {
+                        log.Printf("Evidence %s failed post-write verification: %v", u.ID, err)
+                        if err := evidenceStore.Delete(ctx, key); err != nil && err != errEvidenceNotFound {
+                                log.Printf("Failed to remove unverified evidence object %s: %v", key, err)
+                        }
+                        return false, fmt.Errorf("%w: %v", errEvidenceStoreFailed, err)
+                }
+        }
+
+        // Record how the object was encrypted; the checksum stays over the plaintext
+        if encryption := evidenceEncryption(ctx, key); encryption != nil {
+                u.Metadata["encryption"] = encryption
+        }
+
+        return spooled, nil
+}
+
+// Statements recording a stored upload, each tagged with ref: the evidence row,
+// its audit entry and, when TSA_URL is set, its timestamp request
+func evidenceRowItems(u *evidenceUpload, ref string) []BatchItem {
+        metadataJSON, _ := json.Marshal(u.Metadata)
+        auditValues := map[string]interface{}{
+                "session_id":    u.SessionID,
+                "evidence_type": u.EvidenceType,
+                "checksum":      u.Checksum,
+                "metadata":      u.Metadata,
+        }
+        items := []BatchItem{
+                {
+                        SQL: `
+                                INSERT INTO evidence (id, session_id, evidence_type, file_path, metadata, checksum, captured_at, created_at)
+                                VALUES ($1, $2, $3, $4, $5, $6, $7, CURRENT_TIMESTAMP)
+                        `,
+                        Args: []interface{}{u.ID, u.SessionID, u.EvidenceType, fmt.Sprintf("/evidence/%s", u.ID),
+                                string(metadataJSON), u.Checksum, u.CapturedAt},
+                },
+                auditLogItem(u.UserID, auditActionEvidenceUpload, "evidence", u.ID, auditValues),
+        }
+        // Request a trusted timestamp over the verified hash once the upload commits
+        if cfg.TSAURL != "" {
+                items = append(items, evidenceTimestampItem(u.ID, u.Checksum))
+        }
+        for i := range items {
+                items[i].Ref = ref
+        }
+        return items
+}
+
+// Confirm the store holds expected bytes under key, as reported both by Put and
+// by the store itself, catching truncated writes before the evidence row commits
+func verifyStoredEvidenceSize(ctx context.Context, key string, expected, written int64) error {
+        if written != expected {
+                return fmt.Errorf("store accepted %d of %d bytes", written, expected)
+        }
+        stored, err := evidenceStore.Size(ctx, key)
+        if err != nil {
+                return fmt.Errorf("size check failed: %v", err)
+        }
+        if stored != expected {
+                return fmt.Errorf("store reports %d bytes, expected %d", stored, expected)
+        }
+        return nil
+}
+
+// Status and message for a storeEvidenceFile error
+func evidenceStoreErrorStatus(err error) (int, string) {
+        var quotaErr *QuotaExceededError
+        switch {
+        case errors.As(err, &quotaErr):
+                return quotaErr.StatusCode, quotaErr.Reason
+        case errors.Is(err, errEvidenceStoreUnavailable):
+                return http.StatusServiceUnavailable, "Evidence store unavailable"
+        case errors.Is(err, errEvidenceStoreFailed):
+                return http.StatusInternalServerError, "Evidence store error"
+        }
+        return http.StatusInternalServerError, "Database error"
+}
+
+// Write the response for a storeEvidenceFile error; quota errors include usage
+func writeEvidenceStoreError(w http.ResponseWriter, err error) {
+        var quotaErr *QuotaExceededError
+        if errors.As(err, &quotaErr) {
+                writeJSON(w, quotaErr.StatusCode, map[string]interface{}{
+                        "error": quotaErr.Reason,
+                        "usage": quotaErr.Usage,
+                })
+                return
+        }
+        status, message := evidenceStoreErrorStatus(err)
+        if status == http.StatusServiceUnavailable {
+                w.Header().Set("Retry-After", retryAfterSeconds(max(evidenceStoreBreaker.OpenFor(), time.Second)))
+        }
+        http.Error(w, message, status)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "fmt"
+        "log"
+        "net/http"
+        "net/url"
+        "sort"
+        "strconv"
+        "strings"
+
+        "github.com/google/uuid"
+        "github.com/gorilla/mux"
+)
+
+// Metadata fields promoted to generated columns (migration 012), with btree
+// indexes; filters on them avoid evaluating JSONB for every row
+var indexedEvidenceMetadata = map[string]string{
+        "uploaded_by":  "e.uploaded_by",
+        "content_type": "e.content_type",
+}
+
+// Default and maximum evidence returned by one search
+const (
+        defaultEvidenceSearchLimit = 100
+        maxEvidenceSearchLimit     = 1000
+)
+
+// List a session's live evidence, filtered by query parameters: evidence_type,
+// the promoted metadata fields uploaded_by and content_type, and any other
+// metadata field as metadata.<field>=<value>. Promoted fields are matched on
+// their indexed columns, whether given bare or as metadata.<field>; other
+// fields fall back to the JSONB ->> operator. Results are newest first, up to
+// ?limit= (default 100, max 1000).
+func handleSearchEvidence(w http.ResponseWriter, r *http.Request) {
+        sessionID := mux.Vars(r)["session_id"]
+        if _, err := uuid.Parse(sessionID); err != nil {
+                http.Error(w, "Session not found", http.StatusNotFound)
+                return
+        }
+
+        sqlQuery, args, err := evidenceSearchQuery(sessionID, r.URL.Query())
+        if err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+        records, err := searchEvidence(r.Context(), sqlQuery, args)
+        if err != nil {
+                log.Printf("Failed to search evidence for session %s: %v", sessionID, err)
+                http.Error(w, "Database error", http.StatusInternalServerError)
+                return
+        }
+        writeJSON(w, http.StatusOK, map[string]interface{}{
+                "session_id": sessionID,
+                "evidence":   records,
+        })
+}
+
+// Build the SQL and arguments searching sessionID's evidence with the handler's
+// query parameters, or an error naming the first invalid parameter
+func evidenceSearchQuery(sessionID string, query url.Values) (string, []interface{}, error) {
+        limit := defaultEvidenceSearchLimit
+        if raw := query.Get("limit"); raw != "" {
+                parsed, err := strconv.Atoi(raw)
+                if err != nil || parsed <= 0 {
+                        return "", nil, errors.New("limit must be a positive integer")
+                }
+                limit = min(parsed, maxEvidenceSearchLimit)
+        }
+
+        conditions := []string{"e.session_id = $1", "NOT COALESCE(e.flagged_for_review, false)"}
+        args := []interface{}{sessionID}
+        addCondition := func(expr string, value string) {
+                args = append(args, value)
+                conditions = append(conditions, fmt.Sprintf("%s = $%d", expr, len(args)))
+        }
+
+        keys := make([]string, 0, len(query))
+        for key := range query {
+                keys = append(keys, key)
+        }
+        sort.Strings(keys) // stable SQL text for the plan cache
+        for _, key := range keys {
+                value := query.Get(key)
+                field, isMetadata := strings.CutPrefix(key, "metadata.")
+                switch {
+                case key == "limit":
+                case key == "evidence_type":
+                        addCondition("e.evidence_type", value)
+                case indexedEvidenceMetadata[field] != "":
+                        addCondition(indexedEvidenceMetadata[field], value)
+                case isMetadata && field != "":
+                        args = append(args, field)
+                        addCondition(fmt.Sprintf("e.metadata->>$%d", len(args)), value)
+                default:
+                        return "", nil, fmt.Errorf("unknown search parameter %q", key)
+                }
+        }
+        args = append(args, limit)
+
+        return fmt.Sprintf(`
+                SELECT %s
+                FROM evidence e
+                LEFT JOIN evidence_timestamps t ON t.evidence_id = e.id
+                WHERE %s
+                ORDER BY e.created_at DESC, e.id
+                LIMIT $%d
+        `, evidenceRecordColumns, strings.Join(conditions, " AND "), len(args)), args, nil
+}
+
+// Run an evidence search query selecting evidenceRecordColumns
+func searchEvidence(ctx context.Context, query string, args []interface{}) ([]*EvidenceRecord, error) {
+        rows, err := dbFor(ctx).Query(ctx, query, args...)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        records := make([]*EvidenceRecord, 0)
+        for rows.Next() {
+                record, err := scanEvidenceRecord(rows)
+                if err != nil {
+                        return nil, err
+                }
+                records = append(records, record)
+        }
+        return records, rows.Err()
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "net/http"
+        "net/http/httptest"
+        "net/url"
+        "reflect"
+        "strings"
+        "testing"
+
+        "github.com/gorilla/mux"
+)
+
+// GET the session's evidence search with the given raw query string
+func searchSessionEvidence(t *testing.T, sessionID, rawQuery string) *httptest.ResponseRecorder {
+        t.Helper()
+        r := httptest.NewRequest(http.MethodGet, "/v1/tests/sessions/"+sessionID+"/evidence?"+rawQuery, nil)
+        r = mux.SetURLVars(r, map[string]string{"session_id": sessionID})
+        w := httptest.NewRecorder()
+        handleSearchEvidence(w, r)
+        return w
+}
+
+func TestEvidenceSearchQuery(t *testing.T) {
+        const sessionID = "5b0c7d2e-3f41-4a6b-9c8d-1e2f3a4b5c6d"
+        tests := []struct {
+                name     string
+                rawQuery string
+                wantSQL  []string
+                wantArgs []interface{}
+        }{
+                {"session only", "", []string{"e.session_id = $1", "LIMIT $2"}, []interface{}{sessionID, 100}},
+                {"promoted field", "uploaded_by=inspector-3",
+                        []string{"e.uploaded_by = $2", "LIMIT $3"}, []interface{}{sessionID, "inspector-3", 100}},
+                {"promoted field under metadata.", "metadata.content_type=image%2Fjpeg&limit=20",
+                        []string{"e.content_type = $2"}, []interface{}{sessionID, "image/jpeg", 20}},
+                {"other field uses JSONB", "metadata.floor=3&evidence_type=photo",
+                        []string{"e.evidence_type = $2", "e.metadata->>$3 = $4", "LIMIT $5"},
+                        []interface{}{sessionID, "photo", "floor", "3", 100}},
+                {"limit capped", "limit=50000", []string{"LIMIT $2"}, []interface{}{sessionID, 1000}},
+        }
+        for _, tt := range tests {
+                query, _ := url.ParseQuery(tt.rawQuery)
+                sql, args, err := evidenceSearchQuery(sessionID, query)
+                if err != nil {
+                        t.Errorf("%s: %v", tt.name, err)
+                        continue
+                }
+                for _, want := range tt.wantSQL {
+                        if !strings.Contains(sql, want) {
+                                t.Errorf("%s: SQL does not contain %q:\n%s", tt.name, want, sql)
+                        }
+                }
+                if strings.Contains(tt.rawQuery, "uploaded_by") && strings.Contains(sql, "e.metadata->>$") {
+                        t.Errorf("%s: promoted field filtered through JSONB:\n%s", tt.name, sql)
+                }
+                if !reflect.DeepEqual(args, tt.wantArgs) {
+                        t.Errorf("%s: args = %v, want %v", tt.name, args, tt.wantArgs)
+                }
+        }
+}
+
+func TestSearchEvidenceRejectsBadRequests(t *testing.T) {
+        const sessionID = "5b0c7d2e-3f41-4a6b-9c8d-1e2f3a4b5c6d"
+        tests := []struct {
+                name      string
+                sessionID string
+                rawQuery  string
+                want      int
+                wantBody  string
+        }{
+                {"malformed session id", "lobby-7", "", http.StatusNotFound, "Session not found"},
+                {"zero limit", sessionID, "limit=0", http.StatusBadRequest, "limit must be a positive integer"},
+                {"non-numeric limit", sessionID, "limit=all", http.StatusBadRequest, "limit must be a positive integer"},
+                {"unknown parameter", sessionID, "uploader=inspector-3", http.StatusBadRequest, `"uploader"`},
+                {"empty metadata field", sessionID, "metadata.=x", http.StatusBadRequest, `"metadata."`},
+        }
+        for _, tt := range tests {
+                w := searchSessionEvidence(t, tt.sessionID, tt.rawQuery)
+                if w.Code != tt.want || !strings.Contains(w.Body.String(), tt.wantBody) {
+                        t.Errorf("%s: %d %q, want %d containing %q", tt.name, w.Code, w.Body.String(), tt.want, tt.wantBody)
+                }
+        }
+}
+
+func TestSearchEvidenceFilters(t *testing.T) {
+        pool := testDB(t)
+        useTestEvidenceStore(t)
+        sessionID := insertTestSession(t, pool, nil, nil)
+        insertTestEvidence(t, pool, sessionID, []byte("hydrant-a"),
+                map[string]interface{}{"uploaded_by": "inspector-3", "content_type": "image/jpeg", "floor": "1"})
+        wanted := insertTestEvidence(t, pool, sessionID, []byte("hydrant-b"),
+                map[string]interface{}{"uploaded_by": "inspector-3", "content_type": "image/png", "floor": "2"})
+        insertTestEvidence(t, pool, sessionID, []byte("hydrant-c"),
+                map[string]interface{}{"uploaded_by": "inspector-5", "content_type": "image/png", "floor": "2"})
+        flagged := insertTestEvidence(t, pool, sessionID, []byte("hydrant-d"),
+                map[string]interface{}{"uploaded_by": "inspector-3", "content_type": "image/png", "floor": "2"})
+        if _, err := pool.Exec(context.Background(),
+                `UPDATE evidence SET flagged_for_review = true, flagged_at = NOW() WHERE id = $1`, flagged); err != nil {
+                t.Fatal(err)
+        }
+
+        tests := []struct {
+                rawQuery string
+                want     int
+        }{
+                {"", 3},
+                {"uploaded_by=inspector-3", 2},
+                {"uploaded_by=inspector-3&content_type=image%2Fpng", 1},
+                {"metadata.uploaded_by=inspector-3&metadata.floor=2", 1},
+                {"uploaded_by=inspector-3&limit=1", 1},
+                {"uploaded_by=nobody", 0},
+        }
+        for _, tt := range tests {
+                w := searchSessionEvidence(t, sessionID, tt.rawQuery)
+                var body struct {
+                        Evidence []EvidenceRecord `json:"evidence"`
+                }
+                if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &body) != nil {
+                        t.Fatalf("%s: %d %s", tt.rawQuery, w.Code, w.Body.String())
+                }
+                if len(body.Evidence) != tt.want {
+                        t.Errorf("%s: %d results, want %d", tt.rawQuery, len(body.Evidence), tt.want)
+                }
+                for _, record := range body.Evidence {
+                        if record.ID == flagged {
+                                t.Errorf("%s: flagged evidence returned", tt.rawQuery)
+                        }
+                }
+                if tt.want == 1 && !strings.HasSuffix(tt.rawQuery, "limit=1") && body.Evidence[0].ID != wanted {
+                        t.Errorf("%s: got %s, want %s", tt.rawQuery, body.Evidence[0].ID, wanted)
+                }
+        }
+}
+
+// Count sequential scans of table in an EXPLAIN (FORMAT JSON) plan
+func seqScans(t *testing.T, plan, table string) int {
+        t.Helper()
+        type planNode struct {
+                NodeType     string     `json:"Node Type"`
+                RelationName string     `json:"Relation Name"`
+                Plans        []planNode `json:"Plans"`
+        }
+        var explained []struct {
+                Plan planNode `json:"Plan"`
+        }
+        if err := json.Unmarshal([]byte(plan), &explained); err != nil || len(explained) == 0 {
+                t.Fatalf("unparseable plan %q: %v", plan, err)
+        }
+        var count func(node planNode) int
+        count = func(node planNode) int {
+                n := 0
+                if node.NodeType == "Seq Scan" && node.RelationName == table {
+                        n++
+                }
+                for _, child := range node.Plans {
+                        n += count(child)
+                }
+                return n
+        }
+        return count(explained[0].Plan)
+}
+
+func TestSeqScans(t *testing.T) {
+        plan := `[{"Plan": {"Node Type": "Limit", "Plans": [{"Node Type": "Nested Loop", "Plans": [
+                {"Node Type": "Index Scan", "Relation Name": "evidence", "Index Name": "ix_evidence_session_uploaded_by"},
+                {"Node Type": "Seq Scan", "Relation Name": "evidence_timestamps"}]}]}}]`
+        if got := seqScans(t, plan, "evidence"); got != 0 {
+                t.Errorf("seqScans(evidence) = %d, want 0", got)
+        }
+        if got := seqScans(t, plan, "evidence_timestamps"); got != 1 {
+                t.Errorf("seqScans(evidence_timestamps) = %d, want 1", got)
+        }
+}
+
+func TestEvidenceSearchUsesPromotedIndex(t *testing.T) {
+        pool := testDB(t)
+        ctx := context.Background()
+        sessionID := insertTestSession(t, pool, nil, nil)
+
+        // Enough rows from enough uploaders that the planner prefers the
+        // (session_id, uploaded_by) index over the session_id one
+        if _, err := pool.Exec(ctx, `
+                INSERT INTO evidence (session_id, evidence_type, file_path, metadata, checksum)
+                SELECT $1, 'photo', 'evidence/plan',
+                       jsonb_build_object('uploaded_by', 'inspector-' || (n % 40), 'content_type', 'image/jpeg', 'file_size', 1),
+                       md5(n::text)
+                FROM generate_series(1, 4000) AS n
+        `, sessionID); err != nil {
+                t.Fatal(err)
+        }
+        if _, err := pool.Exec(ctx, `ANALYZE evidence`); err != nil {
+                t.Fatal(err)
+        }
+
+        tests := []struct {
+                rawQuery  string
+                wantIndex string
+        }{
+                {"uploaded_by=inspector-7", "ix_evidence_session_uploaded_by"},
+                {"metadata.uploaded_by=inspector-7&evidence_type=photo", "ix_evidence_session_uploaded_by"},
+        }
+        for _, tt := range tests {
+                query, _ := url.ParseQuery(tt.rawQuery)
+                sql, args, err := evidenceSearchQuery(sessionID, query)
+                if err != nil {
+                        t.Fatal(err)
+                }
+                var plan string
+                if err := pool.QueryRow(ctx, "EXPLAIN (FORMAT JSON) "+sql, args...).Scan(&plan); err != nil {
+                        t.Fatalf("%s: %v", tt.rawQuery, err)
+                }
+                if !strings.Contains(plan, tt.wantIndex) {
+                        t.Errorf("%s: plan does not use %s:\n%s", tt.rawQuery, tt.wantIndex, plan)
+                }
+                if strings.Contains(plan, `"Seq Scan"`) && strings.Contains(plan, `"Relation Name": "evidence"`) {
+                        t.Errorf("%s: plan scans the whole evidence table:\n%s", tt.rawQuery, plan)
+                }
+        }
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "fmt"
+        "io"
+        "os"
+        "path/filepath"
+        "strings"
+)
+
+// Returned by an EvidenceStore when no object exists for a key
+var errEvidenceNotFound = errors.New("evidence object not found")
+
+// Blob storage for evidence file contents, keyed by evidence ID
+type EvidenceStore interface {
+        // Put stores the full contents of r under key and returns the number of bytes written
+        Put(ctx context.Context, key string, r io.Reader) (int64, error)
+        // Get opens the object stored under key for reading
+        Get(ctx context.Context, key string) (io.ReadSeekCloser, error)
+        // Size reports the stored object's size in bytes
+        Size(ctx context.Context, key string) (int64, error)
+        // Delete removes the object stored under key; deleting a missing object is not an error
+        Delete(ctx context.Context, key string) error
+}
+
+// Active evidence store, configured at startup
+var evidenceStore EvidenceStore
+
+// Where a store keeps its objects, reported on evidence records so data
+// residency can be verified without access to the backend
+type StorageLocation struct {
+        Location string
+        Class    string
+}
+
+// Implemented by evidence stores that can describe where their objects live
+type EvidenceStoreLocator interface {
+        StorageLocation() StorageLocation
+}
+
+// Location of the active evidence store, or the zero value when it cannot say
+func evidenceStorageLocation() StorageLocation {
+        if locator, ok := evidenceStore.(EvidenceStoreLocator); ok {
+                return locator.StorageLocation()
+        }
+        return StorageLocation{}
+}
+
+// Evidence store backed by a local directory
+type FileEvidenceStore struct {
+        root string
+}
+
+// Create a filesystem evidence store rooted at dir
+func NewFileEvidenceStore(dir string) (*FileEvidenceStore, error) {
+        if err := os.MkdirAll(dir, 0o750); err != nil {
+                return nil, fmt.Errorf("failed to create evidence store directory: %v", err)
+        }
+        return &FileEvidenceStore{root: dir}, nil
+}
+
+// Resolve a key to a path, fanning out by prefix to keep directories small.
+// Keys may carry a single namespace segment ("tenant/id"), stored in its own subdirectory.
+func (s *FileEvidenceStore) path(key string) (string, error) {
+        namespace, name, namespaced := strings.Cut(key, "/")
+        if !namespaced {
+                namespace, name = "", key
+        }
+        if name == "" || strings.ContainsAny(name, `/\`) || strings.Contains(key, "..") ||
+                (namespaced && (namespace == "" || strings.Contains(namespace, `\`))) {
+                return "", fmt.Errorf("invalid evidence key %q", key)
+        }
+        prefix := name
+        if len(prefix) > 2 {
+                prefix = prefix[:2]
+        }
+        return filepath.Join(s.root, namespace, prefix, name), nil
+}
+
+// Report the configured EVIDENCE_STORE_LOCATION and EVIDENCE_STORE_CLASS; the
+// directory itself is deployment detail and not exposed
+func (s *FileEvidenceStore) StorageLocation() StorageLocation {
+        return StorageLocation{Location: cfg.EvidenceStoreLocation, Class: cfg.EvidenceStoreClass}
+}
+
+// Verify the store root is an accessible directory
+func (s *FileEvidenceStore) Check(ctx context.Context) error {
+        info, err := os.Stat(s.root)
+        if err != nil {
+                return err
+        }
+        if !info.IsDir() {
+                return fmt.Errorf("evidence store root %s is not a directory", s.root)
+        }
+        return nil
+}
+
+func (s *FileEvidenceStore) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+        path, err := s.path(key)
+        if err != nil {
+                return 0, err
+        }
+        if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+                return 0, err
+        }
+
+        // Write to a temp file and rename so readers never observe partial objects
+        tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+        if err != nil {
+                return 0, err
+        }
+        defer os.Remove(tmp.Name())
+
+        n, err := io.Copy(tmp, r)
+        if err == nil {
+                err = tmp.Sync()
+        }
+        if closeErr := tmp.Close(); err == nil {
+                err = closeErr
+        }
+        if err != nil {
+                return n, err
+        }
+        return n, os.Rename(tmp.Name(), path)
+}
+
+func (s *FileEvidenceStore) Get(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+        path, err := s.path(key)
+        if err != nil {
+                return nil, err
+        }
+        f, err := os.Open(path)
+        if errors.Is(err, os.ErrNotExist) {
+                return nil, errEvidenceNotFound
+        }
+        return f, err
+}
+
+func (s *FileEvidenceStore) Size(ctx context.Context, key string) (int64, error) {
+        path, err := s.path(key)
+        if err != nil {
+                return 0, err
+        }
+        info, err := os.Stat(path)
+        if errors.Is(err, os.ErrNotExist) {
+                return 0, errEvidenceNotFound
+        }
+        if err != nil {
+                return 0, err
+        }
+        return info.Size(), nil
+}
+
+func (s *FileEvidenceStore) Delete(ctx context.Context, key string) error {
+        path, err := s.path(key)
+        if err != nil {
+                return err
+        }
+        if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+                return err
+        }
+        return nil
+}
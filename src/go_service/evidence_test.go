@@ -0,0 +1,1046 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "encoding/json"
+        "fmt"
+        "io"
+        "io/fs"
+        "mime/multipart"
+        "net/http"
+        "net/http/httptest"
+        "net/textproto"
+        "path/filepath"
+        "strconv"
+        "strings"
+        "testing"
+        "time"
+
+        "github.com/gorilla/mux"
+)
+
+func getEvidence(t *testing.T, method, evidenceID string, header http.Header) *httptest.ResponseRecorder {
+        t.Helper()
+        r := httptest.NewRequest(method, "/v1/evidence/"+evidenceID, nil)
+        for name, values := range header {
+                r.Header[name] = values
+        }
+        r = mux.SetURLVars(r, map[string]string{"evidence_id": evidenceID})
+        w := httptest.NewRecorder()
+        handleEvidenceDownload(w, r)
+        return w
+}
+
+func TestEvidenceHeadMatchesGetWithoutBody(t *testing.T) {
+        pool := testDB(t)
+        useTestEvidenceStore(t)
+        content := []byte("%PDF-1.7 hydrant flow test certificate")
+        evidenceID := insertTestEvidence(t, pool, insertTestSession(t, pool, nil, nil), content,
+                map[string]interface{}{"content_type": "application/pdf"})
+
+        get := getEvidence(t, http.MethodGet, evidenceID, nil)
+        head := getEvidence(t, http.MethodHead, evidenceID, nil)
+
+        if head.Code != http.StatusOK || get.Code != http.StatusOK {
+                t.Fatalf("status HEAD %d GET %d, want 200", head.Code, get.Code)
+        }
+        if head.Body.Len() != 0 {
+                t.Errorf("HEAD returned %d body bytes", head.Body.Len())
+        }
+        if get.Body.String() != string(content) {
+                t.Errorf("GET body = %q", get.Body.String())
+        }
+        for _, name := range []string{"Content-Type", "Content-Length", "ETag", "X-Content-SHA256"} {
+                if head.Header().Get(name) == "" || head.Header().Get(name) != get.Header().Get(name) {
+                        t.Errorf("%s: HEAD %q, GET %q", name, head.Header().Get(name), get.Header().Get(name))
+                }
+        }
+        if head.Header().Get("Content-Length") != strconv.Itoa(len(content)) {
+                t.Errorf("Content-Length = %q, want %d", head.Header().Get("Content-Length"), len(content))
+        }
+
+        missing := getEvidence(t, http.MethodHead, "00000000-0000-0000-0000-000000000000", nil)
+        if missing.Code != http.StatusNotFound {
+                t.Errorf("HEAD of unknown evidence = %d, want 404", missing.Code)
+        }
+}
+
+func getEvidenceMetadata(t *testing.T, evidenceID string) *httptest.ResponseRecorder {
+        t.Helper()
+        r := httptest.NewRequest(http.MethodGet, "/v1/evidence/"+evidenceID+"/metadata", nil)
+        r = mux.SetURLVars(r, map[string]string{"evidence_id": evidenceID})
+        w := httptest.NewRecorder()
+        handleEvidenceMetadata(w, r)
+        return w
+}
+
+func TestEvidenceMetadataWithoutBlob(t *testing.T) {
+        pool := testDB(t)
+        store := useTestEvidenceStore(t)
+        sessionID := insertTestSession(t, pool, nil, nil)
+        content := []byte("\x89PNG sprinkler head photo")
+        evidenceID := insertTestEvidence(t, pool, sessionID, content,
+                map[string]interface{}{"content_type": "image/png", "original_filename": "riser-2.png"})
+
+        // The metadata endpoint must not need the blob
+        if err := store.Delete(context.Background(), evidenceObjectKey(context.Background(), evidenceID)); err != nil {
+                t.Fatal(err)
+        }
+
+        w := getEvidenceMetadata(t, evidenceID)
+        if w.Code != http.StatusOK {
+                t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+        }
+        var record EvidenceRecord
+        if err := json.Unmarshal(w.Body.Bytes(), &record); err != nil {
+                t.Fatal(err)
+        }
+        if record.ID != evidenceID || record.SessionID != sessionID {
+                t.Errorf("record ids = %s/%s, want %s/%s", record.ID, record.SessionID, evidenceID, sessionID)
+        }
+        if record.Checksum != calculateSHA256(content) || record.FileSize != int64(len(content)) {
+                t.Errorf("checksum %s size %d do not describe the stored content", record.Checksum, record.FileSize)
+        }
+        if record.Metadata["original_filename"] != "riser-2.png" {
+                t.Errorf("metadata = %v", record.Metadata)
+        }
+}
+
+func TestEvidenceMetadataSoftDeleted(t *testing.T) {
+        pool := testDB(t)
+        useTestEvidenceStore(t)
+        evidenceID := insertTestEvidence(t, pool, insertTestSession(t, pool, nil, nil), []byte("extinguisher tag"), nil)
+        if _, err := pool.Exec(context.Background(),
+                `UPDATE evidence SET flagged_for_review = true, flagged_at = now() WHERE id = $1`, evidenceID); err != nil {
+                t.Fatal(err)
+        }
+
+        if w := getEvidenceMetadata(t, evidenceID); w.Code != http.StatusGone {
+                t.Errorf("soft-deleted metadata = %d, want 410", w.Code)
+        }
+        if w := getEvidenceMetadata(t, "11111111-2222-3333-4444-555555555555"); w.Code != http.StatusNotFound {
+                t.Errorf("unknown metadata = %d, want 404", w.Code)
+        }
+}
+
+func TestEvidenceDownloadIfRange(t *testing.T) {
+        pool := testDB(t)
+        useTestEvidenceStore(t)
+        content := []byte("0123456789 sprinkler riser video frames 0123456789")
+        evidenceID := insertTestEvidence(t, pool, insertTestSession(t, pool, nil, nil), content,
+                map[string]interface{}{"content_type": "video/mp4"})
+        etag := evidenceETag(calculateSHA256(content))
+
+        tests := []struct {
+                name    string
+                ifRange string
+                want    int
+                body    string
+        }{
+                {"matching ETag resumes", etag, http.StatusPartialContent, string(content[11:21])},
+                {"changed object restarts", evidenceETag(calculateSHA256([]byte("older upload"))), http.StatusOK, string(content)},
+                {"weak ETag never matches", "W/" + etag, http.StatusOK, string(content)},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        w := getEvidence(t, http.MethodGet, evidenceID, http.Header{
+                                "Range":    {"bytes=11-20"},
+                                "If-Range": {tt.ifRange},
+                        })
+                        if w.Code != tt.want {
+                                t.Fatalf("status = %d, want %d", w.Code, tt.want)
+                        }
+                        if w.Body.String() != tt.body {
+                                t.Errorf("body = %q, want %q", w.Body.String(), tt.body)
+                        }
+                        if tt.want == http.StatusPartialContent {
+                                if got, want := w.Header().Get("Content-Range"), "bytes 11-20/"+strconv.Itoa(len(content)); got != want {
+                                        t.Errorf("Content-Range = %q, want %q", got, want)
+                                }
+                        }
+                })
+        }
+}
+
+// Upload content to a session slot keyed by its hash, returning the evidence ID
+func uploadByContentHash(t *testing.T, userID, sessionID, evidenceType string, content []byte) (int, string) {
+        t.Helper()
+        r := evidenceUploadRequest(t, map[string]string{
+                "session_id":    sessionID,
+                "evidence_type": evidenceType,
+                "sha256_hash":   calculateSHA256(content),
+        }, map[string][]byte{"extinguisher-tag.jpg": content})
+        r.Header.Del("Idempotency-Key")
+        r.Header.Set("X-Idempotency-From-Hash", "true")
+        r.Header.Set("X-User-ID", userID)
+        w := httptest.NewRecorder()
+        handleEvidence(w, r)
+        var response EvidenceResponse
+        json.Unmarshal(w.Body.Bytes(), &response)
+        return w.Code, response.EvidenceID
+}
+
+func TestContentHashIdempotencyDeduplicates(t *testing.T) {
+        pool := testDB(t)
+        useTestEvidenceStore(t)
+        userID := insertTestUser(t, pool, "content-hash")
+        sessionID := insertTestSession(t, pool, nil, nil)
+        content := []byte("\xff\xd8\xff\xe0 extinguisher tag, serviced 2026-09")
+
+        status, original := uploadByContentHash(t, userID, sessionID, "photo", content)
+        if status != http.StatusCreated || original == "" {
+                t.Fatalf("first upload = %d %q", status, original)
+        }
+        status, again := uploadByContentHash(t, userID, sessionID, "photo", content)
+        if status != http.StatusCreated || again != original {
+                t.Errorf("re-upload = %d %q, want the original evidence %s", status, again, original)
+        }
+
+        // A different slot or different bytes is a different upload
+        if _, other := uploadByContentHash(t, userID, sessionID, "document", content); other == "" || other == original {
+                t.Errorf("same content as another evidence type = %q, want a new evidence ID", other)
+        }
+        if _, other := uploadByContentHash(t, userID, sessionID, "photo", append(content, '!')); other == "" || other == original {
+                t.Errorf("changed content = %q, want a new evidence ID", other)
+        }
+
+        var count int
+        pool.QueryRow(context.Background(), `SELECT COUNT(*) FROM evidence WHERE session_id = $1`, sessionID).Scan(&count)
+        if count != 3 {
+                t.Errorf("%d evidence rows, want 3", count)
+        }
+}
+
+func TestEvidenceUploadRequiresKeyOrHashOptIn(t *testing.T) {
+        content := []byte("sprinkler head inventory")
+        for _, optIn := range []string{"", "false", "nonsense"} {
+                r := evidenceUploadRequest(t, map[string]string{"sha256_hash": calculateSHA256(content)},
+                        map[string][]byte{"inventory.csv": content})
+                r.Header.Del("Idempotency-Key")
+                if optIn != "" {
+                        r.Header.Set("X-Idempotency-From-Hash", optIn)
+                }
+                w := httptest.NewRecorder()
+                handleEvidence(w, r)
+                if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Idempotency-Key header required") {
+                        t.Errorf("X-Idempotency-From-Hash %q: %d %q, want 400", optIn, w.Code, w.Body.String())
+                }
+        }
+}
+
+func TestResolveEvidenceContentType(t *testing.T) {
+        pngHeader := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+        tests := []struct {
+                name       string
+                content    []byte
+                provided   string
+                filename   string
+                want       string
+                wantSource string
+        }{
+                {"client wins", pngHeader, "image/x-custom", "panel.png", "image/x-custom", contentTypeSourceClient},
+                {"sniffed", pngHeader, "", "upload.bin", "image/png", contentTypeSourceSniffed},
+                {"sniffed despite misleading extension", []byte("%PDF-1.4 hydrant certificate"), "", "cert.png", "application/pdf", contentTypeSourceSniffed},
+                {"extension refines plain text", []byte(`{"zone":"B","pressure_kpa":550}`), "", "readings.json", "application/json", contentTypeSourceExtension},
+                {"extension for unsniffable bytes", []byte{0x00, 0x01, 0x02, 0x03}, "", "Riser-Diagram.PDF", "application/pdf", contentTypeSourceExtension},
+                {"plain text without extension", []byte("inspector notes"), "", "notes", "text/plain; charset=utf-8", contentTypeSourceSniffed},
+                {"nothing to go on", []byte{0x00, 0x01, 0x02, 0x03}, "", "blob.zz9", "application/octet-stream", contentTypeSourceDefault},
+                {"empty file", nil, "", "empty", "application/octet-stream", contentTypeSourceDefault},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        file := bytes.NewReader(tt.content)
+                        file.Seek(3, io.SeekStart)
+                        got, source, err := resolveEvidenceContentType(file, tt.provided, tt.filename)
+                        if err != nil {
+                                t.Fatal(err)
+                        }
+                        if got != tt.want || source != tt.wantSource {
+                                t.Errorf("got %q (%s), want %q (%s)", got, source, tt.want, tt.wantSource)
+                        }
+                        if tt.provided == "" {
+                                if pos, _ := file.Seek(0, io.SeekCurrent); pos != 0 {
+                                        t.Errorf("file left at offset %d, want 0", pos)
+                                }
+                        }
+                })
+        }
+}
+
+// Build an evidence upload whose file part carries no Content-Type header
+func untypedEvidenceUpload(t *testing.T, userID, sessionID, filename string, content []byte) *http.Request {
+        t.Helper()
+        var body bytes.Buffer
+        form := multipart.NewWriter(&body)
+        form.WriteField("session_id", sessionID)
+        form.WriteField("evidence_type", "document")
+        form.WriteField("sha256_hash", calculateSHA256(content))
+        part, err := form.CreatePart(textproto.MIMEHeader{
+                "Content-Disposition": {fmt.Sprintf(`form-data; name="file"; filename=%q`, filename)},
+        })
+        if err != nil {
+                t.Fatal(err)
+        }
+        part.Write(content)
+        form.Close()
+
+        r := httptest.NewRequest(http.MethodPost, "/v1/evidence", &body)
+        r.Header.Set("Content-Type", form.FormDataContentType())
+        r.Header.Set("Idempotency-Key", "untyped-"+filename+"-"+sessionID)
+        r.Header.Set("X-User-ID", userID)
+        return r
+}
+
+func TestUntypedEvidenceUploadRecordsInferredType(t *testing.T) {
+        pool := testDB(t)
+        useTestEvidenceStore(t)
+        userID := insertTestUser(t, pool, "untyped")
+        sessionID := insertTestSession(t, pool, nil, nil)
+
+        tests := []struct {
+                filename   string
+                content    []byte
+                want       string
+                wantSource string
+        }{
+                {"exit-sign.gif", []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00"), "image/gif", contentTypeSourceSniffed},
+                {"flow-test.json", []byte(`{"litres_per_minute":950}`), "application/json", contentTypeSourceExtension},
+        }
+        for _, tt := range tests {
+                t.Run(tt.filename, func(t *testing.T) {
+                        w := httptest.NewRecorder()
+                        handleEvidence(w, untypedEvidenceUpload(t, userID, sessionID, tt.filename, tt.content))
+                        if w.Code != http.StatusCreated {
+                                t.Fatalf("upload = %d %s", w.Code, w.Body.String())
+                        }
+                        var response EvidenceResponse
+                        json.Unmarshal(w.Body.Bytes(), &response)
+                        record, err := loadEvidenceRecord(context.Background(), response.EvidenceID)
+                        if err != nil {
+                                t.Fatal(err)
+                        }
+                        if record.Metadata["content_type"] != tt.want || record.Metadata["content_type_source"] != tt.wantSource {
+                                t.Errorf("metadata content type = %v (%v), want %s (%s)", record.Metadata["content_type"],
+                                        record.Metadata["content_type_source"], tt.want, tt.wantSource)
+                        }
+                })
+        }
+}
+
+func TestEvidenceUploadChecksSessionState(t *testing.T) {
+        pool := testDB(t)
+        useTestEvidenceStore(t)
+        withConfig(t, func(c *Config) { c.EvidenceClosedSessionStatuses = "finalized, archived" })
+        userID := insertTestUser(t, pool, "session-state")
+
+        sessionWithStatus := func(status string) string {
+                sessionID := insertTestSession(t, pool, nil, nil)
+                if _, err := pool.Exec(context.Background(), "UPDATE test_sessions SET status = $2 WHERE id = $1", sessionID, status); err != nil {
+                        t.Fatal(err)
+                }
+                return sessionID
+        }
+
+        tests := []struct {
+                name      string
+                sessionID string
+                want      int
+        }{
+                {"active", sessionWithStatus("in_progress"), http.StatusCreated},
+                {"archived", sessionWithStatus("archived"), http.StatusConflict},
+                {"finalized in another case", sessionWithStatus("Finalized"), http.StatusConflict},
+                {"unknown", "6f1e2d3c-4b5a-4978-8e6f-5d4c3b2a1908", http.StatusNotFound},
+                {"malformed ID", "building-12/session-3", http.StatusNotFound},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        content := []byte("evacuation drill sign-in sheet: " + tt.name)
+                        r := evidenceUploadRequest(t, map[string]string{
+                                "session_id":    tt.sessionID,
+                                "evidence_type": "document",
+                                "sha256_hash":   calculateSHA256(content),
+                        }, map[string][]byte{"drill.pdf": content})
+                        r.Header.Set("X-User-ID", userID)
+                        w := httptest.NewRecorder()
+                        handleEvidence(w, r)
+                        if w.Code != tt.want {
+                                t.Fatalf("status = %d %s, want %d", w.Code, w.Body.String(), tt.want)
+                        }
+                        if tt.want == http.StatusConflict {
+                                var body map[string]string
+                                json.Unmarshal(w.Body.Bytes(), &body)
+                                if !strings.EqualFold(body["status"], strings.Fields(tt.name)[0]) {
+                                        t.Errorf("409 body = %v, want the session status", body)
+                                }
+                        }
+                })
+        }
+}
+
+// Upload content to a session through the handler, so quota usage is counted
+func uploadTestEvidence(t *testing.T, userID, sessionID, filename string, content []byte) string {
+        t.Helper()
+        r := evidenceUploadRequest(t, map[string]string{
+                "session_id":    sessionID,
+                "evidence_type": "photo",
+                "sha256_hash":   calculateSHA256(content),
+        }, map[string][]byte{filename: content})
+        r.Header.Set("Idempotency-Key", "bulk-"+filename+"-"+sessionID)
+        r.Header.Set("X-User-ID", userID)
+        w := httptest.NewRecorder()
+        handleEvidence(w, r)
+        if w.Code != http.StatusCreated {
+                t.Fatalf("upload %s = %d %s", filename, w.Code, w.Body.String())
+        }
+        var response EvidenceResponse
+        json.Unmarshal(w.Body.Bytes(), &response)
+        return response.EvidenceID
+}
+
+// Set generous quotas so uploads maintain evidence_usage counters
+func trackEvidenceUsage(t *testing.T) {
+        withConfig(t, func(c *Config) {
+                c.SessionMaxEvidenceCount = 1 << 20
+                c.UserMaxEvidenceCount = 1 << 20
+        })
+}
+
+func evidenceUsage(t *testing.T, scope, scopeID string) (count, size int64) {
+        t.Helper()
+        dbPool.QueryRow(context.Background(),
+                "SELECT evidence_count, total_bytes FROM evidence_usage WHERE scope = $1 AND scope_id = $2", scope, scopeID).Scan(&count, &size)
+        return count, size
+}
+
+func deleteSessionEvidence(t *testing.T, sessionID, userID, query string) *httptest.ResponseRecorder {
+        t.Helper()
+        r := httptest.NewRequest(http.MethodDelete, "/v1/tests/sessions/"+sessionID+"/evidence"+query, nil)
+        if userID != "" {
+                r.Header.Set("X-User-ID", userID)
+        }
+        w := httptest.NewRecorder()
+        handleDeleteSessionEvidence(w, mux.SetURLVars(r, map[string]string{"session_id": sessionID}))
+        return w
+}
+
+func TestBulkDeleteRejectsBadRequests(t *testing.T) {
+        if w := deleteSessionEvidence(t, "7a1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d", "", ""); w.Code != http.StatusBadRequest {
+                t.Errorf("without X-User-ID = %d, want 400", w.Code)
+        }
+        if w := deleteSessionEvidence(t, "session-seven", "operator", ""); w.Code != http.StatusNotFound {
+                t.Errorf("malformed session = %d, want 404", w.Code)
+        }
+}
+
+func TestBulkSoftDeleteReleasesUsageOnce(t *testing.T) {
+        pool := testDB(t)
+        useTestEvidenceStore(t)
+        trackEvidenceUsage(t)
+        userID := insertTestUser(t, pool, "bulk-soft")
+        sessionID := insertTestSession(t, pool, nil, nil)
+
+        ids := []string{
+                uploadTestEvidence(t, userID, sessionID, "riser.jpg", []byte("riser photo, 24 bytes...")),
+                uploadTestEvidence(t, userID, sessionID, "valve.jpg", []byte("valve photo")),
+                uploadTestEvidence(t, userID, sessionID, "pump.jpg", []byte("pump photo!")),
+        }
+        if count, size := evidenceUsage(t, quotaScopeSession, sessionID); count != 3 || size != 46 {
+                t.Fatalf("session usage before delete = %d/%d, want 3/46", count, size)
+        }
+
+        // One record was already deleted on its own; its usage must not be released twice
+        if _, err := softDeleteEvidence(context.Background(), ids[0], userID); err != nil {
+                t.Fatal(err)
+        }
+
+        w := deleteSessionEvidence(t, sessionID, userID, "")
+        if w.Code != http.StatusOK {
+                t.Fatalf("bulk delete = %d %s", w.Code, w.Body.String())
+        }
+        var result map[string]interface{}
+        json.Unmarshal(w.Body.Bytes(), &result)
+        if result["mode"] != "soft" || result["deleted"] != float64(2) {
+                t.Errorf("result = %v, want 2 soft-deleted", result)
+        }
+        for _, scope := range [][2]string{{quotaScopeSession, sessionID}, {quotaScopeUser, userID}} {
+                if count, size := evidenceUsage(t, scope[0], scope[1]); count != 0 || size != 0 {
+                        t.Errorf("%s usage after delete = %d/%d, want 0/0", scope[0], count, size)
+                }
+        }
+
+        // Soft-deleted blobs are kept for review
+        for _, id := range ids {
+                if _, err := evidenceStore.Size(context.Background(), evidenceObjectKey(context.Background(), id)); err != nil {
+                        t.Errorf("blob %s removed by a soft delete: %v", id, err)
+                }
+        }
+
+        var entries int
+        var summary string
+        pool.QueryRow(context.Background(), `
+                SELECT count(*), max(new_values::text) FROM audit_log
+                WHERE action = $1 AND new_values->>'session_id' = $2
+        `, auditActionEvidenceBulkDelete, sessionID).Scan(&entries, &summary)
+        if entries != 1 {
+                t.Errorf("%d bulk delete audit entries, want 1", entries)
+        }
+        var values map[string]interface{}
+        json.Unmarshal([]byte(summary), &values)
+        if values["evidence_count"] != float64(2) || values["released_bytes"] != float64(22) || values["mode"] != "soft" {
+                t.Errorf("audit summary = %v", values)
+        }
+}
+
+func TestBulkHardDeletePurgesBlobs(t *testing.T) {
+        pool := testDB(t)
+        useTestEvidenceStore(t)
+        trackEvidenceUsage(t)
+        oldPool := workerPool
+        workerPool = nil // purge inline
+        t.Cleanup(func() { workerPool = oldPool })
+        userID := insertTestUser(t, pool, "bulk-hard")
+        sessionID := insertTestSession(t, pool, nil, nil)
+        keep := insertTestSession(t, pool, nil, nil)
+
+        purged := []string{
+                uploadTestEvidence(t, userID, sessionID, "alarm-1.jpg", []byte("alarm panel one")),
+                uploadTestEvidence(t, userID, sessionID, "alarm-2.jpg", []byte("alarm panel two")),
+        }
+        kept := uploadTestEvidence(t, userID, keep, "other-session.jpg", []byte("unrelated session"))
+
+        if w := deleteSessionEvidence(t, sessionID, userID, "?hard=true"); w.Code != http.StatusOK {
+                t.Fatalf("hard delete = %d %s", w.Code, w.Body.String())
+        }
+        var remaining int
+        pool.QueryRow(context.Background(), "SELECT count(*) FROM evidence WHERE session_id = $1", sessionID).Scan(&remaining)
+        if remaining != 0 {
+                t.Errorf("%d evidence rows left after hard delete", remaining)
+        }
+        for _, id := range purged {
+                if _, err := evidenceStore.Size(context.Background(), evidenceObjectKey(context.Background(), id)); err != errEvidenceNotFound {
+                        t.Errorf("blob %s: err = %v, want it purged", id, err)
+                }
+        }
+        if _, err := evidenceStore.Size(context.Background(), evidenceObjectKey(context.Background(), kept)); err != nil {
+                t.Errorf("other session's blob purged: %v", err)
+        }
+        if count, _ := evidenceUsage(t, quotaScopeUser, userID); count != 1 {
+                t.Errorf("user usage after hard delete = %d, want 1 (the other session)", count)
+        }
+
+        if w := deleteSessionEvidence(t, "00000000-0000-4000-8000-000000000000", userID, "?hard=true"); w.Code != http.StatusNotFound {
+                t.Errorf("unknown session = %d, want 404", w.Code)
+        }
+}
+
+func TestEvidenceMaxBytesByType(t *testing.T) {
+        withConfig(t, func(c *Config) {
+                c.EvidenceMaxBytes = 5 << 20
+                c.EvidenceTypeMaxBytes = map[string]int64{"screenshot": 512 << 10, "video": 200 << 20, "drawing": 0}
+        })
+        tests := []struct {
+                evidenceType string
+                want         int64
+        }{
+                {"screenshot", 512 << 10},
+                {"Screenshot", 512 << 10},
+                {"video", 200 << 20},
+                {"drawing", 0},
+                {"photo", 5 << 20},
+        }
+        for _, tt := range tests {
+                if got := evidenceMaxBytes(tt.evidenceType); got != tt.want {
+                        t.Errorf("evidenceMaxBytes(%q) = %d, want %d", tt.evidenceType, got, tt.want)
+                }
+        }
+}
+
+func TestEvidenceBodyLimit(t *testing.T) {
+        tests := []struct {
+                name    string
+                global  int64
+                perType map[string]int64
+                want    int64
+        }{
+                {"no limits", 0, map[string]int64{"video": 100}, 0},
+                {"global only", 4096, nil, 4096},
+                {"largest override", 4096, map[string]int64{"screenshot": 1024, "video": 65536}, 65536},
+                {"an unlimited type", 4096, map[string]int64{"video": 0}, 0},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        withConfig(t, func(c *Config) {
+                                c.EvidenceMaxBytes = tt.global
+                                c.EvidenceTypeMaxBytes = tt.perType
+                        })
+                        if got := evidenceBodyLimit(); got != tt.want {
+                                t.Errorf("evidenceBodyLimit() = %d, want %d", got, tt.want)
+                        }
+                })
+        }
+}
+
+func TestEnvInt64Prefix(t *testing.T) {
+        t.Setenv("MAX_BYTES_SCREENSHOT", "2048")
+        t.Setenv("MAX_BYTES_THERMAL_IMAGE", "0")
+        t.Setenv("MAX_BYTES_VIDEO", "lots")
+        t.Setenv("MAX_BYTES_", "10")
+        limits := envInt64Prefix("MAX_BYTES_")
+        if limits["screenshot"] != 2048 {
+                t.Errorf("screenshot = %d, want 2048", limits["screenshot"])
+        }
+        if limit, ok := limits["thermal_image"]; !ok || limit != 0 {
+                t.Errorf("thermal_image = %d, %v; want an explicit 0", limit, ok)
+        }
+        if _, ok := limits["video"]; ok {
+                t.Error("malformed value was kept")
+        }
+        if _, ok := limits[""]; ok {
+                t.Error("empty suffix was kept")
+        }
+}
+
+func TestUploadSizeLimitPerEvidenceType(t *testing.T) {
+        withConfig(t, func(c *Config) {
+                c.EvidenceMaxBytes = 8 << 10
+                c.EvidenceTypeMaxBytes = map[string]int64{"screenshot": 1 << 10, "video": 64 << 10}
+        })
+        content := bytes.Repeat([]byte("frame"), 600) // 3000 bytes
+
+        tests := []struct {
+                evidenceType string
+                wantLimit    int64
+        }{
+                {"screenshot", 1 << 10},
+                {"video", 0}, // within its limit
+                {"photo", 0}, // within the global default
+        }
+        for _, tt := range tests {
+                t.Run(tt.evidenceType, func(t *testing.T) {
+                        // The tab in the filename is rejected only once the size check passes
+                        r := evidenceUploadRequest(t, map[string]string{
+                                "session_id":    "9a1d6e0c-52b7-4f38-8c21-6be0d4f7a310",
+                                "evidence_type": tt.evidenceType,
+                                "sha256_hash":   calculateSHA256(content),
+                        }, map[string][]byte{"capture\t1": content})
+                        w := httptest.NewRecorder()
+                        handleEvidence(w, r)
+
+                        if tt.wantLimit == 0 {
+                                if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Invalid filename") {
+                                        t.Errorf("status = %d %s, want the size check to pass", w.Code, w.Body.String())
+                                }
+                                return
+                        }
+                        if w.Code != http.StatusRequestEntityTooLarge {
+                                t.Fatalf("status = %d, want 413", w.Code)
+                        }
+                        var body struct {
+                                EvidenceType string `json:"evidence_type"`
+                                MaxBytes     int64  `json:"max_bytes"`
+                        }
+                        json.Unmarshal(w.Body.Bytes(), &body)
+                        if body.EvidenceType != tt.evidenceType || body.MaxBytes != tt.wantLimit {
+                                t.Errorf("413 body = %+v, want %s limit %d", body, tt.evidenceType, tt.wantLimit)
+                        }
+                })
+        }
+
+        t.Run("body over every limit", func(t *testing.T) {
+                huge := bytes.Repeat([]byte{0xff}, 2<<20)
+                r := evidenceUploadRequest(t, map[string]string{"session_id": "s", "evidence_type": "video"}, map[string][]byte{"long.mp4": huge})
+                w := httptest.NewRecorder()
+                handleEvidence(w, r)
+                if w.Code != http.StatusRequestEntityTooLarge {
+                        t.Errorf("status = %d, want 413 while streaming", w.Code)
+                }
+        })
+}
+
+func TestEvidenceStorageLocationFollowsBackend(t *testing.T) {
+        withConfig(t, func(c *Config) {
+                c.EvidenceStoreLocation = "ap-southeast-2/fire-evidence-syd"
+                c.EvidenceStoreClass = "infrequent-access"
+        })
+        want := StorageLocation{Location: "ap-southeast-2/fire-evidence-syd", Class: "infrequent-access"}
+
+        file := useTestEvidenceStore(t)
+        if got := evidenceStorageLocation(); got != want {
+                t.Errorf("file store: %+v, want %+v", got, want)
+        }
+
+        spooling, err := NewSpoolingEvidenceStore(file, t.TempDir())
+        if err != nil {
+                t.Fatal(err)
+        }
+        evidenceStore = spooling
+        if got := evidenceStorageLocation(); got != want {
+                t.Errorf("spooling store: %+v, want the primary's %+v", got, want)
+        }
+
+        // A backend that cannot describe itself reports nothing rather than guessing
+        evidenceStore = newOutageStore(t)
+        if got := evidenceStorageLocation(); got != (StorageLocation{}) {
+                t.Errorf("opaque store: %+v, want no location", got)
+        }
+}
+
+func TestEvidenceMetadataReportsStorageLocation(t *testing.T) {
+        pool := testDB(t)
+        useTestEvidenceStore(t)
+        withConfig(t, func(c *Config) {
+                c.EvidenceStoreLocation = "eu-central-1/inspections"
+                c.EvidenceStoreClass = "archive"
+        })
+        sessionID := insertTestSession(t, pool, nil, nil)
+        evidenceID := insertTestEvidence(t, pool, sessionID, []byte("hydrant flow test sheet"), nil)
+
+        w := getEvidenceMetadata(t, evidenceID)
+        var body map[string]interface{}
+        if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+                t.Fatal(err)
+        }
+        if body["storage_location"] != "eu-central-1/inspections" || body["storage_class"] != "archive" {
+                t.Errorf("storage = %v / %v, want the configured backend", body["storage_location"], body["storage_class"])
+        }
+}
+
+func deleteEvidence(evidenceID, userID, idempotencyKey string) *httptest.ResponseRecorder {
+        r := httptest.NewRequest(http.MethodDelete, "/v1/evidence/"+evidenceID, nil)
+        r = mux.SetURLVars(r, map[string]string{"evidence_id": evidenceID})
+        if userID != "" {
+                r.Header.Set("X-User-ID", userID)
+        }
+        if idempotencyKey != "" {
+                r.Header.Set("Idempotency-Key", idempotencyKey)
+        }
+        w := httptest.NewRecorder()
+        handleDeleteEvidence(w, r)
+        return w
+}
+
+func TestDeleteEvidenceRejectsBadRequests(t *testing.T) {
+        withConfig(t, func(c *Config) { c.IdempotencyKeyMaxLength = 16 })
+        const evidenceID = "2c8e5f1a-9b4d-4a07-8e63-d1f5b0c7a924"
+        tests := []struct {
+                name       string
+                evidenceID string
+                userID     string
+                key        string
+                want       int
+        }{
+                {"malformed id", "photo-17", "inspector-13", "", http.StatusNotFound},
+                {"missing user", evidenceID, "", "", http.StatusBadRequest},
+                {"overlong key", evidenceID, "inspector-13", strings.Repeat("d", 17), http.StatusBadRequest},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        if w := deleteEvidence(tt.evidenceID, tt.userID, tt.key); w.Code != tt.want {
+                                t.Errorf("status = %d, want %d", w.Code, tt.want)
+                        }
+                })
+        }
+}
+
+func TestDeleteEvidenceTwiceIsConsistent(t *testing.T) {
+        pool := testDB(t)
+        useTestEvidenceStore(t)
+        trackEvidenceUsage(t)
+        userID := insertTestUser(t, pool, "delete-twice")
+        sessionID := insertTestSession(t, pool, nil, nil)
+        evidenceID := uploadTestEvidence(t, userID, sessionID, "sprinkler-gauge.jpg", []byte("gauge at 72 psi"))
+
+        for _, key := range []string{"", "delete-" + evidenceID[:8]} {
+                name := "without key"
+                if key != "" {
+                        name = "with key"
+                        evidenceID = uploadTestEvidence(t, userID, sessionID, "sprinkler-gauge-2.jpg", []byte("gauge at 70 psi"))
+                }
+                t.Run(name, func(t *testing.T) {
+                        var responses [2]EvidenceDeletion
+                        for i := range responses {
+                                w := deleteEvidence(evidenceID, userID, key)
+                                if w.Code != http.StatusOK {
+                                        t.Fatalf("delete %d = %d %s, want 200", i+1, w.Code, w.Body.String())
+                                }
+                                json.Unmarshal(w.Body.Bytes(), &responses[i])
+                        }
+                        if responses[0] != responses[1] || responses[0].Status != "deleted" || responses[0].DeletedAt.IsZero() {
+                                t.Errorf("responses = %+v and %+v, want the same deletion", responses[0], responses[1])
+                        }
+
+                        var audits int
+                        pool.QueryRow(context.Background(), "SELECT count(*) FROM audit_log WHERE action = $1 AND resource_id::text = $2",
+                                auditActionEvidenceDelete, evidenceID).Scan(&audits)
+                        if audits != 1 {
+                                t.Errorf("%d audit entries, want 1", audits)
+                        }
+                })
+        }
+
+        // Usage was released once per record
+        if count, size := evidenceUsage(t, quotaScopeSession, sessionID); count != 0 || size != 0 {
+                t.Errorf("session usage = %d/%d, want 0/0", count, size)
+        }
+        if w := deleteEvidence("7e3a0c5b-1f92-4d68-b8e4-0a6c2d9f1b73", userID, ""); w.Code != http.StatusNotFound {
+                t.Errorf("unknown evidence = %d, want 404", w.Code)
+        }
+}
+
+func patchEvidenceMetadata(evidenceID, userID, body string) *httptest.ResponseRecorder {
+        r := httptest.NewRequest(http.MethodPatch, "/v1/evidence/"+evidenceID+"/metadata", strings.NewReader(body))
+        r = mux.SetURLVars(r, map[string]string{"evidence_id": evidenceID})
+        if userID != "" {
+                r.Header.Set("X-User-ID", userID)
+        }
+        w := httptest.NewRecorder()
+        handleUpdateEvidenceMetadata(w, r)
+        return w
+}
+
+func TestEvidenceMetadataPatchRejectsImmutableFields(t *testing.T) {
+        const evidenceID = "5a1d7c3e-0b6f-4e92-a4d8-63c1f0e2b957"
+        tests := []struct {
+                name string
+                body string
+                want string
+        }{
+                {"checksum", `{"checksum": "00ff"}`, `Field "checksum" is immutable`},
+                {"file path alongside a valid type", `{"evidence_type": "video", "file_path": "/tmp/x"}`, `Field "file_path" is immutable`},
+                {"empty patch", `{}`, "No metadata fields to update"},
+                {"blank type", `{"evidence_type": "  "}`, "evidence_type must be a non-empty string"},
+                {"numeric labels", `{"labels": {"floor": 3}}`, "labels must be an object of strings"},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        w := patchEvidenceMetadata(evidenceID, "inspector-22", tt.body)
+                        if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tt.want) {
+                                t.Errorf("status = %d %q, want 400 %q", w.Code, w.Body.String(), tt.want)
+                        }
+                })
+        }
+}
+
+func TestEvidenceMetadataPatch(t *testing.T) {
+        pool := testDB(t)
+        useTestEvidenceStore(t)
+        userID := insertTestUser(t, pool, "metadata-patch")
+        sessionID := insertTestSession(t, pool, nil, nil)
+        evidenceID := uploadTestEvidence(t, userID, sessionID, "exit-sign.jpg", []byte("exit sign unlit"))
+        original, err := loadEvidenceRecord(context.Background(), evidenceID)
+        if err != nil {
+                t.Fatal(err)
+        }
+
+        w := patchEvidenceMetadata(evidenceID, userID, `{"evidence_type": "document", "labels": {"floor": "B2", "zone": "east"}}`)
+        if w.Code != http.StatusOK {
+                t.Fatalf("patch = %d %s, want 200", w.Code, w.Body.String())
+        }
+        var updated EvidenceRecord
+        json.Unmarshal(w.Body.Bytes(), &updated)
+        labels, _ := updated.Metadata["labels"].(map[string]interface{})
+        if updated.EvidenceType != "document" || labels["floor"] != "B2" || labels["zone"] != "east" {
+                t.Errorf("updated = %s, want the new type and labels", w.Body.String())
+        }
+        if updated.Checksum != original.Checksum || updated.FilePath != original.FilePath {
+                t.Errorf("file fields changed: %s/%s, was %s/%s", updated.Checksum, updated.FilePath, original.Checksum, original.FilePath)
+        }
+
+        var previous, current string
+        err = pool.QueryRow(context.Background(), `
+                SELECT new_values->'previous'->>'evidence_type', new_values->'current'->>'evidence_type'
+                FROM audit_log WHERE action = $1 AND resource_id::text = $2
+        `, auditActionEvidenceMetadataUpdate, evidenceID).Scan(&previous, &current)
+        if err != nil || previous != "photo" || current != "document" {
+                t.Errorf("audit = %q -> %q, %v; want photo -> document", previous, current, err)
+        }
+
+        // A rejected checksum change leaves the record as it was
+        if w := patchEvidenceMetadata(evidenceID, userID, `{"checksum": "`+calculateSHA256([]byte("forged"))+`"}`); w.Code != http.StatusBadRequest {
+                t.Errorf("checksum change = %d, want 400", w.Code)
+        }
+        // Clearing labels keeps the type
+        if w := patchEvidenceMetadata(evidenceID, userID, `{"labels": null}`); w.Code != http.StatusOK {
+                t.Fatalf("clear labels = %d %s", w.Code, w.Body.String())
+        }
+        final, err := loadEvidenceRecord(context.Background(), evidenceID)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if _, ok := final.Metadata["labels"]; ok || final.EvidenceType != "document" || final.Checksum != original.Checksum {
+                t.Errorf("final = %+v, want labels cleared and the checksum kept", final)
+        }
+
+        if w := patchEvidenceMetadata("9d0e4b2a-6c1f-4a83-b7e5-f2a8c3d0e641", userID, `{"evidence_type": "video"}`); w.Code != http.StatusNotFound {
+                t.Errorf("unknown evidence = %d, want 404", w.Code)
+        }
+}
+
+// Evidence store that silently loses the last missing bytes of every object:
+// Put reports (and Size finds) fewer bytes than were sent when shortPut is set,
+// or Put reports the full count while Size finds fewer otherwise
+type truncatingStore struct {
+        EvidenceStore
+        missing  int64
+        shortPut bool
+}
+
+func (s *truncatingStore) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+        data, err := io.ReadAll(r)
+        if err != nil {
+                return 0, err
+        }
+        kept := data[:max(0, int64(len(data))-s.missing)]
+        n, err := s.EvidenceStore.Put(ctx, key, bytes.NewReader(kept))
+        if s.shortPut {
+                return n, err
+        }
+        return int64(len(data)), err
+}
+
+func TestVerifyStoredEvidenceSize(t *testing.T) {
+        store := useTestEvidenceStore(t)
+        ctx := context.Background()
+        store.Put(ctx, "alarm-test.wav", strings.NewReader("ten bytes!"))
+
+        tests := []struct {
+                name              string
+                key               string
+                expected, written int64
+                wantErr           string
+        }{
+                {"intact", "alarm-test.wav", 10, 10, ""},
+                {"short write", "alarm-test.wav", 12, 10, "store accepted 10 of 12 bytes"},
+                {"short object", "alarm-test.wav", 12, 12, "store reports 10 bytes, expected 12"},
+                {"missing object", "never-written.wav", 4, 4, "size check failed"},
+        }
+        for _, tt := range tests {
+                err := verifyStoredEvidenceSize(ctx, tt.key, tt.expected, tt.written)
+                if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+                        t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantErr)
+                }
+        }
+}
+
+func TestTruncatedEvidenceUploadRolledBack(t *testing.T) {
+        pool := testDB(t)
+        withConfig(t, func(c *Config) { c.EvidenceVerifyStoredSize = true })
+        logs := captureLog(t)
+        userID := insertTestUser(t, pool, "truncated-upload")
+
+        for _, shortPut := range []bool{true, false} {
+                t.Run(fmt.Sprintf("short put %v", shortPut), func(t *testing.T) {
+                        files := useTestEvidenceStore(t)
+                        evidenceStore = &truncatingStore{EvidenceStore: files, missing: 7, shortPut: shortPut}
+                        sessionID := insertTestSession(t, pool, nil, nil)
+                        content := []byte("fire extinguisher tag: serviced 2026-03")
+
+                        r := evidenceUploadRequest(t, map[string]string{
+                                "session_id":    sessionID,
+                                "evidence_type": "photo",
+                                "sha256_hash":   calculateSHA256(content),
+                        }, map[string][]byte{"extinguisher.jpg": content})
+                        r.Header.Set("Idempotency-Key", "truncated-"+sessionID)
+                        r.Header.Set("X-User-ID", userID)
+                        w := httptest.NewRecorder()
+                        handleEvidence(w, r)
+                        if w.Code != http.StatusInternalServerError {
+                                t.Fatalf("upload = %d %s, want 500", w.Code, w.Body.String())
+                        }
+
+                        var rows int
+                        pool.QueryRow(context.Background(), "SELECT count(*) FROM evidence WHERE session_id = $1", sessionID).Scan(&rows)
+                        if rows != 0 {
+                                t.Errorf("%d evidence rows after a truncated write, want 0", rows)
+                        }
+                        objects := 0
+                        filepath.WalkDir(files.root, func(path string, d fs.DirEntry, err error) error {
+                                if err == nil && d.Type().IsRegular() {
+                                        objects++
+                                }
+                                return nil
+                        })
+                        if objects != 0 {
+                                t.Errorf("store holds %d objects, want the truncated one removed", objects)
+                        }
+                })
+        }
+        if !strings.Contains(logs.String(), "failed post-write verification") {
+                t.Error("verification failure not logged")
+        }
+}
+
+func TestParseEvidenceCapturedAt(t *testing.T) {
+        withConfig(t, func(c *Config) { c.EvidenceCapturedAtMaxSkew = 2 * time.Minute })
+        now := time.Now()
+        offline := time.Date(2026, 2, 3, 16, 45, 12, 123456789, time.FixedZone("AEDT", 11*3600))
+
+        got, err := parseEvidenceCapturedAt(offline.Format(time.RFC3339Nano))
+        if err != nil || !got.Equal(offline.Truncate(time.Microsecond)) || got.Location() != time.UTC {
+                t.Errorf("offline capture = %v, %v; want %v in UTC at microsecond precision", got, err, offline)
+        }
+        if got, err := parseEvidenceCapturedAt(""); got != nil || err != nil {
+                t.Errorf("empty = %v, %v; want no capture time", got, err)
+        }
+        if _, err := parseEvidenceCapturedAt(now.Add(time.Minute).Format(time.RFC3339)); err != nil {
+                t.Errorf("capture within the skew rejected: %v", err)
+        }
+        for _, value := range []string{now.Add(10 * time.Minute).Format(time.RFC3339), "2026-02-03 16:45", "yesterday"} {
+                if _, err := parseEvidenceCapturedAt(value); err == nil {
+                        t.Errorf("captured_at %q accepted", value)
+                }
+        }
+}
+
+func TestFutureCapturedAtRejected(t *testing.T) {
+        withConfig(t, func(c *Config) { c.EvidenceCapturedAtMaxSkew = 5 * time.Minute })
+        r := evidenceUploadRequest(t, map[string]string{
+                "session_id":    "session-future",
+                "evidence_type": "photo",
+                "sha256_hash":   calculateSHA256([]byte("hose cabinet")),
+                "captured_at":   time.Now().Add(3 * time.Hour).UTC().Format(time.RFC3339),
+        }, map[string][]byte{"hose-cabinet.jpg": []byte("hose cabinet")})
+        r.Header.Set("Idempotency-Key", "future-capture-1")
+        r.Header.Set("X-User-ID", "inspector-95")
+        w := httptest.NewRecorder()
+        handleEvidence(w, r)
+        if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "captured_at is in the future") {
+                t.Errorf("status = %d %q, want 400", w.Code, w.Body.String())
+        }
+}
+
+func TestCapturedAtStoredApartFromCreatedAt(t *testing.T) {
+        pool := testDB(t)
+        useTestEvidenceStore(t)
+        userID := insertTestUser(t, pool, "offline-capture")
+        sessionID := insertTestSession(t, pool, nil, nil)
+        content := []byte("emergency lighting duration test: 92 minutes")
+        capturedAt := time.Now().Add(-26 * time.Hour).Truncate(time.Second)
+
+        r := evidenceUploadRequest(t, map[string]string{
+                "session_id":    sessionID,
+                "evidence_type": "document",
+                "sha256_hash":   calculateSHA256(content),
+                "captured_at":   capturedAt.In(time.FixedZone("", -5*3600)).Format(time.RFC3339),
+        }, map[string][]byte{"lighting.txt": content})
+        r.Header.Set("Idempotency-Key", "offline-capture-"+sessionID)
+        r.Header.Set("X-User-ID", userID)
+        w := httptest.NewRecorder()
+        handleEvidence(w, r)
+        if w.Code != http.StatusCreated {
+                t.Fatalf("upload = %d %s", w.Code, w.Body.String())
+        }
+        var response EvidenceResponse
+        json.Unmarshal(w.Body.Bytes(), &response)
+
+        w = getEvidenceMetadata(t, response.EvidenceID)
+        var record EvidenceRecord
+        json.Unmarshal(w.Body.Bytes(), &record)
+        if record.CapturedAt == nil || !record.CapturedAt.Equal(capturedAt) {
+                t.Errorf("captured_at = %v, want %v", record.CapturedAt, capturedAt)
+        }
+        if time.Since(record.CreatedAt) > time.Minute {
+                t.Errorf("created_at = %v, want the upload time", record.CreatedAt)
+        }
+}
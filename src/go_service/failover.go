@@ -0,0 +1,103 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "io"
+        "log"
+        "net"
+        "strings"
+        "time"
+
+        "github.com/jackc/pgx/v5"
+        "github.com/jackc/pgx/v5/pgconn"
+        "github.com/prometheus/client_golang/prometheus"
+)
+
+// Transactions retried after a failover-class error, by operation
+var dbFailoverRetries = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+                Name: "db_failover_retries_total",
+                Help: "Database transactions retried after a failover-class error.",
+        },
+        []string{"operation"},
+)
+
+func init() {
+        prometheus.MustRegister(dbFailoverRetries)
+}
+
+// Wraps a failed COMMIT. Its outcome is unknown once the statement has reached
+// the server, so it is only retried when the driver reports it was never sent.
+type commitError struct {
+        err error
+}
+
+func (e *commitError) Error() string {
+        return "commit failed: " + e.err.Error()
+}
+
+func (e *commitError) Unwrap() error {
+        return e.err
+}
+
+// Commit tx, marking a failure as a commit failure for isFailoverError
+func commitTx(ctx context.Context, tx pgx.Tx) error {
+        if err := tx.Commit(ctx); err != nil {
+                return &commitError{err: err}
+        }
+        return nil
+}
+
+// Report whether err means the transaction was aborted by a failover (server
+// shutdown, terminated or refused connection, demoted primary) before it could
+// commit, so replaying the whole transaction cannot apply anything twice.
+// Cancellations and deadlines are never failovers, even when they surface as
+// network timeouts: the caller has given up and must not be replayed.
+func isFailoverError(err error) bool {
+        if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+                return false
+        }
+
+        var ce *commitError
+        if errors.As(err, &ce) {
+                return pgconn.SafeToRetry(ce.err)
+        }
+
+        var pgErr *pgconn.PgError
+        if errors.As(err, &pgErr) {
+                switch pgErr.Code {
+                case "57P01", "57P02", "57P03", // admin_shutdown, crash_shutdown, cannot_connect_now
+                        "25006": // read_only_sql_transaction: the primary was demoted
+                        return true
+                }
+                return strings.HasPrefix(pgErr.Code, "08") // connection_exception class
+        }
+
+        var connectErr *pgconn.ConnectError
+        var netErr net.Error
+        return pgconn.SafeToRetry(err) || errors.As(err, &connectErr) || errors.As(err, &netErr) ||
+                errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed)
+}
+
+// Run a transaction, replaying it from the start after failover-class errors up
+// to DB_FAILOVER_MAX_RETRIES times. The pool discards broken connections, so a
+// replay acquires a fresh connection to the new primary. fn must do all of its
+// writes inside the transaction it begins and commit it with commitTx; side
+// effects outside the transaction belong after withFailoverRetry returns.
+func withFailoverRetry(ctx context.Context, operation string, fn func() error) error {
+        for attempt := int64(0); ; attempt++ {
+                err := fn()
+                if err == nil || attempt >= cfg.DBFailoverMaxRetries || !isFailoverError(err) {
+                        return err
+                }
+                dbFailoverRetries.WithLabelValues(operation).Inc()
+                backoff := cfg.DBFailoverRetryBackoff * time.Duration(1<<min(attempt, 6))
+                log.Printf("Retrying %s after failover-class error (attempt %d, in %s): %v", operation, attempt+1, backoff, err)
+                select {
+                case <-time.After(backoff):
+                case <-ctx.Done():
+                        return err
+                }
+        }
+}
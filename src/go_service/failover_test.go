@@ -0,0 +1,152 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "fmt"
+        "io"
+        "net/http"
+        "testing"
+        "time"
+
+        "github.com/jackc/pgx/v5/pgconn"
+)
+
+// net.Error reporting a timeout, as a read past a context deadline does
+type timeoutError struct{ cause error }
+
+func (e timeoutError) Error() string   { return "i/o timeout" }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+func (e timeoutError) Unwrap() error   { return e.cause }
+
+func TestIsFailoverError(t *testing.T) {
+        tests := []struct {
+                name string
+                err  error
+                want bool
+        }{
+                {"admin shutdown", &pgconn.PgError{Code: "57P01"}, true},
+                {"connection failure", fmt.Errorf("merge: %w", &pgconn.PgError{Code: "08006"}), true},
+                {"demoted primary", &pgconn.PgError{Code: "25006"}, true},
+                {"unique violation", &pgconn.PgError{Code: "23505"}, false},
+                {"connection dropped", io.ErrUnexpectedEOF, true},
+                {"network timeout", timeoutError{}, true},
+                {"merge rejected", &MergeError{StatusCode: http.StatusConflict, Message: "stale"}, false},
+                {"cancelled", fmt.Errorf("query: %w", context.Canceled), false},
+                {"deadline as network timeout", timeoutError{cause: context.DeadlineExceeded}, false},
+                {"commit reached the server", &commitError{err: io.ErrUnexpectedEOF}, false},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        if got := isFailoverError(tt.err); got != tt.want {
+                                t.Errorf("isFailoverError(%v) = %v, want %v", tt.err, got, tt.want)
+                        }
+                })
+        }
+}
+
+func TestWithFailoverRetryLimits(t *testing.T) {
+        withConfig(t, func(c *Config) {
+                c.DBFailoverMaxRetries = 2
+                c.DBFailoverRetryBackoff = time.Millisecond
+        })
+        shutdown := &pgconn.PgError{Code: "57P01"}
+
+        tests := []struct {
+                name         string
+                failures     int
+                failWith     error
+                wantAttempts int
+                wantErr      bool
+        }{
+                {"recovers on replay", 2, shutdown, 3, false},
+                {"gives up after the limit", 5, shutdown, 3, true},
+                {"other errors are not replayed", 5, errors.New("syntax error"), 1, true},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        before := counterValue(t, dbFailoverRetries.WithLabelValues("test_"+t.Name()))
+                        attempts := 0
+                        err := withFailoverRetry(context.Background(), "test_"+t.Name(), func() error {
+                                attempts++
+                                if attempts <= tt.failures {
+                                        return tt.failWith
+                                }
+                                return nil
+                        })
+                        if attempts != tt.wantAttempts || (err != nil) != tt.wantErr {
+                                t.Errorf("attempts = %d, err = %v; want %d attempts, error %v", attempts, err, tt.wantAttempts, tt.wantErr)
+                        }
+                        if retries := counterValue(t, dbFailoverRetries.WithLabelValues("test_"+t.Name())) - before; retries != float64(tt.wantAttempts-1) {
+                                t.Errorf("retries counted = %v, want %d", retries, tt.wantAttempts-1)
+                        }
+                })
+        }
+
+        t.Run("cancelled during backoff", func(t *testing.T) {
+                withConfig(t, func(c *Config) { c.DBFailoverRetryBackoff = time.Hour })
+                ctx, cancel := context.WithCancel(context.Background())
+                attempts := 0
+                go func() {
+                        time.Sleep(20 * time.Millisecond)
+                        cancel()
+                }()
+                err := withFailoverRetry(ctx, "test_cancelled", func() error {
+                        attempts++
+                        return shutdown
+                })
+                if attempts != 1 || err != shutdown {
+                        t.Errorf("attempts = %d, err = %v; want one attempt returning its error", attempts, err)
+                }
+        })
+}
+
+func TestFailoverReplaysDroppedTransactionOnce(t *testing.T) {
+        pool := testDB(t)
+        withConfig(t, func(c *Config) {
+                c.DBFailoverMaxRetries = 3
+                c.DBFailoverRetryBackoff = 10 * time.Millisecond
+        })
+        sessionID := insertTestSession(t, pool, map[string]interface{}{"inspections": 0}, nil)
+        ctx := context.Background()
+
+        attempts := 0
+        err := withFailoverRetry(ctx, "test_drop", func() error {
+                attempts++
+                tx, err := pool.Begin(ctx)
+                if err != nil {
+                        return err
+                }
+                defer tx.Rollback(ctx)
+
+                if _, err := tx.Exec(ctx, `
+                        UPDATE test_sessions
+                        SET session_data = jsonb_set(session_data, '{inspections}', to_jsonb((session_data->>'inspections')::int + 1))
+                        WHERE id = $1
+                `, sessionID); err != nil {
+                        return err
+                }
+                // The first attempt loses its connection mid-transaction, as in a failover
+                if attempts == 1 {
+                        if _, err := tx.Exec(ctx, "SELECT pg_terminate_backend(pg_backend_pid())"); err != nil {
+                                return err
+                        }
+                }
+                return commitTx(ctx, tx)
+        })
+        if err != nil {
+                t.Fatal(err)
+        }
+        if attempts != 2 {
+                t.Errorf("attempts = %d, want 2", attempts)
+        }
+
+        state, err := loadSessionState(ctx, sessionID)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if got := state.SessionData["inspections"]; got != float64(1) {
+                t.Errorf("inspections = %v, want the aborted write applied exactly once", got)
+        }
+}
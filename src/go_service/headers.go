@@ -0,0 +1,17 @@
+package main
+
+import (
+        "net/http"
+)
+
+// Reject requests carrying more than MAX_REQUEST_HEADERS distinct header fields
+// with 431. Total header size is bounded separately by http.Server.MaxHeaderBytes.
+func headerLimitHandler(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                if cfg.MaxRequestHeaders > 0 && int64(len(r.Header)) > cfg.MaxRequestHeaders {
+                        http.Error(w, "Too many request header fields", http.StatusRequestHeaderFieldsTooLarge)
+                        return
+                }
+                next.ServeHTTP(w, r)
+        })
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+        "fmt"
+        "net/http"
+        "net/http/httptest"
+        "strings"
+        "testing"
+)
+
+func TestHeaderLimitRejectsTooManyFields(t *testing.T) {
+        withConfig(t, func(c *Config) { c.MaxRequestHeaders = 8 })
+        handler := headerLimitHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+        tests := []struct {
+                fields int
+                want   int
+        }{
+                {8, http.StatusOK},
+                {9, http.StatusRequestHeaderFieldsTooLarge},
+                {500, http.StatusRequestHeaderFieldsTooLarge},
+        }
+        for _, tt := range tests {
+                r := httptest.NewRequest(http.MethodGet, "/v1/tests/sessions/s-9", nil)
+                for i := 0; i < tt.fields; i++ {
+                        r.Header.Set(fmt.Sprintf("X-Probe-%d", i), "1")
+                }
+                // Repeated values of one field count once
+                r.Header.Add("X-Probe-0", "2")
+                w := httptest.NewRecorder()
+                handler.ServeHTTP(w, r)
+                if w.Code != tt.want {
+                        t.Errorf("%d fields: status %d, want %d", tt.fields, w.Code, tt.want)
+                }
+        }
+
+        withConfig(t, func(c *Config) { c.MaxRequestHeaders = 0 })
+        r := httptest.NewRequest(http.MethodGet, "/", nil)
+        for i := 0; i < 200; i++ {
+                r.Header.Set(fmt.Sprintf("X-Unchecked-%d", i), "1")
+        }
+        w := httptest.NewRecorder()
+        handler.ServeHTTP(w, r)
+        if w.Code != http.StatusOK {
+                t.Errorf("disabled limit: status %d, want 200", w.Code)
+        }
+}
+
+func TestOversizedHeadersRejectedWith431(t *testing.T) {
+        withConfig(t, func(c *Config) {
+                c.MaxHeaderBytes = 4 << 10
+                c.MaxRequestHeaders = 0
+        })
+        server := httptest.NewUnstartedServer(headerLimitHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+        server.Config.MaxHeaderBytes = int(cfg.MaxHeaderBytes)
+        server.Start()
+        defer server.Close()
+
+        tests := []struct {
+                name string
+                size int
+                want int
+        }{
+                {"small cookie", 512, http.StatusOK},
+                {"oversized cookie", 64 << 10, http.StatusRequestHeaderFieldsTooLarge},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        req, _ := http.NewRequest(http.MethodGet, server.URL+"/v1/evidence/e-1", nil)
+                        req.Header.Set("Cookie", "session="+strings.Repeat("z", tt.size))
+                        resp, err := server.Client().Do(req)
+                        if err != nil {
+                                t.Fatal(err)
+                        }
+                        resp.Body.Close()
+                        if resp.StatusCode != tt.want {
+                                t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+                        }
+                })
+        }
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "encoding/json"
+        "errors"
+        "io"
+        "log"
+        "mime/multipart"
+        "net/http"
+        "net/http/httptest"
+        "os"
+        "sync/atomic"
+        "testing"
+        "time"
+
+        "github.com/gorilla/mux"
+        "github.com/jackc/pgx/v5/pgxpool"
+        "github.com/prometheus/client_golang/prometheus"
+        dto "github.com/prometheus/client_model/go"
+)
+
+// Override configuration for the duration of a test
+func withConfig(t *testing.T, mutate func(c *Config)) {
+        t.Helper()
+        saved := cfg
+        t.Cleanup(func() { cfg = saved })
+        mutate(&cfg)
+}
+
+// Connect dbPool to the throwaway database named by TEST_DATABASE_URL with
+// schema.sql applied, skipping the test when it is unset
+func testDB(t testing.TB) *pgxpool.Pool {
+        t.Helper()
+        url := os.Getenv("TEST_DATABASE_URL")
+        if url == "" {
+                t.Skip("TEST_DATABASE_URL not set")
+        }
+
+        ctx := context.Background()
+        pool, err := pgxpool.New(ctx, url)
+        if err != nil {
+                t.Fatalf("failed to connect to test database: %v", err)
+        }
+        schema, err := os.ReadFile("../app/database/schema.sql")
+        if err != nil {
+                t.Fatalf("failed to read schema: %v", err)
+        }
+        if _, err := pool.Exec(ctx, string(schema)); err != nil {
+                t.Fatalf("failed to apply schema: %v", err)
+        }
+
+        saved := dbPool
+        dbPool = pool
+        t.Cleanup(func() {
+                dbPool = saved
+                pool.Close()
+        })
+        return pool
+}
+
+// Insert a session (and the building it belongs to) with the given data and
+// vector clock, returning its ID
+func insertTestSession(t *testing.T, pool *pgxpool.Pool, data map[string]interface{}, clock map[string]int64) string {
+        t.Helper()
+        ctx := context.Background()
+        if data == nil {
+                data = map[string]interface{}{}
+        }
+        if clock == nil {
+                clock = map[string]int64{}
+        }
+        dataJSON, _ := json.Marshal(data)
+        clockJSON, _ := json.Marshal(clock)
+
+        var sessionID string
+        err := pool.QueryRow(ctx, `
+                WITH building AS (
+                        INSERT INTO buildings (name, address, building_type)
+                        VALUES ('Test building', '1 Test St', 'commercial')
+                        RETURNING id
+                )
+                INSERT INTO test_sessions (building_id, session_name, session_data, vector_clock)
+                SELECT id, 'test session', $1, $2 FROM building
+                RETURNING id::text
+        `, string(dataJSON), string(clockJSON)).Scan(&sessionID)
+        if err != nil {
+                t.Fatalf("failed to insert test session: %v", err)
+        }
+        return sessionID
+}
+
+// POST body to handleCRDTResults for sessionID and return the recorded response
+func postCRDTResults(t *testing.T, sessionID string, body []byte, header http.Header) *httptest.ResponseRecorder {
+        t.Helper()
+        r := httptest.NewRequest(http.MethodPost, "/v1/tests/sessions/"+sessionID+"/results", bytes.NewReader(body))
+        for name, values := range header {
+                r.Header[name] = values
+        }
+        r = mux.SetURLVars(r, map[string]string{"session_id": sessionID})
+        w := httptest.NewRecorder()
+        handleCRDTResults(w, r)
+        return w
+}
+
+// Merge payload into sessionID as userID in its own transaction, committing on success
+func mergeTestPayload(t *testing.T, pool *pgxpool.Pool, sessionID, userID string, payload *CRDTPayload) (*CRDTResponse, error) {
+        t.Helper()
+        ctx := context.Background()
+        changes, err := parseChanges(payload.Changes, time.Now().UTC())
+        if err != nil {
+                t.Fatalf("invalid test changes: %v", err)
+        }
+        tx, err := pool.Begin(ctx)
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer tx.Rollback(ctx)
+        response, err := mergeCRDTPayload(ctx, tx, sessionID, userID, payload, changes)
+        if err != nil {
+                return nil, err
+        }
+        return response, tx.Commit(ctx)
+}
+
+// Point evidenceStore at a fresh file store for the duration of a test
+func useTestEvidenceStore(t *testing.T) *FileEvidenceStore {
+        t.Helper()
+        store, err := NewFileEvidenceStore(t.TempDir())
+        if err != nil {
+                t.Fatal(err)
+        }
+        saved := evidenceStore
+        evidenceStore = store
+        t.Cleanup(func() { evidenceStore = saved })
+        return store
+}
+
+// Insert an evidence row for sessionID and store content under its object key
+func insertTestEvidence(t *testing.T, pool *pgxpool.Pool, sessionID string, content []byte, metadata map[string]interface{}) string {
+        t.Helper()
+        ctx := context.Background()
+        if metadata == nil {
+                metadata = map[string]interface{}{}
+        }
+        metadata["file_size"] = len(content)
+        metadataJSON, _ := json.Marshal(metadata)
+
+        var evidenceID string
+        err := pool.QueryRow(ctx, `
+                INSERT INTO evidence (session_id, evidence_type, file_path, metadata, checksum)
+                VALUES ($1, 'photo', 'evidence/test', $2, $3)
+                RETURNING id::text
+        `, sessionID, string(metadataJSON), calculateSHA256(content)).Scan(&evidenceID)
+        if err != nil {
+                t.Fatalf("failed to insert test evidence: %v", err)
+        }
+        if _, err := evidenceStore.Put(ctx, evidenceObjectKey(ctx, evidenceID), bytes.NewReader(content)); err != nil {
+                t.Fatalf("failed to store test evidence: %v", err)
+        }
+        return evidenceID
+}
+
+// Capture the standard logger's output for the duration of a test
+func captureLog(t *testing.T) *bytes.Buffer {
+        t.Helper()
+        var buf bytes.Buffer
+        saved, flags := log.Writer(), log.Flags()
+        log.SetOutput(&buf)
+        log.SetFlags(0)
+        t.Cleanup(func() {
+                log.SetOutput(saved)
+                log.SetFlags(flags)
+        })
+        return &buf
+}
+
+// Build a multipart evidence upload with one file part per entry in files
+// (filename to content) plus the given form fields
+func evidenceUploadRequest(t *testing.T, fields map[string]string, files map[string][]byte) *http.Request {
+        t.Helper()
+        var body bytes.Buffer
+        form := multipart.NewWriter(&body)
+        for name, value := range fields {
+                if err := form.WriteField(name, value); err != nil {
+                        t.Fatal(err)
+                }
+        }
+        for filename, content := range files {
+                part, err := form.CreateFormFile("file", filename)
+                if err != nil {
+                        t.Fatal(err)
+                }
+                part.Write(content)
+        }
+        if err := form.Close(); err != nil {
+                t.Fatal(err)
+        }
+
+        r := httptest.NewRequest(http.MethodPost, "/v1/evidence", &body)
+        r.Header.Set("Content-Type", form.FormDataContentType())
+        r.Header.Set("Idempotency-Key", "upload-"+t.Name())
+        r.Header.Set("X-User-ID", "inspector-"+t.Name())
+        return r
+}
+
+// Insert a user, returning its ID for use as X-User-ID
+func insertTestUser(t *testing.T, pool *pgxpool.Pool, username string) string {
+        t.Helper()
+        var userID string
+        err := pool.QueryRow(context.Background(), `
+                INSERT INTO users (username, email, full_name_encrypted, password_hash)
+                VALUES ($1, $1 || '@example.test', '\x00', 'x')
+                RETURNING id::text
+        `, username+"-"+time.Now().Format("150405.000000000")).Scan(&userID)
+        if err != nil {
+                t.Fatalf("failed to insert test user: %v", err)
+        }
+        return userID
+}
+
+// Returned by outageStore while it is down
+var errTestStoreDown = errors.New("evidence store down")
+
+// Evidence store that fails every call while down. A failing Put first consumes
+// up to partial bytes, like a backend that drops the connection mid-upload.
+type outageStore struct {
+        EvidenceStore
+        down    atomic.Bool
+        partial int64
+        puts    atomic.Int64
+}
+
+func newOutageStore(t *testing.T) *outageStore {
+        t.Helper()
+        inner, err := NewFileEvidenceStore(t.TempDir())
+        if err != nil {
+                t.Fatal(err)
+        }
+        return &outageStore{EvidenceStore: inner}
+}
+
+func (s *outageStore) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+        s.puts.Add(1)
+        if s.down.Load() {
+                n, _ := io.CopyN(io.Discard, r, s.partial)
+                return n, errTestStoreDown
+        }
+        return s.EvidenceStore.Put(ctx, key, r)
+}
+
+func (s *outageStore) Get(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+        if s.down.Load() {
+                return nil, errTestStoreDown
+        }
+        return s.EvidenceStore.Get(ctx, key)
+}
+
+func (s *outageStore) Size(ctx context.Context, key string) (int64, error) {
+        if s.down.Load() {
+                return 0, errTestStoreDown
+        }
+        return s.EvidenceStore.Size(ctx, key)
+}
+
+// Current value of a Prometheus counter
+func counterValue(t *testing.T, counter prometheus.Counter) float64 {
+        t.Helper()
+        var m dto.Metric
+        if err := counter.Write(&m); err != nil {
+                t.Fatal(err)
+        }
+        return m.GetCounter().GetValue()
+}
+
+// Number of db_query_duration_seconds samples recorded for a query name
+func queryCount(t *testing.T, name string) uint64 {
+        t.Helper()
+        var m dto.Metric
+        if err := dbQueryDuration.WithLabelValues(name).(prometheus.Histogram).Write(&m); err != nil {
+                t.Fatal(err)
+        }
+        return m.GetHistogram().GetSampleCount()
+}
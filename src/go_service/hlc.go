@@ -0,0 +1,32 @@
+package main
+
+import "time"
+
+// Hybrid logical clock values packed into one comparable int64: milliseconds of
+// physical time in the high bits and a logical counter in the low 16. Values
+// track wall time while it moves forward, and keep increasing through clock
+// skew or bursts within a millisecond, so they order every write to a session
+// even where timestamps tie. A logical counter overflow carries into the
+// physical part, which stays ordered.
+const hlcLogicalBits = 16
+
+// Pack physical time and a logical counter into an HLC value
+func hlcPack(physical time.Time, logical int64) int64 {
+        return physical.UnixMilli()<<hlcLogicalBits | logical
+}
+
+// Advance an HLC for a local event: the current physical time if it is ahead
+// of the last value, otherwise the next logical tick after it
+func hlcNext(last int64, now time.Time) int64 {
+        return max(hlcPack(now, 0), last+1)
+}
+
+// Stamp changes with successive HLC values after last, in the order they are
+// applied, and return the session's new HLC
+func stampChanges(changes []Change, last int64, now time.Time) int64 {
+        for i := range changes {
+                last = hlcNext(last, now)
+                changes[i].HLC = last
+        }
+        return last
+}
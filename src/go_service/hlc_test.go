@@ -0,0 +1,99 @@
+package main
+
+import (
+        "context"
+        "fmt"
+        "testing"
+        "time"
+)
+
+func TestHLCNext(t *testing.T) {
+        now := time.Date(2026, 3, 14, 9, 30, 0, 0, time.UTC)
+        tests := []struct {
+                name string
+                last int64
+                now  time.Time
+                want int64
+        }{
+                {"fresh session takes wall time", 0, now, hlcPack(now, 0)},
+                {"wall time ahead", hlcPack(now.Add(-time.Second), 7), now, hlcPack(now, 0)},
+                {"same millisecond ticks logically", hlcPack(now, 3), now, hlcPack(now, 4)},
+                {"wall clock behind keeps increasing", hlcPack(now.Add(time.Minute), 0), now, hlcPack(now.Add(time.Minute), 1)},
+                {"logical overflow carries", hlcPack(now, 1<<hlcLogicalBits-1), now, hlcPack(now.Add(time.Millisecond), 0)},
+        }
+        for _, tt := range tests {
+                if got := hlcNext(tt.last, tt.now); got != tt.want {
+                        t.Errorf("%s: hlcNext = %d, want %d", tt.name, got, tt.want)
+                }
+        }
+}
+
+func TestStampChangesMonotonic(t *testing.T) {
+        now := time.Now()
+        changes := make([]Change, 500)
+        last := stampChanges(changes, hlcPack(now.Add(time.Hour), 0), now) // a session stamped by a fast clock
+        for i := 1; i < len(changes); i++ {
+                if changes[i].HLC <= changes[i-1].HLC {
+                        t.Fatalf("change %d HLC %d not after %d", i, changes[i].HLC, changes[i-1].HLC)
+                }
+        }
+        if last != changes[len(changes)-1].HLC {
+                t.Errorf("returned HLC %d, want the last stamp %d", last, changes[len(changes)-1].HLC)
+        }
+}
+
+func TestLWWTieBreak(t *testing.T) {
+        ts := time.Date(2026, 3, 14, 9, 30, 0, 0, time.UTC)
+        tests := []struct {
+                name    string
+                change  Change
+                current FieldMeta
+                want    bool
+        }{
+                {"later timestamp", Change{Timestamp: ts.Add(time.Second), NodeID: "a"}, FieldMeta{Timestamp: ts, NodeID: "z"}, true},
+                {"earlier timestamp despite HLC", Change{Timestamp: ts, HLC: 900}, FieldMeta{Timestamp: ts.Add(time.Second), HLC: 1}, false},
+                {"higher node ID", Change{Timestamp: ts, NodeID: "tablet-b", HLC: 1}, FieldMeta{Timestamp: ts, NodeID: "tablet-a", HLC: 9}, true},
+                {"lower node ID ignores HLC", Change{Timestamp: ts, NodeID: "tablet-a", HLC: 9}, FieldMeta{Timestamp: ts, NodeID: "tablet-b", HLC: 1}, false},
+                {"change ID before HLC", Change{Timestamp: ts, NodeID: "n", ChangeID: "c-2", HLC: 1}, FieldMeta{Timestamp: ts, NodeID: "n", ChangeID: "c-1", HLC: 9}, true},
+                {"HLC decides full ties", Change{Timestamp: ts, HLC: 5}, FieldMeta{Timestamp: ts, HLC: 8}, false},
+                {"later HLC wins full ties", Change{Timestamp: ts, HLC: 8}, FieldMeta{Timestamp: ts, HLC: 5}, true},
+                {"unstamped tie applies", Change{Timestamp: ts}, FieldMeta{Timestamp: ts, HLC: 8}, true},
+        }
+        for _, tt := range tests {
+                if got := lwwWins(tt.change, tt.current); got != tt.want {
+                        t.Errorf("%s: lwwWins = %v, want %v", tt.name, got, tt.want)
+                }
+        }
+}
+
+func TestSessionHLCAcrossRapidWrites(t *testing.T) {
+        pool := testDB(t)
+        sessionID := insertTestSession(t, pool, nil, nil)
+
+        var last int64
+        for i := 0; i < 25; i++ {
+                response, err := mergeTestPayload(t, pool, sessionID, "inspector-90", &CRDTPayload{
+                        Changes: []map[string]interface{}{
+                                {"op": "set", "path": fmt.Sprintf("/extinguisher_%02d", i), "value": "tagged"},
+                                {"op": "set", "path": "/last_checked", "value": i},
+                        },
+                })
+                if err != nil {
+                        t.Fatal(err)
+                }
+                if response.HLC <= last {
+                        t.Fatalf("write %d: HLC %d not after %d", i, response.HLC, last)
+                }
+                last = response.HLC
+        }
+
+        var stored int64
+        pool.QueryRow(context.Background(), "SELECT hlc FROM test_sessions WHERE id = $1", sessionID).Scan(&stored)
+        state, err := loadSessionState(context.Background(), sessionID)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if stored != last || state.fields["/last_checked"].HLC != last {
+                t.Errorf("stored HLC %d, last_checked stamped %d; want both %d", stored, state.fields["/last_checked"].HLC, last)
+        }
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "fmt"
+        "net/http"
+        "reflect"
+        "strings"
+
+        "github.com/jackc/pgx/v5"
+)
+
+// A CRDT merge about to be written: the session state before and after applying
+// the changes
+type MergeProposal struct {
+        SessionID   string
+        Changes     []Change
+        Current     map[string]interface{}
+        Proposed    map[string]interface{}
+        VectorClock map[string]int64
+}
+
+// Validates a merge inside its transaction, before the session UPDATE. Returning
+// a *MergeError vetoes the merge with that status and message; any other error
+// fails it with 500. Either way the transaction is rolled back.
+type PreCommitHook interface {
+        Validate(ctx context.Context, tx pgx.Tx, proposal *MergeProposal) error
+}
+
+// Hooks run on every merge, configured at startup; none by default
+var preCommitHooks []PreCommitHook
+
+// Rejects changes to fields that already hold a value, such as results that are
+// final once recorded. Paths are JSON pointers.
+type FinalizedFieldsHook struct {
+        Paths []string
+}
+
+func (h *FinalizedFieldsHook) Validate(ctx context.Context, tx pgx.Tx, proposal *MergeProposal) error {
+        for _, path := range h.Paths {
+                tokens := splitPointer(path)
+                before, set := lookupPath(proposal.Current, tokens)
+                if !set || before == nil {
+                        continue
+                }
+                after, _ := lookupPath(proposal.Proposed, tokens)
+                if !reflect.DeepEqual(before, after) {
+                        return &MergeError{
+                                StatusCode: http.StatusConflict,
+                                Message:    fmt.Sprintf("Field %s is finalized and cannot be changed", path),
+                        }
+                }
+        }
+        return nil
+}
+
+// Read the value at a tokenized JSON pointer, reporting whether it exists
+func lookupPath(data map[string]interface{}, tokens []string) (interface{}, bool) {
+        var current interface{} = data
+        for _, t := range tokens {
+                object, ok := current.(map[string]interface{})
+                if !ok {
+                        return nil, false
+                }
+                if current, ok = object[t]; !ok {
+                        return nil, false
+                }
+        }
+        return current, true
+}
+
+// Run the configured hooks against a proposed merge, stopping at the first veto
+func runPreCommitHooks(ctx context.Context, tx pgx.Tx, proposal *MergeProposal) error {
+        for _, hook := range preCommitHooks {
+                if err := hook.Validate(ctx, tx, proposal); err != nil {
+                        return err
+                }
+        }
+        return nil
+}
+
+// Deep copy of session data for hooks, which compare it against the merged result
+func copySessionData(data map[string]interface{}) map[string]interface{} {
+        raw, _ := json.Marshal(data)
+        var copied map[string]interface{}
+        json.Unmarshal(raw, &copied)
+        if copied == nil {
+                copied = make(map[string]interface{})
+        }
+        return copied
+}
+
+// Configure pre-commit hooks from the environment
+func newPreCommitHooksFromConfig() []PreCommitHook {
+        var hooks []PreCommitHook
+        var paths []string
+        for _, path := range strings.Split(cfg.CRDTFinalizedFields, ",") {
+                if path = strings.TrimSpace(path); path != "" {
+                        if !strings.HasPrefix(path, "/") {
+                                path = "/" + path
+                        }
+                        paths = append(paths, path)
+                }
+        }
+        if len(paths) > 0 {
+                hooks = append(hooks, &FinalizedFieldsHook{Paths: paths})
+        }
+        return hooks
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "net/http"
+        "reflect"
+        "testing"
+
+        "github.com/jackc/pgx/v5"
+)
+
+func TestFinalizedFieldsHook(t *testing.T) {
+        hook := &FinalizedFieldsHook{Paths: []string{"/result", "/signoff/inspector"}}
+        current := map[string]interface{}{
+                "result":  "pass",
+                "notes":   "door closer adjusted",
+                "signoff": map[string]interface{}{"inspector": "J. Okafor"},
+        }
+
+        tests := []struct {
+                name     string
+                current  map[string]interface{}
+                proposed map[string]interface{}
+                veto     bool
+        }{
+                {"unrelated change", current, map[string]interface{}{"result": "pass", "notes": "rechecked",
+                        "signoff": map[string]interface{}{"inspector": "J. Okafor"}}, false},
+                {"finalized field changed", current, map[string]interface{}{"result": "fail", "notes": "door closer adjusted",
+                        "signoff": map[string]interface{}{"inspector": "J. Okafor"}}, true},
+                {"nested finalized field removed", current, map[string]interface{}{"result": "pass",
+                        "signoff": map[string]interface{}{}}, true},
+                {"first write to an unset field", map[string]interface{}{"notes": "pending"},
+                        map[string]interface{}{"notes": "pending", "result": "pass"}, false},
+                {"null counts as unset", map[string]interface{}{"result": nil},
+                        map[string]interface{}{"result": "fail"}, false},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        err := hook.Validate(context.Background(), nil, &MergeProposal{Current: tt.current, Proposed: tt.proposed})
+                        var mergeErr *MergeError
+                        if tt.veto {
+                                if !errors.As(err, &mergeErr) || mergeErr.StatusCode != http.StatusConflict {
+                                        t.Errorf("err = %v, want a 409 veto", err)
+                                }
+                        } else if err != nil {
+                                t.Errorf("err = %v, want no veto", err)
+                        }
+                })
+        }
+}
+
+func TestPreCommitHooksFromConfig(t *testing.T) {
+        withConfig(t, func(c *Config) { c.CRDTFinalizedFields = "" })
+        if hooks := newPreCommitHooksFromConfig(); len(hooks) != 0 {
+                t.Errorf("default hooks = %v, want none", hooks)
+        }
+
+        withConfig(t, func(c *Config) { c.CRDTFinalizedFields = " result, /signoff/inspector ,," })
+        hooks := newPreCommitHooksFromConfig()
+        if len(hooks) != 1 {
+                t.Fatalf("hooks = %v, want one finalized-fields hook", hooks)
+        }
+        finalized, ok := hooks[0].(*FinalizedFieldsHook)
+        if !ok || !reflect.DeepEqual(finalized.Paths, []string{"/result", "/signoff/inspector"}) {
+                t.Errorf("hook = %#v", hooks[0])
+        }
+}
+
+// Vetoes any merge that would mark the building demolished, after first
+// writing to the database to show its writes roll back with the veto
+type demolitionVeto struct {
+        marker string
+}
+
+func (h *demolitionVeto) Validate(ctx context.Context, tx pgx.Tx, proposal *MergeProposal) error {
+        if _, err := tx.Exec(ctx, `INSERT INTO audit_log (action, resource_type, new_values) VALUES ('hook.probe', 'session', $1)`,
+                `{"marker":"`+h.marker+`"}`); err != nil {
+                return err
+        }
+        if proposal.Proposed["status"] == "demolished" {
+                return &MergeError{StatusCode: http.StatusForbidden, Message: "Demolition must be recorded by an administrator"}
+        }
+        return nil
+}
+
+func usePreCommitHooks(t *testing.T, hooks ...PreCommitHook) {
+        t.Helper()
+        old := preCommitHooks
+        preCommitHooks = hooks
+        t.Cleanup(func() { preCommitHooks = old })
+}
+
+func TestPreCommitHookVetoesMerge(t *testing.T) {
+        pool := testDB(t)
+        marker := "veto-" + t.Name()
+        usePreCommitHooks(t, &demolitionVeto{marker: marker})
+        sessionID := insertTestSession(t, pool, map[string]interface{}{"status": "occupied"}, nil)
+
+        _, err := mergeTestPayload(t, pool, sessionID, "inspector-veto", &CRDTPayload{
+                Changes: []map[string]interface{}{{"op": "set", "path": "/status", "value": "demolished"}},
+        })
+        var mergeErr *MergeError
+        if !errors.As(err, &mergeErr) || mergeErr.StatusCode != http.StatusForbidden {
+                t.Fatalf("err = %v, want the hook's 403", err)
+        }
+
+        state, err := loadSessionState(context.Background(), sessionID)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if state.SessionData["status"] != "occupied" {
+                t.Errorf("vetoed change was applied: %v", state.SessionData)
+        }
+        var probes int
+        pool.QueryRow(context.Background(), `SELECT count(*) FROM audit_log WHERE new_values->>'marker' = $1`, marker).Scan(&probes)
+        if probes != 0 {
+                t.Errorf("hook's write survived the veto (%d rows)", probes)
+        }
+
+        // Allowed changes commit together with the hook's writes
+        if _, err := mergeTestPayload(t, pool, sessionID, "inspector-veto", &CRDTPayload{
+                Changes: []map[string]interface{}{{"op": "set", "path": "/status", "value": "vacant"}},
+        }); err != nil {
+                t.Fatal(err)
+        }
+        pool.QueryRow(context.Background(), `SELECT count(*) FROM audit_log WHERE new_values->>'marker' = $1`, marker).Scan(&probes)
+        if probes != 1 {
+                t.Errorf("hook wrote %d rows for the allowed merge, want 1", probes)
+        }
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "io"
+        "log"
+        "net/http"
+        "strings"
+        "time"
+
+        "github.com/google/uuid"
+        "github.com/gorilla/mux"
+        "github.com/jackc/pgx/v5"
+)
+
+// Formats accepted for client idempotency keys
+const (
+        idempotencyKeyFormatAny  = "any"
+        idempotencyKeyFormatUUID = "uuid"
+        idempotencyKeyFormatULID = "ulid"
+)
+
+// Crockford base32 alphabet used by ULIDs
+const ulidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// Report whether key is a canonical 26-character ULID. The first character is
+// limited to 0-7 because a ULID is 128 bits in 130 bits of base32.
+func isULID(key string) bool {
+        if len(key) != 26 || key[0] > '7' {
+                return false
+        }
+        for _, c := range strings.ToUpper(key) {
+                if !strings.ContainsRune(ulidAlphabet, c) {
+                        return false
+                }
+        }
+        return true
+}
+
+// Enforce IDEMPOTENCY_KEY_MIN_LENGTH/MAX_LENGTH (in bytes) and
+// IDEMPOTENCY_KEY_FORMAT before a key is hashed
+func validateIdempotencyKey(key string) error {
+        if int64(len(key)) < cfg.IdempotencyKeyMinLength {
+                return fmt.Errorf("idempotency key must be at least %d bytes", cfg.IdempotencyKeyMinLength)
+        }
+        if cfg.IdempotencyKeyMaxLength > 0 && int64(len(key)) > cfg.IdempotencyKeyMaxLength {
+                return fmt.Errorf("idempotency key must be at most %d bytes", cfg.IdempotencyKeyMaxLength)
+        }
+        switch cfg.IdempotencyKeyFormat {
+        case idempotencyKeyFormatUUID:
+                // Only the canonical hyphenated form, not the braced or URN variants uuid.Parse allows
+                if _, err := uuid.Parse(key); err != nil || len(key) != 36 {
+                        return fmt.Errorf("idempotency key must be a UUID")
+                }
+        case idempotencyKeyFormatULID:
+                if !isULID(key) {
+                        return fmt.Errorf("idempotency key must be a ULID")
+                }
+        }
+        return nil
+}
+
+// Derive the stored key hash for a client idempotency key. IDEMPOTENCY_NAMESPACE
+// is mixed in so services sharing a database cannot collide; without one the
+// hash is the plain key's, keeping existing records valid.
+func idempotencyKeyHash(key string) string {
+        if cfg.IdempotencyNamespace == "" {
+                return calculateSHA256([]byte(key))
+        }
+        return calculateSHA256([]byte(cfg.IdempotencyNamespace + "\x00" + key))
+}
+
+// Policies for completed keys older than IDEMPOTENCY_KEY_MAX_AGE
+const (
+        idempotencyMaxAgeReprocess = "reprocess"
+        idempotencyMaxAgeReject    = "reject"
+)
+
+// Returned by checkIdempotency for a key too old to replay under the reject policy
+var errIdempotencyKeyTooOld = errors.New("idempotency key is too old to replay; use a new key")
+
+// Returned by checkIdempotency when a key is reused for a request whose
+// fingerprint differs from the one that claimed it
+var errIdempotencyKeyReused = errors.New("idempotency key was already used for a different request")
+
+// Returned by checkIdempotency when X-User-ID is not a UUID or names no user;
+// keys are recorded against the user, so neither can claim one
+var (
+        errInvalidUserID = errors.New("X-User-ID must be a user ID (UUID)")
+        errUnknownUser   = errors.New("X-User-ID does not name a known user")
+)
+
+// Check that userID names an existing user before a key is claimed for it
+func resolveIdempotencyUser(ctx context.Context, userID string) error {
+        if _, err := uuid.Parse(userID); err != nil {
+                return errInvalidUserID
+        }
+        var exists bool
+        err := timeQuery("resolve_idempotency_user", func() error {
+                return dbFor(ctx).QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE id = $1::uuid)", userID).Scan(&exists)
+        })
+        if err != nil {
+                return fmt.Errorf("failed to resolve user: %v", err)
+        }
+        if !exists {
+                return errUnknownUser
+        }
+        return nil
+}
+
+// Status and client message for a failed idempotency check; unexpected
+// failures are logged and reported as internal errors
+func idempotencyCheckErrorStatus(err error) (int, string) {
+        switch {
+        case errors.Is(err, errIdempotencyKeyTooOld), errors.Is(err, errIdempotencyKeyReused):
+                return http.StatusUnprocessableEntity, err.Error()
+        case errors.Is(err, errInvalidUserID):
+                return http.StatusBadRequest, err.Error()
+        case errors.Is(err, errUnknownUser):
+                return http.StatusForbidden, err.Error()
+        }
+        log.Printf("Idempotency check failed: %v", err)
+        return http.StatusInternalServerError, "Internal server error"
+}
+
+// Write the response for a failed idempotency check
+func writeIdempotencyCheckError(w http.ResponseWriter, err error) {
+        statusCode, message := idempotencyCheckErrorStatus(err)
+        http.Error(w, message, statusCode)
+}
+
+// Idempotency-Status values: the request holding the key was processed, its
+// cached response was replayed, or its first attempt is still running
+const (
+        idempotencyStatusOriginal   = "original"
+        idempotencyStatusReplayed   = "replayed"
+        idempotencyStatusInProgress = "in_progress"
+)
+
+// Tell the client how its idempotency key was handled, unless
+// IDEMPOTENCY_STATUS_HEADERS is off. Replays also carry Idempotency-Replayed
+// so retry storms are visible from the client side.
+func setIdempotencyStatus(w http.ResponseWriter, status string) {
+        if !cfg.IdempotencyStatusHeaders {
+                return
+        }
+        w.Header().Set("Idempotency-Status", status)
+        if status == idempotencyStatusReplayed {
+                w.Header().Set("Idempotency-Replayed", "true")
+        }
+}
+
+// Reject a duplicate of a request that is still being processed, estimating the
+// remaining time from the claim's age against IDEMPOTENCY_EXPECTED_DURATION
+func writeIdempotencyInProgress(w http.ResponseWriter, check *IdempotencyCheck) {
+        setIdempotencyStatus(w, idempotencyStatusInProgress)
+        remaining := cfg.IdempotencyExpectedDuration - time.Since(check.CreatedAt)
+        if remaining < time.Second {
+                remaining = time.Second
+        }
+        w.Header().Set("Retry-After", retryAfterSeconds(remaining))
+        writeJSON(w, http.StatusConflict, map[string]string{
+                "error": "A request with this idempotency key is still in progress",
+        })
+}
+
+// Write a cached idempotent response
+func writeReplayedResponse(w http.ResponseWriter, statusCode int, data []byte) {
+        stats.Inc(statIdempotencyHits)
+        setIdempotencyStatus(w, idempotencyStatusReplayed)
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(statusCode)
+        w.Write(data)
+}
+
+// Replace the vector_clock of a cached CRDT response with the session's current
+// clock, so replays report present causality while the changes stay deduplicated
+func refreshReplayVectorClock(ctx context.Context, sessionID string, data []byte) ([]byte, error) {
+        var response map[string]json.RawMessage
+        if err := json.Unmarshal(data, &response); err != nil {
+                return nil, err
+        }
+
+        state, err := loadSessionState(ctx, sessionID)
+        if err != nil {
+                return nil, err
+        }
+
+        clockJSON, err := json.Marshal(state.VectorClock)
+        if err != nil {
+                return nil, err
+        }
+        response["vector_clock"] = clockJSON
+        return json.Marshal(response)
+}
+
+// Side effects enqueued at most once per parent idempotency key, via the outbox dedup key
+const (
+        subOpEvidenceWebhook = "evidence_webhook"
+)
+
+// Outbox dedup key for a side effect of the request holding an idempotency key,
+// so a retried request whose first attempt committed cannot enqueue it twice
+func subOperationKey(keyHash, operation string) string {
+        return keyHash + ":" + operation
+}
+
+// Largest error body captured for caching under an idempotency key
+const maxCachedErrorBody = 64 << 10
+
+// Captures the status and body of error responses written after an idempotency
+// key is claimed, so they can be cached per IDEMPOTENCY_CACHE_ERROR_CLASSES
+type errorRecorder struct {
+        http.ResponseWriter
+        status int
+        body   bytes.Buffer
+}
+
+func (r *errorRecorder) WriteHeader(statusCode int) {
+        if r.status == 0 {
+                r.status = statusCode
+        }
+        r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *errorRecorder) Write(b []byte) (int, error) {
+        if r.status == 0 {
+                r.status = http.StatusOK
+        }
+        if r.status >= 400 && r.body.Len()+len(b) <= maxCachedErrorBody {
+                r.body.Write(b)
+        }
+        return r.ResponseWriter.Write(b)
+}
+
+func (r *errorRecorder) Unwrap() http.ResponseWriter {
+        return r.ResponseWriter
+}
+
+// Report whether error responses with this status are cached. 5xx responses
+// (including 507 quota errors) are never cached so transient server failures
+// can always be retried, nor are 408 and 429, which ask the client to retry.
+func cacheableErrorStatus(statusCode int) bool {
+        if statusCode < 400 || statusCode >= 500 {
+                return false
+        }
+        if statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests {
+                return false
+        }
+        for _, class := range strings.Split(cfg.IdempotencyCacheErrorClasses, ",") {
+                if strings.TrimSpace(strings.ToLower(class)) == fmt.Sprintf("%dxx", statusCode/100) {
+                        return true
+                }
+        }
+        return false
+}
+
+// Settle a claimed key whose request did not cache a success response: cache the
+// recorded error when its status class is configured, otherwise release the claim.
+// A response carrying Retry-After is never cached, whatever its status. Only
+// errors written after the claim reach here: validation failures before it
+// (missing headers, malformed keys, rate limits, unparseable bodies) are never
+// cached, and a retry is validated afresh.
+func settleIdempotencyClaim(ctx context.Context, keyHash, userID, endpoint, requestHash string, rec *errorRecorder) {
+        if !cacheableErrorStatus(rec.status) || rec.Header().Get("Retry-After") != "" {
+                releaseIdempotencyKey(ctx, keyHash)
+                return
+        }
+
+        // response_data is JSONB; plain-text errors are cached (and replayed) as {"error": ...}
+        var responseData interface{} = json.RawMessage(rec.body.Bytes())
+        if !json.Valid(rec.body.Bytes()) {
+                responseData = map[string]string{"error": strings.TrimSpace(rec.body.String())}
+        }
+        if err := storeIdempotencyKey(ctx, keyHash, userID, endpoint, requestHash, responseData, rec.status); err != nil {
+                log.Printf("Failed to cache error response: %v", err)
+                releaseIdempotencyKey(ctx, keyHash)
+        }
+}
+
+// Extend the TTL of a completed idempotency key so very late retries of a long
+// client retry loop are still deduplicated. The optional body {"ttl_seconds": N}
+// sets the new expiry to now+N (default IDEMPOTENCY_EXTEND_DEFAULT_TTL), capped at
+// IDEMPOTENCY_KEY_MAX_LIFETIME after the key was first stored. Expired keys
+// cannot be revived.
+func handleExtendIdempotencyKey(w http.ResponseWriter, r *http.Request) {
+        key := mux.Vars(r)["key"]
+        if err := validateIdempotencyKey(key); err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+        userID := r.Header.Get("X-User-ID")
+        if userID == "" {
+                http.Error(w, "X-User-ID header required", http.StatusBadRequest)
+                return
+        }
+
+        ttl := cfg.IdempotencyExtendDefaultTTL
+        var body struct {
+                TTLSeconds *int64 `json:"ttl_seconds"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+                http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+                return
+        }
+        if body.TTLSeconds != nil {
+                if *body.TTLSeconds <= 0 {
+                        http.Error(w, "ttl_seconds must be positive", http.StatusBadRequest)
+                        return
+                }
+                ttl = time.Duration(*body.TTLSeconds) * time.Second
+        }
+
+        ctx := r.Context()
+        keyHash := idempotencyKeyHash(key)
+        var statusCode *int
+        var owner string
+        var createdAt, expiresAt time.Time
+        err := dbFor(ctx).QueryRow(ctx, `
+                SELECT status_code, COALESCE(user_id::text, ''), created_at, expires_at
+                FROM idempotency_keys
+                WHERE key_hash = $1
+        `, keyHash).Scan(&statusCode, &owner, &createdAt, &expiresAt)
+        // Keys linked to another user are reported as unknown rather than forbidden
+        if err == pgx.ErrNoRows || (err == nil && owner != "" && owner != userID) {
+                http.Error(w, "Idempotency key not found", http.StatusNotFound)
+                return
+        }
+        if err != nil {
+                log.Printf("Failed to load idempotency key: %v", err)
+                http.Error(w, "Database error", http.StatusInternalServerError)
+                return
+        }
+        if !expiresAt.After(time.Now()) {
+                http.Error(w, "Idempotency key has expired", http.StatusGone)
+                return
+        }
+        if statusCode == nil {
+                http.Error(w, "Idempotency key is still in progress", http.StatusConflict)
+                return
+        }
+
+        newExpiry := time.Now().Add(ttl)
+        maxExpiry := createdAt.Add(cfg.IdempotencyKeyMaxLifetime)
+        if newExpiry.After(maxExpiry) {
+                newExpiry = maxExpiry
+        }
+        if newExpiry.Before(expiresAt) {
+                newExpiry = expiresAt // never shorten
+        }
+
+        // Guard on expiry so a key that lapsed (and was reclaimed) meanwhile is not revived
+        tag, err := dbFor(ctx).Exec(ctx, `
+                UPDATE idempotency_keys SET expires_at = $2
+                WHERE key_hash = $1 AND expires_at > CURRENT_TIMESTAMP AND created_at = $3
+        `, keyHash, newExpiry, createdAt)
+        if err != nil {
+                log.Printf("Failed to extend idempotency key: %v", err)
+                http.Error(w, "Database error", http.StatusInternalServerError)
+                return
+        }
+        if tag.RowsAffected() == 0 {
+                http.Error(w, "Idempotency key has expired", http.StatusGone)
+                return
+        }
+
+        writeJSON(w, http.StatusOK, map[string]interface{}{
+                "expires_at":     newExpiry.UTC(),
+                "max_expires_at": maxExpiry.UTC(),
+        })
+}
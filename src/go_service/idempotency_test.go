@@ -0,0 +1,1008 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "net/http"
+        "net/http/httptest"
+        "reflect"
+        "strconv"
+        "strings"
+        "testing"
+        "time"
+
+        "github.com/gorilla/mux"
+)
+
+// Post a single set change under idempotencyKey, returning the decoded response
+func postIdempotentChange(t *testing.T, sessionID, userID, idempotencyKey, path string, value interface{}, clock map[string]int64) (*http.Response, CRDTResponse) {
+        t.Helper()
+        body, _ := json.Marshal(CRDTPayload{
+                SessionID:      sessionID,
+                Changes:        []map[string]interface{}{{"op": "set", "path": path, "value": value}},
+                VectorClock:    clock,
+                IdempotencyKey: idempotencyKey,
+        })
+        w := postCRDTResults(t, sessionID, body, http.Header{"X-User-Id": {userID}})
+        if w.Code != http.StatusOK {
+                t.Fatalf("POST %s = %d: %s", idempotencyKey, w.Code, w.Body.String())
+        }
+        var response CRDTResponse
+        if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+                t.Fatal(err)
+        }
+        return w.Result(), response
+}
+
+func TestReplayVectorClockStrictVsRefreshed(t *testing.T) {
+        pool := testDB(t)
+        withConfig(t, func(c *Config) { c.IdempotencyStatusHeaders = true })
+        userID := insertTestUser(t, pool, "replay")
+        sessionID := insertTestSession(t, pool, map[string]interface{}{"exits": map[string]interface{}{}}, nil)
+
+        _, first := postIdempotentChange(t, sessionID, userID, "replay-exit-1", "/exits/north", "clear",
+                map[string]int64{"handheld-3": 1})
+        // A later write advances the stored clock past the first response's
+        _, second := postIdempotentChange(t, sessionID, userID, "replay-exit-2", "/exits/south", "blocked",
+                map[string]int64{"handheld-3": 2})
+        if reflect.DeepEqual(first.VectorClock, second.VectorClock) {
+                t.Fatalf("second write did not advance the clock: %v", second.VectorClock)
+        }
+
+        tests := []struct {
+                name    string
+                refresh bool
+                want    map[string]int64
+        }{
+                {"strict", false, first.VectorClock},
+                {"refreshed", true, second.VectorClock},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        cfg.ReplayRefreshVectorClock = tt.refresh
+                        resp, replay := postIdempotentChange(t, sessionID, userID, "replay-exit-1", "/exits/north", "clear",
+                                map[string]int64{"handheld-3": 1})
+                        if status := resp.Header.Get("Idempotency-Status"); status != idempotencyStatusReplayed {
+                                t.Errorf("Idempotency-Status = %q, want %q", status, idempotencyStatusReplayed)
+                        }
+                        if !reflect.DeepEqual(replay.VectorClock, tt.want) {
+                                t.Errorf("replayed vector_clock = %v, want %v", replay.VectorClock, tt.want)
+                        }
+                        // Only the clock is refreshed; the rest of the cached response is unchanged
+                        if replay.Status != first.Status || replay.SessionID != first.SessionID {
+                                t.Errorf("replay = %+v, want the cached response of %+v", replay, first)
+                        }
+                })
+        }
+
+        // Replays are deduplicated, so the stored clock is where the second write left it
+        state, err := loadSessionState(context.Background(), sessionID)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if !reflect.DeepEqual(state.VectorClock, second.VectorClock) {
+                t.Errorf("stored clock = %v, replays must not advance it past %v", state.VectorClock, second.VectorClock)
+        }
+}
+
+func TestRefreshReplayVectorClockRejectsCorruptCache(t *testing.T) {
+        // Decoding fails before the session is loaded, so no database is needed
+        if _, err := refreshReplayVectorClock(context.Background(), "session-x", []byte("not json")); err == nil {
+                t.Error("corrupt cached response was refreshed")
+        }
+}
+
+func TestSubOperationKey(t *testing.T) {
+        parent := idempotencyKeyHash("upload-7f3a")
+        keys := map[string]bool{
+                subOperationKey(parent, subOpEvidenceWebhook):                            true,
+                subOperationKey(parent, subOpEvidenceWebhook+":1"):                       true,
+                subOperationKey(idempotencyKeyHash("upload-7f3b"), subOpEvidenceWebhook): true,
+        }
+        if len(keys) != 3 {
+                t.Errorf("sub-operation keys collide: %v", keys)
+        }
+        if subOperationKey(parent, subOpEvidenceWebhook) != subOperationKey(parent, subOpEvidenceWebhook) {
+                t.Error("sub-operation key is not stable across retries")
+        }
+}
+
+func countOutboxEvents(t *testing.T, dedupKey string) int {
+        t.Helper()
+        var count int
+        if err := dbPool.QueryRow(context.Background(),
+                "SELECT count(*) FROM outbox WHERE dedup_key = $1", dedupKey).Scan(&count); err != nil {
+                t.Fatal(err)
+        }
+        return count
+}
+
+func TestRetriedUploadDoesNotRefireWebhook(t *testing.T) {
+        pool := testDB(t)
+        useTestEvidenceStore(t)
+        withConfig(t, func(c *Config) { c.EvidenceWebhookURL = "https://hooks.example.test/evidence" })
+        userID := insertTestUser(t, pool, "webhook")
+        sessionID := insertTestSession(t, pool, nil, nil)
+        content := []byte("certificate of occupancy scan")
+
+        upload := func() *httptest.ResponseRecorder {
+                r := evidenceUploadRequest(t, map[string]string{
+                        "session_id":    sessionID,
+                        "evidence_type": "document",
+                        "sha256_hash":   calculateSHA256(content),
+                }, map[string][]byte{"occupancy.pdf": content})
+                r.Header.Set("X-User-ID", userID)
+                w := httptest.NewRecorder()
+                handleEvidence(w, r)
+                return w
+        }
+
+        first := upload()
+        if first.Code != http.StatusCreated {
+                t.Fatalf("first upload = %d: %s", first.Code, first.Body.String())
+        }
+        retry := upload()
+        if retry.Code != http.StatusCreated || retry.Body.String() != first.Body.String() {
+                t.Errorf("retry = %d %s, want the cached %s", retry.Code, retry.Body.String(), first.Body.String())
+        }
+        if status := retry.Header().Get("Idempotency-Status"); cfg.IdempotencyStatusHeaders && status != idempotencyStatusReplayed {
+                t.Errorf("Idempotency-Status = %q, want %q", status, idempotencyStatusReplayed)
+        }
+
+        dedupKey := subOperationKey(idempotencyKeyHash("upload-"+t.Name()), subOpEvidenceWebhook)
+        if n := countOutboxEvents(t, dedupKey); n != 1 {
+                t.Errorf("webhook queued %d times, want once", n)
+        }
+}
+
+func TestWebhookQueuedOnceWhenResponseWasNotCached(t *testing.T) {
+        pool := testDB(t)
+        ctx := context.Background()
+        // A first attempt committed its webhook but crashed before caching its
+        // response, so the retry runs the handler again and re-enqueues
+        dedupKey := subOperationKey(idempotencyKeyHash("crash-"+t.Name()), subOpEvidenceWebhook)
+        for attempt := 1; attempt <= 2; attempt++ {
+                tx, err := pool.Begin(ctx)
+                if err != nil {
+                        t.Fatal(err)
+                }
+                event := EvidenceEvent{Event: "evidence.uploaded", EvidenceID: "attempt", SessionID: "s"}
+                if err := enqueueOutboxEvent(ctx, tx, event.Event, "https://hooks.example.test/x", event, dedupKey); err != nil {
+                        t.Fatalf("attempt %d: %v", attempt, err)
+                }
+                if err := tx.Commit(ctx); err != nil {
+                        t.Fatal(err)
+                }
+        }
+        if n := countOutboxEvents(t, dedupKey); n != 1 {
+                t.Errorf("webhook queued %d times across retries, want once", n)
+        }
+}
+
+func TestValidateIdempotencyKeyLengthBoundaries(t *testing.T) {
+        withConfig(t, func(c *Config) {
+                c.IdempotencyKeyMinLength = 8
+                c.IdempotencyKeyMaxLength = 255
+                c.IdempotencyKeyFormat = ""
+        })
+        tests := []struct {
+                length  int
+                wantErr string
+        }{
+                {7, "at least 8 bytes"},
+                {8, ""},
+                {255, ""},
+                {256, "at most 255 bytes"},
+                {64 << 10, "at most 255 bytes"},
+        }
+        for _, tt := range tests {
+                err := validateIdempotencyKey(strings.Repeat("k", tt.length))
+                if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+                        t.Errorf("length %d: err = %v, want %q", tt.length, err, tt.wantErr)
+                }
+        }
+
+        // Lengths are in bytes, so multi-byte keys hit the limit sooner
+        if err := validateIdempotencyKey(strings.Repeat("é", 128)); err == nil {
+                t.Error("256-byte key of 128 two-byte runes accepted")
+        }
+
+        // A zero maximum disables the upper bound
+        cfg.IdempotencyKeyMaxLength = 0
+        if err := validateIdempotencyKey(strings.Repeat("k", 4096)); err != nil {
+                t.Errorf("unbounded key rejected: %v", err)
+        }
+}
+
+func TestOverlongIdempotencyKeyRejectedBeforeProcessing(t *testing.T) {
+        withConfig(t, func(c *Config) {
+                c.IdempotencyKeyMinLength = 1
+                c.IdempotencyKeyMaxLength = 64
+        })
+        key := strings.Repeat("a", 65)
+
+        r := evidenceUploadRequest(t, nil, nil)
+        r.Header.Set("Idempotency-Key", key)
+        w := httptest.NewRecorder()
+        handleEvidence(w, r)
+        if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "at most 64 bytes") {
+                t.Errorf("evidence upload: %d %q, want 400", w.Code, w.Body.String())
+        }
+
+        body, _ := json.Marshal(CRDTPayload{
+                IdempotencyKey: key,
+                Changes:        []map[string]interface{}{{"op": "set", "path": "/sprinklers", "value": "ok"}},
+        })
+        w = postCRDTResults(t, "session-long-key", body, http.Header{"X-User-Id": {"u-long-key"}})
+        if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "at most 64 bytes") {
+                t.Errorf("CRDT results: %d %q, want 400", w.Code, w.Body.String())
+        }
+}
+
+func TestInProgressRetryAfter(t *testing.T) {
+        withConfig(t, func(c *Config) {
+                c.IdempotencyExpectedDuration = 30 * time.Second
+                c.IdempotencyStatusHeaders = true
+        })
+        tests := []struct {
+                name string
+                age  time.Duration
+                want string
+        }{
+                {"just claimed", 0, "30"},
+                {"partway through", 12 * time.Second, "18"},
+                {"overrunning the estimate", 2 * time.Minute, "1"},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        w := httptest.NewRecorder()
+                        // Half a second of slack keeps the rounded-up estimate stable
+                        writeIdempotencyInProgress(w, &IdempotencyCheck{Pending: true, CreatedAt: time.Now().Add(-tt.age - 500*time.Millisecond)})
+                        if w.Code != http.StatusConflict {
+                                t.Errorf("status = %d, want 409", w.Code)
+                        }
+                        if got := w.Header().Get("Retry-After"); got != tt.want {
+                                t.Errorf("Retry-After = %s, want %s", got, tt.want)
+                        }
+                        if got := w.Header().Get("Idempotency-Status"); got != idempotencyStatusInProgress {
+                                t.Errorf("Idempotency-Status = %q", got)
+                        }
+                })
+        }
+}
+
+func TestConcurrentDuplicateGetsRetryAfter(t *testing.T) {
+        pool := testDB(t)
+        withConfig(t, func(c *Config) {
+                c.IdempotencyExpectedDuration = 20 * time.Second
+                c.IdempotencyClaimTTL = time.Minute
+        })
+        userID := insertTestUser(t, pool, "in-progress")
+        sessionID := insertTestSession(t, pool, nil, nil)
+        payload := CRDTPayload{
+                IdempotencyKey: "in-progress-" + sessionID,
+                Changes:        []map[string]interface{}{{"op": "set", "path": "/standpipe", "value": "flowed"}},
+        }
+
+        // The first request has claimed the key and is still merging
+        changesJSON, _ := json.Marshal(payload.Changes)
+        check, err := checkIdempotency(context.Background(), idempotencyKeyHash(payload.IdempotencyKey), userID,
+                "/v1/tests/sessions/"+sessionID+"/results", calculateSHA256(changesJSON))
+        if err != nil || check != nil {
+                t.Fatalf("claim = %+v, %v; want a fresh claim", check, err)
+        }
+
+        body, _ := json.Marshal(payload)
+        w := postCRDTResults(t, sessionID, body, http.Header{"X-User-Id": {userID}})
+        if w.Code != http.StatusConflict {
+                t.Fatalf("duplicate = %d %s, want 409", w.Code, w.Body.String())
+        }
+        seconds, err := strconv.Atoi(w.Header().Get("Retry-After"))
+        if err != nil || seconds < 1 || seconds > 20 {
+                t.Errorf("Retry-After = %q, want 1-20 seconds", w.Header().Get("Retry-After"))
+        }
+}
+
+func TestCacheableErrorStatus(t *testing.T) {
+        tests := []struct {
+                classes string
+                status  int
+                want    bool
+        }{
+                {"4xx", http.StatusUnprocessableEntity, true},
+                {" 4XX ", http.StatusConflict, true},
+                {"4xx", http.StatusTooManyRequests, false},
+                {"4xx", http.StatusRequestTimeout, false},
+                {"4xx,5xx", http.StatusInternalServerError, false},
+                {"4xx,5xx", http.StatusServiceUnavailable, false},
+                {"4xx", http.StatusOK, false},
+                {"", http.StatusBadRequest, false},
+        }
+        for _, tt := range tests {
+                withConfig(t, func(c *Config) { c.IdempotencyCacheErrorClasses = tt.classes })
+                if got := cacheableErrorStatus(tt.status); got != tt.want {
+                        t.Errorf("cacheableErrorStatus(%d) with %q = %v, want %v", tt.status, tt.classes, got, tt.want)
+                }
+        }
+}
+
+func TestErrorRecorderCapturesErrorBodies(t *testing.T) {
+        w := httptest.NewRecorder()
+        rec := &errorRecorder{ResponseWriter: w}
+        http.Error(rec, "hydrant flow below minimum", http.StatusUnprocessableEntity)
+        if rec.status != http.StatusUnprocessableEntity || strings.TrimSpace(rec.body.String()) != "hydrant flow below minimum" {
+                t.Errorf("recorded %d %q", rec.status, rec.body.String())
+        }
+        if w.Code != http.StatusUnprocessableEntity {
+                t.Errorf("response passed through as %d", w.Code)
+        }
+
+        ok := &errorRecorder{ResponseWriter: httptest.NewRecorder()}
+        ok.Write([]byte(`{"status":"ok"}`))
+        if ok.status != http.StatusOK || ok.body.Len() != 0 {
+                t.Errorf("success recorded as %d with %d body bytes", ok.status, ok.body.Len())
+        }
+}
+
+func TestCached422Replays(t *testing.T) {
+        pool := testDB(t)
+        withConfig(t, func(c *Config) {
+                c.IdempotencyCacheErrorClasses = "4xx"
+                c.IdempotencyStatusHeaders = true
+        })
+        userID := insertTestUser(t, pool, "cached-422")
+        sessionID := insertTestSession(t, pool, map[string]interface{}{"alarms": []interface{}{"panel-1"}}, nil)
+        body, _ := json.Marshal(CRDTPayload{
+                Changes:        []map[string]interface{}{{"op": "replace", "path": "/alarms/0", "value": "panel-2"}},
+                IdempotencyKey: "cached-422-" + sessionID,
+        })
+
+        first := postCRDTResults(t, sessionID, body, http.Header{"X-User-Id": {userID}})
+        if first.Code != http.StatusUnprocessableEntity {
+                t.Fatalf("first = %d %s, want 422", first.Code, first.Body.String())
+        }
+        second := postCRDTResults(t, sessionID, body, http.Header{"X-User-Id": {userID}})
+        if second.Code != http.StatusUnprocessableEntity {
+                t.Fatalf("retry = %d, want the cached 422", second.Code)
+        }
+        if got := second.Header().Get("Idempotency-Status"); got != idempotencyStatusReplayed {
+                t.Errorf("retry Idempotency-Status = %q, want %q", got, idempotencyStatusReplayed)
+        }
+        var cached map[string]string
+        if err := json.Unmarshal(second.Body.Bytes(), &cached); err != nil || cached["error"] == "" {
+                t.Errorf("replayed body = %s, want the wrapped error", second.Body.String())
+        }
+}
+
+func TestRetryableErrorsNotCached(t *testing.T) {
+        pool := testDB(t)
+        withConfig(t, func(c *Config) { c.IdempotencyCacheErrorClasses = "4xx,5xx" })
+        userID := insertTestUser(t, pool, "uncached")
+
+        tests := []struct {
+                name       string
+                status     int
+                retryAfter string
+        }{
+                {"500", http.StatusInternalServerError, ""},
+                {"429", http.StatusTooManyRequests, "7"},
+                {"409 with Retry-After", http.StatusConflict, "2"},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        ctx := context.Background()
+                        keyHash := idempotencyKeyHash("uncached-" + tt.name + "-" + userID)
+                        check, err := checkIdempotency(ctx, keyHash, userID, "/v1/evidence", "request-hash")
+                        if err != nil || check != nil {
+                                t.Fatalf("claim = %+v, %v", check, err)
+                        }
+
+                        rec := &errorRecorder{ResponseWriter: httptest.NewRecorder()}
+                        if tt.retryAfter != "" {
+                                rec.Header().Set("Retry-After", tt.retryAfter)
+                        }
+                        http.Error(rec, "try again", tt.status)
+                        settleIdempotencyClaim(ctx, keyHash, userID, "/v1/evidence", "request-hash", rec)
+
+                        // The claim was released, so a retry claims the key afresh
+                        check, err = checkIdempotency(ctx, keyHash, userID, "/v1/evidence", "request-hash")
+                        if err != nil || check != nil {
+                                t.Errorf("retry saw %+v, %v; want a fresh claim", check, err)
+                        }
+                })
+        }
+}
+
+func TestIdempotencyKeyHashNamespaces(t *testing.T) {
+        const key = "0d4f7a52-9c1e-4b8a-a6f3-2e7d5c9b1a04"
+        withConfig(t, func(c *Config) { c.IdempotencyNamespace = "" })
+        plain := idempotencyKeyHash(key)
+        if plain != calculateSHA256([]byte(key)) {
+                t.Error("un-namespaced hash changed, invalidating existing records")
+        }
+
+        hashes := map[string]string{"": plain}
+        for _, namespace := range []string{"inspections", "billing", "inspections-eu"} {
+                withConfig(t, func(c *Config) { c.IdempotencyNamespace = namespace })
+                hash := idempotencyKeyHash(key)
+                if hash != idempotencyKeyHash(key) {
+                        t.Errorf("namespace %q: hash is not stable", namespace)
+                }
+                for other, otherHash := range hashes {
+                        if hash == otherHash {
+                                t.Errorf("namespaces %q and %q collide", namespace, other)
+                        }
+                }
+                hashes[namespace] = hash
+        }
+}
+
+func TestSameKeyUnderTwoNamespaces(t *testing.T) {
+        pool := testDB(t)
+        withConfig(t, func(c *Config) { c.IdempotencyStatusHeaders = true })
+        userID := insertTestUser(t, pool, "namespaces")
+        sessionID := insertTestSession(t, pool, map[string]interface{}{}, nil)
+        key := "shared-" + sessionID
+
+        post := func(namespace, value string) string {
+                withConfig(t, func(c *Config) { c.IdempotencyNamespace = namespace })
+                body, _ := json.Marshal(CRDTPayload{
+                        Changes:        []map[string]interface{}{{"op": "set", "path": "/" + namespace, "value": value}},
+                        IdempotencyKey: key,
+                })
+                w := postCRDTResults(t, sessionID, body, http.Header{"X-User-Id": {userID}})
+                if w.Code != http.StatusOK {
+                        t.Fatalf("%s: %d %s", namespace, w.Code, w.Body.String())
+                }
+                return w.Header().Get("Idempotency-Status")
+        }
+
+        if status := post("inspections", "first"); status != idempotencyStatusOriginal {
+                t.Errorf("inspections: Idempotency-Status %q, want %q", status, idempotencyStatusOriginal)
+        }
+        // A different payload under the same key would be a conflict within one namespace
+        if status := post("maintenance", "second"); status != idempotencyStatusOriginal {
+                t.Errorf("maintenance: Idempotency-Status %q, want an independent original", status)
+        }
+        if status := post("inspections", "first"); status != idempotencyStatusReplayed {
+                t.Errorf("inspections retry: Idempotency-Status %q, want %q", status, idempotencyStatusReplayed)
+        }
+
+        for _, namespace := range []string{"inspections", "maintenance"} {
+                withConfig(t, func(c *Config) { c.IdempotencyNamespace = namespace })
+                var count int
+                pool.QueryRow(context.Background(), "SELECT count(*) FROM idempotency_keys WHERE key_hash = $1", idempotencyKeyHash(key)).Scan(&count)
+                if count != 1 {
+                        t.Errorf("%s: %d stored records, want 1", namespace, count)
+                }
+        }
+}
+
+// POST to the extend endpoint for key as userID with the given JSON body
+func extendIdempotencyKey(key, userID, body string) *httptest.ResponseRecorder {
+        r := httptest.NewRequest(http.MethodPost, "/v1/idempotency/"+key+":extend", strings.NewReader(body))
+        r = mux.SetURLVars(r, map[string]string{"key": key})
+        if userID != "" {
+                r.Header.Set("X-User-ID", userID)
+        }
+        w := httptest.NewRecorder()
+        handleExtendIdempotencyKey(w, r)
+        return w
+}
+
+func TestExtendIdempotencyKeyRejectsBadRequests(t *testing.T) {
+        withConfig(t, func(c *Config) { c.IdempotencyKeyMinLength = 8 })
+        tests := []struct {
+                name   string
+                key    string
+                userID string
+                body   string
+        }{
+                {"short key", "x", "inspector-4", ""},
+                {"missing user", "retry-loop-0001", "", ""},
+                {"malformed body", "retry-loop-0001", "inspector-4", "{ttl_seconds"},
+                {"zero ttl", "retry-loop-0001", "inspector-4", `{"ttl_seconds": 0}`},
+                {"negative ttl", "retry-loop-0001", "inspector-4", `{"ttl_seconds": -3600}`},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        if w := extendIdempotencyKey(tt.key, tt.userID, tt.body); w.Code != http.StatusBadRequest {
+                                t.Errorf("status = %d, want 400", w.Code)
+                        }
+                })
+        }
+}
+
+func TestExtendIdempotencyKey(t *testing.T) {
+        pool := testDB(t)
+        withConfig(t, func(c *Config) {
+                c.IdempotencyExtendDefaultTTL = 12 * time.Hour
+                c.IdempotencyKeyMaxLifetime = 72 * time.Hour
+        })
+        userID := insertTestUser(t, pool, "long-retry")
+        ctx := context.Background()
+
+        // Store a completed key created createdAgo, expiring in expiresIn
+        storeKey := func(key string, createdAgo, expiresIn time.Duration) {
+                t.Helper()
+                _, err := pool.Exec(ctx, `
+                        INSERT INTO idempotency_keys (key_hash, user_id, endpoint, request_hash, response_data, status_code, created_at, expires_at)
+                        VALUES ($1, $2, '/v1/evidence', 'request-hash', '{}', 201, $3, $4)
+                `, idempotencyKeyHash(key), userID, time.Now().Add(-createdAgo), time.Now().Add(expiresIn))
+                if err != nil {
+                        t.Fatal(err)
+                }
+        }
+        expiry := func(key string) time.Time {
+                t.Helper()
+                var expiresAt time.Time
+                if err := pool.QueryRow(ctx, "SELECT expires_at FROM idempotency_keys WHERE key_hash = $1", idempotencyKeyHash(key)).Scan(&expiresAt); err != nil {
+                        t.Fatal(err)
+                }
+                return expiresAt
+        }
+
+        t.Run("live key", func(t *testing.T) {
+                key := "live-" + userID
+                storeKey(key, 20*time.Hour, 4*time.Hour)
+                w := extendIdempotencyKey(key, userID, `{"ttl_seconds": 86400}`)
+                if w.Code != http.StatusOK {
+                        t.Fatalf("status = %d %s, want 200", w.Code, w.Body.String())
+                }
+                if got := time.Until(expiry(key)); got < 23*time.Hour || got > 25*time.Hour {
+                        t.Errorf("expires in %s, want about 24h", got)
+                }
+        })
+
+        t.Run("capped at the maximum lifetime", func(t *testing.T) {
+                key := "capped-" + userID
+                storeKey(key, 70*time.Hour, time.Hour)
+                w := extendIdempotencyKey(key, userID, "")
+                if w.Code != http.StatusOK {
+                        t.Fatalf("status = %d %s, want 200", w.Code, w.Body.String())
+                }
+                if got := time.Until(expiry(key)); got < time.Hour || got > 2*time.Hour+time.Minute {
+                        t.Errorf("expires in %s, want capped at 72h after creation", got)
+                }
+        })
+
+        t.Run("expired key", func(t *testing.T) {
+                key := "expired-" + userID
+                storeKey(key, 30*time.Hour, -6*time.Hour)
+                before := expiry(key)
+                if w := extendIdempotencyKey(key, userID, ""); w.Code != http.StatusGone {
+                        t.Fatalf("status = %d, want 410", w.Code)
+                }
+                if !expiry(key).Equal(before) {
+                        t.Error("expired key was revived")
+                }
+        })
+
+        t.Run("another user's key", func(t *testing.T) {
+                key := "foreign-" + userID
+                storeKey(key, time.Hour, time.Hour)
+                if w := extendIdempotencyKey(key, insertTestUser(t, pool, "other-retry"), ""); w.Code != http.StatusNotFound {
+                        t.Errorf("status = %d, want 404", w.Code)
+                }
+        })
+}
+
+func TestOversizedResponsesNotCached(t *testing.T) {
+        pool := testDB(t)
+        withConfig(t, func(c *Config) { c.IdempotencyMaxResponseBytes = 2 << 10 })
+        userID := insertTestUser(t, pool, "large-responses")
+        ctx := context.Background()
+
+        tests := []struct {
+                name      string
+                findings  int
+                wantCache bool
+        }{
+                {"under the limit", 5, true},
+                {"over the limit", 200, false},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        findings := make([]string, tt.findings)
+                        for i := range findings {
+                                findings[i] = fmt.Sprintf("Sprinkler head %03d obstructed by storage", i)
+                        }
+                        response := map[string]interface{}{"status": "processed", "findings": findings}
+                        original, _ := json.Marshal(response)
+
+                        keyHash := idempotencyKeyHash("large-" + strconv.Itoa(tt.findings) + "-" + userID)
+                        requestHash := calculateSHA256(original)
+                        if err := storeIdempotencyKey(ctx, keyHash, userID, "/v1/reports", requestHash, response, http.StatusOK); err != nil {
+                                t.Fatal(err)
+                        }
+                        check, err := checkIdempotency(ctx, keyHash, userID, "/v1/reports", requestHash)
+                        if err != nil || check == nil || check.Pending {
+                                t.Fatalf("check = %+v, %v; want the processed record", check, err)
+                        }
+                        if check.StatusCode != http.StatusOK {
+                                t.Errorf("status = %d, want the original 200", check.StatusCode)
+                        }
+
+                        var replayed map[string]interface{}
+                        json.Unmarshal([]byte(check.ResponseData), &replayed)
+                        if tt.wantCache {
+                                if _, ok := replayed["findings"]; !ok || replayed["not_cacheable"] != nil {
+                                        t.Errorf("replay = %s, want the original response", check.ResponseData)
+                                }
+                                return
+                        }
+                        if replayed["not_cacheable"] != true || replayed["response_bytes"] != float64(len(original)) {
+                                t.Errorf("replay = %s, want the not-cacheable marker for %d bytes", check.ResponseData, len(original))
+                        }
+                })
+        }
+}
+
+func TestIdempotencyKeyFormats(t *testing.T) {
+        tests := []struct {
+                format string
+                key    string
+                valid  bool
+        }{
+                {idempotencyKeyFormatUUID, "f47ac10b-58cc-4372-a567-0e02b2c3d479", true},
+                {idempotencyKeyFormatUUID, "F47AC10B-58CC-4372-A567-0E02B2C3D479", true},
+                {idempotencyKeyFormatUUID, "f47ac10b58cc4372a5670e02b2c3d479", false},
+                {idempotencyKeyFormatUUID, "{f47ac10b-58cc-4372-a567-0e02b2c3d479}", false},
+                {idempotencyKeyFormatUUID, "urn:uuid:f47ac10b-58cc-4372-a567-0e02b2c3d479", false},
+                {idempotencyKeyFormatUUID, "retry-1", false},
+                {idempotencyKeyFormatULID, "01HZX3K7Q9M2V8T5R4N6B1C0DE", true},
+                {idempotencyKeyFormatULID, "01hzx3k7q9m2v8t5r4n6b1c0de", true},
+                {idempotencyKeyFormatULID, "81HZX3K7Q9M2V8T5R4N6B1C0DE", false}, // overflows 128 bits
+                {idempotencyKeyFormatULID, "01HZX3K7Q9M2V8T5R4N6B1C0DU", false}, // U is not Crockford base32
+                {idempotencyKeyFormatULID, "01HZX3K7Q9M2V8T5R4N6B1C0D", false},
+                {idempotencyKeyFormatAny, "retry-1", true},
+        }
+        for _, tt := range tests {
+                t.Run(tt.format+" "+tt.key, func(t *testing.T) {
+                        withConfig(t, func(c *Config) {
+                                c.IdempotencyKeyMinLength = 1
+                                c.IdempotencyKeyMaxLength = 255
+                                c.IdempotencyKeyFormat = tt.format
+                        })
+                        err := validateIdempotencyKey(tt.key)
+                        if (err == nil) != tt.valid {
+                                t.Errorf("err = %v, want valid %v", err, tt.valid)
+                        }
+                        if err != nil && !strings.Contains(err.Error(), strings.ToUpper(tt.format)) {
+                                t.Errorf("err = %v, want it to name the %s format", err, tt.format)
+                        }
+                })
+        }
+}
+
+func TestMalformedUUIDKeyRejectedBeforeProcessing(t *testing.T) {
+        withConfig(t, func(c *Config) {
+                c.IdempotencyKeyMinLength = 1
+                c.IdempotencyKeyFormat = idempotencyKeyFormatUUID
+        })
+        // A counter reused across installs: exactly the bug the format check catches
+        key := "upload-00042"
+
+        r := evidenceUploadRequest(t, nil, nil)
+        r.Header.Set("Idempotency-Key", key)
+        w := httptest.NewRecorder()
+        handleEvidence(w, r)
+        if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "must be a UUID") {
+                t.Errorf("evidence upload: %d %q, want 400", w.Code, w.Body.String())
+        }
+
+        body, _ := json.Marshal(CRDTPayload{
+                IdempotencyKey: key,
+                Changes:        []map[string]interface{}{{"op": "set", "path": "/alarm_test", "value": "passed"}},
+        })
+        w = postCRDTResults(t, "session-uuid-key", body, http.Header{"X-User-Id": {"u-uuid-key"}})
+        if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "must be a UUID") {
+                t.Errorf("CRDT results: %d %q, want 400", w.Code, w.Body.String())
+        }
+}
+
+func TestWriteIdempotencyCheckError(t *testing.T) {
+        tests := []struct {
+                err  error
+                want int
+        }{
+                {errIdempotencyKeyTooOld, http.StatusUnprocessableEntity},
+                {errIdempotencyKeyReused, http.StatusUnprocessableEntity},
+                {errInvalidUserID, http.StatusBadRequest},
+                {errUnknownUser, http.StatusForbidden},
+                {fmt.Errorf("claim: %w", errIdempotencyKeyTooOld), http.StatusUnprocessableEntity},
+                {context.DeadlineExceeded, http.StatusInternalServerError},
+        }
+        for _, tt := range tests {
+                w := httptest.NewRecorder()
+                writeIdempotencyCheckError(w, tt.err)
+                if w.Code != tt.want {
+                        t.Errorf("%v: status = %d, want %d", tt.err, w.Code, tt.want)
+                }
+        }
+}
+
+func TestKeysOlderThanMaxAge(t *testing.T) {
+        pool := testDB(t)
+        userID := insertTestUser(t, pool, "aged-keys")
+        ctx := context.Background()
+
+        tests := []struct {
+                name       string
+                maxAge     time.Duration
+                policy     string
+                age        time.Duration
+                wantReplay bool
+                wantErr    error
+        }{
+                {"disabled", 0, idempotencyMaxAgeReject, 20 * time.Hour, true, nil},
+                {"within the window", 6 * time.Hour, idempotencyMaxAgeReject, 5 * time.Hour, true, nil},
+                {"aged out, reprocessed", 6 * time.Hour, idempotencyMaxAgeReprocess, 7 * time.Hour, false, nil},
+                {"aged out, rejected", 90 * time.Minute, idempotencyMaxAgeReject, 3 * time.Hour, false, errIdempotencyKeyTooOld},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        withConfig(t, func(c *Config) {
+                                c.IdempotencyKeyMaxAge = tt.maxAge
+                                c.IdempotencyKeyMaxAgePolicy = tt.policy
+                        })
+                        keyHash := idempotencyKeyHash("aged-" + tt.name + "-" + userID)
+                        response := map[string]interface{}{"status": "processed", "inspection": "hydrant flow test"}
+                        if err := storeIdempotencyKey(ctx, keyHash, userID, "/v1/inspections", "flow-hash", response, http.StatusOK); err != nil {
+                                t.Fatal(err)
+                        }
+                        _, err := pool.Exec(ctx, "UPDATE idempotency_keys SET created_at = $2 WHERE key_hash = $1",
+                                keyHash, time.Now().Add(-tt.age))
+                        if err != nil {
+                                t.Fatal(err)
+                        }
+
+                        check, err := checkIdempotency(ctx, keyHash, userID, "/v1/inspections", "flow-hash")
+                        if !errors.Is(err, tt.wantErr) {
+                                t.Fatalf("err = %v, want %v", err, tt.wantErr)
+                        }
+                        replayed := check != nil && !check.Pending && check.StatusCode == http.StatusOK
+                        if replayed != tt.wantReplay {
+                                t.Errorf("check = %+v, replayed = %v, want %v", check, replayed, tt.wantReplay)
+                        }
+                        if !tt.wantReplay && tt.wantErr == nil && check != nil {
+                                t.Errorf("check = %+v, want the key reclaimed for a fresh request", check)
+                        }
+                })
+        }
+}
+
+func TestEvidenceFileFingerprint(t *testing.T) {
+        checksum := calculateSHA256([]byte("panel schedule"))
+        for _, tt := range []struct {
+                include bool
+                want    string
+        }{
+                {true, checksum + ":panel.pdf"},
+                {false, checksum},
+        } {
+                withConfig(t, func(c *Config) { c.IdempotencyFingerprintFilename = tt.include })
+                if got := evidenceFileFingerprint(checksum, "panel.pdf"); got != tt.want {
+                        t.Errorf("include filename %v: fingerprint = %q, want %q", tt.include, got, tt.want)
+                }
+        }
+}
+
+func TestRenamedEvidenceRetryFingerprint(t *testing.T) {
+        pool := testDB(t)
+        useTestEvidenceStore(t)
+        userID := insertTestUser(t, pool, "renamed-retry")
+        content := []byte("riser valve tamper switch: closed")
+
+        upload := func(sessionID, key, filename string) (int, string) {
+                t.Helper()
+                r := evidenceUploadRequest(t, map[string]string{
+                        "session_id":    sessionID,
+                        "evidence_type": "photo",
+                        "sha256_hash":   calculateSHA256(content),
+                }, map[string][]byte{filename: content})
+                r.Header.Set("Idempotency-Key", key)
+                r.Header.Set("X-User-ID", userID)
+                w := httptest.NewRecorder()
+                handleEvidence(w, r)
+                var response EvidenceResponse
+                json.Unmarshal(w.Body.Bytes(), &response)
+                return w.Code, response.EvidenceID
+        }
+        evidenceRows := func(sessionID string) int {
+                t.Helper()
+                var count int
+                if err := pool.QueryRow(context.Background(), "SELECT count(*) FROM evidence WHERE session_id = $1", sessionID).Scan(&count); err != nil {
+                        t.Fatal(err)
+                }
+                return count
+        }
+
+        tests := []struct {
+                includeFilename bool
+                wantRetry       int
+        }{
+                // The filename is part of the fingerprint, so a renamed retry is a different request
+                {true, http.StatusUnprocessableEntity},
+                // Only the content counts, so the renamed retry replays the first upload
+                {false, http.StatusCreated},
+        }
+        for _, tt := range tests {
+                t.Run(fmt.Sprintf("include filename %v", tt.includeFilename), func(t *testing.T) {
+                        withConfig(t, func(c *Config) { c.IdempotencyFingerprintFilename = tt.includeFilename })
+                        sessionID := insertTestSession(t, pool, nil, nil)
+                        key := fmt.Sprintf("tamper-%v-%s", tt.includeFilename, sessionID)
+
+                        code, firstID := upload(sessionID, key, "IMG_0412.jpg")
+                        if code != http.StatusCreated {
+                                t.Fatalf("upload = %d", code)
+                        }
+                        code, retryID := upload(sessionID, key, "tamper-switch.jpg")
+                        if code != tt.wantRetry {
+                                t.Errorf("renamed retry = %d, want %d", code, tt.wantRetry)
+                        }
+                        if tt.wantRetry == http.StatusCreated && retryID != firstID {
+                                t.Errorf("renamed retry = %s, want the replayed %s", retryID, firstID)
+                        }
+                        if n := evidenceRows(sessionID); n != 1 {
+                                t.Errorf("%d evidence rows, want only the first upload", n)
+                        }
+
+                        // An exact retry replays in both modes
+                        if code, id := upload(sessionID, key, "IMG_0412.jpg"); code != http.StatusCreated || id != firstID {
+                                t.Errorf("exact retry = %d %s, want the replayed %s", code, id, firstID)
+                        }
+                })
+        }
+}
+
+func TestReusedKeyWithDifferentRequestRejected(t *testing.T) {
+        pool := testDB(t)
+        ctx := context.Background()
+        userID := insertTestUser(t, pool, "key-reuse")
+        keyHash := idempotencyKeyHash("reuse-" + userID)
+
+        if check, err := checkIdempotency(ctx, keyHash, userID, "/v1/inspections", "hash-a"); err != nil || check != nil {
+                t.Fatalf("claim = %+v, %v; want a fresh claim", check, err)
+        }
+        // Reused while the first request is still running
+        if _, err := checkIdempotency(ctx, keyHash, userID, "/v1/inspections", "hash-b"); !errors.Is(err, errIdempotencyKeyReused) {
+                t.Errorf("pending reuse: err = %v, want errIdempotencyKeyReused", err)
+        }
+        if check, err := checkIdempotency(ctx, keyHash, userID, "/v1/inspections", "hash-a"); err != nil || check == nil || !check.Pending {
+                t.Errorf("pending duplicate = %+v, %v; want the pending claim", check, err)
+        }
+
+        if err := storeIdempotencyKey(ctx, keyHash, userID, "/v1/inspections", "hash-a", map[string]string{"status": "ok"}, http.StatusOK); err != nil {
+                t.Fatal(err)
+        }
+        if _, err := checkIdempotency(ctx, keyHash, userID, "/v1/inspections", "hash-b"); !errors.Is(err, errIdempotencyKeyReused) {
+                t.Errorf("completed reuse: err = %v, want errIdempotencyKeyReused", err)
+        }
+        if check, err := checkIdempotency(ctx, keyHash, userID, "/v1/inspections", "hash-a"); err != nil || check == nil || check.StatusCode != http.StatusOK {
+                t.Errorf("replay = %+v, %v; want the stored 200", check, err)
+        }
+}
+
+func TestSetIdempotencyStatus(t *testing.T) {
+        tests := []struct {
+                status       string
+                enabled      bool
+                wantStatus   string
+                wantReplayed string
+        }{
+                {idempotencyStatusOriginal, true, "original", ""},
+                {idempotencyStatusReplayed, true, "replayed", "true"},
+                {idempotencyStatusInProgress, true, "in_progress", ""},
+                {idempotencyStatusReplayed, false, "", ""},
+        }
+        for _, tt := range tests {
+                withConfig(t, func(c *Config) { c.IdempotencyStatusHeaders = tt.enabled })
+                w := httptest.NewRecorder()
+                setIdempotencyStatus(w, tt.status)
+                if got := w.Header().Get("Idempotency-Status"); got != tt.wantStatus {
+                        t.Errorf("%s (enabled %v): Idempotency-Status = %q, want %q", tt.status, tt.enabled, got, tt.wantStatus)
+                }
+                if got := w.Header().Get("Idempotency-Replayed"); got != tt.wantReplayed {
+                        t.Errorf("%s (enabled %v): Idempotency-Replayed = %q, want %q", tt.status, tt.enabled, got, tt.wantReplayed)
+                }
+        }
+}
+
+func TestWriteReplayedResponseHeaders(t *testing.T) {
+        withConfig(t, func(c *Config) { c.IdempotencyStatusHeaders = true })
+        w := httptest.NewRecorder()
+        writeReplayedResponse(w, http.StatusCreated, []byte(`{"id":"evidence-7"}`))
+        if w.Code != http.StatusCreated || w.Body.String() != `{"id":"evidence-7"}` {
+                t.Errorf("replay = %d %s", w.Code, w.Body.String())
+        }
+        if w.Header().Get("Idempotency-Replayed") != "true" || w.Header().Get("Idempotency-Status") != "replayed" {
+                t.Errorf("headers = %v", w.Header())
+        }
+}
+
+func TestIdempotencyStatusHeadersOnReplay(t *testing.T) {
+        pool := testDB(t)
+        withConfig(t, func(c *Config) { c.IdempotencyStatusHeaders = true })
+        userID := insertTestUser(t, pool, "status-headers")
+        sessionID := insertTestSession(t, pool, map[string]interface{}{"fire_pump": "untested"}, nil)
+
+        first, _ := postIdempotentChange(t, sessionID, userID, "status-pump-1", "/fire_pump", "churned", nil)
+        if got := first.Header.Get("Idempotency-Status"); got != "original" {
+                t.Errorf("first Idempotency-Status = %q, want original", got)
+        }
+        if _, ok := first.Header["Idempotency-Replayed"]; ok {
+                t.Errorf("first response carries Idempotency-Replayed: %v", first.Header)
+        }
+
+        replay, _ := postIdempotentChange(t, sessionID, userID, "status-pump-1", "/fire_pump", "churned", nil)
+        if replay.Header.Get("Idempotency-Status") != "replayed" || replay.Header.Get("Idempotency-Replayed") != "true" {
+                t.Errorf("replay headers = %v, want replayed", replay.Header)
+        }
+
+        // With the headers off a replay looks like any other response
+        cfg.IdempotencyStatusHeaders = false
+        quiet, _ := postIdempotentChange(t, sessionID, userID, "status-pump-1", "/fire_pump", "churned", nil)
+        if quiet.Header.Get("Idempotency-Status") != "" || quiet.Header.Get("Idempotency-Replayed") != "" {
+                t.Errorf("headers = %v, want none when disabled", quiet.Header)
+        }
+}
+
+func TestResolveIdempotencyUserRejectsNonUUID(t *testing.T) {
+        // Rejected before any query, so no database is needed
+        for _, userID := range []string{"inspector-7", "", "1234"} {
+                if err := resolveIdempotencyUser(context.Background(), userID); !errors.Is(err, errInvalidUserID) {
+                        t.Errorf("%q: err = %v, want errInvalidUserID", userID, err)
+                }
+        }
+}
+
+func TestIdempotentRequestsRequireKnownUser(t *testing.T) {
+        pool := testDB(t)
+        useTestEvidenceStore(t)
+        sessionID := insertTestSession(t, pool, nil, nil)
+        unknownUser := "6f1c2b7e-3d4a-4c8e-9b1f-2a7d5e8c0f93"
+
+        for _, tt := range []struct {
+                userID string
+                want   int
+        }{
+                {"inspector-7", http.StatusBadRequest},
+                {unknownUser, http.StatusForbidden},
+        } {
+                body, _ := json.Marshal(CRDTPayload{
+                        IdempotencyKey: "unknown-user-" + tt.userID,
+                        Changes:        []map[string]interface{}{{"op": "set", "path": "/fire_door", "value": "closed"}},
+                })
+                if w := postCRDTResults(t, sessionID, body, http.Header{"X-User-Id": {tt.userID}}); w.Code != tt.want {
+                        t.Errorf("CRDT post as %q = %d %s, want %d", tt.userID, w.Code, w.Body.String(), tt.want)
+                }
+
+                content := []byte("fire door closer")
+                r := evidenceUploadRequest(t, map[string]string{
+                        "session_id":    sessionID,
+                        "evidence_type": "photo",
+                        "sha256_hash":   calculateSHA256(content),
+                }, map[string][]byte{"fire-door.jpg": content})
+                r.Header.Set("Idempotency-Key", "unknown-user-upload-"+tt.userID)
+                r.Header.Set("X-User-ID", tt.userID)
+                w := httptest.NewRecorder()
+                handleEvidence(w, r)
+                if w.Code != tt.want {
+                        t.Errorf("upload as %q = %d %s, want %d", tt.userID, w.Code, w.Body.String(), tt.want)
+                }
+        }
+
+        var keyHashes []string
+        for _, userID := range []string{"inspector-7", unknownUser} {
+                keyHashes = append(keyHashes, idempotencyKeyHash("unknown-user-"+userID), idempotencyKeyHash("unknown-user-upload-"+userID))
+        }
+        var keys, evidence int
+        pool.QueryRow(context.Background(), "SELECT count(*) FROM idempotency_keys WHERE key_hash = ANY($1)", keyHashes).Scan(&keys)
+        pool.QueryRow(context.Background(), "SELECT count(*) FROM evidence WHERE session_id = $1", sessionID).Scan(&evidence)
+        if keys != 0 || evidence != 0 {
+                t.Errorf("%d keys claimed and %d evidence rows stored for rejected users", keys, evidence)
+        }
+}
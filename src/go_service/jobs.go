@@ -0,0 +1,106 @@
+package main
+
+import (
+        "context"
+        "fmt"
+        "sort"
+        "strings"
+        "sync"
+        "time"
+)
+
+// Heartbeats of background jobs, so a stuck job shows up in /readyz. Each job
+// reports after every successful run; one whose last success is older than
+// JOB_STALE_INTERVALS of its interval is reported down, failing readiness if
+// it is listed in CRITICAL_JOBS and degrading it otherwise.
+type JobHeartbeats struct {
+        mu   sync.Mutex
+        jobs map[string]*jobHeartbeat
+}
+
+type jobHeartbeat struct {
+        interval    time.Duration
+        registered  time.Time
+        lastSuccess time.Time
+}
+
+var jobHeartbeats = &JobHeartbeats{jobs: make(map[string]*jobHeartbeat)}
+
+// Background job names, as reported under /readyz dependencies with a "job:" prefix
+const (
+        jobOutboxRelay    = "outbox_relay"
+        jobTimestampRelay = "timestamp_relay"
+        jobSpoolReconcile = "spool_reconcile"
+        jobLeakDetector   = "leak_detector"
+)
+
+// Start tracking a job expected to run every interval. Until its first success
+// its freshness is measured from registration.
+func (h *JobHeartbeats) Register(name string, interval time.Duration) {
+        h.mu.Lock()
+        defer h.mu.Unlock()
+        h.jobs[name] = &jobHeartbeat{interval: interval, registered: time.Now()}
+}
+
+// Record a successful run of a job
+func (h *JobHeartbeats) Beat(name string) {
+        h.mu.Lock()
+        defer h.mu.Unlock()
+        if job, ok := h.jobs[name]; ok {
+                job.lastSuccess = time.Now()
+        }
+}
+
+// Error describing a job that has not succeeded within its allowed staleness, or nil
+func (h *JobHeartbeats) check(name string) error {
+        h.mu.Lock()
+        defer h.mu.Unlock()
+        job, ok := h.jobs[name]
+        if !ok {
+                return nil
+        }
+        allowed := job.interval * time.Duration(max(cfg.JobStaleIntervals, 1))
+        if job.lastSuccess.IsZero() {
+                if age := time.Since(job.registered); age > allowed {
+                        return fmt.Errorf("no successful run in %s since start (expected every %s)", age.Round(time.Second), job.interval)
+                }
+                return nil
+        }
+        if age := time.Since(job.lastSuccess); age > allowed {
+                return fmt.Errorf("last successful run %s ago (expected every %s)", age.Round(time.Second), job.interval)
+        }
+        return nil
+}
+
+// Readiness checks for every registered job, in name order
+func (h *JobHeartbeats) readinessChecks() []readinessCheck {
+        h.mu.Lock()
+        names := make([]string, 0, len(h.jobs))
+        for name := range h.jobs {
+                names = append(names, name)
+        }
+        h.mu.Unlock()
+        sort.Strings(names)
+
+        checks := make([]readinessCheck, 0, len(names))
+        for _, name := range names {
+                checks = append(checks, readinessCheck{
+                        Name:     "job:" + name,
+                        Critical: criticalJob(name),
+                        Probe: func(ctx context.Context) error {
+                                return h.check(name)
+                        },
+                })
+        }
+        return checks
+}
+
+// Report whether a job is listed in CRITICAL_JOBS
+func criticalJob(name string) bool {
+        for _, critical := range strings.Split(cfg.CriticalJobs, ",") {
+                if strings.TrimSpace(critical) == name {
+                        return true
+                }
+        }
+        return false
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "net/http"
+        "net/http/httptest"
+        "strings"
+        "testing"
+        "time"
+)
+
+// Heartbeats with one job per entry, each last seen (or registered) ago
+func stalledHeartbeats(interval time.Duration, lastSeen map[string]time.Duration) *JobHeartbeats {
+        h := &JobHeartbeats{jobs: make(map[string]*jobHeartbeat)}
+        for name, ago := range lastSeen {
+                h.Register(name, interval)
+                h.jobs[name].registered = time.Now().Add(-ago)
+        }
+        return h
+}
+
+func TestJobHeartbeatCheck(t *testing.T) {
+        withConfig(t, func(c *Config) { c.JobStaleIntervals = 3 })
+        h := stalledHeartbeats(time.Minute, map[string]time.Duration{
+                jobOutboxRelay:    2 * time.Minute,
+                jobTimestampRelay: 10 * time.Minute,
+                jobSpoolReconcile: 10 * time.Minute,
+                jobLeakDetector:   0,
+        })
+        h.Beat(jobSpoolReconcile)
+        h.Beat(jobLeakDetector)
+        h.jobs[jobLeakDetector].lastSuccess = time.Now().Add(-4 * time.Minute)
+
+        tests := []struct {
+                name    string
+                wantErr string
+        }{
+                {jobOutboxRelay, ""}, // never ran, but within three intervals of start
+                {jobTimestampRelay, "no successful run in 10m0s since start"},
+                {jobSpoolReconcile, ""}, // stale registration, fresh beat
+                {jobLeakDetector, "last successful run 4m0s ago (expected every 1m0s)"},
+                {"unregistered", ""},
+        }
+        for _, tt := range tests {
+                err := h.check(tt.name)
+                if tt.wantErr == "" && err != nil {
+                        t.Errorf("%s: unexpected error %v", tt.name, err)
+                }
+                if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+                        t.Errorf("%s: err = %v, want one containing %q", tt.name, err, tt.wantErr)
+                }
+        }
+
+        // Beating an unregistered job is ignored rather than tracked
+        h.Beat("unregistered")
+        if _, ok := h.jobs["unregistered"]; ok {
+                t.Error("Beat registered an unknown job")
+        }
+}
+
+func TestCriticalJob(t *testing.T) {
+        withConfig(t, func(c *Config) { c.CriticalJobs = " outbox_relay , spool_reconcile" })
+        for name, want := range map[string]bool{
+                jobOutboxRelay:    true,
+                jobSpoolReconcile: true,
+                jobTimestampRelay: false,
+                "outbox":          false,
+        } {
+                if got := criticalJob(name); got != want {
+                        t.Errorf("criticalJob(%q) = %v, want %v", name, got, want)
+                }
+        }
+}
+
+func TestStalledJobReadiness(t *testing.T) {
+        withConfig(t, func(c *Config) {
+                c.JobStaleIntervals = 2
+                c.ReadyzTimeout = time.Second
+                c.CriticalJobs = jobOutboxRelay
+        })
+        store := newOutageStore(t)
+        saved := evidenceStore
+        evidenceStore = store
+        t.Cleanup(func() { evidenceStore = saved })
+
+        tests := []struct {
+                name    string
+                stalled string
+                want    string
+        }{
+                {"all fresh", "", "ready"},
+                {"non-critical job stalled", jobTimestampRelay, "degraded"},
+                {"critical job stalled", jobOutboxRelay, "unready"},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        h := stalledHeartbeats(30*time.Second, map[string]time.Duration{jobOutboxRelay: 0, jobTimestampRelay: 0})
+                        if tt.stalled != "" {
+                                h.jobs[tt.stalled].registered = time.Now().Add(-5 * time.Minute)
+                        }
+                        overall, dependencies := runReadinessChecks(context.Background(),
+                                append(storeChecks(true), h.readinessChecks()...))
+                        if overall != tt.want {
+                                t.Errorf("status = %s, want %s (%+v)", overall, tt.want, dependencies)
+                        }
+                        for _, name := range []string{jobOutboxRelay, jobTimestampRelay} {
+                                dep, ok := dependencies["job:"+name]
+                                if !ok {
+                                        t.Fatalf("job:%s missing from %+v", name, dependencies)
+                                }
+                                if wantDown := name == tt.stalled; (dep.Status == "down") != wantDown || dep.Critical != (name == jobOutboxRelay) {
+                                        t.Errorf("job:%s = %+v", name, dep)
+                                }
+                        }
+
+                        // A successful run brings the job back
+                        if tt.stalled != "" {
+                                h.Beat(tt.stalled)
+                                if overall, _ := runReadinessChecks(context.Background(), append(storeChecks(true), h.readinessChecks()...)); overall != "ready" {
+                                        t.Errorf("after a beat status = %s, want ready", overall)
+                                }
+                        }
+                })
+        }
+}
+
+func TestReadyzReportsStalledJob(t *testing.T) {
+        testDB(t)
+        withConfig(t, func(c *Config) {
+                c.JobStaleIntervals = 3
+                c.ReadyzTimeout = time.Second
+                c.CriticalJobs = jobSpoolReconcile
+        })
+        saved := jobHeartbeats
+        jobHeartbeats = stalledHeartbeats(time.Minute, map[string]time.Duration{jobSpoolReconcile: time.Hour})
+        t.Cleanup(func() { jobHeartbeats = saved })
+
+        w := httptest.NewRecorder()
+        readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+        var body struct {
+                Status       string                      `json:"status"`
+                Dependencies map[string]DependencyStatus `json:"dependencies"`
+        }
+        if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+                t.Fatal(err)
+        }
+        if w.Code != http.StatusServiceUnavailable || body.Status != "unready" {
+                t.Errorf("readyz = %d %s, want 503 unready", w.Code, body.Status)
+        }
+        if dep := body.Dependencies["job:"+jobSpoolReconcile]; dep.Status != "down" || !strings.Contains(dep.Error, "since start") {
+                t.Errorf("job:%s = %+v", jobSpoolReconcile, dep)
+        }
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+        "context"
+        "log"
+        "os"
+        "runtime"
+        "sync"
+        "time"
+
+        "github.com/prometheus/client_golang/prometheus"
+)
+
+// Alerts raised by the leak detector by resource ("goroutines" or "fds")
+var leakAlertsTotal = prometheus.NewCounterVec(
+        prometheus.CounterOpts{
+                Name: "leak_alerts_total",
+                Help: "Sustained goroutine or file descriptor growth detected by the leak sampler.",
+        },
+        []string{"resource"},
+)
+
+func init() {
+        prometheus.MustRegister(leakAlertsTotal)
+}
+
+// Count this process's open file descriptors, or -1 where /proc is unavailable
+func openFDCount() int {
+        entries, err := os.ReadDir("/proc/self/fd")
+        if err != nil {
+                return -1
+        }
+        return len(entries)
+}
+
+// Report whether samples never decrease and grow by at least threshold overall
+func monotonicGrowth(samples []int, threshold int) bool {
+        if len(samples) < 2 || threshold <= 0 {
+                return false
+        }
+        for i := 1; i < len(samples); i++ {
+                if samples[i] < samples[i-1] {
+                        return false
+                }
+        }
+        return samples[len(samples)-1]-samples[0] >= threshold
+}
+
+// Periodically samples goroutine and open-FD counts, alerting when either grows
+// monotonically past its threshold across the sampling window
+type LeakDetector struct {
+        mu         sync.Mutex
+        window     int
+        goroutines []int
+        fds        []int
+        alerts     map[string]int
+}
+
+var leakDetector = &LeakDetector{alerts: make(map[string]int)}
+
+// Record one sample and return the resources whose growth crossed their threshold
+func (d *LeakDetector) observe(goroutines, fds int) []string {
+        d.mu.Lock()
+        defer d.mu.Unlock()
+
+        window := cfg.LeakWindowSamples
+        if window < 2 {
+                window = 2
+        }
+        d.goroutines = appendWindow(d.goroutines, goroutines, int(window))
+        var alerts []string
+        if len(d.goroutines) == int(window) && monotonicGrowth(d.goroutines, int(cfg.LeakGoroutineGrowthThreshold)) {
+                alerts = append(alerts, "goroutines")
+        }
+        if fds >= 0 {
+                d.fds = appendWindow(d.fds, fds, int(window))
+                if len(d.fds) == int(window) && monotonicGrowth(d.fds, int(cfg.LeakFDGrowthThreshold)) {
+                        alerts = append(alerts, "fds")
+                }
+        }
+
+        for _, resource := range alerts {
+                d.alerts[resource]++
+                leakAlertsTotal.WithLabelValues(resource).Inc()
+                // Start a fresh window so a sustained leak alerts once per window, not every sample
+                if resource == "goroutines" {
+                        d.goroutines = d.goroutines[:0]
+                } else {
+                        d.fds = d.fds[:0]
+                }
+        }
+        return alerts
+}
+
+// Append a sample, keeping at most size of the most recent ones
+func appendWindow(samples []int, v, size int) []int {
+        samples = append(samples, v)
+        if len(samples) > size {
+                samples = samples[len(samples)-size:]
+        }
+        return samples
+}
+
+// Alert counts by resource since startup
+func (d *LeakDetector) Alerts() map[string]int {
+        d.mu.Lock()
+        defer d.mu.Unlock()
+
+        alerts := make(map[string]int, len(d.alerts))
+        for k, v := range d.alerts {
+                alerts[k] = v
+        }
+        return alerts
+}
+
+// Sample every LEAK_SAMPLE_INTERVAL until ctx is cancelled
+func (d *LeakDetector) Run(ctx context.Context) {
+        ticker := time.NewTicker(cfg.LeakSampleInterval)
+        defer ticker.Stop()
+        jobHeartbeats.Register(jobLeakDetector, cfg.LeakSampleInterval)
+
+        for {
+                select {
+                case <-ctx.Done():
+                        return
+                case <-ticker.C:
+                        goroutines, fds := runtime.NumGoroutine(), openFDCount()
+                        jobHeartbeats.Beat(jobLeakDetector)
+                        for _, resource := range d.observe(goroutines, fds) {
+                                log.Printf("WARN: possible %s leak: grew monotonically over %d samples (goroutines=%d open_fds=%d)",
+                                        resource, cfg.LeakWindowSamples, goroutines, fds)
+                        }
+                }
+        }
+}
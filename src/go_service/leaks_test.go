@@ -0,0 +1,97 @@
+package main
+
+import (
+        "os"
+        "runtime"
+        "testing"
+)
+
+func TestMonotonicGrowth(t *testing.T) {
+        tests := []struct {
+                samples   []int
+                threshold int
+                want      bool
+        }{
+                {[]int{40, 45, 45, 52, 60}, 20, true},
+                {[]int{40, 45, 44, 52, 60}, 10, false}, // a dip means the count is not leaking
+                {[]int{40, 41, 42, 43, 44}, 10, false}, // growing, but not past the threshold
+                {[]int{40}, 1, false},
+                {[]int{40, 90}, 0, false}, // zero threshold disables
+        }
+        for _, tt := range tests {
+                if got := monotonicGrowth(tt.samples, tt.threshold); got != tt.want {
+                        t.Errorf("monotonicGrowth(%v, %d) = %v, want %v", tt.samples, tt.threshold, got, tt.want)
+                }
+        }
+}
+
+func TestLeakDetectorAlertsOnGoroutineGrowth(t *testing.T) {
+        withConfig(t, func(c *Config) {
+                c.LeakWindowSamples = 4
+                c.LeakGoroutineGrowthThreshold = 30
+                c.LeakFDGrowthThreshold = 1000
+        })
+        detector := &LeakDetector{alerts: make(map[string]int)}
+        stop := make(chan struct{})
+        defer close(stop)
+
+        // Leak 15 goroutines between samples, as a handler that never returns would
+        var alerts []string
+        for i := 0; i < 4; i++ {
+                alerts = detector.observe(runtime.NumGoroutine(), -1)
+                for j := 0; j < 15; j++ {
+                        go func() { <-stop }()
+                }
+        }
+        if len(alerts) != 1 || alerts[0] != "goroutines" {
+                t.Fatalf("alerts = %v, want goroutines after a full window of growth", alerts)
+        }
+        if detector.Alerts()["goroutines"] != 1 {
+                t.Errorf("alert counts = %v", detector.Alerts())
+        }
+
+        // The window restarts after an alert, so the next sample alone does not re-alert
+        if alerts := detector.observe(runtime.NumGoroutine(), -1); len(alerts) != 0 {
+                t.Errorf("re-alerted immediately: %v", alerts)
+        }
+}
+
+func TestLeakDetectorStableCountsDoNotAlert(t *testing.T) {
+        withConfig(t, func(c *Config) {
+                c.LeakWindowSamples = 3
+                c.LeakGoroutineGrowthThreshold = 5
+                c.LeakFDGrowthThreshold = 5
+        })
+        detector := &LeakDetector{alerts: make(map[string]int)}
+        for _, sample := range [][2]int{{20, 9}, {26, 15}, {22, 21}, {30, 40}} {
+                if alerts := detector.observe(sample[0], sample[1]); len(alerts) != 0 && alerts[0] == "goroutines" {
+                        t.Errorf("goroutine alert for fluctuating counts at %v", sample)
+                }
+        }
+        if detector.Alerts()["fds"] != 1 {
+                t.Errorf("fd growth 9 -> 21 was not reported: %v", detector.Alerts())
+        }
+}
+
+func TestOpenFDCount(t *testing.T) {
+        before := openFDCount()
+        if before < 0 {
+                t.Skip("/proc/self/fd unavailable")
+        }
+        var files []*os.File
+        for i := 0; i < 5; i++ {
+                f, err := os.Open(os.DevNull)
+                if err != nil {
+                        t.Fatal(err)
+                }
+                files = append(files, f)
+        }
+        defer func() {
+                for _, f := range files {
+                        f.Close()
+                }
+        }()
+        if after := openFDCount(); after < before+5 {
+                t.Errorf("open FDs %d -> %d after opening 5 files", before, after)
+        }
+}
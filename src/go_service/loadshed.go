@@ -0,0 +1,116 @@
+package main
+
+import (
+        "math"
+        "math/rand"
+        "net/http"
+        "strings"
+        "sync"
+        "sync/atomic"
+        "time"
+
+        "github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+        requestsShedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+                Name: "requests_shed_total",
+                Help: "Requests rejected with 503 by adaptive load shedding.",
+        })
+        loadShedProbability = prometheus.NewGauge(prometheus.GaugeOpts{
+                Name: "load_shed_probability",
+                Help: "Current probability that an incoming request is shed.",
+        })
+)
+
+func init() {
+        prometheus.MustRegister(requestsShedTotal, loadShedProbability)
+}
+
+// Weight of each new sample in the latency moving average
+const loadShedEWMAAlpha = 0.1
+
+// Adaptive load shedder: tracks an exponentially weighted moving average of
+// handler latency and the number of in-flight requests, and rejects incoming
+// requests with a probability that grows with how far either exceeds its
+// threshold, capped at LOAD_SHED_MAX_PERCENT
+type LoadShedder struct {
+        mu       sync.Mutex
+        ewma     time.Duration
+        inFlight atomic.Int64
+}
+
+var loadShedder = &LoadShedder{}
+
+// Probability of shedding the next request
+func (s *LoadShedder) probability() float64 {
+        s.mu.Lock()
+        ewma := s.ewma
+        s.mu.Unlock()
+
+        var p float64
+        if threshold := cfg.LoadShedLatencyThreshold; threshold > 0 && ewma > threshold {
+                p = math.Max(p, float64(ewma-threshold)/float64(threshold))
+        }
+        if limit := cfg.LoadShedMaxInFlight; limit > 0 {
+                if inFlight := s.inFlight.Load(); inFlight > limit {
+                        p = math.Max(p, float64(inFlight-limit)/float64(limit))
+                }
+        }
+        return math.Min(p, float64(cfg.LoadShedMaxPercent)/100)
+}
+
+// Fold a completed request's latency into the moving average
+func (s *LoadShedder) observe(latency time.Duration) {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+
+        if s.ewma == 0 {
+                s.ewma = latency
+                return
+        }
+        s.ewma = time.Duration(loadShedEWMAAlpha*float64(latency) + (1-loadShedEWMAAlpha)*float64(s.ewma))
+}
+
+// Probes and metrics must keep answering under load
+func loadShedExempt(r *http.Request) bool {
+        switch r.URL.Path {
+        case "/health", "/livez", "/readyz", "/metrics", "/stats":
+                return true
+        }
+        return false
+}
+
+// Long-poll and SSE requests are excluded from latency tracking so they do not skew it
+func longLivedRequest(r *http.Request) bool {
+        return strings.HasSuffix(r.URL.Path, "/watch") || strings.HasSuffix(r.URL.Path, "/events")
+}
+
+// Shed requests with 503 while the service is overloaded
+func loadSheddingMiddleware(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                if loadShedExempt(r) || (cfg.LoadShedLatencyThreshold <= 0 && cfg.LoadShedMaxInFlight <= 0) {
+                        next.ServeHTTP(w, r)
+                        return
+                }
+
+                p := loadShedder.probability()
+                loadShedProbability.Set(p)
+                if p > 0 && rand.Float64() < p {
+                        requestsShedTotal.Inc()
+                        stats.Inc(statRequestsShed)
+                        w.Header().Set("Retry-After", "1")
+                        http.Error(w, "Service overloaded, retry later", http.StatusServiceUnavailable)
+                        return
+                }
+
+                loadShedder.inFlight.Add(1)
+                defer loadShedder.inFlight.Add(-1)
+
+                start := time.Now()
+                next.ServeHTTP(w, r)
+                if !longLivedRequest(r) {
+                        loadShedder.observe(time.Since(start))
+                }
+        })
+}
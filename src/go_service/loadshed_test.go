@@ -0,0 +1,106 @@
+package main
+
+import (
+        "net/http"
+        "net/http/httptest"
+        "testing"
+        "time"
+)
+
+// Give a test its own shedder so latency history does not leak between tests
+func useTestLoadShedder(t *testing.T) *LoadShedder {
+        t.Helper()
+        old := loadShedder
+        loadShedder = &LoadShedder{}
+        t.Cleanup(func() { loadShedder = old })
+        return loadShedder
+}
+
+func TestLoadShedderProbability(t *testing.T) {
+        tests := []struct {
+                name      string
+                threshold time.Duration
+                maxFlight int64
+                ewma      time.Duration
+                inFlight  int64
+                want      float64
+        }{
+                {"healthy", 100 * time.Millisecond, 10, 80 * time.Millisecond, 4, 0},
+                {"latency 50% over", 100 * time.Millisecond, 0, 150 * time.Millisecond, 0, 0.5},
+                {"in-flight 20% over", 0, 10, 0, 12, 0.2},
+                {"worse gate wins", 100 * time.Millisecond, 10, 110 * time.Millisecond, 13, 0.3},
+                {"capped", 100 * time.Millisecond, 0, time.Second, 0, 0.6},
+                {"gates disabled", 0, 0, time.Hour, 1000, 0},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        withConfig(t, func(c *Config) {
+                                c.LoadShedLatencyThreshold = tt.threshold
+                                c.LoadShedMaxInFlight = tt.maxFlight
+                                c.LoadShedMaxPercent = 60
+                        })
+                        s := &LoadShedder{ewma: tt.ewma}
+                        s.inFlight.Store(tt.inFlight)
+                        if got := s.probability(); got < tt.want-1e-9 || got > tt.want+1e-9 {
+                                t.Errorf("probability = %v, want %v", got, tt.want)
+                        }
+                })
+        }
+}
+
+func TestLoadSheddingUnderHighLatency(t *testing.T) {
+        withConfig(t, func(c *Config) {
+                c.LoadShedLatencyThreshold = 2 * time.Millisecond
+                c.LoadShedMaxPercent = 50
+        })
+        useTestLoadShedder(t)
+        shedBefore := stats.Counter(statRequestsShed).Load()
+
+        // Every request that gets through takes 10ms, five times the threshold
+        slow := loadSheddingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                time.Sleep(10 * time.Millisecond)
+        }))
+        const requests = 60
+        shed := 0
+        for i := 0; i < requests; i++ {
+                w := httptest.NewRecorder()
+                slow.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/tests/sessions/s-1", nil))
+                if w.Code == http.StatusServiceUnavailable {
+                        shed++
+                        if w.Header().Get("Retry-After") == "" {
+                                t.Error("shed response has no Retry-After")
+                        }
+                }
+        }
+
+        // The first request has no latency history; after it about half are shed
+        if shed == 0 || shed >= requests-1 {
+                t.Errorf("shed %d of %d requests, want some but not all", shed, requests)
+        }
+        if got := stats.Counter(statRequestsShed).Load() - shedBefore; got != int64(shed) {
+                t.Errorf("shed counter moved by %d, want %d", got, shed)
+        }
+}
+
+func TestLoadSheddingExemptsProbes(t *testing.T) {
+        withConfig(t, func(c *Config) {
+                c.LoadShedMaxInFlight = 1
+                c.LoadShedMaxPercent = 100
+        })
+        s := useTestLoadShedder(t)
+        s.inFlight.Store(100)
+
+        handler := loadSheddingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+        for _, path := range []string{"/health", "/livez", "/readyz", "/metrics", "/stats"} {
+                w := httptest.NewRecorder()
+                handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+                if w.Code != http.StatusOK {
+                        t.Errorf("%s = %d under overload, want 200", path, w.Code)
+                }
+        }
+        w := httptest.NewRecorder()
+        handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/evidence", nil))
+        if w.Code != http.StatusServiceUnavailable {
+                t.Errorf("/v1/evidence = %d at 100%% shed probability, want 503", w.Code)
+        }
+}
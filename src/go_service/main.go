@@ -5,18 +5,23 @@ import (
         "crypto/sha256"
         "encoding/hex"
         "encoding/json"
+        "errors"
         "fmt"
         "io"
         "log"
         "net/http"
         "os"
         "runtime"
+        "strconv"
+        "strings"
         "time"
 
         "github.com/golang-jwt/jwt/v5"
         "github.com/gorilla/mux"
         "github.com/jackc/pgx/v5"
         "github.com/jackc/pgx/v5/pgxpool"
+        "github.com/prometheus/client_golang/prometheus"
+        "github.com/prometheus/client_golang/prometheus/promhttp"
         "github.com/google/uuid"
         _ "net/http/pprof" // Import pprof for profiling endpoints
 )
@@ -25,16 +30,29 @@ import (
 type CRDTPayload struct {
         SessionID      string                   `json:"session_id"`
         Changes        []map[string]interface{} `json:"changes"`
-        VectorClock    map[string]int           `json:"vector_clock"`
+        VectorClock    map[string]int64           `json:"vector_clock"`
         IdempotencyKey string                   `json:"idempotency_key"`
+        // Optional template used to seed a session's first write
+        SessionTemplate string `json:"session_template,omitempty"`
+        // Merge strategy from X-Merge-Strategy for this request only; not serialized
+        strategyOverride string
 }
 
 // CRDT response structure
 type CRDTResponse struct {
         SessionID    string         `json:"session_id"`
         Status       string         `json:"status"`
-        VectorClock  map[string]int `json:"vector_clock"`
-        ProcessedAt  time.Time      `json:"processed_at"`
+        VectorClock  map[string]int64 `json:"vector_clock"`
+        ProcessedAt  *time.Time     `json:"processed_at,omitempty"`
+        // Changes that altered session data vs. those superseded or without effect
+        AppliedCount int            `json:"applied_count"`
+        SkippedCount int            `json:"skipped_count"`
+        // Session's hybrid logical clock after this merge; orders writes where timestamps tie
+        HLC int64 `json:"hlc,omitempty"`
+        // Stored clock entries ahead of the posted clock, when it was behind or concurrent
+        MissingDependencies map[string]int64 `json:"missing_dependencies,omitempty"`
+        // Entries advanced by this merge, for ?clock=delta; not cached or serialized
+        clockDelta map[string]int64
 }
 
 // Evidence submission structures
@@ -53,6 +71,9 @@ type IdempotencyCheck struct {
         ResponseData string    `json:"response_data"`
         StatusCode   int       `json:"status_code"`
         ExpiresAt    time.Time `json:"expires_at"`
+        // Claimed by a request that has not finished yet
+        Pending   bool      `json:"pending"`
+        CreatedAt time.Time `json:"created_at"`
 }
 
 // Database connection pool
@@ -65,16 +86,12 @@ func initDB() error {
                 return fmt.Errorf("DATABASE_URL environment variable not set")
         }
 
-        config, err := pgxpool.ParseConfig(databaseURL)
+        config, err := newPoolConfig(databaseURL)
         if err != nil {
-                return fmt.Errorf("failed to parse database URL: %v", err)
+                return err
         }
-
-        // Configure connection pool settings for production
-        config.MaxConns = 30
-        config.MinConns = 5
-        config.MaxConnLifetime = 1 * time.Hour
-        config.MaxConnIdleTime = 30 * time.Minute
+        // Tenant pools share the default pool's settings
+        tenantPools.base = config.Copy()
 
         dbPool, err = pgxpool.NewWithConfig(context.Background(), config)
         if err != nil {
@@ -90,6 +107,29 @@ func initDB() error {
         return nil
 }
 
+// Parse a database URL into a pool configuration with the service's pool settings
+func newPoolConfig(databaseURL string) (*pgxpool.Config, error) {
+        config, err := pgxpool.ParseConfig(databaseURL)
+        if err != nil {
+                return nil, fmt.Errorf("failed to parse database URL: %v", err)
+        }
+
+        // Configure connection pool settings for production
+        config.MaxConns = 30
+        config.MinConns = 5
+        config.MaxConnLifetime = 1 * time.Hour
+        config.MaxConnIdleTime = 30 * time.Minute
+
+        // Have Postgres abort runaway statements so they cannot pin a pooled connection
+        if cfg.DBStatementTimeout > 0 {
+                config.ConnConfig.RuntimeParams["statement_timeout"] = strconv.FormatInt(cfg.DBStatementTimeout.Milliseconds(), 10)
+        }
+
+        // Evict dead connections (e.g. after a failover) before they reach a query
+        configurePoolHealth(config)
+        return config, nil
+}
+
 // JWT validation middleware for internal service communication
 func validateInternalJWT(next http.HandlerFunc) http.HandlerFunc {
         return func(w http.ResponseWriter, r *http.Request) {
@@ -131,6 +171,34 @@ func validateInternalJWT(next http.HandlerFunc) http.HandlerFunc {
                                 http.Error(w, "Invalid issuer", http.StatusUnauthorized)
                                 return
                         }
+                        r = r.WithContext(withClaims(r.Context(), claims))
+                        if err := checkRouteScopes(r, claims); err != nil {
+                                http.Error(w, err.Error(), http.StatusForbidden)
+                                return
+                        }
+                        if err := checkActingUser(r, claims); err != nil {
+                                http.Error(w, err.Error(), http.StatusForbidden)
+                                return
+                        }
+
+                        // Route the request to its tenant's schema or database
+                        tenantID, err := resolveTenantClaim(claims)
+                        if err == nil && tenantID != "" {
+                                var pool *pgxpool.Pool
+                                if pool, err = tenantPools.Get(r.Context(), tenantID); err == nil {
+                                        r = r.WithContext(withTenant(r.Context(), tenantID, pool))
+                                }
+                        }
+                        if err != nil {
+                                var tenantErr *TenantError
+                                if errors.As(err, &tenantErr) {
+                                        http.Error(w, tenantErr.Error(), http.StatusForbidden)
+                                        return
+                                }
+                                log.Printf("Tenant routing failed: %v", err)
+                                http.Error(w, "Database error", http.StatusInternalServerError)
+                                return
+                        }
                 } else {
                         http.Error(w, "Invalid token claims", http.StatusUnauthorized)
                         return
@@ -140,49 +208,159 @@ func validateInternalJWT(next http.HandlerFunc) http.HandlerFunc {
         }
 }
 
+// Context key for validated internal JWT claims
+type claimsContextKey struct{}
+
+// Attach validated token claims to a request context
+func withClaims(ctx context.Context, claims jwt.MapClaims) context.Context {
+        return context.WithValue(ctx, claimsContextKey{}, claims)
+}
+
+// Validated token claims for the request, or nil outside validateInternalJWT
+func claimsFromContext(ctx context.Context) jwt.MapClaims {
+        claims, _ := ctx.Value(claimsContextKey{}).(jwt.MapClaims)
+        return claims
+}
+
 // Calculate SHA-256 hash
 func calculateSHA256(data []byte) string {
         hash := sha256.Sum256(data)
         return hex.EncodeToString(hash[:])
 }
 
-// Check idempotency
+// Write a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+        body, err := json.Marshal(v)
+        if err != nil {
+                log.Printf("Failed to encode response: %v", err)
+                http.Error(w, "Internal server error", http.StatusInternalServerError)
+                return
+        }
+        body = append(body, '\n')
+
+        w.Header().Set("Content-Type", "application/json")
+        if cfg.JSONReprDigest {
+                w.Header().Set("Repr-Digest", reprDigest(body))
+        }
+        w.WriteHeader(statusCode)
+        w.Write(body)
+}
+
+// Check idempotency, claiming the key for this request when it is unseen. A nil
+// result means the caller holds the claim and must either store its response or
+// release the claim. Concurrent duplicates see the claim as Pending. Expired keys
+// and claims older than IDEMPOTENCY_CLAIM_TTL (abandoned by a crashed request)
+// are reclaimed. Completed keys first stored more than IDEMPOTENCY_KEY_MAX_AGE
+// ago are reclaimed as expired, or rejected with errIdempotencyKeyTooOld, per
+// IDEMPOTENCY_KEY_MAX_AGE_POLICY. A live key presented with a different
+// requestHash is rejected with errIdempotencyKeyReused. userID must name an
+// existing user (errInvalidUserID, errUnknownUser) before anything is claimed.
 func checkIdempotency(ctx context.Context, keyHash, userID, endpoint, requestHash string) (*IdempotencyCheck, error) {
-        var check IdempotencyCheck
+        if err := resolveIdempotencyUser(ctx, userID); err != nil {
+                return nil, err
+        }
 
+        claimQuery := `
+                INSERT INTO idempotency_keys (key_hash, user_id, endpoint, request_hash, expires_at)
+                VALUES ($1, $2, $3, $4, $5)
+                ON CONFLICT (key_hash) DO UPDATE
+                SET user_id = EXCLUDED.user_id, endpoint = EXCLUDED.endpoint, request_hash = EXCLUDED.request_hash,
+                    response_data = NULL, status_code = NULL, created_at = CURRENT_TIMESTAMP, expires_at = EXCLUDED.expires_at
+                WHERE idempotency_keys.expires_at <= CURRENT_TIMESTAMP
+                   OR (idempotency_keys.status_code IS NULL AND idempotency_keys.created_at < $6)
+                   OR ($7 AND idempotency_keys.status_code IS NOT NULL AND idempotency_keys.created_at < $8)
+        `
+        expiresAt := time.Now().Add(24 * time.Hour)
+        staleBefore := time.Now().Add(-cfg.IdempotencyClaimTTL)
+        maxAgeEnabled := cfg.IdempotencyKeyMaxAge > 0
+        tooOldBefore := time.Now().Add(-cfg.IdempotencyKeyMaxAge)
+        reprocessTooOld := maxAgeEnabled && cfg.IdempotencyKeyMaxAgePolicy != idempotencyMaxAgeReject
+
+        var claimed bool
+        err := timeQuery("claim_idempotency", func() error {
+                tag, err := dbFor(ctx).Exec(ctx, claimQuery, keyHash, userID, endpoint, requestHash, expiresAt, staleBefore,
+                        reprocessTooOld, tooOldBefore)
+                claimed = tag.RowsAffected() == 1
+                return err
+        })
+        if err != nil {
+                return nil, fmt.Errorf("failed to check idempotency: %v", err)
+        }
+        if claimed {
+                return nil, nil // No existing request found
+        }
+
+        var check IdempotencyCheck
+        var statusCode *int
         query := `
-                SELECT key_hash, user_id, endpoint, request_hash, response_data, status_code, expires_at
+                SELECT key_hash, COALESCE(user_id::text, ''), endpoint, request_hash, COALESCE(response_data::text, ''), status_code,
+                       expires_at, created_at
                 FROM idempotency_keys 
-                WHERE key_hash = $1 AND expires_at > CURRENT_TIMESTAMP
+                WHERE key_hash = $1
         `
 
-        row := dbPool.QueryRow(ctx, query, keyHash)
-        err := row.Scan(&check.KeyHash, &check.UserID, &check.Endpoint,
-                &check.RequestHash, &check.ResponseData, &check.StatusCode, &check.ExpiresAt)
+        err = timeQuery("check_idempotency", func() error {
+                return dbFor(ctx).QueryRow(ctx, query, keyHash).Scan(&check.KeyHash, &check.UserID, &check.Endpoint,
+                        &check.RequestHash, &check.ResponseData, &statusCode, &check.ExpiresAt, &check.CreatedAt)
+        })
 
         if err == pgx.ErrNoRows {
-                return nil, nil // No existing request found
+                // The claim holder released it between our statements; let the client retry
+                return &IdempotencyCheck{KeyHash: keyHash, Pending: true, CreatedAt: time.Now()}, nil
         }
         if err != nil {
                 return nil, fmt.Errorf("failed to check idempotency: %v", err)
         }
 
+        // A key only replays (or waits on) the request it was claimed for
+        if check.RequestHash != requestHash {
+                return nil, errIdempotencyKeyReused
+        }
+
+        if statusCode == nil {
+                check.Pending = true
+        } else {
+                check.StatusCode = *statusCode
+                if maxAgeEnabled && !reprocessTooOld && check.CreatedAt.Before(tooOldBefore) {
+                        return nil, errIdempotencyKeyTooOld
+                }
+        }
         return &check, nil
 }
 
-// Store idempotency key
+// Release an unfinished claim so the request can be retried
+func releaseIdempotencyKey(ctx context.Context, keyHash string) {
+        if _, err := dbFor(ctx).Exec(ctx, "DELETE FROM idempotency_keys WHERE key_hash = $1 AND status_code IS NULL", keyHash); err != nil {
+                log.Printf("Failed to release idempotency claim: %v", err)
+        }
+}
+
+// Store idempotency key. Responses over IDEMPOTENCY_MAX_RESPONSE_BYTES are
+// replaced by a "not cacheable" marker: the key still records the request as
+// processed, and replays return the marker with the original status.
 func storeIdempotencyKey(ctx context.Context, keyHash, userID, endpoint, requestHash string, responseData interface{}, statusCode int) error {
         responseJSON, _ := json.Marshal(responseData)
+        if limit := cfg.IdempotencyMaxResponseBytes; limit > 0 && int64(len(responseJSON)) > limit {
+                responseJSON, _ = json.Marshal(map[string]interface{}{
+                        "status":         "processed",
+                        "not_cacheable":  true,
+                        "response_bytes": len(responseJSON),
+                })
+        }
         expiresAt := time.Now().Add(24 * time.Hour) // 24 hour expiration
 
         query := `
                 INSERT INTO idempotency_keys (key_hash, user_id, endpoint, request_hash, response_data, status_code, expires_at)
                 VALUES ($1, $2, $3, $4, $5, $6, $7)
-                ON CONFLICT (key_hash) DO NOTHING
+                ON CONFLICT (key_hash) DO UPDATE
+                SET response_data = EXCLUDED.response_data, status_code = EXCLUDED.status_code, expires_at = EXCLUDED.expires_at
+                WHERE idempotency_keys.status_code IS NULL
         `
 
-        _, err := dbPool.Exec(ctx, query, keyHash, userID, endpoint, requestHash, responseJSON, statusCode, expiresAt)
-        return err
+        return timeQuery("store_idempotency_key", func() error {
+                _, err := dbFor(ctx).Exec(ctx, query, keyHash, userID, endpoint, requestHash, responseJSON, statusCode, expiresAt)
+                return err
+        })
 }
 
 // Evidence handling with hash verification
@@ -192,13 +370,93 @@ func handleEvidence(w http.ResponseWriter, r *http.Request) {
                 return
         }
 
+        // Validate headers before touching the body. net/http only sends
+        // "100 Continue" on the first body read, so clients sending
+        // "Expect: 100-continue" never transmit the file for a rejected request.
+        // Content-addressed clients may opt into a key derived from the file
+        // checksum instead of sending Idempotency-Key
+        idempotencyKey := r.Header.Get("Idempotency-Key")
+        keyFromHash, _ := strconv.ParseBool(r.Header.Get("X-Idempotency-From-Hash"))
+        if idempotencyKey == "" && !keyFromHash {
+                http.Error(w, "Idempotency-Key header required", http.StatusBadRequest)
+                return
+        }
+        if idempotencyKey != "" {
+                if err := validateIdempotencyKey(idempotencyKey); err != nil {
+                        http.Error(w, err.Error(), http.StatusBadRequest)
+                        return
+                }
+        }
+
+        userID := r.Header.Get("X-User-ID")
+        if userID == "" {
+                http.Error(w, "X-User-ID header required", http.StatusBadRequest)
+                return
+        }
+
+        if ok, wait := evidenceRateLimiter.Allow(tenantFromContext(r.Context()), userID); !ok {
+                w.Header().Set("Retry-After", retryAfterSeconds(wait))
+                http.Error(w, "Evidence upload rate limit exceeded", http.StatusTooManyRequests)
+                return
+        }
+
+        if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+                http.Error(w, "Content-Type must be multipart/form-data", http.StatusUnsupportedMediaType)
+                return
+        }
+
+        // Reject before reading the body while the evidence store circuit is open
+        if wait := evidenceStoreUnavailableFor(); wait > 0 {
+                w.Header().Set("Retry-After", retryAfterSeconds(wait))
+                http.Error(w, "Evidence store unavailable", http.StatusServiceUnavailable)
+                return
+        }
+
+        // Cap concurrent uploads per session, independently of the per-user rate
+        // limit. Clients naming the session in X-Session-ID or ?session_id= are
+        // turned away before the body is read; otherwise the slot is taken once
+        // the form is parsed.
+        hintedSession := uploadSessionHint(r)
+        if hintedSession != "" {
+                release, ok := acquireSessionUpload(w, r, hintedSession)
+                if !ok {
+                        return
+                }
+                defer release()
+        }
+
+        // The evidence type is a form field, so only the loosest type limit can be
+        // enforced while the body streams in; the exact limit is checked below.
+        // The allowance covers multipart framing and the other form fields.
+        // Stalled transfers are aborted after UPLOAD_IDLE_TIMEOUT without a byte
+        idleBody := limitUploadIdle(w, r)
+        if limit := evidenceBodyLimit(); limit > 0 {
+                r.Body = http.MaxBytesReader(w, r.Body, limit+1<<20)
+        }
+
         // Parse multipart form
         err := r.ParseMultipartForm(10 << 20) // 10MB max
+        idleBody.Done()
+        if idleBody.Stalled() {
+                w.Header().Set("Connection", "close")
+                http.Error(w, "Upload stalled: no data received within the idle timeout", http.StatusRequestTimeout)
+                return
+        }
+        if isBodyTooLarge(err) {
+                http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+                return
+        }
         if err != nil {
                 http.Error(w, "Failed to parse form", http.StatusBadRequest)
                 return
         }
 
+        // Several file parts make a multi-file upload
+        if len(r.MultipartForm.File["file"]) > 1 {
+                handleMultiEvidence(w, r, userID, idempotencyKey, hintedSession)
+                return
+        }
+
         // Get file and hash
         file, fileHeader, err := r.FormFile("file")
         if err != nil {
@@ -219,84 +477,198 @@ func handleEvidence(w http.ResponseWriter, r *http.Request) {
                 return
         }
 
+        release, ok := acquireFormSessionUpload(w, r, sessionID, hintedSession)
+        if !ok {
+                return
+        }
+        defer release()
+
         evidenceType := r.FormValue("evidence_type")
         if evidenceType == "" {
                 http.Error(w, "Evidence type required", http.StatusBadRequest)
                 return
         }
 
-        // Calculate actual hash
-        hasher := sha256.New()
-        if _, err := io.Copy(hasher, file); err != nil {
-                http.Error(w, "Failed to read file", http.StatusInternalServerError)
+        capturedAt, err := parseEvidenceCapturedAt(r.FormValue("captured_at"))
+        if err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
                 return
         }
 
-        actualHash := hex.EncodeToString(hasher.Sum(nil))
-        if actualHash != providedHash {
-                log.Printf("Hash mismatch - provided: %s, actual: %s", providedHash, actualHash)
-                http.Error(w, "Hash mismatch - file integrity check failed", http.StatusBadRequest)
+        if limit := evidenceMaxBytes(evidenceType); limit > 0 && fileHeader.Size > limit {
+                writeEvidenceTooLarge(w, evidenceType, limit)
                 return
         }
 
-        // Get idempotency key and user ID
-        idempotencyKey := r.Header.Get("Idempotency-Key")
-        if idempotencyKey == "" {
-                http.Error(w, "Idempotency-Key header required", http.StatusBadRequest)
+        filename, err := sanitizeEvidenceFilename(fileHeader.Filename)
+        if err != nil {
+                http.Error(w, "Invalid filename: "+err.Error(), http.StatusBadRequest)
                 return
         }
 
-        userID := r.Header.Get("X-User-ID")
-        if userID == "" {
-                http.Error(w, "X-User-ID header required", http.StatusBadRequest)
+        // Calculate actual hash, scanning the same bytes for malware when configured
+        actualHash, threat, err := hashAndScan(r.Context(), evidenceScanner, file)
+        if errors.Is(err, errScanUnavailable) {
+                log.Printf("Evidence scan unavailable: %v", err)
+                http.Error(w, "Evidence scanner unavailable", http.StatusServiceUnavailable)
+                return
+        }
+        if err != nil {
+                log.Printf("Failed to hash/scan evidence: %v", err)
+                http.Error(w, "Failed to read file", http.StatusInternalServerError)
+                return
+        }
+        if threat != "" {
+                log.Printf("Evidence rejected by scanner for session %s: %s", sessionID, threat)
+                writeJSON(w, http.StatusUnprocessableEntity, map[string]string{
+                        "error":  "Evidence rejected by malware scan",
+                        "reason": threat,
+                })
                 return
         }
 
-        keyHash := calculateSHA256([]byte(idempotencyKey))
-        requestHash := calculateSHA256([]byte(fmt.Sprintf("%s:%s:%s:%s", sessionID, evidenceType, providedHash, fileHeader.Filename)))
+        if actualHash != providedHash {
+                log.Printf("Hash mismatch - provided: %s, actual: %s", providedHash, actualHash)
+                handleHashMismatch(context.WithoutCancel(r.Context()), w.Header(), file, QuarantinedEvidence{
+                        SessionID:    sessionID,
+                        UserID:       userID,
+                        EvidenceType: evidenceType,
+                        Filename:     filename,
+                        DeclaredHash: providedHash,
+                        ActualHash:   actualHash,
+                        Size:         fileHeader.Size,
+                })
+                http.Error(w, "Hash mismatch - file integrity check failed", http.StatusBadRequest)
+                return
+        }
+
+        if idempotencyKey == "" {
+                // Identical content re-uploaded to the same session and evidence type deduplicates
+                idempotencyKey = fmt.Sprintf("content:%s:%s:%s", sessionID, evidenceType, actualHash)
+        }
+        keyHash := idempotencyKeyHash(idempotencyKey)
+        requestHash := calculateSHA256([]byte(sessionID + ":" + evidenceType + ":" + evidenceFileFingerprint(providedHash, filename)))
 
         // Check idempotency
-        ctx := context.Background()
+        // Detach from client cancellation but keep request values (tenant routing)
+        ctx := context.WithoutCancel(r.Context())
         existingCheck, err := checkIdempotency(ctx, keyHash, userID, "/v1/evidence", requestHash)
         if err != nil {
-                log.Printf("Idempotency check failed: %v", err)
-                http.Error(w, "Internal server error", http.StatusInternalServerError)
+                writeIdempotencyCheckError(w, err)
                 return
         }
 
+        if existingCheck != nil && existingCheck.Pending {
+                writeIdempotencyInProgress(w, existingCheck)
+                return
+        }
         if existingCheck != nil {
                 // Return cached response
-                w.Header().Set("Content-Type", "application/json")
-                w.WriteHeader(existingCheck.StatusCode)
-                w.Write([]byte(existingCheck.ResponseData))
+                writeReplayedResponse(w, existingCheck.StatusCode, []byte(existingCheck.ResponseData))
                 return
         }
+        // This request holds the key; settle it unless a success response gets cached
+        stored := false
+        setIdempotencyStatus(w, idempotencyStatusOriginal)
+        rec := &errorRecorder{ResponseWriter: w}
+        w = rec
+        defer func() {
+                if !stored {
+                        settleIdempotencyClaim(ctx, keyHash, userID, "/v1/evidence", requestHash, rec)
+                }
+        }()
 
         // Store evidence metadata in database
         evidenceID := uuid.New().String()
 
+        contentType, contentTypeSource, err := resolveEvidenceContentType(file, fileHeader.Header.Get("Content-Type"), filename)
+        if err != nil {
+                http.Error(w, "Failed to read file", http.StatusInternalServerError)
+                return
+        }
+
         // Store basic metadata
         metadata := map[string]interface{}{
-                "original_filename": fileHeader.Filename,
-                "file_size":         fileHeader.Size,
-                "uploaded_by":       userID,
-                "content_type":      fileHeader.Header.Get("Content-Type"),
+                "original_filename":   filename,
+                "file_size":           fileHeader.Size,
+                "uploaded_by":         userID,
+                "content_type":        contentType,
+                "content_type_source": contentTypeSource,
         }
-        metadataJSON, _ := json.Marshal(metadata)
 
-        query := `
-                INSERT INTO evidence (id, session_id, evidence_type, file_path, metadata, checksum, created_at)
-                VALUES ($1, $2, $3, $4, $5, $6, CURRENT_TIMESTAMP)
-        `
+        tx, err := dbFor(ctx).Begin(ctx)
+        if err != nil {
+                log.Printf("Failed to begin evidence transaction: %v", err)
+                http.Error(w, "Database error", http.StatusInternalServerError)
+                return
+        }
+        defer tx.Rollback(ctx)
 
-        _, err = dbPool.Exec(ctx, query, evidenceID, sessionID, evidenceType,
-                fmt.Sprintf("/evidence/%s", evidenceID), string(metadataJSON), actualHash)
+        // Finalized and archived sessions no longer accept evidence
+        if status, err := checkSessionAcceptsEvidence(ctx, tx, sessionID); err != nil {
+                writeSessionCheckError(w, sessionID, status, err)
+                return
+        }
+
+        // Queue the webhook with the evidence row, at most once per idempotency key
+        var webhook []BatchItem
+        if cfg.EvidenceWebhookURL != "" {
+                event := EvidenceEvent{
+                        Event:        "evidence.uploaded",
+                        EvidenceID:   evidenceID,
+                        SessionID:    sessionID,
+                        EvidenceType: evidenceType,
+                        Checksum:     actualHash,
+                        UploadedBy:   userID,
+                        OccurredAt:   time.Now().UTC(),
+                }
+                item, err := outboxEventItem(event.Event, cfg.EvidenceWebhookURL, event, subOperationKey(keyHash, subOpEvidenceWebhook))
+                if err != nil {
+                        log.Printf("Failed to queue evidence webhook: %v", err)
+                        http.Error(w, "Internal server error", http.StatusInternalServerError)
+                        return
+                }
+                item.Ref = evidenceID
+                webhook = append(webhook, item)
+        }
 
+        // Reserve quota, persist the verified bytes and record the evidence row
+        upload := &evidenceUpload{
+                ID:           evidenceID,
+                SessionID:    sessionID,
+                EvidenceType: evidenceType,
+                UserID:       userID,
+                Checksum:     actualHash,
+                Size:         fileHeader.Size,
+                Metadata:     metadata,
+                File:         file,
+                CapturedAt:   capturedAt,
+        }
+        spooled, err := storeEvidenceFile(ctx, tx, upload, webhook...)
+        // The blob is removed again if the row is not committed
+        committed := false
+        defer func() {
+                if !committed {
+                        evidenceStore.Delete(context.Background(), evidenceObjectKey(ctx, evidenceID))
+                }
+        }()
         if err != nil {
-                log.Printf("Database error storing evidence: %v", err)
+                writeEvidenceStoreError(w, err)
+                return
+        }
+
+        if err := tx.Commit(ctx); err != nil {
+                log.Printf("Failed to commit evidence transaction: %v", err)
                 http.Error(w, "Database error", http.StatusInternalServerError)
                 return
         }
+        committed = true
+
+        // Generate thumbnails and other derived artifacts off the request path
+        if len(evidenceProcessors) > 0 {
+                parent := &EvidenceRecord{ID: evidenceID, SessionID: sessionID, EvidenceType: evidenceType}
+                scheduleEvidenceProcessing(ctx, parent, contentType)
+        }
 
         // Prepare response
         response := EvidenceResponse{
@@ -304,16 +676,22 @@ func handleEvidence(w http.ResponseWriter, r *http.Request) {
                 Hash:       actualHash,
                 Status:     "verified",
         }
+        statusCode := http.StatusCreated
+        // Spooled uploads are durable locally but not yet in the evidence store
+        if spooled {
+                response.Status = "pending_storage"
+                statusCode = http.StatusAccepted
+        }
 
         // Store idempotency key
-        if err := storeIdempotencyKey(ctx, keyHash, userID, "/v1/evidence", requestHash, response, http.StatusCreated); err != nil {
+        if err := storeIdempotencyKey(ctx, keyHash, userID, "/v1/evidence", requestHash, response, statusCode); err != nil {
                 log.Printf("Failed to store idempotency key: %v", err)
+        } else {
+                stored = true
         }
 
         // Return response
-        w.Header().Set("Content-Type", "application/json")
-        w.WriteHeader(http.StatusCreated)
-        json.NewEncoder(w).Encode(response)
+        writeJSON(w, statusCode, response)
 }
 
 // CRDT results processing with vector clocks
@@ -330,20 +708,74 @@ func handleCRDTResults(w http.ResponseWriter, r *http.Request) {
                 return
         }
 
+        body, err := io.ReadAll(r.Body)
+        if isBodyTooLarge(err) {
+                http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+                return
+        }
+        if err != nil {
+                http.Error(w, "Failed to read request body", http.StatusBadRequest)
+                return
+        }
+        // Signatures cover the exact body bytes, so verify before any decoding
+        if err := verifyPayloadSignature(r, body); err != nil {
+                writeSignatureError(w, err)
+                return
+        }
+        if err := validateUTF8Body(body); err != nil {
+                http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+                return
+        }
+        if err := validateJSONDepth(body, cfg.MaxJSONDepth); err != nil {
+                http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+                return
+        }
+
         var payload CRDTPayload
-        if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+        if err := json.Unmarshal(body, &payload); err != nil {
                 http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
                 return
         }
+        if err := checkUnknownCRDTFields(body, "payload"); err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+
+        // JSONB cannot store NUL bytes; reject instead of failing the UPDATE
+        if err := validateCRDTPayloadText(&payload); err != nil {
+                http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+                return
+        }
 
         // Validate required fields
         if payload.IdempotencyKey == "" {
                 http.Error(w, "Idempotency key required", http.StatusBadRequest)
                 return
         }
+        if err := validateIdempotencyKey(payload.IdempotencyKey); err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+
+        if err := checkClockOnlyPayload(&payload); err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+        if err := validateVectorClockCounters(payload.VectorClock); err != nil {
+                http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+                return
+        }
+
+        // Unparseable changes are rejected once the user is known and the key is held
+        changes, parseErr := parseChanges(payload.Changes, time.Now().UTC())
 
-        if len(payload.Changes) == 0 {
-                http.Error(w, "Changes required", http.StatusBadRequest)
+        clockView, nodeID, err := parseClockView(r)
+        if err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+        if payload.strategyOverride, err = parseMergeStrategyHeader(r); err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
                 return
         }
 
@@ -354,62 +786,218 @@ func handleCRDTResults(w http.ResponseWriter, r *http.Request) {
                 return
         }
 
+        // Fail fast rather than hold a connection waiting on a hot session's row lock
+        release, ok := sessionMergeLimiter.Acquire(tenantSessionKey(tenantFromContext(r.Context()), sessionID),
+                cfg.SessionMaxConcurrentMerges)
+        if !ok {
+                w.Header().Set("Retry-After", "1")
+                http.Error(w, "Too many concurrent merges for this session", http.StatusTooManyRequests)
+                return
+        }
+        defer release()
+
         // Check idempotency
-        keyHash := calculateSHA256([]byte(payload.IdempotencyKey))
+        keyHash := idempotencyKeyHash(payload.IdempotencyKey)
         changesJSON, _ := json.Marshal(payload.Changes)
         requestHash := calculateSHA256(changesJSON)
         endpoint := fmt.Sprintf("/v1/tests/sessions/%s/results", sessionID)
 
-        ctx := context.Background()
+        // Detach from client cancellation but keep request values (tenant routing)
+        ctx := context.WithoutCancel(r.Context())
         existingCheck, err := checkIdempotency(ctx, keyHash, userID, endpoint, requestHash)
         if err != nil {
-                log.Printf("Idempotency check failed: %v", err)
-                http.Error(w, "Internal server error", http.StatusInternalServerError)
+                writeIdempotencyCheckError(w, err)
                 return
         }
 
+        if existingCheck != nil && existingCheck.Pending {
+                writeIdempotencyInProgress(w, existingCheck)
+                return
+        }
         if existingCheck != nil {
-                // Return cached response
-                w.Header().Set("Content-Type", "application/json")
-                w.WriteHeader(existingCheck.StatusCode)
-                w.Write([]byte(existingCheck.ResponseData))
+                // Return cached response, optionally with the current stored clock
+                responseData := []byte(existingCheck.ResponseData)
+                if cfg.ReplayRefreshVectorClock {
+                        refreshed, err := refreshReplayVectorClock(ctx, sessionID, responseData)
+                        if err != nil {
+                                log.Printf("Failed to refresh replayed vector clock for session %s: %v", sessionID, err)
+                        } else {
+                                responseData = refreshed
+                        }
+                }
+                writeReplayedResponse(w, existingCheck.StatusCode, responseData)
                 return
         }
+        // This request holds the key; settle it unless a success response gets cached
+        stored := false
+        setIdempotencyStatus(w, idempotencyStatusOriginal)
+        rec := &errorRecorder{ResponseWriter: w}
+        w = rec
+        defer func() {
+                if !stored {
+                        settleIdempotencyClaim(ctx, keyHash, userID, endpoint, requestHash, rec)
+                }
+        }()
+        dedupKey := deadLetterDedupKey(keyHash, requestHash)
+
+        if parseErr != nil {
+                deadLetterCRDTPayload(ctx, sessionID, userID, endpoint, dedupKey, &payload, http.StatusUnprocessableEntity, parseErr.Error())
+                http.Error(w, parseErr.Error(), http.StatusUnprocessableEntity)
+                return
+        }
+
+        // Process CRDT changes with vector clock merging inside a transaction,
+        // replayed whole if a database failover aborts it
+        var response *CRDTResponse
+        err = withFailoverRetry(ctx, "crdt_merge", func() error {
+                tx, err := dbFor(ctx).Begin(ctx)
+                if err != nil {
+                        return err
+                }
+                defer tx.Rollback(ctx)
+
+                response, err = mergeCRDTPayload(ctx, tx, sessionID, userID, &payload, changes)
+                if err != nil {
+                        return err
+                }
+                return commitTx(ctx, tx)
+        })
+        if err != nil {
+                deadLetterMergeFailure(ctx, sessionID, userID, endpoint, dedupKey, &payload, err)
+                writeMergeError(w, sessionID, err)
+                return
+        }
+
+        // Wake long-poll watchers on every instance
+        publishSessionChange(ctx, SessionChange{SessionID: sessionID, VectorClock: response.VectorClock})
+
+        // Store idempotency key
+        if err := storeIdempotencyKey(ctx, keyHash, userID, endpoint, requestHash, response, http.StatusOK); err != nil {
+                log.Printf("Failed to store idempotency key: %v", err)
+        } else {
+                stored = true
+        }
+
+        // The full response is cached above; minimal preference only shapes this reply
+        minimizeCRDTResponse(w, r, response)
+        // Likewise the clock view; replays always return the cached full clock
+        applyClockView(response, clockView, nodeID)
 
-        // Process CRDT changes with vector clock merging
+        writeJSON(w, http.StatusOK, response)
+}
+
+// Returned by mergeCRDTPayload when the payload cannot be applied to the session
+type MergeError struct {
+        StatusCode int
+        Message    string
+}
+
+func (e *MergeError) Error() string {
+        return e.Message
+}
+
+// Write the HTTP response for a failed merge
+func writeMergeError(w http.ResponseWriter, sessionID string, err error) {
+        var mergeErr *MergeError
+        if errors.As(err, &mergeErr) {
+                http.Error(w, mergeErr.Message, mergeErr.StatusCode)
+                return
+        }
+        log.Printf("Failed to merge changes into session %s: %v", sessionID, err)
+        http.Error(w, "Database error", http.StatusInternalServerError)
+}
+
+// Merge a CRDT payload into a session within tx, locking the session row for the
+// duration of the read-modify-write
+func mergeCRDTPayload(ctx context.Context, tx pgx.Tx, sessionID, userID string, payload *CRDTPayload, changes []Change) (*CRDTResponse, error) {
         // 1. Retrieve current session data and vector clock
         var currentData map[string]interface{}
-        var currentVectorClock map[string]int
+        var currentVectorClock map[string]int64
 
         query := `
-                SELECT session_data, vector_clock 
+                SELECT session_data, vector_clock, COALESCE(crdt_meta, '{}'), updated_at, COALESCE(merge_strategy, ''),
+                       COALESCE(hlc, 0)
                 FROM test_sessions 
                 WHERE id = $1
+                FOR UPDATE
         `
 
-        var sessionDataJSON, vectorClockJSON string
-        err = dbPool.QueryRow(ctx, query, sessionID).Scan(&sessionDataJSON, &vectorClockJSON)
+        var sessionDataJSON, vectorClockJSON, crdtMetaJSON, sessionStrategy string
+        var lastWrite *time.Time
+        var sessionHLC int64
+        err := timeQuery("crdt_read_session", func() error {
+                return tx.QueryRow(ctx, query, sessionID).Scan(&sessionDataJSON, &vectorClockJSON, &crdtMetaJSON, &lastWrite,
+                        &sessionStrategy, &sessionHLC)
+        })
         if err != nil && err != pgx.ErrNoRows {
-                log.Printf("Failed to retrieve session data: %v", err)
-                http.Error(w, "Database error", http.StatusInternalServerError)
-                return
+                return nil, fmt.Errorf("failed to retrieve session data: %v", err)
         }
 
         // Initialize or parse existing data
         if sessionDataJSON != "" {
                 json.Unmarshal([]byte(sessionDataJSON), &currentData)
-        } else {
+        }
+        if currentData == nil {
                 currentData = make(map[string]interface{})
         }
 
-        if vectorClockJSON != "" {
-                json.Unmarshal([]byte(vectorClockJSON), &currentVectorClock)
-        } else {
-                currentVectorClock = make(map[string]int)
+        // Stored clocks may be in the legacy bare-map or the versioned envelope form
+        currentVectorClock, err = decodeVectorClock([]byte(vectorClockJSON))
+        if err != nil {
+                return nil, fmt.Errorf("failed to decode vector clock: %v", err)
+        }
+
+        // Seed a brand-new session (empty clock) from the requested template
+        if len(currentVectorClock) == 0 && payload.SessionTemplate != "" {
+                template, err := loadSessionTemplate(ctx, payload.SessionTemplate)
+                if err == errUnknownSessionTemplate {
+                        return nil, &MergeError{StatusCode: http.StatusUnprocessableEntity, Message: "Unknown session template"}
+                }
+                if err != nil {
+                        return nil, fmt.Errorf("failed to load session template %s: %v", payload.SessionTemplate, err)
+                }
+                currentData = template.SessionData
+                currentVectorClock = template.VectorClock
+        }
+
+        fieldMeta := make(map[string]FieldMeta)
+        if crdtMetaJSON != "" {
+                json.Unmarshal([]byte(crdtMetaJSON), &fieldMeta)
+        }
+
+        // Use the request's merge strategy, else the session's, falling back to the
+        // configured default
+        strategy := cfg.MergeStrategy
+        if sessionStrategy != "" {
+                if mergeStrategies[sessionStrategy] {
+                        strategy = sessionStrategy
+                } else {
+                        log.Printf("Session %s has unknown merge strategy %q; using %s", sessionID, sessionStrategy, strategy)
+                }
+        }
+        if payload.strategyOverride != "" {
+                strategy = payload.strategyOverride
+                log.Printf("Merging into session %s with requested strategy %s", sessionID, strategy)
+        }
+        if strategy == MergeStrategyLWW {
+                if changes, err = liftLegacyMeta(changes, time.Now().UTC()); err != nil {
+                        return nil, &MergeError{StatusCode: http.StatusUnprocessableEntity, Message: err.Error()}
+                }
+        }
+
+        // Optionally reject changes that arrive too long after the session moved on
+        if grace := cfg.ChangeLateGraceWindow; grace > 0 && lastWrite != nil {
+                if late, age := findLateChange(changes, *lastWrite, grace); late != nil {
+                        return nil, &MergeError{
+                                StatusCode: http.StatusConflict,
+                                Message: fmt.Sprintf("Change to %s is stale: %s older than the session's latest write (grace window %s)",
+                                        late.Path, age.Round(time.Second), grace),
+                        }
+                }
         }
 
         // 2. Merge vector clocks (take maximum for each node)
-        mergedVectorClock := make(map[string]int)
+        mergedVectorClock := make(map[string]int64)
         for k, v := range currentVectorClock {
                 mergedVectorClock[k] = v
         }
@@ -418,48 +1006,98 @@ func handleCRDTResults(w http.ResponseWriter, r *http.Request) {
                         mergedVectorClock[k] = v
                 }
         }
+        if err := advanceServerNode(mergedVectorClock, currentVectorClock, payload.VectorClock); err != nil {
+                return nil, &MergeError{StatusCode: http.StatusConflict, Message: err.Error()}
+        }
 
-        // 3. Apply changes to session data
-        mergedData := currentData
-        for _, change := range payload.Changes {
-                // Simple merge strategy - in production, this would be more sophisticated
-                for k, v := range change {
-                        mergedData[k] = v
+        // Bound clock growth at write time against fabricated node IDs
+        if limit := cfg.MaxVectorClockNodes; limit > 0 && int64(len(mergedVectorClock)) > limit {
+                log.Printf("Rejecting merge into session %s: vector clock would have %d nodes (max %d)",
+                        sessionID, len(mergedVectorClock), limit)
+                return nil, &MergeError{
+                        StatusCode: http.StatusUnprocessableEntity,
+                        Message:    fmt.Sprintf("Vector clock exceeds %d distinct nodes", limit),
+                }
+        }
+
+        // 3. Apply changes to session data using the strategy resolved above
+        var previousData map[string]interface{}
+        if len(preCommitHooks) > 0 {
+                previousData = copySessionData(currentData)
+        }
+        // Record the submitting user as each winning change's provenance, and stamp
+        // changes with the session's HLC in the order they are applied
+        for i := range changes {
+                changes[i].UserID = userID
+        }
+        changes = sortChanges(changes)
+        sessionHLC = stampChanges(changes, sessionHLC, time.Now())
+        mergeState := &MergeState{Data: currentData, Fields: fieldMeta}
+        applied, skipped, err := applyChanges(mergeState, changes, strategy)
+        if err != nil {
+                return nil, &MergeError{StatusCode: http.StatusUnprocessableEntity, Message: err.Error()}
+        }
+
+        // Let configured hooks veto the merge before anything is written
+        if len(preCommitHooks) > 0 {
+                err := runPreCommitHooks(ctx, tx, &MergeProposal{
+                        SessionID:   sessionID,
+                        Changes:     changes,
+                        Current:     previousData,
+                        Proposed:    mergeState.Data,
+                        VectorClock: mergedVectorClock,
+                })
+                if err != nil {
+                        return nil, err
                 }
         }
 
         // 4. Update session in database
-        mergedDataJSON, _ := json.Marshal(mergedData)
-        mergedVectorClockJSON, _ := json.Marshal(mergedVectorClock)
+        mergedDataJSON, _ := json.Marshal(mergeState.Data)
+        mergedVectorClockJSON, _ := encodeVectorClock(mergedVectorClock)
+        fieldMetaJSON, _ := json.Marshal(mergeState.Fields)
 
         updateQuery := `
                 UPDATE test_sessions 
-                SET session_data = $2, vector_clock = $3, updated_at = CURRENT_TIMESTAMP
+                SET session_data = $2, vector_clock = $3, crdt_meta = $4, hlc = $5, updated_at = CURRENT_TIMESTAMP
                 WHERE id = $1
         `
 
-        _, err = dbPool.Exec(ctx, updateQuery, sessionID, string(mergedDataJSON), string(mergedVectorClockJSON))
+        err = timeQuery("crdt_write_session", func() error {
+                _, err := tx.Exec(ctx, updateQuery, sessionID, string(mergedDataJSON), string(mergedVectorClockJSON),
+                        string(fieldMetaJSON), sessionHLC)
+                return err
+        })
         if err != nil {
-                log.Printf("Failed to update session: %v", err)
-                http.Error(w, "Database error", http.StatusInternalServerError)
-                return
+                return nil, fmt.Errorf("failed to update session: %v", err)
         }
 
-        // Prepare response
-        response := CRDTResponse{
-                SessionID:   sessionID,
-                Status:      "processed",
-                VectorClock: mergedVectorClock,
-                ProcessedAt: time.Now().UTC(),
-        }
-
-        // Store idempotency key
-        if err := storeIdempotencyKey(ctx, keyHash, userID, endpoint, requestHash, response, http.StatusOK); err != nil {
-                log.Printf("Failed to store idempotency key: %v", err)
+        processedAt := time.Now().UTC()
+        if cfg.SessionWebhookURL != "" {
+                event := SessionUpdatedEvent{
+                        Event:       "session.updated",
+                        SessionID:   sessionID,
+                        VectorClock: mergedVectorClock,
+                        OccurredAt:  processedAt,
+                }
+                if err := enqueueOutboxEvent(ctx, tx, event.Event, cfg.SessionWebhookURL, event, ""); err != nil {
+                        return nil, fmt.Errorf("failed to queue session webhook: %v", err)
+                }
         }
 
-        w.Header().Set("Content-Type", "application/json")
-        json.NewEncoder(w).Encode(response)
+        return &CRDTResponse{
+                SessionID:    sessionID,
+                Status:       "processed",
+                VectorClock:  mergedVectorClock,
+                ProcessedAt:  &processedAt,
+                AppliedCount: applied,
+                SkippedCount: skipped,
+                HLC:          sessionHLC,
+                clockDelta:   clockDelta(currentVectorClock, mergedVectorClock),
+                // Compared against the clock before this merge: the server's own advance
+                // is a consequence of this request, not a missed update
+                MissingDependencies: missingDependencies(currentVectorClock, payload.VectorClock),
+        }, nil
 }
 
 // Health check handler
@@ -473,6 +1111,19 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
         })
 }
 
+// Register the memory stats endpoint; it exposes heap internals, so it is
+// JWT-protected unless explicitly opened up, and can be disabled
+func registerMemoryEndpoint(router *mux.Router) {
+        if !cfg.MemoryEndpointEnabled {
+                return
+        }
+        if cfg.MemoryEndpointRequireAuth {
+                router.HandleFunc("/memory", validateInternalJWT(memoryStatsHandler)).Methods("GET")
+        } else {
+                router.HandleFunc("/memory", memoryStatsHandler).Methods("GET")
+        }
+}
+
 // Memory stats handler for performance monitoring
 func memoryStatsHandler(w http.ResponseWriter, r *http.Request) {
         var m runtime.MemStats
@@ -489,6 +1140,8 @@ func memoryStatsHandler(w http.ResponseWriter, r *http.Request) {
                 "heap_idle_mb":     bToMb(m.HeapIdle),
                 "heap_inuse_mb":    bToMb(m.HeapInuse),
                 "num_goroutines":   runtime.NumGoroutine(),
+                "open_fds":         openFDCount(),
+                "leak_alerts":      leakDetector.Alerts(),
                 "timestamp":        time.Now().UTC().Format(time.RFC3339),
         }
         
@@ -507,19 +1160,142 @@ func main() {
                 log.Fatalf("Failed to initialize database: %v", err)
         }
         defer dbPool.Close()
+        defer tenantPools.Close()
+
+        // Initialize evidence blob storage
+        store, err := NewFileEvidenceStore(cfg.EvidenceStoreDir)
+        if err != nil {
+                log.Fatalf("Failed to initialize evidence store: %v", err)
+        }
+        evidenceStore = store
+
+        // Fail evidence requests fast while the store keeps failing
+        if cfg.EvidenceStoreBreakerThreshold > 0 {
+                evidenceStoreBreaker = NewCircuitBreaker("evidence_store", cfg.EvidenceStoreBreakerThreshold,
+                        cfg.EvidenceStoreBreakerCooldown, evidenceStoreBreakerState)
+                evidenceStore = NewBreakerEvidenceStore(evidenceStore, evidenceStoreBreaker)
+        }
+
+        // Optionally spool uploads locally while the evidence store is unavailable
+        if cfg.EvidenceSpoolDir != "" {
+                if cfg.EvidenceSpoolReconcileInterval <= 0 {
+                        log.Fatalf("EVIDENCE_SPOOL_RECONCILE_INTERVAL must be positive, got %s", cfg.EvidenceSpoolReconcileInterval)
+                }
+                spooling, err := NewSpoolingEvidenceStore(evidenceStore, cfg.EvidenceSpoolDir)
+                if err != nil {
+                        log.Fatalf("Failed to initialize evidence spool: %v", err)
+                }
+                evidenceStore = spooling
+                go spooling.Run(context.Background(), cfg.EvidenceSpoolReconcileInterval)
+        }
+
+        // Optionally encrypt evidence before it reaches the store (or the spool,
+        // so spooled uploads are never held in plaintext)
+        wrapper, err := newEvidenceKeyWrapperFromConfig()
+        if err != nil {
+                log.Fatalf("Failed to initialize evidence encryption: %v", err)
+        }
+        if wrapper != nil {
+                evidenceStore = NewEncryptingEvidenceStore(evidenceStore, wrapper)
+        }
+
+        // Keep uploads that fail hash verification for investigation when configured
+        if cfg.HashMismatchPolicy == hashMismatchQuarantine {
+                quarantine, err := NewFileEvidenceStore(cfg.EvidenceQuarantineDir)
+                if err != nil {
+                        log.Fatalf("Failed to initialize quarantine store: %v", err)
+                }
+                quarantineStore = quarantine
+        }
+
+        // Initialize optional malware scanning for uploads
+        if evidenceScanner, err = newScannerFromConfig(); err != nil {
+                log.Fatalf("Failed to initialize evidence scanner: %v", err)
+        }
+
+        // Start background workers and post-upload evidence processors
+        workerPool = NewWorkerPool(int(cfg.WorkerPoolSize), int(cfg.WorkerQueueSize))
+        defer workerPool.Close()
+        evidenceProcessors = newEvidenceProcessorsFromConfig()
+        preCommitHooks = newPreCommitHooksFromConfig()
+
+        // Start session change listener for watchers
+        go sessionNotifier.Run(context.Background())
+
+        // Deliver queued webhook events
+        if cfg.OutboxPollInterval <= 0 {
+                log.Fatalf("OUTBOX_POLL_INTERVAL must be positive, got %s", cfg.OutboxPollInterval)
+        }
+        go outboxRelay(context.Background())
+
+        // Obtain RFC 3161 timestamps for uploaded evidence
+        if cfg.TSAURL != "" {
+                if cfg.TSARetryInterval <= 0 {
+                        log.Fatalf("TSA_RETRY_INTERVAL must be positive, got %s", cfg.TSARetryInterval)
+                }
+                go timestampRelay(context.Background())
+        }
+
+        // Sample goroutine and FD counts for leak detection
+        if cfg.LeakSampleInterval > 0 {
+                go leakDetector.Run(context.Background())
+        }
+
+        initMaintenanceMode()
 
         // Create router
         router := mux.NewRouter()
+        router.Use(requestMetricsMiddleware)
+        router.Use(slowRequestProfilerMiddleware)
+        router.Use(serverLoadMiddleware)
+        router.Use(maintenanceMiddleware)
+        router.Use(loadSheddingMiddleware)
+        router.Use(compressionMiddleware)
+        router.Use(decompressionMiddleware)
 
         // Health endpoint (no authentication required)
         router.HandleFunc("/health", healthHandler).Methods("GET")
+        router.HandleFunc("/livez", healthHandler).Methods("GET")
+        router.HandleFunc("/readyz", readyzHandler).Methods("GET")
         
-        // Memory stats endpoint for performance monitoring
-        router.HandleFunc("/memory", memoryStatsHandler).Methods("GET")
+        // Prometheus metrics endpoint, or in-memory JSON stats when Prometheus is disabled
+        // OpenMetrics exposition is required for exemplars (trace IDs on latency buckets)
+        if cfg.PrometheusEnabled {
+                router.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+                        promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}),
+                )).Methods("GET")
+        } else {
+                router.HandleFunc("/stats", statsHandler).Methods("GET")
+        }
+
+        // Sliding-window latency percentiles per endpoint
+        router.HandleFunc("/stats/latency", latencyStatsHandler).Methods("GET")
+
+        registerMemoryEndpoint(router)
 
         // Protected endpoints with JWT middleware
+        router.HandleFunc("/v1/capabilities", validateInternalJWT(handleCapabilities)).Methods("GET")
         router.HandleFunc("/v1/evidence", validateInternalJWT(handleEvidence)).Methods("POST")
+        router.HandleFunc("/v1/evidence/{evidence_id}", validateInternalJWT(handleEvidenceDownload)).Methods("GET", "HEAD")
+        router.HandleFunc("/v1/evidence/{evidence_id}", validateInternalJWT(handleDeleteEvidence)).Methods("DELETE")
+        router.HandleFunc("/v1/evidence/{evidence_id}/metadata", validateInternalJWT(handleEvidenceMetadata)).Methods("GET")
+        router.HandleFunc("/v1/evidence/{evidence_id}/metadata", validateInternalJWT(handleUpdateEvidenceMetadata)).Methods("PATCH")
+        router.HandleFunc("/v1/idempotency/{key}:extend", validateInternalJWT(handleExtendIdempotencyKey)).Methods("POST")
+        router.HandleFunc("/v1/audit", validateInternalJWT(requireAdmin(handleListAudit))).Methods("GET")
+        router.HandleFunc("/v1/admin/dead-letters", validateInternalJWT(requireAdmin(handleListDeadLetters))).Methods("GET")
+        router.HandleFunc("/v1/admin/maintenance", validateInternalJWT(requireAdmin(handleMaintenance))).Methods("GET", "PUT")
+        router.HandleFunc("/v1/admin/dead-letters/{dead_letter_id}/replay", validateInternalJWT(requireAdmin(handleReplayDeadLetter))).Methods("POST")
+        router.HandleFunc("/v1/tests/sessions/{session_id}", validateInternalJWT(handleGetSession)).Methods("GET", "HEAD")
+        router.HandleFunc("/v1/tests/sessions/{session_id}/evidence", validateInternalJWT(handleSearchEvidence)).Methods("GET")
+        router.HandleFunc("/v1/tests/sessions/{session_id}/evidence", validateInternalJWT(handleDeleteSessionEvidence)).Methods("DELETE")
+        router.HandleFunc("/v1/tests/sessions/{session_id}/evidence:bundle", validateInternalJWT(handleEvidenceBundle)).Methods("GET")
         router.HandleFunc("/v1/tests/sessions/{session_id}/results", validateInternalJWT(handleCRDTResults)).Methods("POST")
+        router.HandleFunc("/v1/tests/sessions/{session_id}/results/batch", validateInternalJWT(handleCRDTBatch)).Methods("POST")
+        router.HandleFunc("/v1/tests/sessions/{session_id}/watch", validateInternalJWT(handleWatchSession)).Methods("GET")
+        router.HandleFunc("/v1/tests/sessions/{session_id}/events", validateInternalJWT(handleSessionEvents)).Methods("GET")
+
+        // Structured 404s, built after all routes are registered
+        router.NotFoundHandler = notFoundHandler(router)
 
         // Start profiling server on port 6060
         go func() {
@@ -530,18 +1306,24 @@ func main() {
         }()
 
         // Start main server
+        tlsConfig, err := newServerTLSConfig()
+        if err != nil {
+                log.Fatalf("Invalid TLS configuration: %v", err)
+        }
         port := ":9091"
         log.Printf("Go performance service starting on port %s", port)
 
-        server := &http.Server{
-                Addr:         port,
-                Handler:      router,
-                ReadTimeout:  15 * time.Second,
-                WriteTimeout: 15 * time.Second,
-                IdleTimeout:  60 * time.Second,
+        server, err := newHTTPServer(port, headerLimitHandler(router), tlsConfig)
+        if err != nil {
+                log.Fatalf("Invalid server configuration: %v", err)
         }
 
-        if err := server.ListenAndServe(); err != nil {
+        if tlsConfig != nil {
+                err = server.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+        } else {
+                err = server.ListenAndServe()
+        }
+        if err != nil {
                 log.Fatalf("Server failed to start: %v", err)
         }
 }
\ No newline at end of file
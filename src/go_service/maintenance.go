@@ -0,0 +1,122 @@
+package main
+
+import (
+        "encoding/json"
+        "log"
+        "net/http"
+        "sync/atomic"
+        "time"
+)
+
+// Maintenance mode rejects all traffic except probes and metrics with 503, so
+// orchestration sees the instance as alive (/health, /livez) but not ready
+// (/readyz). It starts from MAINTENANCE_MODE and can be toggled at runtime
+// through the admin endpoint; runtime changes apply to this instance only.
+
+// Current maintenance state
+type MaintenanceState struct {
+        Enabled           bool       `json:"enabled"`
+        Message           string     `json:"message,omitempty"`
+        RetryAfterSeconds int64      `json:"retry_after_seconds"`
+        Since             *time.Time `json:"since,omitempty"`
+}
+
+var maintenanceState atomic.Pointer[MaintenanceState]
+
+// Load the initial maintenance state from configuration
+func initMaintenanceMode() {
+        state := &MaintenanceState{
+                Enabled:           cfg.MaintenanceMode,
+                Message:           cfg.MaintenanceMessage,
+                RetryAfterSeconds: int64(cfg.MaintenanceRetryAfter.Seconds()),
+        }
+        if state.Enabled {
+                now := time.Now().UTC()
+                state.Since = &now
+                log.Printf("Starting in maintenance mode")
+        }
+        maintenanceState.Store(state)
+}
+
+// Current maintenance state, or nil before initMaintenanceMode
+func currentMaintenance() *MaintenanceState {
+        return maintenanceState.Load()
+}
+
+// Paths served during maintenance: probes, metrics and the toggle itself
+func maintenanceExempt(r *http.Request) bool {
+        switch r.URL.Path {
+        case "/health", "/livez", "/readyz", "/metrics", "/stats", "/v1/admin/maintenance":
+                return true
+        }
+        return false
+}
+
+// Reject non-exempt requests with 503 while maintenance mode is on
+func maintenanceMiddleware(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                state := currentMaintenance()
+                if state == nil || !state.Enabled || maintenanceExempt(r) {
+                        next.ServeHTTP(w, r)
+                        return
+                }
+                if state.RetryAfterSeconds > 0 {
+                        w.Header().Set("Retry-After", retryAfterSeconds(time.Duration(state.RetryAfterSeconds)*time.Second))
+                }
+                writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
+                        "error":               "maintenance",
+                        "message":             state.Message,
+                        "retry_after_seconds": state.RetryAfterSeconds,
+                })
+        })
+}
+
+// Report the maintenance state (GET) or replace it (PUT) with
+// {"enabled": bool, "message": "...", "retry_after_seconds": N}; omitted
+// message and retry_after_seconds keep their current values. Admin only.
+func handleMaintenance(w http.ResponseWriter, r *http.Request) {
+        current := currentMaintenance()
+        if r.Method == http.MethodGet {
+                writeJSON(w, http.StatusOK, current)
+                return
+        }
+
+        var body struct {
+                Enabled           *bool   `json:"enabled"`
+                Message           *string `json:"message"`
+                RetryAfterSeconds *int64  `json:"retry_after_seconds"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+                http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+                return
+        }
+        if body.Enabled == nil {
+                http.Error(w, "enabled is required", http.StatusBadRequest)
+                return
+        }
+        if body.RetryAfterSeconds != nil && *body.RetryAfterSeconds < 0 {
+                http.Error(w, "retry_after_seconds must not be negative", http.StatusBadRequest)
+                return
+        }
+
+        next := *current
+        next.Enabled = *body.Enabled
+        if body.Message != nil {
+                next.Message = *body.Message
+        }
+        if body.RetryAfterSeconds != nil {
+                next.RetryAfterSeconds = *body.RetryAfterSeconds
+        }
+        switch {
+        case next.Enabled && !current.Enabled:
+                now := time.Now().UTC()
+                next.Since = &now
+        case !next.Enabled:
+                next.Since = nil
+        }
+        maintenanceState.Store(&next)
+
+        subject, _ := claimsFromContext(r.Context())["sub"].(string)
+        log.Printf("Maintenance mode set to %t by %q", next.Enabled, subject)
+        writeJSON(w, http.StatusOK, &next)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+        "encoding/json"
+        "net/http"
+        "net/http/httptest"
+        "strings"
+        "testing"
+        "time"
+
+        "github.com/gorilla/mux"
+)
+
+// Replace the maintenance state for one test
+func useMaintenance(t *testing.T, state *MaintenanceState) {
+        t.Helper()
+        saved := maintenanceState.Load()
+        maintenanceState.Store(state)
+        t.Cleanup(func() { maintenanceState.Store(saved) })
+}
+
+func maintenanceRouter() *mux.Router {
+        router := mux.NewRouter()
+        router.Use(maintenanceMiddleware)
+        router.HandleFunc("/livez", healthHandler).Methods("GET")
+        router.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("# metrics")) })
+        ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+        router.HandleFunc("/v1/evidence", ok).Methods("POST")
+        router.HandleFunc("/v1/tests/sessions/{session_id}", ok).Methods("GET")
+        return router
+}
+
+func TestMaintenanceModeRejectsTrafficButNotProbes(t *testing.T) {
+        useMaintenance(t, &MaintenanceState{Enabled: true, Message: "Database migration in progress", RetryAfterSeconds: 300})
+        router := maintenanceRouter()
+
+        for _, req := range []struct{ method, path string }{
+                {http.MethodPost, "/v1/evidence"},
+                {http.MethodGet, "/v1/tests/sessions/7f2c"},
+        } {
+                w := httptest.NewRecorder()
+                router.ServeHTTP(w, httptest.NewRequest(req.method, req.path, nil))
+                var body map[string]interface{}
+                json.Unmarshal(w.Body.Bytes(), &body)
+                if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "300" {
+                        t.Errorf("%s %s = %d, Retry-After %q; want 503 with 300", req.method, req.path, w.Code, w.Header().Get("Retry-After"))
+                }
+                if body["error"] != "maintenance" || body["message"] != "Database migration in progress" {
+                        t.Errorf("%s %s body = %s", req.method, req.path, w.Body.String())
+                }
+        }
+
+        for _, path := range []string{"/livez", "/metrics"} {
+                w := httptest.NewRecorder()
+                router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+                if w.Code != http.StatusOK {
+                        t.Errorf("%s = %d during maintenance, want 200", path, w.Code)
+                }
+        }
+}
+
+func TestMaintenanceModeOffPassesTraffic(t *testing.T) {
+        useMaintenance(t, &MaintenanceState{Enabled: false, RetryAfterSeconds: 120})
+        w := httptest.NewRecorder()
+        maintenanceRouter().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/evidence", nil))
+        if w.Code != http.StatusOK {
+                t.Errorf("status = %d, want 200 outside maintenance", w.Code)
+        }
+}
+
+func TestInitMaintenanceModeFromConfig(t *testing.T) {
+        useMaintenance(t, nil)
+        withConfig(t, func(c *Config) {
+                c.MaintenanceMode = true
+                c.MaintenanceMessage = "Quarterly upgrade"
+                c.MaintenanceRetryAfter = 90 * time.Second
+        })
+        captureLog(t)
+        initMaintenanceMode()
+        state := currentMaintenance()
+        if !state.Enabled || state.Message != "Quarterly upgrade" || state.RetryAfterSeconds != 90 || state.Since == nil {
+                t.Errorf("state = %+v, want maintenance from config", state)
+        }
+}
+
+func TestHandleMaintenanceToggle(t *testing.T) {
+        useMaintenance(t, &MaintenanceState{Message: "Back soon", RetryAfterSeconds: 60})
+        captureLog(t)
+        put := func(body string) (*httptest.ResponseRecorder, MaintenanceState) {
+                w := httptest.NewRecorder()
+                handleMaintenance(w, httptest.NewRequest(http.MethodPut, "/v1/admin/maintenance", strings.NewReader(body)))
+                var state MaintenanceState
+                json.Unmarshal(w.Body.Bytes(), &state)
+                return w, state
+        }
+
+        w, state := put(`{"enabled": true, "retry_after_seconds": 600}`)
+        if w.Code != http.StatusOK || !state.Enabled || state.Message != "Back soon" || state.RetryAfterSeconds != 600 || state.Since == nil {
+                t.Errorf("enable = %d %+v, want enabled keeping the message", w.Code, state)
+        }
+        if !currentMaintenance().Enabled {
+                t.Error("maintenance not enabled after PUT")
+        }
+
+        w, state = put(`{"enabled": false}`)
+        if w.Code != http.StatusOK || state.Enabled || state.Since != nil || state.RetryAfterSeconds != 600 {
+                t.Errorf("disable = %d %+v", w.Code, state)
+        }
+
+        for _, body := range []string{`{"message": "no flag"}`, `{"enabled": true, "retry_after_seconds": -5}`, `not json`} {
+                if w, _ := put(body); w.Code != http.StatusBadRequest {
+                        t.Errorf("%s = %d, want 400", body, w.Code)
+                }
+        }
+        if currentMaintenance().Enabled {
+                t.Error("rejected updates changed the state")
+        }
+}
+
+func TestReadyzUnreadyDuringMaintenance(t *testing.T) {
+        testDB(t)
+        withConfig(t, func(c *Config) { c.ReadyzTimeout = time.Second })
+        useTestEvidenceStore(t)
+        useMaintenance(t, &MaintenanceState{Enabled: true})
+
+        w := httptest.NewRecorder()
+        readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+        if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), `"maintenance"`) {
+                t.Errorf("readyz = %d %s, want 503 maintenance", w.Code, w.Body.String())
+        }
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+        "net/http"
+        "net/http/httptest"
+        "testing"
+
+        "github.com/gorilla/mux"
+)
+
+func TestMemoryEndpointExposure(t *testing.T) {
+        tests := []struct {
+                name        string
+                enabled     bool
+                requireAuth bool
+                token       string
+                want        int
+        }{
+                {"protected without token", true, true, "", http.StatusUnauthorized},
+                {"protected with bad token", true, true, "not-a-jwt", http.StatusUnauthorized},
+                {"open", true, false, "", http.StatusOK},
+                {"disabled", false, true, "", http.StatusNotFound},
+                {"disabled and open", false, false, "", http.StatusNotFound},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        withConfig(t, func(c *Config) {
+                                c.MemoryEndpointEnabled = tt.enabled
+                                c.MemoryEndpointRequireAuth = tt.requireAuth
+                        })
+                        t.Setenv("INTERNAL_JWT_SECRET_KEY", "memory-test-secret")
+                        router := mux.NewRouter()
+                        registerMemoryEndpoint(router)
+
+                        r := httptest.NewRequest(http.MethodGet, "/memory", nil)
+                        if tt.token != "" {
+                                r.Header.Set("X-Internal-Authorization", tt.token)
+                        }
+                        w := httptest.NewRecorder()
+                        router.ServeHTTP(w, r)
+                        if w.Code != tt.want {
+                                t.Errorf("GET /memory = %d, want %d", w.Code, tt.want)
+                        }
+                })
+        }
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+        "context"
+        "encoding/hex"
+        "log"
+        "net/http"
+        "strings"
+        "time"
+
+        "github.com/gorilla/mux"
+        "github.com/prometheus/client_golang/prometheus"
+)
+
+// Latency of database queries by logical query name
+var dbQueryDuration = prometheus.NewHistogramVec(
+        prometheus.HistogramOpts{
+                Name:    "db_query_duration_seconds",
+                Help:    "Database query latency by query name.",
+                Buckets: prometheus.DefBuckets,
+        },
+        []string{"query"},
+)
+
+// Latency of HTTP requests by route template and method
+var httpRequestDuration = prometheus.NewHistogramVec(
+        prometheus.HistogramOpts{
+                Name:    "http_request_duration_seconds",
+                Help:    "HTTP request latency by route and method.",
+                Buckets: prometheus.DefBuckets,
+        },
+        []string{"route", "method"},
+)
+
+func init() {
+        prometheus.MustRegister(dbQueryDuration, httpRequestDuration)
+}
+
+// Context key for the W3C trace ID of the request
+type traceIDContextKey struct{}
+
+// Extract the trace ID from a W3C traceparent header ("00-<trace-id>-<span-id>-<flags>")
+func parseTraceParent(header string) (string, bool) {
+        parts := strings.Split(strings.TrimSpace(header), "-")
+        if len(parts) != 4 || len(parts[1]) != 32 || parts[1] == strings.Repeat("0", 32) {
+                return "", false
+        }
+        if _, err := hex.DecodeString(parts[1]); err != nil {
+                return "", false
+        }
+        return strings.ToLower(parts[1]), true
+}
+
+// Trace ID propagated with the request, or ""
+func traceIDFromContext(ctx context.Context) string {
+        traceID, _ := ctx.Value(traceIDContextKey{}).(string)
+        return traceID
+}
+
+// Observe a latency, attaching the trace ID as an exemplar when there is one so
+// dashboards can jump from a latency bucket to the trace
+func observeWithTrace(ctx context.Context, observer prometheus.Observer, seconds float64) {
+        if traceID := traceIDFromContext(ctx); traceID != "" {
+                if eo, ok := observer.(prometheus.ExemplarObserver); ok {
+                        eo.ObserveWithExemplar(seconds, prometheus.Labels{"trace_id": traceID})
+                        return
+                }
+        }
+        observer.Observe(seconds)
+}
+
+// Record request latency per route and response counts, propagating the
+// traceparent trace ID
+func requestMetricsMiddleware(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                if traceID, ok := parseTraceParent(r.Header.Get("traceparent")); ok {
+                        r = r.WithContext(context.WithValue(r.Context(), traceIDContextKey{}, traceID))
+                }
+
+                route := "unmatched"
+                if current := mux.CurrentRoute(r); current != nil {
+                        if tpl, err := current.GetPathTemplate(); err == nil {
+                                route = tpl
+                        }
+                }
+
+                rec := &statusRecorder{ResponseWriter: w}
+                start := time.Now()
+                next.ServeHTTP(rec, r)
+                elapsed := time.Since(start)
+                stats.recordResponse(rec.status)
+                observeWithTrace(r.Context(), httpRequestDuration.WithLabelValues(route, r.Method), elapsed.Seconds())
+                if !longLivedRequest(r) {
+                        latencyTracker.Observe(r.Method+" "+route, elapsed)
+                }
+        })
+}
+
+// Run a named query, recording its latency and logging a warning when it exceeds
+// SLOW_QUERY_THRESHOLD
+func timeQuery(name string, query func() error) error {
+        start := time.Now()
+        err := query()
+        elapsed := time.Since(start)
+
+        dbQueryDuration.WithLabelValues(name).Observe(elapsed.Seconds())
+        if cfg.SlowQueryThreshold > 0 && elapsed >= cfg.SlowQueryThreshold {
+                log.Printf("WARN: slow query %s took %s (threshold %s)", name, elapsed, cfg.SlowQueryThreshold)
+        }
+        return err
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "net/http"
+        "net/http/httptest"
+        "strings"
+        "testing"
+        "time"
+
+        "github.com/gorilla/mux"
+        "github.com/prometheus/client_golang/prometheus"
+        dto "github.com/prometheus/client_model/go"
+)
+
+func TestTimeQueryWarnsOnSlowQuery(t *testing.T) {
+        withConfig(t, func(c *Config) { c.SlowQueryThreshold = 5 * time.Millisecond })
+        logs := captureLog(t)
+
+        errLocked := errors.New("lock not available")
+        err := timeQuery("select_session_for_update", func() error {
+                time.Sleep(10 * time.Millisecond)
+                return errLocked
+        })
+        if err != errLocked {
+                t.Errorf("timeQuery returned %v, want the query's error", err)
+        }
+        if !strings.Contains(logs.String(), "WARN: slow query select_session_for_update") {
+                t.Errorf("no slow query warning logged: %q", logs.String())
+        }
+}
+
+func TestTimeQuerySkipsFastAndDisabled(t *testing.T) {
+        tests := []struct {
+                name      string
+                threshold time.Duration
+                sleep     time.Duration
+        }{
+                {"under threshold", time.Hour, 0},
+                {"disabled", 0, 2 * time.Millisecond},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        withConfig(t, func(c *Config) { c.SlowQueryThreshold = tt.threshold })
+                        logs := captureLog(t)
+                        if err := timeQuery("insert_evidence", func() error {
+                                time.Sleep(tt.sleep)
+                                return nil
+                        }); err != nil {
+                                t.Fatal(err)
+                        }
+                        if logs.Len() != 0 {
+                                t.Errorf("unexpected log output: %q", logs.String())
+                        }
+                })
+        }
+}
+
+func TestParseTraceParent(t *testing.T) {
+        tests := []struct {
+                header string
+                want   string
+                ok     bool
+        }{
+                {"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736", true},
+                {" 00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00 ", "0af7651916cd43dd8448eb211c80319c", true},
+                {"00-00000000000000000000000000000000-b7ad6b7169203331-01", "", false},
+                {"00-0af7651916cd43dd8448eb211c80319z-b7ad6b7169203331-01", "", false},
+                {"00-0af7651916cd43dd-b7ad6b7169203331-01", "", false},
+                {"", "", false},
+        }
+        for _, tt := range tests {
+                got, ok := parseTraceParent(tt.header)
+                if got != tt.want || ok != tt.ok {
+                        t.Errorf("parseTraceParent(%q) = %q, %v; want %q, %v", tt.header, got, ok, tt.want, tt.ok)
+                }
+        }
+}
+
+// Exemplar trace IDs recorded on a histogram, across all buckets
+func exemplarTraceIDs(t *testing.T, metric prometheus.Metric) []string {
+        t.Helper()
+        var m dto.Metric
+        if err := metric.Write(&m); err != nil {
+                t.Fatal(err)
+        }
+        var traceIDs []string
+        for _, bucket := range m.GetHistogram().GetBucket() {
+                for _, label := range bucket.GetExemplar().GetLabel() {
+                        if label.GetName() == "trace_id" {
+                                traceIDs = append(traceIDs, label.GetValue())
+                        }
+                }
+        }
+        return traceIDs
+}
+
+func TestObserveWithTraceRecordsExemplar(t *testing.T) {
+        histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_latency_seconds", Buckets: []float64{0.1, 1}})
+        ctx := context.WithValue(context.Background(), traceIDContextKey{}, "a3ce929d0e0e47364bf92f3577b34da6")
+
+        observeWithTrace(ctx, histogram, 0.25)
+        if got := exemplarTraceIDs(t, histogram); len(got) != 1 || got[0] != "a3ce929d0e0e47364bf92f3577b34da6" {
+                t.Errorf("exemplars = %v, want the current trace ID", got)
+        }
+
+        untraced := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_untraced_seconds", Buckets: []float64{0.1, 1}})
+        observeWithTrace(context.Background(), untraced, 0.25)
+        if got := exemplarTraceIDs(t, untraced); len(got) != 0 {
+                t.Errorf("untraced observation recorded exemplars %v", got)
+        }
+}
+
+func TestRequestMetricsMiddlewareAttachesTraceID(t *testing.T) {
+        router := mux.NewRouter()
+        router.Use(requestMetricsMiddleware)
+        router.HandleFunc("/v1/test-exemplars/{id}", func(w http.ResponseWriter, r *http.Request) {
+                if got := traceIDFromContext(r.Context()); got != "0af7651916cd43dd8448eb211c80319c" {
+                        t.Errorf("handler saw trace ID %q", got)
+                }
+        }).Methods("PUT")
+
+        r := httptest.NewRequest(http.MethodPut, "/v1/test-exemplars/42", nil)
+        r.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+        router.ServeHTTP(httptest.NewRecorder(), r)
+
+        metric := httpRequestDuration.WithLabelValues("/v1/test-exemplars/{id}", http.MethodPut).(prometheus.Metric)
+        if got := exemplarTraceIDs(t, metric); len(got) != 1 || got[0] != "0af7651916cd43dd8448eb211c80319c" {
+                t.Errorf("exemplars = %v, want the traceparent trace ID", got)
+        }
+}
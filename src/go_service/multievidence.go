@@ -0,0 +1,395 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "fmt"
+        "log"
+        "mime/multipart"
+        "net/http"
+        "strconv"
+        "strings"
+        "time"
+
+        "github.com/google/uuid"
+)
+
+// Outcome for one file of a multi-file evidence upload
+type EvidenceFileResult struct {
+        Index      int    `json:"index"`
+        Filename   string `json:"filename"`
+        Status     string `json:"status"` // verified, pending_storage or failed
+        StatusCode int    `json:"status_code"`
+        EvidenceID string `json:"evidence_id,omitempty"`
+        Hash       string `json:"hash,omitempty"`
+        Error      string `json:"error,omitempty"`
+        // Set when the file failed its hash check and was quarantined
+        QuarantineID string `json:"quarantine_id,omitempty"`
+}
+
+// Response for a multi-file evidence upload
+type MultiEvidenceResponse struct {
+        Partial bool                 `json:"partial"`
+        Results []EvidenceFileResult `json:"results"`
+}
+
+// Statements recording one file of a multi-file upload: its evidence rows and,
+// when configured, its webhook deduplicated per file under keyHash. Every item's
+// Ref is the file's index so a failing statement can be reported against it.
+func multiEvidenceRowItems(u *evidenceUpload, index int, keyHash string) ([]BatchItem, error) {
+        ref := strconv.Itoa(index)
+        items := evidenceRowItems(u, ref)
+        if cfg.EvidenceWebhookURL != "" {
+                event := EvidenceEvent{
+                        Event:        "evidence.uploaded",
+                        EvidenceID:   u.ID,
+                        SessionID:    u.SessionID,
+                        EvidenceType: u.EvidenceType,
+                        Checksum:     u.Checksum,
+                        UploadedBy:   u.UserID,
+                        OccurredAt:   time.Now().UTC(),
+                }
+                webhook, err := outboxEventItem(event.Event, cfg.EvidenceWebhookURL, event,
+                        subOperationKey(keyHash, fmt.Sprintf("%s:%d", subOpEvidenceWebhook, index)))
+                if err != nil {
+                        return nil, err
+                }
+                webhook.Ref = ref
+                items = append(items, webhook)
+        }
+        return items, nil
+}
+
+// The file index and cause of a failed multi-file row batch, or -1 when the
+// failure is not attributable to one of count files.
+func failedEvidenceFile(err error, count int) (int, error) {
+        var itemErr *BatchItemError
+        if !errors.As(err, &itemErr) {
+                return -1, err
+        }
+        index, convErr := strconv.Atoi(itemErr.Ref)
+        if convErr != nil || index < 0 || index >= count {
+                return -1, err
+        }
+        return index, itemErr.Err
+}
+
+// Verify one file of a multi-file upload: size limit, filename, malware scan and
+// hash. Returns the open file with result's filename and hash set, or a nil file
+// with result marked failed. Only an unavailable scanner is returned as an error.
+// Files failing the hash check are quarantined per HASH_MISMATCH_POLICY.
+func verifyEvidenceFile(ctx context.Context, fh *multipart.FileHeader, providedHash, sessionID, userID, evidenceType string, result *EvidenceFileResult) (multipart.File, error) {
+        fail := func(status int, message string) (multipart.File, error) {
+                result.Status, result.StatusCode, result.Error = "failed", status, message
+                return nil, nil
+        }
+
+        if limit := evidenceMaxBytes(evidenceType); limit > 0 && fh.Size > limit {
+                return fail(http.StatusRequestEntityTooLarge, fmt.Sprintf("Evidence file too large (max %d bytes)", limit))
+        }
+        filename, err := sanitizeEvidenceFilename(fh.Filename)
+        if err != nil {
+                return fail(http.StatusBadRequest, "Invalid filename: "+err.Error())
+        }
+        result.Filename = filename
+        if providedHash == "" {
+                return fail(http.StatusBadRequest, "SHA256 hash required")
+        }
+
+        file, err := fh.Open()
+        if err != nil {
+                return fail(http.StatusInternalServerError, "Failed to read file")
+        }
+        actualHash, threat, err := hashAndScan(ctx, evidenceScanner, file)
+        if err != nil {
+                file.Close()
+                // An unavailable scanner fails the whole request, in either mode
+                if errors.Is(err, errScanUnavailable) {
+                        return nil, err
+                }
+                log.Printf("Failed to hash/scan evidence: %v", err)
+                return fail(http.StatusInternalServerError, "Failed to read file")
+        }
+        if threat != "" {
+                file.Close()
+                return fail(http.StatusUnprocessableEntity, "Evidence rejected by malware scan: "+threat)
+        }
+        if actualHash != providedHash {
+                result.QuarantineID = handleHashMismatch(context.WithoutCancel(ctx), http.Header{}, file, QuarantinedEvidence{
+                        SessionID:    sessionID,
+                        UserID:       userID,
+                        EvidenceType: evidenceType,
+                        Filename:     filename,
+                        DeclaredHash: providedHash,
+                        ActualHash:   actualHash,
+                        Size:         fh.Size,
+                })
+                file.Close()
+                return fail(http.StatusBadRequest, "Hash mismatch - file integrity check failed")
+        }
+        result.Hash = actualHash
+        return file, nil
+}
+
+// Store several files (repeated "file" parts, each with a "sha256_hash" value in
+// the same order) for one session and evidence type. By default the upload is
+// atomic: any failing file fails the request and nothing is stored. With
+// ?partial=true the files that verify and store are kept and 207 Multi-Status
+// reports every file's outcome. The per-file outcomes are cached under the
+// idempotency key, so a retry replays the same partial result.
+func handleMultiEvidence(w http.ResponseWriter, r *http.Request, userID, idempotencyKey, hintedSession string) {
+        files := r.MultipartForm.File["file"]
+        hashes := r.MultipartForm.Value["sha256_hash"]
+        if len(hashes) != len(files) {
+                http.Error(w, "One sha256_hash is required per file", http.StatusBadRequest)
+                return
+        }
+        partial, _ := strconv.ParseBool(r.URL.Query().Get("partial"))
+
+        sessionID := r.FormValue("session_id")
+        if sessionID == "" {
+                http.Error(w, "Session ID required", http.StatusBadRequest)
+                return
+        }
+        release, ok := acquireFormSessionUpload(w, r, sessionID, hintedSession)
+        if !ok {
+                return
+        }
+        defer release()
+
+        evidenceType := r.FormValue("evidence_type")
+        if evidenceType == "" {
+                http.Error(w, "Evidence type required", http.StatusBadRequest)
+                return
+        }
+
+        // One capture time applies to every file in the upload
+        capturedAt, err := parseEvidenceCapturedAt(r.FormValue("captured_at"))
+        if err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+
+        // Verify every file before claiming the idempotency key
+        results := make([]EvidenceFileResult, len(files))
+        opened := make([]multipart.File, len(files))
+        defer func() {
+                for _, f := range opened {
+                        if f != nil {
+                                f.Close()
+                        }
+                }
+        }()
+        firstFailure := -1
+        for i, fh := range files {
+                results[i] = EvidenceFileResult{Index: i, Filename: fh.Filename}
+                file, err := verifyEvidenceFile(r.Context(), fh, hashes[i], sessionID, userID, evidenceType, &results[i])
+                if err != nil {
+                        log.Printf("Evidence scan unavailable: %v", err)
+                        http.Error(w, "Evidence scanner unavailable", http.StatusServiceUnavailable)
+                        return
+                }
+                opened[i] = file
+                if file == nil && firstFailure < 0 {
+                        firstFailure = i
+                }
+        }
+        if firstFailure >= 0 && !partial {
+                writeJSON(w, results[firstFailure].StatusCode, map[string]interface{}{
+                        "error":   "Evidence upload rejected",
+                        "results": results,
+                })
+                return
+        }
+
+        // The key and request hash cover every file and the mode
+        var fingerprint strings.Builder
+        fmt.Fprintf(&fingerprint, "%s:%s:partial=%t", sessionID, evidenceType, partial)
+        for i := range files {
+                fmt.Fprintf(&fingerprint, ":%s", evidenceFileFingerprint(hashes[i], results[i].Filename))
+        }
+        if idempotencyKey == "" {
+                idempotencyKey = "content:" + calculateSHA256([]byte(fingerprint.String()))
+        }
+        keyHash := idempotencyKeyHash(idempotencyKey)
+        requestHash := calculateSHA256([]byte(fingerprint.String()))
+
+        ctx := context.WithoutCancel(r.Context())
+        existingCheck, err := checkIdempotency(ctx, keyHash, userID, "/v1/evidence", requestHash)
+        if err != nil {
+                writeIdempotencyCheckError(w, err)
+                return
+        }
+        if existingCheck != nil && existingCheck.Pending {
+                writeIdempotencyInProgress(w, existingCheck)
+                return
+        }
+        if existingCheck != nil {
+                writeReplayedResponse(w, existingCheck.StatusCode, []byte(existingCheck.ResponseData))
+                return
+        }
+        stored := false
+        setIdempotencyStatus(w, idempotencyStatusOriginal)
+        rec := &errorRecorder{ResponseWriter: w}
+        w = rec
+        defer func() {
+                if !stored {
+                        settleIdempotencyClaim(ctx, keyHash, userID, "/v1/evidence", requestHash, rec)
+                }
+        }()
+
+        tx, err := dbFor(ctx).Begin(ctx)
+        if err != nil {
+                log.Printf("Failed to begin evidence transaction: %v", err)
+                http.Error(w, "Database error", http.StatusInternalServerError)
+                return
+        }
+        defer tx.Rollback(ctx)
+
+        if status, err := checkSessionAcceptsEvidence(ctx, tx, sessionID); err != nil {
+                writeSessionCheckError(w, sessionID, status, err)
+                return
+        }
+
+        // Blobs of files whose rows are not committed are removed again
+        var storedIDs []string
+        committed := false
+        defer func() {
+                if !committed {
+                        for _, id := range storedIDs {
+                                evidenceStore.Delete(context.Background(), evidenceObjectKey(ctx, id))
+                        }
+                }
+        }()
+
+        // Each file's rows and webhook are queued as batch items tagged with the file's
+        // index. In partial mode they are sent per file inside its savepoint; otherwise
+        // every file's rows are pipelined in one round trip once all bytes are stored.
+        contentTypes := make([]string, len(files))
+        spooled := make([]bool, len(files))
+        var rows []BatchItem
+        for i, fh := range files {
+                if opened[i] == nil {
+                        continue
+                }
+                contentType, contentTypeSource, err := resolveEvidenceContentType(opened[i], fh.Header.Get("Content-Type"), results[i].Filename)
+                if err != nil {
+                        contentType, contentTypeSource = "application/octet-stream", contentTypeSourceDefault
+                }
+                contentTypes[i] = contentType
+                evidenceID := uuid.New().String()
+                upload := &evidenceUpload{
+                        ID:           evidenceID,
+                        SessionID:    sessionID,
+                        EvidenceType: evidenceType,
+                        UserID:       userID,
+                        Checksum:     results[i].Hash,
+                        Size:         fh.Size,
+                        Metadata: map[string]interface{}{
+                                "original_filename":   results[i].Filename,
+                                "file_size":           fh.Size,
+                                "uploaded_by":         userID,
+                                "content_type":        contentType,
+                                "content_type_source": contentTypeSource,
+                        },
+                        File:       opened[i],
+                        CapturedAt: capturedAt,
+                }
+
+                // In partial mode each file runs in a savepoint so one failure leaves the others intact
+                fileTx := tx
+                if partial {
+                        if fileTx, err = tx.Begin(ctx); err != nil {
+                                log.Printf("Failed to begin evidence savepoint: %v", err)
+                                http.Error(w, "Database error", http.StatusInternalServerError)
+                                return
+                        }
+                }
+                storedIDs = append(storedIDs, evidenceID)
+                spooled[i], err = storeEvidenceBlob(ctx, fileTx, upload)
+                var fileRows []BatchItem
+                if err == nil {
+                        fileRows, err = multiEvidenceRowItems(upload, i, keyHash)
+                }
+                if err == nil && partial {
+                        if err = execBatch(ctx, fileTx, fileRows); err == nil {
+                                err = fileTx.Commit(ctx)
+                        }
+                }
+                if err != nil {
+                        if !partial {
+                                writeEvidenceStoreError(w, err)
+                                return
+                        }
+                        fileTx.Rollback(ctx)
+                        evidenceStore.Delete(context.Background(), evidenceObjectKey(ctx, evidenceID))
+                        storedIDs = storedIDs[:len(storedIDs)-1]
+                        results[i].Status = "failed"
+                        results[i].StatusCode, results[i].Error = evidenceStoreErrorStatus(err)
+                        continue
+                }
+                if !partial {
+                        rows = append(rows, fileRows...)
+                }
+                results[i].EvidenceID = evidenceID
+        }
+
+        // A failing row rejects the atomic upload and is reported against its file
+        if err := execBatch(ctx, tx, rows); err != nil {
+                index, fileErr := failedEvidenceFile(err, len(results))
+                if index < 0 {
+                        log.Printf("Failed to record evidence for session %s: %v", sessionID, err)
+                        http.Error(w, "Database error", http.StatusInternalServerError)
+                        return
+                }
+                log.Printf("Failed to record evidence file %d of session %s: %v", index, sessionID, fileErr)
+                for i := range results {
+                        results[i].EvidenceID = ""
+                }
+                results[index].Status = "failed"
+                results[index].StatusCode, results[index].Error = evidenceStoreErrorStatus(fileErr)
+                writeJSON(w, results[index].StatusCode, map[string]interface{}{
+                        "error":   "Evidence upload rejected",
+                        "results": results,
+                })
+                return
+        }
+
+        for i := range results {
+                if results[i].EvidenceID == "" {
+                        continue
+                }
+                results[i].Status, results[i].StatusCode = "verified", http.StatusCreated
+                if spooled[i] {
+                        results[i].Status, results[i].StatusCode = "pending_storage", http.StatusAccepted
+                }
+        }
+
+        if err := tx.Commit(ctx); err != nil {
+                log.Printf("Failed to commit evidence transaction: %v", err)
+                http.Error(w, "Database error", http.StatusInternalServerError)
+                return
+        }
+        committed = true
+
+        if len(evidenceProcessors) > 0 {
+                for i, result := range results {
+                        if result.EvidenceID != "" {
+                                parent := &EvidenceRecord{ID: result.EvidenceID, SessionID: sessionID, EvidenceType: evidenceType}
+                                scheduleEvidenceProcessing(ctx, parent, contentTypes[i])
+                        }
+                }
+        }
+
+        response := MultiEvidenceResponse{Partial: partial, Results: results}
+        statusCode := http.StatusCreated
+        if partial {
+                statusCode = http.StatusMultiStatus
+        }
+        if err := storeIdempotencyKey(ctx, keyHash, userID, "/v1/evidence", requestHash, response, statusCode); err != nil {
+                log.Printf("Failed to store idempotency key: %v", err)
+        } else {
+                stored = true
+        }
+        writeJSON(w, statusCode, response)
+}
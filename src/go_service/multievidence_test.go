@@ -0,0 +1,214 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "encoding/json"
+        "errors"
+        "mime/multipart"
+        "net/http"
+        "net/http/httptest"
+        "reflect"
+        "strings"
+        "testing"
+)
+
+// One file part of a multi-file upload, with the hash declared for it
+type multiEvidenceFile struct {
+        filename string
+        content  []byte
+        hash     string
+}
+
+// Build a multi-file upload keeping the files and their hashes in order
+func multiEvidenceRequest(t *testing.T, sessionID, query string, files []multiEvidenceFile) *http.Request {
+        t.Helper()
+        var body bytes.Buffer
+        form := multipart.NewWriter(&body)
+        form.WriteField("session_id", sessionID)
+        form.WriteField("evidence_type", "photo")
+        for _, f := range files {
+                form.WriteField("sha256_hash", f.hash)
+        }
+        for _, f := range files {
+                part, err := form.CreateFormFile("file", f.filename)
+                if err != nil {
+                        t.Fatal(err)
+                }
+                part.Write(f.content)
+        }
+        form.Close()
+
+        r := httptest.NewRequest(http.MethodPost, "/v1/evidence"+query, &body)
+        r.Header.Set("Content-Type", form.FormDataContentType())
+        r.Header.Set("Idempotency-Key", "multi-"+t.Name())
+        r.Header.Set("X-User-ID", "inspector-"+t.Name())
+        return r
+}
+
+func validEvidenceFile(filename, content string) multiEvidenceFile {
+        return multiEvidenceFile{filename, []byte(content), calculateSHA256([]byte(content))}
+}
+
+func TestMultiEvidenceAtomicByDefault(t *testing.T) {
+        files := []multiEvidenceFile{
+                validEvidenceFile("riser-1.jpg", "riser gauge 65 psi"),
+                {"riser-2.jpg", []byte("riser gauge 60 psi"), calculateSHA256([]byte("something else"))},
+                validEvidenceFile("riser-3.jpg", "riser gauge 62 psi"),
+        }
+        w := httptest.NewRecorder()
+        handleEvidence(w, multiEvidenceRequest(t, "c2d8a4f0-1b3e-4e7a-9f65-0d9e8b7c6a51", "", files))
+        if w.Code != http.StatusBadRequest {
+                t.Fatalf("status = %d %s, want the failing file's 400", w.Code, w.Body.String())
+        }
+        var body struct {
+                Results []EvidenceFileResult `json:"results"`
+        }
+        if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+                t.Fatal(err)
+        }
+        if len(body.Results) != 3 || body.Results[1].Status != "failed" || body.Results[0].EvidenceID != "" {
+                t.Errorf("results = %+v, want file 1 failed and nothing stored", body.Results)
+        }
+}
+
+func TestMultiEvidenceRequiresHashPerFile(t *testing.T) {
+        files := []multiEvidenceFile{
+                validEvidenceFile("hose-reel-a.jpg", "hose reel A"),
+                validEvidenceFile("hose-reel-b.jpg", "hose reel B"),
+        }
+        r := multiEvidenceRequest(t, "c2d8a4f0-1b3e-4e7a-9f65-0d9e8b7c6a51", "", files)
+        r.ParseMultipartForm(1 << 20)
+        r.MultipartForm.Value["sha256_hash"] = r.MultipartForm.Value["sha256_hash"][:1]
+        w := httptest.NewRecorder()
+        handleMultiEvidence(w, r, "inspector-1", "multi-hash-count", "")
+        if w.Code != http.StatusBadRequest {
+                t.Errorf("status = %d, want 400", w.Code)
+        }
+}
+
+func TestMultiEvidencePartialMode(t *testing.T) {
+        pool := testDB(t)
+        useTestEvidenceStore(t)
+        sessionID := insertTestSession(t, pool, nil, nil)
+        userID := insertTestUser(t, pool, "partial-upload")
+        files := []multiEvidenceFile{
+                validEvidenceFile("exit-sign-north.jpg", "illuminated"),
+                {"exit-sign-south.jpg", []byte("flickering"), calculateSHA256([]byte("illuminated"))},
+                {"exit-sign\tEAST.jpg", []byte("dark"), calculateSHA256([]byte("dark"))},
+                validEvidenceFile("exit-sign-west.jpg", "illuminated, battery tested"),
+        }
+
+        upload := func() (*httptest.ResponseRecorder, MultiEvidenceResponse) {
+                r := multiEvidenceRequest(t, sessionID, "?partial=true", files)
+                r.Header.Set("X-User-ID", userID)
+                w := httptest.NewRecorder()
+                handleEvidence(w, r)
+                var response MultiEvidenceResponse
+                json.Unmarshal(w.Body.Bytes(), &response)
+                return w, response
+        }
+
+        w, first := upload()
+        if w.Code != http.StatusMultiStatus {
+                t.Fatalf("status = %d %s, want 207", w.Code, w.Body.String())
+        }
+        wantCodes := []int{http.StatusCreated, http.StatusBadRequest, http.StatusBadRequest, http.StatusCreated}
+        for i, result := range first.Results {
+                if result.StatusCode != wantCodes[i] {
+                        t.Errorf("file %d: status %d (%s), want %d", i, result.StatusCode, result.Error, wantCodes[i])
+                }
+                if stored := result.EvidenceID != ""; stored != (wantCodes[i] == http.StatusCreated) {
+                        t.Errorf("file %d: evidence ID %q", i, result.EvidenceID)
+                }
+        }
+        var count int
+        pool.QueryRow(context.Background(), "SELECT count(*) FROM evidence WHERE session_id = $1", sessionID).Scan(&count)
+        if count != 2 {
+                t.Errorf("%d evidence rows, want the 2 valid files", count)
+        }
+
+        // A retry replays the same per-file outcome without storing again
+        w, retry := upload()
+        if w.Code != http.StatusMultiStatus || !reflect.DeepEqual(retry, first) {
+                t.Errorf("retry = %d %+v, want the original 207 %+v", w.Code, retry, first)
+        }
+        pool.QueryRow(context.Background(), "SELECT count(*) FROM evidence WHERE session_id = $1", sessionID).Scan(&count)
+        if count != 2 {
+                t.Errorf("%d evidence rows after retry, want 2", count)
+        }
+}
+
+func TestMultiEvidenceRowItemsTagFile(t *testing.T) {
+        withConfig(t, func(c *Config) { c.EvidenceWebhookURL = "https://hooks.example.com/evidence" })
+        upload := &evidenceUpload{ID: "evidence-2", SessionID: "session-1", EvidenceType: "photo", UserID: "inspector-1", Checksum: "abc"}
+        items, err := multiEvidenceRowItems(upload, 2, "key-hash")
+        if err != nil {
+                t.Fatal(err)
+        }
+        for _, item := range items {
+                if item.Ref != "2" {
+                        t.Errorf("item %q has Ref %q, want the file index", strings.TrimSpace(item.SQL), item.Ref)
+                }
+        }
+        webhook := items[len(items)-1]
+        if !strings.Contains(webhook.SQL, "INSERT INTO outbox") {
+                t.Fatalf("last item = %s, want the webhook", webhook.SQL)
+        }
+        if key := webhook.Args[3].(*string); *key != subOperationKey("key-hash", subOpEvidenceWebhook+":2") {
+                t.Errorf("dedup key = %q, want the file's sub-operation key", *key)
+        }
+}
+
+func TestFailedEvidenceFile(t *testing.T) {
+        cause := errors.New("duplicate key")
+        cases := []struct {
+                name  string
+                err   error
+                index int
+        }{
+                {"item failure", &BatchItemError{Index: 4, Ref: "1", Err: cause}, 1},
+                {"unindexed item", &BatchItemError{Index: 0, Ref: "session", Err: cause}, -1},
+                {"index out of range", &BatchItemError{Index: 9, Ref: "3", Err: cause}, -1},
+                {"connection failure", cause, -1},
+        }
+        for _, tc := range cases {
+                index, err := failedEvidenceFile(tc.err, 3)
+                if index != tc.index {
+                        t.Errorf("%s: index = %d, want %d", tc.name, index, tc.index)
+                }
+                if index >= 0 && err != cause {
+                        t.Errorf("%s: err = %v, want the item's cause", tc.name, err)
+                }
+        }
+}
+
+func TestMultiEvidenceAtomicRecordsEveryFile(t *testing.T) {
+        pool := testDB(t)
+        useTestEvidenceStore(t)
+        withConfig(t, func(c *Config) { c.EvidenceWebhookURL = "https://hooks.example.com/evidence" })
+        sessionID := insertTestSession(t, pool, nil, nil)
+        userID := insertTestUser(t, pool, "atomic-upload")
+        files := []multiEvidenceFile{
+                validEvidenceFile("valve-1.jpg", "valve open"),
+                validEvidenceFile("valve-2.jpg", "valve chained"),
+                validEvidenceFile("valve-3.jpg", "valve tagged"),
+        }
+        r := multiEvidenceRequest(t, sessionID, "", files)
+        r.Header.Set("X-User-ID", userID)
+        w := httptest.NewRecorder()
+        handleEvidence(w, r)
+        if w.Code != http.StatusCreated {
+                t.Fatalf("status = %d %s, want 201", w.Code, w.Body.String())
+        }
+
+        ctx := context.Background()
+        var evidence, audits, webhooks int
+        pool.QueryRow(ctx, "SELECT count(*) FROM evidence WHERE session_id = $1", sessionID).Scan(&evidence)
+        pool.QueryRow(ctx, `SELECT count(*) FROM audit_log WHERE action = $1 AND resource_id IN
+                (SELECT id FROM evidence WHERE session_id = $2)`, auditActionEvidenceUpload, sessionID).Scan(&audits)
+        pool.QueryRow(ctx, "SELECT count(*) FROM outbox WHERE payload->>'session_id' = $1", sessionID).Scan(&webhooks)
+        if evidence != 3 || audits != 3 || webhooks != 3 {
+                t.Errorf("%d evidence rows, %d audit entries, %d webhooks, want 3 of each", evidence, audits, webhooks)
+        }
+}
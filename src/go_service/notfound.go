@@ -0,0 +1,81 @@
+package main
+
+import (
+        "net/http"
+        "strings"
+
+        "github.com/gorilla/mux"
+)
+
+// Build a 404 handler that suggests the closest registered route for near-miss
+// paths (e.g. /v1/evidences -> /v1/evidence) when ROUTE_SUGGESTIONS_ENABLED is set
+func notFoundHandler(router *mux.Router) http.HandlerFunc {
+        var templates []string
+        router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+                if tpl, err := route.GetPathTemplate(); err == nil {
+                        templates = append(templates, tpl)
+                }
+                return nil
+        })
+
+        return func(w http.ResponseWriter, r *http.Request) {
+                body := map[string]interface{}{
+                        "error": "Not found",
+                        "path":  r.URL.Path,
+                }
+                if cfg.RouteSuggestionsEnabled {
+                        if suggestion, ok := closestRoute(r.URL.Path, templates, int(cfg.RouteSuggestionMaxDistance)); ok {
+                                body["did_you_mean"] = suggestion
+                        }
+                }
+                writeJSON(w, http.StatusNotFound, body)
+        }
+}
+
+// Find the route template closest to path within maxDistance edits. Template
+// variables match whatever segment the path has in that position.
+func closestRoute(path string, templates []string, maxDistance int) (string, bool) {
+        best, bestDistance := "", maxDistance+1
+        pathSegments := strings.Split(path, "/")
+        for _, tpl := range templates {
+                tplSegments := strings.Split(tpl, "/")
+                candidate := tpl
+                if len(tplSegments) == len(pathSegments) {
+                        filled := make([]string, len(tplSegments))
+                        for i, seg := range tplSegments {
+                                if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+                                        filled[i] = pathSegments[i]
+                                } else {
+                                        filled[i] = seg
+                                }
+                        }
+                        candidate = strings.Join(filled, "/")
+                }
+                if d := levenshtein(path, candidate); d < bestDistance {
+                        best, bestDistance = candidate, d
+                }
+        }
+        return best, best != "" && bestDistance > 0
+}
+
+// Edit distance between a and b
+func levenshtein(a, b string) int {
+        ra, rb := []rune(a), []rune(b)
+        prev := make([]int, len(rb)+1)
+        curr := make([]int, len(rb)+1)
+        for j := range prev {
+                prev[j] = j
+        }
+        for i := 1; i <= len(ra); i++ {
+                curr[0] = i
+                for j := 1; j <= len(rb); j++ {
+                        cost := 1
+                        if ra[i-1] == rb[j-1] {
+                                cost = 0
+                        }
+                        curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+                }
+                prev, curr = curr, prev
+        }
+        return prev[len(rb)]
+}
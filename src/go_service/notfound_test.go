@@ -0,0 +1,92 @@
+package main
+
+import (
+        "encoding/json"
+        "net/http"
+        "net/http/httptest"
+        "testing"
+
+        "github.com/gorilla/mux"
+)
+
+// Router with a handful of the service's real route shapes
+func suggestionTestRouter() *mux.Router {
+        router := mux.NewRouter()
+        noop := func(w http.ResponseWriter, r *http.Request) {}
+        router.HandleFunc("/v1/evidence", noop).Methods("POST")
+        router.HandleFunc("/v1/evidence/{evidence_id}", noop).Methods("GET")
+        router.HandleFunc("/v1/tests/sessions/{session_id}/results", noop).Methods("POST")
+        router.HandleFunc("/health", noop).Methods("GET")
+        router.NotFoundHandler = notFoundHandler(router)
+        return router
+}
+
+func getNotFound(t *testing.T, router *mux.Router, path string) map[string]interface{} {
+        t.Helper()
+        w := httptest.NewRecorder()
+        router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+        if w.Code != http.StatusNotFound {
+                t.Fatalf("GET %s = %d, want 404", path, w.Code)
+        }
+        var body map[string]interface{}
+        if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+                t.Fatalf("404 body is not JSON: %q", w.Body.String())
+        }
+        return body
+}
+
+func TestNotFoundSuggestsClosestRoute(t *testing.T) {
+        withConfig(t, func(c *Config) {
+                c.RouteSuggestionsEnabled = true
+                c.RouteSuggestionMaxDistance = 3
+        })
+        router := suggestionTestRouter()
+
+        tests := []struct {
+                path string
+                want string
+        }{
+                {"/v1/evidences", "/v1/evidence"},
+                {"/v1/test/sessions/8c1e/results", "/v1/tests/sessions/8c1e/results"},
+                {"/v1/tests/sessions/8c1e/result", "/v1/tests/sessions/8c1e/results"},
+                {"/healthz", "/health"},
+        }
+        for _, tt := range tests {
+                body := getNotFound(t, router, tt.path)
+                if body["did_you_mean"] != tt.want {
+                        t.Errorf("%s: did_you_mean = %v, want %s", tt.path, body["did_you_mean"], tt.want)
+                }
+                if body["error"] != "Not found" || body["path"] != tt.path {
+                        t.Errorf("%s: body = %v", tt.path, body)
+                }
+        }
+
+        if body := getNotFound(t, router, "/admin/backup/restore"); body["did_you_mean"] != nil {
+                t.Errorf("unrelated path got suggestion %v", body["did_you_mean"])
+        }
+}
+
+func TestNotFoundSuggestionsDisabled(t *testing.T) {
+        withConfig(t, func(c *Config) { c.RouteSuggestionsEnabled = false })
+        if body := getNotFound(t, suggestionTestRouter(), "/v1/evidences"); body["did_you_mean"] != nil {
+                t.Errorf("suggestion %v returned while disabled", body["did_you_mean"])
+        }
+}
+
+func TestLevenshtein(t *testing.T) {
+        tests := []struct {
+                a, b string
+                want int
+        }{
+                {"", "", 0},
+                {"evidence", "evidences", 1},
+                {"sessions", "sesions", 1},
+                {"kitten", "sitting", 3},
+                {"zoné", "zone", 1},
+        }
+        for _, tt := range tests {
+                if got := levenshtein(tt.a, tt.b); got != tt.want {
+                        t.Errorf("levenshtein(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+                }
+        }
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "log"
+        "sync"
+        "time"
+)
+
+// Postgres channel carrying session change notifications
+const sessionChangesChannel = "session_changes"
+
+// Notification payload emitted on each accepted CRDT write
+type SessionChange struct {
+        TenantID    string           `json:"tenant_id,omitempty"`
+        SessionID   string           `json:"session_id"`
+        VectorClock map[string]int64 `json:"vector_clock,omitempty"`
+}
+
+// Fans out LISTEN/NOTIFY session change events to in-process subscribers
+type SessionNotifier struct {
+        mu   sync.Mutex
+        subs map[string]map[chan SessionChange]struct{}
+}
+
+var sessionNotifier = &SessionNotifier{
+        subs: make(map[string]map[chan SessionChange]struct{}),
+}
+
+// Subscribe to changes for a session, keyed by tenantSessionKey. The returned
+// cancel func must be called to release the subscription.
+func (n *SessionNotifier) Subscribe(sessionID string) (<-chan SessionChange, func()) {
+        ch := make(chan SessionChange, 16)
+
+        n.mu.Lock()
+        if n.subs[sessionID] == nil {
+                n.subs[sessionID] = make(map[chan SessionChange]struct{})
+        }
+        n.subs[sessionID][ch] = struct{}{}
+        n.mu.Unlock()
+
+        cancel := func() {
+                n.mu.Lock()
+                delete(n.subs[sessionID], ch)
+                if len(n.subs[sessionID]) == 0 {
+                        delete(n.subs, sessionID)
+                }
+                n.mu.Unlock()
+        }
+        return ch, cancel
+}
+
+// Deliver a change to all subscribers of its session, dropping it for slow consumers
+func (n *SessionNotifier) dispatch(change SessionChange) {
+        n.mu.Lock()
+        defer n.mu.Unlock()
+
+        for ch := range n.subs[tenantSessionKey(change.TenantID, change.SessionID)] {
+                select {
+                case ch <- change:
+                default:
+                }
+        }
+}
+
+// Listen for session change notifications until ctx is cancelled, reconnecting on error
+func (n *SessionNotifier) Run(ctx context.Context) {
+        for ctx.Err() == nil {
+                if err := n.listen(ctx); err != nil && ctx.Err() == nil {
+                        log.Printf("Session notification listener error: %v", err)
+                        time.Sleep(time.Second)
+                }
+        }
+}
+
+func (n *SessionNotifier) listen(ctx context.Context) error {
+        conn, err := dbPool.Acquire(ctx)
+        if err != nil {
+                return err
+        }
+        defer conn.Release()
+
+        if _, err := conn.Exec(ctx, "LISTEN "+sessionChangesChannel); err != nil {
+                return err
+        }
+
+        for {
+                notification, err := conn.Conn().WaitForNotification(ctx)
+                if err != nil {
+                        // The connection state is unknown after an interrupted wait
+                        conn.Conn().Close(context.Background())
+                        return err
+                }
+
+                var change SessionChange
+                if err := json.Unmarshal([]byte(notification.Payload), &change); err != nil {
+                        log.Printf("Malformed session change notification: %v", err)
+                        continue
+                }
+                n.dispatch(change)
+        }
+}
+
+// Publish a session change to all service instances via NOTIFY. Notifications
+// always go through the default pool, which is the one instances listen on.
+func publishSessionChange(ctx context.Context, change SessionChange) {
+        change.TenantID = tenantFromContext(ctx)
+        payload, _ := json.Marshal(change)
+        // NOTIFY payloads are capped at 8000 bytes; fall back to the session ID alone
+        if len(payload) >= 8000 {
+                payload, _ = json.Marshal(SessionChange{TenantID: change.TenantID, SessionID: change.SessionID})
+        }
+
+        if _, err := dbPool.Exec(ctx, "SELECT pg_notify($1, $2)", sessionChangesChannel, string(payload)); err != nil {
+                log.Printf("Failed to publish session change: %v", err)
+        }
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+        "context"
+        "net/http"
+        "net/http/httptest"
+        "net/url"
+        "testing"
+        "time"
+
+        "github.com/gorilla/mux"
+)
+
+func TestClockAdvancedPast(t *testing.T) {
+        tests := []struct {
+                name   string
+                stored map[string]int64
+                client map[string]int64
+                want   bool
+        }{
+                {"identical", map[string]int64{"a": 2, "server": 5}, map[string]int64{"a": 2, "server": 5}, false},
+                {"client ahead", map[string]int64{"a": 1}, map[string]int64{"a": 4}, false},
+                {"one node ahead", map[string]int64{"a": 2, "server": 6}, map[string]int64{"a": 2, "server": 5}, true},
+                {"node unknown to client", map[string]int64{"b": 1}, map[string]int64{"a": 9}, true},
+                {"empty stored", map[string]int64{}, map[string]int64{"a": 1}, false},
+        }
+        for _, tt := range tests {
+                if got := clockAdvancedPast(tt.stored, tt.client); got != tt.want {
+                        t.Errorf("%s: clockAdvancedPast = %v, want %v", tt.name, got, tt.want)
+                }
+        }
+}
+
+func TestSessionNotifierScopesByTenant(t *testing.T) {
+        n := &SessionNotifier{subs: make(map[string]map[chan SessionChange]struct{})}
+        acme, cancelAcme := n.Subscribe(tenantSessionKey("acme", "s1"))
+        defer cancelAcme()
+        other, cancelOther := n.Subscribe(tenantSessionKey("globex", "s1"))
+        defer cancelOther()
+
+        n.dispatch(SessionChange{TenantID: "acme", SessionID: "s1", VectorClock: map[string]int64{"server": 3}})
+
+        select {
+        case change := <-acme:
+                if change.VectorClock["server"] != 3 {
+                        t.Errorf("delivered clock = %v", change.VectorClock)
+                }
+        case <-time.After(time.Second):
+                t.Fatal("subscriber for the written session was not notified")
+        }
+        select {
+        case change := <-other:
+                t.Fatalf("another tenant's subscriber received %+v", change)
+        default:
+        }
+}
+
+func TestSessionNotifierCancelAndSlowConsumers(t *testing.T) {
+        n := &SessionNotifier{subs: make(map[string]map[chan SessionChange]struct{})}
+        key := tenantSessionKey("", "s2")
+        ch, cancel := n.Subscribe(key)
+
+        // A subscriber that never reads must not block dispatch
+        done := make(chan struct{})
+        go func() {
+                for i := 0; i < 100; i++ {
+                        n.dispatch(SessionChange{SessionID: "s2"})
+                }
+                close(done)
+        }()
+        select {
+        case <-done:
+        case <-time.After(2 * time.Second):
+                t.Fatal("dispatch blocked on a full subscriber")
+        }
+        if len(ch) != cap(ch) {
+                t.Errorf("buffered %d of %d notifications", len(ch), cap(ch))
+        }
+
+        cancel()
+        if _, ok := n.subs[key]; ok {
+                t.Error("subscription map still holds the cancelled session")
+        }
+}
+
+func TestWatchSessionRejectsBadParameters(t *testing.T) {
+        for _, query := range []string{"clock=not-json", "timeout=soon", "timeout=-5s"} {
+                r := httptest.NewRequest(http.MethodGet, "/v1/tests/sessions/s3/watch?"+query, nil)
+                r = mux.SetURLVars(r, map[string]string{"session_id": "s3"})
+                w := httptest.NewRecorder()
+                handleWatchSession(w, r)
+                if w.Code != http.StatusBadRequest {
+                        t.Errorf("%s: status = %d, want 400", query, w.Code)
+                }
+        }
+}
+
+func TestWatchSessionLongPoll(t *testing.T) {
+        pool := testDB(t)
+        sessionID := insertTestSession(t, pool, nil, map[string]int64{"server": 1})
+
+        watch := func(clock string, timeout time.Duration) *httptest.ResponseRecorder {
+                q := url.Values{"clock": {clock}, "timeout": {timeout.String()}}
+                r := httptest.NewRequest(http.MethodGet, "/v1/tests/sessions/"+sessionID+"/watch?"+q.Encode(), nil)
+                r = mux.SetURLVars(r, map[string]string{"session_id": sessionID})
+                w := httptest.NewRecorder()
+                handleWatchSession(w, r)
+                return w
+        }
+
+        // Nothing changes: the request is held until the timeout
+        start := time.Now()
+        if w := watch(`{"server":1}`, 200*time.Millisecond); w.Code != http.StatusNoContent {
+                t.Fatalf("unchanged session: status = %d, want 204", w.Code)
+        }
+        if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+                t.Errorf("returned after %s, before the timeout", elapsed)
+        }
+
+        // A client already behind is answered immediately
+        if w := watch(`{}`, 5*time.Second); w.Code != http.StatusOK {
+                t.Fatalf("stale client: status = %d, want 200", w.Code)
+        }
+
+        // A write during the wait wakes the watcher
+        result := make(chan *httptest.ResponseRecorder, 1)
+        go func() { result <- watch(`{"server":1}`, 5*time.Second) }()
+        time.Sleep(100 * time.Millisecond)
+        if _, err := pool.Exec(context.Background(), `UPDATE test_sessions SET vector_clock = '{"server":2}' WHERE id = $1`, sessionID); err != nil {
+                t.Fatal(err)
+        }
+        sessionNotifier.dispatch(SessionChange{SessionID: sessionID})
+
+        select {
+        case w := <-result:
+                if w.Code != http.StatusOK {
+                        t.Fatalf("after write: status = %d, want 200", w.Code)
+                }
+        case <-time.After(3 * time.Second):
+                t.Fatal("watcher was not woken by the change")
+        }
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "fmt"
+        "log"
+        "time"
+
+        "github.com/jackc/pgx/v5"
+        "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Longest delay between delivery attempts of an outbox event
+const maxOutboxBackoff = 5 * time.Minute
+
+// Queue an event for delivery within tx, so it is committed (or discarded)
+// together with the change it describes. A non-empty dedupKey makes the enqueue
+// a no-op if an event with the same key was already queued.
+func enqueueOutboxEvent(ctx context.Context, tx pgx.Tx, eventType, destination string, payload interface{}, dedupKey string) error {
+        item, err := outboxEventItem(eventType, destination, payload, dedupKey)
+        if err != nil {
+                return err
+        }
+        _, err = tx.Exec(ctx, item.SQL, item.Args...)
+        return err
+}
+
+// The statement enqueueOutboxEvent runs, for callers pipelining it with other writes
+func outboxEventItem(eventType, destination string, payload interface{}, dedupKey string) (BatchItem, error) {
+        payloadJSON, err := json.Marshal(payload)
+        if err != nil {
+                return BatchItem{}, err
+        }
+        var key *string
+        if dedupKey != "" {
+                key = &dedupKey
+        }
+
+        return BatchItem{
+                SQL: `
+                        INSERT INTO outbox (event_type, destination, payload, dedup_key)
+                        VALUES ($1, $2, $3, $4)
+                        ON CONFLICT (dedup_key) DO NOTHING
+                `,
+                Args: []interface{}{eventType, destination, string(payloadJSON), key},
+        }, nil
+}
+
+// Poll the outbox of the default database and every open tenant pool until ctx
+// is cancelled, delivering events at least once
+func outboxRelay(ctx context.Context) {
+        ticker := time.NewTicker(cfg.OutboxPollInterval)
+        defer ticker.Stop()
+        jobHeartbeats.Register(jobOutboxRelay, cfg.OutboxPollInterval)
+
+        for {
+                select {
+                case <-ctx.Done():
+                        return
+                case <-ticker.C:
+                        pools := tenantPools.All()
+                        pools[""] = dbPool
+                        failed := false
+                        for tenantID, pool := range pools {
+                                if err := relayOutbox(ctx, pool); err != nil && ctx.Err() == nil {
+                                        log.Printf("Outbox relay error (tenant %q): %v", tenantID, err)
+                                        failed = true
+                                }
+                        }
+                        if !failed {
+                                jobHeartbeats.Beat(jobOutboxRelay)
+                        }
+                }
+        }
+}
+
+// Deliver one batch of due events. Rows are locked with SKIP LOCKED so several
+// instances can relay concurrently without delivering the same event at once.
+func relayOutbox(ctx context.Context, pool *pgxpool.Pool) error {
+        tx, err := pool.Begin(ctx)
+        if err != nil {
+                return err
+        }
+        defer tx.Rollback(ctx)
+
+        rows, err := tx.Query(ctx, `
+                SELECT id, destination, payload::text, attempts
+                FROM outbox
+                WHERE delivered_at IS NULL AND failed_at IS NULL AND next_attempt_at <= CURRENT_TIMESTAMP
+                ORDER BY id
+                LIMIT $1
+                FOR UPDATE SKIP LOCKED
+        `, cfg.OutboxBatchSize)
+        if err != nil {
+                return err
+        }
+        type outboxEvent struct {
+                id          int64
+                destination string
+                payload     string
+                attempts    int
+        }
+        var events []outboxEvent
+        for rows.Next() {
+                var e outboxEvent
+                if err := rows.Scan(&e.id, &e.destination, &e.payload, &e.attempts); err != nil {
+                        rows.Close()
+                        return err
+                }
+                events = append(events, e)
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+                return err
+        }
+
+        for _, e := range events {
+                if err := postWebhook(ctx, e.destination, json.RawMessage(e.payload)); err != nil {
+                        attempts := e.attempts + 1
+                        backoff := min(time.Duration(1<<min(attempts, 16))*time.Second, maxOutboxBackoff)
+                        var failedAt *time.Time
+                        if cfg.OutboxMaxAttempts > 0 && int64(attempts) >= cfg.OutboxMaxAttempts {
+                                now := time.Now()
+                                failedAt = &now
+                                log.Printf("Giving up on outbox event %d after %d attempts: %v", e.id, attempts, err)
+                        }
+                        if _, err := tx.Exec(ctx, `
+                                UPDATE outbox
+                                SET attempts = $2, last_error = $3, next_attempt_at = CURRENT_TIMESTAMP + $4::interval, failed_at = $5
+                                WHERE id = $1
+                        `, e.id, attempts, err.Error(), fmt.Sprintf("%d seconds", int64(backoff.Seconds())), failedAt); err != nil {
+                                return err
+                        }
+                        continue
+                }
+                if _, err := tx.Exec(ctx, "UPDATE outbox SET delivered_at = CURRENT_TIMESTAMP, attempts = attempts + 1 WHERE id = $1", e.id); err != nil {
+                        return err
+                }
+        }
+        return tx.Commit(ctx)
+}
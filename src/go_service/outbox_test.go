@@ -0,0 +1,172 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "io"
+        "net/http"
+        "net/http/httptest"
+        "sync"
+        "testing"
+        "time"
+
+        "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Webhook receiver recording delivered event bodies; fail makes it answer 503
+type outboxReceiver struct {
+        mu     sync.Mutex
+        bodies []string
+        fail   bool
+}
+
+func newOutboxReceiver(t *testing.T) (*outboxReceiver, string) {
+        t.Helper()
+        rcv := &outboxReceiver{}
+        server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                rcv.mu.Lock()
+                defer rcv.mu.Unlock()
+                if rcv.fail {
+                        w.WriteHeader(http.StatusServiceUnavailable)
+                        return
+                }
+                body, _ := io.ReadAll(r.Body)
+                rcv.bodies = append(rcv.bodies, string(body))
+        }))
+        t.Cleanup(server.Close)
+        return rcv, server.URL
+}
+
+func (rcv *outboxReceiver) delivered() []string {
+        rcv.mu.Lock()
+        defer rcv.mu.Unlock()
+        return append([]string(nil), rcv.bodies...)
+}
+
+// Retire events left pending by other tests so a relay run only sees this test's
+func quiesceOutbox(t *testing.T, pool *pgxpool.Pool) {
+        t.Helper()
+        if _, err := pool.Exec(context.Background(),
+                "UPDATE outbox SET failed_at = CURRENT_TIMESTAMP WHERE delivered_at IS NULL AND failed_at IS NULL"); err != nil {
+                t.Fatal(err)
+        }
+}
+
+// Enqueue an event in its own transaction, committing or rolling back
+func enqueueTestEvent(t *testing.T, pool *pgxpool.Pool, destination, dedupKey string, commit bool) {
+        t.Helper()
+        ctx := context.Background()
+        tx, err := pool.Begin(ctx)
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer tx.Rollback(ctx)
+        event := EvidenceEvent{Event: "evidence.uploaded", EvidenceID: dedupKey, SessionID: "outbox-session"}
+        if err := enqueueOutboxEvent(ctx, tx, event.Event, destination, event, dedupKey); err != nil {
+                t.Fatal(err)
+        }
+        if commit {
+                if err := tx.Commit(ctx); err != nil {
+                        t.Fatal(err)
+                }
+        }
+}
+
+func outboxDelivered(t *testing.T, pool *pgxpool.Pool, dedupKey string) (delivered bool, attempts int) {
+        t.Helper()
+        err := pool.QueryRow(context.Background(),
+                "SELECT delivered_at IS NOT NULL, attempts FROM outbox WHERE dedup_key = $1", dedupKey).Scan(&delivered, &attempts)
+        if err != nil {
+                t.Fatal(err)
+        }
+        return delivered, attempts
+}
+
+func TestOutboxEventCommittedWithTransaction(t *testing.T) {
+        pool := testDB(t)
+        rolledBack := "rolled-back-" + time.Now().Format(time.RFC3339Nano)
+        committed := "committed-" + time.Now().Format(time.RFC3339Nano)
+
+        enqueueTestEvent(t, pool, "https://hooks.example.test/audit", rolledBack, false)
+        enqueueTestEvent(t, pool, "https://hooks.example.test/audit", committed, true)
+
+        if n := countOutboxEvents(t, rolledBack); n != 0 {
+                t.Errorf("rolled-back transaction left %d outbox events", n)
+        }
+        if n := countOutboxEvents(t, committed); n != 1 {
+                t.Errorf("committed transaction left %d outbox events, want 1", n)
+        }
+}
+
+func TestOutboxRelayDelivers(t *testing.T) {
+        pool := testDB(t)
+        quiesceOutbox(t, pool)
+        rcv, url := newOutboxReceiver(t)
+        dedupKey := "relay-" + time.Now().Format(time.RFC3339Nano)
+        enqueueTestEvent(t, pool, url, dedupKey, true)
+
+        if err := relayOutbox(context.Background(), pool); err != nil {
+                t.Fatal(err)
+        }
+        bodies := rcv.delivered()
+        if len(bodies) != 1 {
+                t.Fatalf("receiver got %d events, want 1", len(bodies))
+        }
+        var event EvidenceEvent
+        if err := json.Unmarshal([]byte(bodies[0]), &event); err != nil || event.EvidenceID != dedupKey {
+                t.Errorf("delivered %s, want the queued event", bodies[0])
+        }
+        if delivered, attempts := outboxDelivered(t, pool, dedupKey); !delivered || attempts != 1 {
+                t.Errorf("delivered=%v attempts=%d, want delivered on the first attempt", delivered, attempts)
+        }
+
+        // Delivered rows are not sent again
+        if err := relayOutbox(context.Background(), pool); err != nil {
+                t.Fatal(err)
+        }
+        if n := len(rcv.delivered()); n != 1 {
+                t.Errorf("receiver got %d events after a second relay, want 1", n)
+        }
+}
+
+func TestOutboxEventSurvivesRestart(t *testing.T) {
+        pool := testDB(t)
+        quiesceOutbox(t, pool)
+        rcv, url := newOutboxReceiver(t)
+        dedupKey := "restart-" + time.Now().Format(time.RFC3339Nano)
+
+        // The process commits the event, then dies before the relay delivers it
+        enqueueTestEvent(t, pool, url, dedupKey, true)
+        crashed, cancel := context.WithCancel(context.Background())
+        cancel()
+        relayOutbox(crashed, pool)
+
+        // Its first relay attempt after coming back hits a receiver outage
+        rcv.mu.Lock()
+        rcv.fail = true
+        rcv.mu.Unlock()
+        if err := relayOutbox(context.Background(), pool); err != nil {
+                t.Fatal(err)
+        }
+        if delivered, attempts := outboxDelivered(t, pool, dedupKey); delivered || attempts != 1 {
+                t.Fatalf("delivered=%v attempts=%d after a failed attempt", delivered, attempts)
+        }
+
+        // A fresh relay (as after another restart) delivers once the backoff elapses
+        rcv.mu.Lock()
+        rcv.fail = false
+        rcv.mu.Unlock()
+        if _, err := pool.Exec(context.Background(),
+                "UPDATE outbox SET next_attempt_at = CURRENT_TIMESTAMP WHERE dedup_key = $1", dedupKey); err != nil {
+                t.Fatal(err)
+        }
+        if err := relayOutbox(context.Background(), pool); err != nil {
+                t.Fatal(err)
+        }
+        if delivered, attempts := outboxDelivered(t, pool, dedupKey); !delivered || attempts != 2 {
+                t.Errorf("delivered=%v attempts=%d, want delivered on the second attempt", delivered, attempts)
+        }
+        if n := len(rcv.delivered()); n != 1 {
+                t.Errorf("receiver got %d events, want exactly 1", n)
+        }
+}
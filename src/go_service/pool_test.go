@@ -0,0 +1,139 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "os"
+        "testing"
+        "time"
+
+        "github.com/jackc/pgx/v5/pgconn"
+        "github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestPoolConfigStatementTimeout(t *testing.T) {
+        tests := []struct {
+                timeout time.Duration
+                want    string
+        }{
+                {0, ""},
+                {250 * time.Millisecond, "250"},
+                {30 * time.Second, "30000"},
+        }
+        for _, tt := range tests {
+                withConfig(t, func(c *Config) { c.DBStatementTimeout = tt.timeout })
+                config, err := newPoolConfig("postgres://firemode@db.invalid:5432/firemode")
+                if err != nil {
+                        t.Fatal(err)
+                }
+                if got := config.ConnConfig.RuntimeParams["statement_timeout"]; got != tt.want {
+                        t.Errorf("DB_STATEMENT_TIMEOUT=%s: statement_timeout = %q, want %q", tt.timeout, got, tt.want)
+                }
+        }
+}
+
+func TestStatementTimeoutCancelsSlowQuery(t *testing.T) {
+        testDB(t)
+        withConfig(t, func(c *Config) { c.DBStatementTimeout = 100 * time.Millisecond })
+        config, err := newPoolConfig(os.Getenv("TEST_DATABASE_URL"))
+        if err != nil {
+                t.Fatal(err)
+        }
+        config.MinConns = 0
+        pool, err := pgxpool.NewWithConfig(context.Background(), config)
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer pool.Close()
+
+        start := time.Now()
+        _, err = pool.Exec(context.Background(), "SELECT pg_sleep(5)")
+        var pgErr *pgconn.PgError
+        if !errors.As(err, &pgErr) || pgErr.Code != "57014" {
+                t.Fatalf("err = %v, want query_canceled (57014)", err)
+        }
+        if elapsed := time.Since(start); elapsed > 2*time.Second {
+                t.Errorf("statement ran for %s despite a 100ms timeout", elapsed)
+        }
+
+        // The connection is returned to the pool usable
+        var one int
+        if err := pool.QueryRow(context.Background(), "SELECT 1").Scan(&one); err != nil || one != 1 {
+                t.Errorf("follow-up query: %v", err)
+        }
+}
+
+func TestPoolConfigHealthCheckPeriod(t *testing.T) {
+        defaults, err := pgxpool.ParseConfig("postgres://firemode@db.invalid:5432/firemode")
+        if err != nil {
+                t.Fatal(err)
+        }
+        tests := []struct {
+                period time.Duration
+                want   time.Duration
+        }{
+                {0, defaults.HealthCheckPeriod},
+                {5 * time.Second, 5 * time.Second},
+        }
+        for _, tt := range tests {
+                withConfig(t, func(c *Config) { c.DBHealthCheckPeriod = tt.period })
+                config, err := newPoolConfig("postgres://firemode@db.invalid:5432/firemode")
+                if err != nil {
+                        t.Fatal(err)
+                }
+                if config.HealthCheckPeriod != tt.want {
+                        t.Errorf("DB_HEALTH_CHECK_PERIOD=%s: HealthCheckPeriod = %s, want %s", tt.period, config.HealthCheckPeriod, tt.want)
+                }
+                if config.PrepareConn == nil || config.AfterRelease == nil {
+                        t.Error("connection health hooks not installed")
+                }
+        }
+}
+
+func TestPoolRecoversFromDroppedConnection(t *testing.T) {
+        admin := testDB(t)
+        withConfig(t, func(c *Config) {
+                c.DBPingIdleThreshold = time.Nanosecond // ping on every acquire
+                c.DBPingTimeout = time.Second
+        })
+        config, err := newPoolConfig(os.Getenv("TEST_DATABASE_URL"))
+        if err != nil {
+                t.Fatal(err)
+        }
+        config.MinConns = 0
+        config.MaxConns = 1
+        pool, err := pgxpool.NewWithConfig(context.Background(), config)
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer pool.Close()
+
+        ctx := context.Background()
+        var before int32
+        if err := pool.QueryRow(ctx, "SELECT pg_backend_pid()").Scan(&before); err != nil {
+                t.Fatal(err)
+        }
+        evicted := func() float64 {
+                return counterValue(t, dbPoolEvictions.WithLabelValues("ping_failed")) + counterValue(t, dbPoolEvictions.WithLabelValues("closed"))
+        }
+        evictedBefore := evicted()
+
+        // Simulate the server dropping the idle pooled connection, as after a failover
+        var terminated bool
+        if err := admin.QueryRow(ctx, "SELECT pg_terminate_backend($1)", before).Scan(&terminated); err != nil || !terminated {
+                t.Fatalf("terminate backend %d: %v", before, err)
+        }
+        time.Sleep(50 * time.Millisecond)
+
+        // The next query is served by a fresh connection rather than failing
+        var after int32
+        if err := pool.QueryRow(ctx, "SELECT pg_backend_pid()").Scan(&after); err != nil {
+                t.Fatalf("query after dropped connection: %v", err)
+        }
+        if after == before {
+                t.Errorf("query ran on the terminated backend %d", before)
+        }
+        if got := evicted() - evictedBefore; got != 1 {
+                t.Errorf("evictions = %v, want 1", got)
+        }
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+        "bytes"
+        "fmt"
+        "log"
+        "net/http"
+        "os"
+        "path/filepath"
+        "runtime/pprof"
+        "runtime/trace"
+        "strings"
+        "sync"
+        "sync/atomic"
+        "time"
+)
+
+// Captures diagnostics for requests still running after
+// SLOW_REQUEST_PROFILE_THRESHOLD: a goroutine dump, plus an execution trace of
+// SLOW_REQUEST_TRACE_DURATION when set. Captures are written to
+// SLOW_REQUEST_PROFILE_DIR at most once per SLOW_REQUEST_PROFILE_INTERVAL, so
+// a burst of slow requests costs one capture rather than one each.
+type SlowRequestProfiler struct {
+        mu          sync.Mutex
+        lastCapture time.Time
+        // runtime/trace allows one trace at a time per process
+        tracing atomic.Bool
+}
+
+var slowRequestProfiler = &SlowRequestProfiler{}
+
+// Reserve the next capture slot, or report that one was taken too recently
+func (p *SlowRequestProfiler) allow() bool {
+        p.mu.Lock()
+        defer p.mu.Unlock()
+        if time.Since(p.lastCapture) < cfg.SlowRequestProfileInterval {
+                return false
+        }
+        p.lastCapture = time.Now()
+        return true
+}
+
+// Write diagnostics for a request that has been running for threshold
+func (p *SlowRequestProfiler) capture(r *http.Request, threshold time.Duration) {
+        traceDuration := cfg.SlowRequestTraceDuration
+        if err := os.MkdirAll(cfg.SlowRequestProfileDir, 0o750); err != nil {
+                log.Printf("Slow request profiler: %v", err)
+                return
+        }
+        // File names sort by time and identify the route, and the trace when known
+        name := time.Now().UTC().Format("20060102T150405.000Z") + "-" + strings.NewReplacer("/", "_", ":", "_").Replace(strings.Trim(r.URL.Path, "/"))
+        if traceID := traceIDFromContext(r.Context()); traceID != "" {
+                name += "-" + traceID
+        }
+        base := filepath.Join(cfg.SlowRequestProfileDir, name)
+
+        var dump bytes.Buffer
+        fmt.Fprintf(&dump, "# %s %s running for over %s\n\n", r.Method, r.URL.Path, threshold)
+        if err := pprof.Lookup("goroutine").WriteTo(&dump, 2); err != nil {
+                log.Printf("Slow request profiler: goroutine dump failed: %v", err)
+                return
+        }
+        if err := os.WriteFile(base+".goroutines.txt", dump.Bytes(), 0o640); err != nil {
+                log.Printf("Slow request profiler: %v", err)
+                return
+        }
+        log.Printf("Captured goroutine dump for slow request %s %s to %s.goroutines.txt", r.Method, r.URL.Path, base)
+
+        if traceDuration <= 0 || !p.tracing.CompareAndSwap(false, true) {
+                return
+        }
+        defer p.tracing.Store(false)
+        f, err := os.Create(base + ".trace")
+        if err != nil {
+                log.Printf("Slow request profiler: %v", err)
+                return
+        }
+        defer f.Close()
+        // Fails if a trace is already running, e.g. one started through pprof
+        if err := trace.Start(f); err != nil {
+                log.Printf("Slow request profiler: execution trace failed: %v", err)
+                os.Remove(f.Name())
+                return
+        }
+        time.Sleep(traceDuration)
+        trace.Stop()
+        log.Printf("Captured execution trace for slow request %s %s to %s.trace", r.Method, r.URL.Path, base)
+}
+
+// Arm a timer per request that captures diagnostics if the request outlives
+// the threshold. Long-poll and SSE requests are expected to be long and skipped.
+func slowRequestProfilerMiddleware(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                threshold := cfg.SlowRequestProfileThreshold
+                if threshold <= 0 || longLivedRequest(r) {
+                        next.ServeHTTP(w, r)
+                        return
+                }
+                timer := time.AfterFunc(threshold, func() {
+                        if slowRequestProfiler.allow() {
+                                slowRequestProfiler.capture(r, threshold)
+                        }
+                })
+                defer timer.Stop()
+                next.ServeHTTP(w, r)
+        })
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+        "bytes"
+        "log"
+        "net/http"
+        "net/http/httptest"
+        "os"
+        "path/filepath"
+        "strings"
+        "sync"
+        "testing"
+        "time"
+)
+
+// Log output written from the profiler's timer goroutines
+type profilerLog struct {
+        mu  sync.Mutex
+        buf bytes.Buffer
+}
+
+func (l *profilerLog) Write(p []byte) (int, error) {
+        l.mu.Lock()
+        defer l.mu.Unlock()
+        return l.buf.Write(p)
+}
+
+// Wait up to a second for a log line containing s, which orders everything
+// the capture did before logging it ahead of the caller
+func (l *profilerLog) waitFor(s string) bool {
+        deadline := time.Now().Add(time.Second)
+        for time.Now().Before(deadline) {
+                l.mu.Lock()
+                found := strings.Contains(l.buf.String(), s)
+                l.mu.Unlock()
+                if found {
+                        return true
+                }
+                time.Sleep(5 * time.Millisecond)
+        }
+        return false
+}
+
+// Profile requests slower than threshold into a temporary directory, with the
+// rate limit reset
+func useTestProfiler(t *testing.T, threshold, trace time.Duration) (string, *profilerLog) {
+        t.Helper()
+        dir := t.TempDir()
+        withConfig(t, func(c *Config) {
+                c.SlowRequestProfileThreshold = threshold
+                c.SlowRequestProfileDir = dir
+                c.SlowRequestProfileInterval = time.Hour
+                c.SlowRequestTraceDuration = trace
+        })
+        slowRequestProfiler.mu.Lock()
+        slowRequestProfiler.lastCapture = time.Time{}
+        slowRequestProfiler.mu.Unlock()
+
+        logs := &profilerLog{}
+        saved := log.Writer()
+        log.SetOutput(logs)
+        t.Cleanup(func() {
+                log.SetOutput(saved)
+                // Rate-limited captures read the config under the lock
+                slowRequestProfiler.mu.Lock()
+                slowRequestProfiler.mu.Unlock()
+        })
+        return dir, logs
+}
+
+func serveProfiled(path string, delay time.Duration) {
+        handler := slowRequestProfilerMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                time.Sleep(delay)
+                w.WriteHeader(http.StatusOK)
+        }))
+        handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+}
+
+func TestSlowRequestCapturesGoroutineDump(t *testing.T) {
+        dir, logs := useTestProfiler(t, 20*time.Millisecond, 0)
+        serveProfiled("/v1/reports/annual", 150*time.Millisecond)
+        if !logs.waitFor("Captured goroutine dump") {
+                t.Fatal("no capture logged for the slow request")
+        }
+
+        dumps, _ := filepath.Glob(filepath.Join(dir, "*.goroutines.txt"))
+        if len(dumps) != 1 {
+                t.Fatalf("captures = %v, want one goroutine dump", dumps)
+        }
+        if !strings.Contains(filepath.Base(dumps[0]), "v1_reports_annual") {
+                t.Errorf("capture %s does not name the route", dumps[0])
+        }
+        dump, _ := os.ReadFile(dumps[0])
+        if !strings.HasPrefix(string(dump), "# GET /v1/reports/annual running for over 20ms") || !strings.Contains(string(dump), "goroutine ") {
+                t.Errorf("dump starts %q, want the request line and goroutine stacks", string(dump[:min(len(dump), 120)]))
+        }
+        if traces, _ := filepath.Glob(filepath.Join(dir, "*.trace")); len(traces) != 0 {
+                t.Errorf("traces = %v with tracing disabled", traces)
+        }
+
+        // A second slow request within the interval is not captured
+        serveProfiled("/v1/reports/quarterly", 150*time.Millisecond)
+        if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 1 {
+                t.Errorf("files = %v, want the rate limit to skip the second capture", files)
+        }
+}
+
+func TestSlowRequestCapturesTrace(t *testing.T) {
+        dir, logs := useTestProfiler(t, 10*time.Millisecond, 30*time.Millisecond)
+        serveProfiled("/v1/evidence", 120*time.Millisecond)
+        if !logs.waitFor("Captured execution trace") {
+                t.Fatal("no trace logged for the slow request")
+        }
+
+        traces, _ := filepath.Glob(filepath.Join(dir, "*.trace"))
+        if len(traces) != 1 {
+                t.Fatalf("traces = %v, want one", traces)
+        }
+        if info, err := os.Stat(traces[0]); err != nil || info.Size() == 0 {
+                t.Errorf("trace %s is empty: %v", traces[0], err)
+        }
+}
+
+func TestFastAndLongLivedRequestsNotCaptured(t *testing.T) {
+        tests := []struct {
+                name      string
+                threshold time.Duration
+                path      string
+                delay     time.Duration
+        }{
+                {"fast request", time.Second, "/v1/sessions/abc", 0},
+                {"watch request", 10 * time.Millisecond, "/v1/sessions/abc/watch", 60 * time.Millisecond},
+                {"event stream", 10 * time.Millisecond, "/v1/sessions/abc/events", 60 * time.Millisecond},
+                {"disabled", 0, "/v1/sessions/abc", 60 * time.Millisecond},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        dir, _ := useTestProfiler(t, tt.threshold, 0)
+                        serveProfiled(tt.path, tt.delay)
+                        if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+                                t.Errorf("captures = %v, want none", files)
+                        }
+                })
+        }
+}
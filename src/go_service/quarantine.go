@@ -0,0 +1,78 @@
+package main
+
+import (
+        "context"
+        "fmt"
+        "io"
+        "log"
+        "net/http"
+
+        "github.com/google/uuid"
+)
+
+// HASH_MISMATCH_POLICY values: drop uploads whose bytes do not match the
+// declared hash, or keep them in the quarantine store for tamper investigation
+const (
+        hashMismatchReject     = "reject"
+        hashMismatchQuarantine = "quarantine"
+)
+
+// Store for quarantined uploads, separate from evidence so mismatched bytes are
+// never served as evidence; nil unless HASH_MISMATCH_POLICY is quarantine
+var quarantineStore EvidenceStore
+
+// An upload rejected for a hash mismatch, as recorded in evidence_quarantine
+type QuarantinedEvidence struct {
+        SessionID    string
+        UserID       string
+        EvidenceType string
+        Filename     string
+        DeclaredHash string
+        ActualHash   string
+        Size         int64
+}
+
+// Handle an upload whose content hash did not match the declared one. Under the
+// quarantine policy its bytes are kept with both hashes recorded, and the
+// quarantine ID is returned (and set as X-Quarantine-ID on h) for operators.
+// The client still receives an error either way; a failure to quarantine is
+// logged and does not change that response.
+func handleHashMismatch(ctx context.Context, h http.Header, file io.ReadSeeker, q QuarantinedEvidence) string {
+        stats.Inc(statHashMismatches)
+        if cfg.HashMismatchPolicy != hashMismatchQuarantine || quarantineStore == nil {
+                return ""
+        }
+        id, err := quarantineEvidence(ctx, file, q)
+        if err != nil {
+                log.Printf("Failed to quarantine mismatched upload for session %s: %v", q.SessionID, err)
+                return ""
+        }
+        log.Printf("Quarantined upload %s for session %s: declared %s, actual %s", id, q.SessionID, q.DeclaredHash, q.ActualHash)
+        h.Set("X-Quarantine-ID", id)
+        return id
+}
+
+// Copy the upload to the quarantine store and record it
+func quarantineEvidence(ctx context.Context, file io.ReadSeeker, q QuarantinedEvidence) (string, error) {
+        if _, err := file.Seek(0, io.SeekStart); err != nil {
+                return "", err
+        }
+        id := uuid.New().String()
+        key := evidenceObjectKey(ctx, id)
+        if _, err := quarantineStore.Put(ctx, key, file); err != nil {
+                return "", fmt.Errorf("failed to store quarantined bytes: %v", err)
+        }
+
+        query := `
+                INSERT INTO evidence_quarantine (id, object_key, session_id, user_id, evidence_type, filename,
+                        declared_hash, actual_hash, size_bytes)
+                VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+        `
+        _, err := dbFor(ctx).Exec(ctx, query, id, key, q.SessionID, q.UserID, q.EvidenceType, q.Filename,
+                q.DeclaredHash, q.ActualHash, q.Size)
+        if err != nil {
+                quarantineStore.Delete(context.Background(), key)
+                return "", fmt.Errorf("failed to record quarantined upload: %v", err)
+        }
+        return id, nil
+}
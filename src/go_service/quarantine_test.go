@@ -0,0 +1,91 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "io"
+        "net/http"
+        "net/http/httptest"
+        "testing"
+)
+
+// Use a temporary quarantine store under policy
+func useQuarantine(t *testing.T, policy string) *FileEvidenceStore {
+        t.Helper()
+        store, err := NewFileEvidenceStore(t.TempDir())
+        if err != nil {
+                t.Fatal(err)
+        }
+        withConfig(t, func(c *Config) { c.HashMismatchPolicy = policy })
+        saved := quarantineStore
+        quarantineStore = store
+        t.Cleanup(func() { quarantineStore = saved })
+        return store
+}
+
+func mismatchedUpload(t *testing.T, sessionID, userID string, content []byte) *httptest.ResponseRecorder {
+        t.Helper()
+        r := evidenceUploadRequest(t, map[string]string{
+                "session_id":    sessionID,
+                "evidence_type": "photo",
+                "sha256_hash":   calculateSHA256([]byte("the photo the inspector took")),
+        }, map[string][]byte{"valve-tag.jpg": content})
+        r.Header.Set("Idempotency-Key", "mismatch-"+sessionID)
+        r.Header.Set("X-User-ID", userID)
+        w := httptest.NewRecorder()
+        handleEvidence(w, r)
+        return w
+}
+
+func TestHashMismatchRejectPolicyDiscardsBytes(t *testing.T) {
+        store := useQuarantine(t, hashMismatchReject)
+        w := mismatchedUpload(t, "session-reject", "inspector-100", []byte("a substituted photo"))
+        if w.Code != http.StatusBadRequest || w.Header().Get("X-Quarantine-ID") != "" {
+                t.Errorf("upload = %d, X-Quarantine-ID %q; want 400 without quarantine", w.Code, w.Header().Get("X-Quarantine-ID"))
+        }
+        if size, err := store.Size(context.Background(), "anything"); err != errEvidenceNotFound {
+                t.Errorf("quarantine store used: %d, %v", size, err)
+        }
+}
+
+func TestHashMismatchQuarantinePolicyKeepsBytes(t *testing.T) {
+        pool := testDB(t)
+        store := useQuarantine(t, hashMismatchQuarantine)
+        captureLog(t)
+        userID := insertTestUser(t, pool, "quarantine")
+        sessionID := insertTestSession(t, pool, nil, nil)
+        content := []byte("a substituted photo, edited after capture")
+
+        w := mismatchedUpload(t, sessionID, userID, content)
+        quarantineID := w.Header().Get("X-Quarantine-ID")
+        if w.Code != http.StatusBadRequest || quarantineID == "" {
+                t.Fatalf("upload = %d, X-Quarantine-ID %q; want 400 with a quarantine ID", w.Code, quarantineID)
+        }
+
+        var objectKey, declared, actual string
+        var size int64
+        err := pool.QueryRow(context.Background(), `
+                SELECT object_key, declared_hash, actual_hash, size_bytes FROM evidence_quarantine WHERE id = $1
+        `, quarantineID).Scan(&objectKey, &declared, &actual, &size)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if declared != calculateSHA256([]byte("the photo the inspector took")) || actual != calculateSHA256(content) || size != int64(len(content)) {
+                t.Errorf("record = %s/%s/%d, want the declared and actual hashes", declared, actual, size)
+        }
+        blob, err := store.Get(context.Background(), objectKey)
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer blob.Close()
+        if kept, _ := io.ReadAll(blob); !bytes.Equal(kept, content) {
+                t.Errorf("quarantined bytes = %q, want the upload", kept)
+        }
+
+        // Nothing was accepted as evidence
+        var evidenceRows int
+        pool.QueryRow(context.Background(), "SELECT count(*) FROM evidence WHERE session_id = $1", sessionID).Scan(&evidenceRows)
+        if evidenceRows != 0 {
+                t.Errorf("%d evidence rows for a mismatched upload", evidenceRows)
+        }
+}
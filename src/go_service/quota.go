@@ -0,0 +1,179 @@
+package main
+
+import (
+        "context"
+        "fmt"
+        "net/http"
+
+        "github.com/jackc/pgx/v5"
+)
+
+// Quota scopes tracked in evidence_usage
+const (
+        quotaScopeSession = "session"
+        quotaScopeUser    = "user"
+)
+
+// Current evidence usage for a quota scope
+type EvidenceUsage struct {
+        Scope         string `json:"scope"`
+        ScopeID       string `json:"scope_id"`
+        EvidenceCount int64  `json:"evidence_count"`
+        TotalBytes    int64  `json:"total_bytes"`
+        MaxCount      int64  `json:"max_evidence_count,omitempty"`
+        MaxBytes      int64  `json:"max_total_bytes,omitempty"`
+}
+
+// Returned when an upload would exceed a configured quota
+type QuotaExceededError struct {
+        StatusCode int
+        Reason     string
+        Usage      EvidenceUsage
+}
+
+func (e *QuotaExceededError) Error() string {
+        return fmt.Sprintf("%s quota exceeded for %s: %s", e.Usage.Scope, e.Usage.ScopeID, e.Reason)
+}
+
+// Seed statement creating a scope's usage row from the evidence table on first
+// use. The aggregate sits behind an uncorrelated NOT EXISTS, which Postgres
+// evaluates once up front, so existing rows never trigger a count. Sessions are
+// matched on the indexed session_id column and users on the indexed
+// uploaded_by generated column.
+func seedEvidenceUsageItem(scope, scopeID string) BatchItem {
+        seedFilter := "session_id = $3::uuid"
+        if scope == quotaScopeUser {
+                seedFilter = "uploaded_by = $3"
+        }
+
+        return BatchItem{
+                Ref: scope + ":" + scopeID,
+                SQL: fmt.Sprintf(`
+                        INSERT INTO evidence_usage (scope, scope_id, evidence_count, total_bytes)
+                        SELECT $1, $2, usage.evidence_count, usage.total_bytes
+                        FROM (
+                                SELECT COUNT(*) AS evidence_count, COALESCE(SUM((metadata->>'file_size')::bigint), 0) AS total_bytes
+                                FROM evidence
+                                WHERE %s
+                        ) usage
+                        WHERE NOT EXISTS (SELECT 1 FROM evidence_usage WHERE scope = $1 AND scope_id = $2)
+                        ON CONFLICT (scope, scope_id) DO NOTHING
+                `, seedFilter),
+                Args: []interface{}{scope, scopeID, scopeID},
+        }
+}
+
+// Lock the usage counters for a scope
+func lockEvidenceUsage(ctx context.Context, tx pgx.Tx, scope, scopeID string) (*EvidenceUsage, error) {
+        usage := EvidenceUsage{Scope: scope, ScopeID: scopeID}
+        query := `
+                SELECT evidence_count, total_bytes
+                FROM evidence_usage
+                WHERE scope = $1 AND scope_id = $2
+                FOR UPDATE
+        `
+        if err := tx.QueryRow(ctx, query, scope, scopeID).Scan(&usage.EvidenceCount, &usage.TotalBytes); err != nil {
+                return nil, fmt.Errorf("failed to lock evidence usage: %v", err)
+        }
+
+        return &usage, nil
+}
+
+// Check a scope's usage against its limits for an additional upload of size bytes
+func checkEvidenceQuota(usage *EvidenceUsage, maxCount, maxBytes, size int64) error {
+        usage.MaxCount = maxCount
+        usage.MaxBytes = maxBytes
+
+        if maxCount > 0 && usage.EvidenceCount+1 > maxCount {
+                return &QuotaExceededError{
+                        StatusCode: http.StatusTooManyRequests,
+                        Reason:     "maximum evidence count reached",
+                        Usage:      *usage,
+                }
+        }
+        if maxBytes > 0 && usage.TotalBytes+size > maxBytes {
+                return &QuotaExceededError{
+                        StatusCode: http.StatusInsufficientStorage,
+                        Reason:     "maximum evidence storage reached",
+                        Usage:      *usage,
+                }
+        }
+        return nil
+}
+
+// Reserve quota for a new upload within tx, incrementing the counters of each
+// scope that has a limit configured; with no limits this does nothing.
+// Counters are only maintained while their scope is limited, so after running
+// a scope unlimited its evidence_usage rows should be deleted before a limit is
+// set again, letting them reseed from the evidence table.
+// Session rows are always locked before user rows to keep lock ordering consistent.
+func reserveEvidenceQuota(ctx context.Context, tx pgx.Tx, sessionID, userID string, size int64) error {
+        type quotaScope struct {
+                scope    string
+                scopeID  string
+                maxCount int64
+                maxBytes int64
+        }
+        var scopes []quotaScope
+        for _, s := range []quotaScope{
+                {quotaScopeSession, sessionID, cfg.SessionMaxEvidenceCount, cfg.SessionMaxEvidenceBytes},
+                {quotaScopeUser, userID, cfg.UserMaxEvidenceCount, cfg.UserMaxEvidenceBytes},
+        } {
+                if s.maxCount > 0 || s.maxBytes > 0 {
+                        scopes = append(scopes, s)
+                }
+        }
+        if len(scopes) == 0 {
+                return nil
+        }
+
+        // Seed the limited scopes in one round-trip
+        seeds := make([]BatchItem, 0, len(scopes))
+        for _, s := range scopes {
+                seeds = append(seeds, seedEvidenceUsageItem(s.scope, s.scopeID))
+        }
+        if err := execBatch(ctx, tx, seeds); err != nil {
+                return fmt.Errorf("failed to seed evidence usage: %v", err)
+        }
+
+        for _, s := range scopes {
+                usage, err := lockEvidenceUsage(ctx, tx, s.scope, s.scopeID)
+                if err != nil {
+                        return err
+                }
+                if err := checkEvidenceQuota(usage, s.maxCount, s.maxBytes, size); err != nil {
+                        return err
+                }
+        }
+
+        increments := make([]BatchItem, 0, len(scopes))
+        for _, s := range scopes {
+                increments = append(increments, BatchItem{
+                        Ref: s.scope + ":" + s.scopeID,
+                        SQL: `
+                                UPDATE evidence_usage
+                                SET evidence_count = evidence_count + 1, total_bytes = total_bytes + $3, updated_at = CURRENT_TIMESTAMP
+                                WHERE scope = $1 AND scope_id = $2
+                        `,
+                        Args: []interface{}{s.scope, s.scopeID, size},
+                })
+        }
+        if err := execBatch(ctx, tx, increments); err != nil {
+                return fmt.Errorf("failed to update evidence usage: %v", err)
+        }
+        return nil
+}
+
+// Return usage for deleted evidence within tx. Counters never go below zero.
+func releaseEvidenceQuota(ctx context.Context, tx pgx.Tx, scope, scopeID string, count, size int64) error {
+        query := `
+                UPDATE evidence_usage
+                SET evidence_count = GREATEST(evidence_count - $3, 0), total_bytes = GREATEST(total_bytes - $4, 0),
+                    updated_at = CURRENT_TIMESTAMP
+                WHERE scope = $1 AND scope_id = $2
+        `
+        if _, err := tx.Exec(ctx, query, scope, scopeID, count, size); err != nil {
+                return fmt.Errorf("failed to release evidence usage: %v", err)
+        }
+        return nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "net/http"
+        "reflect"
+        "strings"
+        "testing"
+
+        "github.com/google/uuid"
+        "github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestCheckEvidenceQuotaCountLimit(t *testing.T) {
+        usage := &EvidenceUsage{Scope: quotaScopeSession, ScopeID: "s-1", EvidenceCount: 4, TotalBytes: 400}
+
+        if err := checkEvidenceQuota(usage, 5, 0, 100); err != nil {
+                t.Fatalf("fifth upload under a count limit of 5 rejected: %v", err)
+        }
+
+        usage.EvidenceCount = 5
+        err := checkEvidenceQuota(usage, 5, 0, 100)
+        var quotaErr *QuotaExceededError
+        if !errors.As(err, &quotaErr) {
+                t.Fatalf("sixth upload: got %v, want QuotaExceededError", err)
+        }
+        if quotaErr.StatusCode != http.StatusTooManyRequests {
+                t.Errorf("status = %d, want 429", quotaErr.StatusCode)
+        }
+        if quotaErr.Usage.MaxCount != 5 || quotaErr.Usage.EvidenceCount != 5 {
+                t.Errorf("usage = %+v, want count 5 of max 5", quotaErr.Usage)
+        }
+}
+
+func TestCheckEvidenceQuotaByteLimit(t *testing.T) {
+        tests := []struct {
+                name     string
+                used     int64
+                size     int64
+                exceeded bool
+        }{
+                {"well under", 0, 1024, false},
+                {"exactly at limit", 3072, 1024, false},
+                {"one byte over", 3073, 1024, true},
+                {"single file over", 0, 4097, true},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        usage := &EvidenceUsage{Scope: quotaScopeUser, ScopeID: "inspector", TotalBytes: tt.used}
+                        err := checkEvidenceQuota(usage, 0, 4096, tt.size)
+                        if !tt.exceeded {
+                                if err != nil {
+                                        t.Fatalf("unexpected error: %v", err)
+                                }
+                                return
+                        }
+                        var quotaErr *QuotaExceededError
+                        if !errors.As(err, &quotaErr) {
+                                t.Fatalf("got %v, want QuotaExceededError", err)
+                        }
+                        if quotaErr.StatusCode != http.StatusInsufficientStorage {
+                                t.Errorf("status = %d, want 507", quotaErr.StatusCode)
+                        }
+                })
+        }
+}
+
+func TestCheckEvidenceQuotaUnlimited(t *testing.T) {
+        usage := &EvidenceUsage{EvidenceCount: 1 << 40, TotalBytes: 1 << 50}
+        if err := checkEvidenceQuota(usage, 0, 0, 1<<30); err != nil {
+                t.Fatalf("zero limits should be unlimited, got %v", err)
+        }
+}
+
+func TestReserveEvidenceQuotaMaintainsCounters(t *testing.T) {
+        pool := testDB(t)
+        withConfig(t, func(c *Config) {
+                c.SessionMaxEvidenceCount = 2
+                c.SessionMaxEvidenceBytes = 0
+                c.UserMaxEvidenceCount = 0
+                c.UserMaxEvidenceBytes = 1000
+        })
+        ctx := context.Background()
+        sessionID := uuid.NewString()
+        userID := "quota-" + uuid.NewString()
+
+        reserve := func(size int64) error {
+                tx, err := pool.Begin(ctx)
+                if err != nil {
+                        t.Fatal(err)
+                }
+                defer tx.Rollback(ctx)
+                if err := reserveEvidenceQuota(ctx, tx, sessionID, userID, size); err != nil {
+                        return err
+                }
+                return tx.Commit(ctx)
+        }
+
+        if err := reserve(400); err != nil {
+                t.Fatalf("first reservation: %v", err)
+        }
+        var quotaErr *QuotaExceededError
+        if err := reserve(700); !errors.As(err, &quotaErr) || quotaErr.Usage.Scope != quotaScopeUser {
+                t.Fatalf("reservation past the user byte limit: got %v", err)
+        }
+        if err := reserve(500); err != nil {
+                t.Fatalf("second reservation: %v", err)
+        }
+        if err := reserve(1); !errors.As(err, &quotaErr) || quotaErr.Usage.Scope != quotaScopeSession {
+                t.Fatalf("reservation past the session count limit: got %v", err)
+        }
+
+        var count, bytes int64
+        err := pool.QueryRow(ctx, "SELECT evidence_count, total_bytes FROM evidence_usage WHERE scope = $1 AND scope_id = $2",
+                quotaScopeSession, sessionID).Scan(&count, &bytes)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if count != 2 || bytes != 900 {
+                t.Errorf("session usage = %d files / %d bytes, want 2 / 900", count, bytes)
+        }
+}
+
+func TestSeedEvidenceUsageItemUsesIndexedFilters(t *testing.T) {
+        tests := []struct {
+                scope  string
+                filter string
+        }{
+                {quotaScopeSession, "session_id = $3::uuid"},
+                {quotaScopeUser, "uploaded_by = $3"},
+        }
+        for _, tt := range tests {
+                item := seedEvidenceUsageItem(tt.scope, "scope-7")
+                if !strings.Contains(item.SQL, tt.filter) || !strings.Contains(item.SQL, "WHERE NOT EXISTS") {
+                        t.Errorf("%s seed:\n%s\nwant filter %q behind NOT EXISTS", tt.scope, item.SQL, tt.filter)
+                }
+                if strings.Contains(item.SQL, "session_id::text") || strings.Contains(item.SQL, "metadata->>'uploaded_by'") {
+                        t.Errorf("%s seed filters on an unindexed expression:\n%s", tt.scope, item.SQL)
+                }
+                if !reflect.DeepEqual(item.Args, []interface{}{tt.scope, "scope-7", "scope-7"}) || item.Ref != tt.scope+":scope-7" {
+                        t.Errorf("%s seed = %+v", tt.scope, item)
+                }
+        }
+}
+
+// Usage rows for the given session and user, keyed by scope
+func usageRows(t *testing.T, pool *pgxpool.Pool, sessionID, userID string) map[string]int64 {
+        t.Helper()
+        rows, err := pool.Query(context.Background(), `
+                SELECT scope, evidence_count FROM evidence_usage
+                WHERE (scope = 'session' AND scope_id = $1) OR (scope = 'user' AND scope_id = $2)
+        `, sessionID, userID)
+        if err != nil {
+                t.Fatal(err)
+        }
+        counts := make(map[string]int64)
+        for rows.Next() {
+                var scope string
+                var count int64
+                if err := rows.Scan(&scope, &count); err != nil {
+                        t.Fatal(err)
+                }
+                counts[scope] = count
+        }
+        if err := rows.Err(); err != nil {
+                t.Fatal(err)
+        }
+        return counts
+}
+
+func TestReserveEvidenceQuotaOnlyTracksLimitedScopes(t *testing.T) {
+        pool := testDB(t)
+        ctx := context.Background()
+        tests := []struct {
+                name   string
+                limits func(c *Config)
+                want   map[string]int64
+        }{
+                {"no limits", func(c *Config) {}, map[string]int64{}},
+                {"session limited", func(c *Config) { c.SessionMaxEvidenceBytes = 1 << 30 }, map[string]int64{quotaScopeSession: 1}},
+                {"user limited", func(c *Config) { c.UserMaxEvidenceCount = 50 }, map[string]int64{quotaScopeUser: 1}},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        withConfig(t, func(c *Config) {
+                                c.SessionMaxEvidenceCount, c.SessionMaxEvidenceBytes = 0, 0
+                                c.UserMaxEvidenceCount, c.UserMaxEvidenceBytes = 0, 0
+                                tt.limits(c)
+                        })
+                        sessionID, userID := uuid.NewString(), "quota-"+uuid.NewString()
+                        tx, err := pool.Begin(ctx)
+                        if err != nil {
+                                t.Fatal(err)
+                        }
+                        defer tx.Rollback(ctx)
+                        if err := reserveEvidenceQuota(ctx, tx, sessionID, userID, 2048); err != nil {
+                                t.Fatal(err)
+                        }
+                        if err := tx.Commit(ctx); err != nil {
+                                t.Fatal(err)
+                        }
+                        if got := usageRows(t, pool, sessionID, userID); !reflect.DeepEqual(got, tt.want) {
+                                t.Errorf("usage rows = %v, want %v", got, tt.want)
+                        }
+                })
+        }
+}
+
+func TestEvidenceUsageSeededOnlyOnce(t *testing.T) {
+        pool := testDB(t)
+        useTestEvidenceStore(t)
+        withConfig(t, func(c *Config) { c.UserMaxEvidenceCount = 100 })
+        ctx := context.Background()
+        userID := "quota-" + uuid.NewString()
+        sessionID := insertTestSession(t, pool, nil, nil)
+        for _, photo := range []string{"bell-1", "bell-2", "bell-3"} {
+                insertTestEvidence(t, pool, sessionID, []byte(photo), map[string]interface{}{"uploaded_by": userID})
+        }
+
+        reserve := func() {
+                tx, err := pool.Begin(ctx)
+                if err != nil {
+                        t.Fatal(err)
+                }
+                defer tx.Rollback(ctx)
+                if err := reserveEvidenceQuota(ctx, tx, sessionID, userID, 10); err != nil {
+                        t.Fatal(err)
+                }
+                if err := tx.Commit(ctx); err != nil {
+                        t.Fatal(err)
+                }
+        }
+
+        // The first reservation seeds from the three existing rows
+        reserve()
+        if got := usageRows(t, pool, sessionID, userID)[quotaScopeUser]; got != 4 {
+                t.Fatalf("user usage = %d, want 3 seeded + 1", got)
+        }
+
+        // Later rows are not recounted once the counter exists
+        insertTestEvidence(t, pool, sessionID, []byte("bell-4"), map[string]interface{}{"uploaded_by": userID})
+        reserve()
+        if got := usageRows(t, pool, sessionID, userID)[quotaScopeUser]; got != 5 {
+                t.Errorf("user usage = %d, want 5 without a reseed", got)
+        }
+}
+
+func TestEvidenceUsageSeedUsesIndexes(t *testing.T) {
+        pool := testDB(t)
+        ctx := context.Background()
+        sessions := make([]string, 20)
+        for i := range sessions {
+                sessions[i] = insertTestSession(t, pool, nil, nil)
+        }
+        if _, err := pool.Exec(ctx, `
+                INSERT INTO evidence (session_id, evidence_type, file_path, metadata, checksum)
+                SELECT s.id::uuid, 'photo', 'evidence/seed',
+                       jsonb_build_object('uploaded_by', 'seed-inspector-' || (n % 200), 'file_size', n), md5(s.id || n)
+                FROM unnest($1::text[]) AS s(id), generate_series(1, 200) AS n
+        `, sessions); err != nil {
+                t.Fatal(err)
+        }
+        if _, err := pool.Exec(ctx, `ANALYZE evidence`); err != nil {
+                t.Fatal(err)
+        }
+
+        tests := []struct {
+                item BatchItem
+                want string
+        }{
+                {seedEvidenceUsageItem(quotaScopeSession, sessions[3]), "Index"},
+                {seedEvidenceUsageItem(quotaScopeUser, "seed-inspector-17"), "ix_evidence_uploaded_by"},
+        }
+        for _, tt := range tests {
+                tx, err := pool.Begin(ctx)
+                if err != nil {
+                        t.Fatal(err)
+                }
+                var plan string
+                err = tx.QueryRow(ctx, "EXPLAIN (FORMAT JSON) "+tt.item.SQL, tt.item.Args...).Scan(&plan)
+                tx.Rollback(ctx)
+                if err != nil {
+                        t.Fatalf("%s: %v", tt.item.Ref, err)
+                }
+                if seqScans(t, plan, "evidence") > 0 || !strings.Contains(plan, tt.want) {
+                        t.Errorf("%s: plan scans evidence or does not use %s:\n%s", tt.item.Ref, tt.want, plan)
+                }
+        }
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+        "fmt"
+        "log"
+        "math"
+        "net/http"
+        "strconv"
+        "strings"
+        "sync"
+        "time"
+)
+
+// Token bucket refilled continuously at rate tokens per second up to burst
+type tokenBucket struct {
+        rate   float64
+        burst  float64
+        tokens float64
+        last   time.Time
+}
+
+// Take a token if available; otherwise report how long until one is
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+        b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+        b.last = now
+        if b.tokens >= 1 {
+                b.tokens--
+                return true, 0
+        }
+        return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Per-user evidence upload limiter. Limits are requests per minute, resolved from
+// EVIDENCE_RATE_LIMIT_OVERRIDES by user ("<user_id>=N") then tenant
+// ("tenant:<tenant_id>=N", applied to each user of the tenant), falling back to
+// EVIDENCE_RATE_LIMIT_PER_MINUTE. A limit of 0 means unlimited.
+type RateLimiter struct {
+        mu        sync.Mutex
+        buckets   map[string]*tokenBucket
+        overrides map[string]int64
+        lastSweep time.Time
+}
+
+var evidenceRateLimiter = newRateLimiter(cfg.EvidenceRateLimitOverrides)
+
+// Build a limiter from raw override values, ignoring malformed entries
+func newRateLimiter(raw map[string]string) *RateLimiter {
+        overrides := make(map[string]int64, len(raw))
+        for key, value := range raw {
+                limit, err := strconv.ParseInt(value, 10, 64)
+                if err != nil || limit < 0 {
+                        log.Printf("Ignoring invalid rate limit override %s=%q", key, value)
+                        continue
+                }
+                overrides[key] = limit
+        }
+        return &RateLimiter{buckets: make(map[string]*tokenBucket), overrides: overrides}
+}
+
+// Per-minute limit for a user
+func (l *RateLimiter) limitFor(tenantID, userID string) int64 {
+        if limit, ok := l.overrides[userID]; ok {
+                return limit
+        }
+        if tenantID != "" {
+                if limit, ok := l.overrides["tenant:"+tenantID]; ok {
+                        return limit
+                }
+        }
+        return cfg.EvidenceRateLimitPerMinute
+}
+
+// Consume one request for a user, returning the wait before retrying when limited
+func (l *RateLimiter) Allow(tenantID, userID string) (bool, time.Duration) {
+        limit := l.limitFor(tenantID, userID)
+        if limit <= 0 {
+                return true, 0
+        }
+
+        l.mu.Lock()
+        defer l.mu.Unlock()
+
+        now := time.Now()
+        l.sweep(now)
+
+        key := tenantSessionKey(tenantID, userID)
+        rate := float64(limit) / 60
+        bucket, ok := l.buckets[key]
+        if !ok || bucket.burst != float64(limit) {
+                // New user, or their limit changed; start from a full bucket
+                bucket = &tokenBucket{rate: rate, burst: float64(limit), tokens: float64(limit), last: now}
+                l.buckets[key] = bucket
+        }
+        return bucket.take(now)
+}
+
+// Drop buckets that have been idle long enough to have refilled completely
+func (l *RateLimiter) sweep(now time.Time) {
+        if now.Sub(l.lastSweep) < time.Minute {
+                return
+        }
+        l.lastSweep = now
+        for key, bucket := range l.buckets {
+                if now.Sub(bucket.last) > time.Minute {
+                        delete(l.buckets, key)
+                }
+        }
+}
+
+// Format a Retry-After value in whole seconds, rounding up
+func retryAfterSeconds(wait time.Duration) string {
+        return fmt.Sprintf("%d", int64(math.Ceil(wait.Seconds())))
+}
+
+// Counts in-flight operations per session so one session cannot monopolize
+// upload or merge capacity. Entries are removed when their count drops to zero.
+type ConcurrencyLimiter struct {
+        mu       sync.Mutex
+        inFlight map[string]int64
+}
+
+var sessionUploadLimiter = &ConcurrencyLimiter{inFlight: make(map[string]int64)}
+
+// Admits CRDT merges per session before they queue on the session row lock
+var sessionMergeLimiter = &ConcurrencyLimiter{inFlight: make(map[string]int64)}
+
+// Start an operation for key unless limit are already in flight (0 means unlimited).
+// The returned release must be called when the operation finishes.
+func (l *ConcurrencyLimiter) Acquire(key string, limit int64) (func(), bool) {
+        if limit <= 0 {
+                return func() {}, true
+        }
+
+        l.mu.Lock()
+        defer l.mu.Unlock()
+        if l.inFlight[key] >= limit {
+                return nil, false
+        }
+        l.inFlight[key]++
+
+        var once sync.Once
+        return func() {
+                once.Do(func() {
+                        l.mu.Lock()
+                        defer l.mu.Unlock()
+                        if l.inFlight[key]--; l.inFlight[key] <= 0 {
+                                delete(l.inFlight, key)
+                        }
+                })
+        }, true
+}
+
+// Header naming an upload's session ahead of the multipart body
+const uploadSessionHeader = "X-Session-ID"
+
+// Session named by X-Session-ID or the session_id query parameter, so the
+// per-session upload slot can be taken before the body is read. Returns ""
+// when the client only sends session_id as a form field.
+func uploadSessionHint(r *http.Request) string {
+        if sessionID := strings.TrimSpace(r.Header.Get(uploadSessionHeader)); sessionID != "" {
+                return sessionID
+        }
+        return strings.TrimSpace(r.URL.Query().Get("session_id"))
+}
+
+// Take the per-session upload slot for sessionID, writing 429 when the session
+// is at SESSION_MAX_CONCURRENT_UPLOADS
+func acquireSessionUpload(w http.ResponseWriter, r *http.Request, sessionID string) (func(), bool) {
+        release, ok := sessionUploadLimiter.Acquire(tenantSessionKey(tenantFromContext(r.Context()), sessionID),
+                cfg.SessionMaxConcurrentUploads)
+        if !ok {
+                w.Header().Set("Retry-After", "1")
+                http.Error(w, "Too many concurrent uploads for this session", http.StatusTooManyRequests)
+                return nil, false
+        }
+        return release, true
+}
+
+// Take the upload slot for the form's session_id once the body is parsed. When
+// the slot was already taken for a hinted session, the form must name the same
+// session and nothing more is acquired.
+func acquireFormSessionUpload(w http.ResponseWriter, r *http.Request, sessionID, hinted string) (func(), bool) {
+        if hinted == "" {
+                return acquireSessionUpload(w, r, sessionID)
+        }
+        if sessionID != hinted {
+                http.Error(w, "session_id does not match "+uploadSessionHeader, http.StatusBadRequest)
+                return nil, false
+        }
+        return func() {}, true
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+        "context"
+        "io"
+        "net/http"
+        "net/http/httptest"
+        "strconv"
+        "strings"
+        "sync"
+        "sync/atomic"
+        "testing"
+        "time"
+)
+
+// Exhaust a user's bucket, returning how many requests were allowed
+func allowedRequests(l *RateLimiter, tenantID, userID string, attempts int) int {
+        allowed := 0
+        for i := 0; i < attempts; i++ {
+                if ok, _ := l.Allow(tenantID, userID); ok {
+                        allowed++
+                }
+        }
+        return allowed
+}
+
+func TestRateLimiterPerUserOverrides(t *testing.T) {
+        withConfig(t, func(c *Config) { c.EvidenceRateLimitPerMinute = 5 })
+        limiter := newRateLimiter(map[string]string{
+                "lead-inspector":  "40",
+                "tenant:metro_fd": "12",
+                "contractor-9":    "0",
+                "broken":          "lots",
+                "negative":        "-3",
+        })
+
+        tests := []struct {
+                name     string
+                tenantID string
+                userID   string
+                want     int
+        }{
+                {"privileged user exceeds the default within their limit", "", "lead-inspector", 40},
+                {"unknown user falls back to the default", "", "new-hire", 5},
+                {"tenant override", "metro_fd", "field-tech", 12},
+                {"user override beats tenant override", "metro_fd", "lead-inspector", 40},
+                {"zero override is unlimited", "", "contractor-9", 100},
+                {"malformed override ignored", "", "broken", 5},
+                {"negative override ignored", "", "negative", 5},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        if got := allowedRequests(limiter, tt.tenantID, tt.userID, 100); got != tt.want {
+                                t.Errorf("allowed %d of 100 requests, want %d", got, tt.want)
+                        }
+                })
+        }
+}
+
+func TestRateLimiterRetryAfter(t *testing.T) {
+        withConfig(t, func(c *Config) { c.EvidenceRateLimitPerMinute = 6 })
+        limiter := newRateLimiter(nil)
+        allowedRequests(limiter, "", "surveyor", 6)
+
+        ok, wait := limiter.Allow("", "surveyor")
+        if ok {
+                t.Fatal("request beyond the limit allowed")
+        }
+        // 6 per minute refills one token every 10 seconds
+        if wait <= 9*time.Second || wait > 10*time.Second {
+                t.Errorf("wait = %s, want about 10s", wait)
+        }
+        if got := retryAfterSeconds(wait); got != "10" {
+                t.Errorf("Retry-After = %s, want 10", got)
+        }
+
+        // The same user in another tenant has a separate bucket
+        if ok, _ := limiter.Allow("harbor", "surveyor"); !ok {
+                t.Error("bucket shared across tenants")
+        }
+}
+
+func TestEvidenceUploadRateLimited(t *testing.T) {
+        withConfig(t, func(c *Config) { c.EvidenceRateLimitPerMinute = 2 })
+        saved := evidenceRateLimiter
+        evidenceRateLimiter = newRateLimiter(map[string]string{"inspector-TestEvidenceUploadRateLimited/privileged": "4"})
+        t.Cleanup(func() { evidenceRateLimiter = saved })
+
+        // Requests are rejected for their content type once admitted, so no database is needed
+        upload := func(user string) *httptest.ResponseRecorder {
+                r := httptest.NewRequest(http.MethodPost, "/v1/evidence", nil)
+                r.Header.Set("Idempotency-Key", "rate-"+user)
+                r.Header.Set("X-User-ID", "inspector-"+t.Name()+"/"+user)
+                r.Header.Set("Content-Type", "text/plain")
+                w := httptest.NewRecorder()
+                handleEvidence(w, r)
+                return w
+        }
+
+        for _, tt := range []struct {
+                user    string
+                allowed int
+        }{{"default", 2}, {"privileged", 4}} {
+                for i := 0; i < tt.allowed; i++ {
+                        if w := upload(tt.user); w.Code != http.StatusUnsupportedMediaType {
+                                t.Fatalf("%s request %d = %d, want it admitted", tt.user, i+1, w.Code)
+                        }
+                }
+                w := upload(tt.user)
+                if w.Code != http.StatusTooManyRequests {
+                        t.Fatalf("%s request %d = %d, want 429", tt.user, tt.allowed+1, w.Code)
+                }
+                if seconds, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || seconds < 1 || seconds > 30 {
+                        t.Errorf("%s Retry-After = %q", tt.user, w.Header().Get("Retry-After"))
+                }
+        }
+}
+
+func TestConcurrencyLimiterCapsInFlight(t *testing.T) {
+        limiter := &ConcurrencyLimiter{inFlight: make(map[string]int64)}
+
+        var (
+                wg       sync.WaitGroup
+                mu       sync.Mutex
+                releases []func()
+                rejected int
+        )
+        for i := 0; i < 12; i++ {
+                wg.Add(1)
+                go func() {
+                        defer wg.Done()
+                        release, ok := limiter.Acquire("session-pump-room", 4)
+                        mu.Lock()
+                        defer mu.Unlock()
+                        if ok {
+                                releases = append(releases, release)
+                        } else {
+                                rejected++
+                        }
+                }()
+        }
+        wg.Wait()
+        if len(releases) != 4 || rejected != 8 {
+                t.Fatalf("acquired %d, rejected %d, want 4 and 8", len(releases), rejected)
+        }
+
+        // Another session has its own allowance
+        if _, ok := limiter.Acquire("session-riser-3", 4); !ok {
+                t.Error("a different session was rejected")
+        }
+
+        // Releasing twice must not free a second slot
+        releases[0]()
+        releases[0]()
+        if got := limiter.inFlight["session-pump-room"]; got != 3 {
+                t.Errorf("in flight after release = %d, want 3", got)
+        }
+        for _, release := range releases[1:] {
+                release()
+        }
+        if _, ok := limiter.inFlight["session-pump-room"]; ok {
+                t.Error("entry not removed once its uploads finished")
+        }
+}
+
+// Body that records whether the handler started reading it
+type watchedBody struct {
+        io.Reader
+        read atomic.Bool
+}
+
+func (b *watchedBody) Read(p []byte) (int, error) {
+        b.read.Store(true)
+        return b.Reader.Read(p)
+}
+
+func TestSessionUploadCapEnforcedForConcurrentUploads(t *testing.T) {
+        withConfig(t, func(c *Config) { c.SessionMaxConcurrentUploads = 2 })
+        const sessionID = "3f6c1e52-8d0b-4c1e-9a57-2b1f0c9d4e11"
+
+        // Two uploads stall mid-body, holding the session's slots
+        var (
+                wg    sync.WaitGroup
+                pipes []*io.PipeWriter
+                codes = make([]int, 2)
+        )
+        for i := range codes {
+                pr, pw := io.Pipe()
+                pipes = append(pipes, pw)
+                r := httptest.NewRequest(http.MethodPost, "/v1/evidence", pr)
+                r.Header.Set("Content-Type", "multipart/form-data; boundary=stalled")
+                r.Header.Set("Idempotency-Key", "stalled-upload-"+strconv.Itoa(i))
+                r.Header.Set("X-User-ID", "inspector-"+strconv.Itoa(i))
+                r.Header.Set(uploadSessionHeader, sessionID)
+                wg.Add(1)
+                go func() {
+                        defer wg.Done()
+                        w := httptest.NewRecorder()
+                        handleEvidence(w, r)
+                        codes[i] = w.Code
+                }()
+        }
+        deadline := time.Now().Add(5 * time.Second)
+        for {
+                sessionUploadLimiter.mu.Lock()
+                inFlight := sessionUploadLimiter.inFlight[sessionID]
+                sessionUploadLimiter.mu.Unlock()
+                if inFlight == 2 {
+                        break
+                }
+                if time.Now().After(deadline) {
+                        t.Fatalf("in flight = %d, want 2", inFlight)
+                }
+                time.Sleep(5 * time.Millisecond)
+        }
+
+        // A third upload naming the session is turned away without its body being read
+        for _, hint := range []string{"header", "query"} {
+                body := &watchedBody{Reader: strings.NewReader("--stalled--\r\n")}
+                r := httptest.NewRequest(http.MethodPost, "/v1/evidence", body)
+                r.Header.Set("Content-Type", "multipart/form-data; boundary=stalled")
+                r.Header.Set("Idempotency-Key", "third-upload-"+hint)
+                r.Header.Set("X-User-ID", "inspector-late")
+                if hint == "header" {
+                        r.Header.Set(uploadSessionHeader, sessionID)
+                } else {
+                        r.URL.RawQuery = "session_id=" + sessionID
+                }
+                w := httptest.NewRecorder()
+                handleEvidence(w, r)
+                if w.Code != http.StatusTooManyRequests {
+                        t.Errorf("%s hint: status = %d, want 429", hint, w.Code)
+                }
+                if w.Header().Get("Retry-After") == "" {
+                        t.Errorf("%s hint: 429 without Retry-After", hint)
+                }
+                if body.read.Load() {
+                        t.Errorf("%s hint: body was read before rejecting", hint)
+                }
+        }
+
+        for _, pw := range pipes {
+                pw.CloseWithError(io.ErrUnexpectedEOF)
+        }
+        wg.Wait()
+        for i, code := range codes {
+                if code == http.StatusTooManyRequests {
+                        t.Errorf("stalled upload %d was rate limited", i)
+                }
+        }
+        sessionUploadLimiter.mu.Lock()
+        defer sessionUploadLimiter.mu.Unlock()
+        if _, ok := sessionUploadLimiter.inFlight[sessionID]; ok {
+                t.Error("session slots not released after the uploads finished")
+        }
+}
+
+func TestFormSessionMustMatchHint(t *testing.T) {
+        withConfig(t, func(c *Config) { c.SessionMaxConcurrentUploads = 1 })
+        r := httptest.NewRequest(http.MethodPost, "/v1/evidence", nil)
+
+        w := httptest.NewRecorder()
+        if _, ok := acquireFormSessionUpload(w, r, "session-b", "session-a"); ok || w.Code != http.StatusBadRequest {
+                t.Errorf("mismatched form session: ok = %v, status = %d, want 400", ok, w.Code)
+        }
+
+        // The hinted slot is already held, so a matching form takes nothing more
+        w = httptest.NewRecorder()
+        release, ok := acquireFormSessionUpload(w, r, "session-a", "session-a")
+        if !ok {
+                t.Fatalf("matching form session rejected with %d", w.Code)
+        }
+        release()
+        sessionUploadLimiter.mu.Lock()
+        defer sessionUploadLimiter.mu.Unlock()
+        if _, held := sessionUploadLimiter.inFlight["session-a"]; held {
+                t.Error("a slot was taken for an already hinted session")
+        }
+}
+
+func TestSessionMergeLimitFailsFast(t *testing.T) {
+        withConfig(t, func(c *Config) { c.SessionMaxConcurrentMerges = 1 })
+        const sessionID = "6a2f8c14-d03b-4e75-b9a1-5c7e0f2d8b36"
+        release, ok := sessionMergeLimiter.Acquire(sessionID, 1)
+        if !ok {
+                t.Fatal("could not take the session's merge slot")
+        }
+        defer release()
+
+        body := []byte(`{"changes": [{"op": "set", "path": "/riser", "value": "drained"}], "idempotency_key": "merge-cap-1"}`)
+        w := postCRDTResults(t, sessionID, body, http.Header{"X-User-Id": {"inspector-12"}})
+        if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+                t.Errorf("status = %d, Retry-After %q; want 429 with Retry-After 1", w.Code, w.Header().Get("Retry-After"))
+        }
+
+        // Other sessions are unaffected
+        if other, ok := sessionMergeLimiter.Acquire("other-"+sessionID, 1); !ok {
+                t.Error("another session was limited")
+        } else {
+                other()
+        }
+}
+
+func TestHammeredSessionGets429InsteadOfHanging(t *testing.T) {
+        pool := testDB(t)
+        withConfig(t, func(c *Config) { c.SessionMaxConcurrentMerges = 2 })
+        userID := insertTestUser(t, pool, "hammer")
+        sessionID := insertTestSession(t, pool, nil, nil)
+        ctx := context.Background()
+
+        // Hold the session row lock so admitted merges queue on it
+        lock, err := pool.Begin(ctx)
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer lock.Rollback(ctx)
+        if _, err := lock.Exec(ctx, "SELECT 1 FROM test_sessions WHERE id = $1 FOR UPDATE", sessionID); err != nil {
+                t.Fatal(err)
+        }
+
+        const requests = 12
+        codes := make(chan int, requests)
+        for i := 0; i < requests; i++ {
+                go func() {
+                        body := []byte(`{"changes": [{"op": "set", "path": "/pull_station_` + strconv.Itoa(i) + `", "value": "tested"}], "idempotency_key": "hammer-` +
+                                strconv.Itoa(i) + "-" + sessionID + `"}`)
+                        codes <- postCRDTResults(t, sessionID, body, http.Header{"X-User-Id": {userID}}).Code
+                }()
+        }
+
+        // Everything beyond the two admitted merges is turned away while the lock is held
+        rejected := 0
+        timeout := time.After(5 * time.Second)
+        for rejected < requests-2 {
+                select {
+                case code := <-codes:
+                        if code != http.StatusTooManyRequests {
+                                t.Fatalf("status = %d while the session was locked, want 429", code)
+                        }
+                        rejected++
+                case <-timeout:
+                        t.Fatalf("only %d of %d excess requests rejected; the rest are hanging", rejected, requests-2)
+                }
+        }
+
+        lock.Rollback(ctx)
+        for i := 0; i < 2; i++ {
+                select {
+                case code := <-codes:
+                        if code != http.StatusOK {
+                                t.Errorf("admitted merge = %d, want 200", code)
+                        }
+                case <-time.After(5 * time.Second):
+                        t.Fatal("admitted merge did not finish after the lock was released")
+                }
+        }
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "net/http"
+        "time"
+)
+
+// Implemented by evidence stores that can probe their own backend
+type EvidenceStoreChecker interface {
+        Check(ctx context.Context) error
+}
+
+// Key probed on stores without a Check method; a not-found answer proves reachability
+const readinessProbeKey = "readyz-probe"
+
+// A dependency probed by /readyz. Failing non-critical checks degrade readiness
+// instead of failing it.
+type readinessCheck struct {
+        Name     string
+        Critical bool
+        Probe    func(ctx context.Context) error
+}
+
+// Result of a single readiness probe
+type DependencyStatus struct {
+        Status    string `json:"status"`
+        Critical  bool   `json:"critical"`
+        LatencyMs int64  `json:"latency_ms"`
+        Error     string `json:"error,omitempty"`
+}
+
+// Dependencies and background job heartbeats probed on each readiness check
+func readinessChecks() []readinessCheck {
+        checks := []readinessCheck{
+                {Name: "database", Critical: true, Probe: func(ctx context.Context) error {
+                        return dbPool.Ping(ctx)
+                }},
+                {Name: "evidence_store", Critical: cfg.ReadyzStoreCritical, Probe: checkEvidenceStore},
+        }
+        return append(checks, jobHeartbeats.readinessChecks()...)
+}
+
+// Probe the configured evidence store
+func checkEvidenceStore(ctx context.Context) error {
+        return probeEvidenceStore(ctx, evidenceStore)
+}
+
+// Probe a store via its Check method, or a sentinel Size lookup when it has none
+func probeEvidenceStore(ctx context.Context, store EvidenceStore) error {
+        if checker, ok := store.(EvidenceStoreChecker); ok {
+                return checker.Check(ctx)
+        }
+        if _, err := store.Size(ctx, readinessProbeKey); err != nil && !errors.Is(err, errEvidenceNotFound) {
+                return err
+        }
+        return nil
+}
+
+// Readiness probe: 200 when all critical dependencies are up ("ready", or
+// "degraded" if a non-critical one is down), 503 otherwise or in maintenance mode
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+        overall, dependencies := runReadinessChecks(r.Context(), readinessChecks())
+
+        // Maintenance keeps the instance alive but out of rotation
+        if state := currentMaintenance(); state != nil && state.Enabled {
+                overall = "maintenance"
+        }
+
+        statusCode := http.StatusOK
+        if overall == "unready" || overall == "maintenance" {
+                statusCode = http.StatusServiceUnavailable
+        }
+        writeJSON(w, statusCode, map[string]interface{}{
+                "status":       overall,
+                "dependencies": dependencies,
+                "time":         time.Now().UTC().Format(time.RFC3339),
+        })
+}
+
+// Probe each dependency with READYZ_TIMEOUT, returning the overall status
+// ("ready", "degraded" or "unready") and the per-dependency results
+func runReadinessChecks(ctx context.Context, checks []readinessCheck) (string, map[string]DependencyStatus) {
+        overall := "ready"
+        dependencies := make(map[string]DependencyStatus)
+
+        for _, check := range checks {
+                probeCtx, cancel := context.WithTimeout(ctx, cfg.ReadyzTimeout)
+                start := time.Now()
+                err := check.Probe(probeCtx)
+                cancel()
+
+                status := DependencyStatus{Status: "up", Critical: check.Critical, LatencyMs: time.Since(start).Milliseconds()}
+                if err != nil {
+                        status.Status = "down"
+                        status.Error = err.Error()
+                        if check.Critical {
+                                overall = "unready"
+                        } else if overall == "ready" {
+                                overall = "degraded"
+                        }
+                }
+                dependencies[check.Name] = status
+        }
+        return overall, dependencies
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "net/http"
+        "net/http/httptest"
+        "strings"
+        "testing"
+        "time"
+)
+
+// Store whose Check blocks until the probe's deadline
+type hangingStore struct{ EvidenceStore }
+
+func (hangingStore) Check(ctx context.Context) error {
+        <-ctx.Done()
+        return ctx.Err()
+}
+
+func storeChecks(critical bool) []readinessCheck {
+        return []readinessCheck{
+                {Name: "database", Critical: true, Probe: func(ctx context.Context) error { return nil }},
+                {Name: "evidence_store", Critical: critical, Probe: checkEvidenceStore},
+        }
+}
+
+func TestReadinessEvidenceStore(t *testing.T) {
+        withConfig(t, func(c *Config) { c.ReadyzTimeout = 50 * time.Millisecond })
+        store := newOutageStore(t)
+        saved := evidenceStore
+        t.Cleanup(func() { evidenceStore = saved })
+
+        tests := []struct {
+                name     string
+                store    EvidenceStore
+                down     bool
+                critical bool
+                want     string
+                wantErr  string
+        }{
+                {"store up", store, false, true, "ready", ""},
+                {"store down, critical", store, true, true, "unready", errTestStoreDown.Error()},
+                {"store down, non-critical", store, true, false, "degraded", errTestStoreDown.Error()},
+                {"store hangs past the timeout", hangingStore{store}, false, true, "unready", "deadline exceeded"},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        evidenceStore = tt.store
+                        store.down.Store(tt.down)
+                        start := time.Now()
+                        overall, dependencies := runReadinessChecks(context.Background(), storeChecks(tt.critical))
+                        if overall != tt.want {
+                                t.Errorf("status = %s, want %s", overall, tt.want)
+                        }
+                        dep := dependencies["evidence_store"]
+                        if (tt.wantErr == "") != (dep.Status == "up") || !strings.Contains(dep.Error, tt.wantErr) {
+                                t.Errorf("evidence_store = %+v, want error %q", dep, tt.wantErr)
+                        }
+                        if dep.Critical != tt.critical || dependencies["database"].Status != "up" {
+                                t.Errorf("dependencies = %+v", dependencies)
+                        }
+                        if elapsed := time.Since(start); elapsed > time.Second {
+                                t.Errorf("probe took %s despite a 50ms timeout", elapsed)
+                        }
+                })
+        }
+}
+
+func TestProbeEvidenceStoreTreatsNotFoundAsUp(t *testing.T) {
+        // FileEvidenceStore has no Check method, so the sentinel lookup is used
+        store, err := NewFileEvidenceStore(t.TempDir())
+        if err != nil {
+                t.Fatal(err)
+        }
+        if err := probeEvidenceStore(context.Background(), store); err != nil {
+                t.Errorf("missing sentinel reported as an outage: %v", err)
+        }
+}
+
+func TestReadyzReportsDependencies(t *testing.T) {
+        testDB(t)
+        withConfig(t, func(c *Config) {
+                c.ReadyzTimeout = time.Second
+                c.ReadyzStoreCritical = false
+        })
+        store := newOutageStore(t)
+        store.down.Store(true)
+        saved := evidenceStore
+        evidenceStore = store
+        t.Cleanup(func() { evidenceStore = saved })
+
+        w := httptest.NewRecorder()
+        readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+        var body struct {
+                Status       string                      `json:"status"`
+                Dependencies map[string]DependencyStatus `json:"dependencies"`
+        }
+        if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+                t.Fatal(err)
+        }
+        if w.Code != http.StatusOK || body.Status != "degraded" {
+                t.Errorf("readyz = %d %s, want 200 degraded", w.Code, body.Status)
+        }
+        if body.Dependencies["database"].Status != "up" || body.Dependencies["evidence_store"].Status != "down" {
+                t.Errorf("dependencies = %+v", body.Dependencies)
+        }
+}
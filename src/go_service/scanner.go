@@ -0,0 +1,137 @@
+package main
+
+import (
+        "bufio"
+        "context"
+        "crypto/sha256"
+        "encoding/binary"
+        "encoding/hex"
+        "errors"
+        "fmt"
+        "io"
+        "net"
+        "strings"
+        "time"
+)
+
+// Malware scanner for uploaded evidence. Scan consumes the full stream and
+// returns a non-empty threat name when the content should be rejected.
+type Scanner interface {
+        Scan(ctx context.Context, r io.Reader) (threat string, err error)
+}
+
+// Returned when the configured scanner could not produce a verdict
+var errScanUnavailable = errors.New("evidence scanner unavailable")
+
+// Active evidence scanner; nil disables scanning
+var evidenceScanner Scanner
+
+// Build the scanner selected by EVIDENCE_SCANNER
+func newScannerFromConfig() (Scanner, error) {
+        switch cfg.EvidenceScanner {
+        case "", "none":
+                return nil, nil
+        case "clamd":
+                return &ClamdScanner{Address: cfg.ClamdAddress, Timeout: cfg.ScanTimeout}, nil
+        default:
+                return nil, fmt.Errorf("unknown evidence scanner %q", cfg.EvidenceScanner)
+        }
+}
+
+// Hash src with SHA-256, streaming the same bytes through the scanner when one is configured
+func hashAndScan(ctx context.Context, scanner Scanner, src io.Reader) (hash, threat string, err error) {
+        hasher := sha256.New()
+        if scanner == nil {
+                if _, err := io.Copy(hasher, src); err != nil {
+                        return "", "", err
+                }
+                return hex.EncodeToString(hasher.Sum(nil)), "", nil
+        }
+
+        pr, pw := io.Pipe()
+        type scanResult struct {
+                threat string
+                err    error
+        }
+        results := make(chan scanResult, 1)
+        go func() {
+                threat, err := scanner.Scan(ctx, pr)
+                // Drain anything the scanner did not read so the writer never blocks
+                io.Copy(io.Discard, pr)
+                results <- scanResult{threat, err}
+        }()
+
+        _, copyErr := io.Copy(io.MultiWriter(hasher, pw), src)
+        pw.CloseWithError(copyErr)
+        result := <-results
+
+        if copyErr != nil {
+                return "", "", copyErr
+        }
+        if result.err != nil {
+                return "", "", fmt.Errorf("%w: %v", errScanUnavailable, result.err)
+        }
+        return hex.EncodeToString(hasher.Sum(nil)), result.threat, nil
+}
+
+// Scanner backed by a clamd daemon using the INSTREAM protocol
+type ClamdScanner struct {
+        Address string
+        Timeout time.Duration
+}
+
+func (c *ClamdScanner) Scan(ctx context.Context, r io.Reader) (string, error) {
+        dialer := net.Dialer{Timeout: c.Timeout}
+        conn, err := dialer.DialContext(ctx, "tcp", c.Address)
+        if err != nil {
+                return "", err
+        }
+        defer conn.Close()
+        conn.SetDeadline(time.Now().Add(c.Timeout))
+
+        if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+                return "", err
+        }
+
+        // Stream length-prefixed chunks, terminated by a zero-length chunk
+        buf := make([]byte, 32<<10)
+        var size [4]byte
+        for {
+                n, readErr := r.Read(buf)
+                if n > 0 {
+                        binary.BigEndian.PutUint32(size[:], uint32(n))
+                        if _, err := conn.Write(size[:]); err != nil {
+                                return "", err
+                        }
+                        if _, err := conn.Write(buf[:n]); err != nil {
+                                return "", err
+                        }
+                }
+                if readErr == io.EOF {
+                        break
+                }
+                if readErr != nil {
+                        return "", readErr
+                }
+        }
+        binary.BigEndian.PutUint32(size[:], 0)
+        if _, err := conn.Write(size[:]); err != nil {
+                return "", err
+        }
+
+        reply, err := bufio.NewReader(conn).ReadString(0)
+        if err != nil && err != io.EOF {
+                return "", err
+        }
+        reply = strings.TrimRight(reply, "\x00\n")
+
+        // Replies look like "stream: OK" or "stream: <signature> FOUND"
+        switch {
+        case strings.HasSuffix(reply, " OK"):
+                return "", nil
+        case strings.HasSuffix(reply, " FOUND"):
+                return strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND"), nil
+        default:
+                return "", fmt.Errorf("unexpected clamd reply %q", reply)
+        }
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+        "bufio"
+        "bytes"
+        "context"
+        "encoding/binary"
+        "errors"
+        "io"
+        "net"
+        "net/http"
+        "net/http/httptest"
+        "strings"
+        "testing"
+        "time"
+)
+
+const eicarSignature = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// Rejects any stream containing a known pattern
+type patternScanner struct {
+        pattern string
+        threat  string
+        err     error
+}
+
+func (s *patternScanner) Scan(ctx context.Context, r io.Reader) (string, error) {
+        if s.err != nil {
+                return "", s.err
+        }
+        data, err := io.ReadAll(r)
+        if err != nil {
+                return "", err
+        }
+        if bytes.Contains(data, []byte(s.pattern)) {
+                return s.threat, nil
+        }
+        return "", nil
+}
+
+// Reads only the first bytes of the stream, like a scanner that gives up early
+type shortReadScanner struct{}
+
+func (shortReadScanner) Scan(ctx context.Context, r io.Reader) (string, error) {
+        _, err := r.Read(make([]byte, 16))
+        return "", err
+}
+
+func TestHashAndScan(t *testing.T) {
+        scanner := &patternScanner{pattern: eicarSignature, threat: "Eicar-Test-Signature"}
+        infected := []byte("inspection notes\n" + eicarSignature)
+        clean := bytes.Repeat([]byte("alarm panel log line\n"), 5000)
+
+        tests := []struct {
+                name       string
+                scanner    Scanner
+                content    []byte
+                wantThreat string
+        }{
+                {"infected", scanner, infected, "Eicar-Test-Signature"},
+                {"clean", scanner, clean, ""},
+                {"no scanner", nil, infected, ""},
+                {"scanner stops reading early", shortReadScanner{}, clean, ""},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        hash, threat, err := hashAndScan(context.Background(), tt.scanner, bytes.NewReader(tt.content))
+                        if err != nil {
+                                t.Fatal(err)
+                        }
+                        if threat != tt.wantThreat {
+                                t.Errorf("threat = %q, want %q", threat, tt.wantThreat)
+                        }
+                        if hash != calculateSHA256(tt.content) {
+                                t.Errorf("hash = %s, want the SHA-256 of the full content", hash)
+                        }
+                })
+        }
+}
+
+func TestHashAndScanUnavailable(t *testing.T) {
+        scanner := &patternScanner{err: errors.New("connection refused")}
+        _, _, err := hashAndScan(context.Background(), scanner, strings.NewReader("data"))
+        if !errors.Is(err, errScanUnavailable) {
+                t.Errorf("err = %v, want errScanUnavailable", err)
+        }
+}
+
+func TestEvidenceUploadRejectedByScanner(t *testing.T) {
+        saved := evidenceScanner
+        evidenceScanner = &patternScanner{pattern: eicarSignature, threat: "Eicar-Test-Signature"}
+        t.Cleanup(func() { evidenceScanner = saved })
+
+        // dbPool is unset, so reaching the insert would panic: the scan must
+        // reject the upload before any row is written
+        content := []byte(eicarSignature)
+        r := evidenceUploadRequest(t, map[string]string{
+                "session_id":    "5f0c4a52-0d7e-4c1e-9a53-2f1b6c1d9e01",
+                "evidence_type": "document",
+                "sha256_hash":   calculateSHA256(content),
+        }, map[string][]byte{"eicar.com.txt": content})
+        w := httptest.NewRecorder()
+        handleEvidence(w, r)
+
+        if w.Code != http.StatusUnprocessableEntity {
+                t.Fatalf("status = %d, want 422: %s", w.Code, w.Body.String())
+        }
+        if !strings.Contains(w.Body.String(), "Eicar-Test-Signature") {
+                t.Errorf("body = %s, want the threat name", w.Body.String())
+        }
+}
+
+// Serve one clamd INSTREAM exchange, replying with reply
+func fakeClamd(t *testing.T, reply string) (string, <-chan []byte) {
+        t.Helper()
+        ln, err := net.Listen("tcp", "127.0.0.1:0")
+        if err != nil {
+                t.Fatal(err)
+        }
+        t.Cleanup(func() { ln.Close() })
+        received := make(chan []byte, 1)
+        go func() {
+                conn, err := ln.Accept()
+                if err != nil {
+                        return
+                }
+                defer conn.Close()
+                reader := bufio.NewReader(conn)
+                if command, _ := reader.ReadString(0); command != "zINSTREAM\x00" {
+                        return
+                }
+                var stream []byte
+                for {
+                        var size uint32
+                        if err := binary.Read(reader, binary.BigEndian, &size); err != nil || size == 0 {
+                                break
+                        }
+                        chunk := make([]byte, size)
+                        io.ReadFull(reader, chunk)
+                        stream = append(stream, chunk...)
+                }
+                received <- stream
+                conn.Write([]byte(reply + "\x00"))
+        }()
+        return ln.Addr().String(), received
+}
+
+func TestClamdScannerReplies(t *testing.T) {
+        tests := []struct {
+                reply      string
+                wantThreat string
+                wantErr    bool
+        }{
+                {"stream: OK", "", false},
+                {"stream: Win.Test.EICAR_HDB-1 FOUND", "Win.Test.EICAR_HDB-1", false},
+                {"INSTREAM size limit exceeded. ERROR", "", true},
+        }
+        for _, tt := range tests {
+                t.Run(tt.reply, func(t *testing.T) {
+                        addr, received := fakeClamd(t, tt.reply)
+                        scanner := &ClamdScanner{Address: addr, Timeout: 5 * time.Second}
+                        content := bytes.Repeat([]byte("fire door photo "), 4096)
+
+                        threat, err := scanner.Scan(context.Background(), bytes.NewReader(content))
+                        if (err != nil) != tt.wantErr {
+                                t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+                        }
+                        if threat != tt.wantThreat {
+                                t.Errorf("threat = %q, want %q", threat, tt.wantThreat)
+                        }
+                        if stream := <-received; !bytes.Equal(stream, content) {
+                                t.Errorf("clamd received %d bytes, want %d", len(stream), len(content))
+                        }
+                })
+        }
+}
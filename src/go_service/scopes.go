@@ -0,0 +1,93 @@
+package main
+
+import (
+        "fmt"
+        "net/http"
+        "strings"
+
+        "github.com/gorilla/mux"
+)
+
+// Scopes required per route, keyed by "METHOD /path/template". ROUTE_SCOPES
+// entries ("METHOD /path=scope another:scope", comma-separated) override or
+// extend these; an empty value lifts a route's requirement. Several scopes on
+// one route must all be granted. Enforced only when REQUIRE_SCOPES is set.
+var defaultRouteScopes = map[string]string{
+        "GET /v1/capabilities":                                "",
+        "POST /v1/evidence":                                   "evidence:write",
+        "GET /v1/evidence/{evidence_id}":                      "evidence:read",
+        "HEAD /v1/evidence/{evidence_id}":                     "evidence:read",
+        "DELETE /v1/evidence/{evidence_id}":                   "evidence:write",
+        "GET /v1/evidence/{evidence_id}/metadata":             "evidence:read",
+        "PATCH /v1/evidence/{evidence_id}/metadata":           "evidence:write",
+        "POST /v1/idempotency/{key}:extend":                   "crdt:write",
+        "GET /v1/audit":                                       "admin",
+        "GET /v1/admin/dead-letters":                          "admin",
+        "POST /v1/admin/dead-letters/{dead_letter_id}/replay": "admin",
+        "GET /v1/admin/maintenance":                           "admin",
+        "PUT /v1/admin/maintenance":                           "admin",
+        "GET /v1/tests/sessions/{session_id}":                 "crdt:read",
+        "HEAD /v1/tests/sessions/{session_id}":                "crdt:read",
+        "GET /v1/tests/sessions/{session_id}/evidence":        "evidence:read",
+        "DELETE /v1/tests/sessions/{session_id}/evidence":     "evidence:write",
+        "GET /v1/tests/sessions/{session_id}/evidence:bundle": "evidence:read",
+        "POST /v1/tests/sessions/{session_id}/results":        "crdt:write",
+        "POST /v1/tests/sessions/{session_id}/results/batch":  "crdt:write",
+        "GET /v1/tests/sessions/{session_id}/watch":           "crdt:read",
+        "GET /v1/tests/sessions/{session_id}/events":          "crdt:read",
+}
+
+// Scopes required for the matched route, with ROUTE_SCOPES applied
+func requiredScopes(r *http.Request) []string {
+        route := mux.CurrentRoute(r)
+        if route == nil {
+                return nil
+        }
+        template, err := route.GetPathTemplate()
+        if err != nil {
+                return nil
+        }
+        key := r.Method + " " + template
+        scopes, ok := cfg.RouteScopes[key]
+        if !ok {
+                scopes = defaultRouteScopes[key]
+        }
+        return strings.Fields(scopes)
+}
+
+// Scopes granted by token claims, via a space-separated "scope" string (as in
+// OAuth 2.0) or a "scopes" list
+func grantedScopes(claims map[string]interface{}) map[string]bool {
+        granted := make(map[string]bool)
+        if s, ok := claims["scope"].(string); ok {
+                for _, scope := range strings.Fields(s) {
+                        granted[scope] = true
+                }
+        }
+        if list, ok := claims["scopes"].([]interface{}); ok {
+                for _, scope := range list {
+                        if s, ok := scope.(string); ok {
+                                granted[s] = true
+                        }
+                }
+        }
+        return granted
+}
+
+// Check that the token grants every scope the matched route requires
+func checkRouteScopes(r *http.Request, claims map[string]interface{}) error {
+        if !cfg.RequireScopes {
+                return nil
+        }
+        required := requiredScopes(r)
+        if len(required) == 0 {
+                return nil
+        }
+        granted := grantedScopes(claims)
+        for _, scope := range required {
+                if !granted[scope] {
+                        return fmt.Errorf("token lacks required scope %q", scope)
+                }
+        }
+        return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+        "net/http"
+        "net/http/httptest"
+        "reflect"
+        "testing"
+
+        "github.com/golang-jwt/jwt/v5"
+        "github.com/gorilla/mux"
+)
+
+func TestGrantedScopes(t *testing.T) {
+        claims := map[string]interface{}{
+                "scope":  "evidence:read  crdt:write",
+                "scopes": []interface{}{"admin", 7, "evidence:read"},
+        }
+        want := map[string]bool{"evidence:read": true, "crdt:write": true, "admin": true}
+        if got := grantedScopes(claims); !reflect.DeepEqual(got, want) {
+                t.Errorf("granted = %v, want %v", got, want)
+        }
+        if got := grantedScopes(map[string]interface{}{"scope": 42}); len(got) != 0 {
+                t.Errorf("granted = %v from a malformed claim, want none", got)
+        }
+}
+
+// Router with the production route templates behind the internal JWT check
+func scopedRouter() *mux.Router {
+        ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+        router := mux.NewRouter()
+        router.HandleFunc("/v1/evidence", validateInternalJWT(ok)).Methods("POST")
+        router.HandleFunc("/v1/evidence/{evidence_id}", validateInternalJWT(ok)).Methods("GET")
+        router.HandleFunc("/v1/audit", validateInternalJWT(ok)).Methods("GET")
+        router.HandleFunc("/v1/capabilities", validateInternalJWT(ok)).Methods("GET")
+        return router
+}
+
+func TestRouteScopesEnforced(t *testing.T) {
+        withConfig(t, func(c *Config) {
+                c.RequireScopes = true
+                c.VerifyUserIDSubject = false
+                c.RouteScopes = map[string]string{
+                        "GET /v1/audit":                  "admin audit:read",
+                        "GET /v1/evidence/{evidence_id}": "",
+                }
+        })
+        router := scopedRouter()
+        tests := []struct {
+                name   string
+                method string
+                path   string
+                claims jwt.MapClaims
+                want   int
+        }{
+                {"upload with scope", http.MethodPost, "/v1/evidence", jwt.MapClaims{"scope": "evidence:write"}, http.StatusOK},
+                {"upload with scopes list", http.MethodPost, "/v1/evidence", jwt.MapClaims{"scopes": []interface{}{"evidence:write"}}, http.StatusOK},
+                {"upload with read scope only", http.MethodPost, "/v1/evidence", jwt.MapClaims{"scope": "evidence:read"}, http.StatusForbidden},
+                {"upload without scopes", http.MethodPost, "/v1/evidence", jwt.MapClaims{}, http.StatusForbidden},
+                {"override requires both", http.MethodGet, "/v1/audit", jwt.MapClaims{"scope": "admin"}, http.StatusForbidden},
+                {"override satisfied", http.MethodGet, "/v1/audit", jwt.MapClaims{"scope": "audit:read admin"}, http.StatusOK},
+                {"override lifts requirement", http.MethodGet, "/v1/evidence/ab12", jwt.MapClaims{}, http.StatusOK},
+                {"unscoped route", http.MethodGet, "/v1/capabilities", jwt.MapClaims{}, http.StatusOK},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        r := httptest.NewRequest(tt.method, tt.path, nil)
+                        r.Header.Set("X-Internal-Authorization", internalToken(t, tt.claims))
+                        w := httptest.NewRecorder()
+                        router.ServeHTTP(w, r)
+                        if w.Code != tt.want {
+                                t.Errorf("status = %d %q, want %d", w.Code, w.Body.String(), tt.want)
+                        }
+                })
+        }
+}
+
+func TestRouteScopesOffByDefault(t *testing.T) {
+        withConfig(t, func(c *Config) { c.RequireScopes = false })
+        r := httptest.NewRequest(http.MethodPost, "/v1/evidence", nil)
+        r.Header.Set("X-Internal-Authorization", internalToken(t, jwt.MapClaims{}))
+        w := httptest.NewRecorder()
+        scopedRouter().ServeHTTP(w, r)
+        if w.Code != http.StatusOK {
+                t.Errorf("status = %d, want 200 without REQUIRE_SCOPES", w.Code)
+        }
+
+        // An invalid signature is rejected before scopes are considered
+        r = httptest.NewRequest(http.MethodPost, "/v1/evidence", nil)
+        r.Header.Set("X-Internal-Authorization", internalToken(t, jwt.MapClaims{"scope": "evidence:write"})+"x")
+        w = httptest.NewRecorder()
+        scopedRouter().ServeHTTP(w, r)
+        if w.Code != http.StatusUnauthorized {
+                t.Errorf("tampered token = %d, want 401", w.Code)
+        }
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+        "crypto/tls"
+        "fmt"
+        "log"
+        "net/http"
+        "time"
+)
+
+// Check the HTTP server timeouts. Zero disables a timeout, as in net/http; a
+// header timeout longer than the whole-request read timeout would never fire.
+func validateServerTimeouts() error {
+        timeouts := []struct {
+                name  string
+                value time.Duration
+        }{
+                {"SERVER_READ_TIMEOUT", cfg.ServerReadTimeout},
+                {"SERVER_READ_HEADER_TIMEOUT", cfg.ServerReadHeaderTimeout},
+                {"SERVER_WRITE_TIMEOUT", cfg.ServerWriteTimeout},
+                {"SERVER_IDLE_TIMEOUT", cfg.ServerIdleTimeout},
+        }
+        for _, t := range timeouts {
+                if t.value < 0 {
+                        return fmt.Errorf("%s must not be negative", t.name)
+                }
+        }
+        if cfg.ServerReadTimeout > 0 && cfg.ServerReadHeaderTimeout > cfg.ServerReadTimeout {
+                return fmt.Errorf("SERVER_READ_HEADER_TIMEOUT (%s) exceeds SERVER_READ_TIMEOUT (%s)",
+                        cfg.ServerReadHeaderTimeout, cfg.ServerReadTimeout)
+        }
+        return nil
+}
+
+// Build the main HTTP server with the configured timeouts and header limits
+func newHTTPServer(addr string, handler http.Handler, tlsConfig *tls.Config) (*http.Server, error) {
+        if err := validateServerTimeouts(); err != nil {
+                return nil, err
+        }
+        log.Printf("Server timeouts: read=%s read_header=%s write=%s idle=%s",
+                cfg.ServerReadTimeout, cfg.ServerReadHeaderTimeout, cfg.ServerWriteTimeout, cfg.ServerIdleTimeout)
+
+        return &http.Server{
+                Addr:    addr,
+                Handler: handler,
+                // A short header timeout bounds slowloris-style connections that trickle headers
+                ReadHeaderTimeout: cfg.ServerReadHeaderTimeout,
+                ReadTimeout:       cfg.ServerReadTimeout,
+                WriteTimeout:      cfg.ServerWriteTimeout,
+                IdleTimeout:       cfg.ServerIdleTimeout,
+                // Oversized header blocks are rejected by net/http with 431
+                MaxHeaderBytes: int(cfg.MaxHeaderBytes),
+                TLSConfig:      tlsConfig,
+        }, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+        "crypto/tls"
+        "net/http"
+        "strings"
+        "testing"
+        "time"
+)
+
+func TestNewHTTPServerUsesConfiguredTimeouts(t *testing.T) {
+        withConfig(t, func(c *Config) {
+                c.ServerReadTimeout = 40 * time.Second
+                c.ServerReadHeaderTimeout = 3 * time.Second
+                c.ServerWriteTimeout = 2 * time.Minute
+                c.ServerIdleTimeout = 0
+                c.MaxHeaderBytes = 24 << 10
+        })
+        logs := captureLog(t)
+        tlsConfig := &tls.Config{MinVersion: tls.VersionTLS13}
+        handler := http.NotFoundHandler()
+
+        server, err := newHTTPServer(":9090", handler, tlsConfig)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if server.Addr != ":9090" || server.TLSConfig != tlsConfig || server.MaxHeaderBytes != 24<<10 {
+                t.Errorf("server = %+v, want the given address, TLS config and header limit", server)
+        }
+        if server.ReadTimeout != 40*time.Second || server.ReadHeaderTimeout != 3*time.Second ||
+                server.WriteTimeout != 2*time.Minute || server.IdleTimeout != 0 {
+                t.Errorf("timeouts = read %s, header %s, write %s, idle %s; want 40s, 3s, 2m, 0",
+                        server.ReadTimeout, server.ReadHeaderTimeout, server.WriteTimeout, server.IdleTimeout)
+        }
+        if !strings.Contains(logs.String(), "read=40s read_header=3s write=2m0s idle=0s") {
+                t.Errorf("startup log = %q, want the timeouts", logs.String())
+        }
+}
+
+func TestValidateServerTimeouts(t *testing.T) {
+        tests := []struct {
+                name                      string
+                read, header, write, idle time.Duration
+                wantErr                   string
+        }{
+                {"defaults", 15 * time.Second, 5 * time.Second, 15 * time.Second, time.Minute, ""},
+                {"all disabled", 0, 0, 0, 0, ""},
+                {"header without read timeout", 0, 10 * time.Second, 0, 0, ""},
+                {"negative write", 15 * time.Second, 5 * time.Second, -time.Second, time.Minute, "SERVER_WRITE_TIMEOUT must not be negative"},
+                {"negative idle", 15 * time.Second, 5 * time.Second, 15 * time.Second, -1, "SERVER_IDLE_TIMEOUT must not be negative"},
+                {"header exceeds read", 8 * time.Second, 12 * time.Second, 0, 0, "exceeds SERVER_READ_TIMEOUT"},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        withConfig(t, func(c *Config) {
+                                c.ServerReadTimeout = tt.read
+                                c.ServerReadHeaderTimeout = tt.header
+                                c.ServerWriteTimeout = tt.write
+                                c.ServerIdleTimeout = tt.idle
+                        })
+                        err := validateServerTimeouts()
+                        if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+                                t.Errorf("err = %v, want %q", err, tt.wantErr)
+                        }
+                        if _, serverErr := newHTTPServer(":0", nil, nil); (serverErr != nil) != (err != nil) {
+                                t.Errorf("newHTTPServer err = %v, validation err = %v", serverErr, err)
+                        }
+                })
+        }
+}
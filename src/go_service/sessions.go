@@ -0,0 +1,395 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "io"
+        "log"
+        "net/http"
+        "strconv"
+        "strings"
+        "time"
+
+        "github.com/google/uuid"
+        "github.com/gorilla/mux"
+        "github.com/jackc/pgx/v5"
+        "golang.org/x/sync/singleflight"
+)
+
+// Current state of a test session
+type SessionState struct {
+        SessionID   string                 `json:"session_id"`
+        SessionData map[string]interface{} `json:"session_data"`
+        VectorClock map[string]int64       `json:"vector_clock"`
+        UpdatedAt   time.Time              `json:"updated_at"`
+        // Originator of each path's current value, included on request
+        Provenance map[string]FieldProvenance `json:"provenance,omitempty"`
+        fields     map[string]FieldMeta
+}
+
+// Who last wrote a path and when: the winning change under LWW, or the last
+// applied change under overwrite
+type FieldProvenance struct {
+        UserID    string    `json:"user_id,omitempty"`
+        NodeID    string    `json:"node_id,omitempty"`
+        ChangeID  string    `json:"change_id,omitempty"`
+        Timestamp time.Time `json:"timestamp"`
+        Deleted   bool      `json:"deleted,omitempty"`
+}
+
+// Copy of state with per-path provenance filled in. The original may be shared
+// between coalesced readers, so it is not modified.
+func withProvenance(state *SessionState) *SessionState {
+        withProv := *state
+        withProv.Provenance = make(map[string]FieldProvenance, len(state.fields))
+        for path, meta := range state.fields {
+                withProv.Provenance[path] = FieldProvenance{
+                        UserID:    meta.UserID,
+                        NodeID:    meta.NodeID,
+                        ChangeID:  meta.ChangeID,
+                        Timestamp: meta.Timestamp,
+                        Deleted:   meta.Deleted,
+                }
+        }
+        return &withProv
+}
+
+// Load a session's current data and vector clock. Returns pgx.ErrNoRows for unknown sessions.
+func loadSessionState(ctx context.Context, sessionID string) (*SessionState, error) {
+        query := `
+                SELECT session_data, vector_clock, updated_at, COALESCE(crdt_meta, '{}')
+                FROM test_sessions
+                WHERE id = $1
+        `
+
+        var sessionDataJSON, vectorClockJSON, crdtMetaJSON string
+        state := SessionState{SessionID: sessionID}
+        err := timeQuery("read_session", func() error {
+                return dbFor(ctx).QueryRow(ctx, query, sessionID).Scan(&sessionDataJSON, &vectorClockJSON, &state.UpdatedAt,
+                        &crdtMetaJSON)
+        })
+        if err != nil {
+                return nil, err
+        }
+        json.Unmarshal([]byte(crdtMetaJSON), &state.fields)
+
+        if err := json.Unmarshal([]byte(sessionDataJSON), &state.SessionData); err != nil || state.SessionData == nil {
+                state.SessionData = make(map[string]interface{})
+        }
+        if state.VectorClock, err = decodeVectorClock([]byte(vectorClockJSON)); err != nil {
+                return nil, err
+        }
+        return &state, nil
+}
+
+// Coalesces concurrent identical session reads into one query
+var sessionReads singleflight.Group
+
+// Load a session's state, sharing one query among concurrent callers for the
+// same session. The query is detached from any one caller's cancellation so a
+// caller that goes away does not fail the others.
+func loadSessionStateShared(ctx context.Context, sessionID string) (*SessionState, error) {
+        key := tenantSessionKey(tenantFromContext(ctx), sessionID)
+        state, err, _ := sessionReads.Do(key, func() (interface{}, error) {
+                return loadSessionState(context.WithoutCancel(ctx), sessionID)
+        })
+        if err != nil {
+                return nil, err
+        }
+        return state.(*SessionState), nil
+}
+
+// Report whether a read must not be coalesced: "X-Read-Consistency: strong"
+// guarantees the read starts after the request arrived, so it observes every
+// write committed before then, at the cost of its own query
+func strongReadRequested(r *http.Request) bool {
+        return strings.EqualFold(r.Header.Get("X-Read-Consistency"), "strong")
+}
+
+// Report whether any node in stored has advanced beyond the client's view
+func clockAdvancedPast(stored, client map[string]int64) bool {
+        for node, counter := range stored {
+                if counter > client[node] {
+                        return true
+                }
+        }
+        return false
+}
+
+// Long-poll for session changes: holds the request until the stored vector clock
+// advances past the client-supplied ?clock= (JSON object) or the timeout elapses.
+// Returns 200 with the new state, or 204 if nothing changed before the timeout.
+func handleWatchSession(w http.ResponseWriter, r *http.Request) {
+        sessionID := mux.Vars(r)["session_id"]
+
+        clientClock := make(map[string]int64)
+        if raw := r.URL.Query().Get("clock"); raw != "" {
+                if err := json.Unmarshal([]byte(raw), &clientClock); err != nil {
+                        http.Error(w, "Invalid clock parameter", http.StatusBadRequest)
+                        return
+                }
+        }
+
+        timeout := cfg.LongPollDefaultTimeout
+        if raw := r.URL.Query().Get("timeout"); raw != "" {
+                parsed, err := time.ParseDuration(raw)
+                if err != nil || parsed <= 0 {
+                        http.Error(w, "Invalid timeout parameter", http.StatusBadRequest)
+                        return
+                }
+                timeout = parsed
+        }
+        if timeout > cfg.LongPollMaxTimeout {
+                timeout = cfg.LongPollMaxTimeout
+        }
+
+        // Allow the response to outlive the server-wide write timeout
+        http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout + 5*time.Second))
+
+        ctx, cancel := context.WithTimeout(r.Context(), timeout)
+        defer cancel()
+
+        // Subscribe before reading so a write between the read and the wait is not missed
+        changes, unsubscribe := sessionNotifier.Subscribe(tenantSessionKey(tenantFromContext(r.Context()), sessionID))
+        defer unsubscribe()
+
+        for {
+                state, err := loadSessionState(ctx, sessionID)
+                if err == pgx.ErrNoRows {
+                        http.Error(w, "Session not found", http.StatusNotFound)
+                        return
+                }
+                if err != nil && ctx.Err() == nil {
+                        log.Printf("Failed to load session %s: %v", sessionID, err)
+                        http.Error(w, "Database error", http.StatusInternalServerError)
+                        return
+                }
+
+                if err == nil && clockAdvancedPast(state.VectorClock, clientClock) {
+                        writeJSON(w, http.StatusOK, state)
+                        return
+                }
+
+                select {
+                case <-changes:
+                case <-ctx.Done():
+                        if r.Context().Err() == nil {
+                                w.WriteHeader(http.StatusNoContent)
+                        }
+                        return
+                }
+        }
+}
+
+// Stream session updates as Server-Sent Events: one "session_update" event per
+// accepted CRDT write, with heartbeat comments to keep idle connections open.
+func handleSessionEvents(w http.ResponseWriter, r *http.Request) {
+        sessionID := mux.Vars(r)["session_id"]
+
+        if _, err := loadSessionState(r.Context(), sessionID); err != nil {
+                if err == pgx.ErrNoRows {
+                        http.Error(w, "Session not found", http.StatusNotFound)
+                        return
+                }
+                log.Printf("Failed to load session %s: %v", sessionID, err)
+                http.Error(w, "Database error", http.StatusInternalServerError)
+                return
+        }
+
+        changes, unsubscribe := sessionNotifier.Subscribe(tenantSessionKey(tenantFromContext(r.Context()), sessionID))
+        defer unsubscribe()
+
+        rc := http.NewResponseController(w)
+        // Streams are long-lived; disable the server-wide write timeout for this response
+        rc.SetWriteDeadline(time.Time{})
+
+        w.Header().Set("Content-Type", "text/event-stream")
+        w.Header().Set("Cache-Control", "no-cache")
+        w.Header().Set("Connection", "keep-alive")
+        w.Header().Set("X-Accel-Buffering", "no")
+        w.WriteHeader(http.StatusOK)
+        if err := rc.Flush(); err != nil {
+                log.Printf("SSE streaming unsupported: %v", err)
+                return
+        }
+
+        // A nil channel never fires, so a non-positive interval disables heartbeats
+        var heartbeat <-chan time.Time
+        if cfg.SSEHeartbeatInterval > 0 {
+                ticker := time.NewTicker(cfg.SSEHeartbeatInterval)
+                defer ticker.Stop()
+                heartbeat = ticker.C
+        }
+
+        for {
+                select {
+                case <-r.Context().Done():
+                        return
+                case change := <-changes:
+                        data, _ := json.Marshal(change)
+                        if _, err := fmt.Fprintf(w, "event: session_update\ndata: %s\n\n", data); err != nil {
+                                return
+                        }
+                case <-heartbeat:
+                        if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+                                return
+                        }
+                }
+                if err := rc.Flush(); err != nil {
+                        return
+                }
+        }
+}
+
+// Returned when a payload names a session template that is not configured
+var errUnknownSessionTemplate = errors.New("unknown session template")
+
+// Load the seed state for a configured session template
+func loadSessionTemplate(ctx context.Context, name string) (*SessionState, error) {
+        templateID, ok := cfg.SessionTemplates[name]
+        if !ok {
+                return nil, errUnknownSessionTemplate
+        }
+
+        state, err := loadSessionState(ctx, templateID)
+        if err == pgx.ErrNoRows {
+                log.Printf("Session template %q points at missing session %s", name, templateID)
+                return nil, errUnknownSessionTemplate
+        }
+        return state, err
+}
+
+// Returned when evidence targets an unknown session or one no longer accepting it
+var (
+        errSessionNotFound = errors.New("session not found")
+        errSessionClosed   = errors.New("session is not accepting evidence")
+)
+
+// Check within tx that a session exists and is not in one of
+// EVIDENCE_CLOSED_SESSION_STATUSES. The row is share-locked so the session
+// cannot be closed before the upload commits.
+func checkSessionAcceptsEvidence(ctx context.Context, tx pgx.Tx, sessionID string) (string, error) {
+        if _, err := uuid.Parse(sessionID); err != nil {
+                return "", errSessionNotFound
+        }
+
+        var status string
+        err := tx.QueryRow(ctx, "SELECT COALESCE(status, '') FROM test_sessions WHERE id = $1 FOR SHARE", sessionID).Scan(&status)
+        if err == pgx.ErrNoRows {
+                return "", errSessionNotFound
+        }
+        if err != nil {
+                return "", err
+        }
+
+        for _, closed := range strings.Split(cfg.EvidenceClosedSessionStatuses, ",") {
+                if status != "" && strings.EqualFold(strings.TrimSpace(closed), status) {
+                        return status, errSessionClosed
+                }
+        }
+        return status, nil
+}
+
+// Write the response for a checkSessionAcceptsEvidence error
+func writeSessionCheckError(w http.ResponseWriter, sessionID, status string, err error) {
+        switch err {
+        case errSessionNotFound:
+                http.Error(w, "Session not found", http.StatusNotFound)
+        case errSessionClosed:
+                writeJSON(w, http.StatusConflict, map[string]string{
+                        "error":  "Session is not accepting evidence",
+                        "status": status,
+                })
+        default:
+                log.Printf("Failed to check session %s: %v", sessionID, err)
+                http.Error(w, "Database error", http.StatusInternalServerError)
+        }
+}
+
+// ETag derived from a session's vector clock; it changes whenever any node advances
+func sessionETag(clock map[string]int64) string {
+        clockJSON, _ := json.Marshal(clock)
+        return fmt.Sprintf(`"%s"`, calculateSHA256(clockJSON))
+}
+
+// Report whether an If-None-Match header matches the current ETag
+func etagMatches(header, etag string) bool {
+        for _, candidate := range strings.Split(header, ",") {
+                candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+                if candidate == "*" || candidate == etag {
+                        return true
+                }
+        }
+        return false
+}
+
+// Report whether a resource last modified at modTime is unchanged since an
+// If-Modified-Since header. HTTP dates have second precision.
+func notModifiedSince(header string, modTime time.Time) bool {
+        since, err := http.ParseTime(header)
+        if err != nil {
+                return false
+        }
+        return !modTime.Truncate(time.Second).After(since)
+}
+
+// Read a session's current state. HEAD returns the same headers without a body.
+// Conditional requests use the vector-clock ETag, falling back to Last-Modified
+// (updated_at) when If-None-Match is absent, as RFC 9110 prescribes.
+func handleGetSession(w http.ResponseWriter, r *http.Request) {
+        sessionID := mux.Vars(r)["session_id"]
+        includeProvenance, _ := strconv.ParseBool(r.URL.Query().Get("include_provenance"))
+
+        // Large sessions are streamed from the database; provenance needs the
+        // decoded field metadata, so those reads stay buffered
+        if !includeProvenance && streamLargeSession(w, r, sessionID) {
+                return
+        }
+
+        // Concurrent identical reads share a query unless the client needs a strong read
+        load := loadSessionState
+        if cfg.SessionReadCoalescing && !strongReadRequested(r) {
+                load = loadSessionStateShared
+        }
+        state, err := load(r.Context(), sessionID)
+        if err == pgx.ErrNoRows {
+                http.Error(w, "Session not found", http.StatusNotFound)
+                return
+        }
+        if err != nil {
+                log.Printf("Failed to load session %s: %v", sessionID, err)
+                http.Error(w, "Database error", http.StatusInternalServerError)
+                return
+        }
+
+        if includeProvenance {
+                state = withProvenance(state)
+        }
+        body, _ := json.Marshal(state)
+        etag := sessionETag(state.VectorClock)
+
+        w.Header().Set("ETag", etag)
+        w.Header().Set("Last-Modified", state.UpdatedAt.UTC().Format(http.TimeFormat))
+        if match := r.Header.Get("If-None-Match"); match != "" {
+                if etagMatches(match, etag) {
+                        w.WriteHeader(http.StatusNotModified)
+                        return
+                }
+        } else if since := r.Header.Get("If-Modified-Since"); since != "" && notModifiedSince(since, state.UpdatedAt) {
+                w.WriteHeader(http.StatusNotModified)
+                return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+        w.Header().Set("X-Content-SHA256", calculateSHA256(body))
+        if cfg.JSONReprDigest {
+                w.Header().Set("Repr-Digest", reprDigest(body))
+        }
+        w.WriteHeader(http.StatusOK)
+        if r.Method != http.MethodHead {
+                w.Write(body)
+        }
+}
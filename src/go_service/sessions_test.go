@@ -0,0 +1,580 @@
+package main
+
+import (
+        "bufio"
+        "context"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "net/http"
+        "net/http/httptest"
+        "reflect"
+        "strconv"
+        "strings"
+        "sync"
+        "testing"
+        "time"
+
+        "github.com/gorilla/mux"
+)
+
+// Serve handleSessionEvents for one session and return a reader over its stream
+func openSessionEvents(t *testing.T, sessionID string) (*bufio.Reader, context.CancelFunc) {
+        t.Helper()
+        router := mux.NewRouter()
+        router.HandleFunc("/v1/tests/sessions/{session_id}/events", handleSessionEvents)
+        server := httptest.NewServer(router)
+        t.Cleanup(server.Close)
+
+        ctx, cancel := context.WithCancel(context.Background())
+        req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/v1/tests/sessions/"+sessionID+"/events", nil)
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+                cancel()
+                t.Fatal(err)
+        }
+        t.Cleanup(func() { resp.Body.Close() })
+        if resp.StatusCode != http.StatusOK {
+                cancel()
+                t.Fatalf("status = %d, want 200", resp.StatusCode)
+        }
+        if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+                t.Errorf("Content-Type = %q", ct)
+        }
+        return bufio.NewReader(resp.Body), cancel
+}
+
+// Read lines until a blank line ends the next SSE message
+func readSSEMessage(t *testing.T, r *bufio.Reader) []string {
+        t.Helper()
+        lines := make(chan []string, 1)
+        go func() {
+                var msg []string
+                for {
+                        line, err := r.ReadString('\n')
+                        if err != nil {
+                                lines <- msg
+                                return
+                        }
+                        line = strings.TrimRight(line, "\n")
+                        if line == "" {
+                                lines <- msg
+                                return
+                        }
+                        msg = append(msg, line)
+                }
+        }()
+        select {
+        case msg := <-lines:
+                return msg
+        case <-time.After(3 * time.Second):
+                t.Fatal("timed out waiting for an SSE message")
+                return nil
+        }
+}
+
+func TestSessionEventsStreamsUpdatesAndHeartbeats(t *testing.T) {
+        pool := testDB(t)
+        withConfig(t, func(c *Config) { c.SSEHeartbeatInterval = 150 * time.Millisecond })
+        sessionID := insertTestSession(t, pool, nil, nil)
+
+        stream, cancel := openSessionEvents(t, sessionID)
+        defer cancel()
+
+        if msg := readSSEMessage(t, stream); len(msg) != 1 || msg[0] != ": heartbeat" {
+                t.Fatalf("first message = %q, want a heartbeat comment", msg)
+        }
+
+        sessionNotifier.dispatch(SessionChange{SessionID: sessionID, VectorClock: map[string]int64{"server": 4}})
+        msg := readSSEMessage(t, stream)
+        for len(msg) == 1 && msg[0] == ": heartbeat" {
+                msg = readSSEMessage(t, stream)
+        }
+        if len(msg) != 2 || msg[0] != "event: session_update" || !strings.Contains(msg[1], `"server":4`) {
+                t.Fatalf("update message = %q", msg)
+        }
+}
+
+func TestSessionEventsWithoutHeartbeats(t *testing.T) {
+        pool := testDB(t)
+        withConfig(t, func(c *Config) { c.SSEHeartbeatInterval = 0 })
+        sessionID := insertTestSession(t, pool, nil, nil)
+
+        stream, cancel := openSessionEvents(t, sessionID)
+        defer cancel()
+
+        // The first message is the update, with no heartbeat ahead of it
+        time.Sleep(50 * time.Millisecond)
+        sessionNotifier.dispatch(SessionChange{SessionID: sessionID, VectorClock: map[string]int64{"server": 9}})
+        if msg := readSSEMessage(t, stream); len(msg) != 2 || !strings.Contains(msg[1], `"server":9`) {
+                t.Fatalf("first message = %q, want the update", msg)
+        }
+}
+
+func TestSessionEventsReleasesSubscriptionOnDisconnect(t *testing.T) {
+        pool := testDB(t)
+        sessionID := insertTestSession(t, pool, nil, nil)
+        key := tenantSessionKey("", sessionID)
+
+        _, cancel := openSessionEvents(t, sessionID)
+        sessionNotifier.mu.Lock()
+        subscribed := len(sessionNotifier.subs[key])
+        sessionNotifier.mu.Unlock()
+        if subscribed != 1 {
+                t.Fatalf("%d subscriptions while connected, want 1", subscribed)
+        }
+
+        cancel()
+        deadline := time.Now().Add(2 * time.Second)
+        for time.Now().Before(deadline) {
+                sessionNotifier.mu.Lock()
+                _, still := sessionNotifier.subs[key]
+                sessionNotifier.mu.Unlock()
+                if !still {
+                        return
+                }
+                time.Sleep(20 * time.Millisecond)
+        }
+        t.Fatal("subscription outlived the client connection")
+}
+
+func TestSessionEventsUnknownSession(t *testing.T) {
+        testDB(t)
+        r := httptest.NewRequest(http.MethodGet, "/v1/tests/sessions/x/events", nil)
+        r = mux.SetURLVars(r, map[string]string{"session_id": "00000000-0000-0000-0000-000000000000"})
+        w := httptest.NewRecorder()
+        handleSessionEvents(w, r)
+        if w.Code != http.StatusNotFound {
+                t.Errorf("status = %d, want 404", w.Code)
+        }
+}
+
+func TestLoadSessionTemplateUnknownName(t *testing.T) {
+        withConfig(t, func(c *Config) { c.SessionTemplates = map[string]string{"annual": "irrelevant"} })
+        if _, err := loadSessionTemplate(context.Background(), "six-monthly"); err != errUnknownSessionTemplate {
+                t.Errorf("got %v, want errUnknownSessionTemplate", err)
+        }
+}
+
+func TestNewSessionSeededFromTemplate(t *testing.T) {
+        pool := testDB(t)
+        templateID := insertTestSession(t, pool,
+                map[string]interface{}{"checklist": map[string]interface{}{"sprinklers": "pending", "hydrants": "pending"}},
+                map[string]int64{"template": 3})
+        withConfig(t, func(c *Config) { c.SessionTemplates = map[string]string{"annual": templateID} })
+
+        change := map[string]interface{}{"op": "set", "path": "/checklist/sprinklers", "value": "passed"}
+
+        seeded := insertTestSession(t, pool, nil, nil)
+        response, err := mergeTestPayload(t, pool, seeded, "inspector-7", &CRDTPayload{
+                Changes:         []map[string]interface{}{change},
+                VectorClock:     map[string]int64{"tablet-1": 1},
+                SessionTemplate: "annual",
+        })
+        if err != nil {
+                t.Fatalf("merge with template: %v", err)
+        }
+        if response.VectorClock["template"] != 3 || response.VectorClock["tablet-1"] != 1 {
+                t.Errorf("seeded clock = %v, want the template's entries plus the client's", response.VectorClock)
+        }
+        state, err := loadSessionState(context.Background(), seeded)
+        if err != nil {
+                t.Fatal(err)
+        }
+        checklist, _ := state.SessionData["checklist"].(map[string]interface{})
+        if checklist["sprinklers"] != "passed" || checklist["hydrants"] != "pending" {
+                t.Errorf("seeded data = %v, want template data with the change applied", state.SessionData)
+        }
+
+        plain := insertTestSession(t, pool, nil, nil)
+        response, err = mergeTestPayload(t, pool, plain, "inspector-7", &CRDTPayload{
+                Changes:     []map[string]interface{}{change},
+                VectorClock: map[string]int64{"tablet-1": 1},
+        })
+        if err != nil {
+                t.Fatalf("merge without template: %v", err)
+        }
+        if _, ok := response.VectorClock["template"]; ok {
+                t.Errorf("untemplated session clock = %v, has template entries", response.VectorClock)
+        }
+        state, _ = loadSessionState(context.Background(), plain)
+        checklist, _ = state.SessionData["checklist"].(map[string]interface{})
+        if len(checklist) != 1 || checklist["sprinklers"] != "passed" {
+                t.Errorf("untemplated data = %v, want only the change", state.SessionData)
+        }
+
+        _, err = mergeTestPayload(t, pool, insertTestSession(t, pool, nil, nil), "inspector-7", &CRDTPayload{
+                Changes:         []map[string]interface{}{change},
+                SessionTemplate: "quarterly",
+        })
+        var mergeErr *MergeError
+        if !errors.As(err, &mergeErr) || mergeErr.StatusCode != http.StatusUnprocessableEntity {
+                t.Errorf("unknown template: got %v, want 422", err)
+        }
+}
+
+func getSession(t *testing.T, method, sessionID string, header http.Header) *httptest.ResponseRecorder {
+        t.Helper()
+        r := httptest.NewRequest(method, "/v1/tests/sessions/"+sessionID, nil)
+        for name, values := range header {
+                r.Header[name] = values
+        }
+        r = mux.SetURLVars(r, map[string]string{"session_id": sessionID})
+        w := httptest.NewRecorder()
+        handleGetSession(w, r)
+        return w
+}
+
+func TestSessionHeadMatchesGetWithoutBody(t *testing.T) {
+        pool := testDB(t)
+        sessionID := insertTestSession(t, pool, map[string]interface{}{"floor": 3, "alarms": []interface{}{"ok", "ok"}},
+                map[string]int64{"server": 2})
+
+        get := getSession(t, http.MethodGet, sessionID, nil)
+        head := getSession(t, http.MethodHead, sessionID, nil)
+        if head.Code != http.StatusOK || get.Code != http.StatusOK {
+                t.Fatalf("status HEAD %d GET %d, want 200", head.Code, get.Code)
+        }
+        if head.Body.Len() != 0 {
+                t.Errorf("HEAD returned %d body bytes", head.Body.Len())
+        }
+        for _, name := range []string{"ETag", "Last-Modified", "Content-Length", "X-Content-SHA256"} {
+                if head.Header().Get(name) == "" || head.Header().Get(name) != get.Header().Get(name) {
+                        t.Errorf("%s: HEAD %q, GET %q", name, head.Header().Get(name), get.Header().Get(name))
+                }
+        }
+        if head.Header().Get("Content-Length") != strconv.Itoa(get.Body.Len()) {
+                t.Errorf("HEAD Content-Length %s does not match the GET body (%d bytes)",
+                        head.Header().Get("Content-Length"), get.Body.Len())
+        }
+
+        // Conditional HEAD behaves like conditional GET
+        notModified := getSession(t, http.MethodHead, sessionID, http.Header{"If-None-Match": {get.Header().Get("ETag")}})
+        if notModified.Code != http.StatusNotModified {
+                t.Errorf("conditional HEAD = %d, want 304", notModified.Code)
+        }
+        if missing := getSession(t, http.MethodHead, "00000000-0000-0000-0000-000000000000", nil); missing.Code != http.StatusNotFound {
+                t.Errorf("HEAD of unknown session = %d, want 404", missing.Code)
+        }
+}
+
+func TestNotModifiedSince(t *testing.T) {
+        updated := time.Date(2026, 5, 2, 14, 3, 9, 750_000_000, time.UTC)
+        tests := []struct {
+                header string
+                want   bool
+        }{
+                {"Sat, 02 May 2026 14:03:09 GMT", true},  // same second; sub-second precision is ignored
+                {"Sat, 02 May 2026 15:00:00 GMT", true},  // later than the last write
+                {"Sat, 02 May 2026 14:03:08 GMT", false}, // one second before the last write
+                {"Saturday, 02-May-26 14:03:09 GMT", true},
+                {"not a date", false},
+                {"", false},
+        }
+        for _, tt := range tests {
+                if got := notModifiedSince(tt.header, updated); got != tt.want {
+                        t.Errorf("notModifiedSince(%q) = %v, want %v", tt.header, got, tt.want)
+                }
+        }
+}
+
+func TestETagMatches(t *testing.T) {
+        etag := sessionETag(map[string]int64{"tablet-4": 9})
+        for header, want := range map[string]bool{
+                etag:               true,
+                "W/" + etag:        true,
+                `"stale", ` + etag: true,
+                "*":                true,
+                `"stale"`:          false,
+                sessionETag(map[string]int64{"tablet-4": 10}): false,
+        } {
+                if got := etagMatches(header, etag); got != want {
+                        t.Errorf("etagMatches(%s) = %v, want %v", header, got, want)
+                }
+        }
+}
+
+func TestSessionIfModifiedSince(t *testing.T) {
+        pool := testDB(t)
+        withConfig(t, func(c *Config) { c.SessionReadCoalescing = false })
+        sessionID := insertTestSession(t, pool, map[string]interface{}{"extinguishers": 12}, map[string]int64{"server": 1})
+
+        first := getSession(t, http.MethodGet, sessionID, nil)
+        lastModified := first.Header().Get("Last-Modified")
+        if first.Code != http.StatusOK || lastModified == "" {
+                t.Fatalf("GET = %d, Last-Modified %q", first.Code, lastModified)
+        }
+
+        unchanged := getSession(t, http.MethodGet, sessionID, http.Header{"If-Modified-Since": {lastModified}})
+        if unchanged.Code != http.StatusNotModified || unchanged.Body.Len() != 0 {
+                t.Errorf("If-Modified-Since unchanged = %d with %d body bytes, want an empty 304", unchanged.Code, unchanged.Body.Len())
+        }
+
+        // A newer write makes the same conditional request return the session
+        if _, err := pool.Exec(context.Background(),
+                `UPDATE test_sessions SET updated_at = updated_at + interval '5 seconds' WHERE id = $1`, sessionID); err != nil {
+                t.Fatal(err)
+        }
+        modified := getSession(t, http.MethodGet, sessionID, http.Header{"If-Modified-Since": {lastModified}})
+        if modified.Code != http.StatusOK || modified.Body.Len() == 0 {
+                t.Errorf("If-Modified-Since after a write = %d, want 200 with the session", modified.Code)
+        }
+        if modified.Header().Get("Last-Modified") == lastModified {
+                t.Error("Last-Modified did not advance")
+        }
+
+        // If-None-Match takes precedence: a stale ETag returns 200 even when the date matches
+        precedence := getSession(t, http.MethodGet, sessionID, http.Header{
+                "If-None-Match":     {`"stale"`},
+                "If-Modified-Since": {modified.Header().Get("Last-Modified")},
+        })
+        if precedence.Code != http.StatusOK {
+                t.Errorf("stale If-None-Match with a current date = %d, want 200", precedence.Code)
+        }
+}
+
+// Fire n concurrent GETs for a session while its table is locked, so every
+// read is in flight at once, returning the status codes and bodies
+func concurrentSessionGets(t *testing.T, sessionID string, n int, header http.Header) ([]int, []string) {
+        t.Helper()
+        ctx := context.Background()
+        lock, err := dbPool.Begin(ctx)
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer lock.Rollback(ctx)
+        if _, err := lock.Exec(ctx, "LOCK TABLE test_sessions IN ACCESS EXCLUSIVE MODE"); err != nil {
+                t.Fatal(err)
+        }
+
+        codes := make([]int, n)
+        bodies := make([]string, n)
+        var wg sync.WaitGroup
+        for i := 0; i < n; i++ {
+                wg.Add(1)
+                go func() {
+                        defer wg.Done()
+                        r := httptest.NewRequest(http.MethodGet, "/v1/tests/sessions/"+sessionID, nil)
+                        r = mux.SetURLVars(r, map[string]string{"session_id": sessionID})
+                        for name, values := range header {
+                                r.Header[name] = values
+                        }
+                        w := httptest.NewRecorder()
+                        handleGetSession(w, r)
+                        codes[i], bodies[i] = w.Code, w.Body.String()
+                }()
+        }
+        // Give every request time to reach the blocked query
+        time.Sleep(200 * time.Millisecond)
+        lock.Rollback(ctx)
+        wg.Wait()
+        return codes, bodies
+}
+
+func TestConcurrentSessionGetsShareOneQuery(t *testing.T) {
+        pool := testDB(t)
+        withConfig(t, func(c *Config) {
+                c.SessionReadCoalescing = true
+                c.SessionStreamThreshold = 0
+        })
+        sessionID := insertTestSession(t, pool, map[string]interface{}{"alarm_bells": "audible"}, map[string]int64{"tablet-1": 3})
+
+        before := queryCount(t, "read_session")
+        codes, bodies := concurrentSessionGets(t, sessionID, 40, nil)
+        if queries := queryCount(t, "read_session") - before; queries != 1 {
+                t.Errorf("%d session queries for 40 concurrent GETs, want 1", queries)
+        }
+        for i := range codes {
+                if codes[i] != http.StatusOK || bodies[i] != bodies[0] {
+                        t.Fatalf("GET %d = %d %s, want the shared 200 %s", i, codes[i], bodies[i], bodies[0])
+                }
+        }
+
+        // Strong reads each run their own query
+        before = queryCount(t, "read_session")
+        concurrentSessionGets(t, sessionID, 5, http.Header{"X-Read-Consistency": {"strong"}})
+        if queries := queryCount(t, "read_session") - before; queries != 5 {
+                t.Errorf("%d session queries for 5 strong GETs, want 5", queries)
+        }
+}
+
+func TestStrongReadRequested(t *testing.T) {
+        for header, want := range map[string]bool{"": false, "strong": true, "STRONG": true, "eventual": false} {
+                r := httptest.NewRequest(http.MethodGet, "/v1/tests/sessions/x", nil)
+                if header != "" {
+                        r.Header.Set("X-Read-Consistency", header)
+                }
+                if got := strongReadRequested(r); got != want {
+                        t.Errorf("X-Read-Consistency %q: strong = %v, want %v", header, got, want)
+                }
+        }
+}
+
+func TestWithProvenanceLeavesSharedStateUntouched(t *testing.T) {
+        ts := time.Date(2026, 4, 9, 16, 45, 0, 0, time.UTC)
+        shared := &SessionState{
+                SessionID:   "b7e2c9d4-0f61-4a83-95de-3c1a7f08b2e6",
+                SessionData: map[string]interface{}{"smoke_detector": "ok"},
+                fields: map[string]FieldMeta{
+                        "/smoke_detector": {Timestamp: ts, NodeID: "tablet-east", ChangeID: "c-17", UserID: "user-42"},
+                        "/co_detector":    {Timestamp: ts, NodeID: "tablet-east", UserID: "user-42", Deleted: true},
+                },
+        }
+        state := withProvenance(shared)
+        if shared.Provenance != nil {
+                t.Error("shared state was modified")
+        }
+        want := FieldProvenance{UserID: "user-42", NodeID: "tablet-east", ChangeID: "c-17", Timestamp: ts}
+        if got := state.Provenance["/smoke_detector"]; got != want {
+                t.Errorf("smoke detector provenance = %+v, want %+v", got, want)
+        }
+        if !state.Provenance["/co_detector"].Deleted {
+                t.Error("deleted path not reported as deleted")
+        }
+}
+
+func TestProvenanceFollowsLWWWinner(t *testing.T) {
+        pool := testDB(t)
+        withConfig(t, func(c *Config) {
+                c.MergeStrategy = MergeStrategyLWW
+                c.SessionStreamThreshold = 0
+        })
+        sessionID := insertTestSession(t, pool, nil, nil)
+        now := time.Now().UTC()
+
+        // The supervisor's later reading wins over the inspector's delayed sync
+        merges := []struct {
+                userID string
+                nodeID string
+                value  string
+                at     time.Time
+        }{
+                {"supervisor-2", "tablet-sup", "tagged out", now},
+                {"inspector-8", "tablet-insp", "in service", now.Add(-5 * time.Minute)},
+        }
+        for _, m := range merges {
+                _, err := mergeTestPayload(t, pool, sessionID, m.userID, &CRDTPayload{Changes: []map[string]interface{}{{
+                        "op": "set", "path": "/fire_pump", "value": m.value,
+                        "timestamp": m.at.Format(time.RFC3339Nano), "node_id": m.nodeID,
+                }}})
+                if err != nil {
+                        t.Fatal(err)
+                }
+        }
+
+        get := func(query string) SessionState {
+                r := httptest.NewRequest(http.MethodGet, "/v1/tests/sessions/"+sessionID+query, nil)
+                r = mux.SetURLVars(r, map[string]string{"session_id": sessionID})
+                w := httptest.NewRecorder()
+                handleGetSession(w, r)
+                if w.Code != http.StatusOK {
+                        t.Fatalf("GET = %d %s", w.Code, w.Body.String())
+                }
+                var state SessionState
+                json.Unmarshal(w.Body.Bytes(), &state)
+                return state
+        }
+
+        state := get("?include_provenance=true")
+        if state.SessionData["fire_pump"] != "tagged out" {
+                t.Fatalf("fire_pump = %v, want the supervisor's value", state.SessionData["fire_pump"])
+        }
+        prov := state.Provenance["/fire_pump"]
+        if prov.UserID != "supervisor-2" || prov.NodeID != "tablet-sup" || !prov.Timestamp.Equal(now) {
+                t.Errorf("provenance = %+v, want the supervisor's winning write", prov)
+        }
+        if plain := get(""); plain.Provenance != nil {
+                t.Errorf("provenance included without being requested: %v", plain.Provenance)
+        }
+}
+
+func TestCopyTextUnescaper(t *testing.T) {
+        var out strings.Builder
+        u := &copyTextUnescaper{w: &out}
+        // An escaped backslash split across writes, and the row terminator
+        for _, chunk := range []string{`{"path": "C:\\`, `\\riser\\\\`, `valve", "note": "say \\"ok\\""}`, "\n"} {
+                if n, err := u.Write([]byte(chunk)); n != len(chunk) || err != nil {
+                        t.Fatalf("Write = %d, %v", n, err)
+                }
+        }
+        if want := `{"path": "C:\\riser\\valve", "note": "say \"ok\""}`; out.String() != want {
+                t.Errorf("unescaped = %s, want %s", out.String(), want)
+        }
+}
+
+// Session data well over a 64 KiB stream threshold, with escapes and non-ASCII text
+func largeSessionData() map[string]interface{} {
+        data := map[string]interface{}{}
+        for i := 0; i < 3000; i++ {
+                data[fmt.Sprintf("floor_%02d/room_%04d", i%40, i)] = map[string]interface{}{
+                        "status": []string{"pass", "fail", "n/a"}[i%3],
+                        "note":   fmt.Sprintf(`Detector %d: "dusty" \ cleaned — ✓`, i),
+                        "psi":    float64(i%150) + 0.5,
+                }
+        }
+        return data
+}
+
+func TestLargeSessionStreamed(t *testing.T) {
+        pool := testDB(t)
+        sessionID := insertTestSession(t, pool, largeSessionData(), map[string]int64{"tablet-roof": 17, "tablet-basement": 4})
+
+        withConfig(t, func(c *Config) { c.SessionStreamThreshold = 0 })
+        buffered := getSession(t, http.MethodGet, sessionID, nil)
+        withConfig(t, func(c *Config) { c.SessionStreamThreshold = 64 << 10 })
+        streamed := getSession(t, http.MethodGet, sessionID, nil)
+
+        if streamed.Code != http.StatusOK || streamed.Header().Get("Content-Type") != "application/json" {
+                t.Fatalf("streamed = %d %q", streamed.Code, streamed.Header().Get("Content-Type"))
+        }
+        if streamed.Header().Get("ETag") != buffered.Header().Get("ETag") || streamed.Header().Get("ETag") == "" {
+                t.Errorf("ETag = %q, buffered %q", streamed.Header().Get("ETag"), buffered.Header().Get("ETag"))
+        }
+        if !strings.Contains(streamed.Header().Get("Trailer"), "X-Content-SHA256") {
+                t.Errorf("Trailer = %q, want the checksum declared", streamed.Header().Get("Trailer"))
+        }
+        if got, want := streamed.Result().Trailer.Get("X-Content-SHA256"), calculateSHA256(streamed.Body.Bytes()); got != want {
+                t.Errorf("X-Content-SHA256 trailer = %q, want %q", got, want)
+        }
+
+        var fromStream, fromBuffer SessionState
+        if err := json.Unmarshal(streamed.Body.Bytes(), &fromStream); err != nil {
+                t.Fatalf("streamed body is not JSON: %v", err)
+        }
+        json.Unmarshal(buffered.Body.Bytes(), &fromBuffer)
+        if !reflect.DeepEqual(fromStream, fromBuffer) || len(fromStream.SessionData) != 3000 {
+                t.Errorf("streamed state differs from the buffered one (%d fields)", len(fromStream.SessionData))
+        }
+
+        notModified := getSession(t, http.MethodGet, sessionID, http.Header{"If-None-Match": {streamed.Header().Get("ETag")}})
+        if notModified.Code != http.StatusNotModified || notModified.Body.Len() != 0 {
+                t.Errorf("conditional GET = %d with %d bytes, want an empty 304", notModified.Code, notModified.Body.Len())
+        }
+}
+
+func TestLargeSessionHeadDescribesStreamedBody(t *testing.T) {
+        pool := testDB(t)
+        sessionID := insertTestSession(t, pool, largeSessionData(), map[string]int64{"tablet-roof": 17})
+        withConfig(t, func(c *Config) {
+                c.SessionStreamThreshold = 64 << 10
+                c.JSONReprDigest = true
+        })
+
+        get := getSession(t, http.MethodGet, sessionID, nil)
+        head := getSession(t, http.MethodHead, sessionID, nil)
+        if head.Code != http.StatusOK || head.Body.Len() != 0 {
+                t.Fatalf("HEAD = %d with %d bytes, want an empty 200", head.Code, head.Body.Len())
+        }
+        if got, want := head.Header().Get("Content-Length"), strconv.Itoa(get.Body.Len()); got != want {
+                t.Errorf("HEAD Content-Length = %q, want the streamed length %s", got, want)
+        }
+        if got, want := head.Header().Get("X-Content-SHA256"), get.Result().Trailer.Get("X-Content-SHA256"); got == "" || got != want {
+                t.Errorf("HEAD X-Content-SHA256 = %q, want the GET trailer %q", got, want)
+        }
+        if got, want := head.Header().Get("Repr-Digest"), get.Result().Trailer.Get("Repr-Digest"); got == "" || got != want {
+                t.Errorf("HEAD Repr-Digest = %q, want the GET trailer %q", got, want)
+        }
+        if head.Header().Get("ETag") != get.Header().Get("ETag") || head.Header().Get("Trailer") != "" {
+                t.Errorf("HEAD ETag %q Trailer %q, want GET's ETag and no trailers", head.Header().Get("ETag"), head.Header().Get("Trailer"))
+        }
+}
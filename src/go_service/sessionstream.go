@@ -0,0 +1,198 @@
+package main
+
+import (
+        "context"
+        "crypto/sha256"
+        "encoding/hex"
+        "encoding/json"
+        "fmt"
+        "io"
+        "log"
+        "net/http"
+        "strconv"
+        "time"
+
+        "github.com/google/uuid"
+        "github.com/jackc/pgx/v5"
+)
+
+// Sessions whose stored session_data exceeds SESSION_STREAM_THRESHOLD are
+// streamed instead of being decoded and re-encoded in memory: the JSON text is
+// copied from Postgres with COPY TO STDOUT straight into the response. The
+// metadata and the data are read in one repeatable-read snapshot so the ETag
+// always describes the streamed body. The body length and checksum are not
+// known up front, so the response is chunked and X-Content-SHA256 is sent as
+// a trailer (with Repr-Digest when JSON_REPR_DIGEST is set). HEAD streams the
+// same body into the digest and discards it, sending Content-Length and
+// X-Content-SHA256 as headers that describe exactly what GET would return.
+
+// Undoes COPY text-format escaping of a single text column. jsonb output has no
+// raw control characters, so the only escape present is the doubled backslash;
+// the row-terminating newline is dropped.
+type copyTextUnescaper struct {
+        w         io.Writer
+        backslash bool
+        buf       []byte
+}
+
+func (u *copyTextUnescaper) Write(p []byte) (int, error) {
+        u.buf = u.buf[:0]
+        for _, c := range p {
+                switch {
+                case u.backslash:
+                        u.backslash = false
+                        u.buf = append(u.buf, c)
+                case c == '\\':
+                        u.backslash = true
+                case c == '\n':
+                default:
+                        u.buf = append(u.buf, c)
+                }
+        }
+        if _, err := u.w.Write(u.buf); err != nil {
+                return 0, err
+        }
+        return len(p), nil
+}
+
+// Counts the bytes written through it
+type byteCounter struct {
+        n int64
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+        c.n += int64(len(p))
+        return len(p), nil
+}
+
+// Stored size of a session's data, without detoasting it. Shared among
+// concurrent readers like loadSessionStateShared when coalescing is on.
+func sessionDataSize(ctx context.Context, r *http.Request, sessionID string) (int64, error) {
+        query := func(ctx context.Context) (int64, error) {
+                var size int64
+                err := dbFor(ctx).QueryRow(ctx, "SELECT COALESCE(pg_column_size(session_data), 0) FROM test_sessions WHERE id = $1",
+                        sessionID).Scan(&size)
+                return size, err
+        }
+        if !cfg.SessionReadCoalescing || strongReadRequested(r) {
+                return query(ctx)
+        }
+        key := "size:" + tenantSessionKey(tenantFromContext(ctx), sessionID)
+        size, err, _ := sessionReads.Do(key, func() (interface{}, error) {
+                return query(context.WithoutCancel(ctx))
+        })
+        if err != nil {
+                return 0, err
+        }
+        return size.(int64), nil
+}
+
+// Stream a session GET when its data is over SESSION_STREAM_THRESHOLD. Returns
+// false, having written nothing, when the session is small enough (or unknown)
+// for the buffered path to handle.
+func streamLargeSession(w http.ResponseWriter, r *http.Request, sessionID string) bool {
+        threshold := cfg.SessionStreamThreshold
+        id, err := uuid.Parse(sessionID)
+        if threshold <= 0 || err != nil {
+                return false
+        }
+        ctx := r.Context()
+        if size, err := sessionDataSize(ctx, r, sessionID); err != nil || size <= threshold {
+                return false
+        }
+
+        tx, err := dbFor(ctx).BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+        if err != nil {
+                log.Printf("Failed to begin session stream for %s: %v", sessionID, err)
+                http.Error(w, "Database error", http.StatusInternalServerError)
+                return true
+        }
+        defer tx.Rollback(ctx)
+
+        var vectorClockJSON string
+        var updatedAt time.Time
+        err = tx.QueryRow(ctx, "SELECT vector_clock, updated_at FROM test_sessions WHERE id = $1", sessionID).
+                Scan(&vectorClockJSON, &updatedAt)
+        if err == pgx.ErrNoRows {
+                http.Error(w, "Session not found", http.StatusNotFound)
+                return true
+        }
+        if err != nil {
+                log.Printf("Failed to load session %s: %v", sessionID, err)
+                http.Error(w, "Database error", http.StatusInternalServerError)
+                return true
+        }
+        clock, err := decodeVectorClock([]byte(vectorClockJSON))
+        if err != nil {
+                log.Printf("Failed to load session %s: %v", sessionID, err)
+                http.Error(w, "Database error", http.StatusInternalServerError)
+                return true
+        }
+
+        etag := sessionETag(clock)
+        w.Header().Set("ETag", etag)
+        w.Header().Set("Last-Modified", updatedAt.UTC().Format(http.TimeFormat))
+        if match := r.Header.Get("If-None-Match"); match != "" {
+                if etagMatches(match, etag) {
+                        w.WriteHeader(http.StatusNotModified)
+                        return true
+                }
+        } else if since := r.Header.Get("If-Modified-Since"); since != "" && notModifiedSince(since, updatedAt) {
+                w.WriteHeader(http.StatusNotModified)
+                return true
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        if r.Method == http.MethodHead {
+                var size byteCounter
+                hash := sha256.New()
+                if err := copySessionBody(ctx, tx, io.MultiWriter(&size, hash), id, clock, updatedAt); err != nil {
+                        log.Printf("Failed to digest session %s: %v", sessionID, err)
+                        http.Error(w, "Database error", http.StatusInternalServerError)
+                        return true
+                }
+                sum := hash.Sum(nil)
+                w.Header().Set("Content-Length", strconv.FormatInt(size.n, 10))
+                w.Header().Set("X-Content-SHA256", hex.EncodeToString(sum))
+                if cfg.JSONReprDigest {
+                        w.Header().Set("Repr-Digest", formatReprDigest(sum))
+                }
+                w.WriteHeader(http.StatusOK)
+                return true
+        }
+
+        w.Header().Set("Trailer", "X-Content-SHA256")
+        if cfg.JSONReprDigest {
+                w.Header().Add("Trailer", "Repr-Digest")
+        }
+        w.WriteHeader(http.StatusOK)
+        hash := sha256.New()
+        if err := copySessionBody(ctx, tx, io.MultiWriter(w, hash), id, clock, updatedAt); err != nil {
+                // Headers are sent; the client sees a truncated body without a checksum
+                log.Printf("Failed to stream session %s: %v", sessionID, err)
+                return true
+        }
+        sum := hash.Sum(nil)
+        w.Header().Set("X-Content-SHA256", hex.EncodeToString(sum))
+        if cfg.JSONReprDigest {
+                w.Header().Set("Repr-Digest", formatReprDigest(sum))
+        }
+        return true
+}
+
+// Write a session's JSON body to out, copying session_data from Postgres within tx.
+// Everything but session_data comes from the fields already read in the snapshot.
+func copySessionBody(ctx context.Context, tx pgx.Tx, out io.Writer, id uuid.UUID, clock map[string]int64, updatedAt time.Time) error {
+        prefix, _ := json.Marshal(id.String())
+        clockJSON, _ := json.Marshal(clock)
+        updatedJSON, _ := json.Marshal(updatedAt)
+        fmt.Fprintf(out, `{"session_id":%s,"session_data":`, prefix)
+
+        // COPY takes no parameters; the ID is a parsed UUID, so quoting it is safe
+        copySQL := fmt.Sprintf("COPY (SELECT COALESCE(session_data, '{}'::jsonb)::text FROM test_sessions WHERE id = '%s') TO STDOUT", id)
+        if _, err := tx.Conn().PgConn().CopyTo(ctx, &copyTextUnescaper{w: out}, copySQL); err != nil {
+                return err
+        }
+        fmt.Fprintf(out, `,"vector_clock":%s,"updated_at":%s}`, clockJSON, updatedJSON)
+        return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+        "math"
+        "net/http"
+        "sync"
+        "time"
+)
+
+// Latency histogram bins grow geometrically by latencyBinGrowth from 1µs, so a
+// percentile is accurate to within ~5% using a fixed number of counters
+const (
+        latencyBinGrowth = 1.05
+        latencyBinCount  = 400 // covers 1µs to ~5 minutes; slower requests share the last bin
+)
+
+var latencyBinLogGrowth = math.Log(latencyBinGrowth)
+
+// Fixed-size log-linear latency histogram
+type latencyHistogram struct {
+        counts [latencyBinCount]uint32
+        total  uint64
+}
+
+func latencyBin(d time.Duration) int {
+        us := float64(d) / float64(time.Microsecond)
+        if us <= 1 {
+                return 0
+        }
+        return min(int(math.Log(us)/latencyBinLogGrowth), latencyBinCount-1)
+}
+
+// Upper bound of a bin, which percentiles report
+func latencyBinUpper(bin int) time.Duration {
+        return time.Duration(math.Pow(latencyBinGrowth, float64(bin+1)) * float64(time.Microsecond))
+}
+
+// Per-endpoint histograms over a sliding window split into slots. The window
+// advances slot by slot, so memory is bounded by endpoints × slots × bins.
+type LatencyTracker struct {
+        mu        sync.Mutex
+        slot      time.Duration
+        slots     int
+        endpoints map[string][]*latencyHistogram
+        epoch     []int64 // slot number each ring position currently holds
+}
+
+var latencyTracker = newLatencyTracker(cfg.LatencyWindow, int(cfg.LatencyWindowSlots))
+
+func newLatencyTracker(window time.Duration, slots int) *LatencyTracker {
+        if slots < 1 {
+                slots = 1
+        }
+        if window <= 0 {
+                window = time.Minute
+        }
+        return &LatencyTracker{
+                slot:      window / time.Duration(slots),
+                slots:     slots,
+                endpoints: make(map[string][]*latencyHistogram),
+                epoch:     make([]int64, slots),
+        }
+}
+
+// Advance the ring to now, clearing slots that fell out of the window
+func (t *LatencyTracker) rotate(now time.Time) int {
+        current := now.UnixNano() / int64(t.slot)
+        pos := int(current % int64(t.slots))
+        if t.epoch[pos] != current {
+                t.epoch[pos] = current
+                for _, ring := range t.endpoints {
+                        ring[pos] = nil
+                }
+        }
+        return pos
+}
+
+// Record a request latency for an endpoint
+func (t *LatencyTracker) Observe(endpoint string, d time.Duration) {
+        t.mu.Lock()
+        defer t.mu.Unlock()
+
+        pos := t.rotate(time.Now())
+        ring, ok := t.endpoints[endpoint]
+        if !ok {
+                ring = make([]*latencyHistogram, t.slots)
+                t.endpoints[endpoint] = ring
+        }
+        if ring[pos] == nil {
+                ring[pos] = &latencyHistogram{}
+        }
+        ring[pos].counts[latencyBin(d)]++
+        ring[pos].total++
+}
+
+// Latency percentiles for one endpoint over the window
+type LatencyStats struct {
+        Count  uint64  `json:"count"`
+        P50Ms  float64 `json:"p50_ms"`
+        P90Ms  float64 `json:"p90_ms"`
+        P99Ms  float64 `json:"p99_ms"`
+        SLOMet *bool   `json:"slo_met,omitempty"`
+}
+
+// Percentiles per endpoint over the current window
+func (t *LatencyTracker) Snapshot() map[string]LatencyStats {
+        t.mu.Lock()
+        defer t.mu.Unlock()
+
+        now := time.Now()
+        t.rotate(now)
+        oldest := now.UnixNano()/int64(t.slot) - int64(t.slots) + 1
+
+        stats := make(map[string]LatencyStats)
+        for endpoint, ring := range t.endpoints {
+                var merged latencyHistogram
+                for pos, h := range ring {
+                        if h == nil || t.epoch[pos] < oldest {
+                                continue
+                        }
+                        for bin, c := range h.counts {
+                                merged.counts[bin] += c
+                        }
+                        merged.total += h.total
+                }
+                if merged.total == 0 {
+                        delete(t.endpoints, endpoint)
+                        continue
+                }
+
+                s := LatencyStats{
+                        Count: merged.total,
+                        P50Ms: merged.percentile(0.50),
+                        P90Ms: merged.percentile(0.90),
+                        P99Ms: merged.percentile(0.99),
+                }
+                if cfg.LatencySLOP99 > 0 {
+                        met := s.P99Ms <= float64(cfg.LatencySLOP99)/float64(time.Millisecond)
+                        s.SLOMet = &met
+                }
+                stats[endpoint] = s
+        }
+        return stats
+}
+
+// Latency in milliseconds at quantile q
+func (h *latencyHistogram) percentile(q float64) float64 {
+        rank := uint64(math.Ceil(q * float64(h.total)))
+        var seen uint64
+        for bin, c := range h.counts {
+                seen += uint64(c)
+                if seen >= rank {
+                        return float64(latencyBinUpper(bin)) / float64(time.Millisecond)
+                }
+        }
+        return float64(latencyBinUpper(latencyBinCount-1)) / float64(time.Millisecond)
+}
+
+// Report p50/p90/p99 latency per endpoint over the sliding window
+func latencyStatsHandler(w http.ResponseWriter, r *http.Request) {
+        response := map[string]interface{}{
+                "window_seconds": (time.Duration(latencyTracker.slots) * latencyTracker.slot).Seconds(),
+                "endpoints":      latencyTracker.Snapshot(),
+        }
+        if cfg.LatencySLOP99 > 0 {
+                response["slo_p99_ms"] = float64(cfg.LatencySLOP99) / float64(time.Millisecond)
+        }
+        writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+        "encoding/json"
+        "math"
+        "net/http"
+        "net/http/httptest"
+        "testing"
+        "time"
+)
+
+// Report whether got is within the histogram's ~5% bin error of want, plus
+// a little for the rank falling at a bin edge
+func approxLatency(got, want float64) bool {
+        return math.Abs(got-want) <= want*0.06
+}
+
+func TestLatencyTrackerPercentiles(t *testing.T) {
+        tracker := newLatencyTracker(time.Minute, 6)
+        // 1ms..1000ms, one request each
+        for ms := 1; ms <= 1000; ms++ {
+                tracker.Observe("POST /v1/evidence", time.Duration(ms)*time.Millisecond)
+        }
+        // A fast endpoint: 95 requests at 2ms and 5 at 80ms
+        for i := 0; i < 95; i++ {
+                tracker.Observe("GET /health", 2*time.Millisecond)
+        }
+        for i := 0; i < 5; i++ {
+                tracker.Observe("GET /health", 80*time.Millisecond)
+        }
+
+        snapshot := tracker.Snapshot()
+        evidence := snapshot["POST /v1/evidence"]
+        if evidence.Count != 1000 {
+                t.Errorf("evidence count = %d, want 1000", evidence.Count)
+        }
+        for _, p := range []struct {
+                name      string
+                got, want float64
+        }{
+                {"p50", evidence.P50Ms, 500},
+                {"p90", evidence.P90Ms, 900},
+                {"p99", evidence.P99Ms, 990},
+        } {
+                if !approxLatency(p.got, p.want) {
+                        t.Errorf("evidence %s = %.1fms, want about %.0fms", p.name, p.got, p.want)
+                }
+        }
+
+        health := snapshot["GET /health"]
+        if !approxLatency(health.P90Ms, 2) || !approxLatency(health.P99Ms, 80) {
+                t.Errorf("health p90 = %.2fms, p99 = %.2fms, want about 2ms and 80ms", health.P90Ms, health.P99Ms)
+        }
+        if health.SLOMet != nil {
+                t.Error("slo_met reported without a configured SLO")
+        }
+}
+
+func TestLatencyBinBounds(t *testing.T) {
+        if bin := latencyBin(0); bin != 0 {
+                t.Errorf("bin for 0 = %d, want 0", bin)
+        }
+        if bin := latencyBin(time.Hour); bin != latencyBinCount-1 {
+                t.Errorf("bin for 1h = %d, want the last bin", bin)
+        }
+        for _, d := range []time.Duration{3 * time.Microsecond, 750 * time.Microsecond, 42 * time.Millisecond, 7 * time.Second} {
+                if upper := latencyBinUpper(latencyBin(d)); upper < d {
+                        t.Errorf("bin for %s has upper bound %s below it", d, upper)
+                }
+        }
+}
+
+func TestLatencyTrackerWindowExpires(t *testing.T) {
+        tracker := newLatencyTracker(100*time.Millisecond, 4)
+        tracker.Observe("GET /v1/sessions/{session_id}", 15*time.Millisecond)
+        if _, ok := tracker.Snapshot()["GET /v1/sessions/{session_id}"]; !ok {
+                t.Fatal("fresh observation missing from snapshot")
+        }
+        time.Sleep(150 * time.Millisecond)
+        if stats, ok := tracker.Snapshot()["GET /v1/sessions/{session_id}"]; ok {
+                t.Errorf("observation outlived the window: %+v", stats)
+        }
+}
+
+func TestLatencyStatsHandlerReportsSLO(t *testing.T) {
+        withConfig(t, func(c *Config) { c.LatencySLOP99 = 250 * time.Millisecond })
+        previous := latencyTracker
+        latencyTracker = newLatencyTracker(time.Minute, 3)
+        t.Cleanup(func() { latencyTracker = previous })
+
+        for i := 0; i < 50; i++ {
+                latencyTracker.Observe("POST /v1/tests/sessions/{session_id}/results", 40*time.Millisecond)
+                latencyTracker.Observe("GET /v1/evidence/{evidence_id}", 900*time.Millisecond)
+        }
+
+        w := httptest.NewRecorder()
+        latencyStatsHandler(w, httptest.NewRequest(http.MethodGet, "/stats/latency", nil))
+        var body struct {
+                WindowSeconds float64                 `json:"window_seconds"`
+                SLOP99Ms      float64                 `json:"slo_p99_ms"`
+                Endpoints     map[string]LatencyStats `json:"endpoints"`
+        }
+        if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+                t.Fatal(err)
+        }
+        if body.WindowSeconds != 60 || body.SLOP99Ms != 250 {
+                t.Errorf("window = %vs, slo = %vms, want 60 and 250", body.WindowSeconds, body.SLOP99Ms)
+        }
+        results := body.Endpoints["POST /v1/tests/sessions/{session_id}/results"]
+        if results.SLOMet == nil || !*results.SLOMet {
+                t.Errorf("results endpoint slo_met = %v, want true", results.SLOMet)
+        }
+        download := body.Endpoints["GET /v1/evidence/{evidence_id}"]
+        if download.SLOMet == nil || *download.SLOMet {
+                t.Errorf("download endpoint slo_met = %v, want false", download.SLOMet)
+        }
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "fmt"
+        "io"
+        "log"
+        "time"
+)
+
+// Returned by SpoolingEvidenceStore.Put when the primary store failed and the
+// object was spooled locally for later delivery
+var errEvidenceSpooled = errors.New("evidence spooled pending store recovery")
+
+// Evidence store that falls back to a local spool directory when the primary
+// store rejects writes. Spooled objects are tracked in evidence_pending_uploads
+// and flushed to the primary store by Run once it recovers. It sits beneath
+// EncryptingEvidenceStore, so spooled objects are already encrypted.
+type SpoolingEvidenceStore struct {
+        primary EvidenceStore
+        spool   *FileEvidenceStore
+}
+
+// Wrap primary with a spool rooted at dir
+func NewSpoolingEvidenceStore(primary EvidenceStore, dir string) (*SpoolingEvidenceStore, error) {
+        spool, err := NewFileEvidenceStore(dir)
+        if err != nil {
+                return nil, fmt.Errorf("failed to create evidence spool: %v", err)
+        }
+        return &SpoolingEvidenceStore{primary: primary, spool: spool}, nil
+}
+
+// Store r in the primary store, spooling it locally if that fails. Returns
+// errEvidenceSpooled when the object was accepted into the spool; r must be
+// seekable for the spool to replay bytes the primary store already consumed.
+func (s *SpoolingEvidenceStore) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+        n, err := s.primary.Put(ctx, key, r)
+        if err == nil {
+                return n, nil
+        }
+
+        seeker, ok := r.(io.Seeker)
+        if !ok {
+                return n, err
+        }
+        if _, seekErr := seeker.Seek(0, io.SeekStart); seekErr != nil {
+                return n, err
+        }
+
+        log.Printf("Evidence store write failed for %s, spooling locally: %v", key, err)
+        n, spoolErr := s.spool.Put(ctx, key, r)
+        if spoolErr != nil {
+                log.Printf("Failed to spool evidence %s: %v", key, spoolErr)
+                return n, err
+        }
+
+        // Pending uploads live in the default database so one reconciler covers all tenants
+        query := `
+                INSERT INTO evidence_pending_uploads (object_key, size_bytes, last_error)
+                VALUES ($1, $2, $3)
+                ON CONFLICT (object_key) DO UPDATE SET size_bytes = EXCLUDED.size_bytes, last_error = EXCLUDED.last_error
+        `
+        if _, dbErr := dbPool.Exec(ctx, query, key, n, err.Error()); dbErr != nil {
+                log.Printf("Failed to record pending upload %s: %v", key, dbErr)
+                s.spool.Delete(context.Background(), key)
+                return n, err
+        }
+        return n, errEvidenceSpooled
+}
+
+// Report the primary store's location; spooled objects are only held locally
+// until they are flushed there
+func (s *SpoolingEvidenceStore) StorageLocation() StorageLocation {
+        if locator, ok := s.primary.(EvidenceStoreLocator); ok {
+                return locator.StorageLocation()
+        }
+        return StorageLocation{}
+}
+
+// Probe the primary store; the spool only masks outages for writes
+func (s *SpoolingEvidenceStore) Check(ctx context.Context) error {
+        return probeEvidenceStore(ctx, s.primary)
+}
+
+// Open an object from the primary store, falling back to the spool
+func (s *SpoolingEvidenceStore) Get(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+        blob, err := s.primary.Get(ctx, key)
+        if err == nil {
+                return blob, nil
+        }
+        if spooled, spoolErr := s.spool.Get(ctx, key); spoolErr == nil {
+                return spooled, nil
+        }
+        return nil, err
+}
+
+func (s *SpoolingEvidenceStore) Size(ctx context.Context, key string) (int64, error) {
+        size, err := s.primary.Size(ctx, key)
+        if err == nil {
+                return size, nil
+        }
+        if spooled, spoolErr := s.spool.Size(ctx, key); spoolErr == nil {
+                return spooled, nil
+        }
+        return 0, err
+}
+
+// Delete an object from both the primary store and the spool
+func (s *SpoolingEvidenceStore) Delete(ctx context.Context, key string) error {
+        err := s.primary.Delete(ctx, key)
+        if spoolErr := s.spool.Delete(ctx, key); spoolErr != nil && err == nil {
+                err = spoolErr
+        }
+        if _, dbErr := dbPool.Exec(ctx, "DELETE FROM evidence_pending_uploads WHERE object_key = $1", key); dbErr != nil && err == nil {
+                err = dbErr
+        }
+        return err
+}
+
+// Flush spooled objects to the primary store every interval until ctx is cancelled
+func (s *SpoolingEvidenceStore) Run(ctx context.Context, interval time.Duration) {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        jobHeartbeats.Register(jobSpoolReconcile, interval)
+
+        for {
+                select {
+                case <-ctx.Done():
+                        return
+                case <-ticker.C:
+                        if err := s.reconcile(ctx); err != nil && ctx.Err() == nil {
+                                log.Printf("Evidence spool reconciliation error: %v", err)
+                        } else if err == nil {
+                                jobHeartbeats.Beat(jobSpoolReconcile)
+                        }
+                }
+        }
+}
+
+// Deliver pending uploads oldest first, stopping at the first store failure
+func (s *SpoolingEvidenceStore) reconcile(ctx context.Context) error {
+        rows, err := dbPool.Query(ctx, `
+                SELECT object_key FROM evidence_pending_uploads
+                ORDER BY created_at
+                LIMIT 100
+        `)
+        if err != nil {
+                return err
+        }
+        var keys []string
+        for rows.Next() {
+                var key string
+                if err := rows.Scan(&key); err != nil {
+                        rows.Close()
+                        return err
+                }
+                keys = append(keys, key)
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+                return err
+        }
+
+        for _, key := range keys {
+                if err := s.flush(ctx, key); err != nil {
+                        dbPool.Exec(ctx, `
+                                UPDATE evidence_pending_uploads
+                                SET attempts = attempts + 1, last_error = $2, last_attempt_at = CURRENT_TIMESTAMP
+                                WHERE object_key = $1
+                        `, key, err.Error())
+                        return fmt.Errorf("failed to flush %s: %v", key, err)
+                }
+                log.Printf("Flushed spooled evidence %s to store", key)
+        }
+        return nil
+}
+
+// Copy one spooled object to the primary store and release it from the spool
+func (s *SpoolingEvidenceStore) flush(ctx context.Context, key string) error {
+        blob, err := s.spool.Get(ctx, key)
+        if err == errEvidenceNotFound {
+                // The upload was rolled back or already flushed; drop the stale entry
+                _, err = dbPool.Exec(ctx, "DELETE FROM evidence_pending_uploads WHERE object_key = $1", key)
+                return err
+        }
+        if err != nil {
+                return err
+        }
+        _, err = s.primary.Put(ctx, key, blob)
+        blob.Close()
+        if err != nil {
+                return err
+        }
+
+        if _, err := dbPool.Exec(ctx, "DELETE FROM evidence_pending_uploads WHERE object_key = $1", key); err != nil {
+                return err
+        }
+        return s.spool.Delete(ctx, key)
+}
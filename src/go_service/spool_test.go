@@ -0,0 +1,207 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "crypto/rand"
+        "encoding/base64"
+        "errors"
+        "io"
+        "strings"
+        "testing"
+)
+
+func newTestEncryptingStore(t *testing.T, inner EvidenceStore) *EncryptingEvidenceStore {
+        t.Helper()
+        wrapper, err := newLocalKeyWrapper("test-key-1", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)))
+        if err != nil {
+                t.Fatal(err)
+        }
+        return NewEncryptingEvidenceStore(inner, wrapper)
+}
+
+func readAllAndClose(t *testing.T, blob io.ReadCloser) []byte {
+        t.Helper()
+        defer blob.Close()
+        data, err := io.ReadAll(blob)
+        if err != nil {
+                t.Fatal(err)
+        }
+        return data
+}
+
+func TestSpoolRequiresSeekableReader(t *testing.T) {
+        primary := newOutageStore(t)
+        primary.down.Store(true)
+        store, err := NewSpoolingEvidenceStore(primary, t.TempDir())
+        if err != nil {
+                t.Fatal(err)
+        }
+
+        // A stream the primary already consumed cannot be replayed into the spool
+        _, err = store.Put(context.Background(), "ev-stream", io.NopCloser(strings.NewReader("inspection video")))
+        if !errors.Is(err, errTestStoreDown) {
+                t.Fatalf("err = %v, want the primary store error", err)
+        }
+        if _, err := store.spool.Size(context.Background(), "ev-stream"); err != errEvidenceNotFound {
+                t.Errorf("non-seekable upload was spooled: %v", err)
+        }
+}
+
+func TestSpoolServesReadsDuringOutage(t *testing.T) {
+        primary := newOutageStore(t)
+        store, err := NewSpoolingEvidenceStore(primary, t.TempDir())
+        if err != nil {
+                t.Fatal(err)
+        }
+        ctx := context.Background()
+        if _, err := store.spool.Put(ctx, "tenant_a/ev-1", strings.NewReader("spooled riser photo")); err != nil {
+                t.Fatal(err)
+        }
+        primary.down.Store(true)
+
+        blob, err := store.Get(ctx, "tenant_a/ev-1")
+        if err != nil {
+                t.Fatal(err)
+        }
+        if got := readAllAndClose(t, blob); string(got) != "spooled riser photo" {
+                t.Errorf("Get = %q", got)
+        }
+        if size, err := store.Size(ctx, "tenant_a/ev-1"); err != nil || size != int64(len("spooled riser photo")) {
+                t.Errorf("Size = %d, %v", size, err)
+        }
+        if _, err := store.Get(ctx, "tenant_a/ev-missing"); !errors.Is(err, errTestStoreDown) {
+                t.Errorf("Get of an unspooled key = %v, want the primary error", err)
+        }
+}
+
+func TestEncryptingReaderRewindReplaysCiphertext(t *testing.T) {
+        // Several segments, so the rewind has to reset sealing state mid-stream
+        plaintext := make([]byte, 2*evidenceSegmentSize+513)
+        rand.Read(plaintext)
+        inner := &capturingStore{failFirst: true}
+        store := newTestEncryptingStore(t, inner)
+
+        if _, err := store.Put(context.Background(), "ev-rewind", bytes.NewReader(plaintext)); err != nil {
+                t.Fatal(err)
+        }
+        if !bytes.Equal(inner.attempts[0], inner.attempts[1][:len(inner.attempts[0])]) {
+                t.Error("replayed ciphertext differs from the first attempt")
+        }
+
+        // The replayed object decrypts to the original plaintext
+        inner.EvidenceStore = newOutageStore(t)
+        if _, err := inner.EvidenceStore.Put(context.Background(), "ev-rewind", bytes.NewReader(inner.attempts[1])); err != nil {
+                t.Fatal(err)
+        }
+        blob, err := store.Get(context.Background(), "ev-rewind")
+        if err != nil {
+                t.Fatal(err)
+        }
+        if got := readAllAndClose(t, blob); !bytes.Equal(got, plaintext) {
+                t.Errorf("decrypted %d bytes, want the %d byte original", len(got), len(plaintext))
+        }
+
+        // Only a rewind of a seekable source to the start is supported
+        enc := &encryptingReader{src: io.NopCloser(bytes.NewReader(plaintext))}
+        if _, err := enc.Seek(0, io.SeekStart); err == nil {
+                t.Error("rewound a non-seekable source")
+        }
+        enc = &encryptingReader{src: bytes.NewReader(plaintext)}
+        if _, err := enc.Seek(10, io.SeekStart); err == nil {
+                t.Error("seeked to a non-zero offset")
+        }
+}
+
+// Records every Put attempt's bytes; with failFirst the first attempt reads
+// part of the stream, fails, and the store rewinds and writes it again
+type capturingStore struct {
+        EvidenceStore
+        failFirst bool
+        attempts  [][]byte
+}
+
+func (s *capturingStore) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+        if s.failFirst && len(s.attempts) == 0 {
+                partial, _ := io.ReadAll(io.LimitReader(r, evidenceSegmentSize+100))
+                s.attempts = append(s.attempts, partial)
+                if _, err := r.(io.Seeker).Seek(0, io.SeekStart); err != nil {
+                        return 0, err
+                }
+        }
+        data, err := io.ReadAll(r)
+        s.attempts = append(s.attempts, data)
+        return int64(len(data)), err
+}
+
+func TestSpoolOutageAndReconciliation(t *testing.T) {
+        pool := testDB(t)
+        ctx := context.Background()
+        primary := newOutageStore(t)
+        primary.partial = 4096
+        spooling, err := NewSpoolingEvidenceStore(primary, t.TempDir())
+        if err != nil {
+                t.Fatal(err)
+        }
+        // Production wiring: encryption above the spool, so spooled bytes are ciphertext
+        store := newTestEncryptingStore(t, spooling)
+        plaintext := bytes.Repeat([]byte("smoke detector sensitivity readings\n"), 3000)
+
+        primary.down.Store(true)
+        n, err := store.Put(ctx, "ev-outage", bytes.NewReader(plaintext))
+        if !errors.Is(err, errEvidenceSpooled) {
+                t.Fatalf("Put during outage = %v, want errEvidenceSpooled", err)
+        }
+        if n != int64(len(plaintext)) {
+                t.Errorf("Put reported %d plaintext bytes, want %d", n, len(plaintext))
+        }
+        var pending int
+        pool.QueryRow(ctx, "SELECT count(*) FROM evidence_pending_uploads WHERE object_key = 'ev-outage'").Scan(&pending)
+        if pending != 1 {
+                t.Fatalf("pending uploads = %d, want 1", pending)
+        }
+        spooled := readAllAndClose(t, mustGet(t, spooling.spool, "ev-outage"))
+        if bytes.Contains(spooled, plaintext[:64]) {
+                t.Error("spooled object holds plaintext")
+        }
+
+        // Reads during the outage are served from the spool
+        if got := readAllAndClose(t, mustGet(t, store, "ev-outage")); !bytes.Equal(got, plaintext) {
+                t.Error("spooled object does not decrypt to the upload")
+        }
+
+        // Reconciliation fails while the store is down and records the attempt
+        if err := spooling.reconcile(ctx); err == nil {
+                t.Error("reconcile succeeded during the outage")
+        }
+        var attempts int
+        pool.QueryRow(ctx, "SELECT attempts FROM evidence_pending_uploads WHERE object_key = 'ev-outage'").Scan(&attempts)
+        if attempts != 1 {
+                t.Errorf("attempts = %d, want 1", attempts)
+        }
+
+        // Once the store recovers the object is flushed and released from the spool
+        primary.down.Store(false)
+        if err := spooling.reconcile(ctx); err != nil {
+                t.Fatal(err)
+        }
+        pool.QueryRow(ctx, "SELECT count(*) FROM evidence_pending_uploads WHERE object_key = 'ev-outage'").Scan(&pending)
+        if pending != 0 {
+                t.Errorf("pending uploads after reconcile = %d", pending)
+        }
+        if _, err := spooling.spool.Size(ctx, "ev-outage"); err != errEvidenceNotFound {
+                t.Errorf("spool still holds the object: %v", err)
+        }
+        if got := readAllAndClose(t, mustGet(t, newTestEncryptingStore(t, primary), "ev-outage")); !bytes.Equal(got, plaintext) {
+                t.Error("flushed object does not decrypt to the upload")
+        }
+}
+
+func mustGet(t *testing.T, store EvidenceStore, key string) io.ReadSeekCloser {
+        t.Helper()
+        blob, err := store.Get(context.Background(), key)
+        if err != nil {
+                t.Fatal(err)
+        }
+        return blob
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+        "fmt"
+        "net/http"
+        "sort"
+        "sync"
+        "sync/atomic"
+        "time"
+)
+
+// In-memory counters and gauges served as JSON on /stats when
+// PROMETHEUS_ENABLED is off, so deployments without Prometheus still see the
+// core metrics. Events are always recorded; recording is one atomic add.
+type StatsRegistry struct {
+        mu       sync.RWMutex
+        counters map[string]*atomic.Int64
+        gauges   map[string]func() int64
+        started  time.Time
+}
+
+var stats = &StatsRegistry{
+        counters: make(map[string]*atomic.Int64),
+        gauges:   make(map[string]func() int64),
+        started:  time.Now(),
+}
+
+// Core counters
+const (
+        statRequestsTotal    = "requests_total"
+        statIdempotencyHits  = "idempotency_hits_total"
+        statHashMismatches   = "hash_mismatches_total"
+        statRequestsShed     = "requests_shed_total"
+        statResponsesPrefix  = "responses_"
+        statResponsesUnknown = "responses_other_total"
+)
+
+func init() {
+        stats.Gauge("requests_in_flight", requestsInFlight.Load)
+}
+
+// Counter registered under name, created on first use
+func (s *StatsRegistry) Counter(name string) *atomic.Int64 {
+        s.mu.RLock()
+        counter, ok := s.counters[name]
+        s.mu.RUnlock()
+        if ok {
+                return counter
+        }
+
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        if counter, ok = s.counters[name]; !ok {
+                counter = &atomic.Int64{}
+                s.counters[name] = counter
+        }
+        return counter
+}
+
+// Register a gauge read when stats are reported
+func (s *StatsRegistry) Gauge(name string, read func() int64) {
+        s.mu.Lock()
+        defer s.mu.Unlock()
+        s.gauges[name] = read
+}
+
+// Increment a counter
+func (s *StatsRegistry) Inc(name string) {
+        s.Counter(name).Add(1)
+}
+
+// Count a completed request by status class (responses_2xx_total, ...)
+func (s *StatsRegistry) recordResponse(statusCode int) {
+        s.Inc(statRequestsTotal)
+        if statusCode < 100 || statusCode > 599 {
+                s.Inc(statResponsesUnknown)
+                return
+        }
+        s.Inc(fmt.Sprintf("%s%dxx_total", statResponsesPrefix, statusCode/100))
+}
+
+// Point-in-time values of all counters and gauges
+type StatsSnapshot struct {
+        Counters      map[string]int64 `json:"counters"`
+        Gauges        map[string]int64 `json:"gauges"`
+        UptimeSeconds int64            `json:"uptime_seconds"`
+}
+
+func (s *StatsRegistry) Snapshot() StatsSnapshot {
+        s.mu.RLock()
+        defer s.mu.RUnlock()
+
+        snapshot := StatsSnapshot{
+                Counters:      make(map[string]int64, len(s.counters)),
+                Gauges:        make(map[string]int64, len(s.gauges)),
+                UptimeSeconds: int64(time.Since(s.started).Seconds()),
+        }
+        for name, counter := range s.counters {
+                snapshot.Counters[name] = counter.Load()
+        }
+        names := make([]string, 0, len(s.gauges))
+        for name := range s.gauges {
+                names = append(names, name)
+        }
+        sort.Strings(names)
+        for _, name := range names {
+                snapshot.Gauges[name] = s.gauges[name]()
+        }
+        return snapshot
+}
+
+// Serve the in-memory stats as JSON
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+        writeJSON(w, http.StatusOK, stats.Snapshot())
+}
+
+// Captures the response status for stats
+type statusRecorder struct {
+        http.ResponseWriter
+        status int
+}
+
+func (r *statusRecorder) WriteHeader(statusCode int) {
+        if r.status == 0 {
+                r.status = statusCode
+        }
+        r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+        if r.status == 0 {
+                r.status = http.StatusOK
+        }
+        return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+        return r.ResponseWriter
+}
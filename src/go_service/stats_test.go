@@ -0,0 +1,108 @@
+package main
+
+import (
+        "encoding/json"
+        "net/http"
+        "net/http/httptest"
+        "sync"
+        "sync/atomic"
+        "testing"
+)
+
+func TestStatsRegistryCountsConcurrently(t *testing.T) {
+        registry := &StatsRegistry{counters: map[string]*atomic.Int64{}, gauges: map[string]func() int64{}}
+        var wg sync.WaitGroup
+        for i := 0; i < 16; i++ {
+                wg.Add(1)
+                go func() {
+                        defer wg.Done()
+                        for j := 0; j < 250; j++ {
+                                registry.Inc("inspections_synced_total")
+                        }
+                }()
+        }
+        wg.Wait()
+        registry.Gauge("queued_uploads", func() int64 { return 11 })
+
+        snapshot := registry.Snapshot()
+        if snapshot.Counters["inspections_synced_total"] != 4000 || snapshot.Gauges["queued_uploads"] != 11 {
+                t.Errorf("snapshot = %+v, want 4000 syncs and 11 queued", snapshot)
+        }
+}
+
+func TestRecordResponseByClass(t *testing.T) {
+        registry := &StatsRegistry{counters: map[string]*atomic.Int64{}, gauges: map[string]func() int64{}}
+        for _, status := range []int{200, 201, 304, 409, 422, 503, 42} {
+                registry.recordResponse(status)
+        }
+        want := map[string]int64{
+                "requests_total": 7, "responses_2xx_total": 2, "responses_3xx_total": 1,
+                "responses_4xx_total": 2, "responses_5xx_total": 1, "responses_other_total": 1,
+        }
+        for name, count := range want {
+                if got := registry.Snapshot().Counters[name]; got != count {
+                        t.Errorf("%s = %d, want %d", name, got, count)
+                }
+        }
+}
+
+// Current value of a global stats counter
+func statValue(name string) int64 {
+        return stats.Counter(name).Load()
+}
+
+func TestStatsEndpointReflectsEvents(t *testing.T) {
+        requests, clientErrors := statValue(statRequestsTotal), statValue("responses_4xx_total")
+        hits, mismatches := statValue(statIdempotencyHits), statValue(statHashMismatches)
+
+        // Two requests through the metrics middleware, one rejected
+        handler := requestMetricsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                if r.URL.Query().Get("fail") != "" {
+                        http.Error(w, "bad", http.StatusBadRequest)
+                        return
+                }
+                w.Write([]byte("ok"))
+        }))
+        for _, target := range []string{"/v1/capabilities", "/v1/capabilities?fail=1"} {
+                handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+        }
+
+        // An idempotent replay
+        writeReplayedResponse(httptest.NewRecorder(), http.StatusCreated, []byte(`{"evidence_id":"e-1"}`))
+
+        // An upload whose declared hash does not match its content
+        withConfig(t, func(c *Config) { c.HashMismatchPolicy = hashMismatchReject })
+        r := evidenceUploadRequest(t, map[string]string{
+                "session_id":    "session-stats",
+                "evidence_type": "photo",
+                "sha256_hash":   calculateSHA256([]byte("what the client meant to send")),
+        }, map[string][]byte{"smoke-alarm.jpg": []byte("what actually arrived")})
+        r.Header.Set("X-User-ID", "inspector-52")
+        w := httptest.NewRecorder()
+        handleEvidence(w, r)
+        if w.Code != http.StatusBadRequest {
+                t.Fatalf("mismatched upload = %d %s, want 400", w.Code, w.Body.String())
+        }
+
+        w = httptest.NewRecorder()
+        statsHandler(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+        var snapshot StatsSnapshot
+        if err := json.Unmarshal(w.Body.Bytes(), &snapshot); err != nil {
+                t.Fatalf("stats are not JSON: %v", err)
+        }
+        if got := snapshot.Counters[statRequestsTotal] - requests; got != 2 {
+                t.Errorf("requests recorded = %d, want 2", got)
+        }
+        if got := snapshot.Counters["responses_4xx_total"] - clientErrors; got != 1 {
+                t.Errorf("4xx recorded = %d, want 1", got)
+        }
+        if got := snapshot.Counters[statIdempotencyHits] - hits; got != 1 {
+                t.Errorf("idempotency hits = %d, want 1", got)
+        }
+        if got := snapshot.Counters[statHashMismatches] - mismatches; got != 1 {
+                t.Errorf("hash mismatches = %d, want 1", got)
+        }
+        if _, ok := snapshot.Gauges["requests_in_flight"]; !ok {
+                t.Errorf("gauges = %v, want requests_in_flight", snapshot.Gauges)
+        }
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "io"
+        "log"
+        "net/http"
+        "time"
+
+        "github.com/gorilla/mux"
+        "github.com/jackc/pgx/v5"
+)
+
+// Batch of CRDT payloads for one session. Items are applied in order; when a
+// sync_id is given, progress is recorded per item so a resumed request with the
+// same sync_id and item list skips items that were already applied. Without a
+// sync_id every item must carry an idempotency_key, checked and stored exactly
+// as for a single results POST, so a retried batch skips the items it applied.
+type CRDTBatchRequest struct {
+        SyncID string        `json:"sync_id"`
+        Items  []CRDTPayload `json:"items"`
+}
+
+// Outcome of a single batch item
+type CRDTBatchItemResult struct {
+        Index       int              `json:"index"`
+        Status      string           `json:"status"`
+        Error       string           `json:"error,omitempty"`
+        VectorClock map[string]int64 `json:"vector_clock,omitempty"`
+}
+
+// Batch response including the position to resume from
+type CRDTBatchResponse struct {
+        SessionID string                `json:"session_id"`
+        SyncID    string                `json:"sync_id,omitempty"`
+        Status    string                `json:"status"`
+        Applied   int                   `json:"applied"`
+        Skipped   int                   `json:"skipped"`
+        NextIndex int                   `json:"next_index"`
+        Results   []CRDTBatchItemResult `json:"results"`
+}
+
+// Batch item statuses
+const (
+        batchItemApplied        = "applied"
+        batchItemAlreadyApplied = "already_applied"
+        batchItemFailed         = "failed"
+)
+
+// Fingerprint a batch item by position and content
+func syncItemHash(index int, item *CRDTPayload) string {
+        itemJSON, _ := json.Marshal(struct {
+                Changes     []map[string]interface{} `json:"changes"`
+                VectorClock map[string]int64         `json:"vector_clock"`
+        }{item.Changes, item.VectorClock})
+        return calculateSHA256([]byte(fmt.Sprintf("%d:%s", index, itemJSON)))
+}
+
+// Hashes of the given items already applied under the sync cursor, looked up in
+// one round trip before the batch starts
+func syncItemsApplied(ctx context.Context, syncKey string, itemHashes []string) (map[string]bool, error) {
+        applied := make(map[string]bool)
+        err := timeQuery("sync_item_lookup", func() error {
+                rows, err := dbFor(ctx).Query(ctx,
+                        `SELECT item_hash FROM crdt_sync_items WHERE sync_key = $1 AND item_hash = ANY($2)`,
+                        syncKey, itemHashes)
+                if err != nil {
+                        return err
+                }
+                defer rows.Close()
+                for rows.Next() {
+                        var hash string
+                        if err := rows.Scan(&hash); err != nil {
+                                return err
+                        }
+                        applied[hash] = true
+                }
+                return rows.Err()
+        })
+        return applied, err
+}
+
+// Record an applied item under the sync cursor within the merge transaction
+func recordSyncItem(ctx context.Context, tx pgx.Tx, syncKey, syncID, sessionID, userID string, index int, itemHash string) error {
+        query := `
+                INSERT INTO crdt_sync_items (sync_key, item_hash, sync_id, session_id, user_id, item_index)
+                VALUES ($1, $2, $3, $4, $5, $6)
+                ON CONFLICT (sync_key, item_hash) DO NOTHING
+        `
+        _, err := tx.Exec(ctx, query, syncKey, itemHash, syncID, sessionID, userID, index)
+        return err
+}
+
+// Apply one batch item in its own transaction, recording sync progress atomically with the merge.
+// Items are not pipelined into one batch: each merge reads the session state the previous item
+// committed, and committing items one by one is what leaves a clean resume point on failure.
+func applyBatchItem(ctx context.Context, sessionID, userID, syncKey, syncID string, index int, item *CRDTPayload, itemHash string) (*CRDTResponse, error) {
+        if err := validateCRDTPayloadText(item); err != nil {
+                return nil, &MergeError{StatusCode: http.StatusUnprocessableEntity, Message: err.Error()}
+        }
+        if err := checkClockOnlyPayload(item); err != nil {
+                return nil, &MergeError{StatusCode: http.StatusBadRequest, Message: err.Error()}
+        }
+        if err := validateVectorClockCounters(item.VectorClock); err != nil {
+                return nil, &MergeError{StatusCode: http.StatusUnprocessableEntity, Message: err.Error()}
+        }
+        changes, err := parseChanges(item.Changes, time.Now().UTC())
+        if err != nil {
+                return nil, &MergeError{StatusCode: http.StatusUnprocessableEntity, Message: err.Error()}
+        }
+
+        var response *CRDTResponse
+        err = withFailoverRetry(ctx, "crdt_batch_item", func() error {
+                tx, err := dbFor(ctx).Begin(ctx)
+                if err != nil {
+                        return err
+                }
+                defer tx.Rollback(ctx)
+
+                response, err = mergeCRDTPayload(ctx, tx, sessionID, userID, item, changes)
+                if err != nil {
+                        return err
+                }
+                if syncKey != "" {
+                        if err := recordSyncItem(ctx, tx, syncKey, syncID, sessionID, userID, index, itemHash); err != nil {
+                                return fmt.Errorf("failed to record sync progress: %w", err)
+                        }
+                }
+                return commitTx(ctx, tx)
+        })
+        if err != nil {
+                return nil, err
+        }
+        return response, nil
+}
+
+// Apply a batch of CRDT payloads to a session, resuming from a sync cursor when sync_id is set
+func handleCRDTBatch(w http.ResponseWriter, r *http.Request) {
+        sessionID := mux.Vars(r)["session_id"]
+
+        userID := r.Header.Get("X-User-ID")
+        if userID == "" {
+                http.Error(w, "X-User-ID header required", http.StatusBadRequest)
+                return
+        }
+
+        body, err := io.ReadAll(r.Body)
+        if isBodyTooLarge(err) {
+                http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+                return
+        }
+        if err != nil {
+                http.Error(w, "Failed to read request body", http.StatusBadRequest)
+                return
+        }
+        // Signatures cover the exact body bytes, so verify before any decoding
+        if err := verifyPayloadSignature(r, body); err != nil {
+                writeSignatureError(w, err)
+                return
+        }
+        if err := validateUTF8Body(body); err != nil {
+                http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+                return
+        }
+        if err := validateJSONDepth(body, cfg.MaxJSONDepth); err != nil {
+                http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+                return
+        }
+
+        var batch CRDTBatchRequest
+        if err := json.Unmarshal(body, &batch); err != nil {
+                http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+                return
+        }
+        if err := checkUnknownBatchFields(body); err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+        strategyOverride, err := parseMergeStrategyHeader(r)
+        if err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+        for i := range batch.Items {
+                batch.Items[i].strategyOverride = strategyOverride
+        }
+        if len(batch.Items) == 0 {
+                http.Error(w, "Items required", http.StatusBadRequest)
+                return
+        }
+        // Every item is merged while the batch holds the session's merge slot
+        if limit := cfg.MaxBatchItems; limit > 0 && int64(len(batch.Items)) > limit {
+                http.Error(w, fmt.Sprintf("Batch has %d items (max %d)", len(batch.Items), limit), http.StatusRequestEntityTooLarge)
+                return
+        }
+
+        // Without a sync cursor, item keys are what make resending the batch safe
+        for i := range batch.Items {
+                key := batch.Items[i].IdempotencyKey
+                if key == "" && batch.SyncID == "" {
+                        http.Error(w, fmt.Sprintf("items[%d]: idempotency_key required without sync_id", i), http.StatusBadRequest)
+                        return
+                }
+                if key != "" {
+                        if err := validateIdempotencyKey(key); err != nil {
+                                http.Error(w, fmt.Sprintf("items[%d]: %v", i, err), http.StatusBadRequest)
+                                return
+                        }
+                }
+        }
+
+        // Cursors are scoped to the user and session so sync IDs cannot collide across them
+        syncKey := ""
+        if batch.SyncID != "" {
+                syncKey = calculateSHA256([]byte(fmt.Sprintf("%s:%s:%s", userID, sessionID, batch.SyncID)))
+        }
+
+        resultsEndpoint := fmt.Sprintf("/v1/tests/sessions/%s/results", sessionID)
+
+        // A batch holds one merge slot while it applies its items in order
+        release, ok := sessionMergeLimiter.Acquire(tenantSessionKey(tenantFromContext(r.Context()), sessionID),
+                cfg.SessionMaxConcurrentMerges)
+        if !ok {
+                w.Header().Set("Retry-After", "1")
+                http.Error(w, "Too many concurrent merges for this session", http.StatusTooManyRequests)
+                return
+        }
+        defer release()
+
+        ctx := r.Context()
+        response := CRDTBatchResponse{
+                SessionID: sessionID,
+                SyncID:    batch.SyncID,
+                Status:    "complete",
+                Results:   make([]CRDTBatchItemResult, 0, len(batch.Items)),
+        }
+        statusCode := http.StatusOK
+        var lastClock map[string]int64
+
+        itemHashes := make([]string, len(batch.Items))
+        for i := range batch.Items {
+                itemHashes[i] = syncItemHash(i, &batch.Items[i])
+        }
+        applied := map[string]bool{}
+        if syncKey != "" {
+                if applied, err = syncItemsApplied(ctx, syncKey, itemHashes); err != nil {
+                        log.Printf("Sync cursor lookup failed for session %s: %v", sessionID, err)
+                        response.Status = "incomplete"
+                        response.Results = append(response.Results, CRDTBatchItemResult{Index: 0, Status: batchItemFailed, Error: "Database error"})
+                        writeJSON(w, http.StatusInternalServerError, response)
+                        return
+                }
+        }
+
+        for i := range batch.Items {
+                item := &batch.Items[i]
+                itemHash := itemHashes[i]
+
+                if applied[itemHash] {
+                        response.Skipped++
+                        response.Results = append(response.Results, CRDTBatchItemResult{Index: i, Status: batchItemAlreadyApplied})
+                        response.NextIndex = i + 1
+                        continue
+                }
+
+                // Items keyed like single results POSTs share their replay and reuse checks
+                var keyHash, requestHash string
+                if item.IdempotencyKey != "" {
+                        keyHash = idempotencyKeyHash(item.IdempotencyKey)
+                        changesJSON, _ := json.Marshal(item.Changes)
+                        requestHash = calculateSHA256(changesJSON)
+                        check, err := checkIdempotency(ctx, keyHash, userID, resultsEndpoint, requestHash)
+                        if err != nil {
+                                var message string
+                                statusCode, message = idempotencyCheckErrorStatus(err)
+                                response.Results = append(response.Results, CRDTBatchItemResult{Index: i, Status: batchItemFailed, Error: message})
+                                break
+                        }
+                        if check != nil && check.Pending {
+                                statusCode = http.StatusConflict
+                                response.Results = append(response.Results, CRDTBatchItemResult{Index: i, Status: batchItemFailed,
+                                        Error: "A request with this idempotency key is still in progress"})
+                                break
+                        }
+                        if check != nil {
+                                var cached struct {
+                                        Error       string           `json:"error"`
+                                        VectorClock map[string]int64 `json:"vector_clock"`
+                                }
+                                json.Unmarshal([]byte(check.ResponseData), &cached)
+                                // A cached error replays as this item's failure
+                                if check.StatusCode >= http.StatusBadRequest {
+                                        statusCode = check.StatusCode
+                                        response.Results = append(response.Results, CRDTBatchItemResult{Index: i, Status: batchItemFailed, Error: cached.Error})
+                                        break
+                                }
+                                response.Skipped++
+                                response.Results = append(response.Results, CRDTBatchItemResult{Index: i, Status: batchItemAlreadyApplied,
+                                        VectorClock: cached.VectorClock})
+                                response.NextIndex = i + 1
+                                continue
+                        }
+                }
+
+                result, err := applyBatchItem(ctx, sessionID, userID, syncKey, batch.SyncID, i, item, itemHash)
+                if err != nil && keyHash != "" {
+                        releaseIdempotencyKey(ctx, keyHash)
+                }
+                if err != nil {
+                        // Stop at the first failure so the cursor marks a clean resume point
+                        statusCode = http.StatusInternalServerError
+                        message := "Database error"
+                        var mergeErr *MergeError
+                        if errors.As(err, &mergeErr) {
+                                statusCode, message = mergeErr.StatusCode, mergeErr.Message
+                                dedupKey := deadLetterDedupKey(syncKey, itemHash)
+                                if keyHash != "" {
+                                        dedupKey = deadLetterDedupKey(keyHash, requestHash)
+                                }
+                                deadLetterCRDTPayload(ctx, sessionID, userID, r.URL.Path, dedupKey, item, statusCode, message)
+                        } else {
+                                log.Printf("Batch item %d failed for session %s: %v", i, sessionID, err)
+                        }
+                        response.Results = append(response.Results, CRDTBatchItemResult{Index: i, Status: batchItemFailed, Error: message})
+                        break
+                }
+
+                if keyHash != "" {
+                        if err := storeIdempotencyKey(ctx, keyHash, userID, resultsEndpoint, requestHash, result, http.StatusOK); err != nil {
+                                log.Printf("Failed to store idempotency key: %v", err)
+                                releaseIdempotencyKey(ctx, keyHash)
+                        }
+                }
+                lastClock = result.VectorClock
+                response.Applied++
+                response.NextIndex = i + 1
+                response.Results = append(response.Results, CRDTBatchItemResult{Index: i, Status: batchItemApplied, VectorClock: result.VectorClock})
+        }
+
+        if response.NextIndex < len(batch.Items) {
+                response.Status = "incomplete"
+        }
+        if lastClock != nil {
+                publishSessionChange(ctx, SessionChange{SessionID: sessionID, VectorClock: lastClock})
+        }
+
+        writeJSON(w, statusCode, response)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+        "bytes"
+        "encoding/json"
+        "fmt"
+        "net/http"
+        "net/http/httptest"
+        "reflect"
+        "strings"
+        "testing"
+
+        "github.com/gorilla/mux"
+)
+
+func postCRDTBatch(t *testing.T, sessionID, userID string, batch CRDTBatchRequest) (*httptest.ResponseRecorder, CRDTBatchResponse) {
+        t.Helper()
+        body, _ := json.Marshal(batch)
+        r := httptest.NewRequest(http.MethodPost, "/v1/tests/sessions/"+sessionID+"/results/batch", bytes.NewReader(body))
+        r.Header.Set("X-User-ID", userID)
+        r = mux.SetURLVars(r, map[string]string{"session_id": sessionID})
+        w := httptest.NewRecorder()
+        handleCRDTBatch(w, r)
+
+        var response CRDTBatchResponse
+        if strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+                if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+                        t.Fatal(err)
+                }
+        }
+        return w, response
+}
+
+func setItem(path string, value interface{}, clock map[string]int64) CRDTPayload {
+        return CRDTPayload{
+                Changes:     []map[string]interface{}{{"op": "set", "path": path, "value": value}},
+                VectorClock: clock,
+        }
+}
+
+func TestCRDTBatchItemLimit(t *testing.T) {
+        withConfig(t, func(c *Config) { c.MaxBatchItems = 3 })
+        items := make([]CRDTPayload, 4)
+        for i := range items {
+                items[i] = setItem("/hoses/"+string(rune('a'+i)), "inspected", nil)
+        }
+
+        w, _ := postCRDTBatch(t, "session-limit", "inspector-1", CRDTBatchRequest{SyncID: "s1", Items: items})
+        if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "Batch has 4 items (max 3)") {
+                t.Errorf("status = %d %q, want 413 naming the limit", w.Code, w.Body.String())
+        }
+
+        w, _ = postCRDTBatch(t, "session-limit", "inspector-1", CRDTBatchRequest{SyncID: "s1"})
+        if w.Code != http.StatusBadRequest {
+                t.Errorf("empty batch = %d, want 400", w.Code)
+        }
+}
+
+func TestSyncItemHash(t *testing.T) {
+        item := setItem("/valves/main", "open", map[string]int64{"tablet": 4})
+        same := setItem("/valves/main", "open", map[string]int64{"tablet": 4})
+        changed := setItem("/valves/main", "closed", map[string]int64{"tablet": 4})
+
+        if syncItemHash(2, &item) != syncItemHash(2, &same) {
+                t.Error("identical items at the same index hash differently")
+        }
+        if syncItemHash(2, &item) == syncItemHash(3, &item) {
+                t.Error("the item index is not part of the hash")
+        }
+        if syncItemHash(2, &item) == syncItemHash(2, &changed) {
+                t.Error("the item content is not part of the hash")
+        }
+}
+
+func TestCRDTBatchResumesAfterFailure(t *testing.T) {
+        pool := testDB(t)
+        sessionID := insertTestSession(t, pool, map[string]interface{}{"floors": map[string]interface{}{}}, nil)
+        items := []CRDTPayload{
+                setItem("/floors/ground", "pass", map[string]int64{"laptop-2": 1}),
+                // Invalid path: fails the batch midway
+                setItem("floors/first", "pass", map[string]int64{"laptop-2": 2}),
+                setItem("/floors/second", "fail", map[string]int64{"laptop-2": 3}),
+        }
+
+        w, first := postCRDTBatch(t, sessionID, "inspector-9", CRDTBatchRequest{SyncID: "nightly-42", Items: items})
+        if w.Code != http.StatusUnprocessableEntity {
+                t.Fatalf("status = %d, want 422: %s", w.Code, w.Body.String())
+        }
+        if first.Status != "incomplete" || first.Applied != 1 || first.NextIndex != 1 {
+                t.Fatalf("first attempt = %+v, want item 0 applied and next_index 1", first)
+        }
+        if got := first.Results[len(first.Results)-1]; got.Index != 1 || got.Status != batchItemFailed {
+                t.Errorf("last result = %+v, want item 1 failed", got)
+        }
+
+        // The client fixes the failing item and resends the whole batch
+        items[1] = setItem("/floors/first", "pass", map[string]int64{"laptop-2": 2})
+        w, resumed := postCRDTBatch(t, sessionID, "inspector-9", CRDTBatchRequest{SyncID: "nightly-42", Items: items})
+        if w.Code != http.StatusOK {
+                t.Fatalf("resume status = %d: %s", w.Code, w.Body.String())
+        }
+        if resumed.Status != "complete" || resumed.Skipped != 1 || resumed.Applied != 2 || resumed.NextIndex != 3 {
+                t.Errorf("resume = %+v, want 1 skipped, 2 applied, next_index 3", resumed)
+        }
+        wantStatuses := []string{batchItemAlreadyApplied, batchItemApplied, batchItemApplied}
+        for i, result := range resumed.Results {
+                if result.Status != wantStatuses[i] {
+                        t.Errorf("results[%d] = %s, want %s", i, result.Status, wantStatuses[i])
+                }
+        }
+
+        state, err := loadSessionState(t.Context(), sessionID)
+        if err != nil {
+                t.Fatal(err)
+        }
+        floors, _ := state.SessionData["floors"].(map[string]interface{})
+        if floors["ground"] != "pass" || floors["first"] != "pass" || floors["second"] != "fail" {
+                t.Errorf("session floors = %v", floors)
+        }
+
+        // A different sync ID has its own cursor and applies every item
+        _, other := postCRDTBatch(t, sessionID, "inspector-9", CRDTBatchRequest{SyncID: "nightly-43", Items: items})
+        if other.Skipped != 0 || other.Applied != 3 {
+                t.Errorf("new sync = %+v, want all items applied", other)
+        }
+}
+
+func TestSyncItemsAppliedLooksUpAllItems(t *testing.T) {
+        pool := testDB(t)
+        ctx := t.Context()
+        sessionID := insertTestSession(t, pool, nil, nil)
+        tx, err := pool.Begin(ctx)
+        if err != nil {
+                t.Fatal(err)
+        }
+        for _, i := range []int{0, 2} {
+                if err := recordSyncItem(ctx, tx, "sync-key", "nightly-7", sessionID, "inspector-9", i, fmt.Sprintf("hash-%d", i)); err != nil {
+                        t.Fatal(err)
+                }
+        }
+        if err := tx.Commit(ctx); err != nil {
+                t.Fatal(err)
+        }
+
+        applied, err := syncItemsApplied(ctx, "sync-key", []string{"hash-0", "hash-1", "hash-2"})
+        if err != nil {
+                t.Fatal(err)
+        }
+        want := map[string]bool{"hash-0": true, "hash-2": true}
+        if !reflect.DeepEqual(applied, want) {
+                t.Errorf("applied = %v, want %v", applied, want)
+        }
+        if other, _ := syncItemsApplied(ctx, "other-key", []string{"hash-0"}); len(other) != 0 {
+                t.Errorf("another cursor sees %v, want nothing applied", other)
+        }
+}
+
+func keyedItem(key, path string, value interface{}) CRDTPayload {
+        item := setItem(path, value, nil)
+        item.IdempotencyKey = key
+        return item
+}
+
+func TestCRDTBatchWithoutSyncIDRequiresItemKeys(t *testing.T) {
+        withConfig(t, func(c *Config) { c.IdempotencyKeyMinLength = 8 })
+        tests := []struct {
+                name  string
+                items []CRDTPayload
+                want  string
+        }{
+                {"missing key", []CRDTPayload{keyedItem("sprinkler-a-1", "/sprinklers/a", "ok"), setItem("/sprinklers/b", "ok", nil)},
+                        "items[1]: idempotency_key required without sync_id"},
+                {"short key", []CRDTPayload{keyedItem("k1", "/sprinklers/a", "ok")}, "items[0]: idempotency key must be at least 8 bytes"},
+        }
+        for _, tt := range tests {
+                w, _ := postCRDTBatch(t, "session-keys", "inspector-1", CRDTBatchRequest{Items: tt.items})
+                if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tt.want) {
+                        t.Errorf("%s: status = %d %q, want 400 %q", tt.name, w.Code, w.Body.String(), tt.want)
+                }
+        }
+}
+
+func TestCRDTBatchItemKeysMakeRetriesSafe(t *testing.T) {
+        pool := testDB(t)
+        withConfig(t, func(c *Config) { c.IdempotencyStatusHeaders = true })
+        sessionID := insertTestSession(t, pool, map[string]interface{}{"alarms": map[string]interface{}{}}, nil)
+        userID := insertTestUser(t, pool, "keyed-batch")
+        prefix := "alarm-" + sessionID + "-"
+        items := []CRDTPayload{
+                keyedItem(prefix+"1", "/alarms/panel", "armed"),
+                // Invalid path: fails the batch midway
+                keyedItem(prefix+"2", "alarms/bell", "rung"),
+                keyedItem(prefix+"3", "/alarms/strobe", "flashing"),
+        }
+
+        w, first := postCRDTBatch(t, sessionID, userID, CRDTBatchRequest{Items: items})
+        if w.Code != http.StatusUnprocessableEntity || first.Applied != 1 || first.NextIndex != 1 {
+                t.Fatalf("first attempt = %d %+v, want item 0 applied and a 422", w.Code, first)
+        }
+
+        // The fixed batch is resent under the same keys; item 0 is not merged again
+        items[1] = keyedItem(prefix+"2", "/alarms/bell", "rung")
+        w, retry := postCRDTBatch(t, sessionID, userID, CRDTBatchRequest{Items: items})
+        if w.Code != http.StatusOK || retry.Skipped != 1 || retry.Applied != 2 || retry.NextIndex != 3 {
+                t.Fatalf("retry = %d %+v, want 1 skipped and 2 applied", w.Code, retry)
+        }
+        if got := retry.Results[0]; got.Status != batchItemAlreadyApplied || got.VectorClock == nil {
+                t.Errorf("results[0] = %+v, want already applied with its cached clock", got)
+        }
+        state, err := loadSessionState(t.Context(), sessionID)
+        if err != nil {
+                t.Fatal(err)
+        }
+        alarms, _ := state.SessionData["alarms"].(map[string]interface{})
+        if alarms["panel"] != "armed" || alarms["bell"] != "rung" || alarms["strobe"] != "flashing" {
+                t.Errorf("session alarms = %v", alarms)
+        }
+
+        // Keys are shared with single results POSTs, and reusing one for other changes is rejected
+        body, _ := json.Marshal(items[2])
+        if w := postCRDTResults(t, sessionID, body, http.Header{"X-User-Id": {userID}}); w.Code != http.StatusOK ||
+                w.Header().Get("Idempotency-Replayed") != "true" {
+                t.Errorf("single POST of a batch item = %d, replayed %q; want a replay", w.Code, w.Header().Get("Idempotency-Replayed"))
+        }
+        reused := []CRDTPayload{keyedItem(prefix+"3", "/alarms/strobe", "off")}
+        if w, _ := postCRDTBatch(t, sessionID, userID, CRDTBatchRequest{Items: reused}); w.Code != http.StatusUnprocessableEntity {
+                t.Errorf("reused key = %d %s, want 422", w.Code, w.Body.String())
+        }
+}
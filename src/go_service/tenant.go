@@ -0,0 +1,172 @@
+package main
+
+import (
+        "context"
+        "fmt"
+        "regexp"
+        "strings"
+        "sync"
+
+        "github.com/jackc/pgx/v5"
+        "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Tenant routing modes
+const (
+        // Single-tenant: all requests use the default pool
+        TenantRoutingNone = "none"
+        // One schema per tenant in the default database, selected via search_path
+        TenantRoutingSchema = "schema"
+        // One database per tenant, configured in TENANT_DATABASE_URLS
+        TenantRoutingDatabase = "database"
+)
+
+// Tenant IDs double as schema names and evidence key namespaces
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9_]{1,48}$`)
+
+// Context keys for the resolved tenant and its pool
+type tenantContextKey struct{}
+type tenantPoolContextKey struct{}
+
+// Returned when a token names a tenant the service cannot route
+type TenantError struct {
+        TenantID string
+        Reason   string
+}
+
+func (e *TenantError) Error() string {
+        if e.TenantID == "" {
+                return e.Reason
+        }
+        return fmt.Sprintf("tenant %q: %s", e.TenantID, e.Reason)
+}
+
+// Lazily created connection pools, one per tenant
+type TenantPools struct {
+        mu    sync.Mutex
+        base  *pgxpool.Config
+        pools map[string]*pgxpool.Pool
+}
+
+var tenantPools = &TenantPools{pools: make(map[string]*pgxpool.Pool)}
+
+// Schema holding a tenant's tables under schema routing
+func tenantSchema(tenantID string) string {
+        return cfg.TenantSchemaPrefix + tenantID
+}
+
+// Return the pool for a tenant, creating it on first use
+func (t *TenantPools) Get(ctx context.Context, tenantID string) (*pgxpool.Pool, error) {
+        if !tenantIDPattern.MatchString(tenantID) {
+                return nil, &TenantError{TenantID: tenantID, Reason: "invalid tenant ID"}
+        }
+
+        t.mu.Lock()
+        defer t.mu.Unlock()
+
+        if pool, ok := t.pools[tenantID]; ok {
+                return pool, nil
+        }
+
+        var config *pgxpool.Config
+        switch cfg.TenantRouting {
+        case TenantRoutingSchema:
+                config = t.base.Copy()
+                // No fallback to public so a missing tenant table fails instead of leaking across tenants
+                config.ConnConfig.RuntimeParams["search_path"] = pgx.Identifier{tenantSchema(tenantID)}.Sanitize()
+        case TenantRoutingDatabase:
+                databaseURL, ok := cfg.TenantDatabaseURLs[tenantID]
+                if !ok {
+                        return nil, &TenantError{TenantID: tenantID, Reason: "no database configured"}
+                }
+                parsed, err := newPoolConfig(databaseURL)
+                if err != nil {
+                        return nil, err
+                }
+                config = parsed
+        default:
+                return nil, fmt.Errorf("unsupported tenant routing mode %q", cfg.TenantRouting)
+        }
+        config.MaxConns = int32(cfg.TenantPoolMaxConns)
+        config.MinConns = 0
+
+        pool, err := pgxpool.NewWithConfig(ctx, config)
+        if err != nil {
+                return nil, fmt.Errorf("failed to create pool for tenant %q: %v", tenantID, err)
+        }
+        t.pools[tenantID] = pool
+        return pool, nil
+}
+
+// Snapshot of the tenant pools opened so far
+func (t *TenantPools) All() map[string]*pgxpool.Pool {
+        t.mu.Lock()
+        defer t.mu.Unlock()
+
+        pools := make(map[string]*pgxpool.Pool, len(t.pools))
+        for tenantID, pool := range t.pools {
+                pools[tenantID] = pool
+        }
+        return pools
+}
+
+// Close all tenant pools
+func (t *TenantPools) Close() {
+        t.mu.Lock()
+        defer t.mu.Unlock()
+
+        for tenantID, pool := range t.pools {
+                pool.Close()
+                delete(t.pools, tenantID)
+        }
+}
+
+// Attach a resolved tenant and its pool to a request context
+func withTenant(ctx context.Context, tenantID string, pool *pgxpool.Pool) context.Context {
+        ctx = context.WithValue(ctx, tenantContextKey{}, tenantID)
+        return context.WithValue(ctx, tenantPoolContextKey{}, pool)
+}
+
+// Tenant ID for the request, or "" in single-tenant mode
+func tenantFromContext(ctx context.Context) string {
+        tenantID, _ := ctx.Value(tenantContextKey{}).(string)
+        return tenantID
+}
+
+// Pool serving the request's tenant, falling back to the default pool
+func dbFor(ctx context.Context) *pgxpool.Pool {
+        if pool, ok := ctx.Value(tenantPoolContextKey{}).(*pgxpool.Pool); ok && pool != nil {
+                return pool
+        }
+        return dbPool
+}
+
+// Namespace an evidence object key by tenant so blobs are isolated alongside their rows
+func evidenceObjectKey(ctx context.Context, evidenceID string) string {
+        if tenantID := tenantFromContext(ctx); tenantID != "" {
+                return tenantID + "/" + evidenceID
+        }
+        return evidenceID
+}
+
+// Key identifying a session across tenants for in-process fan-out
+func tenantSessionKey(tenantID, sessionID string) string {
+        if tenantID == "" {
+                return sessionID
+        }
+        return tenantID + "/" + sessionID
+}
+
+// Resolve the tenant for a request from its tenant_id claim. Returns "" when
+// tenant routing is disabled.
+func resolveTenantClaim(claims map[string]interface{}) (string, error) {
+        if cfg.TenantRouting == "" || cfg.TenantRouting == TenantRoutingNone {
+                return "", nil
+        }
+        tenantID, _ := claims["tenant_id"].(string)
+        tenantID = strings.TrimSpace(tenantID)
+        if tenantID == "" {
+                return "", &TenantError{Reason: "tenant_id claim required"}
+        }
+        return tenantID, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+        "context"
+        "errors"
+        "os"
+        "testing"
+
+        "github.com/jackc/pgx/v5"
+        "github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestResolveTenantClaim(t *testing.T) {
+        tests := []struct {
+                routing string
+                claims  map[string]interface{}
+                want    string
+                wantErr bool
+        }{
+                {TenantRoutingNone, map[string]interface{}{"tenant_id": "acme"}, "", false},
+                {"", map[string]interface{}{}, "", false},
+                {TenantRoutingSchema, map[string]interface{}{"tenant_id": " northside_fire "}, "northside_fire", false},
+                {TenantRoutingSchema, map[string]interface{}{}, "", true},
+                {TenantRoutingDatabase, map[string]interface{}{"tenant_id": 42}, "", true},
+        }
+        for _, tt := range tests {
+                withConfig(t, func(c *Config) { c.TenantRouting = tt.routing })
+                got, err := resolveTenantClaim(tt.claims)
+                var tenantErr *TenantError
+                if tt.wantErr != errors.As(err, &tenantErr) || got != tt.want {
+                        t.Errorf("%s %v: got %q, %v; want %q (error %v)", tt.routing, tt.claims, got, err, tt.want, tt.wantErr)
+                }
+        }
+}
+
+func TestTenantPoolsRejectUnroutableTenants(t *testing.T) {
+        withConfig(t, func(c *Config) {
+                c.TenantRouting = TenantRoutingDatabase
+                c.TenantDatabaseURLs = map[string]string{}
+        })
+        pools := &TenantPools{pools: make(map[string]*pgxpool.Pool)}
+        for _, tenantID := range []string{"../public", "Acme", "tenant;drop", "", "unconfigured"} {
+                var tenantErr *TenantError
+                if _, err := pools.Get(context.Background(), tenantID); !errors.As(err, &tenantErr) {
+                        t.Errorf("Get(%q) = %v, want a TenantError", tenantID, err)
+                }
+        }
+        if len(pools.All()) != 0 {
+                t.Error("rejected tenants left pools behind")
+        }
+}
+
+func TestTenantScopedKeys(t *testing.T) {
+        ctx := withTenant(context.Background(), "harbor_district", nil)
+        if key := evidenceObjectKey(ctx, "e1"); key != "harbor_district/e1" {
+                t.Errorf("tenant evidence key = %q", key)
+        }
+        if key := evidenceObjectKey(context.Background(), "e1"); key != "e1" {
+                t.Errorf("single-tenant evidence key = %q", key)
+        }
+        if tenantSessionKey("harbor_district", "s1") == tenantSessionKey("uptown", "s1") {
+                t.Error("sessions with the same ID collide across tenants")
+        }
+        if dbFor(ctx) != dbPool {
+                t.Error("a context without a tenant pool must fall back to the default pool")
+        }
+}
+
+// Create schema for tenantID with the full table set
+func createTenantSchema(t *testing.T, pool *pgxpool.Pool, tenantID string) {
+        t.Helper()
+        ctx := context.Background()
+        schema := pgx.Identifier{tenantSchema(tenantID)}.Sanitize()
+        ddl, err := os.ReadFile("../app/database/schema.sql")
+        if err != nil {
+                t.Fatal(err)
+        }
+        conn, err := pool.Acquire(ctx)
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer conn.Release()
+        // Keep public on the path while creating tables so uuid-ossp defaults resolve
+        statements := "DROP SCHEMA IF EXISTS " + schema + " CASCADE; CREATE SCHEMA " + schema +
+                "; SET search_path TO " + schema + ", public; " + string(ddl) + "; RESET search_path"
+        if _, err := conn.Exec(ctx, statements); err != nil {
+                t.Fatalf("failed to create schema for tenant %s: %v", tenantID, err)
+        }
+        t.Cleanup(func() { pool.Exec(context.Background(), "DROP SCHEMA IF EXISTS "+schema+" CASCADE") })
+}
+
+func TestTenantSchemasIsolateWrites(t *testing.T) {
+        pool := testDB(t)
+        withConfig(t, func(c *Config) {
+                c.TenantRouting = TenantRoutingSchema
+                c.TenantSchemaPrefix = "test_tenant_"
+                c.TenantPoolMaxConns = 2
+        })
+        createTenantSchema(t, pool, "eastside")
+        createTenantSchema(t, pool, "westside")
+
+        base, err := newPoolConfig(os.Getenv("TEST_DATABASE_URL"))
+        if err != nil {
+                t.Fatal(err)
+        }
+        pools := &TenantPools{base: base, pools: make(map[string]*pgxpool.Pool)}
+        defer pools.Close()
+
+        ctx := context.Background()
+        eastPool, err := pools.Get(ctx, "eastside")
+        if err != nil {
+                t.Fatal(err)
+        }
+        westPool, err := pools.Get(ctx, "westside")
+        if err != nil {
+                t.Fatal(err)
+        }
+        if again, _ := pools.Get(ctx, "eastside"); again != eastPool {
+                t.Error("tenant pool was not reused")
+        }
+
+        east := withTenant(ctx, "eastside", eastPool)
+        west := withTenant(ctx, "westside", westPool)
+        eastSession := insertTestSession(t, eastPool, map[string]interface{}{"alarm": "eastside"}, map[string]int64{"east": 1})
+        westSession := insertTestSession(t, westPool, map[string]interface{}{"alarm": "westside"}, map[string]int64{"west": 1})
+
+        state, err := loadSessionState(east, eastSession)
+        if err != nil || state.SessionData["alarm"] != "eastside" {
+                t.Fatalf("eastside session = %v, %v", state, err)
+        }
+        if _, err := loadSessionState(west, eastSession); !errors.Is(err, pgx.ErrNoRows) {
+                t.Errorf("westside read of an eastside session = %v, want no rows", err)
+        }
+        if _, err := loadSessionState(east, westSession); !errors.Is(err, pgx.ErrNoRows) {
+                t.Errorf("eastside read of a westside session = %v, want no rows", err)
+        }
+        // Nothing landed in the default schema
+        if _, err := loadSessionState(ctx, eastSession); !errors.Is(err, pgx.ErrNoRows) {
+                t.Errorf("default schema read of a tenant session = %v, want no rows", err)
+        }
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+        "crypto/tls"
+        "crypto/x509"
+        "fmt"
+        "log"
+        "os"
+        "strings"
+)
+
+// Minimum TLS versions accepted by TLS_MIN_VERSION
+var tlsVersions = map[string]uint16{
+        "1.2": tls.VersionTLS12,
+        "1.3": tls.VersionTLS13,
+}
+
+// Build the server TLS configuration from the environment. Returns nil when TLS
+// is disabled (no certificate configured). Handshakes below TLS_MIN_VERSION or
+// without an allowed cipher suite fail; the negotiated version is logged per
+// connection.
+func newServerTLSConfig() (*tls.Config, error) {
+        if cfg.TLSCertFile == "" {
+                return nil, nil
+        }
+
+        minVersion, ok := tlsVersions[cfg.TLSMinVersion]
+        if !ok {
+                return nil, fmt.Errorf("unsupported TLS_MIN_VERSION %q (use 1.2 or 1.3)", cfg.TLSMinVersion)
+        }
+
+        tlsConfig := &tls.Config{
+                MinVersion: minVersion,
+                VerifyConnection: func(cs tls.ConnectionState) error {
+                        log.Printf("TLS connection negotiated %s with %s", tls.VersionName(cs.Version), tls.CipherSuiteName(cs.CipherSuite))
+                        return nil
+                },
+        }
+
+        // Go does not allow configuring TLS 1.3 suites, so the list restricts 1.2 only
+        if cfg.TLSCipherSuites != "" {
+                suites, err := parseCipherSuites(cfg.TLSCipherSuites)
+                if err != nil {
+                        return nil, err
+                }
+                tlsConfig.CipherSuites = suites
+        }
+
+        // mTLS: require client certificates signed by the configured CA
+        if cfg.TLSClientCAFile != "" {
+                caPEM, err := os.ReadFile(cfg.TLSClientCAFile)
+                if err != nil {
+                        return nil, fmt.Errorf("failed to read client CA: %v", err)
+                }
+                pool := x509.NewCertPool()
+                if !pool.AppendCertsFromPEM(caPEM) {
+                        return nil, fmt.Errorf("no certificates found in %s", cfg.TLSClientCAFile)
+                }
+                tlsConfig.ClientCAs = pool
+                tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+        }
+        return tlsConfig, nil
+}
+
+// Resolve a comma-separated list of cipher suite names. Suites Go considers
+// insecure are refused.
+func parseCipherSuites(raw string) ([]uint16, error) {
+        known := make(map[string]uint16)
+        for _, suite := range tls.CipherSuites() {
+                known[suite.Name] = suite.ID
+        }
+
+        var suites []uint16
+        for _, name := range strings.Split(raw, ",") {
+                name = strings.TrimSpace(name)
+                if name == "" {
+                        continue
+                }
+                id, ok := known[name]
+                if !ok {
+                        return nil, fmt.Errorf("unknown or insecure TLS cipher suite %q", name)
+                }
+                suites = append(suites, id)
+        }
+        return suites, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+        "crypto/tls"
+        "net/http"
+        "net/http/httptest"
+        "strings"
+        "testing"
+)
+
+// Start a TLS server using the policy from newServerTLSConfig (httptest supplies
+// the certificate)
+func startPolicyServer(t *testing.T) *httptest.Server {
+        t.Helper()
+        tlsConfig, err := newServerTLSConfig()
+        if err != nil {
+                t.Fatal(err)
+        }
+        server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+        server.TLS = tlsConfig
+        server.StartTLS()
+        t.Cleanup(server.Close)
+        return server
+}
+
+// Attempt a GET with a client limited to the given TLS versions and suites
+func tlsGet(server *httptest.Server, minVersion, maxVersion uint16, suites []uint16) error {
+        transport := server.Client().Transport.(*http.Transport).Clone()
+        transport.TLSClientConfig.MinVersion = minVersion
+        transport.TLSClientConfig.MaxVersion = maxVersion
+        transport.TLSClientConfig.CipherSuites = suites
+        resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+        if err == nil {
+                resp.Body.Close()
+        }
+        return err
+}
+
+func TestTLSMinimumVersion(t *testing.T) {
+        logs := captureLog(t)
+        tests := []struct {
+                min      string
+                client   uint16
+                accepted bool
+        }{
+                {"1.2", tls.VersionTLS11, false},
+                {"1.2", tls.VersionTLS12, true},
+                {"1.3", tls.VersionTLS12, false},
+                {"1.3", tls.VersionTLS13, true},
+        }
+        for _, tt := range tests {
+                t.Run(tt.min+"/"+tls.VersionName(tt.client), func(t *testing.T) {
+                        withConfig(t, func(c *Config) {
+                                c.TLSCertFile = "server.pem"
+                                c.TLSMinVersion = tt.min
+                                c.TLSCipherSuites = ""
+                        })
+                        server := startPolicyServer(t)
+                        err := tlsGet(server, tls.VersionTLS10, tt.client, nil)
+                        if tt.accepted && err != nil {
+                                t.Errorf("handshake failed: %v", err)
+                        }
+                        if !tt.accepted && err == nil {
+                                t.Errorf("%s client accepted with minimum %s", tls.VersionName(tt.client), tt.min)
+                        }
+                })
+        }
+        if !strings.Contains(logs.String(), "TLS connection negotiated TLS 1.2") {
+                t.Errorf("negotiated version not logged: %q", logs.String())
+        }
+}
+
+func TestTLSCipherSuitePolicy(t *testing.T) {
+        withConfig(t, func(c *Config) {
+                c.TLSCertFile = "server.pem"
+                c.TLSMinVersion = "1.2"
+                c.TLSCipherSuites = "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"
+        })
+        server := startPolicyServer(t)
+
+        if err := tlsGet(server, tls.VersionTLS12, tls.VersionTLS12,
+                []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}); err != nil {
+                t.Errorf("allowed suite rejected: %v", err)
+        }
+        if err := tlsGet(server, tls.VersionTLS12, tls.VersionTLS12,
+                []uint16{tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256}); err == nil {
+                t.Error("handshake with a suite outside the policy succeeded")
+        }
+}
+
+func TestTLSConfigValidation(t *testing.T) {
+        tests := []struct {
+                name    string
+                mutate  func(c *Config)
+                wantErr string
+        }{
+                {"TLS 1.1 minimum", func(c *Config) { c.TLSMinVersion = "1.1" }, "unsupported TLS_MIN_VERSION"},
+                {"unknown suite", func(c *Config) { c.TLSCipherSuites = "TLS_FAST_AND_LOOSE" }, "TLS_FAST_AND_LOOSE"},
+                {"insecure suite", func(c *Config) { c.TLSCipherSuites = "TLS_RSA_WITH_RC4_128_SHA" }, "insecure"},
+                {"missing client CA", func(c *Config) { c.TLSClientCAFile = t.TempDir() + "/absent-ca.pem" }, "client CA"},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        withConfig(t, func(c *Config) {
+                                c.TLSCertFile = "server.pem"
+                                c.TLSMinVersion = "1.2"
+                                c.TLSCipherSuites = ""
+                                c.TLSClientCAFile = ""
+                                tt.mutate(c)
+                        })
+                        if _, err := newServerTLSConfig(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                                t.Errorf("err = %v, want %q", err, tt.wantErr)
+                        }
+                })
+        }
+
+        withConfig(t, func(c *Config) { c.TLSCertFile = "" })
+        if tlsConfig, err := newServerTLSConfig(); tlsConfig != nil || err != nil {
+                t.Errorf("TLS without a certificate = %v, %v; want disabled", tlsConfig, err)
+        }
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "crypto/rand"
+        "encoding/asn1"
+        "encoding/hex"
+        "fmt"
+        "io"
+        "log"
+        "math/big"
+        "net/http"
+        "time"
+
+        "github.com/jackc/pgx/v5/pgxpool"
+)
+
+// RFC 3161 timestamp statuses recorded in evidence_timestamps
+const (
+        timestampStatusPending = "pending"
+        timestampStatusGranted = "granted"
+        timestampStatusFailed  = "failed"
+)
+
+// Longest delay between timestamp requests for one evidence record
+const maxTimestampBackoff = 30 * time.Minute
+
+var oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+
+type tsaAlgorithmIdentifier struct {
+        Algorithm  asn1.ObjectIdentifier
+        Parameters asn1.RawValue `asn1:"optional"`
+}
+
+type tsaMessageImprint struct {
+        HashAlgorithm tsaAlgorithmIdentifier
+        HashedMessage []byte
+}
+
+// TimeStampReq (RFC 3161 section 2.4.1)
+type timeStampReq struct {
+        Version        int
+        MessageImprint tsaMessageImprint
+        Nonce          *big.Int `asn1:"optional"`
+        CertReq        bool     `asn1:"optional"`
+}
+
+type tsaStatusInfo struct {
+        Status       int
+        StatusString []asn1.RawValue `asn1:"optional"`
+        FailInfo     asn1.BitString  `asn1:"optional"`
+}
+
+// TimeStampResp (RFC 3161 section 2.4.2); the token is kept as raw DER
+type timeStampResp struct {
+        Status         tsaStatusInfo
+        TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+// The parts of the token's CMS SignedData needed to reach TSTInfo. Later
+// SignedData fields (certificates, signerInfos) are ignored by encoding/asn1.
+type tsaContentInfo struct {
+        ContentType asn1.ObjectIdentifier
+        Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type tsaSignedData struct {
+        Version          int
+        DigestAlgorithms asn1.RawValue
+        EncapContentInfo struct {
+                EContentType asn1.ObjectIdentifier
+                EContent     []byte `asn1:"explicit,tag:0"`
+        }
+}
+
+type tstInfo struct {
+        Version        int
+        Policy         asn1.ObjectIdentifier
+        MessageImprint tsaMessageImprint
+        SerialNumber   *big.Int
+        GenTime        time.Time `asn1:"generalized"`
+}
+
+// Request a timestamp token over a hex SHA-256 digest. The token's message
+// imprint is checked against the digest; its signature is left to verifiers,
+// who need the TSA's certificate chain anyway.
+func requestTimestamp(ctx context.Context, checksum string) ([]byte, time.Time, error) {
+        digest, err := hex.DecodeString(checksum)
+        if err != nil {
+                return nil, time.Time{}, fmt.Errorf("invalid checksum: %v", err)
+        }
+        nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+        if err != nil {
+                return nil, time.Time{}, err
+        }
+        reqDER, err := asn1.Marshal(timeStampReq{
+                Version:        1,
+                MessageImprint: tsaMessageImprint{HashAlgorithm: tsaAlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}, HashedMessage: digest},
+                Nonce:          nonce,
+                CertReq:        true,
+        })
+        if err != nil {
+                return nil, time.Time{}, err
+        }
+
+        ctx, cancel := context.WithTimeout(ctx, cfg.TSATimeout)
+        defer cancel()
+        req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.TSAURL, bytes.NewReader(reqDER))
+        if err != nil {
+                return nil, time.Time{}, err
+        }
+        req.Header.Set("Content-Type", "application/timestamp-query")
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+                return nil, time.Time{}, err
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode != http.StatusOK {
+                return nil, time.Time{}, fmt.Errorf("TSA returned status %d", resp.StatusCode)
+        }
+        respDER, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+        if err != nil {
+                return nil, time.Time{}, err
+        }
+
+        var tsResp timeStampResp
+        if _, err := asn1.Unmarshal(respDER, &tsResp); err != nil {
+                return nil, time.Time{}, fmt.Errorf("malformed timestamp response: %v", err)
+        }
+        // 0 = granted, 1 = granted with modifications
+        if tsResp.Status.Status > 1 || len(tsResp.TimeStampToken.FullBytes) == 0 {
+                return nil, time.Time{}, fmt.Errorf("TSA rejected request (status %d)", tsResp.Status.Status)
+        }
+
+        info, err := parseTimestampToken(tsResp.TimeStampToken.FullBytes)
+        if err != nil {
+                return nil, time.Time{}, err
+        }
+        if !info.MessageImprint.HashAlgorithm.Algorithm.Equal(oidSHA256) || !bytes.Equal(info.MessageImprint.HashedMessage, digest) {
+                return nil, time.Time{}, fmt.Errorf("timestamp token does not cover the evidence checksum")
+        }
+        return tsResp.TimeStampToken.FullBytes, info.GenTime, nil
+}
+
+// Extract TSTInfo from a timestamp token
+func parseTimestampToken(token []byte) (*tstInfo, error) {
+        var content tsaContentInfo
+        if _, err := asn1.Unmarshal(token, &content); err != nil {
+                return nil, fmt.Errorf("malformed timestamp token: %v", err)
+        }
+        // encoding/asn1 keeps the explicit [0] wrapper in a RawValue; Bytes is the SignedData
+        var signed tsaSignedData
+        if _, err := asn1.Unmarshal(content.Content.Bytes, &signed); err != nil {
+                return nil, fmt.Errorf("malformed timestamp signed data: %v", err)
+        }
+        var info tstInfo
+        if _, err := asn1.Unmarshal(signed.EncapContentInfo.EContent, &info); err != nil {
+                return nil, fmt.Errorf("malformed TSTInfo: %v", err)
+        }
+        return &info, nil
+}
+
+// Statement recording that an evidence checksum awaits a timestamp; only queued
+// when TSA_URL is set
+func evidenceTimestampItem(evidenceID, checksum string) BatchItem {
+        return BatchItem{
+                SQL: `
+                        INSERT INTO evidence_timestamps (evidence_id, checksum, status)
+                        VALUES ($1, $2, $3)
+                `,
+                Args: []interface{}{evidenceID, checksum, timestampStatusPending},
+        }
+}
+
+// Timestamp pending evidence in the default database and every open tenant pool
+// until ctx is cancelled. An unreachable TSA leaves records pending for retry
+// with exponential backoff, up to TSA_MAX_ATTEMPTS.
+func timestampRelay(ctx context.Context) {
+        ticker := time.NewTicker(cfg.TSARetryInterval)
+        defer ticker.Stop()
+        jobHeartbeats.Register(jobTimestampRelay, cfg.TSARetryInterval)
+
+        for {
+                select {
+                case <-ctx.Done():
+                        return
+                case <-ticker.C:
+                        pools := tenantPools.All()
+                        pools[""] = dbPool
+                        failed := false
+                        for tenantID, pool := range pools {
+                                if err := timestampPending(ctx, pool); err != nil && ctx.Err() == nil {
+                                        log.Printf("Evidence timestamping error (tenant %q): %v", tenantID, err)
+                                        failed = true
+                                }
+                        }
+                        if !failed {
+                                jobHeartbeats.Beat(jobTimestampRelay)
+                        }
+                }
+        }
+}
+
+// Request timestamps for one batch of due records
+func timestampPending(ctx context.Context, pool *pgxpool.Pool) error {
+        tx, err := pool.Begin(ctx)
+        if err != nil {
+                return err
+        }
+        defer tx.Rollback(ctx)
+
+        rows, err := tx.Query(ctx, `
+                SELECT evidence_id::text, checksum, attempts
+                FROM evidence_timestamps
+                WHERE status = $1 AND next_attempt_at <= CURRENT_TIMESTAMP
+                ORDER BY next_attempt_at
+                LIMIT 20
+                FOR UPDATE SKIP LOCKED
+        `, timestampStatusPending)
+        if err != nil {
+                return err
+        }
+        type pendingTimestamp struct {
+                evidenceID string
+                checksum   string
+                attempts   int
+        }
+        var pending []pendingTimestamp
+        for rows.Next() {
+                var p pendingTimestamp
+                if err := rows.Scan(&p.evidenceID, &p.checksum, &p.attempts); err != nil {
+                        rows.Close()
+                        return err
+                }
+                pending = append(pending, p)
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+                return err
+        }
+
+        for _, p := range pending {
+                token, genTime, err := requestTimestamp(ctx, p.checksum)
+                if err == nil {
+                        if _, err := tx.Exec(ctx, `
+                                UPDATE evidence_timestamps
+                                SET status = $2, token = $3, gen_time = $4, attempts = attempts + 1, last_error = NULL
+                                WHERE evidence_id = $1
+                        `, p.evidenceID, timestampStatusGranted, token, genTime); err != nil {
+                                return err
+                        }
+                        continue
+                }
+
+                attempts := p.attempts + 1
+                status := timestampStatusPending
+                if cfg.TSAMaxAttempts > 0 && int64(attempts) >= cfg.TSAMaxAttempts {
+                        status = timestampStatusFailed
+                        log.Printf("Giving up on timestamp for evidence %s after %d attempts: %v", p.evidenceID, attempts, err)
+                }
+                backoff := min(time.Duration(1<<min(attempts, 16))*time.Second, maxTimestampBackoff)
+                if _, err := tx.Exec(ctx, `
+                        UPDATE evidence_timestamps
+                        SET status = $2, attempts = $3, last_error = $4, next_attempt_at = CURRENT_TIMESTAMP + $5::interval
+                        WHERE evidence_id = $1
+                `, p.evidenceID, status, attempts, err.Error(), fmt.Sprintf("%d seconds", int64(backoff.Seconds()))); err != nil {
+                        return err
+                }
+        }
+        return tx.Commit(ctx)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+        "context"
+        "encoding/asn1"
+        "encoding/hex"
+        "io"
+        "math/big"
+        "net/http"
+        "net/http/httptest"
+        "strings"
+        "sync/atomic"
+        "testing"
+        "time"
+)
+
+var (
+        oidSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+        oidTSTInfo    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+)
+
+// Stub RFC 3161 authority. It answers with an unsigned token over the
+// requested imprint (or over imprint, when set), or with status when it is
+// non-zero. Setting down makes it fail with 503.
+type stubTSA struct {
+        server   *httptest.Server
+        genTime  time.Time
+        status   int
+        imprint  []byte
+        down     atomic.Bool
+        requests atomic.Int64
+}
+
+func newStubTSA(t *testing.T) *stubTSA {
+        t.Helper()
+        tsa := &stubTSA{genTime: time.Date(2026, 9, 3, 10, 20, 30, 0, time.UTC)}
+        tsa.server = httptest.NewServer(http.HandlerFunc(tsa.serve))
+        t.Cleanup(tsa.server.Close)
+        withConfig(t, func(c *Config) {
+                c.TSAURL = tsa.server.URL
+                c.TSATimeout = 2 * time.Second
+        })
+        return tsa
+}
+
+func (s *stubTSA) serve(w http.ResponseWriter, r *http.Request) {
+        s.requests.Add(1)
+        if s.down.Load() {
+                http.Error(w, "maintenance", http.StatusServiceUnavailable)
+                return
+        }
+        if r.Header.Get("Content-Type") != "application/timestamp-query" {
+                http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+                return
+        }
+        body, _ := io.ReadAll(r.Body)
+        var req timeStampReq
+        if _, err := asn1.Unmarshal(body, &req); err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+        }
+
+        resp := timeStampResp{Status: tsaStatusInfo{Status: s.status}}
+        if s.status <= 1 {
+                imprint := req.MessageImprint
+                if s.imprint != nil {
+                        imprint.HashedMessage = s.imprint
+                }
+                token, err := stubTimestampToken(imprint, s.genTime)
+                if err != nil {
+                        http.Error(w, err.Error(), http.StatusInternalServerError)
+                        return
+                }
+                resp.TimeStampToken = asn1.RawValue{FullBytes: token}
+        }
+        der, err := asn1.Marshal(resp)
+        if err != nil {
+                http.Error(w, err.Error(), http.StatusInternalServerError)
+                return
+        }
+        w.Header().Set("Content-Type", "application/timestamp-reply")
+        w.Write(der)
+}
+
+// DER ContentInfo wrapping SignedData wrapping TSTInfo, without signer infos
+func stubTimestampToken(imprint tsaMessageImprint, genTime time.Time) ([]byte, error) {
+        info, err := asn1.Marshal(tstInfo{
+                Version:        1,
+                Policy:         asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1},
+                MessageImprint: imprint,
+                SerialNumber:   big.NewInt(1),
+                GenTime:        genTime,
+        })
+        if err != nil {
+                return nil, err
+        }
+        var signed tsaSignedData
+        signed.Version = 3
+        signed.DigestAlgorithms = asn1.RawValue{Tag: asn1.TagSet, IsCompound: true}
+        signed.EncapContentInfo.EContentType = oidTSTInfo
+        signed.EncapContentInfo.EContent = info
+        signedDER, err := asn1.Marshal(signed)
+        if err != nil {
+                return nil, err
+        }
+        // encoding/asn1 does not add an explicit tag around a pre-encoded
+        // RawValue, so the [0] wrapper is built by hand
+        return asn1.Marshal(struct {
+                ContentType asn1.ObjectIdentifier
+                Content     asn1.RawValue
+        }{oidSignedData, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedDER}})
+}
+
+func TestRequestTimestampFromStubTSA(t *testing.T) {
+        tsa := newStubTSA(t)
+        checksum := calculateSHA256([]byte("sprinkler riser photo"))
+
+        token, genTime, err := requestTimestamp(context.Background(), checksum)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if !genTime.Equal(tsa.genTime) {
+                t.Errorf("gen time = %s, want %s", genTime, tsa.genTime)
+        }
+        info, err := parseTimestampToken(token)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if hex.EncodeToString(info.MessageImprint.HashedMessage) != checksum {
+                t.Errorf("token imprint = %x, want %s", info.MessageImprint.HashedMessage, checksum)
+        }
+}
+
+func TestRequestTimestampFailures(t *testing.T) {
+        checksum := calculateSHA256([]byte("alarm panel log"))
+        tests := []struct {
+                name    string
+                setup   func(tsa *stubTSA)
+                wantErr string
+        }{
+                {"unreachable", func(tsa *stubTSA) { tsa.down.Store(true) }, "status 503"},
+                {"rejected", func(tsa *stubTSA) { tsa.status = 2 }, "rejected request (status 2)"},
+                {"token over another digest", func(tsa *stubTSA) { tsa.imprint = make([]byte, 32) }, "does not cover"},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        tsa := newStubTSA(t)
+                        tt.setup(tsa)
+                        _, _, err := requestTimestamp(context.Background(), checksum)
+                        if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                                t.Errorf("err = %v, want %q", err, tt.wantErr)
+                        }
+                })
+        }
+
+        t.Run("invalid checksum", func(t *testing.T) {
+                tsa := newStubTSA(t)
+                if _, _, err := requestTimestamp(context.Background(), "not-hex"); err == nil {
+                        t.Error("invalid checksum accepted")
+                }
+                if n := tsa.requests.Load(); n != 0 {
+                        t.Errorf("TSA called %d times for an invalid checksum", n)
+                }
+        })
+}
+
+func TestEvidenceRowsRequestTimestampOnlyWithTSA(t *testing.T) {
+        u := &evidenceUpload{ID: "evidence-id", SessionID: "session-id", EvidenceType: "photo", UserID: "inspector-2",
+                Checksum: calculateSHA256([]byte("x")), Metadata: map[string]interface{}{}}
+        for _, tsaURL := range []string{"", "https://tsa.example.test"} {
+                withConfig(t, func(c *Config) { c.TSAURL = tsaURL })
+                requested := false
+                for _, item := range evidenceRowItems(u, "file-0") {
+                        requested = requested || strings.Contains(item.SQL, "evidence_timestamps")
+                        if item.Ref != "file-0" {
+                                t.Errorf("item ref = %q, want file-0", item.Ref)
+                        }
+                }
+                if requested != (tsaURL != "") {
+                        t.Errorf("TSA_URL %q: timestamp requested = %v", tsaURL, requested)
+                }
+        }
+}
+
+// Status, attempts and token of an evidence record's timestamp
+func evidenceTimestamp(t *testing.T, evidenceID string) (status string, attempts int, token []byte) {
+        t.Helper()
+        err := dbPool.QueryRow(context.Background(),
+                "SELECT status, attempts, token FROM evidence_timestamps WHERE evidence_id = $1", evidenceID).Scan(&status, &attempts, &token)
+        if err != nil {
+                t.Fatal(err)
+        }
+        return status, attempts, token
+}
+
+func TestUploadTimestampedAfterTSARecovers(t *testing.T) {
+        pool := testDB(t)
+        useTestEvidenceStore(t)
+        tsa := newStubTSA(t)
+        tsa.down.Store(true)
+        userID := insertTestUser(t, pool, "timestamped")
+        sessionID := insertTestSession(t, pool, nil, nil)
+
+        // The upload succeeds while the TSA is unreachable
+        evidenceID := uploadTestEvidence(t, userID, sessionID, "extinguisher-tag.jpg", []byte("tagged 2026-09"))
+        if status, _, _ := evidenceTimestamp(t, evidenceID); status != timestampStatusPending {
+                t.Fatalf("status = %s, want pending", status)
+        }
+        if err := timestampPending(context.Background(), pool); err != nil {
+                t.Fatal(err)
+        }
+        status, attempts, token := evidenceTimestamp(t, evidenceID)
+        if status != timestampStatusPending || attempts != 1 || token != nil {
+                t.Fatalf("after outage: status %s, attempts %d, token %d bytes; want pending retry", status, attempts, len(token))
+        }
+
+        tsa.down.Store(false)
+        if _, err := pool.Exec(context.Background(),
+                "UPDATE evidence_timestamps SET next_attempt_at = CURRENT_TIMESTAMP WHERE evidence_id = $1", evidenceID); err != nil {
+                t.Fatal(err)
+        }
+        if err := timestampPending(context.Background(), pool); err != nil {
+                t.Fatal(err)
+        }
+        status, attempts, token = evidenceTimestamp(t, evidenceID)
+        if status != timestampStatusGranted || attempts != 2 {
+                t.Fatalf("after recovery: status %s, attempts %d; want granted on the second attempt", status, attempts)
+        }
+        if _, err := parseTimestampToken(token); err != nil {
+                t.Errorf("stored token: %v", err)
+        }
+}
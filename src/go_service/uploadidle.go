@@ -0,0 +1,72 @@
+package main
+
+import (
+        "errors"
+        "io"
+        "net/http"
+        "os"
+        "time"
+)
+
+// Returned by an idle-limited upload body when the client sent nothing for
+// longer than UPLOAD_IDLE_TIMEOUT
+var errUploadIdle = errors.New("upload stalled")
+
+// Request body that aborts once no bytes arrive for the idle timeout. The
+// connection read deadline is pushed forward before every read, so it replaces
+// the server-wide read timeout: slow transfers continue as long as they make
+// progress, while stalled ones fail on the next read.
+type idleTimeoutBody struct {
+        body    io.ReadCloser
+        rc      *http.ResponseController
+        timeout time.Duration
+        stalled bool
+}
+
+// Wrap r.Body with the UPLOAD_IDLE_TIMEOUT deadline. Returns nil, leaving the
+// body untouched, when the timeout is disabled or the connection does not
+// support read deadlines.
+func limitUploadIdle(w http.ResponseWriter, r *http.Request) *idleTimeoutBody {
+        if cfg.UploadIdleTimeout <= 0 {
+                return nil
+        }
+        rc := http.NewResponseController(w)
+        if err := rc.SetReadDeadline(time.Now().Add(cfg.UploadIdleTimeout)); err != nil {
+                return nil
+        }
+        body := &idleTimeoutBody{body: r.Body, rc: rc, timeout: cfg.UploadIdleTimeout}
+        r.Body = body
+        return body
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+        b.rc.SetReadDeadline(time.Now().Add(b.timeout))
+        n, err := b.body.Read(p)
+        if errors.Is(err, os.ErrDeadlineExceeded) {
+                b.stalled = true
+                return n, errUploadIdle
+        }
+        return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+        return b.body.Close()
+}
+
+// Report whether the upload was aborted for inactivity
+func (b *idleTimeoutBody) Stalled() bool {
+        return b != nil && b.stalled
+}
+
+// Finish streaming: clear the idle deadline and restart the write timeout, so a
+// long upload does not leave the response without time to be written. A
+// stalled upload keeps its expired deadline so the unread body is not awaited.
+func (b *idleTimeoutBody) Done() {
+        if b == nil || b.stalled {
+                return
+        }
+        b.rc.SetReadDeadline(time.Time{})
+        if cfg.ServerWriteTimeout > 0 {
+                b.rc.SetWriteDeadline(time.Now().Add(cfg.ServerWriteTimeout))
+        }
+}
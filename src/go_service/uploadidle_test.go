@@ -0,0 +1,104 @@
+package main
+
+import (
+        "bufio"
+        "fmt"
+        "io"
+        "mime/multipart"
+        "net"
+        "net/http"
+        "net/http/httptest"
+        "strings"
+        "testing"
+        "time"
+)
+
+func TestLimitUploadIdleDisabled(t *testing.T) {
+        withConfig(t, func(c *Config) { c.UploadIdleTimeout = 0 })
+        r := httptest.NewRequest(http.MethodPost, "/v1/evidence", strings.NewReader("body"))
+        if body := limitUploadIdle(httptest.NewRecorder(), r); body != nil || body.Stalled() {
+                t.Errorf("limitUploadIdle = %v with the timeout off, want nil", body)
+        }
+
+        // A recorder has no connection deadlines to set
+        cfg.UploadIdleTimeout = time.Second
+        if body := limitUploadIdle(httptest.NewRecorder(), r); body != nil {
+                t.Errorf("limitUploadIdle = %v without deadline support, want nil", body)
+        }
+}
+
+func uploadIdleServer(t *testing.T, timeout time.Duration) *httptest.Server {
+        t.Helper()
+        withConfig(t, func(c *Config) {
+                c.UploadIdleTimeout = timeout
+                c.EvidenceRateLimitPerMinute = 0
+        })
+        server := httptest.NewServer(http.HandlerFunc(handleEvidence))
+        t.Cleanup(server.Close)
+        return server
+}
+
+func TestStalledUploadAborted(t *testing.T) {
+        server := uploadIdleServer(t, 150*time.Millisecond)
+        conn, err := net.Dial("tcp", server.Listener.Addr().String())
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer conn.Close()
+
+        // Promise a large body, send the start of the form, then go quiet
+        const boundary = "stalled-boundary"
+        part := "--" + boundary + "\r\nContent-Disposition: form-data; name=\"file\"; filename=\"pump-room.mp4\"\r\n\r\npartial video bytes"
+        fmt.Fprintf(conn, "POST /v1/evidence HTTP/1.1\r\nHost: fire-ai\r\nIdempotency-Key: stalled-upload-1\r\nX-User-ID: inspector-61\r\n"+
+                "Content-Type: multipart/form-data; boundary=%s\r\nContent-Length: %d\r\n\r\n%s", boundary, 10<<20, part)
+
+        start := time.Now()
+        conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+        resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+        if err != nil {
+                t.Fatalf("no response to the stalled upload: %v", err)
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode != http.StatusRequestTimeout || !resp.Close {
+                t.Errorf("status = %d, close %v; want 408 closing the connection", resp.StatusCode, resp.Close)
+        }
+        if elapsed := time.Since(start); elapsed > 2*time.Second {
+                t.Errorf("aborted after %s, want about the idle timeout", elapsed)
+        }
+}
+
+func TestSlowProgressingUploadContinues(t *testing.T) {
+        server := uploadIdleServer(t, 150*time.Millisecond)
+
+        // Six chunks 60ms apart: well past the idle timeout in total, never idle for it
+        pr, pw := io.Pipe()
+        form := multipart.NewWriter(pw)
+        go func() {
+                file, _ := form.CreateFormFile("file", "sprinkler-walkthrough.mp4")
+                for i := 0; i < 6; i++ {
+                        time.Sleep(60 * time.Millisecond)
+                        file.Write([]byte(strings.Repeat("frame ", 500)))
+                }
+                form.Close()
+                pw.Close()
+        }()
+
+        req, _ := http.NewRequest(http.MethodPost, server.URL+"/v1/evidence", pr)
+        req.Header.Set("Content-Type", form.FormDataContentType())
+        req.Header.Set("Idempotency-Key", "slow-upload-1")
+        req.Header.Set("X-User-ID", "inspector-62")
+        start := time.Now()
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+                t.Fatal(err)
+        }
+        defer resp.Body.Close()
+        body, _ := io.ReadAll(resp.Body)
+        if resp.StatusCode == http.StatusRequestTimeout {
+                t.Fatalf("slow upload aborted after %s: %s", time.Since(start), body)
+        }
+        // Past the form parse, the upload fails validation for its missing fields
+        if resp.StatusCode != http.StatusBadRequest || strings.Contains(string(body), "parse form") {
+                t.Errorf("status = %d %q, want a validation error after the full body", resp.StatusCode, body)
+        }
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+        "encoding/json"
+        "fmt"
+        "log"
+        "path/filepath"
+        "sort"
+        "strings"
+        "unicode"
+        "unicode/utf8"
+)
+
+// Postgres JSONB cannot store U+0000, and encoding/json silently replaces invalid
+// UTF-8 with U+FFFD. CRDT payloads are therefore rejected up front (422) when the
+// raw body is not valid UTF-8 or when any decoded string or object key contains a
+// NUL byte, instead of surfacing an opaque database error on write.
+
+// Returned when a payload contains text that cannot be stored as JSONB
+type InvalidTextError struct {
+        Path   string
+        Reason string
+}
+
+func (e *InvalidTextError) Error() string {
+        return fmt.Sprintf("%s at %s", e.Reason, e.Path)
+}
+
+// Validate that the raw request body is well-formed UTF-8
+func validateUTF8Body(body []byte) error {
+        if !utf8.Valid(body) {
+                return &InvalidTextError{Path: "body", Reason: "invalid UTF-8"}
+        }
+        return nil
+}
+
+// Validate that the raw body does not nest objects or arrays deeper than max
+// (0 disables). Scans iteratively so hostile input cannot exhaust the stack
+// in the decoder or in later recursive merges.
+func validateJSONDepth(body []byte, max int64) error {
+        if max <= 0 {
+                return nil
+        }
+        var depth int64
+        inString, escaped := false, false
+        for _, c := range body {
+                if inString {
+                        switch {
+                        case escaped:
+                                escaped = false
+                        case c == '\\':
+                                escaped = true
+                        case c == '"':
+                                inString = false
+                        }
+                        continue
+                }
+                switch c {
+                case '"':
+                        inString = true
+                case '{', '[':
+                        depth++
+                        if depth > max {
+                                return &InvalidTextError{Path: "body", Reason: fmt.Sprintf("nesting deeper than %d levels", max)}
+                        }
+                case '}', ']':
+                        depth--
+                }
+        }
+        return nil
+}
+
+// Recursively check decoded JSON for NUL bytes in strings and object keys
+func validateJSONText(path string, v interface{}) error {
+        switch val := v.(type) {
+        case string:
+                if strings.ContainsRune(val, 0) {
+                        return &InvalidTextError{Path: path, Reason: "NUL byte in string"}
+                }
+        case map[string]interface{}:
+                for k, child := range val {
+                        childPath := path + "." + k
+                        if strings.ContainsRune(k, 0) {
+                                return &InvalidTextError{Path: path, Reason: "NUL byte in object key"}
+                        }
+                        if err := validateJSONText(childPath, child); err != nil {
+                                return err
+                        }
+                }
+        case []interface{}:
+                for i, child := range val {
+                        if err := validateJSONText(fmt.Sprintf("%s[%d]", path, i), child); err != nil {
+                                return err
+                        }
+                }
+        }
+        return nil
+}
+
+// Validate all text in a CRDT payload can be persisted as JSONB
+func validateCRDTPayloadText(payload *CRDTPayload) error {
+        for i, change := range payload.Changes {
+                if err := validateJSONText(fmt.Sprintf("changes[%d]", i), change); err != nil {
+                        return err
+                }
+        }
+        for node := range payload.VectorClock {
+                if strings.ContainsRune(node, 0) {
+                        return &InvalidTextError{Path: "vector_clock", Reason: "NUL byte in object key"}
+                }
+        }
+        if strings.ContainsRune(payload.IdempotencyKey, 0) {
+                return &InvalidTextError{Path: "idempotency_key", Reason: "NUL byte in string"}
+        }
+        return nil
+}
+
+// Sanitize an uploaded evidence filename before it is persisted: path components
+// are stripped, and names longer than MAX_EVIDENCE_FILENAME_LENGTH bytes are
+// truncated keeping their extension. Names with control characters or invalid
+// UTF-8, or with nothing left after stripping, are rejected.
+func sanitizeEvidenceFilename(name string) (string, error) {
+        if !utf8.ValidString(name) {
+                return "", fmt.Errorf("filename is not valid UTF-8")
+        }
+        for _, r := range name {
+                if unicode.IsControl(r) {
+                        return "", fmt.Errorf("filename contains control characters")
+                }
+        }
+
+        // Clients on any OS may send either separator
+        if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+                name = name[i+1:]
+        }
+        name = strings.TrimSpace(name)
+        if name == "" || name == "." || name == ".." {
+                return "", fmt.Errorf("filename is empty")
+        }
+
+        maxLen := int(cfg.MaxEvidenceFilenameLength)
+        if maxLen > 0 && len(name) > maxLen {
+                ext := filepath.Ext(name)
+                if len(ext) >= maxLen/2 {
+                        ext = ""
+                }
+                base := name[:maxLen-len(ext)]
+                // Do not cut a multi-byte character in half
+                for !utf8.ValidString(base) {
+                        base = base[:len(base)-1]
+                }
+                name = base + ext
+        }
+        return name, nil
+}
+
+// Require changes in a CRDT payload unless CRDT_ALLOW_CLOCK_ONLY accepts posts
+// that only advance the vector clock (heartbeats and acks); those must carry a
+// non-empty clock to merge
+func checkClockOnlyPayload(payload *CRDTPayload) error {
+        if len(payload.Changes) > 0 {
+                return nil
+        }
+        if !cfg.CRDTAllowClockOnly {
+                return fmt.Errorf("Changes required")
+        }
+        if len(payload.VectorClock) == 0 {
+                return fmt.Errorf("Changes or vector_clock required")
+        }
+        return nil
+}
+
+// Policies for unknown top-level fields in a CRDT payload
+const (
+        unknownFieldsIgnore = "ignore"
+        unknownFieldsWarn   = "warn"
+        unknownFieldsReject = "reject"
+)
+
+// Top-level fields of CRDTPayload
+var crdtPayloadFields = map[string]bool{
+        "session_id":       true,
+        "changes":          true,
+        "vector_clock":     true,
+        "idempotency_key":  true,
+        "session_template": true,
+}
+
+// Apply CRDT_UNKNOWN_FIELD_POLICY to the top-level fields of a raw CRDT payload.
+// Under "warn" unknown fields are logged and dropped; under "reject" they fail
+// the request so client bugs surface early. path locates the payload in errors.
+func checkUnknownCRDTFields(raw []byte, path string) error {
+        if cfg.CRDTUnknownFieldPolicy != unknownFieldsWarn && cfg.CRDTUnknownFieldPolicy != unknownFieldsReject {
+                return nil
+        }
+        var fields map[string]json.RawMessage
+        if err := json.Unmarshal(raw, &fields); err != nil {
+                return nil // malformed payloads are reported by the typed decode
+        }
+        var unknown []string
+        for name := range fields {
+                if !crdtPayloadFields[name] {
+                        unknown = append(unknown, name)
+                }
+        }
+        if len(unknown) == 0 {
+                return nil
+        }
+        sort.Strings(unknown)
+        if cfg.CRDTUnknownFieldPolicy == unknownFieldsWarn {
+                log.Printf("Ignoring unknown CRDT payload fields at %s: %s", path, strings.Join(unknown, ", "))
+                return nil
+        }
+        return fmt.Errorf("unknown field(s) at %s: %s", path, strings.Join(unknown, ", "))
+}
+
+// Apply checkUnknownCRDTFields to each item of a raw sync batch body
+func checkUnknownBatchFields(body []byte) error {
+        if cfg.CRDTUnknownFieldPolicy != unknownFieldsWarn && cfg.CRDTUnknownFieldPolicy != unknownFieldsReject {
+                return nil
+        }
+        var batch struct {
+                Items []json.RawMessage `json:"items"`
+        }
+        if err := json.Unmarshal(body, &batch); err != nil {
+                return nil
+        }
+        for i, item := range batch.Items {
+                if err := checkUnknownCRDTFields(item, fmt.Sprintf("items[%d]", i)); err != nil {
+                        return err
+                }
+        }
+        return nil
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+        "context"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "net/http"
+        "net/http/httptest"
+        "reflect"
+        "strings"
+        "testing"
+)
+
+func TestValidateCRDTPayloadTextRejectsNUL(t *testing.T) {
+        tests := []struct {
+                name string
+                body string
+                path string
+        }{
+                {"string value", `{"changes":[{"op":"set","path":"/notes","value":"pump\u0000room"}]}`, "changes[0].value"},
+                {"nested array", `{"changes":[{"readings":[1,"ok","\u0000"]}]}`, "changes[0].readings[2]"},
+                {"object key", `{"changes":[{"op":"set","path":"/a","value":{"k\u0000":1}}]}`, "changes[0].value"},
+                {"vector clock node", `{"changes":[],"vector_clock":{"node\u0000":1}}`, "vector_clock"},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        var payload CRDTPayload
+                        if err := json.Unmarshal([]byte(tt.body), &payload); err != nil {
+                                t.Fatal(err)
+                        }
+                        err := validateCRDTPayloadText(&payload)
+                        var textErr *InvalidTextError
+                        if !errors.As(err, &textErr) {
+                                t.Fatalf("got %v, want InvalidTextError", err)
+                        }
+                        if textErr.Path != tt.path {
+                                t.Errorf("path = %q, want %q", textErr.Path, tt.path)
+                        }
+                })
+        }
+
+        var clean CRDTPayload
+        json.Unmarshal([]byte(`{"changes":[{"op":"set","path":"/notes","value":"Prüfung – ok ✓"}],"idempotency_key":"k"}`), &clean)
+        if err := validateCRDTPayloadText(&clean); err != nil {
+                t.Errorf("valid multilingual text rejected: %v", err)
+        }
+}
+
+func TestValidateUTF8Body(t *testing.T) {
+        if err := validateUTF8Body([]byte(`{"value":"Größe"}`)); err != nil {
+                t.Errorf("valid UTF-8 rejected: %v", err)
+        }
+        // A lone continuation byte and a truncated multi-byte sequence
+        for _, body := range [][]byte{[]byte("{\"value\":\"\x80\"}"), []byte("{\"value\":\"\xe2\x82\"}")} {
+                if err := validateUTF8Body(body); err == nil {
+                        t.Errorf("invalid UTF-8 %q accepted", body)
+                }
+        }
+}
+
+func TestCRDTResultsRejectsInvalidText(t *testing.T) {
+        nul := []byte(`{"idempotency_key":"k1","changes":[{"op":"set","path":"/notes","value":"a\u0000b"}]}`)
+        w := postCRDTResults(t, "session-1", nul, http.Header{"X-User-Id": {"u1"}})
+        if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "NUL byte") {
+                t.Errorf("NUL byte: %d %q, want 422", w.Code, w.Body.String())
+        }
+
+        invalid := []byte("{\"idempotency_key\":\"k2\",\"changes\":[{\"op\":\"set\",\"path\":\"/notes\",\"value\":\"\xff\"}]}")
+        w = postCRDTResults(t, "session-1", invalid, http.Header{"X-User-Id": {"u1"}})
+        if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "invalid UTF-8") {
+                t.Errorf("invalid UTF-8: %d %q, want 422", w.Code, w.Body.String())
+        }
+}
+
+// A set change whose value nests depth objects
+func nestedChangeBody(depth int) []byte {
+        value := strings.Repeat(`{"zone":`, depth) + `"alarm"` + strings.Repeat(`}`, depth)
+        return []byte(`{"idempotency_key":"deep","changes":[{"op":"set","path":"/panel","value":` + value + `}]}`)
+}
+
+func TestValidateJSONDepth(t *testing.T) {
+        tests := []struct {
+                name    string
+                body    string
+                max     int64
+                wantErr bool
+        }{
+                {"within limit", `{"a":[{"b":[1]}]}`, 4, false},
+                {"one past limit", `{"a":[{"b":[[1]]}]}`, 4, true},
+                {"brackets inside strings", `{"note":"[[[[{{{{"}`, 2, false},
+                {"escaped quote inside string", `{"note":"say \"[[[\" twice","x":[1]}`, 2, false},
+                {"disabled", strings.Repeat("[", 500) + strings.Repeat("]", 500), 0, false},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        err := validateJSONDepth([]byte(tt.body), tt.max)
+                        if (err != nil) != tt.wantErr {
+                                t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+                        }
+                })
+        }
+}
+
+func TestCRDTResultsRejectsDeepNesting(t *testing.T) {
+        withConfig(t, func(c *Config) { c.MaxJSONDepth = 16 })
+
+        // The payload wraps the value in three levels: body, changes array, change object
+        if err := validateJSONDepth(nestedChangeBody(13), cfg.MaxJSONDepth); err != nil {
+                t.Errorf("depth 16 rejected: %v", err)
+        }
+        w := postCRDTResults(t, "session-deep", nestedChangeBody(14), http.Header{"X-User-Id": {"u-deep"}})
+        if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "nesting deeper than 16 levels") {
+                t.Errorf("depth 17: %d %q, want 422", w.Code, w.Body.String())
+        }
+
+        // Far beyond the limit is rejected by the scan, without recursing
+        w = postCRDTResults(t, "session-deep", nestedChangeBody(100000), http.Header{"X-User-Id": {"u-deep"}})
+        if w.Code != http.StatusUnprocessableEntity {
+                t.Errorf("depth 100003: %d, want 422", w.Code)
+        }
+}
+
+func TestSanitizeEvidenceFilename(t *testing.T) {
+        withConfig(t, func(c *Config) { c.MaxEvidenceFilenameLength = 32 })
+        tests := []struct {
+                name    string
+                in      string
+                want    string
+                wantErr bool
+        }{
+                {"plain", "riser-valve.jpg", "riser-valve.jpg", false},
+                {"unix traversal", "../../etc/cron.d/backdoor", "backdoor", false},
+                {"windows traversal", `..\..\Windows\system.ini`, "system.ini", false},
+                {"trailing separator", "uploads/../", "", true},
+                {"only dots", "..", "", true},
+                {"surrounding spaces", "  pump room.png ", "pump room.png", false},
+                {"long name keeps extension", strings.Repeat("sprinkler-", 10) + ".jpeg", strings.Repeat("sprinkler-", 3)[:27] + ".jpeg", false},
+                {"long multi-byte name", strings.Repeat("é", 40), strings.Repeat("é", 16), false},
+                {"control character", "report\x07.pdf", "", true},
+                {"newline", "notes\n.txt", "", true},
+                {"invalid UTF-8", "scan\xff.tiff", "", true},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        got, err := sanitizeEvidenceFilename(tt.in)
+                        if tt.wantErr {
+                                if err == nil {
+                                        t.Errorf("sanitize(%q) = %q, want error", tt.in, got)
+                                }
+                                return
+                        }
+                        if err != nil || got != tt.want {
+                                t.Errorf("sanitize(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+                        }
+                        if len(got) > 32 {
+                                t.Errorf("sanitized name is %d bytes", len(got))
+                        }
+                })
+        }
+}
+
+func TestEvidenceUploadRejectsMalformedFilename(t *testing.T) {
+        // Rejected before hashing or any database access
+        content := []byte("monthly alarm test log")
+        r := evidenceUploadRequest(t, map[string]string{
+                "session_id":    "8e2d4c6a-1f3b-4a5c-9d7e-0b1c2d3e4f50",
+                "evidence_type": "document",
+                "sha256_hash":   calculateSHA256(content),
+        }, map[string][]byte{"alarm\tlog.txt": content})
+        w := httptest.NewRecorder()
+        handleEvidence(w, r)
+        if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Invalid filename") {
+                t.Errorf("status = %d %q, want 400 Invalid filename", w.Code, w.Body.String())
+        }
+}
+
+func TestEvidenceUploadStoresSanitizedFilename(t *testing.T) {
+        pool := testDB(t)
+        useTestEvidenceStore(t)
+        withConfig(t, func(c *Config) { c.MaxEvidenceFilenameLength = 64 })
+        userID := insertTestUser(t, pool, "filenames")
+        sessionID := insertTestSession(t, pool, nil, nil)
+
+        tests := []struct {
+                name     string
+                filename string
+                want     string
+        }{
+                {"traversal", `..\..\..\srv\evidence\hose-reel.png`, "hose-reel.png"},
+                {"overlong", strings.Repeat("fire-door-inspection-", 8) + ".pdf", (strings.Repeat("fire-door-inspection-", 8))[:60] + ".pdf"},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        content := []byte("evidence for " + tt.name)
+                        r := evidenceUploadRequest(t, map[string]string{
+                                "session_id":    sessionID,
+                                "evidence_type": "photo",
+                                "sha256_hash":   calculateSHA256(content),
+                        }, map[string][]byte{tt.filename: content})
+                        r.Header.Set("X-User-ID", userID)
+                        w := httptest.NewRecorder()
+                        handleEvidence(w, r)
+                        if w.Code != http.StatusCreated && w.Code != http.StatusOK {
+                                t.Fatalf("upload = %d %s", w.Code, w.Body.String())
+                        }
+                        var uploaded struct {
+                                EvidenceID string `json:"evidence_id"`
+                        }
+                        json.Unmarshal(w.Body.Bytes(), &uploaded)
+                        record, err := loadEvidenceRecord(context.Background(), uploaded.EvidenceID)
+                        if err != nil {
+                                t.Fatal(err)
+                        }
+                        if got := record.Metadata["original_filename"]; got != tt.want {
+                                t.Errorf("original_filename = %q, want %q", got, tt.want)
+                        }
+                })
+        }
+}
+
+func TestUnknownCRDTFieldPolicies(t *testing.T) {
+        payload := []byte(`{"changes": [{"op": "set", "path": "/hydrant", "value": "ok"}], "client_build": "4.2.0-beta", "vector_clock": {}}`)
+
+        tests := []struct {
+                policy  string
+                wantErr bool
+                wantLog bool
+        }{
+                {unknownFieldsIgnore, false, false},
+                {unknownFieldsWarn, false, true},
+                {unknownFieldsReject, true, false},
+        }
+        for _, tt := range tests {
+                t.Run(tt.policy, func(t *testing.T) {
+                        withConfig(t, func(c *Config) { c.CRDTUnknownFieldPolicy = tt.policy })
+                        logs := captureLog(t)
+                        err := checkUnknownCRDTFields(payload, "payload")
+                        if (err != nil) != tt.wantErr {
+                                t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+                        }
+                        if err != nil && !strings.Contains(err.Error(), "client_build") {
+                                t.Errorf("err = %v, want it to name the field", err)
+                        }
+                        if logged := strings.Contains(logs.String(), "client_build"); logged != tt.wantLog {
+                                t.Errorf("logged = %v, want %v: %q", logged, tt.wantLog, logs.String())
+                        }
+                })
+        }
+
+        t.Run("known fields only", func(t *testing.T) {
+                withConfig(t, func(c *Config) { c.CRDTUnknownFieldPolicy = unknownFieldsReject })
+                known := []byte(`{"session_id": "s", "changes": [], "vector_clock": {}, "idempotency_key": "k", "session_template": "t"}`)
+                if err := checkUnknownCRDTFields(known, "payload"); err != nil {
+                        t.Errorf("known fields rejected: %v", err)
+                }
+        })
+}
+
+func TestUnknownFieldRejectedInBatchItem(t *testing.T) {
+        withConfig(t, func(c *Config) { c.CRDTUnknownFieldPolicy = unknownFieldsReject })
+        body := []byte(`{"items": [{"session_id": "a", "changes": []}, {"session_id": "b", "changes": [], "retry": 3}]}`)
+        err := checkUnknownBatchFields(body)
+        if err == nil || !strings.Contains(err.Error(), "items[1]") || !strings.Contains(err.Error(), "retry") {
+                t.Errorf("err = %v, want items[1] named with the retry field", err)
+        }
+}
+
+func TestCRDTHandlerRejectsUnknownField(t *testing.T) {
+        withConfig(t, func(c *Config) { c.CRDTUnknownFieldPolicy = unknownFieldsReject })
+        body := []byte(`{"changes": [{"op": "set", "path": "/valve", "value": "open"}], "idempotency_key": "unknown-field-1", "debug": true}`)
+        w := postCRDTResults(t, "5e0c4b1a-7d2f-4e96-8a3b-1f6d9c2e7b40", body, http.Header{"X-User-Id": {"inspector-11"}})
+        if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "debug") {
+                t.Errorf("status = %d %s, want 400 naming the debug field", w.Code, w.Body.String())
+        }
+}
+
+func TestCheckClockOnlyPayload(t *testing.T) {
+        changes := []map[string]interface{}{{"op": "set", "path": "/riser", "value": "open"}}
+        tests := []struct {
+                name      string
+                allow     bool
+                payload   CRDTPayload
+                wantError string
+        }{
+                {"changes, default", false, CRDTPayload{Changes: changes}, ""},
+                {"clock only, default", false, CRDTPayload{VectorClock: map[string]int64{"tablet-9": 4}}, "Changes required"},
+                {"clock only, allowed", true, CRDTPayload{VectorClock: map[string]int64{"tablet-9": 4}}, ""},
+                {"empty, allowed", true, CRDTPayload{}, "Changes or vector_clock required"},
+                {"changes, allowed", true, CRDTPayload{Changes: changes}, ""},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        withConfig(t, func(c *Config) { c.CRDTAllowClockOnly = tt.allow })
+                        err := checkClockOnlyPayload(&tt.payload)
+                        if got := fmt.Sprint(err); tt.wantError == "" && err != nil || tt.wantError != "" && got != tt.wantError {
+                                t.Errorf("err = %v, want %q", err, tt.wantError)
+                        }
+                })
+        }
+}
+
+func TestClockOnlyPostRejectedByDefault(t *testing.T) {
+        withConfig(t, func(c *Config) { c.CRDTAllowClockOnly = false })
+        body, _ := json.Marshal(CRDTPayload{IdempotencyKey: "heartbeat-1", VectorClock: map[string]int64{"tablet-3": 12}})
+        w := postCRDTResults(t, "session-heartbeat", body, http.Header{"X-User-Id": {"inspector-30"}})
+        if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Changes required") {
+                t.Errorf("status = %d %q, want 400", w.Code, w.Body.String())
+        }
+}
+
+func TestClockOnlyPostAdvancesClock(t *testing.T) {
+        pool := testDB(t)
+        withConfig(t, func(c *Config) { c.CRDTAllowClockOnly = true })
+        userID := insertTestUser(t, pool, "heartbeat")
+        sessionID := insertTestSession(t, pool,
+                map[string]interface{}{"standpipe": "pressurised"}, map[string]int64{"tablet-3": 2, "tablet-7": 5})
+
+        body, _ := json.Marshal(CRDTPayload{
+                IdempotencyKey: "heartbeat-" + sessionID,
+                VectorClock:    map[string]int64{"tablet-3": 9},
+        })
+        w := postCRDTResults(t, sessionID, body, http.Header{"X-User-Id": {userID}})
+        if w.Code != http.StatusOK {
+                t.Fatalf("clock-only post = %d %s, want 200", w.Code, w.Body.String())
+        }
+        var response CRDTResponse
+        json.Unmarshal(w.Body.Bytes(), &response)
+        if response.AppliedCount != 0 || response.VectorClock["tablet-3"] != 9 || response.VectorClock["tablet-7"] != 5 {
+                t.Errorf("response = %+v, want the merged clock and nothing applied", response)
+        }
+
+        state, err := loadSessionState(context.Background(), sessionID)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if !reflect.DeepEqual(state.SessionData, map[string]interface{}{"standpipe": "pressurised"}) || state.VectorClock["tablet-3"] != 9 {
+                t.Errorf("state = %+v, want the data untouched and the clock advanced", state)
+        }
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+        "bytes"
+        "encoding/json"
+        "fmt"
+        "net/http"
+)
+
+// Current vector clock storage format version. Version 0 is the legacy bare
+// map ({"node": 3}); version 1 wraps it in an envelope ({"v":1,"clock":{...}})
+// so metadata can be added alongside the counters without breaking readers.
+const vectorClockVersion = 1
+
+// Versioned vector clock storage envelope
+type vectorClockEnvelope struct {
+        V     int              `json:"v"`
+        Clock map[string]int64 `json:"clock"`
+}
+
+// Decode a stored vector clock in either the legacy or versioned form.
+// Unknown fields in newer envelope versions are ignored so older binaries
+// can still read the counters.
+func decodeVectorClock(data []byte) (map[string]int64, error) {
+        data = bytes.TrimSpace(data)
+        if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+                return make(map[string]int64), nil
+        }
+
+        var probe map[string]json.RawMessage
+        if err := json.Unmarshal(data, &probe); err != nil {
+                return nil, fmt.Errorf("invalid vector clock: %v", err)
+        }
+
+        // A legacy map only holds integer counters, so an object-valued "clock"
+        // alongside "v" identifies the envelope form
+        rawClock, hasClock := probe["clock"]
+        _, hasVersion := probe["v"]
+        if hasClock && hasVersion && bytes.HasPrefix(bytes.TrimSpace(rawClock), []byte("{")) {
+                var envelope vectorClockEnvelope
+                if err := json.Unmarshal(data, &envelope); err != nil {
+                        return nil, fmt.Errorf("invalid vector clock envelope: %v", err)
+                }
+                if envelope.V < 1 {
+                        return nil, fmt.Errorf("unsupported vector clock version %d", envelope.V)
+                }
+                if envelope.Clock == nil {
+                        envelope.Clock = make(map[string]int64)
+                }
+                return envelope.Clock, nil
+        }
+
+        clock := make(map[string]int64)
+        if err := json.Unmarshal(data, &clock); err != nil {
+                return nil, fmt.Errorf("invalid legacy vector clock: %v", err)
+        }
+        return clock, nil
+}
+
+// Encode a vector clock for storage. The legacy bare map is written while
+// VECTOR_CLOCK_LEGACY_FORMAT is set (the default) because the Python app
+// reads vector_clock as a bare map; set it to false once every reader
+// decodes the versioned envelope.
+func encodeVectorClock(clock map[string]int64) ([]byte, error) {
+        if clock == nil {
+                clock = make(map[string]int64)
+        }
+        if cfg.VectorClockLegacyFormat {
+                return json.Marshal(clock)
+        }
+        return json.Marshal(vectorClockEnvelope{V: vectorClockVersion, Clock: clock})
+}
+
+// Reject negative counters and counters above MAX_VECTOR_CLOCK_COUNTER in a
+// client clock. The ceiling stops a buggy client from pushing a node near
+// overflow, where the server could no longer advance it.
+func validateVectorClockCounters(clock map[string]int64) error {
+        for node, counter := range clock {
+                if counter < 0 {
+                        return fmt.Errorf("vector clock counter for %q is negative", node)
+                }
+                if limit := cfg.MaxVectorClockCounter; limit > 0 && counter > limit {
+                        return fmt.Errorf("vector clock counter for %q exceeds %d", node, limit)
+                }
+        }
+        return nil
+}
+
+// Vector clock views selectable with ?clock= on CRDT writes
+const (
+        clockViewFull  = "full"
+        clockViewMine  = "mine"
+        clockViewDelta = "delta"
+)
+
+// Parse the requested vector clock view, defaulting to the full clock. The mine
+// view needs the requesting node, from X-Node-ID or the JWT node_id claim.
+func parseClockView(r *http.Request) (string, string, error) {
+        view := r.URL.Query().Get("clock")
+        switch view {
+        case "", clockViewFull:
+                return clockViewFull, "", nil
+        case clockViewDelta:
+                return view, "", nil
+        case clockViewMine:
+                nodeID := r.Header.Get("X-Node-ID")
+                if nodeID == "" {
+                        nodeID, _ = claimsFromContext(r.Context())["node_id"].(string)
+                }
+                if nodeID == "" {
+                        return "", "", fmt.Errorf("clock=mine requires an X-Node-ID header or node_id claim")
+                }
+                return view, nodeID, nil
+        }
+        return "", "", fmt.Errorf("invalid clock parameter %q (use full, mine or delta)", view)
+}
+
+// Entries of merged that advanced past previous
+func clockDelta(previous, merged map[string]int64) map[string]int64 {
+        delta := make(map[string]int64)
+        for node, counter := range merged {
+                if counter > previous[node] {
+                        delta[node] = counter
+                }
+        }
+        return delta
+}
+
+// Entries of the stored clock ahead of the client's, i.e. updates from those
+// nodes the client has not seen and should fetch. Nil when the client's clock
+// dominates the stored one.
+func missingDependencies(stored, client map[string]int64) map[string]int64 {
+        var missing map[string]int64
+        for node, counter := range stored {
+                if counter > client[node] {
+                        if missing == nil {
+                                missing = make(map[string]int64)
+                        }
+                        missing[node] = counter
+                }
+        }
+        return missing
+}
+
+// Reduce a CRDT response's vector clock to the requested view
+func applyClockView(response *CRDTResponse, view, nodeID string) {
+        switch view {
+        case clockViewMine:
+                clock := make(map[string]int64)
+                if counter, ok := response.VectorClock[nodeID]; ok {
+                        clock[nodeID] = counter
+                }
+                response.VectorClock = clock
+        case clockViewDelta:
+                response.VectorClock = response.clockDelta
+        }
+}
+
+// Policies for payload clocks without an entry for SERVER_NODE_ID
+const (
+        serverNodeMissingAdvance = "advance"
+        serverNodeMissingReject  = "reject"
+)
+
+// Advance the server's own entry in a merged clock when SERVER_NODE_ID is set.
+// A payload that omits the server node (as older clients do) does not reset
+// it: the merge keeps the stored counter, since absence means "not observed",
+// not zero. The counter then moves past both the stored and the payload value,
+// so every write is ordered after everything the server has issued. Under the
+// "reject" policy a payload that omits the node is refused instead, once the
+// session's clock includes it.
+func advanceServerNode(merged, current, payload map[string]int64) error {
+        node := cfg.ServerNodeID
+        if node == "" {
+                return nil
+        }
+        if _, seen := payload[node]; !seen {
+                if _, tracked := current[node]; tracked && cfg.ServerNodeMissingPolicy == serverNodeMissingReject {
+                        return fmt.Errorf("vector clock must include server node %q", node)
+                }
+        }
+        merged[node] = max(current[node], payload[node]) + 1
+        return nil
+}
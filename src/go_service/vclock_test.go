@@ -0,0 +1,468 @@
+package main
+
+import (
+        "bytes"
+        "encoding/json"
+        "errors"
+        "fmt"
+        "net/http"
+        "net/http/httptest"
+        "reflect"
+        "strings"
+        "testing"
+
+        "github.com/golang-jwt/jwt/v5"
+        "github.com/gorilla/mux"
+)
+
+func TestDecodeVectorClockFormats(t *testing.T) {
+        tests := []struct {
+                name string
+                data string
+                want map[string]int64
+        }{
+                {"legacy map", `{"tablet-7": 12, "server": 40}`, map[string]int64{"tablet-7": 12, "server": 40}},
+                {"envelope v1", `{"v":1,"clock":{"tablet-7":12,"server":40}}`, map[string]int64{"tablet-7": 12, "server": 40}},
+                {"future envelope with extra fields", `{"v":3,"clock":{"ipad":2},"hlc":"0001"}`, map[string]int64{"ipad": 2}},
+                {"legacy nodes named v and clock", `{"v": 4, "clock": 9}`, map[string]int64{"v": 4, "clock": 9}},
+                {"empty", ``, map[string]int64{}},
+                {"null", `null`, map[string]int64{}},
+                {"envelope without counters", `{"v":1,"clock":{}}`, map[string]int64{}},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        got, err := decodeVectorClock([]byte(tt.data))
+                        if err != nil {
+                                t.Fatal(err)
+                        }
+                        if !reflect.DeepEqual(got, tt.want) {
+                                t.Errorf("decoded %v, want %v", got, tt.want)
+                        }
+                })
+        }
+}
+
+func TestDecodeVectorClockRejectsInvalid(t *testing.T) {
+        for _, data := range []string{`[1,2]`, `{"v":0,"clock":{"a":1}}`, `{"node":"three"}`, `{"v":1,"clock":{"a":"x"}}`} {
+                if _, err := decodeVectorClock([]byte(data)); err == nil {
+                        t.Errorf("decodeVectorClock(%s) succeeded, want an error", data)
+                }
+        }
+}
+
+func TestEncodeVectorClockVersions(t *testing.T) {
+        clock := map[string]int64{"panel-a": 5, "server": 17}
+
+        withConfig(t, func(c *Config) { c.VectorClockLegacyFormat = true })
+        legacy, err := encodeVectorClock(clock)
+        if err != nil {
+                t.Fatal(err)
+        }
+        var bare map[string]int64
+        if err := json.Unmarshal(legacy, &bare); err != nil || !reflect.DeepEqual(bare, clock) {
+                t.Errorf("legacy encoding = %s, want a bare map", legacy)
+        }
+
+        cfg.VectorClockLegacyFormat = false
+        current, err := encodeVectorClock(clock)
+        if err != nil {
+                t.Fatal(err)
+        }
+        var envelope vectorClockEnvelope
+        if err := json.Unmarshal(current, &envelope); err != nil {
+                t.Fatal(err)
+        }
+        if envelope.V != vectorClockVersion || !reflect.DeepEqual(envelope.Clock, clock) {
+                t.Errorf("envelope = %+v, want version %d with %v", envelope, vectorClockVersion, clock)
+        }
+
+        // A legacy clock re-encodes to the current version without losing counters
+        decoded, err := decodeVectorClock(legacy)
+        if err != nil {
+                t.Fatal(err)
+        }
+        reencoded, err := encodeVectorClock(decoded)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if string(reencoded) != string(current) {
+                t.Errorf("re-encoded %s, want %s", reencoded, current)
+        }
+
+        if empty, _ := encodeVectorClock(nil); string(empty) != `{"v":1,"clock":{}}` {
+                t.Errorf("nil clock encoded as %s", empty)
+        }
+}
+
+// A clock of n fabricated node IDs, as a misbehaving client might send
+func fabricatedClock(prefix string, n int) map[string]int64 {
+        clock := make(map[string]int64, n)
+        for i := 0; i < n; i++ {
+                clock[fmt.Sprintf("%s-%04d", prefix, i)] = int64(i + 1)
+        }
+        return clock
+}
+
+func TestMergeRejectsClockOverNodeLimit(t *testing.T) {
+        pool := testDB(t)
+        logs := captureLog(t)
+        sessionID := insertTestSession(t, pool, map[string]interface{}{"pumps": "ok"}, map[string]int64{"tablet-north": 4})
+
+        // Learn the clock size before fabricated nodes arrive (it includes the server's node)
+        baseline, err := mergeTestPayload(t, pool, sessionID, "inspector-9", &CRDTPayload{
+                Changes: []map[string]interface{}{{"op": "set", "path": "/pumps", "value": "tested"}},
+        })
+        if err != nil {
+                t.Fatal(err)
+        }
+        withConfig(t, func(c *Config) { c.MaxVectorClockNodes = int64(len(baseline.VectorClock) + 2) })
+
+        // Two new nodes fit exactly
+        atLimit, err := mergeTestPayload(t, pool, sessionID, "inspector-9", &CRDTPayload{
+                Changes:     []map[string]interface{}{{"op": "set", "path": "/valves", "value": "open"}},
+                VectorClock: fabricatedClock("handheld", 2),
+        })
+        if err != nil {
+                t.Fatalf("merge at the limit: %v", err)
+        }
+
+        for _, n := range []int{1, 5000} {
+                _, err := mergeTestPayload(t, pool, sessionID, "inspector-9", &CRDTPayload{
+                        Changes:     []map[string]interface{}{{"op": "set", "path": "/valves", "value": "closed"}},
+                        VectorClock: fabricatedClock(fmt.Sprintf("bogus%d", n), n),
+                })
+                var mergeErr *MergeError
+                if !errors.As(err, &mergeErr) || mergeErr.StatusCode != http.StatusUnprocessableEntity {
+                        t.Fatalf("%d extra nodes: err = %v, want a 422 MergeError", n, err)
+                }
+        }
+        if !strings.Contains(logs.String(), sessionID) {
+                t.Errorf("rejection log does not name session %s: %q", sessionID, logs.String())
+        }
+
+        state, err := loadSessionState(t.Context(), sessionID)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if !reflect.DeepEqual(state.VectorClock, atLimit.VectorClock) || state.SessionData["valves"] != "open" {
+                t.Errorf("rejected merges modified the session: %v %v", state.VectorClock, state.SessionData)
+        }
+}
+
+func TestParseClockView(t *testing.T) {
+        tests := []struct {
+                name     string
+                query    string
+                header   string
+                claims   jwt.MapClaims
+                wantView string
+                wantNode string
+                wantErr  bool
+        }{
+                {"default", "", "", nil, clockViewFull, "", false},
+                {"full", "?clock=full", "", nil, clockViewFull, "", false},
+                {"delta", "?clock=delta", "", nil, clockViewDelta, "", false},
+                {"mine from header", "?clock=mine", "tablet-7", jwt.MapClaims{"node_id": "claimed"}, clockViewMine, "tablet-7", false},
+                {"mine from claim", "?clock=mine", "", jwt.MapClaims{"node_id": "tablet-8"}, clockViewMine, "tablet-8", false},
+                {"mine without node", "?clock=mine", "", nil, "", "", true},
+                {"unknown view", "?clock=diff", "", nil, "", "", true},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        r := httptest.NewRequest(http.MethodPost, "/v1/tests/sessions/s/results"+tt.query, nil)
+                        if tt.header != "" {
+                                r.Header.Set("X-Node-ID", tt.header)
+                        }
+                        if tt.claims != nil {
+                                r = r.WithContext(withClaims(r.Context(), tt.claims))
+                        }
+                        view, node, err := parseClockView(r)
+                        if (err != nil) != tt.wantErr || view != tt.wantView || node != tt.wantNode {
+                                t.Errorf("parseClockView = %q, %q, %v; want %q, %q, error %v", view, node, err, tt.wantView, tt.wantNode, tt.wantErr)
+                        }
+                })
+        }
+}
+
+func TestApplyClockViews(t *testing.T) {
+        previous := map[string]int64{"tablet-7": 3, "tablet-8": 9, "server": 40}
+        merged := map[string]int64{"tablet-7": 4, "tablet-8": 9, "server": 41, "tablet-9": 1}
+
+        tests := []struct {
+                view string
+                node string
+                want map[string]int64
+        }{
+                {clockViewFull, "", merged},
+                {clockViewMine, "tablet-8", map[string]int64{"tablet-8": 9}},
+                {clockViewMine, "tablet-unknown", map[string]int64{}},
+                {clockViewDelta, "", map[string]int64{"tablet-7": 4, "server": 41, "tablet-9": 1}},
+        }
+        for _, tt := range tests {
+                response := &CRDTResponse{VectorClock: merged, clockDelta: clockDelta(previous, merged)}
+                applyClockView(response, tt.view, tt.node)
+                if !reflect.DeepEqual(response.VectorClock, tt.want) {
+                        t.Errorf("%s(%s) = %v, want %v", tt.view, tt.node, response.VectorClock, tt.want)
+                }
+        }
+}
+
+func TestCRDTResultsClockViews(t *testing.T) {
+        pool := testDB(t)
+        userID := insertTestUser(t, pool, "clock-views")
+        sessionID := insertTestSession(t, pool, map[string]interface{}{}, map[string]int64{"tablet-a": 5, "tablet-b": 2})
+
+        post := func(query, key string, clock map[string]int64) (int, map[string]int64) {
+                body, _ := json.Marshal(CRDTPayload{
+                        Changes:        []map[string]interface{}{{"op": "set", "path": "/" + key, "value": true}},
+                        VectorClock:    clock,
+                        IdempotencyKey: key + "-" + sessionID,
+                })
+                r := httptest.NewRequest(http.MethodPost, "/v1/tests/sessions/"+sessionID+"/results"+query, bytes.NewReader(body))
+                r.Header.Set("X-User-ID", userID)
+                r.Header.Set("X-Node-ID", "tablet-b")
+                w := httptest.NewRecorder()
+                handleCRDTResults(w, mux.SetURLVars(r, map[string]string{"session_id": sessionID}))
+                var response CRDTResponse
+                json.Unmarshal(w.Body.Bytes(), &response)
+                return w.Code, response.VectorClock
+        }
+
+        status, full := post("", "full", map[string]int64{"tablet-b": 3})
+        if status != http.StatusOK || full["tablet-a"] != 5 || full["tablet-b"] != 3 {
+                t.Fatalf("full view = %d %v", status, full)
+        }
+        if _, mine := post("?clock=mine", "mine", map[string]int64{"tablet-b": 4}); !reflect.DeepEqual(mine, map[string]int64{"tablet-b": 4}) {
+                t.Errorf("mine view = %v, want only tablet-b", mine)
+        }
+        _, delta := post("?clock=delta", "delta", map[string]int64{"tablet-b": 5})
+        if delta["tablet-b"] != 5 {
+                t.Errorf("delta view = %v, want tablet-b advanced to 5", delta)
+        }
+        if _, ok := delta["tablet-a"]; ok {
+                t.Errorf("delta view = %v includes the unchanged tablet-a", delta)
+        }
+        if status, _ := post("?clock=everything", "bad", nil); status != http.StatusBadRequest {
+                t.Errorf("invalid view = %d, want 400", status)
+        }
+}
+
+func TestAdvanceServerNode(t *testing.T) {
+        tests := []struct {
+                name    string
+                node    string
+                policy  string
+                current map[string]int64
+                payload map[string]int64
+                want    map[string]int64
+                wantErr bool
+        }{
+                {"disabled", "", serverNodeMissingReject,
+                        map[string]int64{"go-1": 7}, map[string]int64{"tablet": 2},
+                        map[string]int64{"tablet": 2}, false},
+                {"omitted node keeps and advances the stored counter", "go-1", serverNodeMissingAdvance,
+                        map[string]int64{"go-1": 7, "tablet": 1}, map[string]int64{"tablet": 2},
+                        map[string]int64{"tablet": 2, "go-1": 8}, false},
+                {"payload ahead of the stored counter", "go-1", serverNodeMissingAdvance,
+                        map[string]int64{"go-1": 3}, map[string]int64{"go-1": 11},
+                        map[string]int64{"go-1": 12}, false},
+                {"first write starts the node", "go-1", serverNodeMissingReject,
+                        map[string]int64{}, map[string]int64{"tablet": 1},
+                        map[string]int64{"tablet": 1, "go-1": 1}, false},
+                {"omitted node rejected once tracked", "go-1", serverNodeMissingReject,
+                        map[string]int64{"go-1": 4}, map[string]int64{"tablet": 5},
+                        map[string]int64{"tablet": 5}, true},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        withConfig(t, func(c *Config) {
+                                c.ServerNodeID = tt.node
+                                c.ServerNodeMissingPolicy = tt.policy
+                        })
+                        merged := map[string]int64{}
+                        for node, counter := range tt.payload {
+                                merged[node] = counter
+                        }
+                        err := advanceServerNode(merged, tt.current, tt.payload)
+                        if (err != nil) != tt.wantErr || !reflect.DeepEqual(merged, tt.want) {
+                                t.Errorf("merged = %v, err = %v; want %v, error %v", merged, err, tt.want, tt.wantErr)
+                        }
+                })
+        }
+}
+
+func TestMergeWithoutServerNodePreservesIt(t *testing.T) {
+        pool := testDB(t)
+        withConfig(t, func(c *Config) {
+                c.ServerNodeID = "go-eu-2"
+                c.ServerNodeMissingPolicy = serverNodeMissingAdvance
+        })
+        sessionID := insertTestSession(t, pool, map[string]interface{}{"hose_reel": "untested"},
+                map[string]int64{"go-eu-2": 41, "tablet-west": 3})
+
+        // An older client that does not know about the server's node
+        response, err := mergeTestPayload(t, pool, sessionID, "inspector-12", &CRDTPayload{
+                Changes:     []map[string]interface{}{{"op": "set", "path": "/hose_reel", "value": "passed"}},
+                VectorClock: map[string]int64{"tablet-west": 4},
+        })
+        if err != nil {
+                t.Fatal(err)
+        }
+        if response.VectorClock["go-eu-2"] != 42 || response.VectorClock["tablet-west"] != 4 {
+                t.Errorf("clock = %v, want go-eu-2 advanced from 41 to 42", response.VectorClock)
+        }
+
+        state, err := loadSessionState(t.Context(), sessionID)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if state.VectorClock["go-eu-2"] != 42 {
+                t.Errorf("stored clock = %v, want go-eu-2 at 42", state.VectorClock)
+        }
+
+        // Under the reject policy the same payload is refused with 409
+        cfg.ServerNodeMissingPolicy = serverNodeMissingReject
+        _, err = mergeTestPayload(t, pool, sessionID, "inspector-12", &CRDTPayload{
+                Changes:     []map[string]interface{}{{"op": "set", "path": "/hose_reel", "value": "failed"}},
+                VectorClock: map[string]int64{"tablet-west": 5},
+        })
+        var mergeErr *MergeError
+        if !errors.As(err, &mergeErr) || mergeErr.StatusCode != http.StatusConflict {
+                t.Errorf("err = %v, want a 409 MergeError", err)
+        }
+}
+
+func TestMissingDependencies(t *testing.T) {
+        tests := []struct {
+                name           string
+                stored, client map[string]int64
+                want           map[string]int64
+        }{
+                {"client behind", map[string]int64{"tablet-a": 6, "tablet-b": 2}, map[string]int64{"tablet-a": 4, "tablet-b": 2},
+                        map[string]int64{"tablet-a": 6}},
+                {"concurrent", map[string]int64{"tablet-a": 6, "tablet-b": 2}, map[string]int64{"tablet-a": 7, "tablet-c": 1},
+                        map[string]int64{"tablet-b": 2}},
+                {"client ahead", map[string]int64{"tablet-a": 6}, map[string]int64{"tablet-a": 6, "tablet-b": 1}, nil},
+                {"new session", nil, map[string]int64{"tablet-a": 1}, nil},
+                {"empty client clock", map[string]int64{"tablet-a": 3, "tablet-b": 8}, nil,
+                        map[string]int64{"tablet-a": 3, "tablet-b": 8}},
+        }
+        for _, tt := range tests {
+                if got := missingDependencies(tt.stored, tt.client); !reflect.DeepEqual(got, tt.want) {
+                        t.Errorf("%s: missing = %v, want %v", tt.name, got, tt.want)
+                }
+        }
+}
+
+func TestMergeReportsMissingDependencies(t *testing.T) {
+        pool := testDB(t)
+        withConfig(t, func(c *Config) { c.ServerNodeID = "" })
+        sessionID := insertTestSession(t, pool, map[string]interface{}{"damper_3": "closed"},
+                map[string]int64{"tablet-lobby": 8, "tablet-roof": 3})
+
+        // A client that has not seen the lobby tablet's last five updates
+        behind, err := mergeTestPayload(t, pool, sessionID, "inspector-70", &CRDTPayload{
+                Changes:     []map[string]interface{}{{"op": "set", "path": "/damper_4", "value": "open"}},
+                VectorClock: map[string]int64{"tablet-lobby": 3, "tablet-roof": 3, "tablet-stair": 1},
+        })
+        if err != nil {
+                t.Fatal(err)
+        }
+        if want := map[string]int64{"tablet-lobby": 8}; !reflect.DeepEqual(behind.MissingDependencies, want) {
+                t.Errorf("missing_dependencies = %v, want %v", behind.MissingDependencies, want)
+        }
+
+        // A client that has seen everything gets no missing_dependencies at all
+        upToDate, err := mergeTestPayload(t, pool, sessionID, "inspector-70", &CRDTPayload{
+                Changes:     []map[string]interface{}{{"op": "set", "path": "/damper_5", "value": "open"}},
+                VectorClock: behind.VectorClock,
+        })
+        if err != nil {
+                t.Fatal(err)
+        }
+        encoded, _ := json.Marshal(upToDate)
+        if upToDate.MissingDependencies != nil || bytes.Contains(encoded, []byte("missing_dependencies")) {
+                t.Errorf("response = %s, want missing_dependencies omitted", encoded)
+        }
+}
+
+func TestValidateVectorClockCounters(t *testing.T) {
+        withConfig(t, func(c *Config) { c.MaxVectorClockCounter = 1<<53 - 1 })
+        tests := []struct {
+                name    string
+                clock   map[string]int64
+                limit   int64
+                wantErr string
+        }{
+                {"empty", nil, 1<<53 - 1, ""},
+                {"large but exact", map[string]int64{"tablet-atrium": 1 << 52}, 1<<53 - 1, ""},
+                {"at ceiling", map[string]int64{"tablet-atrium": 1<<53 - 1}, 1<<53 - 1, ""},
+                {"over ceiling", map[string]int64{"tablet-atrium": 1 << 53}, 1<<53 - 1, `"tablet-atrium" exceeds`},
+                {"negative", map[string]int64{"tablet-garage": -1}, 1<<53 - 1, `"tablet-garage" is negative`},
+                {"unlimited", map[string]int64{"tablet-garage": 1<<63 - 1}, 0, ""},
+                {"custom ceiling", map[string]int64{"tablet-garage": 1001}, 1000, "exceeds 1000"},
+        }
+        for _, tt := range tests {
+                cfg.MaxVectorClockCounter = tt.limit
+                err := validateVectorClockCounters(tt.clock)
+                if tt.wantErr == "" && err != nil {
+                        t.Errorf("%s: unexpected error %v", tt.name, err)
+                }
+                if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+                        t.Errorf("%s: err = %v, want one containing %q", tt.name, err, tt.wantErr)
+                }
+        }
+}
+
+func TestOverCeilingCounterRejected(t *testing.T) {
+        withConfig(t, func(c *Config) { c.MaxVectorClockCounter = 1<<53 - 1 })
+        body := []byte(`{"idempotency_key":"ceiling-1","changes":[{"op":"set","path":"/sprinkler_head","value":"ok"}],` +
+                `"vector_clock":{"tablet-plant-room":9007199254740993}}`)
+        w := postCRDTResults(t, "session-ceiling", body, http.Header{"X-User-Id": {"inspector-88"}})
+        if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "tablet-plant-room") {
+                t.Errorf("status = %d %q, want 422 naming the node", w.Code, w.Body.String())
+        }
+}
+
+func TestMergeAcceptsLargeCounter(t *testing.T) {
+        pool := testDB(t)
+        withConfig(t, func(c *Config) {
+                c.ServerNodeID = ""
+                c.MaxVectorClockCounter = 1<<53 - 1
+        })
+        sessionID := insertTestSession(t, pool, map[string]interface{}{"riser_2": "untested"},
+                map[string]int64{"tablet-basement": 7})
+
+        // Past int32 range but below the ceiling, so it must survive exactly
+        const large = int64(1)<<40 + 17
+        response, err := mergeTestPayload(t, pool, sessionID, "inspector-88", &CRDTPayload{
+                Changes:     []map[string]interface{}{{"op": "set", "path": "/riser_2", "value": "passed"}},
+                VectorClock: map[string]int64{"tablet-basement": 7, "tablet-mezzanine": large},
+        })
+        if err != nil {
+                t.Fatal(err)
+        }
+        if response.VectorClock["tablet-mezzanine"] != large {
+                t.Errorf("clock = %v, want tablet-mezzanine at %d", response.VectorClock, large)
+        }
+        state, err := loadSessionState(t.Context(), sessionID)
+        if err != nil {
+                t.Fatal(err)
+        }
+        if state.VectorClock["tablet-mezzanine"] != large {
+                t.Errorf("stored clock = %v, want tablet-mezzanine at %d", state.VectorClock, large)
+        }
+}
+
+func TestBatchItemOverCeilingRejected(t *testing.T) {
+        withConfig(t, func(c *Config) { c.MaxVectorClockCounter = 1000 })
+        item := &CRDTPayload{
+                Changes:     []map[string]interface{}{{"op": "set", "path": "/riser_2", "value": "failed"}},
+                VectorClock: map[string]int64{"tablet-mezzanine": 1001},
+        }
+        _, err := applyBatchItem(t.Context(), "session-ceiling", "inspector-88", "sync-ceiling", "", 0, item, "")
+        var mergeErr *MergeError
+        if !errors.As(err, &mergeErr) || mergeErr.StatusCode != http.StatusUnprocessableEntity {
+                t.Errorf("err = %v, want a 422 MergeError", err)
+        }
+}
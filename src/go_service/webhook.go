@@ -0,0 +1,58 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "encoding/json"
+        "fmt"
+        "net/http"
+        "time"
+)
+
+// Event posted to EVIDENCE_WEBHOOK_URL after an evidence upload commits
+type EvidenceEvent struct {
+        Event        string    `json:"event"`
+        EvidenceID   string    `json:"evidence_id"`
+        SessionID    string    `json:"session_id"`
+        EvidenceType string    `json:"evidence_type"`
+        Checksum     string    `json:"checksum"`
+        UploadedBy   string    `json:"uploaded_by"`
+        OccurredAt   time.Time `json:"occurred_at"`
+}
+
+// Event posted to SESSION_WEBHOOK_URL after a CRDT merge commits
+type SessionUpdatedEvent struct {
+        Event       string           `json:"event"`
+        SessionID   string           `json:"session_id"`
+        VectorClock map[string]int64 `json:"vector_clock"`
+        OccurredAt  time.Time        `json:"occurred_at"`
+}
+
+var webhookClient = &http.Client{}
+
+// Post an event to a webhook, treating any non-2xx status as failure
+func postWebhook(ctx context.Context, url string, event interface{}) error {
+        body, err := json.Marshal(event)
+        if err != nil {
+                return err
+        }
+
+        ctx, cancel := context.WithTimeout(ctx, cfg.WebhookTimeout)
+        defer cancel()
+
+        req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+        if err != nil {
+                return err
+        }
+        req.Header.Set("Content-Type", "application/json")
+
+        resp, err := webhookClient.Do(req)
+        if err != nil {
+                return err
+        }
+        resp.Body.Close()
+        if resp.StatusCode < 200 || resp.StatusCode > 299 {
+                return fmt.Errorf("webhook returned %s", resp.Status)
+        }
+        return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+        "context"
+        "log"
+        "sync"
+)
+
+// A unit of background work; ctx is cancelled when the pool shuts down
+type Job func(ctx context.Context)
+
+// Fixed-size pool of goroutines draining a bounded job queue, for post-response
+// work that must not hold up the request
+type WorkerPool struct {
+        jobs   chan Job
+        wg     sync.WaitGroup
+        cancel context.CancelFunc
+}
+
+var workerPool *WorkerPool
+
+// Start a pool of size workers with a queue of queueSize pending jobs
+func NewWorkerPool(size, queueSize int) *WorkerPool {
+        if size < 1 {
+                size = 1
+        }
+        ctx, cancel := context.WithCancel(context.Background())
+        p := &WorkerPool{jobs: make(chan Job, queueSize), cancel: cancel}
+        for i := 0; i < size; i++ {
+                p.wg.Add(1)
+                go p.run(ctx)
+        }
+        return p
+}
+
+func (p *WorkerPool) run(ctx context.Context) {
+        defer p.wg.Done()
+        for job := range p.jobs {
+                p.safely(ctx, job)
+        }
+}
+
+// Run a job, containing panics so one bad job cannot take down a worker
+func (p *WorkerPool) safely(ctx context.Context, job Job) {
+        defer func() {
+                if r := recover(); r != nil {
+                        log.Printf("Worker job panicked: %v", r)
+                }
+        }()
+        job(ctx)
+}
+
+// Queue a job without blocking. Returns false if the queue is full.
+func (p *WorkerPool) Submit(job Job) bool {
+        select {
+        case p.jobs <- job:
+                return true
+        default:
+                return false
+        }
+}
+
+// Stop accepting jobs, cancel running ones and wait for workers to exit
+func (p *WorkerPool) Close() {
+        close(p.jobs)
+        p.cancel()
+        p.wg.Wait()
+}